@@ -20,11 +20,8 @@ func main() {
 		"version")
 	showVersionAndExitShort := common.CmdEnvBool("Show version and exit.", false,
 		"v")
-
-	configuration, err := client.ParseConfiguration("/etc/nocc/daemon.conf")
-	if err != nil {
-		failedStartDaemon("Failed to parse configuration: " + err.Error())
-	}
+	configFileName := common.CmdEnvString("A configuration file.", "/etc/nocc/daemon.conf",
+		"NOCC_CONFIG", "config")
 
 	common.ParseCmdFlagsCombiningWithEnv()
 
@@ -33,11 +30,20 @@ func main() {
 		os.Exit(0)
 	}
 
+	configuration, err := client.ParseConfiguration(*configFileName)
+	if err != nil {
+		failedStartDaemon("Failed to parse configuration: " + err.Error())
+	}
+
 	if err := client.MakeLoggerClient(configuration); err != nil {
 		failedStartDaemon(err)
 	}
 
-	daemon, err := client.MakeDaemon(configuration)
+	if err := client.MakeTracerClient(configuration); err != nil {
+		failedStartDaemon(err)
+	}
+
+	daemon, err := client.MakeDaemon(configuration, *configFileName)
 	if err != nil {
 		failedStartDaemon(err)
 	}
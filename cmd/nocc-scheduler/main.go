@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/internal/scheduler"
+	"nocc/pb"
+
+	"google.golang.org/grpc"
+)
+
+func failedStart(message string, err error) {
+	_, _ = fmt.Fprintln(os.Stderr, fmt.Sprint("failed to start nocc-scheduler: ", message, ": ", err))
+	os.Exit(1)
+}
+
+func main() {
+	showVersionAndExit := common.CmdEnvBool("Show version and exit", false,
+		"version")
+	showVersionAndExitShort := common.CmdEnvBool("Show version and exit", false,
+		"v")
+	listenAddr := common.CmdEnvString("An address to listen for daemons on.", "0.0.0.0:43220",
+		"NOCC_SCHEDULER_LISTEN_ADDR", "listen-addr")
+	pollInterval := common.CmdEnvInt("Milliseconds between polling Status of servers.", 1000,
+		"NOCC_SCHEDULER_POLL_INTERVAL", "poll-interval")
+	largeCppSize := common.CmdEnvInt("A .cpp of that size (in bytes) or more goes to the least loaded server.", 64*1024,
+		"NOCC_SCHEDULER_LARGE_CPP_SIZE", "large-cpp-size")
+	logFileName := common.CmdEnvString("A filename to log, stderr by default.", "stderr",
+		"NOCC_SCHEDULER_LOG_FILENAME", "log-filename")
+	logLevel := common.CmdEnvInt("Logger verbosity level for INFO (-1 off, 0, 1, 2).", 0,
+		"NOCC_SCHEDULER_LOG_LEVEL", "log-level")
+
+	common.ParseCmdFlagsCombiningWithEnv()
+
+	if *showVersionAndExit || *showVersionAndExitShort {
+		fmt.Println(common.GetVersion())
+		os.Exit(0)
+	}
+
+	if *pollInterval <= 0 {
+		failedStart("Invalid -poll-interval", fmt.Errorf("must be positive"))
+	}
+
+	if err := scheduler.MakeLoggerScheduler(*logFileName, *logLevel); err != nil {
+		failedStart("Can't init logger", err)
+	}
+
+	listener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		failedStart("Failed to listen", err)
+	}
+
+	s := scheduler.MakeScheduler(time.Duration(*pollInterval)*time.Millisecond, int64(*largeCppSize))
+	grpcServer := grpc.NewServer()
+	pb.RegisterSchedulerServiceServer(grpcServer, s)
+	go s.StartPolling()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		grpcServer.GracefulStop()
+	}()
+
+	fmt.Printf("nocc-scheduler %s started successfully, listening %s\n", common.GetVersion(), *listenAddr)
+
+	if err = grpcServer.Serve(listener); err != nil {
+		failedStart("Failed to serve", err)
+	}
+
+	nServers, nPlaced, nNoOpinion := s.GetStats()
+	fmt.Printf("nocc-scheduler stopped: %d servers known, %d placements, %d requests without an opinion\n", nServers, nPlaced, nNoOpinion)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nocc/internal/server"
+	"nocc/pb"
+)
+
+const adminTimeout = 30 * time.Second // purging a large cache walks all its files
+
+// runAdminCommand handles `nocc-server -admin {command} [args]`, calling AdminService of a server running on this machine:
+//
+//	stats                      cache sizes, hit rates and namespaces
+//	top [N]                    the largest N files of every cache (20 by default)
+//	purge [cache=src|obj] [key=hexPrefix] [older=24h] [namespace=ns] [all]
+//	evict                      evict over limits now, as a cron does every 5 seconds
+func runAdminCommand(configuration *Configuration, socketPath string, command string, args []string) int {
+	if socketPath == "" {
+		socketPath = configuration.AdminSocket
+	}
+	client, closeConnection, err := server.DialAdminSocket(socketPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "admin:", err)
+		return 1
+	}
+	defer closeConnection()
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+	defer cancel()
+
+	switch command {
+	case "stats", "top":
+		request := &pb.CacheStatsRequest{}
+		if command == "top" {
+			request.TopEntries = 20
+			if len(args) != 0 {
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n <= 0 {
+					_, _ = fmt.Fprintln(os.Stderr, "admin: invalid number of files", args[0])
+					return 1
+				}
+				request.TopEntries = int32(n)
+			}
+		}
+		reply, err := client.CacheStats(ctx, request)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "admin:", err)
+			return 1
+		}
+		printAdminCacheStats(reply)
+
+	case "purge":
+		request, err := parseAdminPurgeArgs(args)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "admin:", err)
+			return 1
+		}
+		reply, err := client.PurgeCache(ctx, request)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "admin:", err)
+			return 1
+		}
+		fmt.Printf("purged %d files, %d bytes\n", reply.FilesCount, reply.BytesFreed)
+
+	case "evict":
+		reply, err := client.EvictCache(ctx, &pb.EvictCacheRequest{})
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "admin:", err)
+			return 1
+		}
+		fmt.Printf("evicted %d files, %d bytes\n", reply.FilesCount, reply.BytesFreed)
+
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "admin: unknown command %q, expected stats, top, purge or evict\n", command)
+		return 1
+	}
+	return 0
+}
+
+func parseAdminPurgeArgs(args []string) (*pb.PurgeCacheRequest, error) {
+	request := &pb.PurgeCacheRequest{}
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "cache":
+			request.Cache = value
+		case "key":
+			request.KeyPrefix = value
+		case "older":
+			olderThan, err := time.ParseDuration(value)
+			if err != nil || olderThan <= 0 {
+				return nil, fmt.Errorf("invalid duration %q, expected like 24h", value)
+			}
+			request.OlderThanSec = int64(olderThan.Seconds())
+		case "namespace":
+			request.Namespace = value
+		case "all":
+			request.All = true
+		default:
+			return nil, fmt.Errorf("unknown purge argument %q", arg)
+		}
+	}
+	return request, nil
+}
+
+func printAdminCacheStats(reply *pb.CacheStatsReply) {
+	for _, cache := range reply.Caches {
+		fmt.Printf("%s cache: %d files, %d bytes of %d, %s free on disk\n", cache.Cache, cache.FilesCount, cache.BytesOnDisk, cache.Limit, formatFreeDisk(cache.FreeDisk))
+		fmt.Printf("  hits %d, misses %d, purged %d, the least recently used accessed %s ago\n", cache.Hits, cache.Misses, cache.Purged, time.Duration(cache.OldestAccessSec)*time.Second)
+		for _, ns := range cache.Namespaces {
+			fmt.Printf("  namespace %s: %d files, %d bytes", ns.Namespace, ns.FilesCount, ns.BytesOnDisk)
+			if ns.Limit > 0 {
+				fmt.Printf(" of %d", ns.Limit)
+			}
+			fmt.Println()
+		}
+		for _, entry := range cache.TopEntries {
+			fmt.Printf("  %12d  %s  %-40s accessed %s ago %s\n", entry.FileSize, entry.Key, entry.Name, time.Duration(entry.LastAccessSec)*time.Second, entry.Namespace)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"runtime"
 
+	"nocc/internal/common"
+	"nocc/internal/server"
+
 	"github.com/BurntSushi/toml"
 )
 
@@ -11,11 +14,61 @@ type Configuration struct {
 	CompilerQueueSize int
 	LogFileName       string
 	LogLevel          int
+	LogMaxFieldLength int
+	LogMaxLineLength  int
+	LogFullFieldsDir  string
 	SrcCacheDir       string
 	ObjCacheDir       string
 	SrcCacheSize      int64
 	ObjCacheSize      int64
 	CompilerDirs      []string
+	TracingEndpoint   string
+	DashboardAddr     string
+	CapacitySchedule  []server.CapacityWindow
+	CompilerMismatch  string // ignore / warn / refuse, see server.CompilerMismatchPolicy
+	StrictObjTarget   bool
+	ExtraCompilerArgs []string
+	SessionTimeout    int // seconds, 0 means no limit
+	ClientRetention   int // seconds, 0 means a working dir is deleted when a client stops
+	RemapDebugPaths   bool
+	CacheTiers        []string // cache servers to push heavy objects to, see server.ObjCacheReplicator
+	CachePushMinTime  int      // milliseconds, objects compiled faster are not pushed
+	Provenance        bool     // record who compiled every .o, see server.ProvenanceRecorder
+	ProvenanceName    string   // this server in provenance, a hostname by default
+	ProvenanceKey     string   // a PEM file with an ed25519 private key to sign provenance, unsigned if empty
+
+	ReservedSlots map[string]int // a priority class ("interactive", "default", "batch") to compiler slots kept for it, see server.CompilerLauncher
+
+	AdaptiveCapacity      bool  // scale compilers by a load average and free memory within CompilerQueueSize, see server.AdaptiveCapacity
+	AdaptiveMinQueueSize  int   // never fewer compilers than this
+	AdaptiveMinFreeMemory int64 // bytes, below it new sessions are refused as busy
+
+	MinFreeDiskSpace      int64 // bytes on disks of caches, below it cache files are evicted, see server.DiskWatchdog
+	CriticalFreeDiskSpace int64 // bytes, below it new sessions are refused as busy
+
+	CaseInsensitiveTargets []string // like ["mingw"], see server.NoccServer.CaseInsensitiveTargets
+
+	ObjCacheNamespaceLimits     map[string]int64 // a cache namespace to bytes of obj cache it may take, see server.FileCache.PurgeNamespace
+	ObjCacheNamespaceByCompiler bool             // sessions without a project namespace are accounted by a compiler
+
+	CompilerCPUs string // like "2-15,18", see server.CompilerCPUs
+	PinCompilers bool   // pin every compiler to a single cpu of CompilerCPUs
+
+	SystemHeaderDirs []string          // like ["/usr/include"], not uploaded by clients having the same, see server.SystemHeaders
+	Snapshots        map[string]string // a name to a manifest file (an output of sha256sum), see server.Snapshots
+
+	PipelinedUploadsMinBytes int64 // a session uploading more starts compiling before uploads finish, see server.PipelinedUploads
+
+	OnDemandIncludes bool // clients may serve includes over a FUSE root instead of uploading them, see server.OnDemandIncludes
+
+	AcceptClientToolchains bool   // launch compilers uploaded by clients (UploadToolchain), see server.ClientToolchains
+	ClientToolchainsUids   string // like "1000000-1065535", every client gets an own unprivileged uid from it
+	ClientToolchainsUser   string // an unprivileged user to launch them as if ClientToolchainsUids is empty
+
+	AdminSocket string // a unix socket for `nocc-server -admin`, see server.AdminService
+
+	MDNSAnnounce bool   // answer mDNS queries, so that daemons with "mdns:" in Servers find this server, see server.MDNSAnnouncer
+	MDNSService  string // like "_nocc._tcp", to keep several clusters on one LAN apart
 }
 
 func ParseConfiguration(filePath string) (*Configuration, error) {
@@ -24,10 +77,23 @@ func ParseConfiguration(filePath string) (*Configuration, error) {
 		CompilerQueueSize: runtime.NumCPU(),
 		LogFileName:       "stderr",
 		LogLevel:          0,
+		LogMaxFieldLength: 4096,
+		LogMaxLineLength:  32768,
 		SrcCacheDir:       "/var/tmp/nocc/cpp",
 		ObjCacheDir:       "/var/tmp/nocc/obj",
 		SrcCacheSize:      8 * 1024 * 1024 * 1024,
 		ObjCacheSize:      4 * 1024 * 1024 * 1024,
+		CompilerMismatch:  "warn",
+		SessionTimeout:    20 * 60, // 20 minutes, longer than a client InvocationTimeout by default
+		ClientRetention:   5 * 60,
+		CachePushMinTime:  1000,
+		MDNSService:       common.DefaultMDNSService,
+
+		ClientToolchainsUids: "1000000-1065535",
+		ClientToolchainsUser: "nobody",
+
+		AdaptiveMinQueueSize:  1,
+		AdaptiveMinFreeMemory: 1024 * 1024 * 1024,
 	}
 	if _, err := toml.DecodeFile(filePath, &config); err != nil {
 		return nil, err
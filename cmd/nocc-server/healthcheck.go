@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"nocc/internal/server"
+)
+
+const healthcheckTimeout = 3 * time.Second
+
+// runHealthcheck handles `nocc-server -healthcheck`: it queries Status of a running server and prints it.
+// An exit code is 0 if a server responded, so it can be a liveness probe (of Kubernetes, consul, etc.).
+func runHealthcheck(configuration *Configuration, addr string) int {
+	if addr == "" {
+		if len(configuration.ListenAddr) == 0 {
+			_, _ = fmt.Fprintln(os.Stderr, "unhealthy: ListenAddr is empty, set -healthcheck-addr")
+			return 1
+		}
+		addr = configuration.ListenAddr[0]
+	}
+
+	reply, err := server.QueryStatus(addr, healthcheckTimeout)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		return 1
+	}
+
+	fmt.Printf("ok: nocc-server %s, uptime %s\n", reply.ServerVersion, time.Duration(reply.UptimeSec)*time.Second)
+	fmt.Printf("compilers: %d running, %d waiting, %d slots\n", reply.CompilersRunning, reply.CompilersWaiting, reply.CompilerQueueSize)
+	fmt.Printf("clients: %d\n", reply.ActiveClients)
+	fmt.Printf("src cache: %d bytes, %s free on disk\n", reply.SrcCacheBytes, formatFreeDisk(reply.SrcCacheFreeDisk))
+	fmt.Printf("obj cache: %d bytes, %s free on disk\n", reply.ObjCacheBytes, formatFreeDisk(reply.ObjCacheFreeDisk))
+	if reply.CacheOnly {
+		fmt.Println("cache only")
+	}
+	if reply.CacheDegraded {
+		fmt.Println("degraded: fails to save to its caches, see its log")
+	}
+	return 0
+}
+
+func formatFreeDisk(freeBytes int64) string {
+	if freeBytes < 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d bytes", freeBytes)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"path"
@@ -47,12 +48,25 @@ func prepareEmptyDir(parentDir string, subdir string) string {
 func main() {
 	var err error
 
+	if len(os.Args) >= 2 && os.Args[1] == server.OnDemandExecArg {
+		server.ExecInOnDemandRoot(os.Args[2:])
+	}
+
 	showVersionAndExit := common.CmdEnvBool("Show version and exit", false,
 		"version")
 	showVersionAndExitShort := common.CmdEnvBool("Show version and exit", false,
 		"v")
+	healthcheckAndExit := common.CmdEnvBool("Query Status of a running nocc-server and exit, 0 if it responds (for liveness probes)", false,
+		"healthcheck")
+	healthcheckAddr := common.CmdEnvString("An address to query with -healthcheck, the first ListenAddr by default.", "",
+		"NOCC_HEALTHCHECK_ADDR", "healthcheck-addr")
+	adminCommand := common.CmdEnvString("Call AdminService of a running nocc-server and exit: stats, top, purge or evict (see docs).", "",
+		"", "admin")
+	adminSocket := common.CmdEnvString("A socket to call with -admin, AdminSocket of a config by default.", "",
+		"NOCC_ADMIN_SOCKET", "admin-socket")
 
-	configuration, err := ParseConfiguration("/etc/nocc/server.conf")
+	const configFileName = "/etc/nocc/server.conf"
+	configuration, err := ParseConfiguration(configFileName)
 	if err != nil {
 		failedStart("Failed to parse configuration", err)
 	}
@@ -64,32 +78,155 @@ func main() {
 		os.Exit(0)
 	}
 
-	if err = server.MakeLoggerServer(configuration.LogFileName, configuration.LogLevel); err != nil {
+	if *healthcheckAndExit {
+		os.Exit(runHealthcheck(configuration, *healthcheckAddr))
+	}
+
+	if *adminCommand != "" {
+		os.Exit(runAdminCommand(configuration, *adminSocket, *adminCommand, flag.Args()))
+	}
+
+	if err = server.MakeLoggerServer(configuration.LogFileName, configuration.LogLevel, configuration.LogMaxFieldLength, configuration.LogMaxLineLength, configuration.LogFullFieldsDir); err != nil {
 		failedStart("Can't init logger", err)
 	}
 
-	s := &server.NoccServer{}
+	if err = server.MakeTracerServer(configuration.TracingEndpoint); err != nil {
+		failedStart("Can't init tracer", err)
+	}
+
+	s := &server.NoccServer{StartTime: time.Now()}
 
-	s.ActiveClients, err = server.MakeClientsStorage(configuration.CompilerDirs, configuration.SrcCacheDir, configuration.ObjCacheDir)
+	s.ActiveClients, err = server.MakeClientsStorage(configuration.CompilerDirs, configuration.SrcCacheDir, configuration.ObjCacheDir, configuration.SystemHeaderDirs)
 	if err != nil {
 		failedStart("Failed to init clients hashtable", err)
 	}
 
-	s.CompilerLauncher, err = server.MakeCompilerLauncher(configuration.CompilerQueueSize)
+	s.SystemHeaders, err = server.MakeSystemHeaders(configuration.SystemHeaderDirs)
+	if err != nil {
+		failedStart("Failed to init system headers", err)
+	}
+
+	s.CapacitySchedule, err = server.MakeCapacitySchedule(configuration.CompilerQueueSize, configuration.CapacitySchedule)
+	if err != nil {
+		failedStart("Failed to parse CapacitySchedule", err)
+	}
+	s.CacheOnly = configuration.CompilerQueueSize == 0
+	if s.CacheOnly && len(configuration.CapacitySchedule) != 0 {
+		failedStart("Failed to parse CapacitySchedule", fmt.Errorf("a cache server (CompilerQueueSize = 0) doesn't compile"))
+	}
+	reservedSlots := configuration.ReservedSlots
+	if !s.CacheOnly {
+		if err := server.CheckReservedSlots(reservedSlots, configuration.CompilerQueueSize); err != nil {
+			failedStart("Failed to parse ReservedSlots", err)
+		}
+	}
+
+	s.ReadCapacitySchedule = func() (*server.CapacitySchedule, error) {
+		configuration, err := ParseConfiguration(configFileName)
+		if err != nil {
+			return nil, err
+		}
+		if (configuration.CompilerQueueSize == 0) != s.CacheOnly {
+			return nil, fmt.Errorf("CompilerQueueSize can't be changed from/to 0 without a restart")
+		}
+		if configuration.CompilerQueueSize < 0 {
+			return nil, fmt.Errorf("invalid CompilerQueueSize %d", configuration.CompilerQueueSize)
+		}
+		if !s.CacheOnly {
+			if err := server.CheckReservedSlots(reservedSlots, configuration.CompilerQueueSize); err != nil {
+				return nil, fmt.Errorf("%v (ReservedSlots need a restart to change)", err)
+			}
+		}
+		return server.MakeCapacitySchedule(configuration.CompilerQueueSize, configuration.CapacitySchedule)
+	}
+
+	s.AdaptiveCapacity, err = server.MakeAdaptiveCapacity(configuration.AdaptiveCapacity && !s.CacheOnly, configuration.AdaptiveMinQueueSize, configuration.AdaptiveMinFreeMemory)
+	if err != nil {
+		failedStart("Failed to init adaptive capacity", err)
+	}
+
+	s.CompilerLauncher, err = server.MakeCompilerLauncher(s.CapacitySchedule.CapacityAt(time.Now()), configuration.ExtraCompilerArgs, reservedSlots)
 	if err != nil {
 		failedStart("Failed to init compiler launcher", err)
 	}
+	s.CompilerLauncher.CPUs, err = server.MakeCompilerCPUs(configuration.CompilerCPUs, configuration.PinCompilers)
+	if err != nil {
+		failedStart("Failed to parse CompilerCPUs", err)
+	}
+	s.CompilerLauncher.ClientToolchains, err = server.MakeClientToolchains(configuration.AcceptClientToolchains, configuration.ClientToolchainsUids, configuration.ClientToolchainsUser)
+	if err != nil {
+		failedStart("Failed to init ClientToolchainsUids", err)
+	}
+
+	s.PipelinedUploads, err = server.MakePipelinedUploads(configuration.PipelinedUploadsMinBytes)
+	if err != nil {
+		failedStart("Failed to init pipelined uploads", err)
+	}
 
 	s.SrcFileCache, err = server.MakeSrcFileCache(prepareEmptyDir(configuration.SrcCacheDir, "src-cache"), configuration.SrcCacheSize)
 	if err != nil {
 		failedStart("Failed to init src file cache", err)
 	}
 
+	if configuration.OnDemandIncludes {
+		s.OnDemandIncludes, err = server.MakeOnDemandIncludes(path.Join(configuration.SrcCacheDir, "on-demand"), s.SrcFileCache)
+		if err != nil {
+			failedStart("Failed to init on-demand includes", err)
+		}
+	}
+
+	if len(configuration.Snapshots) != 0 {
+		s.Snapshots, err = server.MakeSnapshots(configuration.Snapshots, prepareEmptyDir(configuration.SrcCacheDir, "snapshots"))
+		if err != nil {
+			failedStart("Failed to load snapshots", err)
+		}
+	}
+
 	s.ObjFileCache, err = server.MakeObjFileCache(prepareEmptyDir(configuration.ObjCacheDir, "obj-cache"), prepareEmptyDir(configuration.ObjCacheDir, "compiler-out"), configuration.ObjCacheSize)
 	if err != nil {
 		failedStart("Failed to init obj file cache", err)
 	}
 
+	s.ObjFileCache.NamespaceLimits = configuration.ObjCacheNamespaceLimits
+	s.ObjCacheNamespaceByCompiler = configuration.ObjCacheNamespaceByCompiler
+
+	s.DiskWatchdog, err = server.MakeDiskWatchdog(configuration.MinFreeDiskSpace, configuration.CriticalFreeDiskSpace, s.SrcFileCache.FileCache, s.ObjFileCache.FileCache)
+	if err != nil {
+		failedStart("Failed to init disk watchdog", err)
+	}
+
+	if len(configuration.CacheTiers) != 0 {
+		s.ObjFileCache.Replicator, err = server.MakeObjCacheReplicator(s.ObjFileCache, configuration.CacheTiers, time.Duration(configuration.CachePushMinTime)*time.Millisecond)
+		if err != nil {
+			failedStart("Failed to init cache tiers", err)
+		}
+	}
+
+	compilerMismatchPolicy, err := server.ParseCompilerMismatchPolicy(configuration.CompilerMismatch)
+	if err != nil {
+		failedStart("Failed to parse CompilerMismatch", err)
+	}
+	compilerProbesRoot := ""
+	if !s.CacheOnly { // a cache server doesn't probe compilers, it has none
+		compilerProbesRoot, err = s.ActiveClients.PrepareCompilerProbesRoot()
+		if err != nil {
+			failedStart("Failed to prepare a root for compiler probes", err)
+		}
+	}
+	s.CompilerProbes = server.MakeCompilerProbes(compilerMismatchPolicy, configuration.CompilerDirs, compilerProbesRoot)
+	if configuration.Provenance {
+		s.ObjFileCache.Provenance, err = server.MakeProvenanceRecorder(configuration.ProvenanceName, configuration.ProvenanceKey, s.CompilerProbes)
+		if err != nil {
+			failedStart("Failed to init provenance", err)
+		}
+	}
+	s.StrictObjTarget = configuration.StrictObjTarget
+	s.SessionTimeout = time.Duration(configuration.SessionTimeout) * time.Second
+	s.ClientRetention = time.Duration(configuration.ClientRetention) * time.Second
+	s.RemapDebugPaths = configuration.RemapDebugPaths
+	s.CaseInsensitiveTargets = configuration.CaseInsensitiveTargets
+	s.BuildSummaries = server.MakeBuildSummaries()
+
 	s.GRPCServer = grpc.NewServer()
 	pb.RegisterCompilationServiceServer(s.GRPCServer, s)
 
@@ -99,6 +236,27 @@ func main() {
 	}
 	go s.Cron.StartCron()
 
+	if configuration.DashboardAddr != "" {
+		s.Dashboard = server.MakeDashboard(s, configuration.DashboardAddr)
+		go s.Dashboard.StartListening()
+	}
+
+	s.Admin, err = server.MakeAdminService(s, configuration.AdminSocket)
+	if err != nil {
+		failedStart("Failed to init admin socket", err)
+	}
+	if s.Admin != nil {
+		go s.Admin.StartListening()
+	}
+
+	if configuration.MDNSAnnounce {
+		s.MDNSAnnouncer, err = server.MakeMDNSAnnouncer(configuration.MDNSService, configuration.ListenAddr)
+		if err != nil {
+			failedStart("Failed to init mDNS announcer", err)
+		}
+		go s.MDNSAnnouncer.StartAnnouncing()
+	}
+
 	fmt.Printf("nocc-server %s started successfully. num cpu: %d\n", common.GetVersion(), runtime.NumCPU())
 
 	err = s.StartGRPCListening(configuration.ListenAddr)
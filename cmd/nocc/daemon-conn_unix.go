@@ -0,0 +1,137 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// daemonSocketPath is created by systemd for nocc-daemon (see nocc-daemon.socket)
+const daemonSocketPath = "/run/nocc-daemon.sock"
+
+// userRuntimeDir must be the same as client.userRuntimeDir
+func userRuntimeDir() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return runtimeDir
+	}
+	return fmt.Sprintf("/run/user/%d", os.Getuid())
+}
+
+// userDaemonSocketPath is listened by a per-user daemon: either started by systemd user units (nocc-daemon-user.socket)
+// or spawned by `nocc` itself (see client.listenSelfManagedSocket)
+func userDaemonSocketPath() string {
+	return userRuntimeDir() + "/nocc-daemon.sock"
+}
+
+// dialDaemon connects to a system-wide daemon shared by all users, or to a per-user one.
+// With NOCC_PER_USER_DAEMON=1, a system-wide daemon is ignored: on shared build machines, it lets users
+// have isolated daemons (with own stats and clientIDs).
+func dialDaemon() (io.ReadWriteCloser, error) {
+	if os.Getenv("NOCC_PER_USER_DAEMON") == "1" {
+		return net.Dial("unix", userDaemonSocketPath())
+	}
+
+	conn, err := net.Dial("unix", daemonSocketPath)
+	if err == nil {
+		return conn, nil
+	}
+	if userConn, userErr := net.Dial("unix", userDaemonSocketPath()); userErr == nil {
+		return userConn, nil
+	}
+	return nil, err
+}
+
+// userDaemonOutputPath keeps stdout of a daemon spawned by `nocc`: if it fails to start, the reason is printed there
+func userDaemonOutputPath() string {
+	return userRuntimeDir() + "/nocc-daemon.out"
+}
+
+// dialOrSpawnDaemon starts nocc-daemon in background if it's not running and waits for its socket.
+// When many `nocc` processes spawn a daemon at once, only one of them survives, others exit, see a lock file.
+// A spawned daemon exits itself after ConnectionTimeout of inactivity.
+func dialOrSpawnDaemon() (io.ReadWriteCloser, error) {
+	conn, err := dialDaemon()
+	if err == nil {
+		return conn, nil
+	}
+
+	exited, outputOffset, spawnErr := spawnDaemon()
+	if spawnErr != nil {
+		return nil, fmt.Errorf("%v; can't start nocc-daemon: %v", err, spawnErr)
+	}
+	// a spawned daemon exits if another one (spawned by a neighbour `nocc` at the same time) holds the lock,
+	// but that one may still be starting, so its socket is polled until the deadline anyway
+	hasExited := false
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			hasExited = true
+			exited = nil
+		case <-time.After(20 * time.Millisecond):
+		}
+		if conn, err = net.Dial("unix", userDaemonSocketPath()); err == nil {
+			return conn, nil
+		}
+	}
+	if hasExited {
+		return nil, fmt.Errorf("nocc-daemon exited: %s", readDaemonOutput(outputOffset))
+	}
+	return nil, fmt.Errorf("nocc-daemon didn't start listening in time: %v", err)
+}
+
+// readDaemonOutput returns what a spawned daemon has printed: the output file is shared by all spawned daemons
+// (appended, not to erase the output of a running one), so it's read from an offset before spawning
+func readDaemonOutput(offset int64) string {
+	output, err := os.Open(userDaemonOutputPath())
+	if err != nil {
+		return ""
+	}
+	defer output.Close()
+	data, _ := io.ReadAll(io.NewSectionReader(output, offset, 64*1024))
+	return strings.TrimSpace(string(data))
+}
+
+// spawnDaemon launches nocc-daemon detached from a current session.
+// It's NOCC_DAEMON_EXECUTABLE if set, or located near `nocc`, or found in PATH.
+func spawnDaemon() (exited chan struct{}, outputOffset int64, err error) {
+	daemonPath := os.Getenv("NOCC_DAEMON_EXECUTABLE")
+	if daemonPath == "" {
+		daemonPath = "nocc-daemon"
+		if self, err := os.Executable(); err == nil {
+			if _, err := os.Stat(filepath.Join(filepath.Dir(self), "nocc-daemon")); err == nil {
+				daemonPath = filepath.Join(filepath.Dir(self), "nocc-daemon")
+			}
+		}
+	}
+
+	cmd := exec.Command(daemonPath)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Env = environWithoutMasquerade()
+	// not a pipe: a daemon outlives `nocc`, and writing to a closed pipe would kill it
+	if output, err := os.OpenFile(userDaemonOutputPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+		defer output.Close()
+		if stat, err := output.Stat(); err == nil {
+			outputOffset = stat.Size()
+		}
+		cmd.Stdout = output
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, 0, err
+	}
+
+	exited = make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	return exited, outputOffset, nil
+}
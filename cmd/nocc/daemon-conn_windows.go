@@ -0,0 +1,40 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const daemonPipePath = `\\.\pipe\nocc-daemon`
+
+// dialDaemon connects to a named pipe created by nocc-daemon (there is no systemd socket activation on Windows).
+// A pipe is opened for overlapped I/O, so that waitForInterruption can write while readResponse is blocked reading.
+func dialDaemon() (io.ReadWriteCloser, error) {
+	pipePath, err := windows.UTF16PtrFromString(daemonPipePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		handle, err := windows.CreateFile(pipePath, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return os.NewFile(uintptr(handle), daemonPipePath), nil
+		}
+		// all pipe instances are busy: the daemon is accepting another `nocc` right now
+		if !errors.Is(err, windows.ERROR_PIPE_BUSY) || attempt == 50 {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialOrSpawnDaemon doesn't spawn a daemon on Windows: it's expected to be started as a service
+func dialOrSpawnDaemon() (io.ReadWriteCloser, error) {
+	return dialDaemon()
+}
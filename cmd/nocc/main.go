@@ -2,19 +2,20 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"slices"
-	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
+
+	"nocc/internal/daemonproto"
 )
 
 type CompilationStatus int32
@@ -35,7 +36,36 @@ func realMain() int {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	if len(os.Args) == 2 && (os.Args[1] == "stats" || os.Args[1] == "--stats") {
+		return runCommandInDaemon("stats")
+	}
+	if len(os.Args) == 2 && os.Args[1] == "--check-servers" {
+		return runCommandInDaemon("check-servers")
+	}
+	if len(os.Args) >= 2 && (os.Args[1] == "--add-server" || os.Args[1] == "--drain-server") {
+		return runCommandInDaemon(os.Args[1][2:], os.Args[2:]...)
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "--servers" {
+		return runCommandInDaemon("servers", os.Args[2:]...)
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "--probe-compiler" {
+		return runCommandInDaemon("probe-compiler", os.Args[2:]...)
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "--repro" {
+		return runCommandInDaemon("repro", os.Args[2:]...)
+	}
+	if len(os.Args) >= 3 && os.Args[1] == "--why" {
+		return explainInvocation(os.Args[2:])
+	}
+
 	compiler, args := splitCompilerAndArgs(os.Args)
+	if compiler == "ccache" && len(args) > 0 {
+		exitCode, err := delegateToCcache(args)
+		if err != nil {
+			return exitOnError(err)
+		}
+		return exitCode
+	}
 	if shouldCompileLocally(args) {
 		exitCode, err := executeLocally(compiler, args, nil)
 		if err != nil {
@@ -44,7 +74,7 @@ func realMain() int {
 		return exitCode
 	}
 
-	conn, err := net.Dial("unix", "/run/nocc-daemon.sock")
+	conn, err := dialOrSpawnDaemon()
 	if err == nil {
 		defer conn.Close()
 		return runCompilationInDaemon(ctx, conn, compiler, args)
@@ -57,30 +87,92 @@ func realMain() int {
 	return exitCode
 }
 
-func runCompilationInDaemon(ctx context.Context, conn net.Conn, compiler string, args []string) int {
+func runCompilationInDaemon(ctx context.Context, conn io.ReadWriteCloser, compiler string, args []string) int {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return exitOnError(err)
+	}
+
+	parts := makeRequestParts(cwd, compiler, args)
+	exitCode, err := exchangeWithDaemon(ctx, conn, daemonproto.EncodeFramedRequest(parts, makeRequestAttrs()))
+	if errors.Is(err, daemonproto.ErrLegacyDaemon) {
+		request, legacyErr := daemonproto.EncodeLegacyRequest(parts)
+		if legacyErr != nil {
+			exitCode, err = executeLocally(compiler, args, legacyErr)
+		} else if legacyConn, dialErr := dialDaemon(); dialErr != nil {
+			exitCode, err = executeLocally(compiler, args, dialErr)
+		} else {
+			defer legacyConn.Close()
+			exitCode, err = exchangeWithDaemon(ctx, legacyConn, request)
+		}
+	}
+	if err != nil {
+		return exitOnError(err)
+	}
+	return exitCode
+}
+
+// exchangeWithDaemon sends a request and waits for a response; on Ctrl+C, a daemon is asked to interrupt compilation.
+func exchangeWithDaemon(ctx context.Context, conn io.ReadWriteCloser, request []byte) (int, error) {
 	var compilationStatus atomic.Int32
 	normalExitchan := make(chan struct{})
 	defer close(normalExitchan)
 
+	go waitForInterruption(ctx, conn, &compilationStatus, normalExitchan)
+	if err := sendRequest(conn, &compilationStatus, request); err != nil {
+		return 1, err
+	}
+	return readResponse(conn)
+}
+
+// runCommandInDaemon sends a command (not a compiler invocation) to a daemon and prints its output.
+// See client.HandleDaemonCommand.
+func runCommandInDaemon(command string, arguments ...string) int {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return exitOnError(err)
 	}
 
-	go waitForInterruption(ctx, conn, &compilationStatus, normalExitchan)
-	if err := sendRequest(conn, &compilationStatus, cwd, compiler, args); err != nil {
-		return exitOnError(err)
+	parts := makeRequestParts(cwd, "", append([]string{command}, arguments...))
+	exitCode, err := sendCommandToDaemon(daemonproto.EncodeFramedRequest(parts, makeRequestAttrs()))
+	if errors.Is(err, daemonproto.ErrLegacyDaemon) {
+		var request []byte
+		if request, err = daemonproto.EncodeLegacyRequest(parts); err == nil {
+			exitCode, err = sendCommandToDaemon(request)
+		}
 	}
-
-	exitCode, err := readResponse(conn)
 	if err != nil {
 		return exitOnError(err)
 	}
 	return exitCode
 }
 
+func sendCommandToDaemon(request []byte) (int, error) {
+	conn, err := dialDaemon()
+	if err != nil {
+		return 1, fmt.Errorf("nocc-daemon is not running: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(request); err != nil {
+		return 1, err
+	}
+	return readResponse(conn)
+}
+
+// explainInvocation handles `nocc --why g++ {args}`: what nocc would do with a command line, without compiling.
+// Some command lines are compiled locally without reaching a daemon, see shouldCompileLocally.
+func explainInvocation(args []string) int {
+	compiler, args := splitCompilerAndArgs(append([]string{"nocc"}, args...))
+	if shouldCompileLocally(args) {
+		fmt.Println("decision: compile locally\nreason: no -c, or -E, or input from stdin or /dev/null")
+		return 0
+	}
+	return runCommandInDaemon("why", append([]string{compiler}, args...)...)
+}
+
 // We compile locally under the following conditions:
-// - the user specified "-", or "-E"
+// - the user specified "-" (the source is fed via stdin), or "-E"
 // - the user did not specify or "-c"
 // - the user specified "/dev/null" as an input file
 func shouldCompileLocally(args []string) bool {
@@ -92,6 +184,8 @@ func exitOnError(err error) int {
 	return 1
 }
 
+// splitCompilerAndArgs detects a compiler from a command line, either `nocc g++ ...` (a launcher)
+// or `g++ ...` (masquerade mode, when nocc is launched via a symlink named after a compiler, see getCompiler).
 func splitCompilerAndArgs(args []string) (compiler string, arguments []string) {
 	compiler = filepath.Base(args[0])
 
@@ -102,20 +196,55 @@ func splitCompilerAndArgs(args []string) (compiler string, arguments []string) {
 		arguments = args[1:]
 	}
 
+	// `nocc sccache g++ ...`: sccache can't call nocc on a cache miss, so it's just skipped
+	// (ccache can, see delegateToCcache)
+	for slices.Contains(strippedCompilerWrappers, compiler) && len(arguments) > 0 {
+		compiler = filepath.Base(arguments[0])
+		arguments = arguments[1:]
+	}
+
 	return
 }
 
+// strippedCompilerWrappers are launchers that may be put between nocc and a compiler, see splitCompilerAndArgs
+var strippedCompilerWrappers = []string{"sccache"}
+
+// delegateToCcache handles `nocc ccache g++ ...`: the right order is ccache in front of nocc
+// (look up a cache first, compile remotely only on a miss), so ccache is launched with CCACHE_PREFIX=nocc,
+// and it calls `nocc g++ ...` itself on a cache miss.
+// The same can be achieved without this by `CCACHE_PREFIX=nocc ccache g++ ...`.
+func delegateToCcache(arguments []string) (int, error) {
+	pathCcache, err := getCompiler("ccache")
+	if err != nil {
+		return 1, err
+	}
+	pathNocc, err := os.Executable()
+	if err != nil {
+		return 1, err
+	}
+
+	cmd := exec.Command(*pathCcache, arguments...)
+	cmd.Env = append(os.Environ(), "CCACHE_PREFIX="+pathNocc)
+	return runPassingStdio(cmd)
+}
+
 func getPaths() []string {
 	return strings.Split(os.Getenv("PATH"), string(os.PathListSeparator))
 }
 
+// getCompiler finds a compiler in PATH skipping nocc itself.
+// It's essential for masquerade mode: /usr/lib/nocc/bin/g++ is a symlink (or a hard link) to nocc,
+// that dir is put first in PATH, and the real g++ is found in some dir after it.
 func getCompiler(compiler string) (*string, error) {
-	pathCurrentProgram, _ := os.Executable()
+	var statCurrentProgram os.FileInfo
+	if pathCurrentProgram, err := os.Executable(); err == nil {
+		statCurrentProgram, _ = os.Stat(pathCurrentProgram)
+	}
 
 	for _, path := range getPaths() {
 		pathCompiler := filepath.Join(path, compiler)
-		realPath, err := filepath.EvalSymlinks(pathCompiler)
-		if err != nil || pathCurrentProgram == realPath {
+		stat, err := os.Stat(pathCompiler) // follows symlinks, so a masquerade symlink is the same file as nocc
+		if err != nil || stat.IsDir() || os.SameFile(stat, statCurrentProgram) {
 			continue
 		}
 
@@ -126,6 +255,48 @@ func getCompiler(compiler string) (*string, error) {
 	return nil, err
 }
 
+// environWithoutMasquerade is an environment for a spawned daemon: a daemon compiles locally
+// by looking up a bare `g++` in PATH, and it must not find a masquerade symlink to nocc there (it would call itself forever).
+// A masquerade dir is any dir in PATH containing nocc under another name.
+func environWithoutMasquerade() []string {
+	pathCurrentProgram, err := os.Executable()
+	if err != nil {
+		return os.Environ()
+	}
+	statCurrentProgram, err := os.Stat(pathCurrentProgram)
+	if err != nil {
+		return os.Environ()
+	}
+
+	paths := make([]string, 0)
+	for _, path := range getPaths() {
+		if !containsLinkToProgram(path, statCurrentProgram) {
+			paths = append(paths, path)
+		}
+	}
+	return append(os.Environ(), "PATH="+strings.Join(paths, string(os.PathListSeparator)))
+}
+
+func containsLinkToProgram(dir string, statProgram os.FileInfo) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.Name() == "nocc" || entry.IsDir() {
+			continue
+		}
+		stat, err := os.Stat(filepath.Join(dir, entry.Name())) // follows symlinks, like getCompiler
+		if err == nil && os.SameFile(stat, statProgram) {
+			return true
+		}
+	}
+	return false
+}
+
+// executeLocally runs the compiler directly from the wrapper, bypassing the daemon.
+// Stdin/stdout/stderr are passed through as-is (not buffered), since the source might be piped via stdin
+// (cmake feature checks do `echo ... | cc -x c -`), and the output might be binary (e.g. `-o -`).
 func executeLocally(compiler string, arguments []string, err error) (int, error) {
 	if err != nil {
 		_, _ = os.Stderr.WriteString("[nocc] " + err.Error() + "\n")
@@ -136,22 +307,28 @@ func executeLocally(compiler string, arguments []string, err error) (int, error)
 		return 1, err
 	}
 
-	var compilerStdout, compilerStderr bytes.Buffer
-	cmd := exec.Command(*pathCompiler, arguments...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = &compilerStdout
-	cmd.Stderr = &compilerStderr
-	err = cmd.Run()
-
-	_, _ = os.Stdout.Write(compilerStdout.Bytes())
-	_, _ = os.Stderr.Write(compilerStderr.Bytes())
+	return runPassingStdio(exec.Command(*pathCompiler, arguments...))
+}
 
-	exitCode := cmd.ProcessState.ExitCode()
+func runPassingStdio(cmd *exec.Cmd) (int, error) {
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+
+	// a non-zero compiler exit code is not an error of nocc, it must be returned as is
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, err
+	}
 
-	return exitCode, err
+	return cmd.ProcessState.ExitCode(), nil
 }
 
-func waitForInterruption(ctx context.Context, conn net.Conn, compilationStatus *atomic.Int32, normalExitchan chan struct{}) {
+func waitForInterruption(ctx context.Context, conn io.ReadWriteCloser, compilationStatus *atomic.Int32, normalExitchan chan struct{}) {
 	select {
 	case <-ctx.Done():
 		if compilationStatus.CompareAndSwap(int32(StatusRunning), int32(StatusInterrupted)) {
@@ -163,33 +340,77 @@ func waitForInterruption(ctx context.Context, conn net.Conn, compilationStatus *
 	}
 }
 
-func sendRequest(conn net.Conn, compilationStatus *atomic.Int32, currentPath string, compiler string, arguments []string) (err error) {
+func sendRequest(conn io.ReadWriteCloser, compilationStatus *atomic.Int32, request []byte) (err error) {
 	if compilationStatus.CompareAndSwap(int32(StatusNotStarted), int32(StatusRunning)) {
-		_, err = conn.Write(fmt.Appendf(nil, "%s\b%s\b%s\000", currentPath, compiler, strings.Join(arguments, "\b")))
+		_, err = conn.Write(request)
 	}
 
 	return
 }
 
-func readResponse(conn net.Conn) (int, error) {
-	response, err := bufio.NewReaderSize(conn, 128*1024).ReadString(0x00)
-	if err != nil {
-		return 1, err
+// makeRequestParts are Cwd, Compiler (empty for a daemon command) and a command line.
+func makeRequestParts(cwd string, compiler string, cmdLine []string) []string {
+	return append([]string{cwd, compiler}, cmdLine...)
+}
+
+// compilerEnvVars are passed to a compiler launched by a daemon (a daemon doesn't see `nocc` env), see client.compilerEnvVars
+var compilerEnvVars = []string{"DEPENDENCIES_OUTPUT", "SOURCE_DATE_EPOCH", "GCC_COLORS", "SDKROOT", "GCC_EXEC_PREFIX", "LANG", "LC_ALL", "LC_MESSAGES"}
+
+// makeRequestAttrs are what a legacy request doesn't have, as "key=value", see client.DaemonSockRequest.applyAttrs
+func makeRequestAttrs() []string {
+	attrs := make([]string, 0, 1)
+	if isTerminal(os.Stderr) {
+		attrs = append(attrs, "stderr_tty=1")
 	}
+	for _, key := range compilerEnvVars {
+		if value, ok := os.LookupEnv(key); ok {
+			attrs = append(attrs, "env="+key+"="+value)
+		}
+	}
+	if fifoPath := findJobserverFifo(os.Getenv("MAKEFLAGS")); fifoPath != "" {
+		attrs = append(attrs, "jobserver="+fifoPath)
+	}
+	if buildID := os.Getenv("NOCC_BUILD_ID"); buildID != "" {
+		attrs = append(attrs, "build_id="+buildID)
+	}
+	return attrs
+}
 
-	responseParts := strings.Split(string(response[0:len(response)-1]), "\b") // -1 to strip off the trailing '\0'
+// findJobserverFifo returns a path of `--jobserver-auth=fifo:{path}` in MAKEFLAGS (make 4.4+, ninja), the last one wins like in make;
+// the pipe style `--jobserver-auth=R,W` isn't returned, a daemon can't use fds of `nocc`, see client.Jobservers
+func findJobserverFifo(makeflags string) string {
+	fifoPath := ""
+	for _, flag := range strings.Fields(makeflags) {
+		if auth, ok := strings.CutPrefix(flag, "--jobserver-auth="); ok {
+			fifoPath = ""
+			if path, isFifo := strings.CutPrefix(auth, "fifo:"); isFifo {
+				fifoPath = path
+			}
+		}
+	}
+	return fifoPath
+}
 
-	if len(responseParts) != 3 {
-		return 1, fmt.Errorf("received more than 3 parts in response")
+// readResponse reads a response in the same format as a request was sent, see client.DaemonUnixSockListener.
+// Output is printed only if a checksum (of every chunk of a framed response) matches; otherwise, an error tells what was actually received.
+func readResponse(conn io.ReadWriteCloser) (int, error) {
+	reader := bufio.NewReaderSize(conn, 128*1024)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return 1, fmt.Errorf("failed to read a response from nocc-daemon: %v", err)
+	}
+	if first[0] != 0 {
+		return daemonproto.ReadLegacyResponse(reader, os.Stdout, os.Stderr)
 	}
 
-	exitcode, err := strconv.Atoi(responseParts[0])
+	exitCode, signal, err := daemonproto.ReadFramedResponse(reader, os.Stdout, os.Stderr)
 	if err != nil {
 		return 1, err
 	}
-
-	_, _ = os.Stdout.WriteString(responseParts[1])
-	_, _ = os.Stderr.WriteString(responseParts[2])
-
-	return exitcode, nil
+	if signal != 0 {
+		// like a shell reports a child killed by a signal, so that make tells an OOM kill from an error
+		_, _ = fmt.Fprintf(os.Stderr, "[nocc] the compiler was killed by signal %d (%v)\n", signal, syscall.Signal(signal))
+		return 128 + signal, nil
+	}
+	return exitCode, nil
 }
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// AdaptiveSplit compiles small files locally while all remotes are saturated (queued deep, see IsSaturated)
+// and a local compiler is expected to finish faster than a remote turnaround.
+// A remote turnaround is a rolling average of recent remote invocations (from a start to a received .o, queuing on a server included),
+// a local duration of a .cpp is known if it was compiled locally before; otherwise, a .cpp not larger than AdaptiveLocalMaxSize is small.
+// Only a free local slot is taken: a file never waits for a local compiler instead of a remote one.
+// It's nil if AdaptiveLocal is off or a local compiler is disabled (CompilerQueueSize = 0).
+type AdaptiveSplit struct {
+	mu               sync.Mutex
+	remoteTurnaround time.Duration            // rolling, of remote invocations compiled (not taken from obj cache)
+	localByFile      map[string]time.Duration // the last duration of a .cpp compiled locally, by a full path
+
+	maxCppSize int64
+}
+
+const (
+	// adaptiveSplitWeight is a weight of a new remote invocation in a rolling average: about 10 last ones matter
+	adaptiveSplitWeight = 0.2
+	// adaptiveSplitMaxFiles limits a history of local durations, it's reset when exceeded
+	adaptiveSplitMaxFiles = 50000
+)
+
+func MakeAdaptiveSplit(enabled bool, maxCppSize int64) *AdaptiveSplit {
+	if !enabled {
+		return nil
+	}
+	return &AdaptiveSplit{
+		localByFile: make(map[string]time.Duration),
+		maxCppSize:  maxCppSize,
+	}
+}
+
+func (split *AdaptiveSplit) RecordRemote(duration time.Duration) {
+	if split == nil {
+		return
+	}
+	split.mu.Lock()
+	if split.remoteTurnaround == 0 {
+		split.remoteTurnaround = duration
+	} else {
+		split.remoteTurnaround += time.Duration(adaptiveSplitWeight * float64(duration-split.remoteTurnaround))
+	}
+	split.mu.Unlock()
+}
+
+func (split *AdaptiveSplit) RecordLocal(cppInFile string, duration time.Duration) {
+	if split == nil {
+		return
+	}
+	split.mu.Lock()
+	if len(split.localByFile) >= adaptiveSplitMaxFiles {
+		split.localByFile = make(map[string]time.Duration)
+	}
+	split.localByFile[cppInFile] = duration
+	split.mu.Unlock()
+}
+
+// ShouldCompileLocally is asked before choosing a remote; candidates are remotes able to compile a .cpp.
+// A returned reason is logged, such files are counted as "remotes_saturated" in `nocc --stats`.
+func (split *AdaptiveSplit) ShouldCompileLocally(invocation *Invocation, candidates []*RemoteConnection, localHasFreeSlot bool) (bool, string) {
+	if split == nil || !localHasFreeSlot || len(candidates) == 0 {
+		return false, ""
+	}
+	for _, remote := range candidates {
+		if !remote.IsSaturated() {
+			return false, ""
+		}
+	}
+
+	split.mu.Lock()
+	remoteTurnaround := split.remoteTurnaround
+	localDuration, knownLocally := split.localByFile[invocation.cppInFile]
+	split.mu.Unlock()
+	if remoteTurnaround == 0 {
+		return false, ""
+	}
+
+	if knownLocally {
+		if localDuration >= remoteTurnaround {
+			return false, ""
+		}
+		return true, "locally took " + localDuration.Round(time.Millisecond).String() + ", remotes take " + remoteTurnaround.Round(time.Millisecond).String()
+	}
+	if stat, err := os.Stat(invocation.cppInFile); err != nil || stat.Size() > split.maxCppSize {
+		return false, ""
+	}
+	return true, "a small file, remotes take " + remoteTurnaround.Round(time.Millisecond).String()
+}
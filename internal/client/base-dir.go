@@ -0,0 +1,63 @@
+package client
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// pathOptionsUnderBaseDir are options followed by a path in the same arg, see rewriteArgsUnderBaseDir
+var pathOptionsUnderBaseDir = []string{
+	"-I", "-isystem", "-iquote", "-idirafter", "-include", "-imacros", "-isysroot", "--sysroot=", "-L", "-o", "-MF",
+	"-fmodule-file=", "-fprebuilt-module-path=", "-fmodule-output=", "-fprofile-use=",
+}
+
+// rewriteArgsUnderBaseDir implements BaseDir (like base_dir of ccache): absolute paths under it are made relative to a cwd
+// in args that are a part of obj cache key (see StartCompilationSessionRequest.OriginalCompilerArgs), and in generated depfiles.
+// Then the same file built in different checkouts (e.g. CI workspaces named by a job) hits the same .o on a server,
+// and depfiles stay valid after a build dir is moved.
+// Paths given to a compiler are not changed, so debug info still contains absolute ones (see RemapDebugPaths of a server).
+// Both standalone paths (`-I /dir`, `-o /file`) and paths glued to an option (`-I/dir`, `--sysroot=/dir`) are rewritten,
+// but not paths in other args (like `-DROOT=/dir`): they may get into an object, which must differ then.
+func rewriteArgsUnderBaseDir(baseDir string, cwd string, args []string) []string {
+	if baseDir == "" {
+		return args
+	}
+
+	rewritten := make([]string, len(args))
+	for i, arg := range args {
+		rewritten[i] = arg
+		idx := strings.Index(arg, baseDir)
+		if idx == -1 {
+			continue
+		}
+		option := arg[:idx]
+		if idx == 0 || slices.Contains(pathOptionsUnderBaseDir, option) {
+			rewritten[i] = option + relativeToBaseDir(baseDir, cwd, arg[idx:])
+		}
+	}
+	return rewritten
+}
+
+func cleanBaseDir(baseDir string) string {
+	if baseDir == "" {
+		return ""
+	}
+	return filepath.Clean(baseDir)
+}
+
+// relativeToBaseDir returns fileName relative to cwd if it's under baseDir, and as is otherwise
+func relativeToBaseDir(baseDir string, cwd string, fileName string) string {
+	if baseDir == "" || !filepath.IsAbs(fileName) || !isUnderBaseDir(baseDir, fileName) {
+		return fileName
+	}
+	rel, err := filepath.Rel(cwd, fileName)
+	if err != nil {
+		return fileName
+	}
+	return rel
+}
+
+func isUnderBaseDir(baseDir string, fileName string) bool {
+	return fileName == baseDir || strings.HasPrefix(fileName, baseDir) && (strings.HasSuffix(baseDir, string(filepath.Separator)) || fileName[len(baseDir)] == filepath.Separator)
+}
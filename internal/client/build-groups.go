@@ -0,0 +1,96 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// buildRootMarkers are files that a build system places into the root of a build directory.
+// If a compiler is invoked somewhere inside it (make launches it from subdirectories), we group by that root.
+var buildRootMarkers = []string{
+	"CMakeCache.txt",
+	"build.ninja",
+	"meson-info",
+	"config.status",
+}
+
+// BuildGroup represents one build (one project/build directory) served by a daemon.
+// Multiple builds can share one daemon simultaneously (e.g. two projects are built on a workstation),
+// they are distinguished not to skew each other's stats and local compilation queue.
+// A build is identified either by NOCC_BUILD_ID env passed to `nocc`, or by a build root detected from cwd.
+//
+// Not everything is per build, intentionally. A sessionID is a daemon-wide counter: servers identify a session
+// by a clientID and a sessionID, so per-build counters would collide. Files known to servers (the includes cache)
+// are keyed by an absolute path and sha256: builds including the same header share its upload, they can't see
+// different contents of one path (a changed file is a conflict within one build as well).
+type BuildGroup struct {
+	buildID string
+	stats   *DaemonStats
+}
+
+type BuildGroups struct {
+	mu           sync.Mutex
+	groups       map[string]*BuildGroup
+	cwdToBuildID map[string]string // not to walk up the file system for every invocation
+}
+
+// cwdToBuildIDMaxSize limits remembered cwds, they are forgotten when exceeded (a daemon serving many builds for long)
+const cwdToBuildIDMaxSize = 10000
+
+func MakeBuildGroups() *BuildGroups {
+	return &BuildGroups{
+		groups:       make(map[string]*BuildGroup),
+		cwdToBuildID: make(map[string]string),
+	}
+}
+
+// GetBuildGroup returns a group for an invocation, creating it on first access.
+// explicitBuildID is NOCC_BUILD_ID (empty if not set).
+func (bg *BuildGroups) GetBuildGroup(explicitBuildID string, cwd string) *BuildGroup {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+
+	buildID := explicitBuildID
+	if buildID == "" {
+		var ok bool
+		if buildID, ok = bg.cwdToBuildID[cwd]; !ok {
+			buildID = detectBuildRoot(cwd)
+			if len(bg.cwdToBuildID) >= cwdToBuildIDMaxSize {
+				bg.cwdToBuildID = make(map[string]string)
+			}
+			bg.cwdToBuildID[cwd] = buildID
+		}
+	}
+
+	group := bg.groups[buildID]
+	if group == nil {
+		group = &BuildGroup{buildID: buildID, stats: MakeDaemonStats()}
+		bg.groups[buildID] = group
+		logClient.Info(0, "new build", buildID)
+	}
+	return group
+}
+
+func (bg *BuildGroups) AllGroups() []*BuildGroup {
+	bg.mu.Lock()
+	groups := make([]*BuildGroup, 0, len(bg.groups))
+	for _, group := range bg.groups {
+		groups = append(groups, group)
+	}
+	bg.mu.Unlock()
+	return groups
+}
+
+// detectBuildRoot walks up from cwd to find a directory with any of buildRootMarkers.
+// If not found, cwd itself is a build id.
+func detectBuildRoot(cwd string) string {
+	for dir := cwd; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		for _, marker := range buildRootMarkers {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				return dir
+			}
+		}
+	}
+	return cwd
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// ReportBuildSummaries sends stats of every build to a server when a daemon quits (if ReportBuildSummaries is set).
+// Servers aggregate them into farm-wide stats (see server.BuildSummaries), so that operators see
+// client-side degradation: how much is compiled locally and why, how often remote compilation fails.
+// A report is anonymized: it contains only counters, a build dir is hashed;
+// a clientID is sent only to authenticate, a server keeps its hash.
+// Every build is reported to one remote, not to all, not to be counted several times.
+func (daemon *Daemon) ReportBuildSummaries(ctx context.Context) {
+	for _, group := range daemon.buildGroups.AllGroups() {
+		req := group.stats.makeBuildSummaryRequest()
+		req.ClientID = daemon.clientID
+		req.ClientVersion = common.GetVersion()
+		req.BuildHash = anonymizeBuildID(group.buildID)
+		if req.NInvocations == 0 {
+			continue
+		}
+
+		remote := daemon.chooseRemoteForReport(req.BuildHash)
+		if remote == nil {
+			return
+		}
+		if _, err := remote.compilationServiceClient.ReportBuildSummary(ctx, req); err != nil {
+			logClient.Error("can't report build summary to", remote.remoteHost, err)
+		}
+	}
+}
+
+// chooseRemoteForReport returns the first available remote starting from the one by hash, nil if none is available
+func (daemon *Daemon) chooseRemoteForReport(buildHash string) *RemoteConnection {
+	remoteConnections := daemon.getRemoteConnections()
+	if len(remoteConnections) == 0 {
+		return nil
+	}
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(buildHash))
+	nRemotes := len(remoteConnections)
+	first := int(hasher.Sum32()) % nRemotes
+
+	for i := 0; i < nRemotes; i++ {
+		remote := remoteConnections[(first+i)%nRemotes]
+		if !remote.isUnavailable.Load() && remote.compilationServiceClient != nil {
+			return remote
+		}
+	}
+	return nil
+}
+
+func anonymizeBuildID(buildID string) string {
+	hash := sha256.Sum256([]byte(buildID))
+	return hex.EncodeToString(hash[:8])
+}
+
+func (stats *DaemonStats) makeBuildSummaryRequest() *pb.BuildSummaryRequest {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	req := &pb.BuildSummaryRequest{
+		NInvocations:  int32(stats.nInvocations),
+		NRemote:       int32(stats.nRemote),
+		NObjCacheHits: int32(stats.nObjCacheHits),
+		NLocal:        int32(stats.nLocal),
+		NRemoteFailed: int32(stats.nRemoteFailed),
+		LocalReasons:  make(map[string]int32, len(stats.localReasons)),
+	}
+	for reason, count := range stats.localReasons {
+		req.LocalReasons[reason] = int32(count)
+	}
+	return req
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"nocc/pb"
+)
+
+// CentralScheduler asks a nocc-scheduler (SchedulerAddr) which remote compiles a .cpp, see scheduler.Scheduler.
+// A scheduler knows the load of all servers from all daemons, a daemon knows only its own sessions.
+// If a scheduler is unreachable or has no opinion, a daemon decides itself (fallback, CostAwareScheduler),
+// so a scheduler is not a single point of failure: builds continue with static Servers while it's down.
+type CentralScheduler struct {
+	grpcClient *GRPCClient
+	clientID   string
+	fallback   RemoteScheduler
+
+	unreachableUntil atomic.Int64 // unix nano, while a scheduler is not asked after a failure
+}
+
+const (
+	// centralSchedulerTimeout limits a placement call: it's made for every .cpp, a slow scheduler must not slow a build
+	centralSchedulerTimeout = 200 * time.Millisecond
+	// centralSchedulerRetryTime is how long a daemon decides itself after a scheduler failed to respond
+	centralSchedulerRetryTime = 30 * time.Second
+)
+
+func MakeCentralScheduler(schedulerAddr string, clientID string, socksProxyAddr string, fallback RemoteScheduler) (*CentralScheduler, error) {
+	grpcClient, err := MakeGRPCClient(schedulerAddr, socksProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &CentralScheduler{
+		grpcClient: grpcClient,
+		clientID:   clientID,
+		fallback:   fallback,
+	}, nil
+}
+
+func (scheduler *CentralScheduler) ChooseRemote(invocation *Invocation, candidates []*RemoteConnection) *RemoteConnection {
+	if len(candidates) == 1 || time.Now().UnixNano() < scheduler.unreachableUntil.Load() {
+		return scheduler.fallback.ChooseRemote(invocation, candidates)
+	}
+
+	request := &pb.PlaceCompilationRequest{
+		ClientID:    scheduler.clientID,
+		CppBasename: filepath.Base(invocation.cppInFile),
+		Long:        invocation.predictedLong,
+		Candidates:  make([]string, 0, len(candidates)),
+	}
+	if stat, err := os.Stat(invocation.cppInFile); err == nil {
+		request.CppSize = stat.Size()
+	}
+	for _, remote := range candidates {
+		if !remote.isUnavailable.Load() {
+			request.Candidates = append(request.Candidates, remote.remoteHostPort)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(scheduler.grpcClient.callContext, centralSchedulerTimeout)
+	defer cancel()
+	reply, err := pb.NewSchedulerServiceClient(scheduler.grpcClient.connection).PlaceCompilation(ctx, request)
+	if err != nil {
+		logClient.Error("scheduler", scheduler.grpcClient.remoteHostPort, "is unreachable, deciding locally for", centralSchedulerRetryTime, err)
+		scheduler.unreachableUntil.Store(time.Now().Add(centralSchedulerRetryTime).UnixNano())
+		return scheduler.fallback.ChooseRemote(invocation, candidates)
+	}
+
+	for _, remote := range candidates {
+		if remote.remoteHostPort == reply.RemoteHostPort {
+			logClient.Info(2, "scheduler placed", invocation.cppInFile, "to", remote.remoteHost)
+			return remote
+		}
+	}
+	return scheduler.fallback.ChooseRemote(invocation, candidates)
+}
@@ -3,8 +3,11 @@ package client
 import (
 	"bytes"
 	"context"
+	"os"
+	"slices"
+	"strings"
+
 	"nocc/internal/common"
-	"syscall"
 )
 
 // CompilerLaunchRequest describes an invocation when it's executed locally, not remotely.
@@ -21,11 +24,33 @@ type CompilerLaunchRequest struct {
 	uid           int
 	gid           int
 	interruptChan chan struct{}
+	output        *DaemonOutputStream // if set, output is streamed to `nocc` instead of being returned in a response
+	env           []string            // "KEY=VALUE" from `nocc` env, see compilerEnvVars
+}
+
+// compilerEnvVars are passed from `nocc` env to a compiler (see DaemonSockRequest.Env), others are not.
+// A daemon's own env is inherited from a `nocc` that launched it (maybe of another build), so these are never taken from there.
+var compilerEnvVars = []string{"DEPENDENCIES_OUTPUT", "SOURCE_DATE_EPOCH", "GCC_COLORS", "SDKROOT", "GCC_EXEC_PREFIX", "LANG", "LC_ALL", "LC_MESSAGES"}
+
+// depFileEnvVars make a compiler write a depfile itself; remotely, it's done by a client, see Invocation.applyDepFileEnv
+var depFileEnvVars = []string{"DEPENDENCIES_OUTPUT"}
+
+func isCompilerEnvVar(keyValue string, vars []string) bool {
+	key, _, _ := strings.Cut(keyValue, "=")
+	return slices.Contains(vars, key)
+}
+
+func makeCompilerEnv(env []string) []string {
+	compilerEnv := slices.DeleteFunc(os.Environ(), func(keyValue string) bool {
+		return isCompilerEnvVar(keyValue, compilerEnvVars)
+	})
+	return append(compilerEnv, env...)
 }
 
 type CompilerLaunchResponse struct {
 	interrupted bool
 	exitCode    int
+	signal      int // a compiler was killed by it, exitCode is -1 then
 	stdout      []byte
 	stderr      []byte
 }
@@ -43,13 +68,15 @@ func (request *CompilerLaunchRequest) RunCompilerLocally() CompilerLaunchRespons
 
 	defer cancel()
 	compilerCommand.Dir = request.cwd
-	compilerCommand.Stdout = &compilerStdout
-	compilerCommand.Stderr = &compilerStderr
-	compilerCommand.SysProcAttr = &syscall.SysProcAttr{}
-	compilerCommand.SysProcAttr.Credential = &syscall.Credential{
-		Uid: uint32(request.uid),
-		Gid: uint32(request.gid),
+	compilerCommand.Env = makeCompilerEnv(request.env)
+	if request.output != nil {
+		compilerCommand.Stdout = request.output.Stdout()
+		compilerCommand.Stderr = request.output.Stderr()
+	} else {
+		compilerCommand.Stdout = &compilerStdout
+		compilerCommand.Stderr = &compilerStderr
 	}
+	setCompilerCredentials(compilerCommand, request.uid, request.gid)
 
 	compilerCommand.Run()
 
@@ -61,6 +88,7 @@ func (request *CompilerLaunchRequest) RunCompilerLocally() CompilerLaunchRespons
 
 	return CompilerLaunchResponse{
 		exitCode: compilerCommand.ProcessState.ExitCode(),
+		signal:   common.CompilerTerminationSignal(compilerCommand),
 		stdout:   compilerStdout.Bytes(),
 		stderr:   compilerStderr.Bytes(),
 	}
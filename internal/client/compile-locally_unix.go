@@ -0,0 +1,28 @@
+//go:build !windows
+
+package client
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setCompilerCredentials launches a local compiler as a user who ran `nocc`, not as a daemon user.
+// A per-user daemon runs as that user already, and it can't switch credentials (it's not root).
+func setCompilerCredentials(compilerCommand *exec.Cmd, uid int, gid int) {
+	if uid == os.Getuid() && gid == os.Getgid() {
+		return
+	}
+	compilerCommand.SysProcAttr = &syscall.SysProcAttr{}
+	compilerCommand.SysProcAttr.Credential = &syscall.Credential{
+		Uid: uint32(uid),
+		Gid: uint32(gid),
+	}
+}
+
+func getOpenFilesLimit() uint64 {
+	var rLimit syscall.Rlimit
+	_ = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
+	return uint64(rLimit.Cur)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package client
+
+import (
+	"os/exec"
+)
+
+// setCompilerCredentials does nothing on Windows: a daemon runs as the same user as `nocc`
+func setCompilerCredentials(compilerCommand *exec.Cmd, uid int, gid int) {
+}
+
+// getOpenFilesLimit is reported in logs; there is no such limit for handles on Windows
+func getOpenFilesLimit() uint64 {
+	return 0
+}
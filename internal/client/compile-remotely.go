@@ -3,7 +3,9 @@ package client
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	"nocc/internal/common"
 	"nocc/pb"
 )
 
@@ -13,10 +15,22 @@ import (
 func CompileCppRemotely(daemon *Daemon, remote *RemoteConnection, invocation *Invocation) (*CompilerLaunchResponse, error) {
 	invocation.wgRecv.Add(1)
 
-	// 1. For an input .cpp file, find all dependent .h/.nocc-pch/etc. that are required for compilation
-	response, err := CollectDependentIncludes(invocation)
+	// 1. For an input .cpp file, find all dependent .h/.nocc-pch/etc. that are required for compilation.
+	// If a remote reads includes on demand, they are not collected: only the .cpp and dirs it may read from are sent.
+	var response *DependentIncludesResponse
+	var requiredFiles []*pb.FileMetadata
+	var requiredPchFile *pb.FileMetadata
+	var err error
+	preprocessStart := time.Now()
+	onDemand := remote.acceptsOnDemandIncludes.Load() && daemon.canUseOnDemandIncludes(invocation)
+	if onDemand {
+		response, requiredFiles, err = daemon.collectOnDemandFiles(invocation)
+	} else {
+		response, requiredFiles, requiredPchFile, err = daemon.collectRequiredFiles(invocation)
+	}
+	invocation.summary.preprocessDuration = time.Since(preprocessStart)
 	if err != nil {
-		return nil, fmt.Errorf("failed to collect dependencies: %v", err)
+		return nil, err
 	}
 
 	if response.interrupted {
@@ -25,44 +39,46 @@ func CompileCppRemotely(daemon *Daemon, remote *RemoteConnection, invocation *In
 		}, nil
 	}
 
-	invocation.summary.nIncludes = len(response.requiredFiles)
-	invocation.summary.AddTiming("collected_includes")
-
-	requiredFiles := make([]*pb.FileMetadata, 0, len(response.requiredFiles)+1)
-	for _, hFile := range response.requiredFiles {
-		requiredFiles = append(requiredFiles, hFile.ToPbFileMetadata())
-	}
-
-	requiredFiles = append(requiredFiles, response.cppFile.ToPbFileMetadata())
-
-	var requiredPchFile *pb.FileMetadata
-	if response.pchFile != nil {
-		requiredPchFile = response.pchFile.ToPbFileMetadata()
-		requiredFiles = append(requiredFiles, requiredPchFile)
-	}
-
-	for fOption, fOptionFile := range invocation.fOptionFiles {
-		fileMeta, err := createIncludedFileWithBuffer(fOptionFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create file metadata for option %q for file %q: %v", fOption, fOptionFile, err)
-		}
-		requiredFiles = append(requiredFiles, fileMeta.ToPbFileMetadata())
+	if !onDemand {
+		invocation.requiredFiles, invocation.requiredPchFile = requiredFiles, requiredPchFile
 	}
 
 	// 2. Send sha256 of the .cpp and all dependencies to the remote.
 	// The remote returns indexes that are missing (needed to be uploaded).
-	fileIndexesToUpload, err := remote.StartCompilationSession(invocation, requiredFiles, requiredPchFile)
-	if err != nil {
-		return nil, err
+	// If there are cache servers, one of them is asked first: if it has this .o, it's received from there.
+	// Otherwise, if CacheProbeRemotes is set, a session is started on any remote already having this .o.
+	// Includes read on demand are not a part of an obj cache key, so caches are not asked then.
+	var filesToUpload []fileToUpload
+	if onDemand {
+		remote, filesToUpload, err = daemon.startSessionAvoidingBusy(remote, invocation, requiredFiles, requiredPchFile, onDemand)
+		if err != nil {
+			return nil, err
+		}
+	} else if cacheRemote := daemon.chooseCacheRemote(invocation); cacheRemote != nil && cacheRemote.StartCachedSession(invocation, requiredFiles, requiredPchFile) {
+		remote = cacheRemote
+		invocation.summary.remoteHost = remote.remoteHost
+		invocation.summary.remoteHostPort = remote.remoteHostPort
+	} else {
+		if remoteHavingObj := daemon.findRemoteHavingObj(invocation, remote, requiredFiles, requiredPchFile); remoteHavingObj != remote {
+			remote = remoteHavingObj
+			invocation.summary.remoteHost = remote.remoteHost
+			invocation.summary.remoteHostPort = remote.remoteHostPort
+		}
+		remote, filesToUpload, err = daemon.startSessionAvoidingBusy(remote, invocation, requiredFiles, requiredPchFile, onDemand)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	logClient.Info(1, "remote", remote.remoteHost, "sessionID", invocation.sessionID, "waiting", len(fileIndexesToUpload), "uploads", invocation.cppInFile)
+	logClient.Info(1, "remote", remote.remoteHost, "sessionID", invocation.sessionID, "waiting", len(filesToUpload), "uploads", invocation.cppInFile)
 	logClient.Info(2, "checked", len(requiredFiles), "files whether upload is needed or they exist on remote")
 	invocation.summary.AddTiming("remote_session")
 
 	// 3. Send all files needed to be uploaded.
 	// If all files were recently uploaded or exist in remote cache, this array would be empty.
-	err = remote.UploadFilesToRemote(invocation, requiredFiles, fileIndexesToUpload)
+	uploadStart := time.Now()
+	err = remote.UploadFilesToRemote(invocation, filesToUpload)
+	invocation.summary.uploadDuration = time.Since(uploadStart)
 	if err != nil {
 		return nil, err
 	}
@@ -73,9 +89,14 @@ func CompileCppRemotely(daemon *Daemon, remote *RemoteConnection, invocation *In
 	logClient.Info(2, "wait for a compiled obj", "sessionID", invocation.sessionID)
 	invocation.waitForCompilation(remote)
 	invocation.summary.AddTiming("received_obj")
+	if !invocation.summary.objHeaderTime.IsZero() {
+		invocation.summary.receiveDuration = time.Since(invocation.summary.objHeaderTime)
+	}
 
 	// Now, we have a resulting .o file placed in a path determined by -o from command line.
-	if invocation.compilerExitCode != 0 {
+	if invocation.compilerSignal != 0 {
+		logClient.Error("remote C++ compiler was killed by signal", invocation.compilerSignal, "sessionID", invocation.sessionID, invocation.cppInFile, remote.remoteHost)
+	} else if invocation.compilerExitCode != 0 {
 		logClient.Info(0, "remote C++ compiler exited with code", invocation.compilerExitCode, "sessionID", invocation.sessionID, invocation.cppInFile, remote.remoteHost)
 		logClient.Info(1, "compilerExitCode:", invocation.compilerExitCode, "sessionID", invocation.sessionID, "\ncompilerStdout:", strings.TrimSpace(string(invocation.compilerStdout)), "\ncompilerStderr:", strings.TrimSpace(string(invocation.compilerStderr)))
 	} else {
@@ -85,6 +106,9 @@ func CompileCppRemotely(daemon *Daemon, remote *RemoteConnection, invocation *In
 	// if compiler is launched with -MD/-MF flags, it generates a .o.d file (a dependency file with include list)
 	// we do it on a client side (moreover, they are stripped off compilerArgs and not sent to the remote)
 	// note, that .o.d file is generated ALONG WITH .o (like "a side effect of compilation")
+	if onDemand {
+		response.requiredFiles = invocation.onDemandIncludedFiles()
+	}
 	if invocation.depsFlags.ShouldGenerateDepFile() {
 		depFileName, err := invocation.depsFlags.GenerateAndSaveDepFile(invocation, response.requiredFiles)
 		if err == nil {
@@ -94,13 +118,76 @@ func CompileCppRemotely(daemon *Daemon, remote *RemoteConnection, invocation *In
 		}
 	}
 
+	if invocation.compilerExitCode == 0 && invocation.err == nil && invocation.project.UsesDependMode() {
+		daemon.dependCache.Save(invocation, response)
+	}
+
 	return &CompilerLaunchResponse{
 		exitCode: invocation.compilerExitCode,
+		signal:   invocation.compilerSignal,
 		stdout:   invocation.compilerStdout,
 		stderr:   invocation.compilerStderr,
 	}, invocation.err
 }
 
+// collectRequiredFiles lists all files a remote needs to compile a .cpp: dependencies, -f option files, BMIs and a toolchain.
+// The .cpp itself is among them, so is a .nocc-pch (also returned as requiredPchFile, nil if none).
+func (daemon *Daemon) collectRequiredFiles(invocation *Invocation) (*DependentIncludesResponse, []*pb.FileMetadata, *pb.FileMetadata, error) {
+	response, err := CollectDependentIncludes(invocation)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to collect dependencies: %v", err)
+	}
+
+	if response.interrupted {
+		return response, nil, nil, nil
+	}
+
+	invocation.localCompiler = daemon.localCompilerProbes.Probe(invocation.compilerName, common.ExtractTargetArgs(invocation.compilerArgs))
+	invocation.summary.nIncludes = len(response.requiredFiles)
+	invocation.summary.AddTiming("collected_includes")
+
+	requiredFiles := make([]*pb.FileMetadata, 0, len(response.requiredFiles)+1)
+	for _, hFile := range response.requiredFiles {
+		requiredFiles = append(requiredFiles, hFile.ToPbFileMetadata())
+	}
+
+	requiredFiles = append(requiredFiles, response.cppFile.ToPbFileMetadata())
+
+	var requiredPchFile *pb.FileMetadata
+	if response.pchFile != nil {
+		requiredPchFile = response.pchFile.ToPbFileMetadata()
+		requiredFiles = append(requiredFiles, requiredPchFile)
+	}
+
+	for fOption, fOptionFile := range invocation.fOptionFiles {
+		fileMeta, err := createIncludedFileWithBuffer(fOptionFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create file metadata for option %q for file %q: %v", fOption, fOptionFile, err)
+		}
+		requiredFiles = append(requiredFiles, fileMeta.ToPbFileMetadata())
+	}
+
+	for _, bmiFile := range invocation.bmiInFiles {
+		fileMeta, err := createIncludedFileWithBuffer(bmiFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create file metadata for module %q: %v", bmiFile, err)
+		}
+		requiredFiles = append(requiredFiles, fileMeta.ToPbFileMetadata())
+	}
+
+	if daemon.toolchains != nil {
+		invocation.toolchain, err = daemon.toolchains.Get(invocation)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to pack toolchain: %v", err)
+		}
+		for _, file := range invocation.toolchain.files {
+			requiredFiles = append(requiredFiles, file.ToPbFileMetadata())
+		}
+	}
+
+	return response, requiredFiles, requiredPchFile, nil
+}
+
 func (invocation *Invocation) waitForCompilation(remote *RemoteConnection) {
 	waitCh := make(chan struct{})
 	go invocation.InterruptRemoteCompilation(remote, waitCh)
@@ -111,8 +198,13 @@ func (invocation *Invocation) waitForCompilation(remote *RemoteConnection) {
 // We don't send any request here, just wait: after all uploads finish, the remote starts compiling .cpp.
 // When .o is ready, the remote pushes it to a receiving stream, and wgRecv is done.
 // If compilation exits with non-zero code, the same stream is used to send error details.
+// Waiting is not limited by InvocationTimeout, but by ObjWaitTimeout without progress: huge .o files on slow links take long,
+// but chunks keep arriving; and a server reports sessions being compiled via KeepAlive. See PeriodicallyInterruptHangedInvocations.
 // See FilesReceiving.
 func (invocation *Invocation) WaitForCompiledObj(remote *RemoteConnection, waitCh chan struct{}) {
+	if remote.reportsCompilingSessions.Load() {
+		invocation.onObjWaitProgress()
+	}
 	invocation.wgRecv.Wait()
 	close(waitCh)
 }
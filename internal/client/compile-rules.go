@@ -0,0 +1,257 @@
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"nocc/internal/common"
+)
+
+// CompileRule matches an invocation by regular expressions, all non-empty fields must match.
+// Rules are set in a config as Rules, ForceLocal and ForceRemote, see CompileRules.
+type CompileRule struct {
+	Compiler   string   // a compiler name, like "g++" or "clang.*"
+	Cwd        string   // a dir where `nocc` is launched
+	File       string   // an input file, as in a command line
+	PathPrefix string   // an input file resolved at cwd starts with it, like "/src/third_party/" (not a regexp)
+	Arg        string   // any argument of a command line
+	Args       []string // every one matches any argument, like ["^-O0$", "^-g"]
+}
+
+// PinRule sends matching .cpp files to a specific server instead of distributing them by basename.
+// It's for known pathological files, like huge generated ones that should always go to the biggest server.
+type PinRule struct {
+	CompileRule
+	Server string // "host:port", as in Servers
+}
+
+// PolicyRule is a general form of ForceLocal / ForceRemote: a matching invocation gets all actions of a rule.
+// Rules are checked in order: the first matching one with Action decides local/remote,
+// and every other action is taken from the first matching rule that sets it.
+type PolicyRule struct {
+	CompileRule
+	Action     string // "local" or "remote" (the same as ForceLocal / ForceRemote), empty leaves it to other rules
+	Priority   int    // a server launches a compiler for a higher priority first when its queue is full, 0 by default
+	ServerTag  string // only servers having this tag in ServerTags compile it
+	NoObjCache bool   // a .o is neither looked up in obj cache (of any server) nor saved there
+}
+
+// InvocationPolicy is what Rules decided for a .cpp besides local/remote, see CompileRules.Policy
+type InvocationPolicy struct {
+	Priority   int
+	ServerTag  string
+	NoObjCache bool
+}
+
+// defaultForceLocalRules detect configure tests of build systems: they are tiny, compiling them remotely is slower.
+// Users may add ForceLocal for custom build systems, or ForceRemote to override these.
+var defaultForceLocalRules = []CompileRule{
+	{Cwd: `TryCompile-`},                // cmake
+	{Cwd: `meson-private`},              // meson
+	{Cwd: `\.conf_check`},               // waf
+	{File: `ffconf\.`},                  // ffmpeg
+	{File: `cgo-gcc-input`},             // go
+	{File: `(^|[/\\])conftest[^/\\]*$`}, // autoconf
+	{File: `^tmp\.conftest\.`},          // autoconf
+}
+
+type compiledCompileRule struct {
+	compiler   *regexp.Regexp // nil if not set
+	cwd        *regexp.Regexp
+	file       *regexp.Regexp
+	pathPrefix string
+	arg        *regexp.Regexp
+	args       []*regexp.Regexp
+}
+
+type compiledPolicyRule struct {
+	compiledCompileRule
+	PolicyRule
+	reason string // for `nocc --why`, like "ForceLocal #1 matched"
+}
+
+// CompileRules decide whether a .cpp is compiled locally before sending it to a remote, and where it's sent.
+// Rules are checked first, then user ForceLocal ones, then ForceRemote ones, then defaultForceLocalRules and LocalDebugBuilds.
+// Note, that ForceRemote can't make remote what can't be compiled remotely at all (linking, unsupported options, etc.).
+type CompileRules struct {
+	rules        []compiledPolicyRule // Rules, ForceLocal, ForceRemote and defaults, in order of checking
+	nPolicyRules int                  // rules[:nPolicyRules] are from Rules, others have only Action
+	pins         []compiledCompileRule
+	pinServers   []string            // pinServers[i] is for pins[i]
+	serverTags   map[string][]string // ServerTags from a config, see HasServerTag
+
+	localDebugBuilds bool // see isDebugBuild
+}
+
+func MakeCompileRules(configuration *Configuration) (*CompileRules, error) {
+	rules := &CompileRules{nPolicyRules: len(configuration.Rules), serverTags: configuration.ServerTags, localDebugBuilds: configuration.LocalDebugBuilds}
+
+	for i, rule := range configuration.Rules {
+		if rule.Action != "" && rule.Action != "local" && rule.Action != "remote" {
+			return nil, fmt.Errorf("Rules #%d: unknown Action %q, expected \"local\" or \"remote\"", i+1, rule.Action)
+		}
+		if rule.Action == "" && rule.Priority == 0 && rule.ServerTag == "" && !rule.NoObjCache {
+			return nil, fmt.Errorf("Rules #%d: a rule has no actions", i+1)
+		}
+		if err := rules.appendRule("Rules", i, rule, fmt.Sprintf("Rules #%d matched", i+1)); err != nil {
+			return nil, err
+		}
+	}
+	for i, rule := range configuration.ForceLocal {
+		if err := rules.appendRule("ForceLocal", i, PolicyRule{CompileRule: rule, Action: "local"}, fmt.Sprintf("ForceLocal #%d matched", i+1)); err != nil {
+			return nil, err
+		}
+	}
+	for i, rule := range configuration.ForceRemote {
+		if err := rules.appendRule("ForceRemote", i, PolicyRule{CompileRule: rule, Action: "remote"}, ""); err != nil {
+			return nil, err
+		}
+	}
+	for i, rule := range defaultForceLocalRules {
+		if err := rules.appendRule("defaults", i, PolicyRule{CompileRule: rule, Action: "local"}, "looks like a configure test of a build system"); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, pin := range configuration.PinFiles {
+		compiled, err := compileRule("PinFiles", i, pin.CompileRule)
+		if err != nil {
+			return nil, err
+		}
+		rules.pins = append(rules.pins, compiled)
+		rules.pinServers = append(rules.pinServers, pin.Server)
+	}
+	return rules, nil
+}
+
+func (rules *CompileRules) appendRule(section string, i int, rule PolicyRule, reason string) error {
+	compiled, err := compileRule(section, i, rule.CompileRule)
+	if err != nil {
+		return err
+	}
+	rules.rules = append(rules.rules, compiledPolicyRule{compiledCompileRule: compiled, PolicyRule: rule, reason: reason})
+	return nil
+}
+
+func compileRule(section string, i int, rule CompileRule) (compiledCompileRule, error) {
+	c := compiledCompileRule{pathPrefix: rule.PathPrefix}
+	for _, field := range []struct {
+		dst     **regexp.Regexp
+		pattern string
+	}{{&c.compiler, rule.Compiler}, {&c.cwd, rule.Cwd}, {&c.file, rule.File}, {&c.arg, rule.Arg}} {
+		if field.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(field.pattern)
+		if err != nil {
+			return c, fmt.Errorf("%s #%d: %v", section, i+1, err)
+		}
+		*field.dst = re
+	}
+	for _, pattern := range rule.Args {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return c, fmt.Errorf("%s #%d: %v", section, i+1, err)
+		}
+		c.args = append(c.args, re)
+	}
+	if c.compiler == nil && c.cwd == nil && c.file == nil && c.pathPrefix == "" && c.arg == nil && len(c.args) == 0 {
+		return c, fmt.Errorf("%s #%d: an empty rule would match everything", section, i+1)
+	}
+	return c, nil
+}
+
+func (rule *compiledCompileRule) matches(invocation *Invocation, inFile string) bool {
+	return (rule.compiler == nil || rule.compiler.MatchString(invocation.compilerName)) &&
+		(rule.cwd == nil || rule.cwd.MatchString(invocation.cwd)) &&
+		(rule.file == nil || rule.file.MatchString(inFile)) &&
+		(rule.pathPrefix == "" || strings.HasPrefix(filepath.Clean(common.PathAbs(invocation.cwd, inFile)), rule.pathPrefix)) &&
+		(rule.arg == nil || slices.ContainsFunc(invocation.cmdLine, rule.arg.MatchString)) &&
+		!slices.ContainsFunc(rule.args, func(re *regexp.Regexp) bool { return !slices.ContainsFunc(invocation.cmdLine, re.MatchString) })
+}
+
+// ShouldCompileLocally is called for an input file as in a command line. If rules are nil, only defaults are checked.
+func (rules *CompileRules) ShouldCompileLocally(invocation *Invocation, inFile string) bool {
+	return rules.LocalCompilingReason(invocation, inFile) != ""
+}
+
+// LocalCompilingReason is like ShouldCompileLocally, but tells which rule matched (for `nocc --why`), "" if none.
+func (rules *CompileRules) LocalCompilingReason(invocation *Invocation, inFile string) string {
+	if rules == nil {
+		rules = defaultCompileRules
+	}
+
+	for i := range rules.rules {
+		if rules.rules[i].Action != "" && rules.rules[i].matches(invocation, inFile) {
+			return rules.rules[i].reason // "" for "remote"
+		}
+	}
+	if rules.localDebugBuilds && isDebugBuild(invocation.cmdLine) {
+		return "LocalDebugBuilds: -O0 with debug info"
+	}
+	return ""
+}
+
+// isDebugBuild detects -O0 (or -Og) with debug info, like a compiler does: the last -O wins, and no -O means -O0.
+// Such files are compiled fast, but their .o files are huge, transferring them back is often slower.
+func isDebugBuild(cmdLine []string) bool {
+	optLevel := "0"
+	debugInfo := false
+	for _, arg := range cmdLine {
+		if strings.HasPrefix(arg, "-O") {
+			optLevel = arg[2:]
+		} else if arg == "-g0" {
+			debugInfo = false
+		} else if arg == "-g" || strings.HasPrefix(arg, "-g1") || strings.HasPrefix(arg, "-g2") || strings.HasPrefix(arg, "-g3") ||
+			strings.HasPrefix(arg, "-ggdb") || strings.HasPrefix(arg, "-gdwarf") {
+			debugInfo = true
+		}
+	}
+	return debugInfo && (optLevel == "0" || optLevel == "g")
+}
+
+// Policy collects actions of Rules (except Action) matching a .cpp, see PolicyRule.
+func (rules *CompileRules) Policy(invocation *Invocation) InvocationPolicy {
+	policy := InvocationPolicy{}
+	if rules == nil || len(invocation.inFileArgs) == 0 {
+		return policy
+	}
+
+	for i := range rules.rules[:rules.nPolicyRules] {
+		if !rules.rules[i].matches(invocation, invocation.inFileArgs[0]) {
+			continue
+		}
+		if policy.Priority == 0 {
+			policy.Priority = rules.rules[i].Priority
+		}
+		if policy.ServerTag == "" {
+			policy.ServerTag = rules.rules[i].ServerTag
+		}
+		policy.NoObjCache = policy.NoObjCache || rules.rules[i].NoObjCache
+	}
+	return policy
+}
+
+// HasServerTag tells whether "host:port" has a tag in ServerTags.
+func (rules *CompileRules) HasServerTag(remoteHostPort string, tag string) bool {
+	return rules != nil && slices.Contains(rules.serverTags[remoteHostPort], tag)
+}
+
+// PinnedServer returns "host:port" of a server a .cpp is pinned to by PinFiles, or "" if it's distributed as usual.
+func (rules *CompileRules) PinnedServer(invocation *Invocation) string {
+	if rules == nil || len(invocation.inFileArgs) == 0 {
+		return ""
+	}
+
+	for i := range rules.pins {
+		if rules.pins[i].matches(invocation, invocation.inFileArgs[0]) {
+			return rules.pinServers[i]
+		}
+	}
+	return ""
+}
+
+var defaultCompileRules, _ = MakeCompileRules(&Configuration{})
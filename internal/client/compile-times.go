@@ -0,0 +1,119 @@
+package client
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CompileTimes remembers how long a compiler ran on a server for every .cpp (keyed by a path and compiler args),
+// to predict it next time. A .cpp predicted to compile LongFileTime or longer is "long": it gets a higher priority
+// in server queues (it starts before short ones waiting there) and goes to the least loaded remote instead of its natural one,
+// so that one giant TU doesn't start last on a busy server and finish a build long after others.
+// Durations are kept in CompileTimesFile between daemon launches, if set.
+// It's nil if LongFileTime is not set.
+type CompileTimes struct {
+	mu        sync.Mutex
+	durations map[string]int32 // a key (see compileTimesKey) to milliseconds
+
+	longFileTime time.Duration
+	fileName     string // empty if CompileTimesFile is not set
+}
+
+// compileTimesMaxFiles limits a history, it's reset when exceeded (a daemon serving many projects over months)
+const compileTimesMaxFiles = 200000
+
+func MakeCompileTimes(longFileTimeMs int, fileName string) *CompileTimes {
+	if longFileTimeMs <= 0 {
+		return nil
+	}
+	times := &CompileTimes{
+		durations:    make(map[string]int32),
+		longFileTime: time.Duration(longFileTimeMs) * time.Millisecond,
+		fileName:     fileName,
+	}
+	if fileName != "" {
+		data, err := os.ReadFile(fileName)
+		if err == nil {
+			err = json.Unmarshal(data, &times.durations)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logClient.Error("can't read CompileTimesFile, starting with an empty history:", err)
+			times.durations = make(map[string]int32)
+		}
+	}
+	return times
+}
+
+func compileTimesKey(invocation *Invocation) string {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(invocation.cppInFile))
+	for _, arg := range invocation.compilerArgs {
+		_, _ = hasher.Write([]byte{0})
+		_, _ = hasher.Write([]byte(arg))
+	}
+	return strconv.FormatUint(hasher.Sum64(), 16)
+}
+
+// Record saves a compiler duration reported by a server (not of a .o taken from obj cache)
+func (times *CompileTimes) Record(invocation *Invocation) {
+	if times == nil || invocation.fromObjCache || invocation.compilerDuration <= 0 {
+		return
+	}
+	times.mu.Lock()
+	if len(times.durations) >= compileTimesMaxFiles {
+		times.durations = make(map[string]int32)
+	}
+	times.durations[compileTimesKey(invocation)] = invocation.compilerDuration
+	times.mu.Unlock()
+}
+
+// Predict returns a previous compiler duration of a .cpp, 0 if unknown
+func (times *CompileTimes) Predict(invocation *Invocation) time.Duration {
+	if times == nil {
+		return 0
+	}
+	times.mu.Lock()
+	ms := times.durations[compileTimesKey(invocation)]
+	times.mu.Unlock()
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (times *CompileTimes) IsLong(predicted time.Duration) bool {
+	return times != nil && predicted >= times.longFileTime
+}
+
+// Save writes a history to CompileTimesFile, it's called when a daemon quits
+func (times *CompileTimes) Save() {
+	if times == nil || times.fileName == "" {
+		return
+	}
+	times.mu.Lock()
+	data, err := json.Marshal(times.durations)
+	times.mu.Unlock()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(times.fileName), os.ModePerm)
+	}
+	if err == nil {
+		err = os.WriteFile(times.fileName+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(times.fileName+".tmp", times.fileName)
+	}
+	if err != nil {
+		logClient.Error("can't save CompileTimesFile:", err)
+	}
+}
+
+// sortByLoad orders remotes from the least loaded one (by active sessions to a capacity), stable for equal loads
+func sortByLoad(candidates []*RemoteConnection) []*RemoteConnection {
+	byLoad := make([]*RemoteConnection, len(candidates))
+	copy(byLoad, candidates)
+	sort.SliceStable(byLoad, func(i, j int) bool { return byLoad[i].loadRatio() < byLoad[j].loadRatio() })
+	return byLoad
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// remoteCompilerProbe is a cached result of RemoteConnection.ProbeCompiler.
+// A server launches a compiler to answer, so every (compiler, std, target) is probed once per connection.
+type remoteCompilerProbe struct {
+	compilerName string
+	std          string
+	targetArgs   []string
+
+	once  sync.Once
+	done  atomic.Bool // reply and err are set
+	reply *pb.ProbeCompilerReply
+	err   error
+}
+
+func (remote *RemoteConnection) getCompilerProbe(compilerName string, std string, targetArgs []string) (probe *remoteCompilerProbe, created bool) {
+	key := compilerName + " -std=" + std + " " + strings.Join(targetArgs, " ")
+
+	remote.compilerProbesMu.Lock()
+	defer remote.compilerProbesMu.Unlock()
+	probe = remote.compilerProbes[key]
+	if probe == nil {
+		probe = &remoteCompilerProbe{compilerName: compilerName, std: std, targetArgs: targetArgs}
+		remote.compilerProbes[key] = probe
+		created = true
+	}
+	return probe, created
+}
+
+// ProbeCompiler asks a remote whether its compiler supports -std={std} and a target (-target/-m32/etc.),
+// and what is its version, has it lld, etc.
+// An error means "unknown" (a remote is unavailable, a compiler is not found there, or it's an older nocc-server without this rpc).
+func (remote *RemoteConnection) ProbeCompiler(compilerName string, std string, targetArgs []string) (*pb.ProbeCompilerReply, error) {
+	probe, _ := remote.getCompilerProbe(compilerName, std, targetArgs)
+	remote.runCompilerProbe(probe)
+	return probe.reply, probe.err
+}
+
+func (remote *RemoteConnection) runCompilerProbe(probe *remoteCompilerProbe) {
+	probe.once.Do(func() {
+		defer probe.done.Store(true)
+		if remote.isUnavailable.Load() {
+			probe.err = fmt.Errorf("remote %s is unavailable", remote.remoteHost)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		probe.reply, probe.err = remote.compilationServiceClient.ProbeCompiler(ctx, &pb.ProbeCompilerRequest{
+			ClientID:   remote.clientID,
+			Compiler:   probe.compilerName,
+			Std:        probe.std,
+			TargetArgs: probe.targetArgs,
+		})
+		if probe.err != nil {
+			logClient.Error("can't probe compiler", probe.compilerName, "on", remote.remoteHost, probe.err)
+		}
+	})
+}
+
+// SupportsCompiling is true unless a remote explicitly says that its compiler doesn't support -std={std} or a target.
+// It's called for every compilation, that's why it never waits for a remote: until a probe is done in the background,
+// a remote is supposed to support it (as before probes appeared).
+func (remote *RemoteConnection) SupportsCompiling(compilerName string, std string, targetArgs []string) bool {
+	if std == "" && len(targetArgs) == 0 {
+		return true
+	}
+	probe, created := remote.getCompilerProbe(compilerName, std, targetArgs)
+	if created {
+		go remote.runCompilerProbe(probe)
+	}
+	if !probe.done.Load() {
+		return true
+	}
+	return probe.err != nil || probe.reply.StdSupported && !probe.reply.TargetUnsupported
+}
+
+// reprobeCompilers is called on reconnect: a server could have been restarted with other compilers,
+// and probes failed while it was unavailable; everything probed before is probed again, in the background
+func (remote *RemoteConnection) reprobeCompilers() {
+	remote.compilerProbesMu.Lock()
+	prevProbes := remote.compilerProbes
+	remote.compilerProbes = make(map[string]*remoteCompilerProbe, len(prevProbes))
+	remote.compilerProbesMu.Unlock()
+
+	for _, prev := range prevProbes {
+		probe, created := remote.getCompilerProbe(prev.compilerName, prev.std, prev.targetArgs)
+		if created {
+			go remote.runCompilerProbe(probe)
+		}
+	}
+}
+
+// probeCommandOutput is an output of `nocc --probe-compiler {compiler} [-std=...] [-target ...]`, see HandleDaemonCommand
+func (daemon *Daemon) probeCommandOutput(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("usage: nocc --probe-compiler {compiler} [-std=...] [-target {triple}] [-m32]")
+	}
+	compilerName := args[0]
+	std := ""
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-std=") {
+			std = arg[5:]
+		}
+	}
+	targetArgs := common.ExtractTargetArgs(args[1:])
+
+	b := strings.Builder{}
+	for _, remote := range daemon.getRemoteConnections() {
+		reply, err := remote.ProbeCompiler(compilerName, std, targetArgs)
+		if err != nil {
+			fmt.Fprintf(&b, "%-24s unknown: %v\n", remote.remoteHost, err)
+			continue
+		}
+		fmt.Fprintf(&b, "%-24s %s, lld: %t", remote.remoteHost, reply.Version, reply.HasLld)
+		if std != "" {
+			fmt.Fprintf(&b, ", -std=%s: %t", std, reply.StdSupported)
+		}
+		if len(targetArgs) != 0 {
+			fmt.Fprintf(&b, ", %s: %t (%s)", strings.Join(targetArgs, " "), !reply.TargetUnsupported, reply.Target)
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// LocalCompilerProbes detects a version and a target triple of local compilers.
+// They are sent to a server on session start: objects compiled by another compiler may be incompatible
+// (ABI, codegen), and it would be noticed only at link time or at runtime (see server.CompilerMismatchPolicy).
+// Like on a server, every compiler is probed once, while a daemon is alive.
+type LocalCompilerProbes struct {
+	mu    sync.Mutex
+	table map[string]*localCompilerProbe // key: compiler + target args
+}
+
+type localCompilerProbe struct {
+	once    sync.Once
+	version string // the first line of --version, like "g++ (Debian 12.2.0-14+deb12u1) 12.2.0"
+	target  string // -dumpmachine, like "x86_64-linux-gnu"
+}
+
+func MakeLocalCompilerProbes() *LocalCompilerProbes {
+	return &LocalCompilerProbes{
+		table: make(map[string]*localCompilerProbe),
+	}
+}
+
+func (probes *LocalCompilerProbes) Probe(compilerName string, targetArgs []string) *localCompilerProbe {
+	key := compilerName + " " + strings.Join(targetArgs, " ")
+
+	probes.mu.Lock()
+	probe := probes.table[key]
+	if probe == nil {
+		probe = &localCompilerProbe{}
+		probes.table[key] = probe
+	}
+	probes.mu.Unlock()
+
+	probe.once.Do(func() {
+		if out, err := exec.Command(compilerName, "--version").Output(); err == nil {
+			probe.version, _, _ = strings.Cut(string(out), "\n")
+		}
+		if out, err := exec.Command(compilerName, append(targetArgs, "-dumpmachine")...).Output(); err == nil {
+			probe.target = strings.TrimSpace(string(out))
+		}
+		logClient.Info(1, "probed local compiler", compilerName, targetArgs, "version", probe.version, "target", probe.target)
+	})
+	return probe
+}
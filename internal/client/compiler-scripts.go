@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// CompilerScripts detects compilers that are shell scripts wrapping a real driver, like in Yocto/Buildroot SDKs:
+// > #!/bin/sh
+// > export SDKTARGETSYSROOT=/opt/sdk/sysroots/cortexa53
+// > exec /opt/sdk/bin/aarch64-linux-g++ --sysroot=$SDKTARGETSYSROOT -mcpu=cortex-a53 "$@"
+// For such a compiler, an invocation is parsed as if the real driver was called with injected args (and env),
+// so that --sysroot, a target, etc. are seen (and uploaded/sent), and a driver (not a script) is launched on a server.
+// Only simple scripts are understood: assignments, exports, and `exec` of a driver with "$@"; others are launched as is.
+// A local fallback always launches a script itself.
+type CompilerScripts struct {
+	mu    sync.Mutex
+	table map[string]*compilerScript // key: an abs compiler path
+}
+
+type compilerScript struct {
+	once      sync.Once
+	driver    string   // empty if a compiler is not a script (or a script is not understood)
+	argsFront []string // before "$@"
+	argsBack  []string // after "$@"
+	env       []string // "KEY=VALUE"
+}
+
+// maxCompilerScriptSize is a limit to consider a compiler a wrapper script, not a binary or a huge script
+const maxCompilerScriptSize = 16 * 1024
+
+// notResolvedDrivers are launchers that can't be treated as a driver: they take a compiler as the first arg
+var notResolvedDrivers = []string{"ccache", "sccache", "distcc", "icecc", "nocc"}
+
+func MakeCompilerScripts() *CompilerScripts {
+	return &CompilerScripts{
+		table: make(map[string]*compilerScript),
+	}
+}
+
+// maxCompilerScriptsDepth limits resolving a driver that is a script itself
+const maxCompilerScriptsDepth = 4
+
+// ResolveCmdLine replaces invocation.compilerName with a real driver if it's a wrapper script,
+// and returns cmdLine with args injected by a script; env injected by a script is appended to invocation.compilerEnv
+func (scripts *CompilerScripts) ResolveCmdLine(invocation *Invocation, cmdLine []string) []string {
+	for range maxCompilerScriptsDepth {
+		script := scripts.resolve(invocation)
+		if script == nil {
+			break
+		}
+		invocation.compilerName = script.driver
+		invocation.compilerEnv = append(slices.Clip(invocation.compilerEnv), script.env...)
+		cmdLine = slices.Concat(script.argsFront, cmdLine, script.argsBack)
+	}
+	return cmdLine
+}
+
+// resolve returns a parsed script if invocation.compilerName is a wrapper script, nil otherwise
+func (scripts *CompilerScripts) resolve(invocation *Invocation) *compilerScript {
+	compilerPath := lookupCompilerPath(invocation)
+	if compilerPath == "" {
+		return nil
+	}
+
+	scripts.mu.Lock()
+	script := scripts.table[compilerPath]
+	if script == nil {
+		script = &compilerScript{}
+		scripts.table[compilerPath] = script
+	}
+	scripts.mu.Unlock()
+
+	script.once.Do(func() {
+		err := script.parse(compilerPath)
+		if err != nil {
+			logClient.Info(0, "compiler", compilerPath, "is a script not understood, it's launched as is:", err)
+		} else if script.driver != "" {
+			logClient.Info(0, "compiler", compilerPath, "is a script, driver", script.driver, "args", script.argsFront, script.argsBack, "env", script.env)
+		}
+	})
+	if script.driver == "" {
+		return nil
+	}
+	return script
+}
+
+// parse leaves script.driver empty if a file is not a script; an error means a script that can't be resolved
+func (script *compilerScript) parse(compilerPath string) error {
+	contents, err := readCompilerScript(compilerPath)
+	if contents == nil || err != nil {
+		return err
+	}
+
+	scriptDir := filepath.Dir(compilerPath)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Scan() // #!/bin/sh
+	var env []string
+	var execWords []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "set ") {
+			continue
+		}
+		if execWords != nil {
+			return fmt.Errorf("unexpected line after exec: %s", line)
+		}
+		words, err := splitScriptWords(line, scriptDir, env)
+		if err != nil {
+			return err
+		}
+		if words[0] == "export" {
+			words = words[1:]
+		}
+		for len(words) > 0 && isScriptAssignment(words[0]) {
+			env = append(env, words[0])
+			words = words[1:]
+		}
+		if len(words) > 0 && words[0] == "exec" {
+			execWords = words[1:]
+		} else if len(words) > 0 {
+			return fmt.Errorf("unexpected line: %s", line)
+		}
+	}
+
+	argsAt := slices.Index(execWords, scriptArgsMarker)
+	if len(execWords) == 0 || argsAt <= 0 || slices.Contains(execWords[argsAt+1:], scriptArgsMarker) {
+		return fmt.Errorf("no exec of a compiler with \"$@\"")
+	}
+	if slices.Contains(notResolvedDrivers, filepath.Base(execWords[0])) {
+		return fmt.Errorf("%s is not a compiler driver", execWords[0])
+	}
+
+	script.argsFront = execWords[1:argsAt]
+	script.argsBack = execWords[argsAt+1:]
+	script.env = env
+	script.driver = execWords[0]
+	return nil
+}
+
+// readCompilerScript returns nil if a file is not a shell script
+func readCompilerScript(compilerPath string) ([]byte, error) {
+	stat, err := os.Stat(compilerPath)
+	if err != nil || stat.Size() > maxCompilerScriptSize {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(compilerPath)
+	if err != nil || !bytes.HasPrefix(contents, []byte("#!")) {
+		return nil, nil
+	}
+	shebang, _, _ := strings.Cut(string(contents[2:]), "\n")
+	interpreter := strings.Fields(shebang)
+	if len(interpreter) > 1 && filepath.Base(interpreter[0]) == "env" {
+		interpreter = interpreter[1:]
+	}
+	if len(interpreter) == 0 || !slices.Contains([]string{"sh", "bash", "dash"}, filepath.Base(interpreter[0])) {
+		return nil, nil
+	}
+	return contents, nil
+}
+
+// scriptArgsMarker replaces "$@" in words of a script
+const scriptArgsMarker = "\x00@"
+
+func isScriptAssignment(word string) bool {
+	name, _, found := strings.Cut(word, "=")
+	return found && name != "" && !strings.ContainsAny(name, "-/.$")
+}
+
+// splitScriptWords splits a line like a shell, but without expansions except "$@", a script dir and variables assigned above
+func splitScriptWords(original string, scriptDir string, env []string) ([]string, error) {
+	line := original
+	for _, dirExpr := range []string{`"$(dirname "$0")"`, `$(dirname "$0")`, `$(dirname $0)`, "`dirname $0`", `${0%/*}`} {
+		line = strings.ReplaceAll(line, dirExpr, scriptDir)
+	}
+	for _, argsExpr := range []string{`"$@"`, `"${@}"`, `$@`} {
+		line = strings.ReplaceAll(line, argsExpr, scriptArgsMarker)
+	}
+
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote: %s", original)
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += 1 + end
+		case c == '"':
+			end := strings.IndexByte(line[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote: %s", original)
+			}
+			expanded, err := expandScriptVars(line[i+1:i+1+end], env)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(expanded)
+			i += 1 + end
+		case c == '\\' && i+1 < len(line):
+			word.WriteByte(line[i+1])
+			i++
+		case c == '$':
+			end := i + 1
+			if end < len(line) && line[end] == '{' {
+				end = i + strings.IndexByte(line[i:], '}') + 1
+				if end == i {
+					return nil, fmt.Errorf("unterminated ${: %s", original)
+				}
+			} else {
+				for end < len(line) && (line[end] == '_' || isAlnum(line[end])) {
+					end++
+				}
+			}
+			expanded, err := expandScriptVars(line[i:end], env)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(expanded)
+			i = end - 1
+		case c == '`' || c == ';' || c == '|' || c == '&' || c == '<' || c == '>' || c == '(' || c == ')':
+			return nil, fmt.Errorf("unsupported shell syntax: %s", original)
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty line")
+	}
+	return words, nil
+}
+
+// expandScriptVars expands $VAR and ${VAR} assigned in a script above or set in a daemon env (like PATH);
+// other variables (and other expansions, like ${VAR:-default}) make a script not understood
+func expandScriptVars(s string, env []string) (string, error) {
+	var unknown error
+	expanded := os.Expand(s, func(name string) string {
+		for i := len(env) - 1; i >= 0; i-- {
+			if value, found := strings.CutPrefix(env[i], name+"="); found {
+				return value
+			}
+		}
+		if value, found := os.LookupEnv(name); found {
+			return value
+		}
+		unknown = fmt.Errorf("unsupported variable $%s", name)
+		return ""
+	})
+	return expanded, unknown
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -3,19 +3,82 @@ package client
 import (
 	"runtime"
 	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"nocc/internal/common"
 
 	"github.com/BurntSushi/toml"
 )
 
+const logLevelNotSet = -2
+
+// a command line / env override options of a config file (e.g. `NOCC_SERVERS=... nocc-daemon`), see applyCmdEnvOverrides
+var (
+	cmdServers = common.CmdEnvString("Remote nocc servers, separated by ';', overrides Servers.", "",
+		"NOCC_SERVERS", "servers")
+	cmdClientID = common.CmdEnvString("A clientID sent to servers, overrides ClientID.", "",
+		"NOCC_CLIENT_ID", "client-id")
+	cmdSocksProxyAddr = common.CmdEnvString("A socks5 proxy address, overrides SocksProxyAddr.", "",
+		"NOCC_SOCKS_PROXY", "socks-proxy")
+	cmdSchedulerAddr = common.CmdEnvString("A nocc-scheduler address, overrides SchedulerAddr.", "",
+		"NOCC_SCHEDULER", "scheduler")
+	cmdPriorityClass = common.CmdEnvString("A priority class of sessions on servers (interactive / batch), overrides PriorityClass.", "",
+		"NOCC_PRIORITY_CLASS", "priority-class")
+	cmdLogLevel = common.CmdEnvInt("Logger verbosity level for INFO (-1 off, 0, 1, 2), overrides LogLevel.", logLevelNotSet,
+		"NOCC_LOG_LEVEL", "log-level")
+)
+
 type Configuration struct {
 	ClientID          string
 	SocksProxyAddr    string
 	CompilerQueueSize int
-	Servers           []string
+	MaxObjWrites      int    // received .o files written to a disk in parallel, 0 means no limit
+	MaxSessionsPerRemote int // sessions running on one remote at the same moment, 0 means no limit, see RemoteSessionLimits
+	MaxRemoteSessions    int // sessions running on all remotes at the same moment, 0 means no limit
+	AdaptiveLocal        bool  // if set, small files are compiled locally while remotes are saturated, see AdaptiveSplit
+	AdaptiveLocalMaxSize int64 // a .cpp never compiled locally before is small for AdaptiveLocal if it's not larger, in bytes
+	LongFileTime         int    // milliseconds, a .cpp compiled longer last time is scheduled first, 0 means off, see CompileTimes
+	CompileTimesFile     string // if set, compile times are kept there between daemon launches
+	StatsFile            string // if set, totals of recent daemon launches are kept there, see StatsHistory
+	Jobserver            bool   // if set, local compilations take tokens of a make/ninja jobserver `nocc` runs under, see Jobservers
+	MaxObjSize        int64  // a larger .o (with a BMI and side outputs) is not received but compiled locally, 0 means no limit
+	DependModeDir     string // if set, manifests and .o copies are saved there, see DependCache
+	UploadToolchain   bool   // if set, a local compiler is uploaded and launched on servers, see Toolchains
+	Servers           []string // "host:port", or sources of servers "srv:{dns name}" / "file:{path}", see ServerDiscovery
+	DiscoveryInterval int      // seconds between re-resolving sources of Servers
+	SchedulerAddr     string   // "host:port" of a nocc-scheduler choosing remotes, see CentralScheduler
+	PriorityClass     string   // "interactive" / "batch" / empty (default), servers launch compilers of a higher class first
 	LogFileName       string
 	LogLevel          int
+	LogMaxFieldLength int    // longer log fields (e.g. compiler args) are truncated, 0 means no limit
+	LogMaxLineLength  int    // longer log lines are truncated, 0 means no limit
+	LogFullFieldsDir  string // if set, truncated log fields are dumped there in full
 	InvocationTimeout int
+	ObjWaitTimeout    int // waiting for .o is aborted after it without progress, see WaitForCompiledObj
 	ConnectionTimeout int
+	TracingEndpoint   string
+	TimelineFileName  string
+	ServerCosts       map[string]int // "host:port" (as in Servers) to a relative cost, 0 by default
+	ServerTags        map[string][]string // "host:port" to tags, like ["big-ram"], for ServerTag of Rules
+	CacheProbeRemotes int            // remotes asked whether a .o is in their obj cache before compiling, 0 or 1 means only a chosen one
+	WriteProvenance   bool           // if set, {obj}.provenance.json is written next to every received .o
+	ProvenanceKeys    []string       // PEM files with ed25519 public keys of servers; if set, unsigned objects are compiled locally
+	Rules             []PolicyRule   // match invocations and apply actions to them, see PolicyRule
+	ForceLocal        []CompileRule  // invocations compiled locally, in addition to detected configure tests, see CompileRules
+	ForceRemote       []CompileRule  // invocations never considered configure tests
+	PinFiles          []PinRule      // .cpp files always sent to a specific server, see CompileRules.PinnedServer
+	LocalDebugBuilds  bool           // if set, -O0 -g files are compiled locally, see isDebugBuild
+	ReproDir          string         // if set, files failed remotely but compiled locally are saved there, see ReproRecorder
+	QuarantineTime    int            // a server producing bad objects is not used for it, 0 means never, see ServerQuarantine
+	QuarantineAfter   int            // compiler crashes on a server (while a file compiles locally) that quarantine it
+	BaseDir           string         // absolute paths under it are relative in obj cache keys and depfiles, see rewriteArgsUnderBaseDir
+	SystemHeaderDirs  []string       // like ["/usr/include"], not uploaded to servers having the same, see calcSystemHeaderDirs
+	Snapshots         []string       // names of toolchain snapshots registered on servers, see remoteSnapshot
+	OnDemandIncludes  bool           // if set, servers read includes on demand instead of receiving them, see OnDemandIncludes
+
+	ReportBuildSummaries bool
 }
 
 func ParseConfiguration(filePath string) (*Configuration, error) {
@@ -24,22 +87,125 @@ func ParseConfiguration(filePath string) (*Configuration, error) {
 		Servers:           []string{"localhost:43210"},
 		LogFileName:       "stderr",
 		LogLevel:          0,
+		LogMaxFieldLength: 4096,
+		LogMaxLineLength:  32768,
 		InvocationTimeout: 15 * 60, // 15 minutes
+		ObjWaitTimeout:    60,      // 1 minute
 		ConnectionTimeout: 15,      // 15 seconds
+		DiscoveryInterval: 30,
+		AdaptiveLocalMaxSize: 16 * 1024,
+		QuarantineAfter:   3,
 		ClientID:          "",
 	}
 
 	if _, err := toml.DecodeFile(filePath, &config); err != nil {
 		return nil, err
 	}
+	applyCmdEnvOverrides(&config)
 
 	if err := detectDuplicateServers(config.Servers); err != nil {
 		return nil, err
         }
 
+	if err := detectUnknownServerCosts(config.Servers, config.ServerCosts); err != nil {
+		return nil, err
+	}
+
+	if err := detectUnknownPinnedServers(config.Servers, config.PinFiles); err != nil {
+		return nil, err
+	}
+
+	if err := detectUnknownServerTags(config.Servers, config.ServerTags, config.Rules); err != nil {
+		return nil, err
+	}
+
+	if config.DiscoveryInterval <= 0 {
+		return nil, fmt.Errorf("DiscoveryInterval: must be positive")
+	}
+
+	if common.PriorityClassRank(config.PriorityClass) == -1 {
+		return nil, fmt.Errorf("PriorityClass: unknown %q, expected %q, %q or %q", config.PriorityClass,
+			common.PriorityClassInteractive, common.PriorityClassDefault, common.PriorityClassBatch)
+	}
+
+	if config.BaseDir != "" && !filepath.IsAbs(config.BaseDir) {
+		return nil, fmt.Errorf("BaseDir: %s is not an absolute path", config.BaseDir)
+	}
+
+	for _, dir := range config.SystemHeaderDirs {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("SystemHeaderDirs: %s is not an absolute path", dir)
+		}
+	}
+
 	return &config, nil
 }
 
+// applyCmdEnvOverrides must be called after common.ParseCmdFlagsCombiningWithEnv
+func applyCmdEnvOverrides(config *Configuration) {
+	if *cmdServers != "" {
+		config.Servers = strings.Split(*cmdServers, ";")
+	}
+	if *cmdClientID != "" {
+		config.ClientID = *cmdClientID
+	}
+	if *cmdSocksProxyAddr != "" {
+		config.SocksProxyAddr = *cmdSocksProxyAddr
+	}
+	if *cmdSchedulerAddr != "" {
+		config.SchedulerAddr = *cmdSchedulerAddr
+	}
+	if *cmdPriorityClass != "" {
+		config.PriorityClass = *cmdPriorityClass
+	}
+	if *cmdLogLevel != logLevelNotSet {
+		config.LogLevel = *cmdLogLevel
+	}
+}
+
+func detectUnknownServerCosts(servers []string, serverCosts map[string]int) error {
+	for server := range serverCosts {
+		if !slices.Contains(servers, server) {
+			return fmt.Errorf("ServerCosts: %s is not listed in Servers", server)
+		}
+	}
+
+	return nil
+}
+
+func detectUnknownPinnedServers(servers []string, pinFiles []PinRule) error {
+	for _, pin := range pinFiles {
+		if !slices.Contains(servers, pin.Server) {
+			return fmt.Errorf("PinFiles: %s is not listed in Servers", pin.Server)
+		}
+	}
+
+	return nil
+}
+
+func detectUnknownServerTags(servers []string, serverTags map[string][]string, rules []PolicyRule) error {
+	for server := range serverTags {
+		if !slices.Contains(servers, server) {
+			return fmt.Errorf("ServerTags: %s is not listed in Servers", server)
+		}
+	}
+
+	for i, rule := range rules {
+		if rule.ServerTag == "" {
+			continue
+		}
+		hasTag := false
+		for _, tags := range serverTags {
+			hasTag = hasTag || slices.Contains(tags, rule.ServerTag)
+		}
+		if !hasTag {
+			return fmt.Errorf("Rules #%d: no server has tag %q in ServerTags", i+1, rule.ServerTag)
+		}
+	}
+
+	return nil
+}
+
 func detectDuplicateServers(servers []string) error {
 	mapDuplicate := make(map[string]bool)
 
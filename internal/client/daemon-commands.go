@@ -0,0 +1,115 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Besides compiler invocations, `nocc` can send commands to a daemon, like `nocc --stats`.
+// A command is sent via the same unix socket with an empty compiler: parts are Cwd, "", command, args (see onRequest).
+// Its output is returned as stdout in a regular response.
+
+func (daemon *Daemon) HandleDaemonCommand(req DaemonSockRequest) DaemonSockResponse {
+	switch req.CmdLine[0] {
+	case "stats":
+		return daemonCommandOutput(daemon.statsCommandOutput())
+	case "check-servers":
+		return daemon.checkServersCommand()
+	case "add-server":
+		output, err := daemon.addServerCommandOutput(req.CmdLine[1:])
+		if err != nil {
+			return daemonCommandError(err)
+		}
+		return daemonCommandOutput(output)
+	case "drain-server":
+		output, err := daemon.drainServerCommandOutput(req.CmdLine[1:])
+		if err != nil {
+			return daemonCommandError(err)
+		}
+		return daemonCommandOutput(output)
+	case "servers":
+		output, err := daemon.serversCommandOutput(req)
+		if err != nil {
+			return daemonCommandError(err)
+		}
+		return daemonCommandOutput(output)
+	case "probe-compiler":
+		output, err := daemon.probeCommandOutput(req.CmdLine[1:])
+		if err != nil {
+			return daemonCommandError(err)
+		}
+		return daemonCommandOutput(output)
+	case "repro":
+		output, err := daemon.reproCommandOutput(req)
+		if err != nil {
+			return daemonCommandError(err)
+		}
+		return daemonCommandOutput(output)
+	case "why":
+		output, err := daemon.whyCommandOutput(req)
+		if err != nil {
+			return daemonCommandError(err)
+		}
+		return daemonCommandOutput(output)
+	default:
+		return daemonCommandError(fmt.Errorf("unknown daemon command: %s", req.CmdLine[0]))
+	}
+}
+
+func (daemon *Daemon) statsCommandOutput() string {
+	b := strings.Builder{}
+	b.WriteString(daemon.stats.ToHumanReadableString(daemon))
+
+	// unlike stats of invocations, these are counters of real traffic (including failed sessions)
+	b.WriteString("\nnetwork per remote:\n")
+	degraded := make([]string, 0)
+	for _, remote := range daemon.getRemoteConnections() {
+		fmt.Fprintf(&b, "  %-30s uploaded %d files (%d bytes), received %d obj (%d bytes)", remote.remoteHost,
+			remote.transfer.nFilesUploaded.Load(), remote.transfer.nBytesUploaded.Load(),
+			remote.transfer.nObjReceived.Load(), remote.transfer.nBytesReceived.Load())
+		if connectedAddr := remote.grpcClient.ConnectedAddr(); connectedAddr != "" {
+			fmt.Fprintf(&b, ", over %s", addrFamily(connectedAddr))
+		}
+		if remote.cacheOnly.Load() {
+			b.WriteString(", cache only")
+		}
+		if daemon.serverQuarantine.IsQuarantined(remote.remoteHostPort) {
+			b.WriteString(", quarantined")
+		}
+		b.WriteString("\n")
+		if remote.cacheDegraded.Load() {
+			degraded = append(degraded, remote.remoteHost)
+		}
+	}
+	if len(degraded) > 0 {
+		fmt.Fprintf(&b, "\nfarm is degraded: %d of %d remotes fail to save to their caches: %s\n",
+			len(degraded), len(daemon.getRemoteConnections()), strings.Join(degraded, ", "))
+	}
+	daemon.serverQuarantine.WriteStats(&b)
+
+	groups := daemon.buildGroups.AllGroups()
+	if len(groups) > 1 {
+		sort.Slice(groups, func(i, j int) bool { return groups[i].buildID < groups[j].buildID })
+		b.WriteString("\nper build:\n")
+		for _, group := range groups {
+			fmt.Fprintf(&b, "  %s\n    %s\n", group.buildID, group.stats.ToShortString())
+		}
+	}
+	daemon.statsHistory.WriteTotals(&b, daemon.stats.toStatsRun(daemon.startTime))
+	return b.String()
+}
+
+func daemonCommandOutput(stdout string) DaemonSockResponse {
+	return DaemonSockResponse{
+		ExitCode: 0,
+		Stdout:   []byte(stdout),
+	}
+}
+
+func daemonCommandError(err error) DaemonSockResponse {
+	return DaemonSockResponse{
+		ExitCode: 1,
+		Stderr:   []byte(fmt.Sprintf("[nocc] %v\n", err)),
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ReloadConfiguration re-reads a config file on SIGHUP, so that changing a list of servers or a queue size
+// doesn't require restarting a daemon (losing includes cache and stats of running builds).
+// Applied are: Servers, ServerCosts, CompilerQueueSize, InvocationTimeout, ObjWaitTimeout, Rules, ServerTags, ForceLocal, ForceRemote, PinFiles, LocalDebugBuilds; other options need a restart.
+func (daemon *Daemon) ReloadConfiguration() {
+	configuration, err := ParseConfiguration(daemon.configFileName)
+	if err != nil {
+		logClient.Error("config not reloaded:", err)
+		return
+	}
+	// like on a server, 0 can't be applied: invocations already compiling locally would wait for a slot forever
+	if (configuration.CompilerQueueSize == 0) != daemon.disableLocalCompiler {
+		logClient.Error("config not reloaded: CompilerQueueSize can't be changed from/to 0 without a restart")
+		return
+	}
+	compileRules, err := MakeCompileRules(configuration)
+	if err != nil {
+		logClient.Error("config not reloaded:", err)
+		return
+	}
+
+	daemon.compileRules.Store(compileRules)
+
+	daemon.localCompilerQueue.SetCapacity(configuration.CompilerQueueSize)
+	daemon.invocationTimeout.Store(int64(time.Duration(configuration.InvocationTimeout) * time.Second))
+	daemon.objWaitTimeout.Store(int64(time.Duration(configuration.ObjWaitTimeout) * time.Second))
+	serverDiscovery := MakeServerDiscovery(configuration.Servers)
+	daemon.serverDiscovery.Store(serverDiscovery)
+	daemon.updateRemoteConnections(resolveServers(serverDiscovery, configuration.Servers), configuration.ServerCosts)
+
+	logClient.Info(0, "config reloaded:", "num servers", len(configuration.Servers), "; compiler queue size", configuration.CompilerQueueSize)
+}
+
+// updateRemoteConnections replaces servers and their costs, see replaceRemoteConnections
+func (daemon *Daemon) updateRemoteConnections(servers []string, serverCosts map[string]int) {
+	daemon.remotesUpdateMu.Lock()
+	defer daemon.remotesUpdateMu.Unlock()
+
+	daemon.serverCosts = serverCosts // read by MakeRemoteConnection
+	daemon.replaceRemoteConnections(servers)
+}
+
+// updateRemoteServers changes servers keeping their costs: update gets current servers and returns new ones.
+// It's done under a lock, so that concurrent commands and discovery don't lose each other's changes.
+func (daemon *Daemon) updateRemoteServers(update func(servers []string) ([]string, error)) error {
+	daemon.remotesUpdateMu.Lock()
+	defer daemon.remotesUpdateMu.Unlock()
+
+	daemon.mu.RLock()
+	servers := slices.Clone(daemon.remoteNoccHosts)
+	daemon.mu.RUnlock()
+	servers, err := update(servers)
+	if err != nil {
+		return err
+	}
+	daemon.replaceRemoteConnections(servers)
+	return nil
+}
+
+// replaceRemoteConnections connects to added servers and replaces daemon.remoteConnections; called under remotesUpdateMu.
+// Remotes left in config keep their connections (and state like compiler probes), only their cost is updated.
+// Removed ones are closed after their active sessions finish.
+func (daemon *Daemon) replaceRemoteConnections(servers []string) {
+	current := make(map[string]*RemoteConnection)
+	for _, remote := range daemon.getRemoteConnections() {
+		current[remote.remoteHostPort] = remote
+	}
+	serverCosts := daemon.serverCosts
+
+	updated := make([]*RemoteConnection, len(servers))
+	wg := sync.WaitGroup{}
+	for index, remoteHostPort := range servers {
+		if remote := current[remoteHostPort]; remote != nil {
+			remote.cost.Store(int32(serverCosts[remoteHostPort]))
+			updated[index] = remote
+			continue
+		}
+
+		wg.Add(1)
+		go func(index int, remoteHostPort string) {
+			remote := MakeRemoteConnection(daemon, remoteHostPort, daemon.socksProxyAddr)
+			updated[index] = remote
+			err := remote.SetupConnection(true)
+
+			if err != nil {
+				remote.OnRemoteBecameUnavailable(err)
+				logClient.Error("error connecting to", remoteHostPort, err)
+			}
+			logClient.Info(0, "remote", remoteHostPort, "added")
+
+			wg.Done()
+		}(index, remoteHostPort)
+	}
+	wg.Wait()
+
+	daemon.mu.Lock()
+	daemon.remoteConnections = updated
+	daemon.remoteNoccHosts = servers
+	daemon.mu.Unlock()
+
+	for remoteHostPort, remote := range current {
+		if !slices.Contains(servers, remoteHostPort) {
+			go daemon.closeRemoteWhenIdle(remote)
+		}
+	}
+}
+
+// closeRemoteWhenIdle closes a removed remote after its active sessions finish.
+// If the same server was added back meanwhile, its new connection has the same clientID:
+// then StopClient isn't sent, it would stop that client on a server.
+func (daemon *Daemon) closeRemoteWhenIdle(remote *RemoteConnection) {
+	remote.waitUntilIdle(time.Duration(daemon.invocationTimeout.Load()))
+
+	daemon.remotesUpdateMu.Lock()
+	defer daemon.remotesUpdateMu.Unlock()
+
+	readded := slices.ContainsFunc(daemon.getRemoteConnections(), func(current *RemoteConnection) bool {
+		return current.remoteHostPort == remote.remoteHostPort
+	})
+	if readded {
+		close(remote.quitChan)
+		remote.Clear()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		remote.Close(ctx, false)
+	}
+	logClient.Info(0, "remote", remote.remoteHostPort, "removed")
+}
+
+// addServerCommandOutput handles `nocc --add-server {host:port}`: a remote is connected to without restarting a daemon
+// (useful for long-lived daemons of CI agents). It's appended to the end of servers, so that files of other remotes
+// stay mostly where they were. Like all changes made by commands, it's lost on SIGHUP, when Servers are re-read from config.
+func (daemon *Daemon) addServerCommandOutput(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: nocc --add-server {host:port}")
+	}
+	remoteHostPort := args[0]
+	if _, _, err := net.SplitHostPort(remoteHostPort); err != nil {
+		return "", fmt.Errorf("invalid server %s: %v", remoteHostPort, err)
+	}
+
+	nServers := 0
+	err := daemon.updateRemoteServers(func(servers []string) ([]string, error) {
+		if slices.Contains(servers, remoteHostPort) {
+			return nil, fmt.Errorf("%s is already in servers", remoteHostPort)
+		}
+		nServers = len(servers) + 1
+		return append(servers, remoteHostPort), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, remote := range daemon.getRemoteConnections() {
+		if remote.remoteHostPort == remoteHostPort && remote.isUnavailable.Load() {
+			return fmt.Sprintf("%s added, but it's unavailable now, it's reconnected to in background\n", remoteHostPort), nil
+		}
+	}
+	return fmt.Sprintf("%s added, %d servers\n", remoteHostPort, nServers), nil
+}
+
+// drainServerCommandOutput handles `nocc --drain-server {host:port}`: a remote isn't chosen for new invocations anymore,
+// and it's disconnected after files being compiled there are done (like a server removed from config on reload).
+func (daemon *Daemon) drainServerCommandOutput(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: nocc --drain-server {host:port}")
+	}
+	remoteHostPort := args[0]
+
+	nServers := 0
+	err := daemon.updateRemoteServers(func(servers []string) ([]string, error) {
+		index := slices.Index(servers, remoteHostPort)
+		if index == -1 {
+			return nil, fmt.Errorf("%s is not in servers", remoteHostPort)
+		}
+		nServers = len(servers) - 1
+		return slices.Delete(servers, index, index+1), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s is draining, %d servers left\n", remoteHostPort, nServers), nil
+}
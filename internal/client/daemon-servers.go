@@ -0,0 +1,251 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"nocc/pb"
+)
+
+// remoteStatusTimeout limits waiting for every remote in `nocc --check-servers`, they are queried in parallel
+const remoteStatusTimeout = 3 * time.Second
+
+type remoteStatus struct {
+	remoteHostPort string
+	reply          *pb.StatusReply
+	rtt            time.Duration // of a second Status call, the first one also establishes a connection
+	err            error
+}
+
+// queryRemoteStatus calls Status over a new connection, not over a remote one:
+// a remote considered unavailable by a daemon is checked too, and a check doesn't interfere with its streams.
+func queryRemoteStatus(remoteHostPort string, socksProxyAddr string) remoteStatus {
+	grpcClient, err := MakeGRPCClient(remoteHostPort, socksProxyAddr)
+	if err != nil {
+		return remoteStatus{remoteHostPort: remoteHostPort, err: err}
+	}
+	defer grpcClient.Clear()
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteStatusTimeout)
+	defer cancel()
+	csc := pb.NewCompilationServiceClient(grpcClient.connection)
+	if _, err := csc.Status(ctx, &pb.StatusRequest{}); err != nil {
+		return remoteStatus{remoteHostPort: remoteHostPort, err: err}
+	}
+	start := time.Now()
+	reply, err := csc.Status(ctx, &pb.StatusRequest{})
+	return remoteStatus{remoteHostPort: remoteHostPort, reply: reply, rtt: time.Since(start), err: err}
+}
+
+// queryAllRemoteStatuses queries all remotes of a daemon in parallel, the order is the same as of Servers in config
+func (daemon *Daemon) queryAllRemoteStatuses() []remoteStatus {
+	remotes := daemon.getRemoteConnections()
+	statuses := make([]remoteStatus, len(remotes))
+	wg := sync.WaitGroup{}
+	for i, remote := range remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = queryRemoteStatus(remote.remoteHostPort, daemon.socksProxyAddr)
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// checkServersCommand handles `nocc --check-servers`: every remote is asked for its Status,
+// a response exits with 1 if any of them doesn't respond (to be used in scripts before starting a build).
+func (daemon *Daemon) checkServersCommand() DaemonSockResponse {
+	statuses := daemon.queryAllRemoteStatuses()
+	if len(statuses) == 0 {
+		return daemonCommandError(fmt.Errorf("no remotes in Servers"))
+	}
+
+	b := strings.Builder{}
+	nFailed := 0
+	for _, status := range statuses {
+		if status.err != nil {
+			nFailed++
+			fmt.Fprintf(&b, "  %-30s FAILED: %v\n", status.remoteHostPort, status.err)
+			continue
+		}
+		reply := status.reply
+		fmt.Fprintf(&b, "  %-30s ok, %s, %d/%d compilers busy, %d waiting", status.remoteHostPort,
+			reply.ServerVersion, reply.CompilersRunning, reply.CompilerQueueSize, reply.CompilersWaiting)
+		if reply.CacheOnly {
+			b.WriteString(", cache only")
+		}
+		if reply.CacheDegraded {
+			b.WriteString(", degraded")
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%d of %d remotes are ok\n", len(statuses)-nFailed, len(statuses))
+
+	response := daemonCommandOutput(b.String())
+	if nFailed > 0 {
+		response.ExitCode = 1
+	}
+	return response
+}
+
+// serversCommandOutput handles `nocc --servers [--bench [{compiler}]]`: every remote is asked for its Status,
+// and a version, an RTT, a load and cache stats are printed along with how a daemon sees it (unavailable, quarantined, etc.).
+// With --bench, a small .cpp is compiled on every remote one by one (bypassing obj cache), to validate a cluster end to end.
+func (daemon *Daemon) serversCommandOutput(req DaemonSockRequest) (string, error) {
+	args := req.CmdLine[1:]
+	bench := len(args) > 0 && args[0] == "--bench"
+	benchCompiler := "g++"
+	if bench && len(args) > 1 {
+		benchCompiler = args[1]
+	} else if !bench && len(args) > 0 {
+		return "", fmt.Errorf("usage: nocc --servers [--bench [{compiler}]]")
+	}
+
+	remotes := daemon.getRemoteConnections()
+	statuses := daemon.queryAllRemoteStatuses()
+	if len(statuses) == 0 {
+		return "", fmt.Errorf("no remotes in Servers")
+	}
+
+	var benchDir string
+	if bench {
+		var err error
+		if benchDir, err = os.MkdirTemp("", "nocc-bench-"); err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(benchDir)
+		if err = os.WriteFile(filepath.Join(benchDir, "nocc-bench.cpp"), []byte(benchmarkSource), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	b := strings.Builder{}
+	for i, status := range statuses {
+		remote := remotes[i]
+		fmt.Fprintf(&b, "%s\n", status.remoteHostPort)
+		if status.err != nil {
+			fmt.Fprintf(&b, "  FAILED: %v\n", status.err)
+			continue
+		}
+
+		reply := status.reply
+		fmt.Fprintf(&b, "  version:   %s, uptime %s\n", reply.ServerVersion, (time.Duration(reply.UptimeSec) * time.Second).String())
+		fmt.Fprintf(&b, "  rtt:       %.2f ms\n", float64(status.rtt.Microseconds())/1000)
+		fmt.Fprintf(&b, "  load:      %d/%d compilers busy, %d waiting, %d clients\n", reply.CompilersRunning, reply.CompilerQueueSize, reply.CompilersWaiting, reply.ActiveClients)
+		fmt.Fprintf(&b, "  src cache: %d MB, %s free on disk\n", reply.SrcCacheBytes/1024/1024, formatFreeDiskMB(reply.SrcCacheFreeDisk))
+		fmt.Fprintf(&b, "  obj cache: %d MB, %s free on disk\n", reply.ObjCacheBytes/1024/1024, formatFreeDiskMB(reply.ObjCacheFreeDisk))
+
+		flags := make([]string, 0)
+		if remote.isUnavailable.Load() {
+			flags = append(flags, "unavailable for a daemon")
+		}
+		if daemon.serverQuarantine.IsQuarantined(remote.remoteHostPort) {
+			flags = append(flags, "quarantined")
+		}
+		if reply.CacheOnly {
+			flags = append(flags, "cache only")
+		}
+		if reply.CacheDegraded {
+			flags = append(flags, "degraded")
+		}
+		if len(flags) > 0 {
+			fmt.Fprintf(&b, "  state:     %s\n", strings.Join(flags, ", "))
+		}
+
+		if bench && !reply.CacheOnly {
+			duration, err := daemon.benchmarkRemote(req, remote, benchCompiler, benchDir)
+			if err != nil {
+				fmt.Fprintf(&b, "  bench:     FAILED: %v\n", err)
+			} else {
+				fmt.Fprintf(&b, "  bench:     %s compiled in %d ms\n", benchCompiler, duration.Milliseconds())
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func formatFreeDiskMB(freeBytes int64) string {
+	if freeBytes < 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d MB", freeBytes/1024/1024)
+}
+
+// benchmarkSource is compiled by `nocc --servers --bench`: it has no includes (only a compiler is needed on a server),
+// but instantiates enough templates to take a noticeable time with -O2
+const benchmarkSource = `template<int N> struct Fib { static constexpr long value = Fib<N - 1>::value + Fib<N - 2>::value; };
+template<> struct Fib<1> { static constexpr long value = 1; };
+template<> struct Fib<0> { static constexpr long value = 0; };
+
+template<int N> long sumUpTo(long *arr) {
+    long s = 0;
+    for (int i = 0; i < N; ++i) s += arr[i] * Fib<(N % 40) + 2>::value;
+    return s + sumUpTo<N - 1>(arr);
+}
+template<> long sumUpTo<0>(long *) { return 0; }
+
+long noccBench(long *arr) { return sumUpTo<300>(arr); }
+`
+
+// benchmarkRemote compiles benchmarkSource on a remote like a usual invocation (uploading it, receiving a .o)
+// and returns a wall time of a session; obj cache is bypassed, so that a compiler is really launched
+func (daemon *Daemon) benchmarkRemote(req DaemonSockRequest, remote *RemoteConnection, compiler string, benchDir string) (time.Duration, error) {
+	if remote.isUnavailable.Load() {
+		return 0, fmt.Errorf("remote %s is unavailable", remote.remoteHost)
+	}
+
+	invocation := CreateInvocation(DaemonSockRequest{
+		SessionId: daemon.totalInvocations.Add(1),
+		Uid:       req.Uid,
+		Gid:       req.Gid,
+		UserName:  req.UserName,
+		Cwd:       benchDir,
+		Compiler:  compiler,
+	})
+	invocation.ParseCmdLineInvocation([]string{"-O2", "-c", "nocc-bench.cpp", "-o", remote.remoteHost + ".o"})
+	if invocation.err != nil {
+		return 0, invocation.err
+	}
+	invocation.policy.NoObjCache = true
+	invocation.localCompiler = daemon.localCompilerProbes.Probe(invocation.compilerName, nil)
+	invocation.summary.remoteHost = remote.remoteHost
+
+	cppFile, err := createIncludedFileWithBuffer(invocation.cppInFile)
+	if err != nil {
+		return 0, err
+	}
+	requiredFiles := []*pb.FileMetadata{cppFile.ToPbFileMetadata()}
+
+	daemon.mu.Lock()
+	daemon.activeInvocations[invocation.sessionID] = invocation
+	daemon.mu.Unlock()
+	defer func() {
+		daemon.mu.Lock()
+		delete(daemon.activeInvocations, invocation.sessionID)
+		daemon.mu.Unlock()
+	}()
+
+	start := time.Now()
+	invocation.wgRecv.Add(1)
+	filesToUpload, err := remote.StartCompilationSession(invocation, requiredFiles, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := remote.UploadFilesToRemote(invocation, filesToUpload); err != nil {
+		return 0, err
+	}
+	invocation.waitForCompilation(remote)
+	if invocation.err != nil {
+		return 0, invocation.err
+	}
+	if invocation.compilerExitCode != 0 {
+		return 0, fmt.Errorf("exit code %d: %s", invocation.compilerExitCode, strings.TrimSpace(string(invocation.compilerStderr)))
+	}
+	return time.Since(start), nil
+}
@@ -3,19 +3,21 @@ package client
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/coreos/go-systemd/v22/activation"
+	"nocc/internal/daemonproto"
+
 	sdaemon "github.com/coreos/go-systemd/v22/daemon"
-	"golang.org/x/sys/unix"
 )
 
 // DaemonUnixSockListener is created when `nocc-daemon` starts.
 // It listens to a unix socket from `nocc` invocations (from a lightweight C++ wrapper).
-// Request/response transferred via this socket are represented as simple C-style strings with \0 delimiters, see below.
+// Request/response transferred via this socket are length-prefixed binary frames, see onRequest.
 type DaemonUnixSockListener struct {
 	activeConnections atomic.Int32
 	lastTimeAlive     time.Time
@@ -24,16 +26,24 @@ type DaemonUnixSockListener struct {
 
 type DaemonSockRequest struct {
 	SessionId     uint32
+	BuildID       string // NOCC_BUILD_ID from `nocc` env, a build_id attr (if empty, detected by cwd), see BuildGroups
 	Uid           int
 	Gid           int
+	UserName      string // by Uid, empty if unknown
 	Cwd           string
 	Compiler      string
 	CmdLine       []string
 	InterruptChan chan struct{}
+	Output        *DaemonOutputStream // a local compiler writes there while running, nil for a legacy `nocc`
+
+	StderrIsTerminal bool     // of `nocc`, then diagnostics are colored (a compiler doesn't detect a terminal itself)
+	Env              []string // "KEY=VALUE" of compilerEnvVars set in `nocc` env, empty for a legacy `nocc`
+	JobserverFifo    string   // if `nocc` runs under a jobserver (from MAKEFLAGS), see Jobservers
 }
 
 type DaemonSockResponse struct {
 	ExitCode int
+	Signal   int // a compiler was killed by it (ExitCode is -1 then), `nocc` exits with 128+Signal like a shell
 	Stdout   []byte
 	Stderr   []byte
 }
@@ -46,15 +56,7 @@ func MakeDaemonRpcListener() *DaemonUnixSockListener {
 }
 
 func (listener *DaemonUnixSockListener) StartListeningUnixSocket() (err error) {
-	listeners, err := activation.Listeners()
-	if err != nil {
-		return
-	}
-	if len(listeners) == 0 {
-		return fmt.Errorf("no socket to listen to")
-	}
-
-	listener.netListener = listeners[0]
+	listener.netListener, err = listenDaemonSocket()
 	return
 }
 
@@ -94,25 +96,36 @@ func (listener *DaemonUnixSockListener) EnterInfiniteLoopUntilQuit(daemon *Daemo
 	}
 }
 
-// onRequest parses a string-encoded message from `nocc` C++ client and calls Daemon.HandleInvocation.
+// onRequest parses a message from `nocc` and calls Daemon.HandleInvocation.
 // After the request has been fully processed (.o is written), we answer back, and `nocc` client dies.
-// Request message format:
-// "{Cwd}\b{Compiler}\b{CmdLine...}\0"
-// Response message format:
-// "{ExitCode}\b{Stdout}\b{Stderr}\0"
+// Messages are length-prefixed binary frames or legacy ones, see daemonproto;
+// output of a local compiler is streamed to a framed `nocc` while it runs, see DaemonOutputStream.
+// After a request, `nocc` may send \0 to interrupt compilation (on Ctrl+C), see waitForInterruption.
 func (listener *DaemonUnixSockListener) onRequest(conn net.Conn, daemon *Daemon) {
 	uid, gid := getConnectedUser(conn)
 
-	slice, err := bufio.NewReaderSize(conn, 128*1024).ReadString(0x00)
+	reader := bufio.NewReaderSize(conn, 128*1024)
+	first, err := reader.Peek(1)
 	if err != nil {
-		listener.respondErr(conn, err)
+		listener.respondErr(conn, nil, err)
 		return
 	}
 
-	reqParts := strings.Split(string(slice[0:len(slice)-1]), "\b") // -1 to strip off the trailing '\0'
+	var output *DaemonOutputStream // nil for a legacy `nocc`
+	var reqParts, reqAttrs []string
+	if first[0] == 0 {
+		output = &DaemonOutputStream{conn: conn}
+		reqParts, reqAttrs, err = daemonproto.ReadFramedRequest(reader)
+	} else {
+		reqParts, err = daemonproto.ReadLegacyRequest(reader)
+	}
+	if err != nil {
+		listener.respondErr(conn, output, err)
+		return
+	}
 
 	if len(reqParts) < 3 {
-		listener.respondErr(conn, fmt.Errorf("invalid request format"))
+		listener.respondErr(conn, output, fmt.Errorf("invalid request format"))
 		return
 	}
 
@@ -120,47 +133,133 @@ func (listener *DaemonUnixSockListener) onRequest(conn net.Conn, daemon *Daemon)
 		SessionId:     daemon.totalInvocations.Add(1),
 		Uid:           uid,
 		Gid:           gid,
+		UserName:      lookupUserName(uid),
 		Cwd:           reqParts[0],
 		Compiler:      reqParts[1],
 		CmdLine:       reqParts[2:],
 		InterruptChan: make(chan struct{}),
+		Output:        output,
 	}
+	request.applyAttrs(reqAttrs)
 
 	listener.activeConnections.Add(1)
-	go waitForInterruption(conn, request.InterruptChan)
+	go waitForInterruption(reader, request.InterruptChan)
 	response := daemon.HandleInvocation(request)
 	listener.activeConnections.Add(-1)
 	listener.lastTimeAlive = time.Now()
 
-	listener.respondOk(conn, response)
+	listener.respondOk(conn, output, response)
 }
 
-func getConnectedUser(conn net.Conn) (uid int, gid int) {
-	unixConn := conn.(*net.UnixConn)
-	f, _ := unixConn.File()
-	pcred, _ := unix.GetsockoptUcred(int(f.Fd()), unix.SOL_SOCKET, unix.SO_PEERCRED)
-	_ = f.Close()
-
-	return int(pcred.Uid), int(pcred.Gid)
+// applyAttrs fills fields not present in a legacy request; a newer `nocc` may send attrs this daemon doesn't know
+func (request *DaemonSockRequest) applyAttrs(attrs []string) {
+	for _, attr := range attrs {
+		key, value, _ := strings.Cut(attr, "=")
+		switch key {
+		case "stderr_tty":
+			request.StderrIsTerminal = value == "1"
+		case "env":
+			if isCompilerEnvVar(value, compilerEnvVars) {
+				request.Env = append(request.Env, value)
+			}
+		case "jobserver":
+			request.JobserverFifo = value
+		case "build_id":
+			request.BuildID = value
+		}
+	}
 }
 
-func waitForInterruption(conn net.Conn, interruptChan chan struct{}) {
-	_, err := bufio.NewReaderSize(conn, 32).ReadSlice(0)
+func waitForInterruption(reader *bufio.Reader, interruptChan chan struct{}) {
+	_, err := reader.ReadSlice(0)
 	if err == nil {
 		logClient.Info(2, "got interrupt signal from client, interrupting compilation")
 		close(interruptChan)
 	}
 }
 
-func (listener *DaemonUnixSockListener) respondOk(conn net.Conn, resp DaemonSockResponse) {
-	_, err := conn.Write(fmt.Appendf(nil, "%d\b%s\b%s\000", resp.ExitCode, resp.Stdout, resp.Stderr))
+func (listener *DaemonUnixSockListener) respondOk(conn net.Conn, output *DaemonOutputStream, resp DaemonSockResponse) {
+	var err error
+	if output != nil {
+		err = output.finish(resp.ExitCode, resp.Signal, resp.Stdout, resp.Stderr)
+	} else if resp.Signal != 0 {
+		_, err = conn.Write(daemonproto.AppendLegacyResponse(nil, 128+resp.Signal, resp.Stdout, resp.Stderr))
+	} else {
+		_, err = conn.Write(daemonproto.AppendLegacyResponse(nil, resp.ExitCode, resp.Stdout, resp.Stderr))
+	}
 	if err != nil {
 		logClient.Error(err)
 	}
 	_ = conn.Close()
 }
 
-func (listener *DaemonUnixSockListener) respondErr(conn net.Conn, err error) {
-       _, _ = conn.Write(fmt.Appendf(nil, "%d\b%s\b%v\000", -1, "", err))
+func (listener *DaemonUnixSockListener) respondErr(conn net.Conn, output *DaemonOutputStream, err error) {
+	if output != nil {
+		_ = output.finish(-1, 0, nil, []byte(err.Error()))
+	} else {
+		_, _ = conn.Write(daemonproto.AppendLegacyResponse(nil, -1, nil, []byte(err.Error())))
+	}
 	_ = conn.Close()
 }
+
+// DaemonOutputStream is a framed response: a header followed by chunks, see daemonproto.AppendFramedChunk.
+// A local compiler writes to it while running (see CompilerLaunchRequest.output), so `nocc` prints output as it's produced,
+// and whatever else a response has is sent when it's done. Large outputs are split into chunks of daemonproto.MaxFramedChunkSize.
+type DaemonOutputStream struct {
+	mu            sync.Mutex
+	conn          net.Conn
+	headerWritten bool
+	err           error // the first failed write, further writes are skipped
+}
+
+type daemonOutputWriter struct {
+	stream *DaemonOutputStream
+	kind   byte
+}
+
+func (stream *DaemonOutputStream) Stdout() io.Writer {
+	return daemonOutputWriter{stream, daemonproto.ChunkStdout}
+}
+
+func (stream *DaemonOutputStream) Stderr() io.Writer {
+	return daemonOutputWriter{stream, daemonproto.ChunkStderr}
+}
+
+// Write never fails: if `nocc` is gone, a compiler is interrupted anyway, its output is just dropped
+func (writer daemonOutputWriter) Write(p []byte) (int, error) {
+	writer.stream.mu.Lock()
+	writer.stream.writeChunks(writer.kind, p)
+	writer.stream.mu.Unlock()
+	return len(p), nil
+}
+
+func (stream *DaemonOutputStream) writeChunks(kind byte, body []byte) {
+	for len(body) > 0 && stream.err == nil {
+		n := min(len(body), daemonproto.MaxFramedChunkSize)
+		stream.writeChunk(kind, body[:n])
+		body = body[n:]
+	}
+}
+
+func (stream *DaemonOutputStream) writeChunk(kind byte, body []byte) {
+	buf := make([]byte, 0, len(daemonproto.FramedPrefix)+1+1+4+len(body)+4)
+	if !stream.headerWritten {
+		buf = daemonproto.AppendFramedHeader(buf)
+		stream.headerWritten = true
+	}
+	buf = daemonproto.AppendFramedChunk(buf, kind, body)
+	_, stream.err = stream.conn.Write(buf)
+}
+
+// finish sends the rest of a response (output not streamed while compiling) and an exit code
+func (stream *DaemonOutputStream) finish(exitCode int, signal int, stdout []byte, stderr []byte) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	stream.writeChunks(daemonproto.ChunkStdout, stdout)
+	stream.writeChunks(daemonproto.ChunkStderr, stderr)
+	if stream.err == nil {
+		stream.writeChunk(daemonproto.ChunkExit, daemonproto.ExitChunkBody(exitCode, signal))
+	}
+	return stream.err
+}
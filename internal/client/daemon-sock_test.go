@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"testing/quick"
+
+	"nocc/internal/daemonproto"
+)
+
+type testDaemonOutput struct {
+	Writes     [][]byte
+	ToStderr   []bool
+	FinalOut   []byte
+	FinalErr   []byte
+	ExitCode   int32
+	WithSignal bool
+}
+
+// sendOverPipe writes output like a local compiler and DaemonSockListener.respondOk do, and reads it like `nocc` does
+func (output testDaemonOutput) sendOverPipe(t *testing.T) (stdout []byte, stderr []byte, exitCode int, signal int) {
+	daemonConn, noccConn := net.Pipe()
+	go func() {
+		stream := &DaemonOutputStream{conn: daemonConn}
+		for i, body := range output.Writes {
+			if i < len(output.ToStderr) && output.ToStderr[i] {
+				_, _ = stream.Stderr().Write(body)
+			} else {
+				_, _ = stream.Stdout().Write(body)
+			}
+		}
+		sentSignal := 0
+		if output.WithSignal {
+			sentSignal = 9
+		}
+		_ = stream.finish(int(output.ExitCode), sentSignal, output.FinalOut, output.FinalErr)
+		_ = daemonConn.Close()
+	}()
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	exitCode, signal, err := daemonproto.ReadFramedResponse(bufio.NewReader(noccConn), &stdoutBuf, &stderrBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdoutBuf.Bytes(), stderrBuf.Bytes(), exitCode, signal
+}
+
+func TestDaemonOutputStream(t *testing.T) {
+	roundTrip := func(output testDaemonOutput) bool {
+		var expectedOut, expectedErr []byte
+		for i, body := range output.Writes {
+			if i < len(output.ToStderr) && output.ToStderr[i] {
+				expectedErr = append(expectedErr, body...)
+			} else {
+				expectedOut = append(expectedOut, body...)
+			}
+		}
+		expectedOut = append(expectedOut, output.FinalOut...)
+		expectedErr = append(expectedErr, output.FinalErr...)
+
+		stdout, stderr, exitCode, signal := output.sendOverPipe(t)
+		return bytes.Equal(stdout, expectedOut) && bytes.Equal(stderr, expectedErr) &&
+			exitCode == int(output.ExitCode) && (signal != 0) == output.WithSignal
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestDaemonOutputStreamLarge checks that output larger than a chunk `nocc` accepts is split
+func TestDaemonOutputStreamLarge(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), daemonproto.MaxFramedChunkSize/16*5/2)
+	output := testDaemonOutput{Writes: [][]byte{large}, FinalErr: large, ExitCode: 1}
+
+	stdout, stderr, exitCode, _ := output.sendOverPipe(t)
+	if !bytes.Equal(stdout, large) || !bytes.Equal(stderr, large) || exitCode != 1 {
+		t.Errorf("received %d bytes of stdout, %d bytes of stderr, exit code %d", len(stdout), len(stderr), exitCode)
+	}
+}
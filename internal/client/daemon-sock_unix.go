@@ -0,0 +1,88 @@
+//go:build !windows
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"golang.org/x/sys/unix"
+)
+
+var selfManagedSocketLock *os.File
+
+// listenDaemonSocket takes a unix socket passed by systemd (see nocc-daemon.socket).
+// If a daemon was started not by systemd (e.g. spawned by `nocc` itself), it creates a per-user socket,
+// see listenSelfManagedSocket.
+func listenDaemonSocket() (net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		return listenSelfManagedSocket()
+	}
+
+	return listeners[0], nil
+}
+
+// userRuntimeDir is $XDG_RUNTIME_DIR, normally /run/user/$UID; `nocc` looks for a per-user socket there
+func userRuntimeDir() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return runtimeDir
+	}
+	return fmt.Sprintf("/run/user/%d", os.Getuid())
+}
+
+// listenSelfManagedSocket creates $XDG_RUNTIME_DIR/nocc-daemon.sock (`nocc` connects to it if /run/nocc-daemon.sock doesn't exist).
+// A lock file protects from two daemons at once: several `nocc` processes may spawn a daemon simultaneously,
+// only the first one succeeds, others exit. The lock is released by the kernel when a daemon process dies.
+func listenSelfManagedSocket() (net.Listener, error) {
+	runtimeDir := userRuntimeDir()
+	socketPath := runtimeDir + "/nocc-daemon.sock"
+
+	lockFile, err := os.OpenFile(runtimeDir+"/nocc-daemon.lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("no socket passed by systemd, and can't create a lock file: %v", err)
+	}
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		_ = lockFile.Close()
+		return nil, fmt.Errorf("another nocc-daemon is already listening %s", socketPath)
+	}
+	selfManagedSocketLock = lockFile // not closed (and not collected by GC): it's held until a daemon exits
+
+	// a socket file left by a previous daemon; it can be removed safely, since that daemon has released the lock
+	_ = os.Remove(socketPath)
+	return net.Listen("unix", socketPath)
+}
+
+// getConnectedUser returns uid/gid of a `nocc` process, local compilation is launched on behalf of them
+func getConnectedUser(conn net.Conn) (uid int, gid int) {
+	unixConn := conn.(*net.UnixConn)
+	f, _ := unixConn.File()
+	pcred, _ := unix.GetsockoptUcred(int(f.Fd()), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	_ = f.Close()
+
+	return int(pcred.Uid), int(pcred.Gid)
+}
+
+var userNamesByUid sync.Map // uid -> string, not to read /etc/passwd on every invocation
+
+// lookupUserName returns a name of a user who launched `nocc`; it's sent to servers for logs (see Invocation.userName)
+func lookupUserName(uid int) string {
+	if userName, ok := userNamesByUid.Load(uid); ok {
+		return userName.(string)
+	}
+
+	userName := strconv.Itoa(uid)
+	if u, err := user.LookupId(userName); err == nil {
+		userName = u.Username
+	}
+	userNamesByUid.Store(uid, userName)
+	return userName
+}
@@ -0,0 +1,140 @@
+//go:build windows
+
+package client
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+const daemonPipePath = `\\.\pipe\nocc-daemon`
+
+// namedPipeListener is a net.Listener over a Windows named pipe, used instead of a unix socket.
+// There is no systemd socket activation on Windows, so a daemon is started manually (or as a service)
+// and creates a pipe itself. One pipe instance is always waiting for a client: the next one is created
+// before Accept returns, so that `nocc` doesn't get "file not found" between two connections.
+type namedPipeListener struct {
+	pipePath *uint16
+
+	mu     sync.Mutex
+	next   windows.Handle // a pipe instance not connected yet
+	closed bool
+}
+
+type namedPipeAddr string
+
+func (addr namedPipeAddr) Network() string { return "pipe" }
+func (addr namedPipeAddr) String() string  { return string(addr) }
+
+// namedPipeConn is a connected pipe instance; os.File performs overlapped I/O via the Go runtime's poller
+type namedPipeConn struct {
+	*os.File
+}
+
+func (conn namedPipeConn) LocalAddr() net.Addr  { return namedPipeAddr(daemonPipePath) }
+func (conn namedPipeConn) RemoteAddr() net.Addr { return namedPipeAddr(daemonPipePath) }
+
+func listenDaemonSocket() (net.Listener, error) {
+	pipePath, err := windows.UTF16PtrFromString(daemonPipePath)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &namedPipeListener{pipePath: pipePath}
+	// FILE_FLAG_FIRST_PIPE_INSTANCE fails if another daemon is already listening
+	listener.next, err = listener.createPipeInstance(windows.FILE_FLAG_FIRST_PIPE_INSTANCE)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (listener *namedPipeListener) createPipeInstance(extraFlags uint32) (windows.Handle, error) {
+	return windows.CreateNamedPipe(listener.pipePath,
+		windows.PIPE_ACCESS_DUPLEX|windows.FILE_FLAG_OVERLAPPED|extraFlags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, 128*1024, 128*1024, 0, nil)
+}
+
+func (listener *namedPipeListener) Accept() (net.Conn, error) {
+	listener.mu.Lock()
+	if listener.closed {
+		listener.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	handle := listener.next
+	listener.mu.Unlock()
+
+	if err := connectNamedPipe(handle); err != nil {
+		listener.mu.Lock()
+		defer listener.mu.Unlock()
+		if listener.closed {
+			return nil, net.ErrClosed
+		}
+		// a client has gone before being accepted; this instance is unusable, replace it
+		_ = windows.CloseHandle(handle)
+		listener.next, _ = listener.createPipeInstance(0)
+		return nil, err
+	}
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	next, err := listener.createPipeInstance(0)
+	if err != nil {
+		_ = windows.CloseHandle(handle)
+		return nil, err
+	}
+	listener.next = next
+	return namedPipeConn{os.NewFile(uintptr(handle), daemonPipePath)}, nil
+}
+
+// connectNamedPipe waits for a client, it's interrupted by CancelIoEx from Close
+func connectNamedPipe(handle windows.Handle) error {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(event)
+
+	overlapped := windows.Overlapped{HEvent: event}
+	err = windows.ConnectNamedPipe(handle, &overlapped)
+	switch err {
+	case nil, windows.ERROR_PIPE_CONNECTED:
+		return nil
+	case windows.ERROR_IO_PENDING:
+		var n uint32
+		return windows.GetOverlappedResult(handle, &overlapped, &n, true)
+	default:
+		return err
+	}
+}
+
+func (listener *namedPipeListener) Close() error {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+
+	if listener.closed {
+		return nil
+	}
+	listener.closed = true
+	_ = windows.CancelIoEx(listener.next, nil)
+	return windows.CloseHandle(listener.next)
+}
+
+func (listener *namedPipeListener) Addr() net.Addr {
+	return namedPipeAddr(daemonPipePath)
+}
+
+// getConnectedUser is a no-op on Windows: a pipe rejects remote clients, and local compilation
+// is launched by the daemon as is, without switching credentials
+func getConnectedUser(conn net.Conn) (uid int, gid int) {
+	return 0, 0
+}
+
+// lookupUserName returns an empty string on Windows, since getConnectedUser doesn't detect a user
+func lookupUserName(uid int) string {
+	return ""
+}
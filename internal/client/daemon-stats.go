@@ -0,0 +1,241 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const statsSlowestFilesCount = 20
+
+type remoteStats struct {
+	nInvocations   int
+	nFailures      int
+	nObjCacheHits  int
+	nBytesSent     int64
+	nBytesReceived int64
+	totalDuration  time.Duration
+
+	// server congestion: compiled .cpp waited for a compiler slot there, see Invocation.compilerQueued
+	nCompiled      int
+	totalQueuedMs  int64
+	peakQueueDepth int32
+}
+
+// slowFile is a breakdown of a slow remote invocation: a long compile (a heavy TU) is a candidate for PCH,
+// long preprocessing (many includes) or a long compile with few includes — for splitting or a unity build
+type slowFile struct {
+	cppInFile  string
+	remoteHost string
+	duration   time.Duration
+
+	preprocess time.Duration
+	upload     time.Duration
+	queued     int32 // ms, as compilerDuration
+	compile    int32
+	receive    time.Duration
+}
+
+// DaemonStats aggregates InvocationSummary of all invocations served by a daemon since its start.
+// Since a daemon quits after a build finishes, it's effectively "stats of the current build".
+// It's printed by `nocc stats`, like `ccache -s`; see StatsHistory for totals of recent builds.
+type DaemonStats struct {
+	mu sync.Mutex
+
+	nInvocations     int
+	nRemote          int
+	nRemoteFailed    int // failed remotely, then compiled locally
+	nObjCacheHits    int
+	nLocal           int
+	localReasons     map[string]int // why compiled locally, see localFallbackReason
+	nFilesSent       int
+	nBytesSent       int64
+	nBytesReceived   int64
+	totalRemoteTime  time.Duration
+	perRemote        map[string]*remoteStats
+	slowestRemoteCpp []slowFile // sorted by duration desc, at most statsSlowestFilesCount
+}
+
+func MakeDaemonStats() *DaemonStats {
+	return &DaemonStats{
+		perRemote:    make(map[string]*remoteStats),
+		localReasons: make(map[string]int),
+	}
+}
+
+func (stats *DaemonStats) RecordLocalInvocation(reason string) {
+	stats.mu.Lock()
+	stats.nInvocations++
+	stats.nLocal++
+	stats.localReasons[reason]++
+	stats.mu.Unlock()
+}
+
+// RecordRemoteInvocation is called after an invocation was tried to be compiled remotely.
+// If it failed (err != nil or compiled locally afterward), it's counted as a failure for that remote.
+func (stats *DaemonStats) RecordRemoteInvocation(invocation *Invocation, failed bool) {
+	summary := invocation.summary
+	duration := time.Since(invocation.createTime)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.nInvocations++
+	perRemote := stats.perRemote[summary.remoteHost]
+	if perRemote == nil {
+		perRemote = &remoteStats{}
+		stats.perRemote[summary.remoteHost] = perRemote
+	}
+	perRemote.nInvocations++
+	perRemote.nBytesSent += int64(summary.nBytesSent)
+	perRemote.nBytesReceived += int64(summary.nBytesReceived)
+	perRemote.totalDuration += duration
+
+	if failed {
+		stats.nRemoteFailed++
+		stats.nLocal++
+		if summary.remoteFailReason != "" {
+			stats.localReasons[summary.remoteFailReason]++
+		} else {
+			stats.localReasons["remote_failed"]++
+		}
+		perRemote.nFailures++
+		return
+	}
+
+	stats.nRemote++
+	stats.nFilesSent += summary.nFilesSent
+	stats.nBytesSent += int64(summary.nBytesSent)
+	stats.nBytesReceived += int64(summary.nBytesReceived)
+	stats.totalRemoteTime += duration
+	if invocation.fromObjCache {
+		stats.nObjCacheHits++
+		perRemote.nObjCacheHits++
+	} else {
+		perRemote.nCompiled++
+		perRemote.totalQueuedMs += int64(invocation.compilerQueued)
+		perRemote.peakQueueDepth = max(perRemote.peakQueueDepth, invocation.compilerQueueDepth)
+	}
+
+	if len(stats.slowestRemoteCpp) < statsSlowestFilesCount || duration > stats.slowestRemoteCpp[len(stats.slowestRemoteCpp)-1].duration {
+		stats.slowestRemoteCpp = append(stats.slowestRemoteCpp, slowFile{
+			cppInFile:  invocation.cppInFile,
+			remoteHost: summary.remoteHost,
+			duration:   duration,
+			preprocess: summary.preprocessDuration,
+			upload:     summary.uploadDuration,
+			queued:     invocation.compilerQueued,
+			compile:    invocation.compilerDuration,
+			receive:    summary.receiveDuration,
+		})
+		sort.Slice(stats.slowestRemoteCpp, func(i, j int) bool {
+			return stats.slowestRemoteCpp[i].duration > stats.slowestRemoteCpp[j].duration
+		})
+		if len(stats.slowestRemoteCpp) > statsSlowestFilesCount {
+			stats.slowestRemoteCpp = stats.slowestRemoteCpp[:statsSlowestFilesCount]
+		}
+	}
+}
+
+func percentOf(part int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+func averageOf(sum int64, count int) int64 {
+	if count == 0 {
+		return 0
+	}
+	return sum / int64(count)
+}
+
+// ToShortString outputs main counters in one line
+func (stats *DaemonStats) ToShortString() string {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	return fmt.Sprintf("%d invocations, %d remote (%d from obj cache), %d local (%d after remote failure), %d bytes uploaded",
+		stats.nInvocations, stats.nRemote, stats.nObjCacheHits, stats.nLocal, stats.nRemoteFailed, stats.nBytesSent)
+}
+
+// ToHumanReadableString outputs stats as a table printed by `nocc --stats`
+func (stats *DaemonStats) ToHumanReadableString(daemon *Daemon) string {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "nocc-daemon started at %s (uptime %s), clientID %s\n", daemon.startTime.Format(time.DateTime), time.Since(daemon.startTime).Round(time.Second), daemon.clientID)
+	fmt.Fprintf(&b, "%-32s %d\n", "invocations", stats.nInvocations)
+	fmt.Fprintf(&b, "%-32s %d (%.1f%%)\n", "  compiled remotely", stats.nRemote, percentOf(stats.nRemote, stats.nInvocations))
+	fmt.Fprintf(&b, "%-32s %d (%.1f%% of remote)\n", "    taken from obj cache", stats.nObjCacheHits, percentOf(stats.nObjCacheHits, stats.nRemote))
+	fmt.Fprintf(&b, "%-32s %d (%.1f%%)\n", "  compiled locally", stats.nLocal, percentOf(stats.nLocal, stats.nInvocations))
+	fmt.Fprintf(&b, "%-32s %d\n", "    after remote failure", stats.nRemoteFailed)
+	fmt.Fprintf(&b, "%-32s %d\n", "files uploaded", stats.nFilesSent)
+	fmt.Fprintf(&b, "%-32s %d bytes\n", "bytes uploaded", stats.nBytesSent)
+	fmt.Fprintf(&b, "%-32s %d bytes\n", "  average per remote invocation", averageOf(stats.nBytesSent, stats.nRemote))
+	fmt.Fprintf(&b, "%-32s %d bytes\n", "bytes received", stats.nBytesReceived)
+	fmt.Fprintf(&b, "%-32s %d ms\n", "average remote invocation", averageOf(stats.totalRemoteTime.Milliseconds(), stats.nRemote))
+	if limits := daemon.sessionLimits; limits != nil {
+		nWaited := limits.nWaited.Load()
+		fmt.Fprintf(&b, "%-32s %d, average %d ms\n", "waited for a session slot", nWaited, averageOf(time.Duration(limits.waitNanos.Load()).Milliseconds(), int(nWaited)))
+	}
+
+	reasons := make([]string, 0, len(stats.localReasons))
+	for reason := range stats.localReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	if len(reasons) > 0 {
+		fmt.Fprintf(&b, "\ncompiled locally because of:\n")
+	}
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "  %-30s %d\n", reason, stats.localReasons[reason])
+	}
+
+	remoteHosts := make([]string, 0, len(stats.perRemote))
+	for remoteHost := range stats.perRemote {
+		remoteHosts = append(remoteHosts, remoteHost)
+	}
+	sort.Strings(remoteHosts)
+	if len(remoteHosts) > 0 {
+		fmt.Fprintf(&b, "\nper remote:\n")
+	}
+	for _, remoteHost := range remoteHosts {
+		r := stats.perRemote[remoteHost]
+		fmt.Fprintf(&b, "  %-30s %d invocations, %d failed, %d from obj cache, %d bytes sent, %d bytes received, average %d ms, queued there %d ms (peak queue %d)\n",
+			remoteHost, r.nInvocations, r.nFailures, r.nObjCacheHits, r.nBytesSent, r.nBytesReceived, averageOf(r.totalDuration.Milliseconds(), r.nInvocations),
+			averageOf(r.totalQueuedMs, r.nCompiled), r.peakQueueDepth)
+	}
+
+	if len(stats.slowestRemoteCpp) > 0 {
+		fmt.Fprintf(&b, "\nslowest files (preprocess / upload / queued on a server / compile / receive):\n")
+	}
+	stats.writeSlowestFiles(&b)
+
+	return b.String()
+}
+
+// SlowestFilesReport outputs the slowest remote invocations with their breakdown, logged when a daemon quits; empty if none
+func (stats *DaemonStats) SlowestFilesReport() string {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if len(stats.slowestRemoteCpp) == 0 {
+		return ""
+	}
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%d slowest files (preprocess / upload / queued on a server / compile / receive):\n", len(stats.slowestRemoteCpp))
+	stats.writeSlowestFiles(&b)
+	return b.String()
+}
+
+func (stats *DaemonStats) writeSlowestFiles(b *strings.Builder) {
+	for _, f := range stats.slowestRemoteCpp {
+		fmt.Fprintf(b, "  %6d ms  %s (%s): %d / %d / %d / %d / %d ms\n", f.duration.Milliseconds(), f.cppInFile, f.remoteHost,
+			f.preprocess.Milliseconds(), f.upload.Milliseconds(), f.queued, f.compile, f.receive.Milliseconds())
+	}
+}
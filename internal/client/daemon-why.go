@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// whyCommandOutput handles `nocc --why g++ {args}`: an invocation is parsed exactly like for compiling,
+// but instead of compiling, a daemon reports what it would do: compile remotely or locally (and why),
+// which remote it would choose, whether a .o is already in its obj cache, and which files it depends on.
+// Nothing is compiled or uploaded; dependencies are collected by a local compiler (`-M`) as usual.
+func (daemon *Daemon) whyCommandOutput(req DaemonSockRequest) (string, error) {
+	if len(req.CmdLine) < 2 {
+		return "", fmt.Errorf("usage: nocc --why {compiler} {args...}")
+	}
+	req.Compiler = req.CmdLine[1]
+	req.CmdLine = req.CmdLine[2:]
+
+	buildGroup := daemon.buildGroups.GetBuildGroup(req.BuildID, req.Cwd)
+	invocation := CreateInvocation(req)
+	invocation.buildGroup = buildGroup
+	invocation.project = daemon.projectConfigs.GetProjectConfig(req.Cwd)
+	invocation.compileRules = daemon.compileRules.Load()
+	invocation.ParseCmdLineInvocation(daemon.compilerScripts.ResolveCmdLine(invocation, req.CmdLine))
+	invocation.policy = invocation.compileRules.Policy(invocation)
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "build: %s\n", buildGroup.buildID)
+	if invocation.compilerName != req.Compiler {
+		fmt.Fprintf(&b, "compiler: %s is a script, parsed as %s %s\n", req.Compiler, invocation.compilerName, strings.Join(invocation.cmdLine, " "))
+	}
+	if invocation.project != nil {
+		fmt.Fprintf(&b, "project config: %s\n", invocation.project.rootDir)
+	}
+
+	switch invocation.invokeType {
+	case invokedUnsupported:
+		fmt.Fprintf(&b, "decision: compile locally\nreason: %v\n", invocation.err)
+		return b.String(), nil
+	case invokedForLocalCompiling:
+		reason := invocation.compileRules.LocalCompilingReason(invocation, invocation.inFileArgs[0])
+		if reason == "" {
+			reason = "assembly source without preprocessing"
+		}
+		fmt.Fprintf(&b, "decision: compile locally\nreason: %s\n", reason)
+		return b.String(), nil
+	case invokedForLinking:
+		fmt.Fprintf(&b, "decision: link locally\nreason: no -c\n")
+		return b.String(), nil
+	case invokedForCompilingPch:
+		fmt.Fprintf(&b, "decision: compile pch locally, its .nocc-pch is uploaded with .cpp files including it\n")
+		return b.String(), nil
+	case invokedForCompilingMany:
+		fmt.Fprintf(&b, "decision: compile every input file separately, as `nocc --why` for each one: %s\n", strings.Join(invocation.inFileArgs, " "))
+		return b.String(), nil
+	}
+
+	if invocation.project.IsForcedLocal(invocation.cwd, invocation.cppInFile) {
+		fmt.Fprintf(&b, "decision: compile locally\nreason: ForceLocal of project config\n")
+		return b.String(), nil
+	}
+
+	predicted := daemon.applyCompileTimePrediction(invocation)
+	remote, err := daemon.chooseRemoteConnectionForCppCompilation(invocation)
+	if err != nil {
+		fmt.Fprintf(&b, "decision: compile locally\nreason: %v\n", err)
+		return b.String(), nil
+	}
+
+	response, requiredFiles, requiredPchFile, err := daemon.collectRequiredFiles(invocation)
+	if err != nil {
+		fmt.Fprintf(&b, "decision: compile locally\nreason: %v\n", err)
+		return b.String(), nil
+	}
+	if response.interrupted {
+		return "", fmt.Errorf("interrupted")
+	}
+
+	fmt.Fprintf(&b, "decision: compile remotely\n")
+	if pinnedServer := invocation.compileRules.PinnedServer(invocation); pinnedServer != "" {
+		fmt.Fprintf(&b, "pinned to: %s (PinFiles)\n", pinnedServer)
+	}
+	if invocation.policy != (InvocationPolicy{}) {
+		fmt.Fprintf(&b, "policy of Rules: priority %d, server tag %q, no obj cache %v\n", invocation.policy.Priority, invocation.policy.ServerTag, invocation.policy.NoObjCache)
+	}
+	if predicted > 0 {
+		fmt.Fprintf(&b, "compiled last time in: %d ms, long %v (see LongFileTime)\n", predicted.Milliseconds(), invocation.predictedLong)
+	}
+	fmt.Fprintf(&b, "remote: %s\n", remote.remoteHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheProbeTimeout)
+	defer cancel()
+	if cacheRemote := daemon.chooseCacheRemote(invocation); cacheRemote != nil {
+		exists, err := cacheRemote.ProbeObjCache(ctx, invocation, requiredFiles, requiredPchFile)
+		fmt.Fprintf(&b, "cache server: %s, %s\n", cacheRemote.remoteHost, formatProbeResult(exists, err))
+	}
+	exists, err := remote.ProbeObjCache(ctx, invocation, requiredFiles, requiredPchFile)
+	fmt.Fprintf(&b, "obj cache of %s: %s\n", remote.remoteHost, formatProbeResult(exists, err))
+
+	if exists {
+		b.WriteString("files to upload: none, a .o is taken from obj cache\n")
+	} else {
+		// which of them are missing, is known only to a remote (uploaded before, or found in its src cache)
+		totalSize := int64(0)
+		for _, file := range requiredFiles {
+			totalSize += file.FileSize
+		}
+		fmt.Fprintf(&b, "files to upload: those of %d below (%d bytes) a remote doesn't have yet\n", len(requiredFiles), totalSize)
+		for _, file := range requiredFiles {
+			fmt.Fprintf(&b, "  %s (%d bytes)\n", file.FileName, file.FileSize)
+		}
+	}
+	return b.String(), nil
+}
+
+func formatProbeResult(exists bool, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("failed to probe: %v", err)
+	case exists:
+		return "has this .o"
+	default:
+		return "doesn't have this .o"
+	}
+}
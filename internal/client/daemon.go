@@ -11,12 +11,15 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"nocc/internal/common"
+	"nocc/pb"
 )
 
 type ServerState int
@@ -37,22 +40,56 @@ type Daemon struct {
 	startTime      time.Time
 	quitDaemonChan chan int
 
-	clientID string
+	clientID       string
+	stableClientID bool   // ClientID is configured, so a next daemon launch is the same client for servers
+	configFileName string // re-read on SIGHUP, see ReloadConfiguration
 
 	listener              *DaemonUnixSockListener
-	remoteConnections     []*RemoteConnection
+	remoteConnections     []*RemoteConnection // replaced on reload, use getRemoteConnections()
 	remoteNoccHosts       []string
+	serverDiscovery       atomic.Pointer[ServerDiscovery] // nil if Servers has no srv:/file:/mdns: sources, replaced on reload
+	discoveryInterval     time.Duration
 	socksProxyAddr        string
-	localCompilerThrottle chan struct{}
+	localCompilerQueue    *LocalCompilerQueue
+	objWriters            *ObjWriters // nil if MaxObjWrites is not set
+	sessionLimits         *RemoteSessionLimits // nil if neither MaxSessionsPerRemote nor MaxRemoteSessions is set
+	adaptiveSplit         *AdaptiveSplit       // nil if AdaptiveLocal is not set
+	compileTimes          *CompileTimes        // nil if LongFileTime is not set
+	jobservers            *Jobservers          // nil if Jobserver is not set
+	maxObjSize            int64       // 0 if MaxObjSize is not set, see monitorRemoteStreamForObjReceiving
+	dependCache           *DependCache // nil if DependModeDir is not set
+	provenanceChecker     *ObjProvenanceChecker // nil if neither WriteProvenance nor ProvenanceKeys is set
+	localCompilerProbes   *LocalCompilerProbes
+	compilerScripts       *CompilerScripts
+	toolchains            *Toolchains // nil if UploadToolchain is not set
+	systemHeaderDirs      []*pb.SystemHeaderDir // nil if SystemHeaderDirs is not set, see calcSystemHeaderDirs
+	snapshotNames         []string              // Snapshots from config, see remoteSnapshot
+	onDemandIncludes      *OnDemandIncludes     // nil if OnDemandIncludes is not set or UploadToolchain is
+	reproRecorder         *ReproRecorder // nil if ReproDir is not set
+	serverQuarantine      *ServerQuarantine // nil if QuarantineTime is not set
 
 	disableLocalCompiler bool
+	reportBuildSummaries bool   // see ReportBuildSummaries
+	baseDir              string // cleaned BaseDir, empty if not set
+	priorityClass        string // PriorityClass from config, sent with every session
 
 	totalInvocations  atomic.Uint32
 	activeInvocations map[uint32]*Invocation
-	invocationTimeout time.Duration
+	stats             *DaemonStats // total for all builds, each BuildGroup also has its own
+	statsHistory      *StatsHistory // nil if StatsFile is not set
+	buildGroups       *BuildGroups
+	projectConfigs    *ProjectConfigs
+	compileRules      atomic.Pointer[CompileRules] // replaced on reload
+	timeline          *BuildTimeline // nil if TimelineFileName is not set
+	scheduler         RemoteScheduler // a CentralScheduler if SchedulerAddr is set
+	serverCosts       map[string]int // from config, by remoteHostPort
+	cacheProbeRemotes int            // see findRemoteHavingObj
+	invocationTimeout atomic.Int64 // time.Duration, replaced on reload (read by invocations and a hang checker)
+	objWaitTimeout    atomic.Int64 // time.Duration, the same
 	connectionTimeout time.Duration
 
-	mu sync.RWMutex
+	mu              sync.RWMutex
+	remotesUpdateMu sync.Mutex // serializes updateRemoteConnections on reload and by commands
 }
 
 // detectClientID returns a clientID for current daemon launch.
@@ -73,21 +110,96 @@ func detectClientID(clientID string) string {
 	return string(b)
 }
 
-func MakeDaemon(configuration *Configuration) (*Daemon, error) {
+func MakeDaemon(configuration *Configuration, configFileName string) (*Daemon, error) {
+	serverDiscovery := MakeServerDiscovery(configuration.Servers)
+	servers := resolveServers(serverDiscovery, configuration.Servers)
+
 	daemon := &Daemon{
 		startTime:             time.Now(),
 		quitDaemonChan:        make(chan int),
 		clientID:              detectClientID(configuration.ClientID),
-		remoteConnections:     make([]*RemoteConnection, len(configuration.Servers)),
-		remoteNoccHosts:       configuration.Servers,
+		stableClientID:        configuration.ClientID != "",
+		configFileName:        configFileName,
+		remoteConnections:     make([]*RemoteConnection, len(servers)),
+		remoteNoccHosts:       servers,
+		discoveryInterval:     time.Duration(configuration.DiscoveryInterval) * time.Second,
 		socksProxyAddr:        configuration.SocksProxyAddr,
-		localCompilerThrottle: make(chan struct{}, configuration.CompilerQueueSize),
+		localCompilerQueue:    MakeLocalCompilerQueue(configuration.CompilerQueueSize),
+		objWriters:            MakeObjWriters(configuration.MaxObjWrites),
+		sessionLimits:         MakeRemoteSessionLimits(configuration.MaxSessionsPerRemote, configuration.MaxRemoteSessions),
+		jobservers:            MakeJobservers(configuration.Jobserver),
+		compileTimes:          MakeCompileTimes(configuration.LongFileTime, configuration.CompileTimesFile),
+		adaptiveSplit:         MakeAdaptiveSplit(configuration.AdaptiveLocal && configuration.CompilerQueueSize > 0, configuration.AdaptiveLocalMaxSize),
+		maxObjSize:            configuration.MaxObjSize,
+		localCompilerProbes:   MakeLocalCompilerProbes(),
+		compilerScripts:       MakeCompilerScripts(),
+		toolchains:            MakeToolchains(configuration.UploadToolchain),
+		onDemandIncludes:      MakeOnDemandIncludes(configuration.OnDemandIncludes && !configuration.UploadToolchain),
+		serverQuarantine:      MakeServerQuarantine(configuration.QuarantineTime, configuration.QuarantineAfter),
 		disableLocalCompiler:  configuration.CompilerQueueSize == 0,
 		activeInvocations:     make(map[uint32]*Invocation, 300),
-		invocationTimeout:     time.Duration(configuration.InvocationTimeout) * time.Second,
+		stats:                 MakeDaemonStats(),
+		statsHistory:          MakeStatsHistory(configuration.StatsFile),
+		buildGroups:           MakeBuildGroups(),
+		projectConfigs:        MakeProjectConfigs(),
+		scheduler:             CostAwareScheduler{},
+		serverCosts:           configuration.ServerCosts,
+		cacheProbeRemotes:     configuration.CacheProbeRemotes,
+		baseDir:               cleanBaseDir(configuration.BaseDir),
+		priorityClass:         configuration.PriorityClass,
+		snapshotNames:         configuration.Snapshots,
+		reportBuildSummaries:  configuration.ReportBuildSummaries,
 		connectionTimeout:     time.Duration(configuration.ConnectionTimeout) * time.Second,
 	}
 
+	// a per-user daemon (a system-wide one runs as root) gets a user suffix to a configured clientID,
+	// otherwise daemons of all users of a shared machine would be one client for servers
+	if configuration.ClientID != "" && os.Getuid() > 0 {
+		daemon.clientID += "-" + lookupUserName(os.Getuid())
+	}
+
+	var err error
+	if configuration.SchedulerAddr != "" {
+		daemon.scheduler, err = MakeCentralScheduler(configuration.SchedulerAddr, daemon.clientID, configuration.SocksProxyAddr, daemon.scheduler)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	daemon.timeline, err = MakeBuildTimeline(configuration.TimelineFileName, daemon.startTime)
+	if err != nil {
+		return nil, err
+	}
+
+	daemon.dependCache, err = MakeDependCache(configuration.DependModeDir)
+	if err != nil {
+		return nil, err
+	}
+
+	compileRules, err := MakeCompileRules(configuration)
+	if err != nil {
+		return nil, err
+	}
+	daemon.compileRules.Store(compileRules)
+	daemon.invocationTimeout.Store(int64(time.Duration(configuration.InvocationTimeout) * time.Second))
+	daemon.objWaitTimeout.Store(int64(time.Duration(configuration.ObjWaitTimeout) * time.Second))
+
+	daemon.reproRecorder, err = MakeReproRecorder(configuration.ReproDir)
+	if err != nil {
+		return nil, err
+	}
+
+	daemon.provenanceChecker, err = MakeObjProvenanceChecker(configuration.WriteProvenance, configuration.ProvenanceKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	daemon.systemHeaderDirs, err = calcSystemHeaderDirs(configuration.SystemHeaderDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	daemon.serverDiscovery.Store(serverDiscovery)
 	daemon.ConnectToRemoteHosts()
 
 	return daemon, nil
@@ -114,6 +226,14 @@ func (daemon *Daemon) ConnectToRemoteHosts() {
 	wg.Wait()
 }
 
+// getRemoteConnections returns remotes from the current config; the slice is never modified, only replaced on reload
+func (daemon *Daemon) getRemoteConnections() []*RemoteConnection {
+	daemon.mu.RLock()
+	remoteConnections := daemon.remoteConnections
+	daemon.mu.RUnlock()
+	return remoteConnections
+}
+
 func (daemon *Daemon) StartListeningUnixSocket() error {
 	daemon.listener = MakeDaemonRpcListener()
 	return daemon.listener.StartListeningUnixSocket()
@@ -122,17 +242,16 @@ func (daemon *Daemon) StartListeningUnixSocket() error {
 func (daemon *Daemon) ServeUntilNobodyAlive() {
 	logClient.Info(0, "nocc-daemon started in", time.Since(daemon.startTime).Milliseconds(), "ms")
 
-	var rLimit syscall.Rlimit
-	_ = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
-	logClient.Info(0, "env:", "clientID", daemon.clientID, "; num servers", len(daemon.remoteConnections), "; ulimit -n", rLimit.Cur, "; num cpu", runtime.NumCPU(), "; version", common.GetVersion())
+	logClient.Info(0, "env:", "clientID", daemon.clientID, "; num servers", len(daemon.getRemoteConnections()), "; ulimit -n", getOpenFilesLimit(), "; num cpu", runtime.NumCPU(), "; version", common.GetVersion())
 
 	go daemon.PeriodicallyInterruptHangedInvocations()
+	go daemon.PeriodicallyRefreshServers(daemon.discoveryInterval)
 	go daemon.listener.StartAcceptingConnections(daemon)
 	daemon.listener.EnterInfiniteLoopUntilQuit(daemon)
 }
 
 func (daemon *Daemon) KeepAlive() {
-	for _, remote := range daemon.remoteConnections {
+	for _, remote := range daemon.getRemoteConnections() {
 		go remote.VerifyAlive()
 	}
 }
@@ -145,9 +264,11 @@ func (daemon *Daemon) QuitDaemonGracefully(reason string) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	for _, remote := range daemon.remoteConnections {
-		remote.SendStopClient(ctx)
-		remote.Clear()
+	if daemon.reportBuildSummaries {
+		daemon.ReportBuildSummaries(ctx)
+	}
+	for _, remote := range daemon.getRemoteConnections() {
+		remote.Close(ctx, daemon.stableClientID) // a next build is likely to be soon, let servers keep files
 	}
 
 	daemon.mu.Lock()
@@ -155,52 +276,149 @@ func (daemon *Daemon) QuitDaemonGracefully(reason string) {
 		invocation.ForceInterrupt(fmt.Errorf("daemon quit: %v", reason))
 	}
 	daemon.mu.Unlock()
+
+	if report := daemon.stats.SlowestFilesReport(); report != "" {
+		logClient.Info(0, report)
+	}
+	// interrupted invocations end their spans on returning, export them too
+	for start := time.Now(); daemon.activeInvocationsCount() > 0 && time.Since(start) < 2*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tracerClient.Close()
+	daemon.timeline.Close()
+	daemon.compileTimes.Save()
+	daemon.statsHistory.Save(daemon.stats.toStatsRun(daemon.startTime))
+}
+
+func (daemon *Daemon) activeInvocationsCount() int {
+	daemon.mu.RLock()
+	defer daemon.mu.RUnlock()
+	return len(daemon.activeInvocations)
 }
 
 func (daemon *Daemon) HandleInvocation(req DaemonSockRequest) DaemonSockResponse {
+	if req.Compiler == "" {
+		return daemon.HandleDaemonCommand(req)
+	}
+
 	response := daemon.HandleCompilation(req)
 
 	return DaemonSockResponse{
 		ExitCode: response.exitCode,
+		Signal:   response.signal,
 		Stdout:   response.stdout,
 		Stderr:   response.stderr,
 	}
 }
 
 func (daemon *Daemon) HandleCompilation(req DaemonSockRequest) CompilerLaunchResponse {
+	buildGroup := daemon.buildGroups.GetBuildGroup(req.BuildID, req.Cwd)
+	req.BuildID = buildGroup.buildID
+
 	invocation := CreateInvocation(req)
-	invocation.ParseCmdLineInvocation(req.CmdLine)
+	invocation.buildGroup = buildGroup
+	invocation.project = daemon.projectConfigs.GetProjectConfig(req.Cwd)
+	invocation.compileRules = daemon.compileRules.Load()
+	invocation.baseDir = daemon.baseDir
+	invocation.ParseCmdLineInvocation(daemon.compilerScripts.ResolveCmdLine(invocation, req.CmdLine))
+	if invocation.invokeType == invokedForCompilingCpp {
+		invocation.applyDepFileEnv()
+	}
+	invocation.policy = invocation.compileRules.Policy(invocation)
+	invocation.summary.AddTiming("parsed_cmdline")
+
+	// a compiler colors diagnostics only writing to a terminal, but its output is captured (by a server or a daemon);
+	// a flag is added to a command line of a server and of a local fallback (see invokeLocally), req.CmdLine stays as is
+	if req.StderrIsTerminal && invocation.invokeType == invokedForCompilingCpp && !specifiesDiagnosticsColor(req.CmdLine) {
+		invocation.diagnosticsColor = true
+	}
+
+	if invocation.invokeType == invokedForCompilingMany {
+		return daemon.compileInputFilesSeparately(req, invocation)
+	}
+
+	if invocation.invokeType != invokedForCompilingCpp {
+		daemon.recordLocalInvocation(buildGroup, localFallbackReason(invocation))
+	}
 
+	timelineLane := daemon.timeline.AcquireLane()
+	response := daemon.dispatchInvocation(req, invocation)
+	daemon.timeline.RecordInvocation(invocation, timelineLane, response.exitCode)
+
+	return response
+}
+
+func (daemon *Daemon) dispatchInvocation(req DaemonSockRequest, invocation *Invocation) CompilerLaunchResponse {
 	switch invocation.invokeType {
 	default:
-		return daemon.InvokeLocalCompilation(req, errors.New("unexpected invokeType after parsing"))
+		return daemon.invokeLocally(req, invocation, errors.New("unexpected invokeType after parsing"))
 
 	case invokedForLocalCompiling:
-		return daemon.InvokeLocalCompilation(req, nil)
+		return daemon.invokeLocally(req, invocation, nil)
 	case invokedUnsupported:
 		// if command-line has unsupported options or is non-well-formed,
 		// invocation.err describes a human-readable reason
-		return daemon.InvokeLocalCompilation(req, invocation.err)
+		return daemon.invokeLocally(req, invocation, invocation.err)
 
 	case invokedForLinking:
 		logClient.Info(1, "fallback to local compiler for linking")
-		return daemon.InvokeLocalCompilation(req, nil)
+		return daemon.invokeLocally(req, invocation, nil)
 
 	case invokedForCompilingPch:
 		logClient.Info(1, "compiling pch locally")
 		return daemon.invokePCHCompilation(req, invocation)
 
 	case invokedForCompilingCpp:
+		if invocation.project.IsForcedLocal(invocation.cwd, invocation.cppInFile) {
+			logClient.Info(1, "compiling locally, forced by project config", invocation.cppInFile)
+			daemon.recordLocalInvocation(invocation.buildGroup, "project_force_local")
+			return daemon.invokeLocally(req, invocation, nil)
+		}
+
+		if invocation.project.UsesDependMode() {
+			if response, reason := daemon.dependCache.Revalidate(invocation); response != nil {
+				logClient.Info(1, "not compiling, depend mode:", reason, invocation.cppInFile)
+				daemon.recordLocalInvocation(invocation.buildGroup, reason)
+				return *response
+			}
+		}
+
+		daemon.applyCompileTimePrediction(invocation)
+
+		if compileLocally, reason := daemon.shouldCompileLocallyWhileSaturated(req, invocation); compileLocally {
+			logClient.Info(1, "compiling locally, remotes are saturated:", reason, invocation.cppInFile)
+			daemon.recordLocalInvocation(invocation.buildGroup, "remotes_saturated")
+			return daemon.invokeLocally(req, invocation, nil)
+		}
+
 		logClient.Info(1, "compiling remotely", invocation.cppInFile)
 		rresult, err := daemon.invokeForRemoteCompiling(invocation)
 
 		if err == nil && (rresult.interrupted || rresult.exitCode == 0) {
+			if !rresult.interrupted && !invocation.fromObjCache {
+				daemon.adaptiveSplit.RecordRemote(time.Since(invocation.createTime))
+				daemon.compileTimes.Record(invocation)
+			}
+			daemon.recordRemoteInvocation(invocation, false)
 			return *rresult
 		}
 
-		lresult := daemon.InvokeLocalCompilation(req, err)
+		if invocation.summary.remoteHost == "" {
+			daemon.recordLocalInvocation(invocation.buildGroup, "no_remote")
+		} else {
+			daemon.recordRemoteInvocation(invocation, true)
+		}
+
+		lresult := daemon.invokeLocally(req, invocation, err)
+		daemon.provenanceChecker.removeStale(invocation)
+		// a busy remote refused a session, nothing was compiled there, it's not its failure
+		refusedAsBusy := invocation.summary.remoteFailReason == "remote_busy"
+		if !refusedAsBusy {
+			daemon.serverQuarantine.OnRemoteFailed(invocation, lresult.exitCode)
+		}
 
-		if lresult.exitCode == 0 {
+		if lresult.exitCode == 0 && !refusedAsBusy {
+			daemon.reproRecorder.Record(invocation, err)
 			message := fmt.Sprintf("compiling %s remotely on %s failed, but succeeded locally\n", invocation.cppInFile, invocation.summary.remoteHost)
 			logClient.Error(message)
 		}
@@ -209,8 +427,46 @@ func (daemon *Daemon) HandleCompilation(req DaemonSockRequest) CompilerLaunchRes
 	}
 }
 
+// compileInputFilesSeparately handles `g++ -c a.cpp b.cpp`: every input file is compiled by its own invocation
+// (in parallel, each one can go remote), as if a build system launched `g++ -c a.cpp` and `g++ -c b.cpp`.
+// Like a compiler, it fails if any file fails; outputs of all files are concatenated in order of a cmd line.
+func (daemon *Daemon) compileInputFilesSeparately(req DaemonSockRequest, invocation *Invocation) CompilerLaunchResponse {
+	responses := make([]CompilerLaunchResponse, len(invocation.inFileArgs))
+	wg := sync.WaitGroup{}
+	for i, inFileArg := range invocation.inFileArgs {
+		fileReq := req
+		fileReq.SessionId = daemon.totalInvocations.Add(1)
+		fileReq.Output = nil // not streamed, outputs of files are concatenated in order
+		fileReq.CmdLine = make([]string, 0, len(req.CmdLine))
+		for _, arg := range req.CmdLine {
+			if arg == inFileArg || !slices.Contains(invocation.inFileArgs, arg) {
+				fileReq.CmdLine = append(fileReq.CmdLine, arg)
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = daemon.HandleCompilation(fileReq)
+		}()
+	}
+	wg.Wait()
+
+	merged := CompilerLaunchResponse{}
+	for _, response := range responses {
+		merged.interrupted = merged.interrupted || response.interrupted
+		if merged.exitCode == 0 {
+			merged.exitCode = response.exitCode
+			merged.signal = response.signal
+		}
+		merged.stdout = append(merged.stdout, response.stdout...)
+		merged.stderr = append(merged.stderr, response.stderr...)
+	}
+	return merged
+}
+
 func (daemon *Daemon) invokePCHCompilation(req DaemonSockRequest, invocation *Invocation) CompilerLaunchResponse {
-	response := daemon.InvokeLocalCompilation(req, nil)
+	response := daemon.invokeLocally(req, invocation, nil)
 	sha256PCH, _ := common.GetFileSHA256(invocation.objOutFile)
 
 	pchinvocation := common.PCHInvocation{
@@ -228,23 +484,34 @@ func (daemon *Daemon) invokePCHCompilation(req DaemonSockRequest, invocation *In
 }
 
 func (daemon *Daemon) invokeForRemoteCompiling(invocation *Invocation) (*CompilerLaunchResponse, error) {
-	if len(daemon.remoteConnections) == 0 {
-		return nil, fmt.Errorf("no remote hosts set; use NOCC_SERVERS env var to provide servers")
+	remote, err := daemon.chooseRemoteConnectionForCppCompilation(invocation)
+	if err != nil {
+		return nil, err
 	}
 
-	remote := daemon.chooseRemoteConnectionForCppCompilation(invocation.cppInFile)
-
 	invocation.summary.remoteHost = remote.remoteHost
+	invocation.summary.remoteHostPort = remote.remoteHostPort
 
 	if remote.isUnavailable.Load() {
 		return nil, fmt.Errorf("remote %s is unavailable", remote.remoteHost)
 	}
 
+	if err := daemon.sessionLimits.Acquire(remote, invocation, time.Duration(daemon.invocationTimeout.Load()), daemon.quitDaemonChan); err != nil {
+		// nothing was sent to a remote, it's not its failure
+		invocation.summary.remoteHost, invocation.summary.remoteHostPort = "", ""
+		return nil, err
+	}
+	defer daemon.sessionLimits.Release(remote)
+
 	daemon.mu.Lock()
 	daemon.activeInvocations[invocation.sessionID] = invocation
 	daemon.mu.Unlock()
 
+	remote.nActiveSessions.Add(1)
+	startInvocationSpan(invocation)
 	response, err := CompileCppRemotely(daemon, remote, invocation)
+	endInvocationSpan(invocation, err)
+	remote.nActiveSessions.Add(-1)
 
 	daemon.mu.Lock()
 	delete(daemon.activeInvocations, invocation.sessionID)
@@ -255,19 +522,87 @@ func (daemon *Daemon) invokeForRemoteCompiling(invocation *Invocation) (*Compile
 	return response, err
 }
 
+// invokeLocally is InvokeLocalCompilation for a parsed invocation, its duration is saved to a summary.
+// Like on a server, diagnostics are colored for a terminal (req is a copy, a caller's command line isn't changed).
+func (daemon *Daemon) invokeLocally(req DaemonSockRequest, invocation *Invocation, reason error) CompilerLaunchResponse {
+	if invocation.diagnosticsColor {
+		req.CmdLine = append(slices.Clip(req.CmdLine), "-fdiagnostics-color=always")
+	}
+	start := time.Now()
+	response := daemon.InvokeLocalCompilation(req, reason)
+	invocation.summary.AddTiming("compiled_locally")
+	if invocation.invokeType == invokedForCompilingCpp && response.exitCode == 0 {
+		daemon.adaptiveSplit.RecordLocal(invocation.cppInFile, time.Since(start))
+	}
+	return response
+}
+
+// applyCompileTimePrediction marks a .cpp that compiled LongFileTime or longer last time: it gets a higher priority in server queues
+// and goes to the least loaded remote (see chooseRemoteConnectionForCppCompilation); a predicted duration is returned, 0 if unknown
+func (daemon *Daemon) applyCompileTimePrediction(invocation *Invocation) time.Duration {
+	predicted := daemon.compileTimes.Predict(invocation)
+	if daemon.compileTimes.IsLong(predicted) {
+		logClient.Info(1, "a long file, predicted", predicted, invocation.cppInFile)
+		invocation.predictedLong = true
+		invocation.policy.Priority++
+	}
+	return predicted
+}
+
+// shouldCompileLocallyWhileSaturated asks AdaptiveSplit whether a .cpp finishes faster locally than on saturated remotes.
+// A .cpp pinned to a server by PinFiles is always sent there.
+func (daemon *Daemon) shouldCompileLocallyWhileSaturated(req DaemonSockRequest, invocation *Invocation) (bool, string) {
+	if daemon.adaptiveSplit == nil || invocation.compileRules.PinnedServer(invocation) != "" {
+		return false, ""
+	}
+	candidates, err := daemon.getCandidatesForCppCompilation(invocation)
+	if err != nil {
+		return false, ""
+	}
+	return daemon.adaptiveSplit.ShouldCompileLocally(invocation, candidates, daemon.localCompilerQueue.HasFreeSlot(req.BuildID))
+}
+
 func (daemon *Daemon) InvokeLocalCompilation(req DaemonSockRequest, reason error) CompilerLaunchResponse {
 	if reason != nil {
 		logClient.Error("compiling locally:", reason)
 	}
 
-	daemon.localCompilerThrottle <- struct{}{}
-	compilerLaunchRequest := CompilerLaunchRequest{req.Cwd, req.Compiler, req.CmdLine, req.Uid, req.Gid, req.InterruptChan}
+	daemon.localCompilerQueue.Acquire(req.BuildID)
+	releaseJobserverToken := daemon.jobservers.Acquire(req.JobserverFifo, req.InterruptChan)
+	compilerLaunchRequest := CompilerLaunchRequest{req.Cwd, req.Compiler, req.CmdLine, req.Uid, req.Gid, req.InterruptChan, req.Output, req.Env}
 	response := compilerLaunchRequest.RunCompilerLocally()
-	<-daemon.localCompilerThrottle
+	releaseJobserverToken()
+	daemon.localCompilerQueue.Release(req.BuildID)
 
 	return response
 }
 
+func (daemon *Daemon) recordLocalInvocation(buildGroup *BuildGroup, reason string) {
+	daemon.stats.RecordLocalInvocation(reason)
+	buildGroup.stats.RecordLocalInvocation(reason)
+}
+
+// localFallbackReason is a short category of why an invocation (not .cpp to .o) is compiled locally, for stats
+func localFallbackReason(invocation *Invocation) string {
+	switch invocation.invokeType {
+	case invokedForLocalCompiling:
+		return "configure_test_or_asm"
+	case invokedUnsupported:
+		return "unsupported_cmdline"
+	case invokedForLinking:
+		return "linking"
+	case invokedForCompilingPch:
+		return "pch"
+	default:
+		return "unknown"
+	}
+}
+
+func (daemon *Daemon) recordRemoteInvocation(invocation *Invocation, failed bool) {
+	daemon.stats.RecordRemoteInvocation(invocation, failed)
+	invocation.buildGroup.stats.RecordRemoteInvocation(invocation, failed)
+}
+
 func (daemon *Daemon) FindInvocationBySessionID(sessionID uint32) *Invocation {
 	daemon.mu.RLock()
 	invocation := daemon.activeInvocations[sessionID]
@@ -277,7 +612,7 @@ func (daemon *Daemon) FindInvocationBySessionID(sessionID uint32) *Invocation {
 
 func (daemon *Daemon) PeriodicallyInterruptHangedInvocations() {
 	signals := make(chan os.Signal, 2)
-	signal.Notify(signals, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP)
 
 	for {
 		select {
@@ -292,11 +627,21 @@ func (daemon *Daemon) PeriodicallyInterruptHangedInvocations() {
 			if sig == syscall.SIGTERM {
 				daemon.QuitDaemonGracefully("got sigterm")
 			}
+			if sig == syscall.SIGHUP {
+				daemon.ReloadConfiguration()
+			}
 
 		case <-time.After(10 * time.Second):
+			invocationTimeout := time.Duration(daemon.invocationTimeout.Load())
+			objWaitTimeout := time.Duration(daemon.objWaitTimeout.Load())
 			daemon.mu.Lock()
 			for _, invocation := range daemon.activeInvocations {
-				if time.Since(invocation.createTime) > daemon.invocationTimeout {
+				// waiting for .o is limited only without progress, see WaitForCompiledObj
+				if lastProgress := invocation.objWaitProgress.Load(); lastProgress != 0 {
+					if sinceProgress := time.Since(time.Unix(0, lastProgress)); sinceProgress > objWaitTimeout {
+						invocation.ForceInterrupt(fmt.Errorf("interrupt sessionID %d (%s) after %d sec waiting for .o without progress", invocation.sessionID, invocation.summary.remoteHost, int(sinceProgress.Seconds())))
+					}
+				} else if time.Since(invocation.createTime) > invocationTimeout {
 					invocation.ForceInterrupt(fmt.Errorf("interrupt sessionID %d (%s) after %d sec timeout, reached step %s", invocation.sessionID, invocation.summary.remoteHost, int(time.Since(invocation.createTime).Seconds()), invocation.summary.timings[len(invocation.summary.timings)-1].stepName))
 				}
 			}
@@ -305,8 +650,163 @@ func (daemon *Daemon) PeriodicallyInterruptHangedInvocations() {
 	}
 }
 
-func (daemon *Daemon) chooseRemoteConnectionForCppCompilation(cppInFile string) *RemoteConnection {
+// chooseRemoteConnectionForCppCompilation balances between remotes based on .cpp basename.
+// Remotes whose compiler doesn't support -std= or a target (-target/-m32, for cross-compilation) of a .cpp are skipped, then RemoteScheduler decides among the rest
+// (e.g., if the natural remote is saturated, the next one having free slots is preferred,
+// so that a server with reduced capacity (see server.CapacitySchedule) receives fewer files).
+// A .cpp pinned to a server by PinFiles is sent there unless it's unavailable.
+func (daemon *Daemon) chooseRemoteConnectionForCppCompilation(invocation *Invocation) (*RemoteConnection, error) {
+	candidates, err := daemon.getCandidatesForCppCompilation(invocation)
+	if err != nil {
+		return nil, err
+	}
+
+	if pinnedServer := invocation.compileRules.PinnedServer(invocation); pinnedServer != "" {
+		for _, remote := range candidates {
+			if remote.remoteHostPort == pinnedServer && !remote.isUnavailable.Load() {
+				return remote, nil
+			}
+		}
+		logClient.Info(1, "pinned remote", pinnedServer, "can't compile now, choosing another one for", invocation.cppInFile)
+	}
+	if invocation.predictedLong {
+		candidates = sortByLoad(candidates)
+	}
+	return daemon.scheduler.ChooseRemote(invocation, candidates), nil
+}
+
+// getCandidatesForCppCompilation returns remotes able to compile a .cpp, the natural one (by .cpp basename) first.
+func (daemon *Daemon) getCandidatesForCppCompilation(invocation *Invocation) ([]*RemoteConnection, error) {
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(filepath.Base(invocation.cppInFile)))
+	remoteConnections := daemon.getRemoteConnections()
+	nRemotes := len(remoteConnections)
+	if nRemotes == 0 {
+		return nil, fmt.Errorf("no remote hosts set; set Servers in a config or use NOCC_SERVERS env var to provide servers")
+	}
+	first := int(hasher.Sum32()) % nRemotes
+
+	std := invocation.GetStdVersion()
+	targetArgs := common.ExtractTargetArgs(invocation.compilerArgs)
+	candidates := make([]*RemoteConnection, 0, nRemotes)
+	nQuarantined := 0
+	for i := 0; i < nRemotes; i++ {
+		remote := remoteConnections[(first+i)%nRemotes]
+		if daemon.serverQuarantine.IsQuarantined(remote.remoteHostPort) {
+			nQuarantined++
+			continue
+		}
+		if !remote.cacheOnly.Load() && invocation.project.AllowsServer(remote.remoteHostPort) && remote.SupportsCompiling(invocation.compilerName, std, targetArgs) &&
+			(invocation.policy.ServerTag == "" || invocation.compileRules.HasServerTag(remote.remoteHostPort, invocation.policy.ServerTag)) {
+			candidates = append(candidates, remote)
+		}
+	}
+	if len(candidates) == 0 && nQuarantined > 0 {
+		return nil, fmt.Errorf("%d of %d remotes are quarantined, others can't compile %s -std=%s %s", nQuarantined, nRemotes, invocation.compilerName, std, strings.Join(targetArgs, " "))
+	}
+	if len(candidates) == 0 && invocation.policy.ServerTag != "" {
+		return nil, fmt.Errorf("no remote having tag %s supports %s -std=%s %s", invocation.policy.ServerTag, invocation.compilerName, std, strings.Join(targetArgs, " "))
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no remote supports %s -std=%s %s", invocation.compilerName, std, strings.Join(targetArgs, " "))
+	}
+	return candidates, nil
+}
+
+// cacheProbeTimeout limits how long compilation is delayed by findRemoteHavingObj; a remote not answered in time is treated as a miss
+const cacheProbeTimeout = 500 * time.Millisecond
+
+// findRemoteHavingObj asks a chosen remote and a few other candidates (up to CacheProbeRemotes in total) in parallel,
+// whether a .o is already in their obj cache (see RemoteConnection.ProbeObjCache).
+// Every remote has its own obj cache, so a .o compiled by another remote (e.g. when the natural one was saturated,
+// or before servers were added) is reused instead of being compiled again: a farm works like one shared cache.
+// Returns chosen if it has a .o or if nobody has it; a remote a .cpp is pinned to (see PinFiles) is not probed around.
+func (daemon *Daemon) findRemoteHavingObj(invocation *Invocation, chosen *RemoteConnection, requiredFiles []*pb.FileMetadata, requiredPchFile *pb.FileMetadata) *RemoteConnection {
+	if daemon.cacheProbeRemotes <= 1 || invocation.policy.NoObjCache || chosen.remoteHostPort == invocation.compileRules.PinnedServer(invocation) {
+		return chosen
+	}
+	candidates, err := daemon.getCandidatesForCppCompilation(invocation)
+	if err != nil || len(candidates) == 1 {
+		return chosen
+	}
+
+	probed := []*RemoteConnection{chosen}
+	for _, remote := range candidates {
+		if remote != chosen && !remote.isUnavailable.Load() && len(probed) < daemon.cacheProbeRemotes {
+			probed = append(probed, remote)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheProbeTimeout)
+	defer cancel()
+	exists := make([]bool, len(probed))
+	wg := sync.WaitGroup{}
+	for i, remote := range probed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if exists[i], err = remote.ProbeObjCache(ctx, invocation, requiredFiles, requiredPchFile); err != nil {
+				logClient.Info(2, "failed to probe obj cache on", remote.remoteHost, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, remote := range probed {
+		if exists[i] {
+			if remote != chosen {
+				logClient.Info(1, "remote", remote.remoteHost, "has obj in cache, not", chosen.remoteHost, invocation.cppInFile)
+			}
+			return remote
+		}
+	}
+	return chosen
+}
+
+// startSessionAvoidingBusy starts a session on a chosen remote. If it refuses as busy (low memory or a full disk, see server.AdaptiveCapacity and server.DiskWatchdog),
+// it's considered saturated for a while, and a session is started once on another remote, if any can take it now.
+// Returns a remote a session was started on; if none, remoteFailReason is "remote_busy", and a .cpp is compiled locally.
+func (daemon *Daemon) startSessionAvoidingBusy(chosen *RemoteConnection, invocation *Invocation, requiredFiles []*pb.FileMetadata, requiredPchFile *pb.FileMetadata, onDemand bool) (*RemoteConnection, []fileToUpload, error) {
+	filesToUpload, err := chosen.StartCompilationSession(invocation, requiredFiles, requiredPchFile)
+	if err == nil || !isRemoteBusyError(err) {
+		return chosen, filesToUpload, err
+	}
+
+	chosen.OnRemoteBusy()
+	invocation.summary.remoteFailReason = "remote_busy"
+	remote, chooseErr := daemon.chooseRemoteConnectionForCppCompilation(invocation)
+	if chooseErr != nil || remote == chosen || remote.IsSaturated() || remote.isUnavailable.Load() || (onDemand && !remote.acceptsOnDemandIncludes.Load()) {
+		return chosen, nil, err
+	}
+
+	logClient.Info(1, "remote", chosen.remoteHost, "is busy, starting a session on", remote.remoteHost, "instead", invocation.cppInFile)
+	invocation.summary.remoteFailReason = ""
+	invocation.summary.remoteHost = remote.remoteHost
+	invocation.summary.remoteHostPort = remote.remoteHostPort
+	filesToUpload, err = remote.StartCompilationSession(invocation, requiredFiles, requiredPchFile)
+	return remote, filesToUpload, err
+}
+
+// chooseCacheRemote returns a cache server (see RemoteConnection.StartCachedSession) to look up a .o before compiling, or nil if none.
+// Like for full servers, a .cpp is always looked up on the same one, based on its basename.
+func (daemon *Daemon) chooseCacheRemote(invocation *Invocation) *RemoteConnection {
+	if !invocation.project.UsesCacheServers() || invocation.policy.NoObjCache {
+		return nil
+	}
+
+	cacheRemotes := make([]*RemoteConnection, 0)
+	for _, remote := range daemon.getRemoteConnections() {
+		if remote.cacheOnly.Load() && !remote.isUnavailable.Load() && invocation.project.AllowsServer(remote.remoteHostPort) &&
+			!daemon.serverQuarantine.IsQuarantined(remote.remoteHostPort) {
+			cacheRemotes = append(cacheRemotes, remote)
+		}
+	}
+	if len(cacheRemotes) == 0 {
+		return nil
+	}
+
 	hasher := fnv.New32a()
-	_, _ = hasher.Write([]byte(filepath.Base(cppInFile)))
-	return daemon.remoteConnections[int(hasher.Sum32())%len(daemon.remoteConnections)]
+	_, _ = hasher.Write([]byte(filepath.Base(invocation.cppInFile)))
+	return cacheRemotes[int(hasher.Sum32())%len(cacheRemotes)]
 }
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// uploadFileDelta sends a file as a delta against a previous version a remote has (see server.offerDeltaBases).
+// It's for generated sources (.pb.cc, moc outputs, etc.) that are regenerated on every build and differ slightly.
+// If a delta isn't much smaller than a file, or a remote couldn't reconstruct a file from it (UploadFileReply.DeltaFailed),
+// 0 sent bytes are returned with no error: then a file is uploaded whole over the same stream.
+func uploadFileDelta(stream pb.CompilationService_UploadFileStreamClient, req fileUploadReq) (int64, error) {
+	body, err := os.ReadFile(req.invocation.uploadedFileName(req.file.FileName))
+	if err == nil && int64(len(body)) != req.file.FileSize {
+		err = fmt.Errorf("file %s changed while uploading", req.file.FileName)
+	}
+	if err != nil {
+		return 0, &uploadFileError{err}
+	}
+
+	deltaBase := req.deltaBase
+	if deltaBase.BlockSize == 0 || len(deltaBase.WeakChecksums) != len(deltaBase.StrongChecksums) {
+		return 0, nil
+	}
+	delta := common.MakeDelta(body, int(deltaBase.BlockSize), deltaBase.WeakChecksums, deltaBase.StrongChecksums)
+	if len(delta) == 0 || int64(len(delta)) > req.file.FileSize*3/4 {
+		logClient.Info(2, "delta is too large", len(delta), "of", req.file.FileSize, req.file.FileName)
+		return 0, nil
+	}
+
+	const chunkSize = 64 * 1024
+	for offset := 0; offset < len(delta); offset += chunkSize {
+		common.InjectDelay(common.FaultUploadStreamDelay)
+		err = stream.Send(&pb.UploadFileChunkRequest{
+			ClientID:  req.clientID,
+			SessionID: req.invocation.sessionID,
+			FileIndex: req.fileIndex,
+			ChunkBody: delta[offset:min(offset+chunkSize, len(delta))],
+			DeltaSize: int64(len(delta)),
+		})
+		if err == io.EOF { // a stream is broken, an actual error is returned by Recv
+			if _, recvErr := stream.Recv(); recvErr != nil {
+				err = recvErr
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	reply, err := stream.Recv()
+	if err != nil {
+		return 0, err
+	}
+	if reply.DeltaFailed {
+		logClient.Info(1, "remote failed to apply delta, upload whole", req.file.FileName)
+		return 0, nil
+	}
+	logClient.Info(2, "uploaded delta", len(delta), "bytes of", req.file.FileSize, req.file.FileName)
+	return int64(len(delta)), nil
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"path"
+	"strings"
 
 	"nocc/internal/common"
 )
@@ -25,6 +26,7 @@ type DepCmdFlags struct {
 	flagMD      bool   // -MD (like -MF {def file})
 	flagMMD     bool   // -MMD (mention only user header files, not system header files)
 	flagMP      bool   // -MP (add a phony target for each dependency other than the main file)
+	appendToMF  bool   // a depfile is appended to, see Invocation.applyDepFileEnv
 }
 
 func (deps *DepCmdFlags) SetCmdFlagMF(absFilename string) {
@@ -82,7 +84,7 @@ func (deps *DepCmdFlags) GenerateAndSaveDepFile(invocation *Invocation, hFiles [
 		// > causing each to depend on nothing.
 		for idx, depStr := range depListMainTarget {
 			if idx > 0 { // 0 is cppInFile
-				depTargets = append(depTargets, DepFileTarget{escapeMakefileSpaces(depStr), nil})
+				depTargets = append(depTargets, DepFileTarget{depStr, nil}) // already quoted
 			}
 		}
 	}
@@ -91,14 +93,20 @@ func (deps *DepCmdFlags) GenerateAndSaveDepFile(invocation *Invocation, hFiles [
 		DTargets: depTargets,
 	}
 
+	if deps.appendToMF {
+		return depFileName, invocation.AppendFile(depFileName, depFile.WriteToBytes())
+	}
 	return depFileName, invocation.WriteFile(depFileName, depFile.WriteToBytes())
 }
 
 // calcDefaultTargetName returns targetName if no -MT and similar options passed
 func (deps *DepCmdFlags) calcDefaultTargetName(invocation *Invocation) string {
 	// g++ documentation doesn't satisfy its actual behavior, the implementation seems to be just
-	// (remember, that objOutFile is not a full path, it's a relative as specified in cmd line)
-	return invocation.objOutFile
+	// the -o argument as specified in cmd line (not a full path), or {basename}.o if -o is omitted
+	if invocation.objOutArg != "" {
+		return quoteMakefileTarget(invocation.objOutArg)
+	}
+	return quoteMakefileTarget(common.ReplaceFileExt(path.Base(invocation.cppInFile), ".o"))
 }
 
 // calcOutputDepFileName returns a name of generated .o.d file based on cmd flags
@@ -115,15 +123,15 @@ func (deps *DepCmdFlags) calcOutputDepFileName(invocation *Invocation) string {
 	if invocation.objOutFile != "" {
 		return common.ReplaceFileExt(invocation.objOutFile, ".d")
 	}
-	return common.ReplaceFileExt(path.Base(invocation.cppInFile), ".d")
+	return common.PathAbs(invocation.cwd, common.ReplaceFileExt(path.Base(invocation.cppInFile), ".d"))
 }
 
-// calcDepListFromHFiles fills DepFileTarget.TargetDepList
+// calcDepListFromHFiles fills DepFileTarget.TargetDepList, every item is quoted (written to a depfile as is)
 func (deps *DepCmdFlags) calcDepListFromHFiles(invocation *Invocation, hFiles []*IncludedFile) []string {
 	depList := make([]string, 0, 1+len(hFiles))
-	depList = append(depList, quoteMakefileTarget(invocation.cppInFile))
+	depList = append(depList, quoteMakefileDep(relativeToBaseDir(invocation.baseDir, invocation.cwd, invocation.cppInFile)))
 	for _, hFile := range hFiles {
-		depList = append(depList, quoteMakefileTarget(hFile.fileName))
+		depList = append(depList, quoteMakefileDep(relativeToBaseDir(invocation.baseDir, invocation.cwd, hFile.fileName)))
 	}
 
 	return depList
@@ -133,8 +141,7 @@ func (deps *DepCmdFlags) calcDepListFromHFiles(invocation *Invocation, hFiles []
 func quoteMakefileTarget(targetName string) (escaped string) {
 	for i := range len(targetName) {
 		switch targetName[i] {
-		case ' ':
-		case '\t':
+		case ' ', '\t':
 			for j := i - 1; j >= 0 && targetName[j] == '\\'; j-- {
 				escaped += string('\\') // escape the preceding backslashes
 			}
@@ -148,3 +155,10 @@ func quoteMakefileTarget(targetName string) (escaped string) {
 	}
 	return
 }
+
+// quoteMakefileDep is quoteMakefileTarget for a dependency, a colon and a newline are also escaped
+func quoteMakefileDep(depName string) string {
+	escaped := quoteMakefileTarget(depName)
+	escaped = strings.ReplaceAll(escaped, "\n", "\\\n")
+	return strings.ReplaceAll(escaped, ":", "\\:")
+}
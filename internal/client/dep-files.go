@@ -3,7 +3,6 @@ package client
 import (
 	"bytes"
 	"fmt"
-	"strings"
 )
 
 // DepFileTarget is one target in .o.d file:
@@ -27,11 +26,11 @@ func (dFile *DepFile) WriteToBytes() []byte {
 		if b.Len() > 0 {
 			b.WriteRune('\n')
 		}
-		fmt.Fprintf(&b, "%s:", dTarget.TargetName) // note that necessary escaping should be pre-done
+		fmt.Fprintf(&b, "%s:", dTarget.TargetName) // note that necessary escaping should be pre-done, for deps also
 		if len(dTarget.TargetDepList) > 0 {
-			fmt.Fprintf(&b, " %s", escapeMakefileSpaces(dTarget.TargetDepList[0]))
+			fmt.Fprintf(&b, " %s", dTarget.TargetDepList[0])
 			for _, hDepFileName := range dTarget.TargetDepList[1:] {
-				fmt.Fprintf(&b, " \\\n  %s", escapeMakefileSpaces(hDepFileName))
+				fmt.Fprintf(&b, " \\\n  %s", hDepFileName)
 			}
 		}
 		b.WriteRune('\n')
@@ -39,11 +38,3 @@ func (dFile *DepFile) WriteToBytes() []byte {
 
 	return b.Bytes()
 }
-
-// escapeMakefileSpaces outputs a string which slashed spaces
-func escapeMakefileSpaces(depItemName string) string {
-	depItemName = strings.ReplaceAll(depItemName, "\n", "\\\n")
-	depItemName = strings.ReplaceAll(depItemName, " ", "\\ ")
-	depItemName = strings.ReplaceAll(depItemName, ":", "\\:")
-	return depItemName
-}
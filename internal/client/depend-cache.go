@@ -0,0 +1,291 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nocc/internal/common"
+)
+
+// DependCache implements a "depend mode" (like in ccache) for build systems with coarse dirty tracking,
+// which launch a compiler for every file even on a no-op rebuild.
+// After a successful remote compilation, a manifest is saved: all dependencies of a .cpp (as collected via `compiler -M`)
+// with their sizes, mtimes and sha256, and a copy of the resulting .o.
+// Before the next compilation of the same command line, they are revalidated (only files with a changed mtime are hashed):
+// * if nothing changed and the .o is the same as was produced, there is nothing to do;
+// * if nothing changed, but the .o was deleted or rewritten, it's restored from a local copy;
+// * otherwise, a .cpp is compiled remotely as usual (and a manifest is overwritten).
+// Like in ccache, a newly created header that would shadow an old one (in an earlier -I dir) is not detected.
+type DependCache struct {
+	dir string
+}
+
+type dependManifest struct {
+	Inputs     []dependFile // a compiler, a .cpp, a pch, files from -f options, BMIs; not a part of a depfile
+	Deps       []dependFile // the same order as collected, to generate the same depfile
+	ObjSize    int64
+	ObjModTime int64
+	ObjSHA256  string
+	Stderr     []byte // compiler warnings are output again when a .o is not compiled
+}
+
+type dependFile struct {
+	FileName      string
+	SymlinkTarget string `json:",omitempty"`
+	FileSize      int64
+	ModTime       int64 // 0 if a file was modified just before saving, then it's always hashed
+	SHA256        string
+}
+
+// a file modified within this interval before saving could be modified once more with the same mtime
+const dependModTimeGranularity = 2 * time.Second
+
+func MakeDependCache(dir string) (*DependCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &DependCache{dir: dir}, nil
+}
+
+// Revalidate returns a response if an invocation doesn't need to be compiled, and a reason for stats.
+// It returns nil if a .cpp must be compiled (no manifest, a dependency changed, etc.).
+func (cache *DependCache) Revalidate(invocation *Invocation) (*CompilerLaunchResponse, string) {
+	if cache == nil || invocation.bmiOutFile != "" || invocation.sideOutputs { // only a .o is saved, not a BMI or side outputs
+		return nil, ""
+	}
+	manifestFileName, cachedObjFileName := cache.fileNames(invocation)
+
+	manifest := &dependManifest{}
+	data, err := os.ReadFile(manifestFileName)
+	if err != nil || json.Unmarshal(data, manifest) != nil {
+		return nil, ""
+	}
+
+	manifestChanged := false
+	for _, files := range [][]dependFile{manifest.Inputs, manifest.Deps} {
+		for i := range files {
+			unchanged, rehashed := files[i].revalidate()
+			if !unchanged {
+				logClient.Info(1, "depend mode: changed", files[i].FileName, "for", invocation.cppInFile)
+				return nil, ""
+			}
+			manifestChanged = manifestChanged || rehashed
+		}
+	}
+
+	reason := "depend_up_to_date"
+	objUnchanged, objRehashed := manifest.revalidateObj(invocation.objOutFile)
+	if objRehashed {
+		manifest.setObjStat(invocation.objOutFile)
+		manifestChanged = true
+	}
+	if !objUnchanged {
+		objData, err := os.ReadFile(cachedObjFileName)
+		if err != nil {
+			return nil, ""
+		}
+		if err := invocation.WriteFile(invocation.objOutFile, objData); err != nil {
+			logClient.Error("depend mode: can't restore", invocation.objOutFile, err)
+			return nil, ""
+		}
+		manifest.setObjStat(invocation.objOutFile)
+		manifestChanged = true
+		reason = "depend_cache_hit"
+	}
+	if manifestChanged {
+		_ = cache.writeFileAtomically(manifestFileName, manifest.toJSON())
+	}
+
+	if invocation.depsFlags.ShouldGenerateDepFile() {
+		hFiles := make([]*IncludedFile, 0, len(manifest.Deps))
+		for _, dep := range manifest.Deps {
+			hFiles = append(hFiles, &IncludedFile{fileName: dep.FileName, isSymlink: dep.SymlinkTarget != "", symlinkTarget: dep.SymlinkTarget})
+		}
+		if _, err := invocation.depsFlags.GenerateAndSaveDepFile(invocation, hFiles); err != nil {
+			logClient.Error("error generating depfile:", err)
+			return nil, ""
+		}
+	}
+
+	return &CompilerLaunchResponse{
+		exitCode: 0,
+		stderr:   manifest.Stderr,
+	}, reason
+}
+
+// Save is called after a .cpp was successfully compiled remotely and a .o was saved
+func (cache *DependCache) Save(invocation *Invocation, includes *DependentIncludesResponse) {
+	if cache == nil || invocation.bmiOutFile != "" || invocation.sideOutputs {
+		return
+	}
+	manifestFileName, cachedObjFileName := cache.fileNames(invocation)
+
+	manifest := &dependManifest{
+		Inputs: make([]dependFile, 0, 4),
+		Deps:   make([]dependFile, 0, len(includes.requiredFiles)),
+		Stderr: invocation.compilerStderr,
+	}
+	inputs := []*IncludedFile{includes.cppFile}
+	if compiler, err := createIncludedFileWithBuffer(lookupCompilerPath(invocation)); err == nil {
+		inputs = append(inputs, compiler)
+	}
+	if includes.pchFile != nil {
+		inputs = append(inputs, includes.pchFile)
+	}
+	for _, fOptionFile := range invocation.fOptionFiles {
+		if file, err := createIncludedFileWithBuffer(fOptionFile); err == nil {
+			inputs = append(inputs, file)
+		}
+	}
+	for _, bmiFile := range invocation.bmiInFiles {
+		if file, err := createIncludedFileWithBuffer(bmiFile); err == nil {
+			inputs = append(inputs, file)
+		}
+	}
+	for _, file := range inputs {
+		manifest.Inputs = append(manifest.Inputs, makeDependFile(file))
+	}
+	for _, file := range includes.requiredFiles {
+		manifest.Deps = append(manifest.Deps, makeDependFile(file))
+	}
+
+	objSHA256, err := common.GetFileSHA256(invocation.objOutFile)
+	if err != nil {
+		return
+	}
+	manifest.ObjSHA256 = objSHA256.ToLongHexString()
+	manifest.setObjStat(invocation.objOutFile)
+
+	objData, err := os.ReadFile(invocation.objOutFile)
+	if err == nil {
+		err = cache.writeFileAtomically(cachedObjFileName, objData)
+	}
+	if err == nil {
+		err = cache.writeFileAtomically(manifestFileName, manifest.toJSON())
+	}
+	if err != nil {
+		logClient.Error("depend mode: can't save", invocation.cppInFile, err)
+	}
+}
+
+// fileNames returns a manifest file and a .o copy for a command line (and a working dir, since paths may be relative)
+func (cache *DependCache) fileNames(invocation *Invocation) (string, string) {
+	hasher := sha256.New()
+	hasher.Write([]byte(invocation.compilerName))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(invocation.cwd))
+	for _, arg := range invocation.cmdLine {
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(arg))
+	}
+	key := hex.EncodeToString(hasher.Sum(nil))
+	return filepath.Join(cache.dir, key+".json"), filepath.Join(cache.dir, key+".o")
+}
+
+func (cache *DependCache) writeFileAtomically(fileName string, data []byte) error {
+	fileTmp, err := os.CreateTemp(cache.dir, "tmp.*")
+	if err != nil {
+		return err
+	}
+	_, err = fileTmp.Write(data)
+	if err1 := fileTmp.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(fileTmp.Name(), fileName)
+	}
+	if err != nil {
+		_ = os.Remove(fileTmp.Name())
+	}
+	return err
+}
+
+// lookupCompilerPath returns a compiler binary, so that upgrading a compiler invalidates manifests
+func lookupCompilerPath(invocation *Invocation) string {
+	if strings.ContainsRune(invocation.compilerName, filepath.Separator) {
+		return common.PathAbs(invocation.cwd, invocation.compilerName)
+	}
+	compilerPath, _ := exec.LookPath(invocation.compilerName)
+	return compilerPath
+}
+
+func makeDependFile(file *IncludedFile) dependFile {
+	if file.isSymlink {
+		return dependFile{FileName: file.fileName, SymlinkTarget: file.symlinkTarget}
+	}
+
+	dep := dependFile{
+		FileName: file.fileName,
+		FileSize: file.fileSize,
+		SHA256:   file.fileSHA256.ToLongHexString(),
+	}
+	if stat, err := os.Stat(file.fileName); err == nil {
+		dep.ModTime = stableModTime(stat.ModTime())
+	}
+	return dep
+}
+
+func stableModTime(modTime time.Time) int64 {
+	if time.Since(modTime) < dependModTimeGranularity {
+		return 0
+	}
+	return modTime.UnixNano()
+}
+
+// revalidate returns whether a file is the same as saved, and whether it was hashed for that (then ModTime is updated)
+func (dep *dependFile) revalidate() (unchanged bool, rehashed bool) {
+	if dep.SymlinkTarget != "" {
+		symlinkTarget := getSymbolicLink(dep.FileName)
+		return symlinkTarget != nil && *symlinkTarget == dep.SymlinkTarget, false
+	}
+
+	stat, err := os.Stat(dep.FileName)
+	if err != nil || stat.Size() != dep.FileSize {
+		return false, false
+	}
+	if dep.ModTime != 0 && stat.ModTime().UnixNano() == dep.ModTime {
+		return true, false
+	}
+
+	fileSHA256, err := common.GetFileSHA256(dep.FileName)
+	if err != nil || fileSHA256.ToLongHexString() != dep.SHA256 {
+		return false, false
+	}
+	dep.ModTime = stableModTime(stat.ModTime())
+	return true, true
+}
+
+// revalidateObj returns whether an existing .o is the one produced by the last compilation, like dependFile.revalidate
+func (manifest *dependManifest) revalidateObj(objOutFile string) (unchanged bool, rehashed bool) {
+	stat, err := os.Stat(objOutFile)
+	if err != nil || stat.Size() != manifest.ObjSize {
+		return false, false
+	}
+	if manifest.ObjModTime != 0 && stat.ModTime().UnixNano() == manifest.ObjModTime {
+		return true, false
+	}
+	objSHA256, err := common.GetFileSHA256(objOutFile)
+	unchanged = err == nil && objSHA256.ToLongHexString() == manifest.ObjSHA256
+	return unchanged, unchanged
+}
+
+func (manifest *dependManifest) setObjStat(objOutFile string) {
+	if stat, err := os.Stat(objOutFile); err == nil {
+		manifest.ObjSize = stat.Size()
+		manifest.ObjModTime = stableModTime(stat.ModTime())
+	}
+}
+
+func (manifest *dependManifest) toJSON() []byte {
+	data, _ := json.Marshal(manifest)
+	return data
+}
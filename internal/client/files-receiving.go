@@ -3,25 +3,34 @@ package client
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"nocc/internal/common"
 	"nocc/pb"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func (rc *RemoteConnection) CreateReceiveStream() {
-	rc.receiveStreamContext = CreateStreamContext()
-	rc.runReceiveStream()
+// nReceiveStreams are opened to every remote, .o files are received over them in parallel.
+// With one stream, a huge .o would block all small ones ready after it (head-of-line blocking).
+// The first stream is SmallObjsOnly: a server never sends large .o over it, see server.RecvCompiledObjStream.
+const nReceiveStreams = 3
+
+func (rc *RemoteConnection) CreateReceiveStream(streamIndex int) {
+	streamContext := CreateStreamContext()
+	rc.receiveStreamContext[streamIndex] = streamContext
+	rc.runReceiveStream(streamIndex, streamContext)
 }
 
-func (rc *RemoteConnection) runReceiveStream() {
-	defer rc.receiveStreamContext.cancelFunc()
+func (rc *RemoteConnection) runReceiveStream(streamIndex int, streamContext *StreamContext) {
+	defer streamContext.cancelFunc()
 
-	stream, err := rc.compilationServiceClient.RecvCompiledObjStream(rc.receiveStreamContext.ctx,
-		&pb.OpenReceiveStreamRequest{ClientID: rc.clientID},
+	stream, err := rc.compilationServiceClient.RecvCompiledObjStream(streamContext.ctx,
+		&pb.OpenReceiveStreamRequest{ClientID: rc.clientID, SmallObjsOnly: streamIndex == 0, AllowInterleaving: true},
 	)
 
 	if err != nil {
@@ -38,7 +47,7 @@ func (rc *RemoteConnection) runReceiveStream() {
 	if !needRecreateStream {
 		// when a daemon stops listening, all streams are automatically closed
 		select {
-		case <-rc.quitDaemonChan:
+		case <-rc.quitChan:
 			return
 		case <-rc.reconnectChan:
 			return
@@ -75,104 +84,244 @@ func (rc *RemoteConnection) runReceiveStream() {
 	logClient.Error("recreate recv stream:", err)
 	time.Sleep(100 * time.Millisecond)
 
-	go rc.CreateReceiveStream()
+	go rc.CreateReceiveStream(streamIndex)
 }
 
 // monitorRemoteStreamForObjReceiving listens to a grpc receiving stream and handles .o files sent by a remote.
 // When a next .o is ready on remote, it sends it to a stream.
-// One stream is used to receive multiple .o files consecutively.
+// One stream is used to receive multiple .o files (several streams work in parallel, see nReceiveStreams).
+// A server may interleave chunks of several .o files (see AllowInterleaving), so every chunk is tagged by sessionID:
+// the first message of a session is a header (exit code, file size), the next ones are chunks of that .o.
 // If compilation exits with non-zero code, the same stream is used to send error details.
 // See RemoteConnection.WaitForCompiledObj.
 func (rc *RemoteConnection) monitorRemoteStreamForObjReceiving(stream pb.CompilationService_RecvCompiledObjStreamClient) (bool, error) {
+	inProgress := make(map[uint32]*objReceiving)
+
 	for {
 		// when a daemon stops listening, all streams are automatically closed
 		select {
-		case <-rc.quitDaemonChan:
+		case <-rc.quitChan:
 			return false, nil
 		case <-rc.reconnectChan:
 			return false, nil
 		default:
 		}
 
-		firstChunk, err := stream.Recv()
+		chunk, err := stream.Recv()
 
 		if err != nil {
-			return false, err
+			// EOF is also unexpected; .o files being received can't be finished
+			for _, receiving := range inProgress {
+				receiving.finish(err)
+			}
+			return len(inProgress) > 0, err // "true" to recreate recv stream
+		}
+
+		if receiving := inProgress[chunk.SessionID]; receiving != nil {
+			if receiving.onNextChunk(chunk.ChunkBody) {
+				delete(inProgress, chunk.SessionID)
+				// skipped chunks (of an unknown or a refused .o) are not counted as received
+				if receiving.finish(nil) == nil && receiving.invocation != nil {
+					rc.transfer.onObjReceived(int64(receiving.fileSize))
+				}
+			}
+			continue
 		}
 
-		invocation := rc.findInvocation(firstChunk.SessionID)
+		invocation := rc.findInvocation(chunk.SessionID)
 		if invocation == nil {
-			logClient.Error("can't find invocation for obj", "sessionID", firstChunk.SessionID)
+			logClient.Error("can't find invocation for obj", "sessionID", chunk.SessionID)
+			if chunk.FileSize > 0 { // chunks of this .o will still come, skip them
+				inProgress[chunk.SessionID] = &objReceiving{fileSize: int(chunk.FileSize)}
+			}
 			continue
 		}
 
-		if firstChunk.Interrupted {
-			invocation.DoneRecvObj(nil, false)
+		if chunk.Interrupted {
+			// a server interrupts a session not only by request (e.g. it expired there), then it's compiled locally
+			var err error
+			select {
+			case <-invocation.interruptChan:
+			default:
+				err = fmt.Errorf("sessionID %d was interrupted on a server", chunk.SessionID)
+			}
+			invocation.DoneRecvObj(err, false)
 			continue
 		}
 
-		invocation.compilerExitCode = int(firstChunk.CompilerExitCode)
-		invocation.compilerStdout = firstChunk.CompilerStdout
-		invocation.compilerStderr = firstChunk.CompilerStderr
-		invocation.compilerDuration = firstChunk.CompilerDuration
-		invocation.summary.nBytesReceived += int(firstChunk.FileSize)
+		invocation.compilerExitCode = int(chunk.CompilerExitCode)
+		invocation.compilerSignal = int(chunk.CompilerSignal)
+		invocation.compilerStdout = chunk.CompilerStdout
+		invocation.compilerStderr = chunk.CompilerStderr
+		invocation.compilerDuration = chunk.CompilerDuration
+		invocation.compilerQueued = chunk.CompilerQueued
+		invocation.compilerQueueDepth = chunk.CompilerQueueDepth
+		invocation.summary.objHeaderTime = time.Now()
+		invocation.fromObjCache = chunk.FromObjCache
+		invocation.onDemandFiles = chunk.OnDemandFiles
+		invocation.summary.nBytesReceived += int(chunk.FileSize)
 
 		// non-zero exitCode means either a bug in the source code or a compiler error
-		if firstChunk.CompilerExitCode != 0 {
+		if chunk.CompilerExitCode != 0 {
+			if chunk.WrongObjTarget {
+				invocation.badObj = "a .o was compiled for another machine"
+				invocation.summary.remoteFailReason = "wrong_obj_target"
+			}
 			invocation.DoneRecvObj(nil, false)
 			continue
 		}
 
-		needRecreateStream, err := receiveObjFileByChunks(stream, invocation, int(firstChunk.FileSize))
-		invocation.DoneRecvObj(err, false)
+		if reason, err := rc.checkObjCanBeReceived(invocation, chunk); err != nil {
+			logClient.Error("refusing a .o", "sessionID", chunk.SessionID, invocation.cppInFile, err)
+			invocation.summary.remoteFailReason = reason
+			invocation.DoneRecvObj(err, false)
+			inProgress[chunk.SessionID] = &objReceiving{fileSize: int(chunk.FileSize)} // its chunks are skipped, not written
+			continue
+		}
 
-		if err != nil {
-			return needRecreateStream, err
+		receiving := startReceivingObjFile(invocation, chunk, rc.objWriters)
+		receiving.provenanceChecker = rc.provenanceChecker
+		if receiving.fileSize == 0 {
+			_ = receiving.finish(nil)
+			continue
 		}
+		inProgress[chunk.SessionID] = receiving
 
-		// continue waiting for next .o files pushed by the remote over the same stream
+		// continue waiting for next chunks (of this .o or others) pushed by the remote over the same stream
 	}
 }
 
-// receiveObjFileByChunks is an actual implementation of saving a server stream to a local client .o file.
-// See server.sendObjFileByChunks.
-func receiveObjFileByChunks(stream pb.CompilationService_RecvCompiledObjStreamClient, invocation *Invocation, fileSize int) (bool, error) {
-	var errWrite error
-	var errRecv error
-	var receivedBytes int
+// checkObjCanBeReceived is called before opening temp files for a .o, so that it doesn't fail with a short write mid-build.
+// A runaway compiler (like -g3 with pathological templates) could produce gigabytes, see MaxObjSize.
+// An error is returned with a category for stats.
+func (rc *RemoteConnection) checkObjCanBeReceived(invocation *Invocation, chunk *pb.RecvCompiledObjChunkReply) (string, error) {
+	if rc.maxObjSize > 0 && chunk.FileSize > rc.maxObjSize {
+		return "obj_too_large", fmt.Errorf("a .o compiled on %s is %d bytes, larger than MaxObjSize %d", rc.remoteHost, chunk.FileSize, rc.maxObjSize)
+	}
+	objDir := filepath.Dir(invocation.objOutFile)
+	if freeSpace, err := getFreeDiskSpace(objDir); err == nil && freeSpace < uint64(chunk.FileSize) {
+		return "no_disk_space", fmt.Errorf("no disk space for a .o of %d bytes compiled on %s: %d bytes free in %s", chunk.FileSize, rc.remoteHost, freeSpace, objDir)
+	}
+	return "", nil
+}
 
-	fileTmp, errWrite := invocation.OpenTempFile(invocation.objOutFile)
+// objReceiving is an actual implementation of saving server stream chunks to a local client .o file.
+// If a client requested a BMI (-fmodule-output) or side outputs (-fstack-usage, etc.), they are sent right after .o,
+// chunks are split by their sizes. See server.objFileSender.
+type objReceiving struct {
+	invocation    *Invocation // nil if it's not found, then chunks are just skipped
+	objWriters    *ObjWriters
+	outputs       []*receivedOutput // .o, then a BMI and side outputs, in the order they are sent
+	errWrite      error
+	fileSize      int // all outputs
+	receivedBytes int
 
-	var nextChunk *pb.RecvCompiledObjChunkReply
-	for receivedBytes < fileSize {
-		nextChunk, errRecv = stream.Recv()
-		if errRecv != nil { // EOF is also unexpected
-			break
+	provenance        []byte // as sent by a server, empty if it doesn't record it
+	provenanceChecker *ObjProvenanceChecker
+}
+
+type receivedOutput struct {
+	fileName string
+	fileSize int
+	fileTmp  *os.File
+}
+
+func startReceivingObjFile(invocation *Invocation, chunk *pb.RecvCompiledObjChunkReply, objWriters *ObjWriters) *objReceiving {
+	receiving := &objReceiving{invocation: invocation, objWriters: objWriters, fileSize: int(chunk.FileSize), provenance: chunk.Provenance}
+	objSize := chunk.FileSize - chunk.ModuleOutputSize
+	for _, sideOutput := range chunk.SideOutputs {
+		objSize -= sideOutput.FileSize
+	}
+
+	receiving.addOutput(invocation.objOutFile, objSize)
+	if invocation.bmiOutFile != "" {
+		if chunk.ModuleOutputSize == 0 { // an older server ignores ModuleOutput, or a compiler hasn't produced it
+			receiving.errWrite = fmt.Errorf("no BMI received for %s", invocation.bmiOutFile)
+		} else {
+			receiving.addOutput(invocation.bmiOutFile, chunk.ModuleOutputSize)
 		}
-		if errWrite == nil {
-			_, errWrite = fileTmp.Write(nextChunk.ChunkBody)
+	}
+	for _, sideOutput := range chunk.SideOutputs {
+		if sideOutput.Ext == "" || strings.ContainsAny(sideOutput.Ext, "/\\") {
+			receiving.errWrite = fmt.Errorf("unexpected side output %q for %s", sideOutput.Ext, invocation.objOutFile)
+		} else {
+			receiving.addOutput(common.ReplaceFileExt(invocation.objOutFile, sideOutput.Ext), sideOutput.FileSize)
 		}
-		if nextChunk.SessionID != invocation.sessionID {
-			errRecv = fmt.Errorf("inconsistent stream, chunks mismatch")
-			break
+	}
+	return receiving
+}
+
+func (receiving *objReceiving) addOutput(fileName string, fileSize int64) {
+	if receiving.errWrite != nil {
+		return
+	}
+	output := &receivedOutput{fileName: fileName, fileSize: int(fileSize)}
+	output.fileTmp, receiving.errWrite = receiving.invocation.OpenTempFile(fileName)
+	if output.fileTmp != nil {
+		receiving.outputs = append(receiving.outputs, output)
+	}
+}
+
+// onNextChunk returns true when a file is fully received
+func (receiving *objReceiving) onNextChunk(chunkBody []byte) bool {
+	if receiving.invocation != nil {
+		receiving.invocation.onObjWaitProgress()
+	}
+	if receiving.errWrite == nil && len(receiving.outputs) != 0 {
+		receiving.objWriters.acquire()
+		offset := receiving.receivedBytes // of a current output, counting from the first one
+		body := chunkBody
+		for _, output := range receiving.outputs {
+			if offset >= output.fileSize {
+				offset -= output.fileSize
+				continue
+			}
+			n := min(output.fileSize-offset, len(body))
+			if _, receiving.errWrite = output.fileTmp.Write(body[:n]); receiving.errWrite != nil || n == len(body) {
+				break
+			}
+			body = body[n:]
+			offset = 0
 		}
-		receivedBytes += len(nextChunk.ChunkBody)
+		receiving.objWriters.release()
 	}
+	receiving.receivedBytes += len(chunkBody)
+	if receiving.receivedBytes > receiving.fileSize && receiving.errWrite == nil {
+		receiving.errWrite = fmt.Errorf("received %d bytes instead of %d", receiving.receivedBytes, receiving.fileSize)
+	}
+	return receiving.receivedBytes >= receiving.fileSize
+}
 
-	if fileTmp != nil {
-		_ = fileTmp.Close()
-		if errWrite == nil {
-			errWrite = os.Rename(fileTmp.Name(), invocation.objOutFile)
+// finish saves received files (if errRecv is nil) and completes an invocation; .o is renamed the last
+func (receiving *objReceiving) finish(errRecv error) error {
+	if receiving.invocation == nil {
+		return errRecv
+	}
+
+	errWrite := receiving.errWrite
+	if errWrite == nil && errRecv == nil && len(receiving.outputs) != 0 {
+		errWrite = receiving.provenanceChecker.verify(receiving.provenance, receiving.outputs[0].fileTmp.Name())
+		if errWrite != nil && len(receiving.provenance) != 0 { // signed, but not by a trusted key, or signed another .o
+			receiving.invocation.badObj = errWrite.Error()
+			receiving.invocation.summary.remoteFailReason = "bad_provenance"
+		}
+	}
+	for i := len(receiving.outputs) - 1; i >= 0; i-- {
+		output := receiving.outputs[i]
+		_ = output.fileTmp.Close()
+		if errWrite == nil && errRecv == nil {
+			errWrite = os.Rename(output.fileTmp.Name(), output.fileName)
 		}
-		_ = os.Remove(fileTmp.Name())
+		_ = os.Remove(output.fileTmp.Name())
+	}
+	if errWrite == nil && errRecv == nil {
+		errWrite = receiving.provenanceChecker.write(receiving.invocation, receiving.provenance)
 	}
 
-	switch {
-	case errRecv != nil:
-		return true, errRecv // "true" to recreate recv stream
-	case errWrite != nil:
-		return false, errWrite // "false" means that the stream is ok, there was just a problem of saving a file
-	default:
-		return false, nil
+	err := errRecv
+	if err == nil {
+		err = errWrite
 	}
+	receiving.invocation.DoneRecvObj(err, false)
+	return err
 }
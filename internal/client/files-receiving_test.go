@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+
+	"nocc/pb"
+)
+
+// TestObjReceivingChunks checks that chunks of any size are split into .o and side outputs (sent as one file) correctly
+func TestObjReceivingChunks(t *testing.T) {
+	dir := t.TempDir()
+
+	receive := func(seed int64, objSize uint16, sideSizes []uint16, chunkSizes []uint16, extraBytes uint8) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		sideSizes = sideSizes[:min(len(sideSizes), 3)]
+		sizes := []int{int(objSize)}
+		header := &pb.RecvCompiledObjChunkReply{FileSize: int64(objSize)}
+		for i, size := range sideSizes {
+			sizes = append(sizes, int(size))
+			header.FileSize += int64(size)
+			header.SideOutputs = append(header.SideOutputs, &pb.SideOutputFile{Ext: fmt.Sprintf(".side%d", i), FileSize: int64(size)})
+		}
+		body := make([]byte, header.FileSize+int64(extraBytes%2)) // sometimes, a server sends more than declared
+		rnd.Read(body)
+
+		invocation := &Invocation{objOutFile: filepath.Join(dir, "1.o")}
+		receiving := startReceivingObjFile(invocation, header, nil)
+		defer func() {
+			for _, output := range receiving.outputs {
+				_ = output.fileTmp.Close()
+				_ = os.Remove(output.fileTmp.Name())
+			}
+		}()
+
+		done := false
+		for offset, i := 0, 0; offset < len(body); i++ {
+			chunkSize := 1 + rnd.Intn(64*1024)
+			if len(chunkSizes) != 0 {
+				chunkSize = int(chunkSizes[i%len(chunkSizes)]) + 1
+			}
+			chunk := body[offset:min(offset+chunkSize, len(body))]
+			offset += len(chunk)
+			if done = receiving.onNextChunk(chunk); done != (offset >= int(header.FileSize)) {
+				return false
+			}
+		}
+		if header.FileSize == 0 {
+			return true // a server sends no chunks at all
+		}
+		if len(body) != int(header.FileSize) {
+			return receiving.errWrite != nil
+		}
+
+		if receiving.errWrite != nil || !done || len(receiving.outputs) != len(sizes) {
+			t.Log(receiving.errWrite)
+			return false
+		}
+		offset := 0
+		for i, output := range receiving.outputs {
+			_, _ = output.fileTmp.Seek(0, io.SeekStart)
+			written, _ := io.ReadAll(output.fileTmp)
+			if !bytes.Equal(written, body[offset:offset+sizes[i]]) {
+				return false
+			}
+			offset += sizes[i]
+		}
+		return true
+	}
+	if err := quick.Check(receive, nil); err != nil {
+		t.Error(err)
+	}
+}
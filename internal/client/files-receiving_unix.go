@@ -0,0 +1,16 @@
+//go:build !windows
+
+package client
+
+import (
+	"syscall"
+)
+
+// getFreeDiskSpace returns bytes available to an unprivileged user on a filesystem containing dir
+func getFreeDiskSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package client
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// getFreeDiskSpace returns bytes available to a current user on a disk containing dir
+func getFreeDiskSpace(dir string) (uint64, error) {
+	dirPtr, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytesAvailable uint64
+	if err := windows.GetDiskFreeSpaceEx(dirPtr, &freeBytesAvailable, nil, nil); err != nil {
+		return 0, err
+	}
+	return freeBytesAvailable, nil
+}
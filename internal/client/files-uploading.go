@@ -1,10 +1,13 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"time"
 
+	"nocc/internal/common"
 	"nocc/pb"
 
 	"google.golang.org/grpc/codes"
@@ -16,6 +19,24 @@ type fileUploadReq struct {
 	invocation *Invocation
 	file       *pb.FileMetadata
 	fileIndex  uint32
+	deltaBase  *pb.UploadDeltaBase // if set, a file is sent as a delta, see uploadFileDelta
+	nRetries   int                 // how many times it was re-queued after a network error, see runUploadStream
+}
+
+// maxUploadRetries limits re-uploading a file after network errors; the delay between them grows from 100ms
+const maxUploadRetries = 3
+
+// uploadFileError is a client file I/O error: it's not retried, unlike network errors
+type uploadFileError struct {
+	err error
+}
+
+func (e *uploadFileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *uploadFileError) Unwrap() error {
+	return e.err
 }
 
 func (rc *RemoteConnection) CreateUploadStream() {
@@ -34,11 +55,11 @@ func (rc *RemoteConnection) runUploadStream() {
 		return
 	}
 
-	invocation, err := rc.monitorClientChanForFileUploading(stream)
+	failedReqs, err := rc.monitorClientChanForFileUploading(stream)
 	if err != nil {
 		// when a daemon stops listening, all streams are automatically closed
 		select {
-		case <-rc.quitDaemonChan:
+		case <-rc.quitChan:
 			return
 		case <-rc.reconnectChan:
 			return
@@ -63,75 +84,252 @@ func (rc *RemoteConnection) runUploadStream() {
 
 		go rc.CreateUploadStream()
 
-		// theoretically, we could implement retries: if something does wrong with the network,
-		// then retry uploading (by pushing req to fu.chanToUpload)
-		// to do this correctly, we need to distinguish network errors vs file errors (and don't retry then)
-		// for now, there are no retries: if something fails, this invocation will be executed locally
-		invocation.DoneUploadFile(err)
+		// if something went wrong with the network, a file is uploaded again (over a new stream) a bit later;
+		// file errors and errors of saving a file on a server are not retried: an invocation will be executed locally
+		for _, req := range failedReqs {
+			if isRetriableUploadError(err) && req.nRetries < maxUploadRetries && req.invocation.waitUploads.Load() != 0 {
+				req.nRetries++
+				go rc.retryUploading(req, 100*time.Millisecond<<(req.nRetries-1))
+				continue
+			}
+			req.invocation.DoneUploadFile(err)
+		}
+	}
+}
+
+// retryUploading re-queues a file failed to upload because of a network error, see maxUploadRetries
+func (rc *RemoteConnection) retryUploading(req fileUploadReq, delay time.Duration) {
+	logClient.Info(0, "retry uploading", req.file.FileName, "attempt", req.nRetries, "after", delay, "sessionID", req.invocation.sessionID)
+	time.Sleep(delay)
+	rc.requeueUpload(req)
+}
+
+func (rc *RemoteConnection) requeueUpload(req fileUploadReq) {
+	select {
+	case <-rc.quitChan:
+		req.invocation.DoneUploadFile(errors.New("remote was removed while retrying an upload"))
+	case rc.chanToUpload <- req:
+	}
+}
+
+// isRetriableUploadError tells network errors (a stream broken, a stall, a server restarting) from others
+func isRetriableUploadError(err error) bool {
+	var fileErr *uploadFileError
+	if errors.As(err, &fileErr) {
+		return false
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.Unavailable, codes.Canceled, codes.DeadlineExceeded, codes.Aborted:
+			return true
+		}
 	}
+	return false
 }
 
 // monitorClientChanForFileUploading listens to chanToUpload and uploads it via stream.
 // One grpc stream is used to upload multiple files consecutively.
-func (rc *RemoteConnection) monitorClientChanForFileUploading(stream pb.CompilationService_UploadFileStreamClient) (*Invocation, error) {
+// Small files waiting in chanToUpload at the same moment are sent in one message, see uploadFilesInBatch.
+// On error, it returns requests that failed (all files of a batch).
+func (rc *RemoteConnection) monitorClientChanForFileUploading(stream pb.CompilationService_UploadFileStreamClient) ([]fileUploadReq, error) {
 	chunkBuf := make([]byte, 64*1024) // reusable chunk for file reading, exists until stream close
+	var next *fileUploadReq           // taken from chanToUpload while collecting a batch, but not fitting it
+	defer func() {
+		if next != nil {
+			go rc.requeueUpload(*next)
+		}
+	}()
 
 	for {
-		select {
-		case <-rc.quitDaemonChan:
-			return nil, nil
-		case <-rc.reconnectChan:
-			return nil, nil
+		var req fileUploadReq
+		if next != nil {
+			req, next = *next, nil
+		} else {
+			select {
+			case <-rc.quitChan:
+				return nil, nil
+			case <-rc.reconnectChan:
+				return nil, nil
+			case req = <-rc.chanToUpload:
+			}
+		}
 
-		case req := <-rc.chanToUpload:
-			logClient.Info(2, "start uploading", req.file.FileSize, req.file.FileName)
-			if req.file.FileSize > 64*1024 {
-				logClient.Info(1, "upload large file", req.file.FileSize, req.file.FileName)
+		if req.file.FileSize <= uploadBatchMaxFileSize && req.deltaBase == nil && rc.acceptsUploadBatches.Load() {
+			var batch []fileUploadReq
+			batch, next = rc.collectUploadBatch(req)
+			if len(batch) > 1 {
+				if failedReqs, err := rc.uploadFilesInBatch(stream, batch); err != nil {
+					return failedReqs, err
+				}
+				continue
 			}
+		}
+
+		logClient.Info(2, "start uploading", req.file.FileSize, req.file.FileName)
+		if req.file.FileSize > 64*1024 {
+			logClient.Info(1, "upload large file", req.file.FileSize, req.file.FileName)
+		}
+
+		// if a stream stalls (a server waits for a lost chunk, a network hangs), no other file would be uploaded,
+		// so it's canceled and recreated after the same timeout as a server considers an upload hanged
+		invocation := req.invocation
+		stallTimer := time.AfterFunc(uploadStallTimeout(req.file.FileSize), rc.uploadStreamContext.cancelFunc)
+		var sentBytes int64
+		var err error
+		if req.deltaBase != nil {
+			sentBytes, err = uploadFileDelta(stream, req)
+		}
+		if sentBytes == 0 && err == nil { // no delta base, or a delta wasn't sent
+			err = uploadFileByChunks(stream, chunkBuf, invocation.uploadedFileName(req.file.FileName), req.file.FileSize, req.clientID, invocation.sessionID, req.fileIndex)
+			sentBytes = req.file.FileSize
+		}
+		stallTimer.Stop()
+
+		// such complexity of error handling prevents hanging sessions and proper stream recreation
+		if err != nil {
+			return []fileUploadReq{req}, err
+		}
+
+		rc.onFileUploaded(req, sentBytes)
+		// continue listening, reuse the same stream to upload new files
+	}
+}
+
+// onFileUploaded is called after a server confirmed a file; sentBytes is less than a file size for a delta
+func (rc *RemoteConnection) onFileUploaded(req fileUploadReq, sentBytes int64) {
+	req.invocation.summary.nFilesSent++
+	req.invocation.summary.nBytesSent += int(sentBytes)
+	rc.transfer.onFileUploaded(sentBytes)
+	req.invocation.DoneUploadFile(nil)
+}
 
-			invocation := req.invocation
-			err := uploadFileByChunks(stream, chunkBuf, req.file.FileName, req.clientID, invocation.sessionID, req.fileIndex)
+// limits of a batch of small files, see uploadFilesInBatch
+const (
+	uploadBatchMaxFileSize = 64 * 1024
+	uploadBatchMaxBytes    = 1024 * 1024
+	uploadBatchMaxFiles    = 256
+)
 
-			// such complexity of error handling prevents hanging sessions and proper stream recreation
-			if err != nil {
-				return invocation, err
+// collectUploadBatch takes small files already waiting in chanToUpload (doesn't wait for new ones);
+// next is a file taken, but not fitting a batch, it's uploaded after a batch
+func (rc *RemoteConnection) collectUploadBatch(first fileUploadReq) (batch []fileUploadReq, next *fileUploadReq) {
+	batch = []fileUploadReq{first}
+	batchBytes := first.file.FileSize
+	for len(batch) < uploadBatchMaxFiles {
+		select {
+		case req := <-rc.chanToUpload:
+			if req.file.FileSize > uploadBatchMaxFileSize || req.deltaBase != nil || batchBytes+req.file.FileSize > uploadBatchMaxBytes {
+				return batch, &req
 			}
+			batch = append(batch, req)
+			batchBytes += req.file.FileSize
+		default:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
 
-			invocation.summary.nFilesSent++
-			invocation.summary.nBytesSent += int(req.file.FileSize)
-			invocation.DoneUploadFile(nil)
-			// continue listening, reuse the same stream to upload new files
+// uploadFilesInBatch sends small files (of any sessions) in one message, and a server confirms them at once.
+// A compilation often requires hundreds of tiny headers, and uploading them one by one takes a round trip per file.
+// A file that can't be read fails alone, other errors fail a whole batch (returned).
+// See server.NoccServer.receiveUploadedBatch.
+func (rc *RemoteConnection) uploadFilesInBatch(stream pb.CompilationService_UploadFileStreamClient, batch []fileUploadReq) ([]fileUploadReq, error) {
+	sentReqs := make([]fileUploadReq, 0, len(batch))
+	files := make([]*pb.UploadBatchFile, 0, len(batch))
+	batchBytes := int64(0)
+	for _, req := range batch {
+		body, err := os.ReadFile(req.invocation.uploadedFileName(req.file.FileName))
+		if err == nil && int64(len(body)) != req.file.FileSize {
+			err = fmt.Errorf("file %s changed while uploading", req.file.FileName)
+		}
+		if err != nil {
+			req.invocation.DoneUploadFile(err)
+			continue
 		}
+		sentReqs = append(sentReqs, req)
+		files = append(files, &pb.UploadBatchFile{SessionID: req.invocation.sessionID, FileIndex: req.fileIndex, Body: body})
+		batchBytes += req.file.FileSize
 	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	logClient.Info(2, "start uploading a batch of", len(files), "files,", batchBytes, "bytes")
+
+	common.InjectDelay(common.FaultUploadStreamDelay)
+	stallTimer := time.AfterFunc(uploadStallTimeout(batchBytes), rc.uploadStreamContext.cancelFunc)
+	err := stream.Send(&pb.UploadFileChunkRequest{
+		ClientID: sentReqs[0].clientID,
+		Batch:    files,
+	})
+	if err == nil || err == io.EOF { // on EOF, an actual error is returned by Recv
+		_, err = stream.Recv()
+	}
+	stallTimer.Stop()
+	if err != nil {
+		return sentReqs, err
+	}
+
+	for _, req := range sentReqs {
+		rc.onFileUploaded(req, req.file.FileSize)
+	}
+	return nil, nil
+}
+
+// uploadStallTimeout is like server.Client.IsFileUploadHanged: large files (.nocc-pch, toolchains) may upload for a long time
+func uploadStallTimeout(fileSize int64) time.Duration {
+	if fileSize > 5*1024*1024 {
+		return 90 * time.Second
+	}
+	return 30 * time.Second
 }
 
 // uploadFileByChunks is an actual implementation of piping a local client file to a server stream.
+// Exactly fileSize bytes are sent (a server expects that much, as sent in FileMetadata), a file changed since then fails.
 // See server.receiveUploadedFileByChunks.
-func uploadFileByChunks(stream pb.CompilationService_UploadFileStreamClient, chunkBuf []byte, clientFileName string, clientID string, sessionID uint32, fileIndex uint32) error {
+func uploadFileByChunks(stream pb.CompilationService_UploadFileStreamClient, chunkBuf []byte, clientFileName string, fileSize int64, clientID string, sessionID uint32, fileIndex uint32) error {
 	fd, err := os.Open(clientFileName)
 	if err != nil {
-		return err
+		return &uploadFileError{err}
 	}
 	defer fd.Close()
+	if stat, err := fd.Stat(); err != nil || stat.Size() != fileSize {
+		return &uploadFileError{fmt.Errorf("file %s changed while uploading", clientFileName)}
+	}
 
 	var n int
 	var sentChunks = 0 // used to correctly handle empty files (when Read returns EOF immediately)
+	var sentBytes = int64(0)
+	reader := io.LimitReader(fd, fileSize)
 	for {
-		n, err = fd.Read(chunkBuf)
+		n, err = reader.Read(chunkBuf)
 		if err != nil && err != io.EOF {
-			return err
+			return &uploadFileError{err}
+		}
+		if err == io.EOF && sentBytes != fileSize { // truncated while reading; a stream is recreated, a server drops a partial file
+			return &uploadFileError{fmt.Errorf("file %s changed while uploading", clientFileName)}
 		}
 		if err == io.EOF && sentChunks != 0 {
 			break
 		}
 		sentChunks++
+		sentBytes += int64(n)
 
+		common.InjectDelay(common.FaultUploadStreamDelay)
+		if common.InjectFault(common.FaultUploadChunkDrop) != nil {
+			continue
+		}
 		err = stream.Send(&pb.UploadFileChunkRequest{
 			ClientID:  clientID,
 			SessionID: sessionID,
 			FileIndex: fileIndex,
 			ChunkBody: chunkBuf[:n],
 		})
+		if err == io.EOF { // a stream is broken, an actual error is returned by Recv
+			if _, recvErr := stream.Recv(); recvErr != nil {
+				err = recvErr
+			}
+		}
 		if err != nil {
 			return err
 		}
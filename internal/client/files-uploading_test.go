@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+
+	"nocc/pb"
+
+	"google.golang.org/grpc"
+)
+
+// testUploadStream collects what uploadFileByChunks sends; a server confirms a file by an empty reply
+type testUploadStream struct {
+	grpc.ClientStream
+	chunks []*pb.UploadFileChunkRequest
+}
+
+func (stream *testUploadStream) Send(chunk *pb.UploadFileChunkRequest) error {
+	chunk.ChunkBody = bytes.Clone(chunk.ChunkBody) // a chunk buffer is reused
+	stream.chunks = append(stream.chunks, chunk)
+	return nil
+}
+
+func (stream *testUploadStream) Recv() (*pb.UploadFileReply, error) {
+	return &pb.UploadFileReply{}, nil
+}
+
+func TestUploadFileByChunks(t *testing.T) {
+	dir := t.TempDir()
+
+	upload := func(seed int64, fileSize uint32, chunkSize uint16) bool {
+		body := make([]byte, fileSize%(256*1024))
+		rand.New(rand.NewSource(seed)).Read(body)
+		fileName := filepath.Join(dir, fmt.Sprintf("%d.h", seed))
+		if err := os.WriteFile(fileName, body, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		stream := &testUploadStream{}
+		chunkBuf := make([]byte, int(chunkSize)%(64*1024)+512)
+		if err := uploadFileByChunks(stream, chunkBuf, fileName, int64(len(body)), "client", 1, 2); err != nil {
+			t.Log(err)
+			return false
+		}
+
+		// like server.receiveUploadedFileByChunks: the first chunk is always sent, even for an empty file
+		received := make([]byte, 0, len(body))
+		for _, chunk := range stream.chunks {
+			if chunk.SessionID != 1 || chunk.FileIndex != 2 || len(chunk.ChunkBody) > len(chunkBuf) {
+				return false
+			}
+			received = append(received, chunk.ChunkBody...)
+		}
+		return len(stream.chunks) > 0 && bytes.Equal(received, body)
+	}
+	if err := quick.Check(upload, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUploadFileByChunksChanged(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "1.h")
+	if err := os.WriteFile(fileName, []byte("#pragma once\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, declaredSize := range []int64{0, 12, 14} {
+		stream := &testUploadStream{}
+		err := uploadFileByChunks(stream, make([]byte, 4), fileName, declaredSize, "client", 1, 2)
+		var fileErr *uploadFileError
+		if !errors.As(err, &fileErr) || len(stream.chunks) != 0 {
+			t.Errorf("declared %d bytes: sent %d chunks, err %v", declaredSize, len(stream.chunks), err)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/proxy"
 	"google.golang.org/grpc"
@@ -15,21 +17,26 @@ type GRPCClient struct {
 	connection     *grpc.ClientConn
 	callContext    context.Context
 	cancelFunc     context.CancelFunc
+
+	connectedAddr atomic.Pointer[string] // an address a last connection was established to, see dialRemote
 }
 
+// remoteDialFallbackDelay is how long a dial waits for a preferred address family (usually IPv6)
+// before racing another one, if a host resolves to both, see net.Dialer.FallbackDelay
+const remoteDialFallbackDelay = 300 * time.Millisecond
+
 func MakeGRPCClient(remoteHostPort string, socksProxyAddr string) (*GRPCClient, error) {
 	// this connection is non-blocking: it's created immediately
 	// if the remote is not available, it will fail on request
+	grpcClient := &GRPCClient{
+		remoteHostPort: remoteHostPort,
+	}
 
-	dialOpts := createDialOpts(socksProxyAddr)
-
-	var remoteAddress string
+	dialOpts := createDialOpts(socksProxyAddr, grpcClient.dialRemote)
 
-	if socksProxyAddr != "" {
-		remoteAddress = fmt.Sprintf("passthrough:%s", remoteHostPort)
-	} else {
-		remoteAddress = fmt.Sprintf("dns:///%s", remoteHostPort)
-	}
+	// without a proxy, a host is resolved on every dial by dialRemote, not by a grpc resolver,
+	// so that addresses of both families are tried in parallel
+	remoteAddress := fmt.Sprintf("passthrough:///%s", remoteHostPort)
 
 	connection, err := grpc.NewClient(
 		remoteAddress,
@@ -40,16 +47,12 @@ func MakeGRPCClient(remoteHostPort string, socksProxyAddr string) (*GRPCClient,
 		return nil, err
 	}
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	return &GRPCClient{
-		remoteHostPort: remoteHostPort,
-		connection:     connection,
-		callContext:    ctx,
-		cancelFunc:     cancelFunc,
-	}, nil
+	grpcClient.connection = connection
+	grpcClient.callContext, grpcClient.cancelFunc = context.WithCancel(context.Background())
+	return grpcClient, nil
 }
 
-func createDialOpts(socksProxyAddr string) []grpc.DialOption {
+func createDialOpts(socksProxyAddr string, dialRemote func(context.Context, string) (net.Conn, error)) []grpc.DialOption {
 	dialOpts := []grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithDefaultCallOptions(),
@@ -60,10 +63,46 @@ func createDialOpts(socksProxyAddr string) []grpc.DialOption {
 		if err == nil {
 			dialOpts = append(dialOpts, dialOpt)
 		}
+	} else {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(dialRemote))
 	}
 	return dialOpts
 }
 
+// dialRemote connects to "host:port" or "[ipv6]:port". If a host resolves to IPv6 and IPv4 addresses,
+// they are raced like RFC 6555 "happy eyeballs" does: a broken IPv6 route doesn't make a remote unavailable.
+func (grpcClient *GRPCClient) dialRemote(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{FallbackDelay: remoteDialFallbackDelay}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	connectedAddr := conn.RemoteAddr().String()
+	grpcClient.connectedAddr.Store(&connectedAddr)
+	return conn, nil
+}
+
+// ConnectedAddr returns an ip:port a connection was established to, empty if not yet (or via a socks proxy)
+func (grpcClient *GRPCClient) ConnectedAddr() string {
+	if grpcClient == nil {
+		return ""
+	}
+	if connectedAddr := grpcClient.connectedAddr.Load(); connectedAddr != nil {
+		return *connectedAddr
+	}
+	return ""
+}
+
+// addrFamily returns "ipv6" or "ipv4" for "ip:port"
+func addrFamily(ipPort string) string {
+	host, _, _ := net.SplitHostPort(ipPort)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
 func runInSocks5(proxyAddr string) (grpc.DialOption, error) {
 	dialer, err := proxy.SOCKS5("unix", proxyAddr, nil, proxy.Direct)
 	if err != nil {
@@ -60,6 +60,7 @@ func CollectDependentIncludes(invocation *Invocation) (*DependentIncludesRespons
 		cmdLine:  compilerCmdLine,
 		uid:      invocation.uid,
 		gid:      invocation.gid,
+		env:      invocation.remoteCompilerEnv(), // not to write a depfile by DEPENDENCIES_OUTPUT while collecting includes
 	}
 
 	response := compilerLaunchRequest.RunCompilerLocally()
@@ -178,7 +179,7 @@ func createIncludedFileWithBuffer(fileName string) (*IncludedFile, error) {
 
 func extractIncludesFromCompilerMStdout(cwd string, compilerMStdout []byte, cppInFile string) map[string]struct{} {
 	scanner := bufio.NewScanner(bytes.NewReader(compilerMStdout))
-	scanner.Split(bufio.ScanWords)
+	scanner.Split(scanMakefileWords)
 	hFilesNames := map[string]struct{}{}
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -191,3 +192,34 @@ func extractIncludesFromCompilerMStdout(cwd string, compilerMStdout []byte, cppI
 	}
 	return hFilesNames
 }
+
+// scanMakefileWords is bufio.ScanWords for `-M` output: a compiler quotes a space in a file name as "\ " (and '#' as "\#", '$' as "$$"),
+// such words are unquoted, like make reads them
+func scanMakefileWords(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := 0
+	for start < len(data) && (data[start] == ' ' || data[start] == '\t' || data[start] == '\n' || data[start] == '\r') {
+		start++
+	}
+
+	word := make([]byte, 0, 64)
+	for i := start; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			return i + 1, word, nil
+		case c == '\\' && i+1 < len(data) && (data[i+1] == ' ' || data[i+1] == '\t' || data[i+1] == '#'):
+			word = append(word, data[i+1])
+			i++
+		case c == '$' && i+1 < len(data) && data[i+1] == '$':
+			word = append(word, '$')
+			i++
+		case (c == '\\' || c == '$') && i+1 == len(data) && !atEOF:
+			return start, nil, nil // an escape may continue in the next chunk
+		default:
+			word = append(word, c)
+		}
+	}
+	if atEOF && len(data) > start {
+		return len(data), word, nil
+	}
+	return start, nil, nil
+}
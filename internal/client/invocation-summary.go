@@ -17,13 +17,22 @@ type invocationTimingItem struct {
 // It's mostly for developing/debugging purposes: multiple nocc invocations are appended to a single log file,
 // from which we can compute statistics, average and percentiles, either in total or partitioned by hosts.
 type InvocationSummary struct {
-	remoteHost string
+	remoteHost       string
+	remoteHostPort   string // as in Servers, see ServerQuarantine
+	remoteFailReason string // a category of a remote failure for stats, like "obj_too_large"; "remote_failed" if empty
 
 	nIncludes      int
 	nFilesSent     int
 	nBytesSent     int
 	nBytesReceived int
 
+	// durations of steps split for a slow-file report, unlike timings, they don't include waiting for other steps;
+	// a compiler queue wait and a compiler duration come from a server, see Invocation.compilerQueued
+	preprocessDuration time.Duration // collecting dependencies of a .cpp (or dirs for on-demand includes)
+	uploadDuration     time.Duration // sending files missing on a remote
+	receiveDuration    time.Duration // from a server sent a .o header until a .o is saved
+	objHeaderTime      time.Time     // when a .o header came, set by a receiving goroutine
+
 	timings []invocationTimingItem
 }
 
@@ -43,8 +52,10 @@ func (s *InvocationSummary) ToLogString(invocation *Invocation) string {
 	duration := time.Since(invocation.createTime).Milliseconds()
 
 	b := strings.Builder{}
-	fmt.Fprintf(&b, "cppInFile=%q, remote=%s, sessionID=%d, nIncludes=%d, nFilesSent=%d, nBytesSent=%d, nBytesReceived=%d, compilerDuration=%dms",
-		invocation.cppInFile, s.remoteHost, invocation.sessionID, s.nIncludes, s.nFilesSent, s.nBytesSent, s.nBytesReceived, invocation.compilerDuration)
+	fmt.Fprintf(&b, "cppInFile=%q, build=%q, remote=%s, sessionID=%d, nIncludes=%d, nFilesSent=%d, nBytesSent=%d, nBytesReceived=%d, compilerDuration=%dms",
+		invocation.cppInFile, invocation.buildGroup.buildID, s.remoteHost, invocation.sessionID, s.nIncludes, s.nFilesSent, s.nBytesSent, s.nBytesReceived, invocation.compilerDuration)
+	fmt.Fprintf(&b, ", preprocess=%dms, upload=%dms, queued=%dms, queueDepth=%d, receive=%dms",
+		s.preprocessDuration.Milliseconds(), s.uploadDuration.Milliseconds(), invocation.compilerQueued, invocation.compilerQueueDepth, s.receiveDuration.Milliseconds())
 
 	prevTime := invocation.createTime
 	fmt.Fprintf(&b, ", started=0ms")
@@ -4,14 +4,17 @@ import (
 	"fmt"
 	"math/rand"
 	"nocc/internal/common"
+	"nocc/pb"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 const (
@@ -20,6 +23,7 @@ const (
 	invokedForCompilingCpp
 	invokedForCompilingPch
 	invokedForLinking
+	invokedForCompilingMany // `g++ -c a.cpp b.cpp`, see Daemon.compileInputFilesSeparately
 )
 
 // Invocation describes one `nocc` invocation inside a daemon.
@@ -31,34 +35,74 @@ type Invocation struct {
 
 	uid        int
 	gid        int
+	userName   string    // sent to a server for logs, empty if unknown
 	createTime time.Time // used for local timeout
 	sessionID  uint32    // incremental while a daemon is alive
 
-	cwd string // working directory, where nocc was launched
+	cwd        string      // working directory, where nocc was launched
+	buildGroup *BuildGroup // a build this invocation belongs to (several builds can share a daemon)
+	project    *ProjectConfiguration // .nocc.toml above cwd, nil if none
+
+	compileRules *CompileRules    // Rules / ForceLocal / ForceRemote from a config, see determineLocalCompiling
+	baseDir      string           // = Daemon.baseDir
+	policy       InvocationPolicy // actions of Rules for a .cpp, set after parsing
 
 	// cmdLine is parsed to the following fields:
 	hascOption   bool              // -c
 	cppInFile    string            // input file as specified in cmd line (.cpp for compilation, .h for pch generation)
-	objOutFile   string            // output file as specified in cmd line (.o for compilation, .gch/.pch for pch generation)
+	cppInFileRel bool              // cppInFile was relative to cwd in cmd line (a server may record it in debug info the same way)
+	xLang        string            // -x {lang} before cppInFile, forwarded to a server as is
+	inFileArgs   []string          // all input files exactly as in cmd line (cppInFile is the first one)
+	objOutFile   string            // output file, resolved at cwd (.o for compilation, .gch/.pch for pch generation)
+	objOutArg    string            // output file exactly as specified after -o, used as a default depfile target
 	compilerName string            // g++ / clang / etc.
 	cmdLine      []string          // original cmdline
 	compilerArgs []string          // args like -Wall, -fpch-preprocess, -I{dir} and many more
 	fOptionFiles map[string]string // -frandomize-layout-seed-file={file} and others
 	depsFlags    DepCmdFlags       // -MD -MF file and others, used for .d files generation (not passed to server)
+	bmiInFiles   []string          // BMIs from -fmodule-file= and -fprebuilt-module-path=, uploaded as dependencies
+	bmiOutFile   string            // -fmodule-output: a BMI compiled along with .o (not passed to server, it's received)
+	sideOutputs  bool              // -fstack-usage, --coverage, etc.: files named after .o are received along with it
+
+	diagnosticsColor bool     // `nocc` prints to a terminal, and cmdLine doesn't specify colors, see DaemonSockRequest.StderrIsTerminal
+	compilerEnv      []string // "KEY=VALUE" from `nocc` env, see compilerEnvVars
+
+	localCompiler *localCompilerProbe // a version and a target of compilerName, sent to a server to compare with its own
+	toolchain     *Toolchain          // nil unless UploadToolchain, then it's uploaded along with dependencies
+
+	requiredFiles   []*pb.FileMetadata // sent to a remote in a session request, kept for ReproRecorder
+	requiredPchFile *pb.FileMetadata
+	replayRoot      string // if set, files are uploaded from a repro bundle extracted there, see uploadedFileName
+
+	onDemandDirs  []string // if set, includes are not collected, a remote reads them from there, see OnDemandIncludes
+	onDemandFiles []string // read by a remote compiler from onDemandDirs, for a depfile
 
 	waitUploads atomic.Int32 // files still waiting for upload to finish; 0 releases wgUpload; see Invocation.DoneUploadFile
 	doneRecv    atomic.Int32 // 1 if o file received or failed receiving; 1 releases wgRecv; see Invocation.DoneRecvObj
 	wgUpload    sync.WaitGroup
 	wgRecv      sync.WaitGroup
 
+	tmpFilesMu sync.Mutex
+	tmpFiles   []string // being received from a remote, see OpenTempFile; removed on ForceInterrupt
+
+	objWaitProgress atomic.Int64 // unix nanoseconds of the last progress waiting for .o, 0 before waiting, see WaitForCompiledObj
+
 	// when remote compilation starts, the server starts a server.Session (with the same sessionID)
 	// after it finishes, we have these fields filled (and objOutFile saved)
-	compilerExitCode int
-	compilerStdout   []byte
-	compilerStderr   []byte
-	compilerDuration int32
+	compilerExitCode   int
+	compilerSignal     int // a remote compiler was killed by it (e.g. 9 by OOM killer), compilerExitCode is -1 then
+	compilerStdout     []byte
+	compilerStderr     []byte
+	compilerDuration   int32
+	compilerQueued     int32 // ms a session waited for a compiler slot on a server, 0 from an old server
+	compilerQueueDepth int32 // the most sessions waiting there meanwhile, see pb.RecvCompiledObjChunkReply
+	fromObjCache       bool
+	predictedLong      bool // compiled LongFileTime or longer last time, see CompileTimes
+
+	badObj string // why a .o from a remote was rejected (a provenance mismatch, a wrong target), see ServerQuarantine
 
 	summary       *InvocationSummary
+	span          *common.Span // nil if tracing is off
 	interruptChan chan struct{}
 }
 
@@ -91,7 +135,18 @@ func isCXXSourceFileName(fileName string) bool {
 		strings.HasSuffix(fileName, ".c++") ||
 		strings.HasSuffix(fileName, ".C++") ||
 		strings.HasSuffix(fileName, ".CXX") ||
-		strings.HasSuffix(fileName, ".ii")
+		strings.HasSuffix(fileName, ".ii") ||
+		isCXXModuleFileName(fileName)
+}
+
+// isCXXModuleFileName detects module interface units (conventions of clang, msvc and build2)
+func isCXXModuleFileName(fileName string) bool {
+	return strings.HasSuffix(fileName, ".cppm") ||
+		strings.HasSuffix(fileName, ".ccm") ||
+		strings.HasSuffix(fileName, ".cxxm") ||
+		strings.HasSuffix(fileName, ".c++m") ||
+		strings.HasSuffix(fileName, ".ixx") ||
+		strings.HasSuffix(fileName, ".mpp")
 }
 
 func isObjCSourceFileName(fileName string) bool {
@@ -125,19 +180,21 @@ func (invocation *Invocation) ParseCmdLineInvocation(cmdLine []string) {
 				invocation.hascOption = true
 				continue
 			} else if parseFileResult := invocation.parseArgFile(cmdLine, "-o", &i); parseFileResult != nil {
+				invocation.objOutArg = parseFileResult.value
 				invocation.objOutFile = common.PathAbs(invocation.cwd, parseFileResult.value)
 				continue
 			} else if args := invocation.parseIncludeArgs(cmdLine, &i); args != nil {
 				invocation.compilerArgs = append(invocation.compilerArgs, args...)
 				continue
-			} else if arg == "-x" {
-				xArg := cmdLine[i+1]
-				if xArg == "c-header" || xArg == "c++-header" || xArg == "objective-c-header" || xArg == "objective-c++-header" {
-					invocation.invokeType = invokedForCompilingPch
-					invocation.compilerArgs = append(invocation.compilerArgs, arg, xArg)
-					i++
-					continue
+			} else if args := invocation.parseSysrootArgs(cmdLine, &i); args != nil {
+				invocation.compilerArgs = append(invocation.compilerArgs, args...)
+				continue
+			} else if parseFileResult := invocation.parseArgFile(cmdLine, "-x", &i); parseFileResult != nil {
+				invocation.parseLanguageArg(parseFileResult.value)
+				if invocation.err != nil {
+					return
 				}
+				continue
 			} else if arg == "-I-" || arg == "-E" {
 				invocation.err = fmt.Errorf("unsupported option: %s", arg)
 				return
@@ -161,6 +218,16 @@ func (invocation *Invocation) ParseCmdLineInvocation(cmdLine []string) {
 				continue
 			} else if invocation.parseFOption(arg) {
 				continue
+			} else if invocation.parseProfileArg(arg) {
+				if invocation.err != nil {
+					return
+				}
+				continue
+			} else if invocation.parseModuleArg(arg) {
+				if invocation.err != nil {
+					return
+				}
+				continue
 			} else if arg == "-M" || arg == "-MM" || arg == "-MG" {
 				// these dep flags are unsupported yet, cmake doesn't use them
 				invocation.err = fmt.Errorf("unsupported option: %s", arg)
@@ -168,6 +235,11 @@ func (invocation *Invocation) ParseCmdLineInvocation(cmdLine []string) {
 			} else if arg == "-march=native" {
 				invocation.err = fmt.Errorf("-march=native can't be launched remotely")
 				return
+			} else if isSideOutputArg(arg) {
+				invocation.sideOutputs = true
+			} else if isExtraOutputArg(arg) {
+				invocation.err = fmt.Errorf("%s produces extra output files, can't be launched remotely", arg)
+				return
 			} else if strings.HasPrefix(arg, "-Wp") {
 				wArgs := strings.Split(arg, ",")
 				for j := 1; j < len(wArgs); j++ {
@@ -177,19 +249,29 @@ func (invocation *Invocation) ParseCmdLineInvocation(cmdLine []string) {
 				}
 				continue
 			}
+		} else if strings.HasPrefix(arg, "@") && strings.HasSuffix(arg, ".modmap") {
+			// a module map generated by cmake for clang: args like -fmodule-file={name}={bmi}, they are parsed as if passed directly
+			modmapArgs, err := readModmapFile(common.PathAbs(invocation.cwd, arg[1:]))
+			if err != nil {
+				invocation.err = err
+				return
+			}
+			cmdLine = slices.Concat(cmdLine[:i+1], modmapArgs, cmdLine[i+1:])
+			continue
 		} else if invocation.parseResponseFile("@", arg) {
 			// only responsefiles without recursive imports
 			continue
-		} else if isSourceFileName(arg) || isHeaderFileName(arg) {
+		} else if isSourceFileName(arg) || isHeaderFileName(arg) || invocation.isInputFileOfExplicitLanguage(arg) {
+			invocation.inFileArgs = append(invocation.inFileArgs, arg)
 			if invocation.cppInFile != "" {
-				invocation.err = fmt.Errorf("unsupported command-line: multiple input source files")
-				return
+				continue
 			}
 
 			// Best effort for compiling configure tests locally
 			determineLocalCompiling(invocation, arg)
 
 			invocation.cppInFile = common.PathAbs(invocation.cwd, arg)
+			invocation.cppInFileRel = !filepath.IsAbs(arg)
 			continue
 		}
 
@@ -200,11 +282,29 @@ func (invocation *Invocation) ParseCmdLineInvocation(cmdLine []string) {
 		return
 	}
 
+	if len(invocation.inFileArgs) > 1 {
+		// with -o or -MF, all files would write the same output (or a compiler fails), it's left to a local compiler
+		if !invocation.hascOption || invocation.objOutArg != "" || invocation.depsFlags.flagMF != "" || hasDuplicates(invocation.inFileArgs) {
+			invocation.err = fmt.Errorf("unsupported command-line: multiple input source files")
+		} else {
+			invocation.invokeType = invokedForCompilingMany
+		}
+		return
+	}
+
 	if invocation.hascOption && invocation.cppInFile != "" {
+		if isDirectory(invocation.objOutFile) {
+			// `-o dir` (or `-o dir/`) is an error for the compiler, let it be reported by a local launch
+			invocation.err = fmt.Errorf("unsupported command-line: output %s is a directory", invocation.objOutArg)
+			return
+		}
 		if invocation.objOutFile == "" {
 			outputFilename := common.ReplaceFileExt(path.Base(invocation.cppInFile), ".o")
 			invocation.objOutFile = filepath.Join(invocation.cwd, outputFilename)
 		}
+		if invocation.bmiOutFile == bmiOutNextToObj {
+			invocation.bmiOutFile = common.ReplaceFileExt(invocation.objOutFile, ".pcm")
+		}
 		invocation.invokeType = invokedForCompilingCpp
 	} else if invocation.cppInFile != "" && invocation.objOutFile != "" {
 		invocation.invokeType = invokedForLinking
@@ -213,6 +313,44 @@ func (invocation *Invocation) ParseCmdLineInvocation(cmdLine []string) {
 	}
 }
 
+// xLanguages are values of -x compiled remotely: a language is forwarded to a server,
+// so an input file is compiled the same way whatever extension it has ("none" returns to detecting by extension)
+var xLanguages = []string{"c", "c++", "objective-c", "objective-c++", "assembler-with-cpp", "none"}
+
+// xHeaderLanguages are values of -x for pch generation
+var xHeaderLanguages = []string{"c-header", "c++-header", "objective-c-header", "objective-c++-header"}
+
+func (invocation *Invocation) parseLanguageArg(xLang string) {
+	if slices.Contains(xHeaderLanguages, xLang) {
+		invocation.invokeType = invokedForCompilingPch
+	} else if !slices.Contains(xLanguages, xLang) {
+		invocation.err = fmt.Errorf("unsupported option: -x %s", xLang)
+		return
+	}
+
+	// -x after an input file has no effect locally, but on a server an input file goes last, so it's not forwarded
+	if invocation.cppInFile == "" {
+		invocation.xLang = xLang
+		invocation.compilerArgs = append(invocation.compilerArgs, "-x", xLang)
+	}
+}
+
+// isInputFileOfExplicitLanguage detects input files with any extension (like `-x c++ file.inc`)
+func (invocation *Invocation) isInputFileOfExplicitLanguage(arg string) bool {
+	return invocation.xLang != "" && invocation.xLang != "none" && isRegularFile(common.PathAbs(invocation.cwd, arg))
+}
+
+// GetStdVersion returns "c++20" for -std=c++20 (the last one wins, like for a compiler), or "" if not specified
+func (invocation *Invocation) GetStdVersion() string {
+	std := ""
+	for _, arg := range invocation.compilerArgs {
+		if strings.HasPrefix(arg, "-std=") {
+			std = arg[5:]
+		}
+	}
+	return std
+}
+
 func (invocation *Invocation) parsePreprocessorArg(args []string, argIndex *int) bool {
 	if parseFileResult := invocation.parseArgFile(args, "-MD", argIndex); parseFileResult != nil {
 		invocation.depsFlags.SetCmdFlagMD()
@@ -227,6 +365,33 @@ func (invocation *Invocation) parsePreprocessorArg(args []string, argIndex *int)
 	return false
 }
 
+// applyDepFileEnv handles DEPENDENCIES_OUTPUT="{file} [{target}]" like `-MMD -MF {file} -MT {target}`, unless a cmd line has -MD and similar.
+// Like a compiler, a depfile is appended to then, not rewritten (a target defaults to a .cpp basename with .o).
+func (invocation *Invocation) applyDepFileEnv() {
+	for _, keyValue := range invocation.compilerEnv {
+		spec, found := strings.CutPrefix(keyValue, "DEPENDENCIES_OUTPUT=")
+		if !found || spec == "" || invocation.depsFlags.ShouldGenerateDepFile() {
+			continue
+		}
+		depFile, target, hasTarget := strings.Cut(spec, " ")
+		invocation.depsFlags.SetCmdFlagMMD()
+		invocation.depsFlags.SetCmdFlagMF(common.PathAbs(invocation.cwd, depFile))
+		if hasTarget {
+			invocation.depsFlags.SetCmdFlagMT(target)
+		} else {
+			invocation.depsFlags.SetCmdFlagMQ(common.ReplaceFileExt(filepath.Base(invocation.cppInFile), ".o"))
+		}
+		invocation.depsFlags.appendToMF = true
+	}
+}
+
+// remoteCompilerEnv is compilerEnv without depFileEnvVars, since a depfile is generated by a client
+func (invocation *Invocation) remoteCompilerEnv() []string {
+	return slices.DeleteFunc(slices.Clone(invocation.compilerEnv), func(keyValue string) bool {
+		return isCompilerEnvVar(keyValue, depFileEnvVars)
+	})
+}
+
 func (invocation *Invocation) parseResponseFile(key string, arg string) bool {
 	if !strings.HasPrefix(arg, key) {
 		return false
@@ -255,6 +420,123 @@ func (invocation *Invocation) parseFOption(arg string) bool {
 	return false
 }
 
+// parseProfileArg handles PGO and coverage flags.
+// Profiles passed to a compiler (.profdata, sample profiles) are uploaded as dependencies, like fOptionFiles.
+// LLVM instrumentation (-fprofile-instr-generate, etc.) is passed as is: profiles are written by a linked binary at runtime.
+// gcc .gcda profiles are named after an object file, which is another one on a server, that's why such files are compiled locally.
+// gcc coverage is not handled here: it's compiled remotely, .gcno files are received as side outputs, see isSideOutputArg.
+func (invocation *Invocation) parseProfileArg(arg string) bool {
+	profileUseKeys := []string{"-fprofile-use=", "-fprofile-instr-use=", "-fprofile-sample-use=", "-fauto-profile="}
+	objNamedProfileArgs := []string{"-fprofile-use", "-fprofile-instr-use"}
+	isClang := strings.Contains(filepath.Base(invocation.compilerName), "clang")
+
+	// for gcc, -fprofile-use={path} and -fprofile-generate={path} are prefixes of .gcda files, not profiles
+	isGccProfileArg := !isClang && (arg == "-fprofile-generate" || strings.HasPrefix(arg, "-fprofile-generate=") || strings.HasPrefix(arg, "-fprofile-use="))
+	if isGccProfileArg || slices.Contains(objNamedProfileArgs, arg) || strings.HasPrefix(arg, "-fprofile-dir=") {
+		invocation.err = fmt.Errorf("%s can't be launched remotely", arg)
+		return true
+	}
+
+	for _, key := range profileUseKeys {
+		if !strings.HasPrefix(arg, key) {
+			continue
+		}
+		profile := common.PathAbs(invocation.cwd, arg[len(key):])
+		invocation.compilerArgs = append(invocation.compilerArgs, key+profile)
+		if !isDirectory(profile) {
+			invocation.fOptionFiles[key] = profile
+		} else if profdata := filepath.Join(profile, "default.profdata"); isRegularFile(profdata) {
+			invocation.fOptionFiles[key] = profdata // clang looks for it in a dir
+		} else {
+			invocation.err = fmt.Errorf("%s without default.profdata can't be launched remotely", arg)
+		}
+		return true
+	}
+
+	return false
+}
+
+// bmiOutNextToObj is a bmiOutFile for -fmodule-output without a value, replaced with .o path after parsing
+const bmiOutNextToObj = "-"
+
+// parseModuleArg handles C++20 modules (clang, with explicitly built BMIs, as cmake does).
+// BMIs of imported modules are uploaded as dependencies, a BMI produced along with .o is received from a server.
+// gcc modules (-fmodules-ts, found via a module mapper) and clang implicit modules (-fmodules with a module cache)
+// are compiled locally, since a compiler looks up BMIs (or even builds them) on its own.
+func (invocation *Invocation) parseModuleArg(arg string) bool {
+	switch {
+	case strings.HasPrefix(arg, "-fmodule-file="):
+		// -fmodule-file={bmi} or -fmodule-file={name}={bmi}
+		value := arg[len("-fmodule-file="):]
+		name, bmi, hasName := strings.Cut(value, "=")
+		if !hasName {
+			name, bmi = "", value
+		}
+		bmi = common.PathAbs(invocation.cwd, bmi)
+		invocation.bmiInFiles = append(invocation.bmiInFiles, bmi)
+		if hasName {
+			invocation.compilerArgs = append(invocation.compilerArgs, "-fmodule-file="+name+"="+bmi)
+		} else {
+			invocation.compilerArgs = append(invocation.compilerArgs, "-fmodule-file="+bmi)
+		}
+		return true
+
+	case strings.HasPrefix(arg, "-fprebuilt-module-path="):
+		// a compiler looks up {dir}/{name}.pcm on import, we don't know which of them, so all are uploaded
+		dir := common.PathAbs(invocation.cwd, arg[len("-fprebuilt-module-path="):])
+		bmis, _ := filepath.Glob(filepath.Join(dir, "*.pcm"))
+		invocation.bmiInFiles = append(invocation.bmiInFiles, bmis...)
+		invocation.compilerArgs = append(invocation.compilerArgs, "-fprebuilt-module-path="+dir)
+		return true
+
+	case strings.HasPrefix(arg, "-fmodule-output="):
+		invocation.bmiOutFile = common.PathAbs(invocation.cwd, arg[len("-fmodule-output="):])
+		return true
+
+	case arg == "-fmodule-output":
+		invocation.bmiOutFile = bmiOutNextToObj
+		return true
+
+	case arg == "-fmodules" || arg == "-fmodules-ts" || strings.HasPrefix(arg, "-fmodule-mapper="):
+		invocation.err = fmt.Errorf("%s can't be launched remotely", arg)
+		return true
+	}
+
+	return false
+}
+
+// readModmapFile reads args from a response file like a compiler does: separated by whitespace, possibly quoted
+func readModmapFile(fileName string) ([]string, error) {
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, 8)
+	arg := strings.Builder{}
+	inQuotes, hasArg := false, false
+	for _, c := range string(contents) {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case !inQuotes && unicode.IsSpace(c):
+			if hasArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				hasArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			hasArg = true
+		}
+	}
+	if hasArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
 func (invocation *Invocation) parseIncludeArgs(args []string, argIndex *int) []string {
 	includefolderKeys := []string{"-I", "-iquote", "-isystem"}
 	includefileKeys := []string{"-include-pch", "-include"}
@@ -280,6 +562,21 @@ func (invocation *Invocation) parseIncludeArgs(args []string, argIndex *int) []s
 	return nil
 }
 
+// parseSysrootArgs makes a sysroot absolute, like include dirs: headers from it are uploaded as dependencies
+// (so a server doesn't need a toolchain at the same path), and a compiler on a server finds them at the same place
+func (invocation *Invocation) parseSysrootArgs(args []string, argIndex *int) []string {
+	sysrootKeys := []string{"--sysroot=", "--sysroot", "-isysroot"}
+
+	for _, key := range sysrootKeys {
+		if parseFileResult := invocation.parseArgFile(args, key, argIndex); parseFileResult != nil {
+			dir := common.PathAbs(invocation.cwd, parseFileResult.value)
+			return []string{strings.TrimSuffix(key, "="), dir}
+		}
+	}
+
+	return nil
+}
+
 type parseFileResult struct {
 	args  []string
 	value string
@@ -307,16 +604,56 @@ func (invocation *Invocation) parseArgFile(args []string, key string, argIndex *
 	return nil
 }
 
+// sideOutputArgs make a compiler write files next to .o, named after it (x.su, x.gcno, x.ii for x.o);
+// a server compiles such invocations to the same path and sends them back along with .o
+var sideOutputArgs = []string{
+	"-fstack-usage", "-fcallgraph-info", "-ftest-coverage", "-fprofile-arcs", "--coverage", "-save-temps=obj", "-ftime-trace",
+}
+
+func isSideOutputArg(arg string) bool {
+	return slices.Contains(sideOutputArgs, arg) || strings.HasPrefix(arg, "-fcallgraph-info=")
+}
+
+// extraOutputArgPrefixes make a compiler write files besides .o elsewhere (.i/.s to cwd, .dwo referred from .o, etc.);
+// they can't be returned from a server, so such invocations are compiled locally not to lose them
+var extraOutputArgPrefixes = []string{
+	"-save-temps", "-gsplit-dwarf", "-ftime-trace=", "-fdump-", "-aux-info",
+	"-fsave-optimization-record", "-foptimization-record-file=", "-MJ",
+}
+
+func isExtraOutputArg(arg string) bool {
+	if arg == "-gsplit-dwarf=single" { // clang: debug info is kept in .o, no .dwo is produced
+		return false
+	}
+	return slices.ContainsFunc(extraOutputArgPrefixes, func(prefix string) bool { return strings.HasPrefix(arg, prefix) })
+}
+
+func isDirectory(fileName string) bool {
+	if fileName == "" {
+		return false
+	}
+	stat, err := os.Stat(fileName)
+	return err == nil && stat.IsDir()
+}
+
+func hasDuplicates(values []string) bool {
+	for i, value := range values {
+		if slices.Contains(values[:i], value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegularFile(fileName string) bool {
+	stat, err := os.Stat(fileName)
+	return err == nil && stat.Mode().IsRegular()
+}
+
 func determineLocalCompiling(invocation *Invocation, arg string) {
 	shouldCompileLocally :=
-		strings.Contains(invocation.cwd, "TryCompile-") || // cmake
-			strings.Contains(invocation.cwd, "meson-private") || // meson
-			strings.Contains(invocation.cwd, ".conf_check") || // waf
-			strings.Contains(arg, "ffconf.") || // ffmpeg
-			strings.Contains(arg, "cgo-gcc-input") || // go
-			strings.HasPrefix(filepath.Base(arg), "conftest") || // autoconf
-			strings.HasPrefix(arg, "tmp.conftest.") || // autoconf
-			isAssemblySourceFileName(arg)
+		invocation.compileRules.ShouldCompileLocally(invocation, arg) ||
+			(isAssemblySourceFileName(arg) && (invocation.xLang == "" || invocation.xLang == "none")) // but `-x assembler-with-cpp`
 
 	if shouldCompileLocally {
 		invocation.invokeType = invokedForLocalCompiling
@@ -327,11 +664,13 @@ func CreateInvocation(req DaemonSockRequest) *Invocation {
 	invocation := &Invocation{
 		uid:           req.Uid,
 		gid:           req.Gid,
+		userName:      req.UserName,
 		createTime:    time.Now(),
 		sessionID:     req.SessionId,
 		cwd:           req.Cwd,
 		compilerName:  req.Compiler,
 		compilerArgs:  make([]string, 0, len(req.CmdLine)),
+		compilerEnv:   req.Env,
 		fOptionFiles:  make(map[string]string, 1),
 		summary:       MakeInvocationSummary(),
 		interruptChan: req.InterruptChan,
@@ -353,11 +692,25 @@ func (invocation *Invocation) DoneRecvObj(err error, forceInterrupt bool) {
 	}
 }
 
+// onObjWaitProgress postpones ObjWaitTimeout: a chunk of .o arrived, or a server reports that it's still compiling
+func (invocation *Invocation) onObjWaitProgress() {
+	invocation.objWaitProgress.Store(time.Now().UnixNano())
+}
+
 func (invocation *Invocation) DoneUploadFile(err error) {
+	// after ForceInterrupt released all uploads, a stuck upload could still fail (its stream is canceled), skip it
+	for {
+		n := invocation.waitUploads.Load()
+		if n == 0 {
+			return
+		}
+		if invocation.waitUploads.CompareAndSwap(n, n-1) {
+			break
+		}
+	}
 	if err != nil {
 		invocation.err = err
 	}
-	invocation.waitUploads.Add(-1)
 	invocation.wgUpload.Done() // will end up after all required files uploaded/failed
 }
 
@@ -369,19 +722,48 @@ func (invocation *Invocation) ForceInterrupt(err error) {
 	for invocation.waitUploads.Load() != 0 {
 		invocation.DoneUploadFile(err)
 	}
+	// a .o being received could stop in the middle (chunks stopped coming), don't leave its tmp file near objOutFile;
+	// if chunks come later, writing to a removed file succeeds, and renaming it fails
+	invocation.tmpFilesMu.Lock()
+	for _, fileNameTmp := range invocation.tmpFiles {
+		_ = os.Remove(fileNameTmp)
+	}
+	invocation.tmpFilesMu.Unlock()
 	// release invocation.wgDone
 	invocation.DoneRecvObj(err, true)
 }
 
+// uploadedFileName is a local file to upload for a client file name (it's the same unless a repro bundle is replayed)
+func (invocation *Invocation) uploadedFileName(fileName string) string {
+	if invocation.replayRoot == "" {
+		return fileName
+	}
+	return filepath.Join(invocation.replayRoot, filepath.FromSlash(reproBundlePath(fileName)))
+}
+
 func (invocation *Invocation) OpenTempFile(fullPath string) (f *os.File, err error) {
 	fileNameTmp := fullPath + "." + strconv.Itoa(rand.Int())
 	fileTmp, err := os.OpenFile(fileNameTmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm)
 	_ = fileTmp.Chown(invocation.uid, invocation.gid)
+	if err == nil {
+		invocation.tmpFilesMu.Lock()
+		invocation.tmpFiles = append(invocation.tmpFiles, fileNameTmp)
+		invocation.tmpFilesMu.Unlock()
+	}
 	return fileTmp, err
 }
 
 func (invocation *Invocation) WriteFile(name string, data []byte) error {
-	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	return invocation.writeFileFlags(name, data, os.O_TRUNC)
+}
+
+// AppendFile is like WriteFile, but keeps the contents of an existing file
+func (invocation *Invocation) AppendFile(name string, data []byte) error {
+	return invocation.writeFileFlags(name, data, os.O_APPEND)
+}
+
+func (invocation *Invocation) writeFileFlags(name string, data []byte, flag int) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|flag, os.ModePerm)
 	_ = f.Chown(invocation.uid, invocation.gid)
 
 	if err != nil {
@@ -395,3 +777,14 @@ func (invocation *Invocation) WriteFile(name string, data []byte) error {
 
 	return err
 }
+
+// specifiesDiagnosticsColor detects gcc and clang flags turning colors on or off, then nocc doesn't force them
+func specifiesDiagnosticsColor(cmdLine []string) bool {
+	for _, arg := range cmdLine {
+		if strings.HasPrefix(arg, "-fdiagnostics-color") || strings.HasPrefix(arg, "-fno-diagnostics-color") ||
+			arg == "-fcolor-diagnostics" || arg == "-fno-color-diagnostics" {
+			return true
+		}
+	}
+	return false
+}
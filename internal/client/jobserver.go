@@ -0,0 +1,128 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Jobservers let local compilations take part in a GNU make (4.4+) or ninja jobserver of a build that runs `nocc`:
+// `nocc` passes a fifo from `--jobserver-auth=fifo:{path}` of MAKEFLAGS, and a compiler launched locally holds a token of it
+// while running, returning it afterward. Remote compilations don't take tokens.
+// So local fallbacks share CPUs with other jobs of a build (linking, codegen) through one limiter.
+// A job holds one token implicitly (make started it), so one local compilation per jobserver runs without a token:
+// otherwise, if all jobs of `make -jN` fell back to local, they would wait for each other's tokens forever.
+// The older pipe style (`--jobserver-auth=R,W`) can't be used: those fds belong to `nocc`, not to a daemon.
+// It's nil if Jobserver is off.
+type Jobservers struct {
+	mu     sync.Mutex
+	byFifo map[string]*jobserverFifo // opened while used, every build has its own fifo
+}
+
+type jobserverFifo struct {
+	file      *os.File
+	readSlot  chan struct{} // one reader at a time, since a read deadline is per file
+	nUsers    int           // compilations running or waiting, a fifo is closed when none
+	tokenless bool          // a compilation is running on an implicit token of its job
+}
+
+// jobserverPollInterval is how often a waiting compilation checks that it was interrupted or an implicit token became free
+const jobserverPollInterval = 200 * time.Millisecond
+
+func MakeJobservers(enabled bool) *Jobservers {
+	if !enabled {
+		return nil
+	}
+	return &Jobservers{
+		byFifo: make(map[string]*jobserverFifo),
+	}
+}
+
+func (jobservers *Jobservers) openFifo(fifoPath string) (*jobserverFifo, error) {
+	jobservers.mu.Lock()
+	defer jobservers.mu.Unlock()
+	fifo := jobservers.byFifo[fifoPath]
+	if fifo == nil {
+		// O_RDWR doesn't block on open, a fifo is pollable then, so reads can have a deadline
+		file, err := os.OpenFile(fifoPath, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		fifo = &jobserverFifo{file: file, readSlot: make(chan struct{}, 1)}
+		jobservers.byFifo[fifoPath] = fifo
+	}
+	fifo.nUsers++
+	return fifo, nil
+}
+
+func (jobservers *Jobservers) closeFifo(fifoPath string, fifo *jobserverFifo, wasTokenless bool) {
+	jobservers.mu.Lock()
+	defer jobservers.mu.Unlock()
+	if wasTokenless {
+		fifo.tokenless = false
+	}
+	fifo.nUsers--
+	if fifo.nUsers == 0 {
+		_ = fifo.file.Close()
+		delete(jobservers.byFifo, fifoPath)
+	}
+}
+
+// Acquire waits for a token of a jobserver (empty fifoPath means `nocc` doesn't run under a jobserver)
+// and returns a function releasing it. If a jobserver can't be used or waiting is interrupted, nothing is held.
+func (jobservers *Jobservers) Acquire(fifoPath string, interruptChan chan struct{}) (release func()) {
+	if jobservers == nil || fifoPath == "" {
+		return func() {}
+	}
+	fifo, err := jobservers.openFifo(fifoPath)
+	if err != nil {
+		logClient.Error("can't open jobserver", fifoPath, err)
+		return func() {}
+	}
+
+	token := make([]byte, 1)
+	start := time.Now()
+	for {
+		jobservers.mu.Lock()
+		tokenless := !fifo.tokenless
+		fifo.tokenless = true
+		jobservers.mu.Unlock()
+		if tokenless {
+			return func() { jobservers.closeFifo(fifoPath, fifo, true) }
+		}
+
+		select {
+		case fifo.readSlot <- struct{}{}:
+		case <-interruptChan:
+			jobservers.closeFifo(fifoPath, fifo, false)
+			return func() {}
+		case <-time.After(jobserverPollInterval):
+			continue
+		}
+		_ = fifo.file.SetReadDeadline(time.Now().Add(jobserverPollInterval))
+		n, err := fifo.file.Read(token)
+		<-fifo.readSlot
+
+		if n == 1 {
+			logClient.Info(2, "got a jobserver token in", time.Since(start))
+			return func() {
+				if _, err := fifo.file.Write(token); err != nil {
+					logClient.Error("can't return a jobserver token", fifoPath, err)
+				}
+				jobservers.closeFifo(fifoPath, fifo, false)
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			logClient.Error("can't read a jobserver token", fifoPath, err)
+			jobservers.closeFifo(fifoPath, fifo, false)
+			return func() {}
+		}
+		select {
+		case <-interruptChan:
+			jobservers.closeFifo(fifoPath, fifo, false)
+			return func() {}
+		default:
+		}
+	}
+}
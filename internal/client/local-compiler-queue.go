@@ -0,0 +1,86 @@
+package client
+
+import (
+	"sync"
+)
+
+// LocalCompilerQueue limits the number of compiler processes launched locally within a daemon.
+// (see CompilerLaunchRequest for why local compilation is performed within a daemon)
+// When several builds share a daemon, slots are shared fairly: while other builds are waiting,
+// a build can't occupy more than capacity/nBuilds slots, so that one huge build doesn't starve a small one.
+type LocalCompilerQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	capacity        int
+	running         int
+	runningPerBuild map[string]int
+	waitingPerBuild map[string]int
+}
+
+func MakeLocalCompilerQueue(capacity int) *LocalCompilerQueue {
+	queue := &LocalCompilerQueue{
+		capacity:        capacity,
+		runningPerBuild: make(map[string]int),
+		waitingPerBuild: make(map[string]int),
+	}
+	queue.cond = sync.NewCond(&queue.mu)
+	return queue
+}
+
+// SetCapacity changes the number of slots (on config reload).
+// If it decreases, running compilers are not killed, new ones just wait until the number goes down.
+func (queue *LocalCompilerQueue) SetCapacity(capacity int) {
+	queue.mu.Lock()
+	queue.capacity = capacity
+	queue.mu.Unlock()
+	queue.cond.Broadcast()
+}
+
+// fairShare is a max number of slots for one build; called under a lock
+func (queue *LocalCompilerQueue) fairShare() int {
+	// zero counters are deleted from maps, so every key is an active build
+	nBuilds := len(queue.runningPerBuild)
+	for buildID := range queue.waitingPerBuild {
+		if _, isRunning := queue.runningPerBuild[buildID]; !isRunning {
+			nBuilds++
+		}
+	}
+	if nBuilds <= 1 {
+		return queue.capacity
+	}
+	return max(1, (queue.capacity+nBuilds-1)/nBuilds)
+}
+
+// HasFreeSlot tells whether Acquire of a build wouldn't wait now, see AdaptiveSplit
+func (queue *LocalCompilerQueue) HasFreeSlot(buildID string) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.running < queue.capacity && queue.runningPerBuild[buildID] < queue.fairShare()
+}
+
+func (queue *LocalCompilerQueue) Acquire(buildID string) {
+	queue.mu.Lock()
+	queue.waitingPerBuild[buildID]++
+	for queue.running >= queue.capacity || queue.runningPerBuild[buildID] >= queue.fairShare() {
+		queue.cond.Wait()
+	}
+	queue.waitingPerBuild[buildID]--
+	if queue.waitingPerBuild[buildID] == 0 {
+		delete(queue.waitingPerBuild, buildID)
+	}
+	queue.running++
+	queue.runningPerBuild[buildID]++
+	queue.mu.Unlock()
+}
+
+func (queue *LocalCompilerQueue) Release(buildID string) {
+	queue.mu.Lock()
+	queue.running--
+	queue.runningPerBuild[buildID]--
+	if queue.runningPerBuild[buildID] == 0 {
+		delete(queue.runningPerBuild, buildID)
+	}
+	queue.mu.Unlock()
+	queue.cond.Broadcast()
+}
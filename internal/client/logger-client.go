@@ -8,5 +8,8 @@ var logClient *common.LoggerWrapper
 func MakeLoggerClient(configuration *Configuration) error {
 	var err error
 	logClient, err = common.MakeLogger(configuration.LogFileName, configuration.LogLevel)
-	return err
+	if err != nil {
+		return err
+	}
+	return logClient.SetLimits(configuration.LogMaxFieldLength, configuration.LogMaxLineLength, configuration.LogFullFieldsDir)
 }
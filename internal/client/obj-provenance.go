@@ -0,0 +1,82 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+
+	"nocc/internal/common"
+)
+
+// ObjProvenanceChecker handles provenance of received objects (see common.ObjProvenance): who compiled them.
+// It's written next to a .o as {obj}.provenance.json, so that it's known which machine produced every object.
+// If public keys are configured, a .o without provenance signed by any of them is rejected (compiled locally),
+// and a sha256 in provenance must match a received .o.
+// It's nil if neither WriteProvenance nor ProvenanceKeys is set.
+type ObjProvenanceChecker struct {
+	writeFiles bool
+	publicKeys []ed25519.PublicKey
+}
+
+func MakeObjProvenanceChecker(writeFiles bool, keyFiles []string) (*ObjProvenanceChecker, error) {
+	if !writeFiles && len(keyFiles) == 0 {
+		return nil, nil
+	}
+
+	checker := &ObjProvenanceChecker{writeFiles: writeFiles}
+	for _, keyFile := range keyFiles {
+		publicKey, err := common.ReadEd25519PublicKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		checker.publicKeys = append(checker.publicKeys, publicKey)
+	}
+	return checker, nil
+}
+
+func provenanceFileName(objOutFile string) string {
+	return objOutFile + ".provenance.json"
+}
+
+// verify is called for a fully received .o before it's renamed to objOutFile
+func (checker *ObjProvenanceChecker) verify(provenance []byte, objTmpFile string) error {
+	if checker == nil || len(checker.publicKeys) == 0 {
+		return nil
+	}
+	if len(provenance) == 0 {
+		return fmt.Errorf("no provenance received, a server doesn't record it")
+	}
+
+	verified, err := common.VerifyObjProvenance(provenance, checker.publicKeys)
+	if err != nil {
+		return err
+	}
+	objSHA256, err := common.GetFileSHA256(objTmpFile)
+	if err != nil {
+		return err
+	}
+	if objSHA256.ToHexString() != verified.ObjSHA256 {
+		return fmt.Errorf("provenance from %s doesn't match a received obj", verified.Server)
+	}
+	return nil
+}
+
+// write saves provenance next to a saved .o, or removes a stale one if a server didn't send it
+func (checker *ObjProvenanceChecker) write(invocation *Invocation, provenance []byte) error {
+	if checker == nil || !checker.writeFiles {
+		return nil
+	}
+	if len(provenance) == 0 {
+		checker.removeStale(invocation)
+		return nil
+	}
+	return invocation.WriteFile(provenanceFileName(invocation.objOutFile), provenance)
+}
+
+// removeStale removes provenance left from a previous remote compilation when a .o is compiled locally
+func (checker *ObjProvenanceChecker) removeStale(invocation *Invocation) {
+	if checker == nil || !checker.writeFiles || invocation.objOutFile == "" {
+		return
+	}
+	_ = os.Remove(provenanceFileName(invocation.objOutFile))
+}
@@ -0,0 +1,31 @@
+package client
+
+// ObjWriters limits the number of received .o files being written to a disk at the same moment.
+// Under `make -j128`, dozens of .o may come from remotes at once; on a slow disk, writing them all in parallel
+// starves everything else (e.g. preprocessing of next files). A stream waiting for a slot is just paused,
+// grpc flow control keeps remaining chunks on a server.
+// It's nil if MaxObjWrites is not set, then writes are not limited.
+type ObjWriters struct {
+	slots chan struct{}
+}
+
+func MakeObjWriters(maxObjWrites int) *ObjWriters {
+	if maxObjWrites <= 0 {
+		return nil
+	}
+	return &ObjWriters{
+		slots: make(chan struct{}, maxObjWrites),
+	}
+}
+
+func (writers *ObjWriters) acquire() {
+	if writers != nil {
+		writers.slots <- struct{}{}
+	}
+}
+
+func (writers *ObjWriters) release() {
+	if writers != nil {
+		<-writers.slots
+	}
+}
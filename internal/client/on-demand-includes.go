@@ -0,0 +1,395 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OnDemandIncludes serves files to servers reading includes on demand (see server.OnDemandIncludes).
+// Instead of collecting dependencies with `compiler -M` and uploading them, a session sends a .cpp
+// and dirs where a compiler searches for includes (see collectDirs), and a server requests files a compiler looks up
+// over a stream (see RemoteConnection.CreateOnDemandStream). Only files inside dirs sent in sessions are served.
+// It's nil if OnDemandIncludes is not set (or UploadToolchain is: a server needs uploaded files then).
+type OnDemandIncludes struct {
+	mu         sync.Mutex
+	dirs       map[string]bool                // sent in sessions, see isServed
+	hashes     map[string]onDemandHash        // of files requested by servers, by a file name
+	searchDirs map[string]*onDemandSearchDirs // implicit include dirs of compilers, see compilerSearchDirs
+}
+
+// onDemandHash is valid while a file has the same size and mtime
+type onDemandHash struct {
+	fileSize int64
+	modTime  int64
+	sha256   common.SHA256
+}
+
+type onDemandSearchDirs struct {
+	once sync.Once
+	dirs []string
+}
+
+const onDemandChunkSize = 64 * 1024
+
+func MakeOnDemandIncludes(enabled bool) *OnDemandIncludes {
+	if !enabled {
+		return nil
+	}
+	return &OnDemandIncludes{
+		dirs:       make(map[string]bool),
+		hashes:     make(map[string]onDemandHash),
+		searchDirs: make(map[string]*onDemandSearchDirs),
+	}
+}
+
+// canUseOnDemandIncludes is false if a server or a client needs all dependencies of a .cpp:
+// side outputs are compiled in a client working dir, depend mode saves a manifest, a repro is replayed from a bundle
+func (daemon *Daemon) canUseOnDemandIncludes(invocation *Invocation) bool {
+	usesDependMode := daemon.dependCache != nil && invocation.project.UsesDependMode()
+	return !invocation.sideOutputs && invocation.replayRoot == "" && !usesDependMode
+}
+
+// collectOnDemandFiles is like Daemon.collectRequiredFiles, but without dependencies: only a .cpp, -f option files and BMIs.
+// Dirs a compiler searches for includes in are set to invocation.onDemandDirs.
+func (daemon *Daemon) collectOnDemandFiles(invocation *Invocation) (*DependentIncludesResponse, []*pb.FileMetadata, error) {
+	invocation.localCompiler = daemon.localCompilerProbes.Probe(invocation.compilerName, common.ExtractTargetArgs(invocation.compilerArgs))
+
+	cppFile, err := createIncludedFileWithBuffer(invocation.cppInFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	requiredFiles := []*pb.FileMetadata{cppFile.ToPbFileMetadata()}
+
+	for fOption, fOptionFile := range invocation.fOptionFiles {
+		fileMeta, err := createIncludedFileWithBuffer(fOptionFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create file metadata for option %q for file %q: %v", fOption, fOptionFile, err)
+		}
+		requiredFiles = append(requiredFiles, fileMeta.ToPbFileMetadata())
+	}
+
+	for _, bmiFile := range invocation.bmiInFiles {
+		fileMeta, err := createIncludedFileWithBuffer(bmiFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create file metadata for module %q: %v", bmiFile, err)
+		}
+		requiredFiles = append(requiredFiles, fileMeta.ToPbFileMetadata())
+	}
+
+	invocation.onDemandDirs = daemon.onDemandIncludes.collectDirs(invocation)
+	invocation.summary.AddTiming("collected_includes")
+	return &DependentIncludesResponse{cppFile: cppFile}, requiredFiles, nil
+}
+
+// onDemandIncludedFiles lists files a remote compiler has read on demand, except a .cpp itself, for a depfile.
+// Headers from dirs mounted on a server (see SystemHeaderDirs) are not read on demand, so they are absent here.
+func (invocation *Invocation) onDemandIncludedFiles() []*IncludedFile {
+	includedFiles := make([]*IncludedFile, 0, len(invocation.onDemandFiles))
+	for _, serverFileName := range invocation.onDemandFiles {
+		if fileName := common.FromServerPath(serverFileName); fileName != invocation.cppInFile {
+			includedFiles = append(includedFiles, &IncludedFile{fileName: fileName})
+		}
+	}
+	return includedFiles
+}
+
+// collectDirs returns dirs a compiler may read includes from: a dir of a .cpp, -I/-iquote/-isystem/-idirafter,
+// dirs of -include/-imacros files, a sysroot, and implicit dirs of a compiler. They are allowed to be served then.
+func (onDemand *OnDemandIncludes) collectDirs(invocation *Invocation) []string {
+	dirs := []string{filepath.Dir(invocation.cppInFile)}
+	args := invocation.compilerArgs
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-I" || arg == "-iquote" || arg == "-isystem" || arg == "-idirafter" || arg == "--sysroot" || arg == "-isysroot") && i+1 < len(args):
+			dirs = append(dirs, common.PathAbs(invocation.cwd, args[i+1]))
+			i++
+		case (arg == "-include" || arg == "-include-pch" || arg == "-imacros") && i+1 < len(args):
+			dirs = append(dirs, filepath.Dir(common.PathAbs(invocation.cwd, args[i+1])))
+			i++
+		case strings.HasPrefix(arg, "--sysroot="):
+			dirs = append(dirs, common.PathAbs(invocation.cwd, arg[len("--sysroot="):]))
+		case strings.HasPrefix(arg, "-I") || strings.HasPrefix(arg, "-isystem") || strings.HasPrefix(arg, "-iquote") || strings.HasPrefix(arg, "-idirafter"):
+			for _, key := range []string{"-idirafter", "-isystem", "-iquote", "-I"} {
+				if strings.HasPrefix(arg, key) {
+					dirs = append(dirs, common.PathAbs(invocation.cwd, arg[len(key):]))
+					break
+				}
+			}
+		}
+	}
+	dirs = append(dirs, onDemand.compilerSearchDirs(invocation)...)
+
+	existing := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if stat, err := os.Stat(dir); err == nil && stat.IsDir() && filepath.Dir(dir) != dir && !slices.Contains(existing, dir) {
+			existing = append(existing, dir)
+		}
+	}
+
+	onDemand.mu.Lock()
+	for _, dir := range existing {
+		onDemand.dirs[dir] = true
+	}
+	onDemand.mu.Unlock()
+	return existing
+}
+
+// compilerSearchDirs returns dirs a compiler searches for includes in by default (like /usr/include),
+// parsed from `compiler -E -v` once for every compiler and args affecting them (a target, a sysroot, -nostdinc, etc.)
+func (onDemand *OnDemandIncludes) compilerSearchDirs(invocation *Invocation) []string {
+	searchArgs := common.ExtractTargetArgs(invocation.compilerArgs)
+	for i, arg := range invocation.compilerArgs {
+		switch {
+		case (arg == "--sysroot" || arg == "-isysroot") && i+1 < len(invocation.compilerArgs):
+			searchArgs = append(searchArgs, arg, invocation.compilerArgs[i+1])
+		case strings.HasPrefix(arg, "--sysroot=") || strings.HasPrefix(arg, "-stdlib=") || strings.HasPrefix(arg, "-nostdinc") ||
+			strings.HasPrefix(arg, "-nostdlibinc") || strings.HasPrefix(arg, "--gcc-toolchain=") || strings.HasPrefix(arg, "--gcc-install-dir="):
+			searchArgs = append(searchArgs, arg)
+		}
+	}
+	key := invocation.compilerName + " " + strings.Join(searchArgs, " ")
+
+	onDemand.mu.Lock()
+	searchDirs := onDemand.searchDirs[key]
+	if searchDirs == nil {
+		searchDirs = &onDemandSearchDirs{}
+		onDemand.searchDirs[key] = searchDirs
+	}
+	onDemand.mu.Unlock()
+
+	searchDirs.once.Do(func() {
+		out, err := exec.Command(invocation.compilerName, append(searchArgs, "-E", "-v", "-x", "c++", os.DevNull)...).CombinedOutput()
+		if err != nil {
+			logClient.Error("can't detect include dirs of", invocation.compilerName, searchArgs, err)
+		}
+		searchDirs.dirs = parseCompilerSearchDirs(string(out))
+		logClient.Info(1, "include dirs of", invocation.compilerName, searchArgs, searchDirs.dirs)
+	})
+	return searchDirs.dirs
+}
+
+// parseCompilerSearchDirs extracts dirs from `compiler -E -v` output, they are listed like
+//
+//	#include <...> search starts here:
+//	 /usr/include
+//	End of search list.
+func parseCompilerSearchDirs(out string) []string {
+	dirs := make([]string, 0)
+	inside := false
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "#include ") && strings.HasSuffix(strings.TrimSpace(line), "search starts here:"):
+			inside = true
+		case strings.HasPrefix(line, "End of search list."):
+			inside = false
+		case inside && strings.HasPrefix(line, " "):
+			dir := strings.TrimSuffix(strings.TrimSpace(line), " (framework directory)")
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+	return dirs
+}
+
+// isServed tells whether a file is inside any dir sent in a session
+func (onDemand *OnDemandIncludes) isServed(fileName string) bool {
+	onDemand.mu.Lock()
+	defer onDemand.mu.Unlock()
+	for dir := fileName; ; dir = filepath.Dir(dir) {
+		if onDemand.dirs[dir] {
+			return true
+		}
+		if filepath.Dir(dir) == dir {
+			return false
+		}
+	}
+}
+
+// serveRequest replies to a request of a server; a body (if requested) is sent in chunks after a reply with a file
+func (onDemand *OnDemandIncludes) serveRequest(request *pb.OnDemandFileRequest, send func(*pb.OnDemandFileReply) error) error {
+	fileName := common.FromServerPath(request.Path)
+	if !filepath.IsAbs(fileName) || !onDemand.isServed(filepath.Clean(fileName)) {
+		return send(&pb.OnDemandFileReply{RequestID: request.RequestID, Error: request.Path + " is not served"})
+	}
+
+	if request.ListDir {
+		entries, err := listOnDemandDir(fileName)
+		if err != nil {
+			return send(&pb.OnDemandFileReply{RequestID: request.RequestID, Error: err.Error()})
+		}
+		return send(&pb.OnDemandFileReply{RequestID: request.RequestID, Entries: entries})
+	}
+
+	if !request.FetchBody {
+		file, err := onDemand.statFile(fileName)
+		if err != nil {
+			return send(&pb.OnDemandFileReply{RequestID: request.RequestID, Error: err.Error()})
+		}
+		file.FileName = request.Path
+		return send(&pb.OnDemandFileReply{RequestID: request.RequestID, File: file})
+	}
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return send(&pb.OnDemandFileReply{RequestID: request.RequestID, Error: err.Error()})
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return send(&pb.OnDemandFileReply{RequestID: request.RequestID, Error: err.Error()})
+	}
+
+	// a server verifies sha256 of a body, so a file changed since statFile fails there
+	if err := send(&pb.OnDemandFileReply{RequestID: request.RequestID, File: &pb.FileMetadata{FileName: request.Path, FileSize: stat.Size()}}); err != nil {
+		return err
+	}
+	chunkBuf := make([]byte, onDemandChunkSize)
+	reader := io.LimitReader(fd, stat.Size())
+	for sentBytes := int64(0); sentBytes < stat.Size(); {
+		n, err := io.ReadFull(reader, chunkBuf)
+		if n == 0 && err != nil {
+			return send(&pb.OnDemandFileReply{RequestID: request.RequestID, Error: "can't read " + request.Path + ": " + err.Error()})
+		}
+		if err := send(&pb.OnDemandFileReply{RequestID: request.RequestID, ChunkBody: chunkBuf[:n]}); err != nil {
+			return err
+		}
+		sentBytes += int64(n)
+	}
+	return nil
+}
+
+// listOnDemandDir lists a dir for a server; own precompiled headers are hidden, a server compiles them its own way
+func listOnDemandDir(dir string) ([]*pb.OnDemandDirEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*pb.OnDemandDirEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if strings.HasSuffix(dirEntry.Name(), ".gch") || strings.HasSuffix(dirEntry.Name(), ".nocc-pch") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue // removed meanwhile
+		}
+		entry := &pb.OnDemandDirEntry{
+			Name:     dirEntry.Name(),
+			IsDir:    info.IsDir(),
+			FileSize: info.Size(),
+			ModTime:  info.ModTime().UnixNano(),
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			entry.IsSymlink = true
+			entry.SymlinkTarget, _ = os.Readlink(filepath.Join(dir, dirEntry.Name()))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// statFile returns a size and sha256 of a file, sha256 is calculated again only if a file has changed
+func (onDemand *OnDemandIncludes) statFile(fileName string) (*pb.FileMetadata, error) {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	onDemand.mu.Lock()
+	hash, exists := onDemand.hashes[fileName]
+	onDemand.mu.Unlock()
+	if !exists || hash.fileSize != stat.Size() || hash.modTime != stat.ModTime().UnixNano() {
+		sha256, _, err := common.CalcSHA256OfFileName(fileName, nil)
+		if err != nil {
+			return nil, err
+		}
+		hash = onDemandHash{fileSize: stat.Size(), modTime: stat.ModTime().UnixNano(), sha256: sha256}
+		onDemand.mu.Lock()
+		onDemand.hashes[fileName] = hash
+		onDemand.mu.Unlock()
+	}
+
+	return &pb.FileMetadata{
+		FileSize:      hash.fileSize,
+		SHA256_B0_7:   hash.sha256.B0_7,
+		SHA256_B8_15:  hash.sha256.B8_15,
+		SHA256_B16_23: hash.sha256.B16_23,
+		SHA256_B24_31: hash.sha256.B24_31,
+	}, nil
+}
+
+// CreateOnDemandStream opens a stream a server requests files over, if it has accepted OnDemandIncludes on StartClient.
+// Like an upload stream, it's recreated after errors.
+func (remote *RemoteConnection) CreateOnDemandStream() {
+	remote.onDemandStreamContext = CreateStreamContext()
+	remote.runOnDemandStream()
+}
+
+func (remote *RemoteConnection) runOnDemandStream() {
+	defer remote.onDemandStreamContext.cancelFunc()
+
+	stream, err := remote.compilationServiceClient.OnDemandFilesStream(remote.onDemandStreamContext.ctx)
+	if err != nil {
+		remote.OnRemoteBecameUnavailable(err)
+		return
+	}
+
+	err = remote.serveOnDemandStream(stream)
+	select {
+	case <-remote.quitChan:
+		return
+	case <-remote.reconnectChan:
+		return
+	default:
+	}
+
+	if status.Code(err) == codes.Unauthenticated {
+		remote.OnRemoteBecameUnavailable(err)
+		return
+	}
+
+	// sessions waiting for a reply fail on a server and are compiled locally
+	logClient.Error("recreate on-demand stream:", err)
+	time.Sleep(100 * time.Millisecond)
+	go remote.CreateOnDemandStream()
+}
+
+// serveOnDemandStream handles every request in its own goroutine: a large file being sent doesn't delay others
+func (remote *RemoteConnection) serveOnDemandStream(stream pb.CompilationService_OnDemandFilesStreamClient) error {
+	var sendMu sync.Mutex
+	send := func(reply *pb.OnDemandFileReply) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(reply)
+	}
+
+	if err := send(&pb.OnDemandFileReply{ClientID: remote.clientID}); err != nil {
+		return err
+	}
+	for {
+		request, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := remote.onDemandIncludes.serveRequest(request, send); err != nil {
+				logClient.Error("can't reply on-demand request", request.Path, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// serveTestRequest returns replies to a request of a server
+func serveTestRequest(t *testing.T, onDemand *OnDemandIncludes, request *pb.OnDemandFileRequest) []*pb.OnDemandFileReply {
+	var replies []*pb.OnDemandFileReply
+	err := onDemand.serveRequest(request, func(reply *pb.OnDemandFileReply) error {
+		if reply.RequestID != request.RequestID {
+			t.Errorf("a reply to %d has RequestID %d", request.RequestID, reply.RequestID)
+		}
+		reply.ChunkBody = bytes.Clone(reply.ChunkBody) // a buffer is reused
+		replies = append(replies, reply)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replies
+}
+
+func TestOnDemandServeRequest(t *testing.T) {
+	dir := t.TempDir()
+	include := filepath.Join(dir, "include")
+	body := bytes.Repeat([]byte("int a;\n"), onDemandChunkSize/7+100) // more than a chunk
+	for fileName, contents := range map[string][]byte{
+		"include/a.h":       body,
+		"include/empty.h":   nil,
+		"include/pch.h.gch": []byte("pch"),
+		"include/sub/b.h":   []byte("int b;\n"),
+		"secret/key":        []byte("secret"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, fileName)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fileName), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.h", filepath.Join(include, "link.h")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../secret/key", filepath.Join(include, "secret.h")); err != nil {
+		t.Fatal(err)
+	}
+
+	onDemand := MakeOnDemandIncludes(true)
+	onDemand.dirs[include] = true
+	aSHA256, _ := common.GetFileSHA256(filepath.Join(include, "a.h"))
+
+	t.Run("list", func(t *testing.T) {
+		replies := serveTestRequest(t, onDemand, &pb.OnDemandFileRequest{RequestID: 1, Path: common.ToServerPath(include), ListDir: true})
+		if len(replies) != 1 || replies[0].Error != "" {
+			t.Fatalf("unexpected replies %v", replies)
+		}
+		var names []string
+		for _, entry := range replies[0].Entries {
+			names = append(names, entry.Name)
+			if entry.Name == "link.h" && (!entry.IsSymlink || entry.SymlinkTarget != "a.h") {
+				t.Errorf("a symlink isn't listed as is: %v", entry)
+			}
+			if entry.Name == "a.h" && (entry.FileSize != int64(len(body)) || entry.ModTime == 0) {
+				t.Errorf("unexpected entry %v", entry)
+			}
+			if entry.Name == "sub" && !entry.IsDir {
+				t.Errorf("a dir isn't listed as a dir: %v", entry)
+			}
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, []string{"a.h", "empty.h", "link.h", "secret.h", "sub"}) {
+			t.Errorf("unexpected names %q", names) // a precompiled header is hidden
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		replies := serveTestRequest(t, onDemand, &pb.OnDemandFileRequest{RequestID: 2, Path: common.ToServerPath(filepath.Join(include, "a.h"))})
+		if len(replies) != 1 || replies[0].File.GetFileSize() != int64(len(body)) || replies[0].File.SHA256_B0_7 != aSHA256.B0_7 || replies[0].File.SHA256_B24_31 != aSHA256.B24_31 {
+			t.Fatalf("unexpected replies %v", replies)
+		}
+	})
+
+	t.Run("fetch", func(t *testing.T) {
+		for _, fileName := range []string{"a.h", "empty.h", "sub/b.h"} {
+			expected, _ := os.ReadFile(filepath.Join(include, fileName))
+			replies := serveTestRequest(t, onDemand, &pb.OnDemandFileRequest{RequestID: 3, Path: common.ToServerPath(filepath.Join(include, fileName)), FetchBody: true})
+			if len(replies) == 0 || replies[0].File.GetFileSize() != int64(len(expected)) {
+				t.Fatalf("unexpected replies %v", replies)
+			}
+			var received []byte
+			for _, chunk := range replies[1:] {
+				if chunk.Error != "" || len(chunk.ChunkBody) == 0 || len(chunk.ChunkBody) > onDemandChunkSize {
+					t.Errorf("unexpected chunk of %d bytes: %q", len(chunk.ChunkBody), chunk.Error)
+				}
+				received = append(received, chunk.ChunkBody...)
+			}
+			if !bytes.Equal(received, expected) {
+				t.Errorf("%s: received %d bytes, expected %d", fileName, len(received), len(expected))
+			}
+		}
+	})
+
+	t.Run("not served", func(t *testing.T) {
+		for _, request := range []*pb.OnDemandFileRequest{
+			{Path: common.ToServerPath(filepath.Join(dir, "secret/key")), FetchBody: true},
+			{Path: common.ToServerPath(filepath.Join(dir, "secret")), ListDir: true},
+			{Path: common.ToServerPath(filepath.Join(include, "../secret/key"))},
+			{Path: common.ToServerPath(dir), ListDir: true},
+			{Path: "include/a.h"},
+		} {
+			replies := serveTestRequest(t, onDemand, request)
+			if len(replies) != 1 || !strings.Contains(replies[0].Error, "is not served") || len(replies[0].Entries) != 0 || replies[0].File != nil {
+				t.Errorf("%s is served: %v", request.Path, replies)
+			}
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		replies := serveTestRequest(t, onDemand, &pb.OnDemandFileRequest{Path: common.ToServerPath(filepath.Join(include, "missing.h"))})
+		if len(replies) != 1 || replies[0].Error == "" || replies[0].File != nil {
+			t.Errorf("unexpected replies %v", replies)
+		}
+	})
+
+	// sha256 is calculated again only after a file changes
+	t.Run("changed", func(t *testing.T) {
+		fileName := filepath.Join(include, "a.h")
+		onDemand.hashes[fileName] = onDemandHash{fileSize: onDemand.hashes[fileName].fileSize, modTime: onDemand.hashes[fileName].modTime, sha256: common.SHA256{B0_7: 1}}
+		if file, _ := onDemand.statFile(fileName); file.SHA256_B0_7 != 1 {
+			t.Errorf("sha256 of a file not changed is calculated again")
+		}
+		if err := os.WriteFile(fileName, []byte("int A;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(fileName, time.Now(), time.Now().Add(time.Second))
+		changedSHA256, _ := common.GetFileSHA256(fileName)
+		if file, _ := onDemand.statFile(fileName); file.FileSize != 7 || file.SHA256_B0_7 != changedSHA256.B0_7 {
+			t.Errorf("sha256 of a changed file isn't calculated again: %v", file)
+		}
+	})
+}
+
+func TestParseCompilerSearchDirs(t *testing.T) {
+	out := `clang version 17.0.6
+ignoring nonexistent directory "/usr/local/include/x86_64-linux-gnu"
+#include "..." search starts here:
+ /usr/include/quoted
+#include <...> search starts here:
+ /usr/lib/gcc/x86_64-linux-gnu/12/../../../../include/c++/12
+ /usr/local/include
+ /usr/include
+ /System/Library/Frameworks (framework directory)
+End of search list.
+ /not/a/dir
+`
+	expected := []string{"/usr/include/quoted", "/usr/include/c++/12", "/usr/local/include", "/usr/include", "/System/Library/Frameworks"}
+	if dirs := parseCompilerSearchDirs(out); !slices.Equal(dirs, expected) {
+		t.Errorf("unexpected dirs %q", dirs)
+	}
+	if dirs := parseCompilerSearchDirs("gcc: error: unrecognized option\n"); dirs == nil || len(dirs) != 0 {
+		t.Errorf("unexpected dirs %q", dirs)
+	}
+}
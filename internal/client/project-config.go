@@ -0,0 +1,156 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"nocc/internal/common"
+
+	"github.com/BurntSushi/toml"
+)
+
+const projectConfigFileName = ".nocc.toml"
+
+// ProjectConfiguration is a `.nocc.toml` found by walking up from cwd of an invocation.
+// It tunes a daemon for one project (e.g. a monorepo), without touching a system-wide config.
+// A daemon is shared among projects, that's why it only narrows what a daemon does: it can't add servers, for example.
+type ProjectConfiguration struct {
+	Servers             []string // a subset of daemon's Servers used for this project (others are ignored), all if empty
+	ForceLocal          []string // globs of input files (relative to a project root, or just basenames) compiled locally
+	DisableDependMode   bool     // don't use DependModeDir for this project, always compile
+	DisableCacheServers bool     // don't look up objects on cache servers, compile on full servers only
+	CacheNamespace      string   // objects are cached on servers apart from other projects, see common.ValidateCacheNamespace
+
+	rootDir string // where .nocc.toml is located
+}
+
+// IsForcedLocal returns true if cppInFile matches any ForceLocal glob.
+func (project *ProjectConfiguration) IsForcedLocal(cwd string, cppInFile string) bool {
+	if project == nil || len(project.ForceLocal) == 0 {
+		return false
+	}
+
+	if !filepath.IsAbs(cppInFile) {
+		cppInFile = filepath.Join(cwd, cppInFile)
+	}
+	relFile, err := filepath.Rel(project.rootDir, cppInFile)
+	if err != nil || strings.HasPrefix(relFile, "..") {
+		relFile = cppInFile
+	}
+
+	for _, pattern := range project.ForceLocal {
+		target := relFile
+		if !strings.ContainsRune(pattern, '/') {
+			target = filepath.Base(cppInFile)
+		}
+		if matched, _ := filepath.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (project *ProjectConfiguration) AllowsServer(remoteHostPort string) bool {
+	return project == nil || len(project.Servers) == 0 || slices.Contains(project.Servers, remoteHostPort)
+}
+
+func (project *ProjectConfiguration) UsesDependMode() bool {
+	return project == nil || !project.DisableDependMode
+}
+
+func (project *ProjectConfiguration) UsesCacheServers() bool {
+	return project == nil || !project.DisableCacheServers
+}
+
+func (project *ProjectConfiguration) GetCacheNamespace() string {
+	if project == nil {
+		return ""
+	}
+	return project.CacheNamespace
+}
+
+// ProjectConfigs finds and caches project configurations.
+// A found file is re-read when its mtime changes, so editing .nocc.toml doesn't need a daemon restart.
+type ProjectConfigs struct {
+	mu          sync.Mutex
+	cwdToFile   map[string]string // not to walk up the file system for every invocation; "" if not found
+	parsedFiles map[string]*parsedProjectConfig
+}
+
+type parsedProjectConfig struct {
+	mtime  time.Time
+	config *ProjectConfiguration // nil if a file is invalid
+}
+
+func MakeProjectConfigs() *ProjectConfigs {
+	return &ProjectConfigs{
+		cwdToFile:   make(map[string]string),
+		parsedFiles: make(map[string]*parsedProjectConfig),
+	}
+}
+
+// GetProjectConfig returns a config for cwd, or nil if there is no .nocc.toml above it (or it's invalid).
+func (pc *ProjectConfigs) GetProjectConfig(cwd string) *ProjectConfiguration {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	fileName, ok := pc.cwdToFile[cwd]
+	if !ok {
+		fileName = detectProjectConfigFile(cwd)
+		pc.cwdToFile[cwd] = fileName
+	}
+	if fileName == "" {
+		return nil
+	}
+
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		delete(pc.cwdToFile, cwd) // removed, walk up again next time
+		return nil
+	}
+
+	parsed := pc.parsedFiles[fileName]
+	if parsed == nil || !parsed.mtime.Equal(stat.ModTime()) {
+		parsed = &parsedProjectConfig{mtime: stat.ModTime()}
+		parsed.config, err = parseProjectConfiguration(fileName)
+		if err != nil {
+			logClient.Error("invalid", fileName, err)
+		} else {
+			logClient.Info(0, "project config", fileName)
+		}
+		pc.parsedFiles[fileName] = parsed
+	}
+	return parsed.config
+}
+
+func parseProjectConfiguration(fileName string) (*ProjectConfiguration, error) {
+	config := &ProjectConfiguration{rootDir: filepath.Dir(fileName)}
+	if _, err := toml.DecodeFile(fileName, config); err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range config.ForceLocal {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	if err := common.ValidateCacheNamespace(config.CacheNamespace); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// detectProjectConfigFile walks up from cwd to find .nocc.toml, "" if not found
+func detectProjectConfigFile(cwd string) string {
+	for dir := cwd; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		fileName := filepath.Join(dir, projectConfigFileName)
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName
+		}
+	}
+	return ""
+}
@@ -3,12 +3,19 @@ package client
 import (
 	"context"
 	"fmt"
+	"net"
+	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"nocc/internal/common"
 	"nocc/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type StreamContext struct {
@@ -37,61 +44,115 @@ func (streamContext *StreamContext) TryCancelStreamContext() {
 // If a remote is not available on daemon start (on becomes unavailable in the middle),
 // then all invocations that should be sent to that remote are executed locally within a daemon.
 type RemoteConnection struct {
-	chanToUpload         chan fileUploadReq
-	quitDaemonChan       chan int
-	reconnectChan        chan struct{}
-	receiveStreamContext *StreamContext
-	uploadStreamContext  *StreamContext
+	chanToUpload          chan fileUploadReq
+	quitChan              chan int // closed when a daemon quits or a remote is removed from config, see Close
+	reconnectChan         chan struct{}
+	receiveStreamContext  [nReceiveStreams]*StreamContext
+	uploadStreamContext   *StreamContext
+	onDemandStreamContext *StreamContext
 
 	socksProxyAddr string
 	remoteHostPort string
 	remoteHost     string // for console output and logs, just IP is more pretty
 	isUnavailable  atomic.Bool
 
+	// a server advertises its current CompilerQueueSize on every keepalive (it may change by schedule);
+	// if more sessions are active than a remote can compile, new ones are sent to other remotes
+	compilerQueueSize atomic.Int32
+	nActiveSessions   atomic.Int32
+	busyUntil         atomic.Int64 // unix nano, while a remote is saturated after refusing a session, see OnRemoteBusy
+
+	cost atomic.Int32 // from ServerCosts in config (may change on reload), see CostAwareScheduler
+
+	cacheDegraded atomic.Bool // a server reports that it fails to save to its caches, see KeepAlive
+	cacheOnly     atomic.Bool // a server doesn't compile, a .o is only looked up there, see StartCachedSession
+
+	reportsCompilingSessions atomic.Bool // an older server doesn't, then waiting for .o is limited by InvocationTimeout only
+	acceptsUploadBatches     atomic.Bool // an older server doesn't, then small files are uploaded one by one, see uploadFilesInBatch
+	acceptsOnDemandIncludes  atomic.Bool // replied on StartClient, then sessions may send dirs instead of includes, see OnDemandIncludes
+
+	acceptedSystemHeaderDirs atomic.Pointer[[]string]          // replied on StartClient, files from them are not sent, see omitKnownFiles
+	snapshots                atomic.Pointer[[]*remoteSnapshot] // replied on StartClient, see chooseSnapshot
+
+	transfer remoteTransferCounters
+
 	grpcClient               *GRPCClient
 	compilationServiceClient pb.CompilationServiceClient
 	findInvocation           func(uint32) *Invocation
-
-	clientID     string // = Daemon.clientID
-	hostUserName string // = Daemon.hostUserName
+	objWriters               *ObjWriters // = Daemon.objWriters
+	sessionLimits            *RemoteSessionLimits // = Daemon.sessionLimits
+	maxObjSize               int64       // = Daemon.maxObjSize
+	provenanceChecker        *ObjProvenanceChecker // = Daemon.provenanceChecker
+
+	compilerProbesMu sync.Mutex
+	compilerProbes   map[string]*remoteCompilerProbe // see ProbeCompiler
+
+	clientID         string                // = Daemon.clientID
+	priorityClass    string                // = Daemon.priorityClass
+	hostUserName     string                // = Daemon.hostUserName
+	uploadsToolchain bool                  // = Daemon.toolchains != nil, then a server doesn't mount its compilers for this client
+	systemHeaderDirs []*pb.SystemHeaderDir // = Daemon.systemHeaderDirs
+	snapshotNames    []string              // = Daemon.snapshotNames
+	onDemandIncludes *OnDemandIncludes     // = Daemon.onDemandIncludes
 }
 
+// remoteBusyTime is how long a remote refusing a session as busy (low memory or a full disk) gets no new sessions
+const remoteBusyTime = 10 * time.Second
+
+// ExtractRemoteHostWithoutPort returns a host of "host:port", brackets of IPv6 are stripped ("[::1]:43210" is "::1")
 func ExtractRemoteHostWithoutPort(remoteHostPort string) (remoteHost string) {
-	remoteHost = remoteHostPort
-	if idx := strings.Index(remoteHostPort, ":"); idx != -1 {
-		remoteHost = remoteHostPort[:idx]
+	if host, _, err := net.SplitHostPort(remoteHostPort); err == nil {
+		return host
 	}
-	return
+	return strings.TrimSuffix(strings.TrimPrefix(remoteHostPort, "["), "]")
 }
 
 func MakeRemoteConnection(daemon *Daemon, remoteHostPort string, socksProxyAddr string) *RemoteConnection {
 	remote := &RemoteConnection{
-		quitDaemonChan: daemon.quitDaemonChan,
+		quitChan:       make(chan int),
 		socksProxyAddr: socksProxyAddr,
 		remoteHostPort: remoteHostPort,
 		remoteHost:     ExtractRemoteHostWithoutPort(remoteHostPort),
 		clientID:       daemon.clientID,
+		priorityClass:  daemon.priorityClass,
 		chanToUpload:   make(chan fileUploadReq, 50),
 		findInvocation: daemon.FindInvocationBySessionID,
+		objWriters:       daemon.objWriters,
+		sessionLimits:    daemon.sessionLimits,
+		maxObjSize:       daemon.maxObjSize,
+		provenanceChecker: daemon.provenanceChecker,
+		compilerProbes:   make(map[string]*remoteCompilerProbe),
+		uploadsToolchain: daemon.toolchains != nil,
+		systemHeaderDirs: daemon.systemHeaderDirs,
+		snapshotNames:    daemon.snapshotNames,
+		onDemandIncludes: daemon.onDemandIncludes,
 	}
+	remote.cost.Store(int32(daemon.serverCosts[remoteHostPort]))
 
 	return remote
 }
 
 func (remote *RemoteConnection) startFileMonitoring() {
 	go remote.CreateUploadStream()
-	go remote.CreateReceiveStream()
+	if remote.acceptsOnDemandIncludes.Load() {
+		go remote.CreateOnDemandStream()
+	}
+	for streamIndex := range nReceiveStreams {
+		go remote.CreateReceiveStream(streamIndex)
+	}
 }
 
-func StartClientRequest(csc pb.CompilationServiceClient, clientID string) error {
+func StartClientRequest(csc pb.CompilationServiceClient, clientID string, uploadsToolchain bool, systemHeaderDirs []*pb.SystemHeaderDir, snapshotNames []string, onDemandIncludes bool) (*pb.StartClientReply, error) {
 	ctxConnect, cancelFunc := context.WithTimeout(context.Background(), 5000*time.Millisecond)
 	defer cancelFunc()
-	_, err := csc.StartClient(ctxConnect, &pb.StartClientRequest{
-		ClientID:      clientID,
-		ClientVersion: common.GetVersion(),
+	return csc.StartClient(ctxConnect, &pb.StartClientRequest{
+		ClientID:         clientID,
+		ClientVersion:    common.GetVersion(),
+		UploadsToolchain: uploadsToolchain,
+		SystemHeaderDirs: systemHeaderDirs,
+		Snapshots:        snapshotNames,
+		OnDemandIncludes: onDemandIncludes,
 	})
-
-	return err
 }
 
 func (remote *RemoteConnection) OnRemoteBecameUnavailable(reason error) {
@@ -106,14 +167,17 @@ func (remote *RemoteConnection) tryReconnectRemote() {
 	timeout := time.After(10 * time.Millisecond)
 	restarttimeout := time.After(5 * time.Minute)
 
-	remote.receiveStreamContext.TryCancelStreamContext()
+	for _, receiveStreamContext := range remote.receiveStreamContext {
+		receiveStreamContext.TryCancelStreamContext()
+	}
 	remote.uploadStreamContext.TryCancelStreamContext()
+	remote.onDemandStreamContext.TryCancelStreamContext()
 	remote.grpcClient.Clear()
 
 reconnect:
 	for {
 		select {
-		case <-remote.quitDaemonChan:
+		case <-remote.quitChan:
 			return
 		case <-restarttimeout:
 			break reconnect
@@ -127,7 +191,7 @@ reconnect:
 
 	for {
 		select {
-		case <-remote.quitDaemonChan:
+		case <-remote.quitChan:
 			return
 		case <-restarttimeout:
 			restarttimeout = remote.reconnectRemote(true)
@@ -143,6 +207,7 @@ func (remote *RemoteConnection) reconnectRemote(start bool) <-chan time.Time {
 	if err == nil {
 		logClient.Error("Reconnected stream")
 		remote.isUnavailable.Store(false)
+		remote.reprobeCompilers()
 		return nil
 	}
 	logClient.Error("remote", remote.remoteHostPort, "unable to reconnect:", err)
@@ -160,10 +225,24 @@ func (remote *RemoteConnection) SetupConnection(startclient bool) error {
 
 	compilationServiceClient := pb.NewCompilationServiceClient(grpcClient.connection)
 	if startclient {
-		err = StartClientRequest(compilationServiceClient, remote.clientID)
+		reply, err := StartClientRequest(compilationServiceClient, remote.clientID, remote.uploadsToolchain, remote.systemHeaderDirs, remote.snapshotNames, remote.onDemandIncludes != nil)
 		if err != nil {
 			return err
 		}
+		// a restarted server could have other system headers and snapshots
+		remote.acceptedSystemHeaderDirs.Store(&reply.SystemHeaderDirs)
+		if len(reply.SystemHeaderDirs) != len(remote.systemHeaderDirs) {
+			logClient.Info(0, "remote", remote.remoteHost, "has other system headers, they are uploaded; same:", reply.SystemHeaderDirs)
+		}
+		snapshots := makeRemoteSnapshots(reply.Snapshots)
+		remote.snapshots.Store(&snapshots)
+		if len(reply.Snapshots) != len(remote.snapshotNames) {
+			logClient.Error("remote", remote.remoteHost, "doesn't have some of snapshots", remote.snapshotNames)
+		}
+		remote.acceptsOnDemandIncludes.Store(reply.OnDemandIncludes)
+		if remote.onDemandIncludes != nil && !reply.OnDemandIncludes {
+			logClient.Info(0, "remote", remote.remoteHost, "doesn't serve includes on demand, they are uploaded")
+		}
 	}
 
 	remote.grpcClient = grpcClient
@@ -176,56 +255,200 @@ func (remote *RemoteConnection) SetupConnection(startclient bool) error {
 	if err != nil {
 		return err
 	}
+	if connectedAddr := grpcClient.ConnectedAddr(); connectedAddr != "" {
+		logClient.Info(0, "remote", remote.remoteHostPort, "connected over", addrFamily(connectedAddr), connectedAddr)
+	}
 
 	remote.startFileMonitoring()
 	return nil
 }
 
+// StartCachedSession starts a session on a cache server (see server.NoccServer.CacheOnly):
+// it succeeds only if a .o is in its obj cache, then a .o is received from it, and nothing is uploaded anywhere.
+// Otherwise, a session is started on a full server as usual.
+func (remote *RemoteConnection) StartCachedSession(invocation *Invocation, requiredFiles []*pb.FileMetadata, requiredPchFile *pb.FileMetadata) bool {
+	_, err := remote.StartCompilationSession(invocation, requiredFiles, requiredPchFile)
+	if err != nil && status.Code(err) != codes.NotFound {
+		logClient.Error("cache remote", remote.remoteHost, "failed to start session:", err)
+	}
+	return err == nil
+}
+
 // StartCompilationSession starts a session on the remote:
 // one `nocc` Invocation for cpp compilation == one server.Session, by design.
 // As an input, we send metadata about all dependencies needed for a .cpp to be compiled (.h/.nocc-pch/etc.).
 // As an output, the remote responds with files that are missing and needed to be uploaded.
-func (remote *RemoteConnection) StartCompilationSession(invocation *Invocation, requiredFiles []*pb.FileMetadata, requiredPchFile *pb.FileMetadata) ([]uint32, error) {
+func (remote *RemoteConnection) StartCompilationSession(invocation *Invocation, requiredFiles []*pb.FileMetadata, requiredPchFile *pb.FileMetadata) ([]fileToUpload, error) {
 	if remote.isUnavailable.Load() {
 		return nil, fmt.Errorf("remote %s is unavailable", remote.remoteHost)
 	}
 
-	startSessionReply, err := remote.compilationServiceClient.StartCompilationSession(
-		remote.grpcClient.callContext,
-		&pb.StartCompilationSessionRequest{
-			ClientID:             remote.clientID,
-			SessionID:            invocation.sessionID,
-			Compiler:             invocation.compilerName,
-			CompilerArgs:         invocation.compilerArgs,
-			OriginalCompilerArgs: invocation.cmdLine,
-			InputFile:            invocation.cppInFile,
-			RequiredFiles:        requiredFiles,
-			RequiredPchFile:      requiredPchFile,
-		})
+	callContext := remote.grpcClient.callContext
+	if invocation.span != nil {
+		callContext = metadata.AppendToOutgoingContext(callContext, "traceparent", invocation.span.Traceparent())
+	}
 
+	request, sessionFiles := remote.makeSessionRequest(invocation, requiredFiles, requiredPchFile)
+	startSessionReply, err := remote.compilationServiceClient.StartCompilationSession(callContext, request)
 	if err != nil {
 		return nil, err
 	}
 
-	return startSessionReply.FileIndexesToUpload, nil
+	deltaBases := make(map[uint32]*pb.UploadDeltaBase, len(startSessionReply.DeltaBases))
+	for _, deltaBase := range startSessionReply.DeltaBases {
+		deltaBases[deltaBase.FileIndex] = deltaBase
+	}
+
+	filesToUpload := make([]fileToUpload, 0, len(startSessionReply.FileIndexesToUpload))
+	for _, fileIndex := range startSessionReply.FileIndexesToUpload {
+		if fileIndex >= uint32(len(sessionFiles)) {
+			return nil, fmt.Errorf("remote %s requested to upload unknown file index %d", remote.remoteHost, fileIndex)
+		}
+		filesToUpload = append(filesToUpload, fileToUpload{file: sessionFiles[fileIndex], fileIndex: fileIndex, deltaBase: deltaBases[fileIndex]})
+	}
+	return filesToUpload, nil
+}
+
+// fileToUpload is a file requested by a remote on a session start.
+// fileIndex is its index in a session request, not in requiredFiles: some of them are not sent, see omitKnownFiles.
+type fileToUpload struct {
+	file      *pb.FileMetadata
+	fileIndex uint32
+	deltaBase *pb.UploadDeltaBase // a remote has a previous version of a file, see uploadFileDelta
+}
+
+// ProbeObjCache asks the remote whether a .o for an invocation is in its obj cache, without starting a session there.
+// Nothing is uploaded, and the remote keeps no state, so it's cheap to ask several remotes before choosing one.
+func (remote *RemoteConnection) ProbeObjCache(ctxSmallTimeout context.Context, invocation *Invocation, requiredFiles []*pb.FileMetadata, requiredPchFile *pb.FileMetadata) (bool, error) {
+	if remote.isUnavailable.Load() {
+		return false, fmt.Errorf("remote %s is unavailable", remote.remoteHost)
+	}
+
+	request, _ := remote.makeSessionRequest(invocation, requiredFiles, requiredPchFile)
+	reply, err := remote.compilationServiceClient.ProbeObjCache(ctxSmallTimeout, request)
+	if err != nil {
+		return false, err
+	}
+	return reply.Exists, nil
+}
+
+// makeSessionRequest describes an invocation for a server, the same for StartCompilationSession and ProbeObjCache.
+// Files listed in a request are also returned (some of requiredFiles are omitted, see omitKnownFiles).
+func (remote *RemoteConnection) makeSessionRequest(invocation *Invocation, requiredFiles []*pb.FileMetadata, requiredPchFile *pb.FileMetadata) (*pb.StartCompilationSessionRequest, []*pb.FileMetadata) {
+	compilerName := invocation.compilerName
+	if invocation.toolchain != nil {
+		compilerName = invocation.toolchain.compilerPath
+	}
+
+	sideOutputsObjFile := ""
+	if invocation.sideOutputs {
+		sideOutputsObjFile = common.ToServerPath(invocation.objOutFile)
+	}
+
+	sessionFiles, snapshotID := remote.omitKnownFiles(requiredFiles)
+	return &pb.StartCompilationSessionRequest{
+		ClientID:             remote.clientID,
+		SessionID:            invocation.sessionID,
+		Compiler:             compilerName,
+		CompilerArgs:         mapArgsToServerPaths(invocation.compilerArgs),
+		OriginalCompilerArgs: rewriteArgsUnderBaseDir(invocation.baseDir, invocation.cwd, invocation.cmdLine),
+		InputFile:            common.ToServerPath(invocation.cppInFile),
+		RequiredFiles:        mapFilesToServerPaths(sessionFiles),
+		RequiredPchFile:      mapFileToServerPath(requiredPchFile),
+		UserName:             invocation.userName,
+		CompilerVersion:      invocation.localCompiler.version,
+		CompilerTarget:       invocation.localCompiler.target,
+		ModuleOutput:         invocation.bmiOutFile != "",
+		SideOutputsObjFile:   sideOutputsObjFile,
+		Cwd:                  common.ToServerPath(invocation.cwd),
+		PriorityClass:        remote.priorityClass,
+		CacheNamespace:       invocation.project.GetCacheNamespace(),
+		Priority:             int32(invocation.policy.Priority),
+		NoObjCache:           invocation.policy.NoObjCache,
+		DiagnosticsColor:     invocation.diagnosticsColor,
+		CompilerEnv:          invocation.remoteCompilerEnv(),
+		InputFileRelative:    invocation.cppInFileRel,
+		SnapshotID:           snapshotID,
+		AcceptsDeltaUploads:  true,
+		OnDemandDirs:         mapArgsToServerPaths(invocation.onDemandDirs),
+	}, sessionFiles
 }
 
-func (remote *RemoteConnection) StartUploadingFileToRemote(invocation *Invocation, file *pb.FileMetadata, fileIndex uint32) {
+// omitKnownFiles returns files to be sent to a remote: without ones it has for sure,
+// from system header dirs it accepted (see calcSystemHeaderDirs) and equal to a snapshot (see remoteSnapshot).
+// A snapshot id is also returned, empty if none is referenced.
+func (remote *RemoteConnection) omitKnownFiles(requiredFiles []*pb.FileMetadata) ([]*pb.FileMetadata, string) {
+	snapshot := remote.chooseSnapshot(requiredFiles)
+	sessionFiles := make([]*pb.FileMetadata, 0, len(requiredFiles))
+	for _, file := range requiredFiles {
+		if !remote.isInAcceptedSystemHeaderDirs(file.FileName) && (snapshot == nil || !snapshot.contains(file)) {
+			sessionFiles = append(sessionFiles, file)
+		}
+	}
+
+	if snapshot == nil {
+		return sessionFiles, ""
+	}
+	return sessionFiles, snapshot.id
+}
+
+// mapArgsToServerPaths and mapFilesToServerPaths make a request from a Windows client understandable by a server,
+// see common.ToServerPath. Files are copied, since their local names are used for uploading.
+func mapArgsToServerPaths(compilerArgs []string) []string {
+	if filepath.Separator == '/' {
+		return compilerArgs
+	}
+	mapped := make([]string, len(compilerArgs))
+	for i, arg := range compilerArgs {
+		mapped[i] = common.ToServerPath(arg)
+	}
+	return mapped
+}
+
+func mapFilesToServerPaths(requiredFiles []*pb.FileMetadata) []*pb.FileMetadata {
+	if filepath.Separator == '/' {
+		return requiredFiles
+	}
+	mapped := make([]*pb.FileMetadata, len(requiredFiles))
+	for i, file := range requiredFiles {
+		mapped[i] = mapFileToServerPath(file)
+	}
+	return mapped
+}
+
+func mapFileToServerPath(file *pb.FileMetadata) *pb.FileMetadata {
+	if filepath.Separator == '/' || file == nil {
+		return file
+	}
+	return &pb.FileMetadata{
+		FileName:      common.ToServerPath(file.FileName),
+		IsSymlink:     file.IsSymlink,
+		SymlinkTarget: common.ToServerPath(file.SymlinkTarget),
+		FileSize:      file.FileSize,
+		SHA256_B0_7:   file.SHA256_B0_7,
+		SHA256_B8_15:  file.SHA256_B8_15,
+		SHA256_B16_23: file.SHA256_B16_23,
+		SHA256_B24_31: file.SHA256_B24_31,
+	}
+}
+
+func (remote *RemoteConnection) StartUploadingFileToRemote(invocation *Invocation, toUpload fileToUpload) {
 	remote.chanToUpload <- fileUploadReq{
 		clientID:   remote.clientID,
 		invocation: invocation,
-		file:       file,
-		fileIndex:  fileIndex,
+		file:       toUpload.file,
+		fileIndex:  toUpload.fileIndex,
+		deltaBase:  toUpload.deltaBase,
 	}
 }
 
 // UploadFilesToRemote uploads files to the remote in parallel and finishes after all of them are done.
-func (remote *RemoteConnection) UploadFilesToRemote(invocation *Invocation, requiredFiles []*pb.FileMetadata, fileIndexesToUpload []uint32) error {
-	invocation.waitUploads.Store(int32(len(fileIndexesToUpload)))
+func (remote *RemoteConnection) UploadFilesToRemote(invocation *Invocation, filesToUpload []fileToUpload) error {
+	invocation.waitUploads.Store(int32(len(filesToUpload)))
 	invocation.wgUpload.Add(int(invocation.waitUploads.Load()))
 
-	for _, fileIndex := range fileIndexesToUpload {
-		remote.StartUploadingFileToRemote(invocation, requiredFiles[fileIndex], fileIndex)
+	for _, toUpload := range filesToUpload {
+		remote.StartUploadingFileToRemote(invocation, toUpload)
 	}
 
 	invocation.wgUpload.Wait()
@@ -233,11 +456,59 @@ func (remote *RemoteConnection) UploadFilesToRemote(invocation *Invocation, requ
 }
 
 func (remote *RemoteConnection) KeepAlive(ctxSmallTimeout context.Context) error {
-	_, err := remote.compilationServiceClient.KeepAlive(ctxSmallTimeout, &pb.KeepAliveRequest{
+	reply, err := remote.compilationServiceClient.KeepAlive(ctxSmallTimeout, &pb.KeepAliveRequest{
 		ClientID: remote.clientID,
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	remote.compilerQueueSize.Store(reply.CompilerQueueSize)
+	remote.cacheOnly.Store(reply.CacheOnly)
+	remote.reportsCompilingSessions.Store(reply.ReportsCompilingSessions)
+	remote.acceptsUploadBatches.Store(reply.AcceptsUploadBatches)
+	for _, sessionID := range reply.CompilingSessionIDs {
+		if invocation := remote.findInvocation(sessionID); invocation != nil {
+			invocation.onObjWaitProgress()
+		}
+	}
+	if remote.cacheDegraded.Swap(reply.CacheDegraded) != reply.CacheDegraded {
+		if reply.CacheDegraded {
+			logClient.Error("remote", remote.remoteHost, "is degraded: it fails to save to its caches, see its log")
+		} else {
+			logClient.Info(0, "remote", remote.remoteHost, "caches recovered")
+		}
+	}
+	return nil
+}
+
+// IsSaturated is true if a remote is already busy with as many sessions as it can compile in parallel (or MaxSessionsPerRemote allows).
+// An older nocc-server doesn't advertise its capacity, then it's never considered saturated.
+func (remote *RemoteConnection) IsSaturated() bool {
+	compilerQueueSize := remote.compilerQueueSize.Load()
+	nActiveSessions := remote.nActiveSessions.Load()
+	return (compilerQueueSize > 0 && nActiveSessions >= compilerQueueSize) || remote.sessionLimits.isRemoteFull(nActiveSessions) ||
+		time.Now().UnixNano() < remote.busyUntil.Load()
+}
+
+// OnRemoteBusy is called when a server refused a session being short of memory or disk space (see server.AdaptiveCapacity, server.DiskWatchdog):
+// it's considered saturated for remoteBusyTime, so that new sessions go to other remotes meanwhile
+func (remote *RemoteConnection) OnRemoteBusy() {
+	if time.Now().UnixNano() >= remote.busyUntil.Swap(time.Now().Add(remoteBusyTime).UnixNano()) {
+		logClient.Info(0, "remote", remote.remoteHost, "is busy, not sending new sessions for", remoteBusyTime)
+	}
+}
+
+// isRemoteBusyError tells whether StartCompilationSession was refused as busy (by AdaptiveCapacity or DiskWatchdog of a server).
+// Only the code is not enough: grpc also returns ResourceExhausted for a too large message.
+func isRemoteBusyError(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted && strings.HasPrefix(status.Convert(err).Message(), "server is busy")
+}
+
+// loadRatio is active sessions to a capacity a remote advertises, for choosing the least loaded one, see sortByLoad
+func (remote *RemoteConnection) loadRatio() float64 {
+	compilerQueueSize := max(1, remote.compilerQueueSize.Load())
+	return float64(remote.nActiveSessions.Load()) / float64(compilerQueueSize)
 }
 
 func (remote *RemoteConnection) VerifyAlive() {
@@ -250,7 +521,9 @@ func (remote *RemoteConnection) VerifyAlive() {
 	if err != nil {
 		logClient.Error("keep alive failed")
 		remote.OnRemoteBecameUnavailable(err)
+		return
 	}
+	remote.logTransferIfChanged()
 }
 
 func (remote *RemoteConnection) SendInterruptSessionRequest(sessionID uint32) error {
@@ -270,17 +543,35 @@ func (remote *RemoteConnection) SendInterruptSessionRequest(sessionID uint32) er
 	return nil
 }
 
-func (remote *RemoteConnection) SendStopClient(ctxSmallTimeout context.Context) {
+func (remote *RemoteConnection) SendStopClient(ctxSmallTimeout context.Context, keepWorkingDir bool) {
 	if remote.isUnavailable.Load() {
 		return
 	}
 	_, _ = remote.compilationServiceClient.StopClient(
 		ctxSmallTimeout,
 		&pb.StopClientRequest{
-			ClientID: remote.clientID,
+			ClientID:       remote.clientID,
+			KeepWorkingDir: keepWorkingDir,
 		})
 }
 
+// Close stops all streams and goroutines of a remote, after which a server forgets this client.
+// With keepWorkingDir, a server keeps uploaded files for a while (see server.ClientRetention) to reuse them on restart.
+func (remote *RemoteConnection) Close(ctxSmallTimeout context.Context, keepWorkingDir bool) {
+	close(remote.quitChan)
+	remote.SendStopClient(ctxSmallTimeout, keepWorkingDir)
+	remote.Clear()
+}
+
+// waitUntilIdle is called for a remote removed from config on reload: it's not chosen for new invocations anymore,
+// but active ones are let to finish (or reach a timeout), see Daemon.closeRemoteWhenIdle
+func (remote *RemoteConnection) waitUntilIdle(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for remote.nActiveSessions.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func (remote *RemoteConnection) Clear() {
 	remote.compilationServiceClient = nil
 	if remote.grpcClient != nil {
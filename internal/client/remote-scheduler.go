@@ -0,0 +1,33 @@
+package client
+
+import (
+	"sort"
+)
+
+// RemoteScheduler is a hook deciding which remote compiles a .cpp.
+// It receives remotes that are able to compile it (e.g. support its -std=), ordered by .cpp basename hash:
+// the first one is "natural", sending a .cpp to the same remote every time keeps obj cache hot.
+// Every remote carries metadata from the config (see RemoteConnection.cost) and live state (IsSaturated).
+// Implementations are CostAwareScheduler and CentralScheduler (with SchedulerAddr).
+type RemoteScheduler interface {
+	ChooseRemote(invocation *Invocation, candidates []*RemoteConnection) *RemoteConnection
+}
+
+// CostAwareScheduler prefers cheap remotes (e.g. on-prem servers) and spills to more expensive ones (e.g. cloud burst nodes)
+// only under queue pressure, when all cheaper ones are saturated.
+// If all costs are equal (nothing is set in the config), it's just "the natural remote unless it's saturated".
+type CostAwareScheduler struct{}
+
+func (CostAwareScheduler) ChooseRemote(_ *Invocation, candidates []*RemoteConnection) *RemoteConnection {
+	byCost := make([]*RemoteConnection, len(candidates))
+	copy(byCost, candidates)
+	sort.SliceStable(byCost, func(i, j int) bool { return byCost[i].cost.Load() < byCost[j].cost.Load() })
+
+	for _, remote := range byCost {
+		if !remote.IsSaturated() {
+			return remote
+		}
+	}
+	// all are saturated: stay with the cheapest natural one, it will queue a session
+	return byCost[0]
+}
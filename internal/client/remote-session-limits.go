@@ -0,0 +1,122 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RemoteSessionLimits caps sessions a daemon runs on remotes at the same moment:
+// MaxSessionsPerRemote on every remote and MaxRemoteSessions on all of them.
+// Without limits, `make -j500` opens 500 sessions on a small server, and a daemon holds files and streams of all of them.
+// A session over a limit waits in a daemon for a slot (a remote over its limit is saturated, see IsSaturated,
+// so another one with free slots is chosen first); if waiting lasts longer than InvocationTimeout, a file is compiled locally.
+// It's nil if neither is set.
+type RemoteSessionLimits struct {
+	perRemote int
+	total     chan struct{} // nil if MaxRemoteSessions is not set
+
+	mu       sync.Mutex
+	byRemote map[string]chan struct{} // by remoteHostPort, empty if MaxSessionsPerRemote is not set
+
+	nWaited   atomic.Int64 // sessions that didn't get a slot immediately, for `nocc --stats`
+	waitNanos atomic.Int64
+}
+
+func MakeRemoteSessionLimits(maxSessionsPerRemote int, maxRemoteSessions int) *RemoteSessionLimits {
+	if maxSessionsPerRemote <= 0 && maxRemoteSessions <= 0 {
+		return nil
+	}
+	limits := &RemoteSessionLimits{
+		perRemote: max(0, maxSessionsPerRemote),
+		byRemote:  make(map[string]chan struct{}),
+	}
+	if maxRemoteSessions > 0 {
+		limits.total = make(chan struct{}, maxRemoteSessions)
+	}
+	return limits
+}
+
+// isRemoteFull tells whether a remote has no free slots, then it's saturated for a RemoteScheduler
+func (limits *RemoteSessionLimits) isRemoteFull(nActiveSessions int32) bool {
+	return limits != nil && limits.perRemote > 0 && int(nActiveSessions) >= limits.perRemote
+}
+
+func (limits *RemoteSessionLimits) remoteSlots(remoteHostPort string) chan struct{} {
+	if limits.perRemote == 0 {
+		return nil
+	}
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	slots := limits.byRemote[remoteHostPort]
+	if slots == nil {
+		slots = make(chan struct{}, limits.perRemote)
+		limits.byRemote[remoteHostPort] = slots
+	}
+	return slots
+}
+
+// Acquire takes a slot of a remote, then a total one (not to hold a total slot while waiting for a busy remote).
+// An error means no slot is held: waiting exceeded timeout, an invocation was interrupted, or a daemon quits.
+func (limits *RemoteSessionLimits) Acquire(remote *RemoteConnection, invocation *Invocation, timeout time.Duration, quitChan chan int) error {
+	if limits == nil {
+		return nil
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	remoteSlots := limits.remoteSlots(remote.remoteHostPort)
+	waited := false
+	for _, slots := range []chan struct{}{remoteSlots, limits.total} {
+		if slots == nil {
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+			continue
+		default:
+		}
+
+		if !waited {
+			waited = true
+			logClient.Info(1, "waiting for a session slot of", remote.remoteHost, invocation.cppInFile)
+		}
+		var err error
+		select {
+		case slots <- struct{}{}:
+		case <-timer.C:
+			err = fmt.Errorf("no free session slot for %s in %d sec", remote.remoteHost, int(timeout.Seconds()))
+		case <-invocation.interruptChan:
+			err = fmt.Errorf("interrupted while waiting for a session slot")
+		case <-quitChan:
+			err = fmt.Errorf("daemon quit while waiting for a session slot")
+		}
+		if err != nil {
+			if slots == limits.total && remoteSlots != nil {
+				<-remoteSlots
+			}
+			return err
+		}
+	}
+
+	if waited {
+		limits.nWaited.Add(1)
+		limits.waitNanos.Add(int64(time.Since(start)))
+	}
+	return nil
+}
+
+func (limits *RemoteSessionLimits) Release(remote *RemoteConnection) {
+	if limits == nil {
+		return
+	}
+	if limits.total != nil {
+		<-limits.total
+	}
+	if remoteSlots := limits.remoteSlots(remote.remoteHostPort); remoteSlots != nil {
+		<-remoteSlots
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// remoteTransferCounters are cumulative network counters of one RemoteConnection since a daemon start.
+// Unlike InvocationSummary, they also include uploads of failed sessions, so they reflect real traffic
+// and help to plan network capacity of a build farm. They are logged on keepalive, see logTransferIfChanged.
+type remoteTransferCounters struct {
+	nFilesUploaded atomic.Int64
+	nBytesUploaded atomic.Int64
+	nObjReceived   atomic.Int64
+	nBytesReceived atomic.Int64
+
+	// a snapshot at the previous log line, to output rates; accessed only from logTransferIfChanged
+	lastLogTime          time.Time
+	lastBytesUploaded    int64
+	lastBytesReceived    int64
+	lastFilesAndObjCount int64
+}
+
+func (counters *remoteTransferCounters) onFileUploaded(fileSize int64) {
+	counters.nFilesUploaded.Add(1)
+	counters.nBytesUploaded.Add(fileSize)
+}
+
+func (counters *remoteTransferCounters) onObjReceived(fileSize int64) {
+	counters.nObjReceived.Add(1)
+	counters.nBytesReceived.Add(fileSize)
+}
+
+// logTransferIfChanged outputs totals and rates since the previous call (if anything was transferred since then)
+func (remote *RemoteConnection) logTransferIfChanged() {
+	counters := &remote.transfer
+	now := time.Now()
+	nFilesUploaded := counters.nFilesUploaded.Load()
+	nBytesUploaded := counters.nBytesUploaded.Load()
+	nObjReceived := counters.nObjReceived.Load()
+	nBytesReceived := counters.nBytesReceived.Load()
+
+	if nFilesUploaded+nObjReceived == counters.lastFilesAndObjCount {
+		return
+	}
+
+	elapsedSec := now.Sub(counters.lastLogTime).Seconds()
+	if counters.lastLogTime.IsZero() || elapsedSec <= 0 {
+		elapsedSec = 1
+	}
+	uploadKBs := float64(nBytesUploaded-counters.lastBytesUploaded) / 1024 / elapsedSec
+	receiveKBs := float64(nBytesReceived-counters.lastBytesReceived) / 1024 / elapsedSec
+
+	logClient.Info(1, "transfer", remote.remoteHost,
+		"uploaded", nFilesUploaded, "files", nBytesUploaded, "bytes", fmtKBs(uploadKBs),
+		"; received", nObjReceived, "obj", nBytesReceived, "bytes", fmtKBs(receiveKBs))
+
+	counters.lastLogTime = now
+	counters.lastBytesUploaded = nBytesUploaded
+	counters.lastBytesReceived = nBytesReceived
+	counters.lastFilesAndObjCount = nFilesUploaded + nObjReceived
+}
+
+func fmtKBs(kbs float64) string {
+	return fmt.Sprintf("(%.1f KB/s)", kbs)
+}
@@ -0,0 +1,385 @@
+package client
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// ReproRecorder saves a "repro bundle" when a .cpp fails to compile remotely, but compiles locally:
+// such failures are bugs (of nocc or of a server environment), and they are hard to reproduce later.
+// A bundle is {ReproDir}/{id}.tar.gz with session.json (a session request, as a server received it, and what it answered)
+// and all uploaded files under files/ (by their client paths), so it can be attached to a bug report.
+// `nocc --repro {id}` replays a bundle on a server: the same session is started, files are uploaded from the bundle.
+type ReproRecorder struct {
+	dir string
+}
+
+type reproSession struct {
+	ID              string
+	Time            time.Time
+	ClientVersion   string
+	Remote          string
+	Compiler        string // as sent to a server (a path inside a toolchain if UploadToolchain)
+	CompilerVersion string
+	CompilerTarget  string
+	Cwd             string
+	CmdLine         []string
+	CompilerArgs    []string
+	InputFile       string
+	InputFileRel    bool
+	Files           []reproFile // in order of a session request
+	RemoteExitCode  int
+	RemoteSignal    int `json:",omitempty"` // a remote compiler was killed by it, like an OOM kill
+	RemoteStdout    string
+	RemoteStderr    string
+	RemoteError     string `json:",omitempty"`
+}
+
+type reproFile struct {
+	FileName      string
+	SymlinkTarget string `json:",omitempty"`
+	FileSize      int64
+	SHA256        string
+	IsPch         bool `json:",omitempty"`
+}
+
+func MakeReproRecorder(dir string) (*ReproRecorder, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &ReproRecorder{dir: dir}, nil
+}
+
+// Record is called after a local fallback succeeded; remoteErr is nil if a remote compiler exited with non-zero code.
+// Nothing is saved if a session wasn't started (e.g. failed to collect includes).
+func (recorder *ReproRecorder) Record(invocation *Invocation, remoteErr error) {
+	if recorder == nil || invocation.requiredFiles == nil {
+		return
+	}
+
+	compilerName := invocation.compilerName
+	if invocation.toolchain != nil {
+		compilerName = invocation.toolchain.compilerPath
+	}
+	session := &reproSession{
+		ID:              fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), invocation.sessionID),
+		Time:            time.Now(),
+		ClientVersion:   common.GetVersion(),
+		Remote:          invocation.summary.remoteHost,
+		Compiler:        compilerName,
+		CompilerVersion: invocation.localCompiler.version,
+		CompilerTarget:  invocation.localCompiler.target,
+		Cwd:             invocation.cwd,
+		CmdLine:         invocation.cmdLine,
+		CompilerArgs:    invocation.compilerArgs,
+		InputFile:       invocation.cppInFile,
+		InputFileRel:    invocation.cppInFileRel,
+		RemoteExitCode:  invocation.compilerExitCode,
+		RemoteSignal:    invocation.compilerSignal,
+		RemoteStdout:    string(invocation.compilerStdout),
+		RemoteStderr:    string(invocation.compilerStderr),
+	}
+	if remoteErr != nil {
+		session.RemoteError = remoteErr.Error()
+	}
+	for _, file := range invocation.requiredFiles {
+		sha256 := common.SHA256{B0_7: file.SHA256_B0_7, B8_15: file.SHA256_B8_15, B16_23: file.SHA256_B16_23, B24_31: file.SHA256_B24_31}
+		session.Files = append(session.Files, reproFile{
+			FileName:      file.FileName,
+			SymlinkTarget: file.SymlinkTarget,
+			FileSize:      file.FileSize,
+			SHA256:        sha256.ToLongHexString(),
+			IsPch:         file == invocation.requiredPchFile,
+		})
+	}
+
+	bundleFileName := filepath.Join(recorder.dir, session.ID+".tar.gz")
+	if err := writeReproBundle(bundleFileName, session); err != nil {
+		logClient.Error("failed to save repro bundle:", err)
+		_ = os.Remove(bundleFileName)
+		return
+	}
+	logClient.Info(0, "saved repro bundle", bundleFileName, "; replay it with `nocc --repro", session.ID+"`")
+}
+
+func writeReproBundle(bundleFileName string, session *reproSession) error {
+	f, err := os.Create(bundleFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzipWriter := gzip.NewWriter(f)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	sessionJSON, _ := json.MarshalIndent(session, "", "  ")
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "session.json", Mode: 0644, Size: int64(len(sessionJSON)), ModTime: session.Time}); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(sessionJSON); err != nil {
+		return err
+	}
+
+	for _, file := range session.Files {
+		if file.SymlinkTarget != "" {
+			continue // it's described in session.json, a server creates it itself
+		}
+		if err := writeReproBundleFile(tarWriter, file.FileName); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func writeReproBundleFile(tarWriter *tar.Writer, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// a file could have been modified after a session; then its sha256 in session.json differs, and a replay fails
+	if err := tarWriter.WriteHeader(&tar.Header{Name: reproBundlePath(fileName), Mode: 0644, Size: stat.Size(), ModTime: stat.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWriter, f)
+	return err
+}
+
+// reproBundlePath is a name inside a bundle for a client file
+func reproBundlePath(fileName string) string {
+	return "files/" + strings.TrimPrefix(filepath.ToSlash(fileName), "/")
+}
+
+// reproCommandOutput handles `nocc --repro` (list saved bundles) and `nocc --repro {id or .tar.gz} [{host:port}]` (replay).
+// A bundle is replayed on a server it was recorded on, unless another one is given (it may be absent in Servers, e.g. a test one).
+func (daemon *Daemon) reproCommandOutput(req DaemonSockRequest) (string, error) {
+	args := req.CmdLine[1:]
+	if len(args) == 0 {
+		return daemon.reproRecorder.listBundles()
+	}
+
+	bundleFileName := args[0]
+	if !strings.HasSuffix(bundleFileName, ".tar.gz") {
+		if daemon.reproRecorder == nil {
+			return "", fmt.Errorf("ReproDir is not set, pass a path to .tar.gz")
+		}
+		bundleFileName = filepath.Join(daemon.reproRecorder.dir, bundleFileName+".tar.gz")
+	} else {
+		bundleFileName = common.PathAbs(req.Cwd, bundleFileName)
+	}
+	remoteHostPort := ""
+	if len(args) > 1 {
+		remoteHostPort = args[1]
+	}
+	return daemon.replayReproBundle(req, bundleFileName, remoteHostPort)
+}
+
+func (recorder *ReproRecorder) listBundles() (string, error) {
+	if recorder == nil {
+		return "", fmt.Errorf("ReproDir is not set, no repro bundles are saved")
+	}
+	matches, err := filepath.Glob(filepath.Join(recorder.dir, "*.tar.gz"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(matches)
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%d repro bundles in %s\n", len(matches), recorder.dir)
+	for _, bundleFileName := range matches {
+		fmt.Fprintf(&b, "  %s\n", strings.TrimSuffix(filepath.Base(bundleFileName), ".tar.gz"))
+	}
+	return b.String(), nil
+}
+
+func (daemon *Daemon) replayReproBundle(req DaemonSockRequest, bundleFileName string, remoteHostPort string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "nocc-repro-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	session, err := extractReproBundle(bundleFileName, tmpDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract %s: %v", bundleFileName, err)
+	}
+
+	remote, err := daemon.findReplayRemote(session.Remote, remoteHostPort)
+	if err != nil {
+		return "", err
+	}
+
+	invocation := CreateInvocation(DaemonSockRequest{
+		SessionId: daemon.totalInvocations.Add(1),
+		Uid:       req.Uid,
+		Gid:       req.Gid,
+		UserName:  req.UserName,
+		Cwd:       session.Cwd,
+		Compiler:  session.Compiler,
+	})
+	invocation.invokeType = invokedForCompilingCpp
+	invocation.cmdLine = session.CmdLine
+	invocation.compilerArgs = session.CompilerArgs
+	invocation.cppInFile = session.InputFile
+	invocation.cppInFileRel = session.InputFileRel
+	invocation.objOutFile = filepath.Join(tmpDir, "replay.o")
+	invocation.localCompiler = &localCompilerProbe{version: session.CompilerVersion, target: session.CompilerTarget}
+	invocation.replayRoot = tmpDir
+	invocation.summary.remoteHost = remote.remoteHost
+
+	requiredFiles := make([]*pb.FileMetadata, 0, len(session.Files))
+	var requiredPchFile *pb.FileMetadata
+	for _, file := range session.Files {
+		sha256 := common.SHA256{}
+		sha256.FromLongHexString(file.SHA256)
+		requiredFiles = append(requiredFiles, &pb.FileMetadata{
+			FileName:      file.FileName,
+			IsSymlink:     file.SymlinkTarget != "",
+			SymlinkTarget: file.SymlinkTarget,
+			FileSize:      file.FileSize,
+			SHA256_B0_7:   sha256.B0_7,
+			SHA256_B8_15:  sha256.B8_15,
+			SHA256_B16_23: sha256.B16_23,
+			SHA256_B24_31: sha256.B24_31,
+		})
+		if file.IsPch {
+			requiredPchFile = requiredFiles[len(requiredFiles)-1]
+		}
+	}
+
+	daemon.mu.Lock()
+	daemon.activeInvocations[invocation.sessionID] = invocation
+	daemon.mu.Unlock()
+	defer func() {
+		daemon.mu.Lock()
+		delete(daemon.activeInvocations, invocation.sessionID)
+		daemon.mu.Unlock()
+	}()
+
+	invocation.wgRecv.Add(1)
+	filesToUpload, err := remote.StartCompilationSession(invocation, requiredFiles, requiredPchFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to start a session on %s: %v", remote.remoteHost, err)
+	}
+	if err := remote.UploadFilesToRemote(invocation, filesToUpload); err != nil {
+		return "", fmt.Errorf("failed to upload files to %s: %v", remote.remoteHost, err)
+	}
+	invocation.waitForCompilation(remote)
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "replayed %s (%s) on %s: uploaded %d of %d files\n", session.ID, session.InputFile, remote.remoteHost, len(filesToUpload), len(requiredFiles))
+	if invocation.err != nil {
+		fmt.Fprintf(&b, "error: %v\n", invocation.err)
+	}
+	fmt.Fprintf(&b, "exit code: %d (recorded %d)\n", invocation.compilerExitCode, session.RemoteExitCode)
+	if invocation.compilerSignal != 0 || session.RemoteSignal != 0 {
+		fmt.Fprintf(&b, "killed by signal: %d (recorded %d)\n", invocation.compilerSignal, session.RemoteSignal)
+	}
+	if len(invocation.compilerStderr) > 0 {
+		fmt.Fprintf(&b, "stderr:\n%s\n", strings.TrimSpace(string(invocation.compilerStderr)))
+	}
+	if session.RemoteError != "" {
+		fmt.Fprintf(&b, "recorded error: %s\n", session.RemoteError)
+	}
+	return b.String(), nil
+}
+
+// findReplayRemote returns a remote from Servers, or connects to another one (it's closed after a replay)
+func (daemon *Daemon) findReplayRemote(recordedRemoteHost string, remoteHostPort string) (*RemoteConnection, error) {
+	for _, remote := range daemon.getRemoteConnections() {
+		if remote.remoteHostPort == remoteHostPort || (remoteHostPort == "" && remote.remoteHost == recordedRemoteHost) {
+			if remote.isUnavailable.Load() {
+				return nil, fmt.Errorf("remote %s is unavailable", remote.remoteHost)
+			}
+			return remote, nil
+		}
+	}
+	if remoteHostPort == "" {
+		return nil, fmt.Errorf("remote %s is not in Servers anymore, pass host:port to replay on", recordedRemoteHost)
+	}
+
+	daemon.remotesUpdateMu.Lock() // MakeRemoteConnection reads serverCosts, replaced on reload
+	remote := MakeRemoteConnection(daemon, remoteHostPort, daemon.socksProxyAddr)
+	daemon.remotesUpdateMu.Unlock()
+	if err := remote.SetupConnection(true); err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", remoteHostPort, err)
+	}
+	go daemon.closeRemoteWhenIdle(remote)
+	return remote, nil
+}
+
+// extractReproBundle writes files of a bundle to dir (under files/) and returns its session.json
+func extractReproBundle(bundleFileName string, dir string) (*reproSession, error) {
+	f, err := os.Open(bundleFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	var session *reproSession
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Name == "session.json" {
+			session = &reproSession{}
+			if err := json.NewDecoder(tarReader).Decode(session); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fileName := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(fileName, filepath.Join(dir, "files")+string(filepath.Separator)) {
+			return nil, fmt.Errorf("unexpected file %s", header.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+			return nil, err
+		}
+		out, err := os.Create(fileName)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(out, tarReader)
+		_ = out.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if session == nil {
+		return nil, fmt.Errorf("no session.json")
+	}
+	return session, nil
+}
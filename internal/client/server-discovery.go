@@ -0,0 +1,209 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nocc/internal/common"
+)
+
+// ServerDiscovery resolves entries of Servers that are not "host:port", but sources of servers:
+// "srv:{name}" is a DNS SRV record (like "srv:_nocc._tcp.example.com"), "file:{path}" is a file with "host:port" per line,
+// "mdns:" or "mdns:{service}" are servers announcing themselves on a LAN (see server.MDNSAnnouncer), no DNS needed.
+// So an autoscaled fleet registers/deregisters servers without editing daemon.conf of every agent:
+// a daemon re-resolves sources every DiscoveryInterval and connects to added servers / drains removed ones.
+// If a source fails to resolve (DNS is down, a file is being rewritten), servers it resolved to last time are kept.
+// It's nil if Servers has no sources, then servers are exactly as listed.
+type ServerDiscovery struct {
+	mu       sync.Mutex
+	entries  []string            // Servers as in config: "host:port" and sources, in their order
+	resolved map[string][]string // by source, the last successful result
+	last     []string            // the last result of Resolve
+}
+
+const (
+	discoverySrvPrefix  = "srv:"
+	discoveryFilePrefix = "file:"
+	discoveryMDNSPrefix = "mdns:"
+)
+
+// mdnsBrowseTime is how long a daemon collects mDNS responses: servers on a LAN answer within milliseconds
+const mdnsBrowseTime = time.Second
+
+func isDiscoverySource(entry string) bool {
+	return strings.HasPrefix(entry, discoverySrvPrefix) || strings.HasPrefix(entry, discoveryFilePrefix) || strings.HasPrefix(entry, discoveryMDNSPrefix)
+}
+
+func MakeServerDiscovery(servers []string) *ServerDiscovery {
+	if !slices.ContainsFunc(servers, isDiscoverySource) {
+		return nil
+	}
+	return &ServerDiscovery{
+		entries:  servers,
+		resolved: make(map[string][]string),
+	}
+}
+
+// Resolve returns "host:port" of all servers: static ones as listed, and sources expanded in place (sorted, without duplicates).
+func (discovery *ServerDiscovery) Resolve() []string {
+	discovery.mu.Lock()
+	defer discovery.mu.Unlock()
+
+	result := make([]string, 0, len(discovery.entries))
+	for _, entry := range discovery.entries {
+		if !isDiscoverySource(entry) {
+			result = append(result, entry)
+			continue
+		}
+		resolved, err := resolveDiscoverySource(entry)
+		if err != nil {
+			logClient.Error("failed to discover servers from", entry, "keeping", len(discovery.resolved[entry]), "previous:", err)
+			resolved = discovery.resolved[entry]
+		} else {
+			discovery.resolved[entry] = resolved
+		}
+		result = append(result, resolved...)
+	}
+
+	// a server listed statically and also discovered is connected to once
+	unique := make([]string, 0, len(result))
+	for _, remoteHostPort := range result {
+		if !slices.Contains(unique, remoteHostPort) {
+			unique = append(unique, remoteHostPort)
+		}
+	}
+	discovery.last = unique
+	return unique
+}
+
+// refresh resolves servers again and tells whether they differ from the previous Resolve
+func (discovery *ServerDiscovery) refresh() ([]string, bool) {
+	discovery.mu.Lock()
+	last := discovery.last
+	discovery.mu.Unlock()
+
+	servers := discovery.Resolve()
+	return servers, !slices.Equal(servers, last)
+}
+
+// resolveServers returns Servers from config with sources expanded, see ServerDiscovery
+func resolveServers(discovery *ServerDiscovery, servers []string) []string {
+	if discovery == nil {
+		return servers
+	}
+	return discovery.Resolve()
+}
+
+func resolveDiscoverySource(entry string) ([]string, error) {
+	var servers []string
+	var err error
+	if name, ok := strings.CutPrefix(entry, discoverySrvPrefix); ok {
+		servers, err = lookupSrvServers(name)
+	} else if service, ok := strings.CutPrefix(entry, discoveryMDNSPrefix); ok {
+		servers, err = browseMDNSServers(service)
+	} else {
+		servers, err = readServersFile(strings.TrimPrefix(entry, discoveryFilePrefix))
+	}
+	if err != nil {
+		return nil, err
+	}
+	// sorted, so that a .cpp goes to the same remote while membership doesn't change (DNS shuffles records)
+	sort.Strings(servers)
+	return slices.Compact(servers), nil
+}
+
+func lookupSrvServers(name string) ([]string, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]string, 0, len(records))
+	for _, record := range records {
+		servers = append(servers, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+	return servers, nil
+}
+
+// browseMDNSServers sends an mDNS query from an ephemeral port (a "legacy" querier, answered directly, not to a group),
+// so it works without binding 5353, which is usually taken by avahi; an empty service means common.DefaultMDNSService
+func browseMDNSServers(service string) ([]string, error) {
+	if service == "" {
+		service = common.DefaultMDNSService
+	}
+	query, err := common.MakeMDNSQuery(service)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err = conn.WriteToUDP(query, common.MDNSGroupAddr); err != nil {
+		return nil, err
+	}
+
+	servers := make([]string, 0)
+	_ = conn.SetReadDeadline(time.Now().Add(mdnsBrowseTime))
+	packet := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(packet)
+		if err != nil { // a deadline, responses are over
+			break
+		}
+		servers = append(servers, common.ParseMDNSServers(packet[:n], service)...)
+	}
+	return servers, nil
+}
+
+// readServersFile reads "host:port" per line, empty lines and lines starting with # are skipped
+func readServersFile(fileName string) ([]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	servers := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for nLine := 1; scanner.Scan(); nLine++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, nLine, err)
+		}
+		servers = append(servers, line)
+	}
+	return servers, scanner.Err()
+}
+
+// PeriodicallyRefreshServers re-resolves sources of Servers every DiscoveryInterval until a daemon quits,
+// and updates remotes if servers changed. Servers added or drained by commands (see addServerCommandOutput) are reset then.
+func (daemon *Daemon) PeriodicallyRefreshServers(discoveryInterval time.Duration) {
+	for {
+		select {
+		case <-daemon.quitDaemonChan:
+			return
+		case <-time.After(discoveryInterval):
+		}
+
+		discovery := daemon.serverDiscovery.Load()
+		if discovery == nil {
+			continue
+		}
+		if servers, changed := discovery.refresh(); changed {
+			logClient.Info(0, "discovered servers changed:", strings.Join(servers, ";"))
+			_ = daemon.updateRemoteServers(func([]string) ([]string, error) { return servers, nil })
+		}
+	}
+}
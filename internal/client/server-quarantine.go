@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerQuarantine excludes servers producing bad artifacts from scheduling for QuarantineTime.
+// A server is quarantined at once if a .o received from it is rejected: its provenance doesn't match (see ObjProvenanceChecker),
+// or it was compiled for another machine (see StrictObjTarget of a server).
+// Compiler crashes (an internal compiler error or a signal) are counted only if a file was compiled locally fine afterward;
+// a server is quarantined after QuarantineAfter of them: a broken toolchain there, not a bug in the source code.
+// It's keyed by "host:port" (as in Servers), so that a quarantine survives reloading a config.
+// It's nil if QuarantineTime is not set, then servers are never excluded.
+type ServerQuarantine struct {
+	mu             sync.Mutex
+	duration       time.Duration
+	crashesToApply int
+	nCrashes       map[string]int       // since the last quarantine of a server
+	until          map[string]time.Time // a server is not chosen for compiling until this moment
+	events         []quarantineEvent    // for `nocc --stats`
+}
+
+type quarantineEvent struct {
+	remoteHostPort string
+	reason         string
+	time           time.Time
+}
+
+func MakeServerQuarantine(quarantineTime int, quarantineAfter int) *ServerQuarantine {
+	if quarantineTime <= 0 {
+		return nil
+	}
+	return &ServerQuarantine{
+		duration:       time.Duration(quarantineTime) * time.Second,
+		crashesToApply: max(quarantineAfter, 1),
+		nCrashes:       make(map[string]int),
+		until:          make(map[string]time.Time),
+	}
+}
+
+func (q *ServerQuarantine) IsQuarantined(remoteHostPort string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return time.Now().Before(q.until[remoteHostPort])
+}
+
+// OnRemoteFailed is called after an invocation failed remotely and was compiled locally with localExitCode.
+func (q *ServerQuarantine) OnRemoteFailed(invocation *Invocation, localExitCode int) {
+	remoteHostPort := invocation.summary.remoteHostPort
+	if q == nil || remoteHostPort == "" {
+		return
+	}
+
+	if invocation.badObj != "" {
+		q.quarantine(remoteHostPort, invocation.badObj)
+		return
+	}
+	if localExitCode != 0 {
+		return
+	}
+
+	crash := ""
+	switch {
+	case invocation.compilerSignal != 0:
+		crash = fmt.Sprintf("a compiler was killed by signal %d", invocation.compilerSignal)
+	case invocation.compilerExitCode != 0 && isCompilerCrash(invocation.compilerStderr):
+		crash = "an internal compiler error"
+	default:
+		return
+	}
+
+	q.mu.Lock()
+	q.nCrashes[remoteHostPort]++
+	nCrashes := q.nCrashes[remoteHostPort]
+	q.mu.Unlock()
+	logClient.Error("remote", remoteHostPort, "crashed compiling", invocation.cppInFile, "but it was compiled locally:", crash)
+
+	if nCrashes >= q.crashesToApply {
+		q.quarantine(remoteHostPort, fmt.Sprintf("%d compiler crashes, the last is %s", nCrashes, crash))
+	}
+}
+
+func (q *ServerQuarantine) quarantine(remoteHostPort string, reason string) {
+	now := time.Now()
+	q.mu.Lock()
+	q.until[remoteHostPort] = now.Add(q.duration)
+	q.nCrashes[remoteHostPort] = 0
+	q.events = append(q.events, quarantineEvent{remoteHostPort, reason, now})
+	q.mu.Unlock()
+
+	logClient.Error("quarantine remote", remoteHostPort, "for", q.duration, "reason:", reason)
+}
+
+// WriteStats outputs quarantine events for `nocc --stats`
+func (q *ServerQuarantine) WriteStats(b *strings.Builder) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.events) > 0 {
+		fmt.Fprintf(b, "\nquarantined remotes (for %s):\n", q.duration)
+	}
+	for _, event := range q.events {
+		fmt.Fprintf(b, "  %s  %-30s %s\n", event.time.Format(time.TimeOnly), event.remoteHostPort, event.reason)
+	}
+}
+
+// isCompilerCrash detects an ICE in compiler stderr, as opposed to errors in the source code
+func isCompilerCrash(stderr []byte) bool {
+	return bytes.Contains(stderr, []byte("internal compiler error")) || // gcc
+		bytes.Contains(stderr, []byte("frontend command failed due to signal")) // clang
+}
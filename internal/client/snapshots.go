@@ -0,0 +1,57 @@
+package client
+
+import (
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// remoteSnapshot is a toolchain snapshot registered on a remote (see server.Snapshots), Snapshots in config.
+// A remote replies with its files on StartClient; a session references a snapshot by id,
+// and required files equal to snapshot ones (same name, size and sha256) are not sent at all.
+// A file differing from a snapshot (e.g. a client has a newer libc header) is sent as usual.
+type remoteSnapshot struct {
+	id    string
+	files map[string]*pb.FileMetadata // by a server path
+}
+
+func makeRemoteSnapshots(snapshots []*pb.Snapshot) []*remoteSnapshot {
+	remoteSnapshots := make([]*remoteSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		files := make(map[string]*pb.FileMetadata, len(snapshot.Files))
+		for _, file := range snapshot.Files {
+			files[file.FileName] = file
+		}
+		remoteSnapshots = append(remoteSnapshots, &remoteSnapshot{id: snapshot.ID, files: files})
+	}
+	return remoteSnapshots
+}
+
+func (snapshot *remoteSnapshot) contains(file *pb.FileMetadata) bool {
+	snapshotFile := snapshot.files[common.ToServerPath(file.FileName)]
+	return snapshotFile != nil && !file.IsSymlink && snapshotFile.FileSize == file.FileSize &&
+		snapshotFile.SHA256_B0_7 == file.SHA256_B0_7 && snapshotFile.SHA256_B8_15 == file.SHA256_B8_15 &&
+		snapshotFile.SHA256_B16_23 == file.SHA256_B16_23 && snapshotFile.SHA256_B24_31 == file.SHA256_B24_31
+}
+
+// chooseSnapshot returns a snapshot containing most of requiredFiles (a session references only one), nil if none
+func (remote *RemoteConnection) chooseSnapshot(requiredFiles []*pb.FileMetadata) *remoteSnapshot {
+	snapshots := remote.snapshots.Load()
+	if snapshots == nil {
+		return nil
+	}
+
+	var chosen *remoteSnapshot
+	maxContained := 0
+	for _, snapshot := range *snapshots {
+		nContained := 0
+		for _, file := range requiredFiles {
+			if snapshot.contains(file) {
+				nContained++
+			}
+		}
+		if nContained > maxContained {
+			chosen, maxContained = snapshot, nContained
+		}
+	}
+	return chosen
+}
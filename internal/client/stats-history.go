@@ -0,0 +1,161 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsHistory is a rolling store of DaemonStats totals of recent daemon launches, kept in StatsFile.
+// A daemon quits after a build, so its own stats are only "the current build";
+// `nocc stats` also prints totals of the last statsHistoryMaxRuns launches, like `ccache -s` does across builds.
+// It's nil if StatsFile is not set.
+type StatsHistory struct {
+	mu       sync.Mutex
+	runs     []statsRun // the oldest first
+	fileName string
+}
+
+// statsRun is totals of one daemon launch, see DaemonStats
+type statsRun struct {
+	Start        time.Time      `json:"start"`
+	Invocations  int            `json:"invocations"`
+	Remote       int            `json:"remote"`
+	ObjCacheHits int            `json:"obj_cache_hits"`
+	Local        int            `json:"local"`
+	RemoteFailed int            `json:"remote_failed"`
+	BytesSent    int64          `json:"bytes_sent"`
+	RemoteTimeMs int64          `json:"remote_time_ms"`
+	PerRemote    map[string]int `json:"per_remote"` // invocations per remote host
+	LocalReasons map[string]int `json:"local_reasons"`
+}
+
+const statsHistoryMaxRuns = 100
+
+func MakeStatsHistory(fileName string) *StatsHistory {
+	if fileName == "" {
+		return nil
+	}
+	history := &StatsHistory{fileName: fileName}
+	data, err := os.ReadFile(fileName)
+	if err == nil {
+		err = json.Unmarshal(data, &history.runs)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logClient.Error("can't read StatsFile, starting with an empty history:", err)
+		history.runs = nil
+	}
+	return history
+}
+
+// toStatsRun takes totals of a daemon launch to be kept in StatsHistory
+func (stats *DaemonStats) toStatsRun(start time.Time) statsRun {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	run := statsRun{
+		Start:        start,
+		Invocations:  stats.nInvocations,
+		Remote:       stats.nRemote,
+		ObjCacheHits: stats.nObjCacheHits,
+		Local:        stats.nLocal,
+		RemoteFailed: stats.nRemoteFailed,
+		BytesSent:    stats.nBytesSent,
+		RemoteTimeMs: stats.totalRemoteTime.Milliseconds(),
+		PerRemote:    make(map[string]int, len(stats.perRemote)),
+		LocalReasons: make(map[string]int, len(stats.localReasons)),
+	}
+	for remoteHost, perRemote := range stats.perRemote {
+		run.PerRemote[remoteHost] = perRemote.nInvocations
+	}
+	for reason, count := range stats.localReasons {
+		run.LocalReasons[reason] = count
+	}
+	return run
+}
+
+// Save appends a launch that is quitting and writes the last statsHistoryMaxRuns launches to StatsFile
+func (history *StatsHistory) Save(current statsRun) {
+	if history == nil || current.Invocations == 0 {
+		return
+	}
+	history.mu.Lock()
+	history.runs = append(history.runs, current)
+	if len(history.runs) > statsHistoryMaxRuns {
+		history.runs = history.runs[len(history.runs)-statsHistoryMaxRuns:]
+	}
+	data, err := json.Marshal(history.runs)
+	history.mu.Unlock()
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(history.fileName), os.ModePerm)
+	}
+	if err == nil {
+		err = os.WriteFile(history.fileName+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(history.fileName+".tmp", history.fileName)
+	}
+	if err != nil {
+		logClient.Error("can't save StatsFile:", err)
+	}
+}
+
+// WriteTotals outputs totals of previous launches and the current one, printed by `nocc stats`
+func (history *StatsHistory) WriteTotals(b *strings.Builder, current statsRun) {
+	if history == nil {
+		return
+	}
+	history.mu.Lock()
+	runs := append(append([]statsRun(nil), history.runs...), current)
+	history.mu.Unlock()
+
+	total := statsRun{PerRemote: make(map[string]int), LocalReasons: make(map[string]int)}
+	for _, run := range runs {
+		total.Invocations += run.Invocations
+		total.Remote += run.Remote
+		total.ObjCacheHits += run.ObjCacheHits
+		total.Local += run.Local
+		total.RemoteFailed += run.RemoteFailed
+		total.BytesSent += run.BytesSent
+		total.RemoteTimeMs += run.RemoteTimeMs
+		for remoteHost, count := range run.PerRemote {
+			total.PerRemote[remoteHost] += count
+		}
+		for reason, count := range run.LocalReasons {
+			total.LocalReasons[reason] += count
+		}
+	}
+
+	fmt.Fprintf(b, "\nlast %d daemon launches, since %s:\n", len(runs), runs[0].Start.Format(time.DateTime))
+	fmt.Fprintf(b, "%-32s %d\n", "invocations", total.Invocations)
+	fmt.Fprintf(b, "%-32s %d (%.1f%%)\n", "  compiled remotely", total.Remote, percentOf(total.Remote, total.Invocations))
+	fmt.Fprintf(b, "%-32s %d (%.1f%% of remote)\n", "    taken from obj cache", total.ObjCacheHits, percentOf(total.ObjCacheHits, total.Remote))
+	fmt.Fprintf(b, "%-32s %d (%.1f%%)\n", "  compiled locally", total.Local, percentOf(total.Local, total.Invocations))
+	fmt.Fprintf(b, "%-32s %d\n", "    after remote failure", total.RemoteFailed)
+	fmt.Fprintf(b, "%-32s %d bytes\n", "  average upload per remote", averageOf(total.BytesSent, total.Remote))
+	fmt.Fprintf(b, "%-32s %d ms\n", "average remote invocation", averageOf(total.RemoteTimeMs, total.Remote))
+
+	reasons := make([]string, 0, len(total.LocalReasons))
+	for reason := range total.LocalReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(b, "  local because of %-15s %d\n", reason, total.LocalReasons[reason])
+	}
+
+	remoteHosts := make([]string, 0, len(total.PerRemote))
+	for remoteHost := range total.PerRemote {
+		remoteHosts = append(remoteHosts, remoteHost)
+	}
+	sort.Strings(remoteHosts)
+	for _, remoteHost := range remoteHosts {
+		fmt.Fprintf(b, "  %-30s %d invocations (%.1f%%)\n", remoteHost, total.PerRemote[remoteHost], percentOf(total.PerRemote[remoteHost], total.Invocations))
+	}
+}
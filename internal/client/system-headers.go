@@ -0,0 +1,50 @@
+package client
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// calcSystemHeaderDirs calculates digests of SystemHeaderDirs from config to be sent to servers on start.
+// A server having the same dirs (see server.SystemHeaders) mounts them instead of receiving files from there,
+// and a client omits such files in sessions (see excludeSystemHeaders). Other servers receive them as usual.
+// It's done once on daemon start, so it takes some time (reading /usr/include takes about a second).
+func calcSystemHeaderDirs(dirs []string) ([]*pb.SystemHeaderDir, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+
+	systemHeaderDirs := make([]*pb.SystemHeaderDir, 0, len(dirs))
+	for _, dir := range dirs {
+		start := time.Now()
+		digest, err := common.CalcDirDigest(dir)
+		if err != nil {
+			return nil, err
+		}
+		systemHeaderDirs = append(systemHeaderDirs, &pb.SystemHeaderDir{
+			Dir:    common.ToServerPath(filepath.Clean(dir)),
+			Digest: digest.ToLongHexString(),
+		})
+		logClient.Info(0, "system headers", dir, "digest", digest.ToLongHexString(), "calculated in", time.Since(start))
+	}
+	return systemHeaderDirs, nil
+}
+
+// isInAcceptedSystemHeaderDirs tells whether a file is not sent to a remote, since a remote has the same system headers
+func (remote *RemoteConnection) isInAcceptedSystemHeaderDirs(fileName string) bool {
+	acceptedDirs := remote.acceptedSystemHeaderDirs.Load()
+	return acceptedDirs != nil && isInSystemHeaderDirs(common.ToServerPath(fileName), *acceptedDirs)
+}
+
+func isInSystemHeaderDirs(fileName string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(fileName, dir) && len(fileName) > len(dir) && fileName[len(dir)] == '/' {
+			return true
+		}
+	}
+	return false
+}
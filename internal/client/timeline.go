@@ -0,0 +1,162 @@
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BuildTimeline writes all invocations to a file in Trace Event Format, to be opened in chrome://tracing or Perfetto.
+// Every invocation is a slice with nested steps (collected_includes, remote_session, uploaded_files, received_obj).
+// Concurrent invocations are placed on different "threads" (lanes), so a timeline shows how busy the daemon was.
+// See https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU.
+// A nil *BuildTimeline is valid and does nothing: it's what MakeBuildTimeline returns when TimelineFileName is not set.
+type BuildTimeline struct {
+	mu sync.Mutex
+
+	file      *os.File
+	startTime time.Time
+	lanes     []bool // lanes[tid] is true while some invocation occupies it
+	closed    bool
+}
+
+type traceEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`
+	Ts   int64          `json:"ts"` // microseconds since daemon start
+	Dur  int64          `json:"dur,omitempty"`
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+func MakeBuildTimeline(fileName string, startTime time.Time) (*BuildTimeline, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := &BuildTimeline{
+		file:      file,
+		startTime: startTime,
+	}
+	_, _ = file.WriteString("[\n")
+	timeline.writeEvent(&traceEvent{Name: "process_name", Ph: "M", Args: map[string]any{"name": "nocc-daemon"}}, true)
+	return timeline, nil
+}
+
+// AcquireLane returns a tid not used by any running invocation, it must be released by RecordInvocation.
+func (timeline *BuildTimeline) AcquireLane() int {
+	if timeline == nil {
+		return 0
+	}
+	timeline.mu.Lock()
+	defer timeline.mu.Unlock()
+
+	for tid, busy := range timeline.lanes {
+		if !busy {
+			timeline.lanes[tid] = true
+			return tid
+		}
+	}
+	timeline.lanes = append(timeline.lanes, true)
+	return len(timeline.lanes) - 1
+}
+
+// RecordInvocation writes an invocation (started at createTime, finished now) and releases its lane.
+func (timeline *BuildTimeline) RecordInvocation(invocation *Invocation, tid int, exitCode int) {
+	if timeline == nil {
+		return
+	}
+	endTime := time.Now()
+
+	args := map[string]any{
+		"cppInFile": invocation.cppInFile,
+		"exitCode":  exitCode,
+	}
+	if invocation.summary.remoteHost != "" {
+		args["remote"] = invocation.summary.remoteHost
+		args["sessionID"] = invocation.sessionID
+	}
+	if invocation.buildGroup != nil {
+		args["build"] = invocation.buildGroup.buildID
+	}
+	if invocation.err != nil {
+		args["error"] = invocation.err.Error()
+	}
+
+	name := filepath.Base(invocation.cppInFile)
+	if invocation.cppInFile == "" {
+		name = "(not a cpp)"
+	}
+	events := []*traceEvent{{
+		Name: name,
+		Cat:  "invocation",
+		Ph:   "X",
+		Ts:   timeline.microsecondsOf(invocation.createTime),
+		Dur:  endTime.Sub(invocation.createTime).Microseconds(),
+		Tid:  tid,
+		Args: args,
+	}}
+	prevTime := invocation.createTime
+	for _, item := range invocation.summary.timings {
+		events = append(events, &traceEvent{
+			Name: item.stepName,
+			Cat:  "step",
+			Ph:   "X",
+			Ts:   timeline.microsecondsOf(prevTime),
+			Dur:  item.timeEnd.Sub(prevTime).Microseconds(),
+			Tid:  tid,
+		})
+		prevTime = item.timeEnd
+	}
+
+	timeline.mu.Lock()
+	defer timeline.mu.Unlock()
+	for _, event := range events {
+		timeline.writeEvent(event, false)
+	}
+	if tid < len(timeline.lanes) {
+		timeline.lanes[tid] = false
+	}
+}
+
+// Close terminates a JSON array, so that the file becomes valid JSON (viewers also accept an unterminated one).
+func (timeline *BuildTimeline) Close() {
+	if timeline == nil {
+		return
+	}
+	timeline.mu.Lock()
+	defer timeline.mu.Unlock()
+
+	if !timeline.closed {
+		timeline.closed = true
+		_, _ = timeline.file.WriteString("\n]\n")
+		_ = timeline.file.Close()
+	}
+}
+
+func (timeline *BuildTimeline) microsecondsOf(t time.Time) int64 {
+	return t.Sub(timeline.startTime).Microseconds()
+}
+
+// writeEvent must be called under a mutex
+func (timeline *BuildTimeline) writeEvent(event *traceEvent, isFirst bool) {
+	if timeline.closed {
+		return
+	}
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if !isFirst {
+		_, _ = timeline.file.WriteString(",\n")
+	}
+	_, _ = timeline.file.Write(bytes)
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"nocc/internal/common"
+)
+
+// Toolchains pack local compilers to be uploaded to servers (like icecream's toolchain tarballs, see UploadToolchain).
+// Then a server doesn't need the same compiler installed: it launches a client's one, uploaded into a client chroot.
+// A toolchain is a compiler binary, its helper programs (cc1plus, as), shared libraries they need, a dynamic loader
+// and /etc/ld.so.cache — at their original paths, since a compiler finds everything relative to where it's installed.
+// System headers are not packed: they are uploaded along with other dependencies of a .cpp, as usual.
+// Files are uploaded like .h files, keyed by sha256, so every server receives a toolchain once and keeps it in src cache.
+type Toolchains struct {
+	mu    sync.Mutex
+	table map[string]*Toolchain // key: an abs compiler path
+}
+
+type Toolchain struct {
+	once         sync.Once
+	compilerPath string // launched on a server instead of invocation.compilerName
+	files        []*IncludedFile
+	hash         common.SHA256 // of all files, for logs
+	err          error
+}
+
+// toolchainHelperPrograms are launched by a compiler driver for -c (clang does it in-process, it has none of them)
+var toolchainHelperPrograms = []string{"cc1", "cc1plus", "as"}
+
+func MakeToolchains(uploadToolchain bool) *Toolchains {
+	if !uploadToolchain {
+		return nil
+	}
+	return &Toolchains{
+		table: make(map[string]*Toolchain),
+	}
+}
+
+// Get returns a packed toolchain for invocation.compilerName; it's packed on first use and kept while a daemon is alive
+func (toolchains *Toolchains) Get(invocation *Invocation) (*Toolchain, error) {
+	compilerPath := lookupCompilerPath(invocation)
+	if compilerPath == "" {
+		return nil, fmt.Errorf("compiler %s not found", invocation.compilerName)
+	}
+
+	toolchains.mu.Lock()
+	toolchain := toolchains.table[compilerPath]
+	if toolchain == nil {
+		toolchain = &Toolchain{compilerPath: compilerPath}
+		toolchains.table[compilerPath] = toolchain
+	}
+	toolchains.mu.Unlock()
+
+	toolchain.once.Do(func() {
+		toolchain.err = toolchain.pack()
+		if toolchain.err != nil {
+			logClient.Error("can't pack toolchain", compilerPath, toolchain.err)
+		} else {
+			logClient.Info(0, "packed toolchain", compilerPath, "files", len(toolchain.files), "hash", toolchain.hash.ToShortHexString())
+		}
+	})
+	return toolchain, toolchain.err
+}
+
+func (toolchain *Toolchain) pack() error {
+	programs := []string{toolchain.compilerPath}
+	for _, helper := range toolchainHelperPrograms {
+		if helperPath := lookupHelperProgram(toolchain.compilerPath, helper); helperPath != "" {
+			programs = append(programs, helperPath)
+		}
+	}
+
+	fileNames := make(map[string]struct{})
+	for _, program := range programs {
+		fileNames[program] = struct{}{}
+		libs, err := listSharedLibraries(program)
+		if err != nil {
+			return err
+		}
+		for _, lib := range libs {
+			fileNames[lib] = struct{}{}
+		}
+	}
+	if _, err := os.Stat("/etc/ld.so.cache"); err == nil {
+		fileNames["/etc/ld.so.cache"] = struct{}{}
+	}
+
+	sortedNames := make([]string, 0, len(fileNames))
+	for fileName := range fileNames {
+		sortedNames = append(sortedNames, fileName)
+	}
+	slices.Sort(sortedNames)
+
+	hasher := sha256.New()
+	packed := make(map[string]bool, len(sortedNames))
+	for _, fileName := range sortedNames {
+		files, err := createRequiredIncludeFiles(fileNames, fileName)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if packed[file.fileName] { // a target of several symlinks
+				continue
+			}
+			packed[file.fileName] = true
+			toolchain.files = append(toolchain.files, file)
+			fmt.Fprintln(hasher, file.fileName, file.symlinkTarget, file.fileSHA256.ToLongHexString())
+		}
+	}
+	toolchain.hash = common.MakeSHA256Struct(hasher)
+	return nil
+}
+
+// lookupHelperProgram returns an abs path of a program that a compiler driver would launch, or empty if there is no such
+func lookupHelperProgram(compilerPath string, helper string) string {
+	out, err := exec.Command(compilerPath, "-print-prog-name="+helper).Output()
+	if err != nil {
+		return ""
+	}
+	helperPath, err := exec.LookPath(strings.TrimSpace(string(out)))
+	if err != nil {
+		return ""
+	}
+	helperPath, _ = filepath.Abs(helperPath)
+	return helperPath
+}
+
+// listSharedLibraries returns abs paths of libraries a program is linked with (including a dynamic loader), as `ldd` shows
+func listSharedLibraries(program string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	lddCommand := exec.Command("ldd", program)
+	lddCommand.Stdout = &stdout
+	lddCommand.Stderr = &stderr
+	if err := lddCommand.Run(); err != nil {
+		if strings.Contains(stdout.String(), "not a dynamic executable") || strings.Contains(stderr.String(), "not a dynamic executable") {
+			return nil, nil // statically linked
+		}
+		return nil, fmt.Errorf("ldd %s: %v %s", program, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// lines look like "libc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x...)" or "/lib64/ld-linux-x86-64.so.2 (0x...)"
+	libs := make([]string, 0, 8)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			if strings.HasPrefix(field, "/") {
+				libs = append(libs, field)
+			}
+		}
+	}
+	return libs, nil
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"path/filepath"
+
+	"nocc/internal/common"
+)
+
+// tracerClient exports spans of remote invocations if TracingEndpoint is set (nil otherwise, all calls are no-op)
+var tracerClient *common.Tracer
+
+func MakeTracerClient(configuration *Configuration) error {
+	var err error
+	tracerClient, err = common.MakeTracer(configuration.TracingEndpoint, "nocc-daemon")
+	return err
+}
+
+// startInvocationSpan starts a root span for a remote invocation.
+// Its traceparent is sent to the server, so that server-side spans are attached to the same trace.
+func startInvocationSpan(invocation *Invocation) {
+	invocation.span = tracerClient.StartSpanAt("compile "+filepath.Base(invocation.cppInFile), nil, invocation.createTime)
+	invocation.span.SetAttribute("nocc.session_id", invocation.sessionID)
+	invocation.span.SetAttribute("nocc.cpp_in_file", invocation.cppInFile)
+	invocation.span.SetAttribute("nocc.cwd", invocation.cwd)
+}
+
+// endInvocationSpan converts InvocationSummary timings to child spans: every step lasts from the previous one.
+func endInvocationSpan(invocation *Invocation, err error) {
+	if invocation.span == nil {
+		return
+	}
+
+	prevTime := invocation.createTime
+	for _, item := range invocation.summary.timings {
+		stepSpan := tracerClient.StartSpanAt(item.stepName, invocation.span, prevTime)
+		stepSpan.EndAt(item.timeEnd)
+		prevTime = item.timeEnd
+	}
+
+	invocation.span.SetAttribute("nocc.remote_host", invocation.summary.remoteHost)
+	invocation.span.SetAttribute("nocc.n_includes", invocation.summary.nIncludes)
+	invocation.span.SetAttribute("nocc.n_files_sent", invocation.summary.nFilesSent)
+	invocation.span.SetAttribute("nocc.n_bytes_sent", invocation.summary.nBytesSent)
+	invocation.span.SetAttribute("nocc.n_bytes_received", invocation.summary.nBytesReceived)
+	invocation.span.SetAttribute("nocc.compiler_exit_code", invocation.compilerExitCode)
+	invocation.span.SetAttribute("nocc.compiler_duration_ms", invocation.compilerDuration)
+	invocation.span.SetAttribute("nocc.compiler_queued_ms", invocation.compilerQueued)
+	invocation.span.SetAttribute("nocc.compiler_queue_depth", invocation.compilerQueueDepth)
+	if err != nil {
+		invocation.span.SetAttribute("error", err.Error())
+	}
+	invocation.span.End()
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// A cache namespace of a session is set by a client (CacheNamespace in .nocc.toml of a project).
+// Objects compiled in a namespace are found only by sessions of the same one, and a server accounts them separately,
+// so that an obj cache of one project can be bounded, inspected and purged without touching others. See server.FileCache.
+const maxCacheNamespaceLength = 64
+
+// ValidateCacheNamespace checks a namespace to be safe for logs and configs: letters, digits, '.', '_' and '-'; empty means none
+func ValidateCacheNamespace(namespace string) error {
+	if len(namespace) > maxCacheNamespaceLength {
+		return fmt.Errorf("cache namespace %q is longer than %d", namespace, maxCacheNamespaceLength)
+	}
+	for _, c := range namespace {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return fmt.Errorf("cache namespace %q may contain only letters, digits, '.', '_' and '-'", namespace)
+		}
+	}
+	return nil
+}
+
+// MakeCacheNamespaceDigest is mixed into an obj cache key of a session in a namespace, empty for no namespace
+func MakeCacheNamespaceDigest(namespace string) SHA256 {
+	if namespace == "" {
+		return SHA256{}
+	}
+	hasher := sha256.New()
+	hasher.Write([]byte("cache-namespace:"))
+	hasher.Write([]byte(namespace))
+	return MakeSHA256Struct(hasher)
+}
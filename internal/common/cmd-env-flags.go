@@ -16,6 +16,7 @@ type cmdLineArg interface {
 	flag.Value
 	isFlagSet() bool
 	getCmdName() string
+	getEnvName() string
 	getDescription() string
 }
 
@@ -60,6 +61,84 @@ func (s *cmdLineArgBool) getCmdName() string {
 	return s.cmdName
 }
 
+func (s *cmdLineArgBool) getEnvName() string {
+	return ""
+}
+
+type cmdLineArgString struct {
+	cmdName string
+	envName string
+	usage   string
+
+	isSet bool
+	value string
+}
+
+func (s *cmdLineArgString) String() string {
+	return s.value
+}
+
+func (s *cmdLineArgString) Set(v string) error {
+	s.isSet = true
+	s.value = v
+	return nil
+}
+
+func (s *cmdLineArgString) getDescription() string {
+	return s.usage
+}
+
+func (s *cmdLineArgString) isFlagSet() bool {
+	return s.isSet
+}
+
+func (s *cmdLineArgString) getCmdName() string {
+	return s.cmdName
+}
+
+func (s *cmdLineArgString) getEnvName() string {
+	return s.envName
+}
+
+type cmdLineArgInt struct {
+	cmdName string
+	envName string
+	usage   string
+
+	isSet bool
+	value int
+}
+
+func (s *cmdLineArgInt) String() string {
+	return strconv.Itoa(s.value)
+}
+
+func (s *cmdLineArgInt) Set(v string) error {
+	s.isSet = true
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	s.value = i
+	return nil
+}
+
+func (s *cmdLineArgInt) getDescription() string {
+	return s.usage
+}
+
+func (s *cmdLineArgInt) isFlagSet() bool {
+	return s.isSet
+}
+
+func (s *cmdLineArgInt) getCmdName() string {
+	return s.cmdName
+}
+
+func (s *cmdLineArgInt) getEnvName() string {
+	return s.envName
+}
+
 func initCmdFlag(s cmdLineArg, cmdName string, usage string) {
 	if cmdName != "" { // only env var makes sense
 		flag.Var(s, cmdName, usage)
@@ -80,6 +159,9 @@ func customPrintUsage() {
 		if f.getCmdName() != "" {
 			fmt.Printf("  -%s%s\n", f.getCmdName(), valueHint)
 		}
+		if f.getEnvName() != "" {
+			fmt.Printf("  %s=\n", f.getEnvName())
+		}
 		fmt.Print("    \t")
 		fmt.Print(strings.ReplaceAll(f.getDescription(), "\n", "\n    \t"))
 		fmt.Print("\n\n")
@@ -93,7 +175,38 @@ func CmdEnvBool(usage string, def bool, cmdFlagName string) *bool {
 	return &sf.value
 }
 
+// CmdEnvString is a string value taken from a command line or (if not set there) from an env variable.
+// An empty value means "not set".
+func CmdEnvString(usage string, def string, envName string, cmdFlagName string) *string {
+	var sf = &cmdLineArgString{cmdFlagName, envName, usage, false, def}
+	allCmdLineArgs = append(allCmdLineArgs, sf)
+	initCmdFlag(sf, cmdFlagName, usage)
+	return &sf.value
+}
+
+// CmdEnvInt is an int value taken from a command line or (if not set there) from an env variable.
+func CmdEnvInt(usage string, def int, envName string, cmdFlagName string) *int {
+	var sf = &cmdLineArgInt{cmdFlagName, envName, usage, false, def}
+	allCmdLineArgs = append(allCmdLineArgs, sf)
+	initCmdFlag(sf, cmdFlagName, usage)
+	return &sf.value
+}
+
+// ParseCmdFlagsCombiningWithEnv parses a command line; values not set there are taken from env variables.
+// An invalid env value (e.g. not a number for CmdEnvInt) is fatal, like an invalid command-line flag.
 func ParseCmdFlagsCombiningWithEnv() {
 	flag.Usage = customPrintUsage
 	flag.Parse()
+
+	for _, f := range allCmdLineArgs {
+		if f.isFlagSet() || f.getEnvName() == "" {
+			continue
+		}
+		if envValue, ok := os.LookupEnv(f.getEnvName()); ok {
+			if err := f.Set(envValue); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "invalid value %q for %s: %v\n", envValue, f.getEnvName(), err)
+				os.Exit(2)
+			}
+		}
+	}
 }
@@ -0,0 +1,26 @@
+package common
+
+import (
+	"strings"
+)
+
+// ExtractTargetArgs returns compiler options that change a target platform: `-target {triple}` / `--target={triple}`
+// and `-m32` / `-m64` / `-mx32` / `-m16`. A .cpp with them is sent only to servers whose compiler supports them,
+// and a resulting triple becomes a part of an obj cache key.
+// (--sysroot is not here: files from a sysroot are dependencies, they are uploaded like any other header)
+func ExtractTargetArgs(compilerArgs []string) []string {
+	var targetArgs []string
+	for i := 0; i < len(compilerArgs); i++ {
+		arg := compilerArgs[i]
+		switch {
+		case arg == "-target" && i+1 < len(compilerArgs):
+			targetArgs = append(targetArgs, arg, compilerArgs[i+1])
+			i++
+		case strings.HasPrefix(arg, "--target="):
+			targetArgs = append(targetArgs, arg)
+		case arg == "-m32" || arg == "-m64" || arg == "-mx32" || arg == "-m16":
+			targetArgs = append(targetArgs, arg)
+		}
+	}
+	return targetArgs
+}
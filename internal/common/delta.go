@@ -0,0 +1,172 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Delta uploads are rsync-like: a server, having a previous version of a file (a base), sends signatures of its blocks
+// (see CalcDeltaSignature), a client finds equal blocks in a new version and sends only what differs (see MakeDelta),
+// and a server reconstructs a new version from a base and a delta (see ApplyDelta).
+// It's used for generated sources (.pb.cc, moc outputs, etc.): they change slightly between builds.
+// A delta is a sequence of ops: deltaOpLiteral {len} {bytes} or deltaOpCopy {block index} {blocks count}.
+const (
+	deltaOpLiteral = 0
+	deltaOpCopy    = 1
+)
+
+// DeltaBlockSize is about sqrt of a file size (like in rsync), but at least 1 KB
+func DeltaBlockSize(fileSize int64) int {
+	blockSize := int(math.Sqrt(float64(fileSize))+63) &^ 63
+	return max(blockSize, 1024)
+}
+
+// CalcDeltaSignature returns a weak (rolling) and a strong checksum of every full block of a base (a shorter tail is skipped).
+func CalcDeltaSignature(base []byte, blockSize int) (weak []uint32, strong []uint64) {
+	nBlocks := len(base) / blockSize
+	weak = make([]uint32, 0, nBlocks)
+	strong = make([]uint64, 0, nBlocks)
+	for offset := 0; offset+blockSize <= len(base); offset += blockSize {
+		block := base[offset : offset+blockSize]
+		weak = append(weak, calcWeakChecksum(block))
+		strong = append(strong, calcStrongChecksum(block))
+	}
+	return
+}
+
+// MakeDelta encodes data as a delta against a base described by its signature.
+func MakeDelta(data []byte, blockSize int, weak []uint32, strong []uint64) []byte {
+	blocksByWeak := make(map[uint32][]int, len(weak))
+	for blockIndex, checksum := range weak {
+		blocksByWeak[checksum] = append(blocksByWeak[checksum], blockIndex)
+	}
+
+	var delta bytes.Buffer
+	literalStart := 0
+	copyFrom, copyCount := -1, 0
+	flushCopy := func() {
+		if copyCount > 0 {
+			delta.WriteByte(deltaOpCopy)
+			delta.Write(binary.AppendUvarint(nil, uint64(copyFrom)))
+			delta.Write(binary.AppendUvarint(nil, uint64(copyCount)))
+			copyFrom, copyCount = -1, 0
+		}
+	}
+	flushLiteral := func(end int) {
+		if end > literalStart {
+			flushCopy()
+			delta.WriteByte(deltaOpLiteral)
+			delta.Write(binary.AppendUvarint(nil, uint64(end-literalStart)))
+			delta.Write(data[literalStart:end])
+		}
+	}
+
+	offset := 0
+	var a, b uint32
+	rolling := false
+	for offset+blockSize <= len(data) {
+		if !rolling {
+			a, b = calcWeakSums(data[offset : offset+blockSize])
+			rolling = true
+		}
+		blockIndex := findEqualBlock(data[offset:offset+blockSize], a|b<<16, blocksByWeak, strong)
+		if blockIndex != -1 {
+			flushLiteral(offset)
+			if copyCount > 0 && copyFrom+copyCount != blockIndex {
+				flushCopy()
+			}
+			if copyCount == 0 {
+				copyFrom = blockIndex
+			}
+			copyCount++
+			offset += blockSize
+			literalStart = offset
+			rolling = false
+			continue
+		}
+
+		// roll a window by one byte
+		if offset+blockSize < len(data) {
+			out, in := uint32(data[offset]), uint32(data[offset+blockSize])
+			a = (a - out + in) & 0xffff
+			b = (b - uint32(blockSize)*out + a) & 0xffff
+		}
+		offset++
+	}
+	flushLiteral(len(data))
+	flushCopy()
+	return delta.Bytes()
+}
+
+// ApplyDelta reconstructs data from a base and a delta made by MakeDelta
+func ApplyDelta(base []byte, blockSize int, delta []byte) ([]byte, error) {
+	data := make([]byte, 0, len(base))
+	for len(delta) > 0 {
+		op := delta[0]
+		arg1, n1 := binary.Uvarint(delta[1:])
+		if n1 <= 0 {
+			return nil, fmt.Errorf("corrupted delta")
+		}
+		delta = delta[1+n1:]
+
+		switch op {
+		case deltaOpLiteral:
+			if arg1 > uint64(len(delta)) {
+				return nil, fmt.Errorf("corrupted delta")
+			}
+			data = append(data, delta[:arg1]...)
+			delta = delta[arg1:]
+		case deltaOpCopy:
+			count, n2 := binary.Uvarint(delta)
+			if n2 <= 0 {
+				return nil, fmt.Errorf("corrupted delta")
+			}
+			delta = delta[n2:]
+			from, to := arg1*uint64(blockSize), (arg1+count)*uint64(blockSize)
+			if to > uint64(len(base)) || from > to {
+				return nil, fmt.Errorf("corrupted delta: a block out of a base")
+			}
+			data = append(data, base[from:to]...)
+		default:
+			return nil, fmt.Errorf("corrupted delta: unknown op %d", op)
+		}
+	}
+	return data, nil
+}
+
+// findEqualBlock returns an index of a base block equal to a window, -1 if none
+func findEqualBlock(window []byte, weakChecksum uint32, blocksByWeak map[uint32][]int, strong []uint64) int {
+	candidates := blocksByWeak[weakChecksum]
+	if len(candidates) == 0 {
+		return -1
+	}
+	strongChecksum := calcStrongChecksum(window)
+	for _, blockIndex := range candidates {
+		if strong[blockIndex] == strongChecksum {
+			return blockIndex
+		}
+	}
+	return -1
+}
+
+// calcWeakSums is an rsync rolling checksum (a, b), a block checksum is a | b << 16
+func calcWeakSums(block []byte) (a uint32, b uint32) {
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func calcWeakChecksum(block []byte) uint32 {
+	a, b := calcWeakSums(block)
+	return a | b<<16
+}
+
+func calcStrongChecksum(block []byte) uint64 {
+	sum := sha256.Sum256(block)
+	return binary.LittleEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,20 @@
+package common
+
+// Fault injection breaks transfer and compilation paths on purpose, to test how a daemon and a server recover:
+// a dropped chunk makes an invocation hang until InvocationTimeout, a failed upload recreates a stream, etc.
+// It's compiled in only with `go build -tags nocc_faults` (see fault-injection_enabled.go), otherwise all hooks are no-op.
+// Faults are set by an env variable of nocc-daemon or nocc-server, comma-separated:
+// NOCC_FAULTS=obj-chunk-drop=5,obj-stream-delay=100ms
+// means "drop every 5th chunk of .o files and delay every chunk by 100ms". A number N is "every Nth call fails".
+// See tests/dt/faults1/run.sh.
+
+type FaultPoint string
+
+const (
+	FaultUploadChunkDrop   FaultPoint = "upload-chunk-drop"   // a client doesn't send a chunk of an uploaded file
+	FaultUploadStreamDelay FaultPoint = "upload-stream-delay" // a client sleeps before sending a chunk of an uploaded file
+	FaultUploadRenameFail  FaultPoint = "upload-rename-fail"  // a server can't save an uploaded file
+	FaultObjChunkDrop      FaultPoint = "obj-chunk-drop"      // a server doesn't send a chunk of .o
+	FaultObjStreamDelay    FaultPoint = "obj-stream-delay"    // a server sleeps before sending a chunk of .o
+	FaultCompilerKill      FaultPoint = "compiler-kill"       // a compiler is killed on a server right after start
+)
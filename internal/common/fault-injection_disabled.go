@@ -0,0 +1,10 @@
+//go:build !nocc_faults
+
+package common
+
+func InjectFault(point FaultPoint) error {
+	return nil
+}
+
+func InjectDelay(point FaultPoint) {
+}
@@ -0,0 +1,69 @@
+//go:build nocc_faults
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type faultSpec struct {
+	everyNth int64
+	delay    time.Duration
+	nCalls   atomic.Int64
+}
+
+var allFaultPoints = []FaultPoint{
+	FaultUploadChunkDrop, FaultUploadStreamDelay, FaultUploadRenameFail, FaultObjChunkDrop, FaultObjStreamDelay, FaultCompilerKill,
+}
+
+var (
+	faultsOnce sync.Once
+	faults     map[FaultPoint]*faultSpec
+)
+
+// parseFaults reads NOCC_FAULTS once; an invalid spec is fatal, since a test would silently check nothing
+func parseFaults() {
+	faults = make(map[FaultPoint]*faultSpec)
+	for _, item := range strings.Split(os.Getenv("NOCC_FAULTS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(item, "=")
+		spec := &faultSpec{}
+		if !slices.Contains(allFaultPoints, FaultPoint(name)) {
+			panic(fmt.Sprintf("NOCC_FAULTS: unknown %q", name))
+		} else if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+			spec.everyNth = n
+		} else if delay, err := time.ParseDuration(value); err == nil {
+			spec.delay = delay
+		} else {
+			panic(fmt.Sprintf("NOCC_FAULTS: invalid %q", item))
+		}
+		faults[FaultPoint(name)] = spec
+	}
+}
+
+// InjectFault returns an error on every Nth call, if NOCC_FAULTS contains "point=N"
+func InjectFault(point FaultPoint) error {
+	faultsOnce.Do(parseFaults)
+	spec := faults[point]
+	if spec == nil || spec.everyNth == 0 || spec.nCalls.Add(1)%spec.everyNth != 0 {
+		return nil
+	}
+	return fmt.Errorf("injected fault %s", point)
+}
+
+// InjectDelay sleeps on every call, if NOCC_FAULTS contains "point={duration}"
+func InjectDelay(point FaultPoint) {
+	faultsOnce.Do(parseFaults)
+	if spec := faults[point]; spec != nil && spec.delay > 0 {
+		time.Sleep(spec.delay)
+	}
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"path"
+	"path/filepath"
 	"strings"
 )
 
@@ -10,9 +11,47 @@ func ReplaceFileExt(fileName string, newExt string) string {
 	return fileName[0:len(fileName)-len(logExt)] + newExt
 }
 
+// PathAbs resolves relPath (as specified in a command line) against cwd, the same way the compiler would open it.
+// "./" and duplicate/trailing slashes are cleaned, so that one file always maps to one string.
+// ".." is resolved against the real cwd: if cwd is a symlink, "../x" is relative to its target, not to its parent.
 func PathAbs(cwd string, relPath string) string {
-	if relPath[0] == '/' {
+	if relPath == "" {
+		return cwd
+	}
+	if filepath.IsAbs(relPath) {
 		return relPath
 	}
-	return strings.Join([]string{cwd, relPath}, "/")
+	if hasDotDotSegment(relPath) {
+		if realCwd, err := filepath.EvalSymlinks(cwd); err == nil {
+			cwd = realCwd
+		}
+	}
+	return filepath.Join(cwd, relPath)
+}
+
+// ToServerPath converts a client path to the form a server expects: slash-separated, absolute paths starting with "/".
+// On Windows, `C:\src\1.cpp` becomes `/C:/src/1.cpp` (a server stores it in a client working dir as is).
+// Relative paths and other platforms' paths are returned unchanged (an argument like `-DX=\"1\"` must stay as is).
+func ToServerPath(clientPath string) string {
+	if filepath.Separator == '/' || !filepath.IsAbs(clientPath) {
+		return clientPath
+	}
+	return "/" + filepath.ToSlash(clientPath)
+}
+
+// FromServerPath is the reverse of ToServerPath, for paths a server sends to a client
+func FromServerPath(serverPath string) string {
+	if filepath.Separator == '/' || !strings.HasPrefix(serverPath, "/") {
+		return serverPath
+	}
+	return filepath.FromSlash(serverPath[1:])
+}
+
+func hasDotDotSegment(relPath string) bool {
+	for _, segment := range strings.Split(relPath, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
 }
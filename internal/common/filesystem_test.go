@@ -0,0 +1,50 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathAbs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "real/build"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "real/build"), filepath.Join(dir, "build")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cwd      string
+		relPath  string
+		expected string
+	}{
+		{"/src", "", "/src"},
+		{"/src", "/usr/include/stdio.h", "/usr/include/stdio.h"},
+		{"/src", "1.cpp", "/src/1.cpp"},
+		{"/src", "./include//a.h", "/src/include/a.h"},
+		{"/src", "include/", "/src/include"},
+		{"/src/build", "../1.cpp", "/src/1.cpp"},                                    // cwd doesn't exist
+		{filepath.Join(dir, "build"), "../1.cpp", filepath.Join(dir, "real/1.cpp")}, // ".." of a symlink target
+		{filepath.Join(dir, "build"), "1.cpp", filepath.Join(dir, "build/1.cpp")},   // a symlink is kept
+		{filepath.Join(dir, "build"), "..x/1.cpp", filepath.Join(dir, "build/..x/1.cpp")},
+	}
+	for _, tt := range tests {
+		if abs := PathAbs(tt.cwd, tt.relPath); abs != tt.expected {
+			t.Errorf("PathAbs(%q, %q) = %q, expected %q", tt.cwd, tt.relPath, abs, tt.expected)
+		}
+	}
+}
+
+func TestServerPath(t *testing.T) {
+	for _, clientPath := range []string{"/src/1.cpp", "1.cpp", "-DX=\"1\"", "", "/"} {
+		serverPath := ToServerPath(clientPath)
+		if filepath.IsAbs(clientPath) && serverPath[0] != '/' {
+			t.Errorf("ToServerPath(%q) = %q isn't absolute", clientPath, serverPath)
+		}
+		if back := FromServerPath(serverPath); back != clientPath {
+			t.Errorf("FromServerPath(%q) = %q, expected %q", serverPath, back, clientPath)
+		}
+	}
+}
@@ -5,13 +5,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
+// dumps of truncated fields contain full command lines, they are private and don't pile up:
+// a process keeps its last maxDumpedFields, and dumps older than dumpedFieldsMaxAge are deleted on start
+const maxDumpedFields = 1000
+const dumpedFieldsMaxAge = 7 * 24 * time.Hour
+
 type LoggerWrapper struct {
 	impl              *log.Logger
 	fileName          string
 	verbosity         int
 	duplicateToStderr bool
+
+	// long fields (e.g. compiler args of a big TU) are truncated, since multi-MB lines break journald, see SetLimits
+	maxFieldLength    int
+	maxLineLength     int
+	fullFieldsDumpDir string
+	nDumpedFields     atomic.Int64
 }
 
 func MakeLogger(logFile string, verbosity int) (*LoggerWrapper, error) {
@@ -39,28 +55,119 @@ func MakeLogger(logFile string, verbosity int) (*LoggerWrapper, error) {
 	}, nil
 }
 
-func formatStr(prefix string, v ...any) string {
-	return fmt.Sprintf("%s%s", prefix, fmt.Sprintln(v...))
+// SetLimits enables truncation of log lines: every field longer than maxFieldLength and every line
+// longer than maxLineLength is cut (0 means no limit).
+// If fullFieldsDumpDir is set, a truncated field is written there to a separate file, and its name is logged instead,
+// so that a full command line is still available for debugging.
+func (logger *LoggerWrapper) SetLimits(maxFieldLength int, maxLineLength int, fullFieldsDumpDir string) error {
+	if maxFieldLength < 0 || maxLineLength < 0 {
+		return errors.New("incorrect log limits passed")
+	}
+	if fullFieldsDumpDir != "" {
+		if err := os.MkdirAll(fullFieldsDumpDir, 0700); err != nil {
+			return err
+		}
+		deleteOldDumps(fullFieldsDumpDir)
+	}
+
+	logger.maxFieldLength = maxFieldLength
+	logger.maxLineLength = maxLineLength
+	logger.fullFieldsDumpDir = fullFieldsDumpDir
+	return nil
+}
+
+func (logger *LoggerWrapper) formatStr(v ...any) string {
+	if logger.maxFieldLength > 0 {
+		truncated := make([]any, len(v))
+		for i, field := range v {
+			truncated[i] = logger.truncateField(field)
+		}
+		v = truncated
+	}
+
+	line := fmt.Sprintln(v...)
+	if logger.maxLineLength > 0 && len(line) > logger.maxLineLength {
+		head := cutAtRuneStart(line, logger.maxLineLength)
+		line = fmt.Sprintf("%s...(line truncated, %d bytes more)\n", head, len(line)-len(head))
+	}
+	return line
+}
+
+// cutAtRuneStart returns at most maxLen bytes of str, not splitting a UTF-8 rune
+func cutAtRuneStart(str string, maxLen int) string {
+	if len(str) <= maxLen {
+		return str
+	}
+	n := maxLen
+	for n > 0 && n > maxLen-utf8.UTFMax+1 && !utf8.RuneStart(str[n]) {
+		n--
+	}
+	return str[:n]
+}
+
+// truncateField leaves a field as is if it's short, it's output with %v anyway
+func (logger *LoggerWrapper) truncateField(field any) any {
+	str, ok := field.(string)
+	if !ok {
+		switch field.(type) {
+		case int, int32, int64, uint32, uint64, bool, float64, nil:
+			return field
+		}
+		str = fmt.Sprint(field)
+	}
+	if len(str) <= logger.maxFieldLength {
+		return field
+	}
+
+	head := cutAtRuneStart(str, logger.maxFieldLength)
+	if logger.fullFieldsDumpDir != "" {
+		nDumped := logger.nDumpedFields.Add(1)
+		dumpFileName := filepath.Join(logger.fullFieldsDumpDir, fmt.Sprintf("nocc-%d-%d.log", os.Getpid(), nDumped))
+		if err := os.WriteFile(dumpFileName, []byte(str), 0600); err == nil {
+			if nDumped > maxDumpedFields {
+				_ = os.Remove(filepath.Join(logger.fullFieldsDumpDir, fmt.Sprintf("nocc-%d-%d.log", os.Getpid(), nDumped-maxDumpedFields)))
+			}
+			return fmt.Sprintf("%s...(%d bytes more, full in %s)", head, len(str)-len(head), dumpFileName)
+		}
+	}
+	return fmt.Sprintf("%s...(%d bytes more)", head, len(str)-len(head))
+}
+
+// deleteOldDumps deletes dumps of truncated fields left by previous launches, see dumpedFieldsMaxAge
+func deleteOldDumps(fullFieldsDumpDir string) {
+	entries, err := os.ReadDir(fullFieldsDumpDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "nocc-") || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > dumpedFieldsMaxAge {
+			_ = os.Remove(filepath.Join(fullFieldsDumpDir, entry.Name()))
+		}
+	}
 }
 
 func (logger *LoggerWrapper) Info(verbosity int, v ...any) {
 	if logger.verbosity >= verbosity && logger.impl != nil {
-		_ = logger.impl.Output(0, formatStr("<6>", v...))
+		_ = logger.impl.Output(0, "<6>"+logger.formatStr(v...))
 	}
 }
 
 func (logger *LoggerWrapper) Error(v ...any) {
+	line := logger.formatStr(v...)
 	if logger.impl != nil {
-		_ = logger.impl.Output(0, formatStr("<3>", v...))
+		_ = logger.impl.Output(0, "<3>"+line)
 	}
 	if logger.duplicateToStderr {
-		_, _ = fmt.Fprint(os.Stderr, formatStr("", v...))
+		_, _ = fmt.Fprint(os.Stderr, line)
 	}
 }
 
 func (logger *LoggerWrapper) TmpDebug(v ...any) {
 	if logger.impl != nil {
-		_ = logger.impl.Output(0, formatStr("<7>", v...))
+		_ = logger.impl.Output(0, "<7>"+logger.formatStr(v...))
 	}
 }
 
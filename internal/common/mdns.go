@@ -0,0 +1,151 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mDNS (RFC 6762) lets nocc-server announce itself on a LAN, and a daemon discover servers without listing them,
+// like icecream does without a scheduler. Only what's needed is implemented: a daemon asks for PTR records of a service
+// ("_nocc._tcp.local."), servers answer with PTR, SRV (a port) and A/AAAA (addresses) records.
+// See server.MDNSAnnouncer and client.ServerDiscovery.
+
+// DefaultMDNSService is a service announced by servers and browsed by daemons unless another one is configured
+const DefaultMDNSService = "_nocc._tcp"
+
+var MDNSGroupAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSServiceName makes "_nocc._tcp.local." of "_nocc._tcp"
+func MDNSServiceName(service string) string {
+	return strings.TrimSuffix(service, ".") + ".local."
+}
+
+// MakeMDNSQuery makes a PTR question for a service, its answers are parsed by ParseMDNSServers
+func MakeMDNSQuery(service string) ([]byte, error) {
+	name, err := dnsmessage.NewName(MDNSServiceName(service))
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	return msg.Pack()
+}
+
+// IsMDNSQueryFor tells whether a packet is a query having a PTR question for a service (a server should answer it).
+// The query ID is returned to be echoed, that's required for a legacy unicast response (RFC 6762, section 6.7).
+func IsMDNSQueryFor(packet []byte, service string) (bool, uint16) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet)
+	if err != nil || header.Response {
+		return false, 0
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return false, 0
+	}
+	serviceName := MDNSServiceName(service)
+	for _, question := range questions {
+		if (question.Type == dnsmessage.TypePTR || question.Type == dnsmessage.TypeALL) && strings.EqualFold(question.Name.String(), serviceName) {
+			return true, header.ID
+		}
+	}
+	return false, 0
+}
+
+// MakeMDNSResponse announces an instance of a service at port on addrs: PTR -> SRV -> A/AAAA records.
+// With unicast, a question is repeated and an ID is echoed, as a querier sending not from port 5353 expects.
+func MakeMDNSResponse(service string, instance string, port int, addrs []net.IP, queryID uint16, unicast bool) ([]byte, error) {
+	serviceName, err := dnsmessage.NewName(MDNSServiceName(service))
+	if err != nil {
+		return nil, err
+	}
+	instanceName, err := dnsmessage.NewName(instance + "." + MDNSServiceName(service))
+	if err != nil {
+		return nil, err
+	}
+	hostName, err := dnsmessage.NewName(instance + ".local.")
+	if err != nil {
+		return nil, err
+	}
+
+	const ttl = 120
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: serviceName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.PTRResource{PTR: instanceName},
+		}},
+		Additionals: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: instanceName, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.SRVResource{Target: hostName, Port: uint16(port)},
+		}},
+	}
+	if unicast {
+		msg.ID = queryID
+		msg.Questions = []dnsmessage.Question{{Name: serviceName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}}
+	}
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: hostName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte(ip4)},
+			})
+		} else {
+			msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: hostName, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())},
+			})
+		}
+	}
+	return msg.Pack()
+}
+
+// ParseMDNSServers extracts "ip:port" of instances of a service from a response: an IPv4 address is preferred.
+func ParseMDNSServers(packet []byte, service string) []string {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(packet); err != nil || !msg.Response {
+		return nil
+	}
+
+	serviceName := MDNSServiceName(service)
+	instances := make([]string, 0)
+	srvs := make(map[string]*dnsmessage.SRVResource)
+	ipv4s := make(map[string]net.IP)
+	ipv6s := make(map[string]net.IP)
+	for _, resource := range append(msg.Answers, msg.Additionals...) {
+		name := strings.ToLower(resource.Header.Name.String())
+		switch body := resource.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if strings.EqualFold(name, serviceName) {
+				instances = append(instances, strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			srvs[name] = body
+		case *dnsmessage.AResource:
+			ipv4s[name] = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ipv6s[name] = net.IP(body.AAAA[:])
+		}
+	}
+
+	servers := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		srv := srvs[instance]
+		if srv == nil {
+			continue
+		}
+		target := strings.ToLower(srv.Target.String())
+		ip := ipv4s[target]
+		if ip == nil {
+			ip = ipv6s[target]
+		}
+		if ip != nil {
+			servers = append(servers, net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return servers
+}
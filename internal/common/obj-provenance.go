@@ -0,0 +1,111 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ObjProvenance describes where a remotely compiled .o came from: which server and compiler produced it, and when.
+// A server records it after compilation and keeps it in obj cache along with a .o (see server.ProvenanceRecorder),
+// a client writes it next to a received .o and may require it to be signed (see client.ObjProvenanceChecker).
+type ObjProvenance struct {
+	Server          string    `json:"server"`
+	Compiler        string    `json:"compiler"`
+	CompilerVersion string    `json:"compiler_version"`
+	CompilerSHA256  string    `json:"compiler_sha256"`
+	CompiledAt      time.Time `json:"compiled_at"`
+	ObjCacheKey     string    `json:"obj_cache_key"`
+	ObjSHA256       string    `json:"obj_sha256"`
+}
+
+// SignedObjProvenance is what is sent to a client and written to a file.
+// Signature is ed25519 of Provenance bytes exactly as they are, that's why they are kept raw, not re-encoded.
+type SignedObjProvenance struct {
+	Provenance json.RawMessage `json:"provenance"`
+	Signature  []byte          `json:"signature,omitempty"` // empty if a server has no ProvenanceKey
+}
+
+func SignObjProvenance(provenance *ObjProvenance, privateKey ed25519.PrivateKey) ([]byte, error) {
+	signed := SignedObjProvenance{}
+	var err error
+	if signed.Provenance, err = json.Marshal(provenance); err != nil {
+		return nil, err
+	}
+	if privateKey != nil {
+		signed.Signature = ed25519.Sign(privateKey, signed.Provenance)
+	}
+	return json.MarshalIndent(&signed, "", "  ")
+}
+
+// VerifyObjProvenance checks that provenance is signed by any of publicKeys and returns it parsed.
+func VerifyObjProvenance(signedJSON []byte, publicKeys []ed25519.PublicKey) (*ObjProvenance, error) {
+	signed := SignedObjProvenance{}
+	if err := json.Unmarshal(signedJSON, &signed); err != nil {
+		return nil, fmt.Errorf("invalid provenance: %v", err)
+	}
+	provenance := &ObjProvenance{}
+	if err := json.Unmarshal(signed.Provenance, provenance); err != nil {
+		return nil, fmt.Errorf("invalid provenance: %v", err)
+	}
+
+	for _, publicKey := range publicKeys {
+		if ed25519.Verify(publicKey, signed.Provenance, signed.Signature) {
+			return provenance, nil
+		}
+	}
+	if len(signed.Signature) == 0 {
+		return nil, fmt.Errorf("provenance from %s is not signed", provenance.Server)
+	}
+	return nil, fmt.Errorf("provenance from %s is signed by an unknown key", provenance.Server)
+}
+
+// ReadEd25519PrivateKey reads a PEM file, like created by `openssl genpkey -algorithm ed25519`
+func ReadEd25519PrivateKey(fileName string) (ed25519.PrivateKey, error) {
+	der, err := readPemBlock(fileName, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", fileName)
+	}
+	return privateKey, nil
+}
+
+// ReadEd25519PublicKey reads a PEM file, like created by `openssl pkey -in private.pem -pubout`
+func ReadEd25519PublicKey(fileName string) (ed25519.PublicKey, error) {
+	der, err := readPemBlock(fileName, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", fileName)
+	}
+	return publicKey, nil
+}
+
+func readPemBlock(fileName string, blockType string) ([]byte, error) {
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: no %s PEM block", fileName, blockType)
+	}
+	return block.Bytes, nil
+}
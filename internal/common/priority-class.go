@@ -0,0 +1,25 @@
+package common
+
+// A priority class of a session is set by a client (PriorityClass of a daemon, like NOCC_PRIORITY_CLASS=batch on CI agents).
+// A server launches compilers of a higher class first, then by a numeric priority (see client.PolicyRule) within a class,
+// and may reserve compiler slots for a class, so that developers waiting for a build are not queued behind bulk CI jobs.
+// See server.CompilerLauncher.
+const (
+	PriorityClassInteractive = "interactive"
+	PriorityClassDefault     = "default" // also an empty class, sent by older clients and by a daemon without PriorityClass
+	PriorityClassBatch       = "batch"
+)
+
+// PriorityClassRank orders priority classes, a higher one is launched first; it's -1 for an unknown class
+func PriorityClassRank(class string) int {
+	switch class {
+	case PriorityClassBatch:
+		return 0
+	case PriorityClassDefault, "":
+		return 1
+	case PriorityClassInteractive:
+		return 2
+	default:
+		return -1
+	}
+}
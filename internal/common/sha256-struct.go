@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 )
 
 //goland:noinspection GoSnakeCaseUsage
@@ -33,6 +35,11 @@ func (h *SHA256) ToLongHexString() string {
 	return fmt.Sprintf("%x-%x-%x-%x", h.B0_7, h.B8_15, h.B16_23, h.B24_31)
 }
 
+// ToHexString is a plain sha256 hex, as `sha256sum` prints it
+func (h *SHA256) ToHexString() string {
+	return fmt.Sprintf("%016x%016x%016x%016x", h.B0_7, h.B8_15, h.B16_23, h.B24_31)
+}
+
 func (h *SHA256) FromLongHexString(hex string) {
 	if n, _ := fmt.Sscanf(hex, "%x-%x-%x-%x", &h.B0_7, &h.B8_15, &h.B16_23, &h.B24_31); n != 4 {
 		*h = SHA256{}
@@ -97,3 +104,35 @@ func CalcSHA256OfFileName(fileName string, preallocatedBuf []byte) (SHA256, []by
 
 	return CalcSHA256OfFile(file, stat.Size(), preallocatedBuf)
 }
+
+// CalcDirDigest is sha256 of a dir tree contents: relative names and sha256 of all files, and targets of symlinks.
+// A client and a server compare digests of system header dirs (like /usr/include) to agree that they are the same,
+// see server.SystemHeaders.
+func CalcDirDigest(dir string) (SHA256, error) {
+	hasher := sha256.New()
+	preallocatedBuf := make([]byte, 64*1024)
+	err := filepath.WalkDir(dir, func(fileName string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, fileName)
+		if entry.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(fileName)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(hasher, "%s -> %s\n", filepath.ToSlash(rel), filepath.ToSlash(target))
+		} else if entry.Type().IsRegular() {
+			fileSHA256, _, err := CalcSHA256OfFileName(fileName, preallocatedBuf)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(hasher, "%s %s\n", filepath.ToSlash(rel), fileSHA256.ToHexString())
+		}
+		return nil
+	})
+	if err != nil {
+		return SHA256{}, err
+	}
+	return MakeSHA256Struct(hasher), nil
+}
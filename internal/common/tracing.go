@@ -0,0 +1,291 @@
+// This module is a minimal OpenTelemetry tracer: spans are batched and exported via OTLP/HTTP (JSON encoding).
+// It's intentionally dependency-free: nocc needs only a tiny subset of the SDK (start/end a span, propagate a parent).
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp.
+
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer collects finished spans and periodically pushes them to an OTLP collector.
+// A nil *Tracer is valid and does nothing: it's what MakeTracer returns when tracing is not configured.
+type Tracer struct {
+	endpoint    string // like http://localhost:4318, "/v1/traces" is appended
+	serviceName string
+	httpClient  *http.Client
+
+	mu      sync.Mutex
+	pending []*Span
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// Span is one timed operation. Spans with the same traceID form a tree via parentID.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []otlpKeyValue
+
+	mu    sync.Mutex
+	ended bool
+}
+
+func MakeTracer(endpoint string, serviceName string) (*Tracer, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("tracing endpoint must start with http:// or https://, got %q", endpoint)
+	}
+
+	tracer := &Tracer{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		httpClient:  &http.Client{Timeout: 5 * time.Second},
+		quit:        make(chan struct{}),
+	}
+	go tracer.exportPeriodically()
+	return tracer, nil
+}
+
+// StartSpan starts a root span (if parent is nil) or a child span.
+func (tracer *Tracer) StartSpan(name string, parent *Span) *Span {
+	return tracer.StartSpanAt(name, parent, time.Now())
+}
+
+// StartSpanAt is like StartSpan, but for operations that were started in the past.
+func (tracer *Tracer) StartSpanAt(name string, parent *Span, start time.Time) *Span {
+	if tracer == nil {
+		return nil
+	}
+	span := &Span{tracer: tracer, name: name, start: start}
+	_, _ = rand.Read(span.spanID[:])
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+	}
+	return span
+}
+
+// StartSpanFromTraceparent starts a span whose parent lives in another process (see Span.Traceparent).
+// If traceparent is empty or malformed, a new root span is started.
+func (tracer *Tracer) StartSpanFromTraceparent(name string, traceparent string) *Span {
+	span := tracer.StartSpan(name, nil)
+	if span == nil {
+		return nil
+	}
+	// version-traceid-parentid-flags, see https://www.w3.org/TR/trace-context/#traceparent-header
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return span
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	parentID, err2 := hex.DecodeString(parts[2])
+	if err1 == nil && err2 == nil {
+		copy(span.traceID[:], traceID)
+		copy(span.parentID[:], parentID)
+	}
+	return span
+}
+
+// Traceparent encodes the span as a W3C traceparent header to be passed to another process.
+func (span *Span) Traceparent() string {
+	if span == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", span.traceID, span.spanID)
+}
+
+func (span *Span) SetAttribute(key string, value any) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	if !span.ended { // an ended span may be being exported already
+		span.attrs = append(span.attrs, makeOtlpKeyValue(key, value))
+	}
+	span.mu.Unlock()
+}
+
+func (span *Span) End() {
+	span.EndAt(time.Now())
+}
+
+// EndAt ends a span once: a session can be closed by whoever comes first (sent, expired, its client deleted),
+// later calls are no-op.
+func (span *Span) EndAt(end time.Time) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	alreadyEnded := span.ended
+	span.ended = true
+	span.mu.Unlock()
+	if alreadyEnded {
+		return
+	}
+	span.end = end
+	span.tracer.mu.Lock()
+	span.tracer.pending = append(span.tracer.pending, span)
+	span.tracer.mu.Unlock()
+}
+
+func (tracer *Tracer) exportPeriodically() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tracer.quit:
+			return
+		case <-ticker.C:
+			tracer.Flush()
+		}
+	}
+}
+
+// Close stops exporting periodically and exports spans finished by now. It's called on process exit,
+// after interrupted operations have ended their spans.
+func (tracer *Tracer) Close() {
+	if tracer == nil {
+		return
+	}
+	tracer.closeOnce.Do(func() {
+		close(tracer.quit)
+	})
+	tracer.Flush()
+}
+
+// Flush exports all finished spans synchronously. It's called periodically and on Close.
+func (tracer *Tracer) Flush() {
+	if tracer == nil {
+		return
+	}
+	tracer.mu.Lock()
+	spans := tracer.pending
+	tracer.pending = nil
+	tracer.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(tracer.makeOtlpRequest(spans))
+	if err != nil {
+		return
+	}
+	resp, err := tracer.httpClient.Post(tracer.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return // tracing is best-effort, never affect compilation
+	}
+	_ = resp.Body.Close()
+}
+
+// the structures below are the JSON mapping of opentelemetry/proto/collector/trace/v1/trace_service.proto
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 is encoded as a string in JSON mapping
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func makeOtlpKeyValue(key string, value any) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case uint32:
+		s := strconv.FormatUint(uint64(v), 10)
+		kv.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (tracer *Tracer) makeOtlpRequest(spans []*Span) *otlpExportRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = "nocc"
+	scope.Scope.Version = GetVersion()
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        span.attrs,
+		}
+		if span.parentID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpKeyValue{makeOtlpKeyValue("service.name", tracer.serviceName)}
+	return &otlpExportRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
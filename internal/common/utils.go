@@ -17,3 +17,15 @@ func CreateCompilerCommand(command string, arguments []string, interruptFunc fun
 
 	return compilerCommand, ctx, cancel
 }
+
+// CompilerTerminationSignal returns a signal a finished compiler was killed by (like SIGKILL by OOM killer), 0 if it exited itself.
+// ProcessState.ExitCode() is -1 then, which can't be told from an error otherwise.
+func CompilerTerminationSignal(compilerCommand *exec.Cmd) int {
+	if compilerCommand.ProcessState == nil {
+		return 0
+	}
+	if status, ok := compilerCommand.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return int(status.Signal())
+	}
+	return 0
+}
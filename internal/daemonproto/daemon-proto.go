@@ -0,0 +1,246 @@
+// Package daemonproto is a format of messages between `nocc` and nocc-daemon over a unix socket (a named pipe on Windows).
+// `nocc` is a lightweight wrapper, that's why this package depends on nothing but the standard library.
+//
+// Since protocol version 2, messages are length-prefixed binary frames, see EncodeFramedRequest and ReadFramedResponse.
+// A legacy `nocc` (before version 2) sends "{Cwd}\b{Compiler}\b{CmdLine...}\0" (and can't send args containing \b),
+// it's answered with "{ExitCode}\b{Stdout}\b{Stderr}\0"; it's supported for one release, in both directions.
+// A framed message starts with \0, a legacy one never does. Framed stdout/stderr are sent as-is, they may contain any bytes.
+package daemonproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FramedPrefix starts every framed message (both a request and a response), followed by FramedProtocolVersion
+var FramedPrefix = []byte("\x00NOCC")
+
+const FramedProtocolVersion = 2
+
+// MaxFramedRequestSize protects a daemon from allocating anything a broken (or fuzzing) peer declares
+const MaxFramedRequestSize = 64 * 1024 * 1024
+
+// MaxFramedChunkSize protects `nocc` from allocating anything a broken daemon declares; larger outputs are split into chunks
+const MaxFramedChunkSize = 1024 * 1024
+
+// kinds of response chunks, see AppendFramedChunk
+const (
+	ChunkStdout = 'o'
+	ChunkStderr = 'e'
+	ChunkExit   = 'x' // the last one: an exit code int32 and a signal int32 that killed a compiler, 0 if none
+)
+
+// ErrLegacyDaemon is returned by ReadLegacyResponse if a daemon of a previous release couldn't parse a framed request;
+// then `nocc` sends a legacy request
+var ErrLegacyDaemon = errors.New("nocc-daemon doesn't support framed requests")
+
+// EncodeFramedRequest makes "{prefix}{version}{size uint32}{parts}", where every part is "{len uint32}{bytes}" (big endian).
+// Parts are Cwd, Compiler (empty for a daemon command), CmdLine, as in a legacy request;
+// attrs ("key=value", like build_id) are nested into one part after Compiler, a daemon skips attrs it doesn't know.
+func EncodeFramedRequest(parts []string, attrs []string) []byte {
+	framedParts := append(slices.Clip(parts[:2]), string(appendFramedParts(nil, attrs)))
+	payload := appendFramedParts(nil, append(framedParts, parts[2:]...))
+
+	request := make([]byte, 0, len(FramedPrefix)+1+4+len(payload))
+	request = append(request, FramedPrefix...)
+	request = append(request, FramedProtocolVersion)
+	request = binary.BigEndian.AppendUint32(request, uint32(len(payload)))
+	return append(request, payload...)
+}
+
+func appendFramedParts(buf []byte, parts []string) []byte {
+	for _, part := range parts {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(part)))
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+// ReadFramedRequest reads what EncodeFramedRequest makes. Parts are returned the same as from a legacy request, attrs separately.
+func ReadFramedRequest(reader *bufio.Reader) ([]string, []string, error) {
+	var header [len("\x00NOCC") + 1 + 4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, nil, fmt.Errorf("truncated request header: %v", err)
+	}
+	if !bytes.Equal(header[:len(FramedPrefix)], FramedPrefix) {
+		return nil, nil, fmt.Errorf("invalid request prefix %q", header[:len(FramedPrefix)])
+	}
+	if version := header[len(FramedPrefix)]; version != FramedProtocolVersion {
+		return nil, nil, fmt.Errorf("unsupported protocol version %d, nocc-daemon supports %d", version, FramedProtocolVersion)
+	}
+	size := binary.BigEndian.Uint32(header[len(FramedPrefix)+1:])
+	if size > MaxFramedRequestSize {
+		return nil, nil, fmt.Errorf("too large request: %d bytes", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, fmt.Errorf("truncated request: %v", err)
+	}
+	parts, err := splitFramedParts(payload, "request part")
+	if err != nil || len(parts) < 3 {
+		return nil, nil, fmt.Errorf("invalid request format")
+	}
+	attrs, err := splitFramedParts([]byte(parts[2]), "request attr")
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(parts[:2:2], parts[3:]...), attrs, nil
+}
+
+func splitFramedParts(payload []byte, what string) ([]string, error) {
+	parts := make([]string, 0, 16)
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("truncated %s %d", what, len(parts)+1)
+		}
+		partLen := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint64(partLen) > uint64(len(payload)) {
+			return nil, fmt.Errorf("%s %d of %d bytes exceeds a request", what, len(parts)+1, partLen)
+		}
+		parts = append(parts, string(payload[:partLen]))
+		payload = payload[partLen:]
+	}
+	return parts, nil
+}
+
+// EncodeLegacyRequest makes "{Cwd}\b{Compiler}\b{CmdLine...}\0" for a daemon of a previous release.
+// It can't pass parts containing \b or \0.
+func EncodeLegacyRequest(parts []string) ([]byte, error) {
+	for _, part := range parts {
+		if strings.ContainsAny(part, "\b\x00") {
+			return nil, fmt.Errorf("nocc-daemon is outdated and can't accept an argument %q, restart it", part)
+		}
+	}
+	return append([]byte(strings.Join(parts, "\b")), 0), nil
+}
+
+func ReadLegacyRequest(reader *bufio.Reader) ([]string, error) {
+	slice, err := reader.ReadString(0x00)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(slice[0:len(slice)-1], "\b"), nil // -1 to strip off the trailing '\0'
+}
+
+// AppendFramedHeader starts a framed response, it's followed by chunks
+func AppendFramedHeader(buf []byte) []byte {
+	buf = append(buf, FramedPrefix...)
+	return append(buf, FramedProtocolVersion)
+}
+
+// AppendFramedChunk appends "{kind}{len uint32}{body}{crc32 uint32}", crc32 (IEEE) is of a chunk before it.
+// A body must not exceed MaxFramedChunkSize.
+func AppendFramedChunk(buf []byte, kind byte, body []byte) []byte {
+	start := len(buf)
+	buf = append(buf, kind)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, body...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+// ExitChunkBody is a body of the ChunkExit chunk
+func ExitChunkBody(exitCode int, signal int) []byte {
+	body := binary.BigEndian.AppendUint32(nil, uint32(int32(exitCode)))
+	return binary.BigEndian.AppendUint32(body, uint32(int32(signal)))
+}
+
+// ReadFramedResponse reads a header followed by chunks until ChunkExit, see AppendFramedChunk.
+// Output is written as it arrives (a daemon streams it while a compiler runs), but only if a checksum of a chunk matches;
+// otherwise, an error tells what was actually received.
+func ReadFramedResponse(reader *bufio.Reader, stdout io.Writer, stderr io.Writer) (exitCode int, signal int, err error) {
+	var header [len("\x00NOCC") + 1]byte
+	if n, err := io.ReadFull(reader, header[:]); err != nil {
+		return 1, 0, fmt.Errorf("failed to read a response header from nocc-daemon: %v, received %s", err, describeReceived(header[:n]))
+	}
+	if !bytes.Equal(header[:len(FramedPrefix)], FramedPrefix) || header[len(FramedPrefix)] != FramedProtocolVersion {
+		return 1, 0, fmt.Errorf("invalid response header from nocc-daemon: %s", describeReceived(header[:]))
+	}
+
+	for nChunk := 1; ; nChunk++ {
+		var chunkHeader [1 + 4]byte
+		if n, err := io.ReadFull(reader, chunkHeader[:]); err != nil {
+			return 1, 0, fmt.Errorf("truncated response from nocc-daemon: chunk %d header: %v, received %s", nChunk, err, describeReceived(chunkHeader[:n]))
+		}
+		kind := chunkHeader[0]
+		bodyLen := binary.BigEndian.Uint32(chunkHeader[1:])
+		if (kind != ChunkStdout && kind != ChunkStderr && kind != ChunkExit) || (kind == ChunkExit && bodyLen != 8) || bodyLen > MaxFramedChunkSize {
+			return 1, 0, fmt.Errorf("invalid response chunk %d header from nocc-daemon: %s", nChunk, describeReceived(chunkHeader[:]))
+		}
+
+		body := make([]byte, bodyLen+4) // with crc32
+		if n, err := io.ReadFull(reader, body); err != nil {
+			return 1, 0, fmt.Errorf("truncated response from nocc-daemon: received %d of %d bytes of chunk %d: %s", n, len(body), nChunk, describeReceived(body[:n]))
+		}
+		body, trailer := body[:bodyLen], body[bodyLen:]
+		hasher := crc32.NewIEEE()
+		_, _ = hasher.Write(chunkHeader[:])
+		_, _ = hasher.Write(body)
+		if received, expected := binary.BigEndian.Uint32(trailer), hasher.Sum32(); received != expected {
+			return 1, 0, fmt.Errorf("corrupted response from nocc-daemon: checksum %08x of chunk %d (%c, %d bytes), expected %08x: %s",
+				received, nChunk, kind, bodyLen, expected, describeReceived(body))
+		}
+
+		switch kind {
+		case ChunkStdout:
+			_, _ = stdout.Write(body)
+		case ChunkStderr:
+			_, _ = stderr.Write(body)
+		case ChunkExit:
+			return int(int32(binary.BigEndian.Uint32(body[0:4]))), int(int32(binary.BigEndian.Uint32(body[4:8]))), nil
+		}
+	}
+}
+
+// AppendLegacyResponse makes "{ExitCode}\b{Stdout}\b{Stderr}\0" for a legacy `nocc`.
+// Like a daemon of a previous release, it doesn't escape output: a legacy `nocc` fails on output containing \b or \0.
+func AppendLegacyResponse(buf []byte, exitCode int, stdout []byte, stderr []byte) []byte {
+	return fmt.Appendf(buf, "%d\b%s\b%s\000", exitCode, stdout, stderr)
+}
+
+// legacyDaemonReply is how a daemon of a previous release answers a framed request: it reads up to \0,
+// which a framed request starts with, and gets no parts
+const legacyDaemonReply = "-1\b\binvalid request format\000"
+
+// ReadLegacyResponse reads what AppendLegacyResponse makes (what a daemon of a previous release sends).
+// If it's an answer to a framed request, ErrLegacyDaemon is returned without writing output.
+func ReadLegacyResponse(reader *bufio.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	response, err := reader.ReadString(0x00)
+	if err != nil {
+		return 1, fmt.Errorf("failed to read a response from nocc-daemon: %v, received %s", err, describeReceived([]byte(response)))
+	}
+	if response == legacyDaemonReply {
+		return 1, ErrLegacyDaemon
+	}
+
+	parts := strings.Split(response[0:len(response)-1], "\b") // -1 to strip off the trailing '\0'
+	if len(parts) != 3 {
+		return 1, fmt.Errorf("invalid response from nocc-daemon: %d parts instead of 3: %s", len(parts), describeReceived([]byte(response)))
+	}
+	exitCode, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 1, fmt.Errorf("invalid exit code in a response from nocc-daemon: %s", describeReceived([]byte(response)))
+	}
+
+	_, _ = io.WriteString(stdout, parts[1])
+	_, _ = io.WriteString(stderr, parts[2])
+	return exitCode, nil
+}
+
+// describeReceived quotes the beginning of received bytes for an error message
+func describeReceived(received []byte) string {
+	const maxLen = 128
+	if len(received) > maxLen {
+		return fmt.Sprintf("%q... (%d bytes)", received[:maxLen], len(received))
+	}
+	return fmt.Sprintf("%q", received)
+}
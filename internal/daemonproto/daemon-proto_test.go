@@ -0,0 +1,257 @@
+package daemonproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// a framed request is followed by \0 if `nocc` is interrupted, it must stay unread
+const interruptByte = 0
+
+func TestFramedRequestRoundTrip(t *testing.T) {
+	roundTrip := func(cwd string, compiler string, cmdLine []string, attrs []string) bool {
+		parts := append([]string{cwd, compiler}, cmdLine...)
+		reader := bufio.NewReader(bytes.NewReader(append(EncodeFramedRequest(parts, attrs), interruptByte)))
+
+		gotParts, gotAttrs, err := ReadFramedRequest(reader)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		rest, _ := io.ReadAll(reader)
+		return slices.Equal(gotParts, parts) && len(gotAttrs) == len(attrs) && (len(attrs) == 0 || slices.Equal(gotAttrs, attrs)) &&
+			bytes.Equal(rest, []byte{interruptByte})
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLegacyRequestRoundTrip(t *testing.T) {
+	roundTrip := func(cwd string, compiler string, cmdLine []string) bool {
+		parts := append([]string{cwd, compiler}, cmdLine...)
+		request, err := EncodeLegacyRequest(parts)
+		if slices.ContainsFunc(parts, func(part string) bool { return strings.ContainsAny(part, "\b\x00") }) {
+			return err != nil
+		}
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		reader := bufio.NewReader(bytes.NewReader(append(request, interruptByte)))
+		gotParts, err := ReadLegacyRequest(reader)
+		rest, _ := io.ReadAll(reader)
+		return err == nil && slices.Equal(gotParts, parts) && bytes.Equal(rest, []byte{interruptByte})
+	}
+	// some generated strings contain \b, to check both outcomes
+	config := &quick.Config{Values: valuesWithDelimiters(roundTrip, "\b")}
+	if err := quick.Check(roundTrip, config); err != nil {
+		t.Error(err)
+	}
+}
+
+// testResponse is what a daemon sends: output written by a compiler while it runs, then an exit code
+type testResponse struct {
+	Writes   []testWrite
+	ExitCode int32
+	Signal   int32
+}
+
+type testWrite struct {
+	ToStderr bool
+	Body     []byte
+}
+
+func (response testResponse) encodeFramed() []byte {
+	buf := AppendFramedHeader(nil)
+	for _, write := range response.Writes {
+		kind := byte(ChunkStdout)
+		if write.ToStderr {
+			kind = ChunkStderr
+		}
+		buf = AppendFramedChunk(buf, kind, write.Body)
+	}
+	return AppendFramedChunk(buf, ChunkExit, ExitChunkBody(int(response.ExitCode), int(response.Signal)))
+}
+
+func (response testResponse) expectedOutput() (stdout []byte, stderr []byte) {
+	for _, write := range response.Writes {
+		if write.ToStderr {
+			stderr = append(stderr, write.Body...)
+		} else {
+			stdout = append(stdout, write.Body...)
+		}
+	}
+	return
+}
+
+func TestFramedResponseRoundTrip(t *testing.T) {
+	roundTrip := func(response testResponse) bool {
+		var stdout, stderr bytes.Buffer
+		exitCode, signal, err := ReadFramedResponse(bufio.NewReader(bytes.NewReader(response.encodeFramed())), &stdout, &stderr)
+		expectedStdout, expectedStderr := response.expectedOutput()
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return exitCode == int(response.ExitCode) && signal == int(response.Signal) &&
+			bytes.Equal(stdout.Bytes(), expectedStdout) && bytes.Equal(stderr.Bytes(), expectedStderr)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestFramedResponseCorruption checks that any single corrupted byte is noticed, not printed as output
+func TestFramedResponseCorruption(t *testing.T) {
+	corrupt := func(response testResponse, offset uint, xor byte) bool {
+		encoded := response.encodeFramed()
+		if xor == 0 {
+			xor = 0xff
+		}
+		encoded[offset%uint(len(encoded))] ^= xor
+
+		_, _, err := ReadFramedResponse(bufio.NewReader(bytes.NewReader(encoded)), io.Discard, io.Discard)
+		return err != nil
+	}
+	if err := quick.Check(corrupt, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLegacyResponseRoundTrip(t *testing.T) {
+	roundTrip := func(exitCode int32, stdoutBody []byte, stderrBody []byte) bool {
+		var stdout, stderr bytes.Buffer
+		got, err := ReadLegacyResponse(bufio.NewReader(bytes.NewReader(AppendLegacyResponse(nil, int(exitCode), stdoutBody, stderrBody))), &stdout, &stderr)
+		if bytes.ContainsAny(stdoutBody, "\b\x00") || bytes.ContainsAny(stderrBody, "\b\x00") {
+			return true // can't be passed in a legacy format, as before
+		}
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return got == int(exitCode) && bytes.Equal(stdout.Bytes(), stdoutBody) && bytes.Equal(stderr.Bytes(), stderrBody)
+	}
+	config := &quick.Config{Values: valuesWithDelimiters(roundTrip, "\b0123456789")}
+	if err := quick.Check(roundTrip, config); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestLegacyBaselineBytes checks bytes as a daemon and `nocc` of a previous release send them
+func TestLegacyBaselineBytes(t *testing.T) {
+	// a request of a previous `nocc`
+	parts, err := ReadLegacyRequest(bufio.NewReader(strings.NewReader("/home/user/project\bg++\b-c\b1.cpp\b-o\b1.o\x00")))
+	if err != nil || !slices.Equal(parts, []string{"/home/user/project", "g++", "-c", "1.cpp", "-o", "1.o"}) {
+		t.Errorf("unexpected parts %q: %v", parts, err)
+	}
+
+	// a response to a previous `nocc`
+	if response := AppendLegacyResponse(nil, 1, []byte("out"), []byte("1.cpp:1: error")); string(response) != "1\bout\b1.cpp:1: error\x00" {
+		t.Errorf("unexpected response %q", response)
+	}
+
+	// responses of a previous daemon
+	var stdout, stderr bytes.Buffer
+	exitCode, err := ReadLegacyResponse(bufio.NewReader(strings.NewReader("0\bout\berr\x00")), &stdout, &stderr)
+	if err != nil || exitCode != 0 || stdout.String() != "out" || stderr.String() != "err" {
+		t.Errorf("unexpected exit code %d, stdout %q, stderr %q: %v", exitCode, stdout.String(), stderr.String(), err)
+	}
+	stdout.Reset()
+	stderr.Reset()
+	if _, err := ReadLegacyResponse(bufio.NewReader(strings.NewReader("-1\b\binvalid request format\x00")), &stdout, &stderr); !errors.Is(err, ErrLegacyDaemon) {
+		t.Errorf("expected ErrLegacyDaemon, got %v", err)
+	}
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("output of a legacy daemon is written: %q %q", stdout.String(), stderr.String())
+	}
+
+	// a previous daemon reads a framed request up to its first \0, there are no parts then
+	framed := EncodeFramedRequest([]string{"/home/user/project", "g++", "-c", "1.cpp"}, []string{"build_id=1"})
+	if parts, err := ReadLegacyRequest(bufio.NewReader(bytes.NewReader(framed))); err != nil || len(parts) >= 3 {
+		t.Errorf("a framed request is parsed by a legacy daemon: %q %v", parts, err)
+	}
+}
+
+// valuesWithDelimiters generates arguments of f like quick.Check does, but strings and bytes are made of few chars,
+// and every 20th char is one of delimiters
+func valuesWithDelimiters(f any, delimiters string) func([]reflect.Value, *rand.Rand) {
+	return func(args []reflect.Value, rnd *rand.Rand) {
+		randomString := func() string {
+			b := make([]byte, rnd.Intn(10))
+			for i := range b {
+				alphabet := "ab -/"
+				if rnd.Intn(20) == 0 {
+					alphabet = delimiters
+				}
+				b[i] = alphabet[rnd.Intn(len(alphabet))]
+			}
+			return string(b)
+		}
+
+		for i := range args {
+			args[i] = randomValue(reflect.TypeOf(f).In(i), rnd, randomString)
+		}
+	}
+}
+
+func randomValue(argType reflect.Type, rnd *rand.Rand, randomString func() string) reflect.Value {
+	switch argType {
+	case reflect.TypeFor[string]():
+		return reflect.ValueOf(randomString())
+	case reflect.TypeFor[[]byte]():
+		return reflect.ValueOf([]byte(randomString()))
+	case reflect.TypeFor[[]string]():
+		strs := make([]string, rnd.Intn(5))
+		for i := range strs {
+			strs[i] = randomString()
+		}
+		return reflect.ValueOf(strs)
+	}
+	value, _ := quick.Value(argType, rnd)
+	return value
+}
+
+// fuzzing checks that a broken peer can't crash a reader or make it allocate what it declares
+
+func FuzzReadFramedRequest(f *testing.F) {
+	f.Add(EncodeFramedRequest([]string{"/home", "g++", "-c", "1.cpp"}, []string{"stderr_tty=1", "build_id=x"}))
+	f.Add(EncodeFramedRequest([]string{"", ""}, nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parts, attrs, err := ReadFramedRequest(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		// a valid request is read back the same after encoding
+		reencoded := EncodeFramedRequest(parts, attrs)
+		parts2, attrs2, err := ReadFramedRequest(bufio.NewReader(bytes.NewReader(reencoded)))
+		if err != nil || !slices.Equal(parts, parts2) || !slices.Equal(attrs, attrs2) {
+			t.Errorf("re-encoded request differs: %q %q, %v", parts2, attrs2, err)
+		}
+	})
+}
+
+func FuzzReadFramedResponse(f *testing.F) {
+	f.Add(testResponse{Writes: []testWrite{{false, []byte("out")}, {true, []byte("err")}}, ExitCode: 1}.encodeFramed())
+	f.Add(testResponse{Signal: 9}.encodeFramed())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _, _ = ReadFramedResponse(bufio.NewReader(bytes.NewReader(data)), io.Discard, io.Discard)
+	})
+}
+
+func FuzzReadLegacyResponse(f *testing.F) {
+	f.Add(AppendLegacyResponse(nil, 0, []byte("out"), []byte("err")))
+	f.Add([]byte("-1\b\binvalid request format\x00"))
+	f.Add([]byte("1\b2\b3\b"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ReadLegacyResponse(bufio.NewReader(bytes.NewReader(data)), io.Discard, io.Discard)
+	})
+}
@@ -0,0 +1,12 @@
+package scheduler
+
+import "nocc/internal/common"
+
+// anywhere in the scheduler code, use logScheduler.Info() and other methods for logging
+var logScheduler *common.LoggerWrapper
+
+func MakeLoggerScheduler(logFile string, verbosity int) error {
+	var err error
+	logScheduler, err = common.MakeLogger(logFile, verbosity)
+	return err
+}
@@ -0,0 +1,185 @@
+package scheduler
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"nocc/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Scheduler is an optional coordinator for large fleets: daemons (with SchedulerAddr) ask it where to compile a .cpp,
+// and it decides knowing the load of every server, which a daemon doesn't (it sees only its own sessions).
+// Only a placement decision goes through a scheduler: files are uploaded and objects received directly from a server.
+// Servers are not configured: a scheduler learns them from candidates of requests and polls their Status,
+// so daemons with different Servers share one scheduler; a server not requested for serverForgetTime is forgotten.
+type Scheduler struct {
+	pb.UnimplementedSchedulerServiceServer
+
+	mu      sync.Mutex
+	servers map[string]*serverLoad // by "host:port", as daemons know them
+
+	pollInterval time.Duration
+	largeCppSize int64 // a .cpp of that size or more goes to the least loaded server, not to a cache-friendly one
+
+	nPlaced    int64
+	nNoOpinion int64 // none of candidates was polled yet or all are cache servers, a daemon decided itself
+}
+
+// serverForgetTime is how long a server is polled after it was a candidate last time
+const serverForgetTime = 10 * time.Minute
+
+type serverLoad struct {
+	hostPort   string
+	connection *grpc.ClientConn
+
+	status          *pb.StatusReply // nil until polled successfully
+	lastRequested   time.Time
+	placedSincePoll int64 // placements not yet reflected in status, so that a burst isn't sent to one server
+}
+
+func MakeScheduler(pollInterval time.Duration, largeCppSize int64) *Scheduler {
+	return &Scheduler{
+		servers:      make(map[string]*serverLoad),
+		pollInterval: pollInterval,
+		largeCppSize: largeCppSize,
+	}
+}
+
+// PlaceCompilation is a grpc handler.
+// A daemon calls it before starting a session; a reply is one of candidates, or empty if a scheduler has no opinion.
+func (s *Scheduler) PlaceCompilation(_ context.Context, in *pb.PlaceCompilationRequest) (*pb.PlaceCompilationReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	eligible := make([]*serverLoad, 0, len(in.Candidates))
+	for _, hostPort := range in.Candidates {
+		load := s.servers[hostPort]
+		if load == nil {
+			connection, err := grpc.NewClient("passthrough:///"+hostPort, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				logScheduler.Error("can't connect to", hostPort, err)
+				continue
+			}
+			load = &serverLoad{hostPort: hostPort, connection: connection}
+			s.servers[hostPort] = load
+			logScheduler.Info(0, "new server", hostPort, "from client", in.ClientID)
+		}
+		load.lastRequested = now
+		if load.status != nil && !load.status.CacheOnly && load.status.CompilerQueueSize > 0 {
+			eligible = append(eligible, load)
+		}
+	}
+
+	chosen := s.choosePlacement(eligible, in.CppBasename, in.CppSize, in.Long)
+	if chosen == nil {
+		s.nNoOpinion++
+		return &pb.PlaceCompilationReply{}, nil
+	}
+	chosen.placedSincePoll++
+	s.nPlaced++
+	logScheduler.Info(2, "placed", in.CppBasename, "of", in.ClientID, "to", chosen.hostPort)
+	return &pb.PlaceCompilationReply{RemoteHostPort: chosen.hostPort}, nil
+}
+
+// choosePlacement orders servers by a rendezvous hash of a .cpp basename: every daemon, whatever its Servers are,
+// sends the same .cpp to the same server while it's not saturated, that keeps obj cache and src cache hot.
+// A large .cpp (or predicted long by a daemon) compiles long, waiting in a queue costs more than a cache miss, so it goes to the least loaded server.
+func (s *Scheduler) choosePlacement(eligible []*serverLoad, cppBasename string, cppSize int64, long bool) *serverLoad {
+	if len(eligible) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(eligible, func(i, j int) bool {
+		return rendezvousWeight(eligible[i].hostPort, cppBasename) > rendezvousWeight(eligible[j].hostPort, cppBasename)
+	})
+	if cppSize < s.largeCppSize && !long {
+		for _, load := range eligible {
+			if load.loadRatio() < 1 {
+				return load
+			}
+		}
+	}
+
+	leastLoaded := eligible[0]
+	for _, load := range eligible[1:] {
+		if load.loadRatio() < leastLoaded.loadRatio() {
+			leastLoaded = load
+		}
+	}
+	return leastLoaded
+}
+
+func rendezvousWeight(hostPort string, cppBasename string) uint64 {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(hostPort))
+	_, _ = hasher.Write([]byte{0})
+	_, _ = hasher.Write([]byte(cppBasename))
+	return hasher.Sum64()
+}
+
+// loadRatio is busy and queued compile slots (with placements since the last poll) to all slots, 1 and more means saturated
+func (load *serverLoad) loadRatio() float64 {
+	busy := load.status.CompilersRunning + load.status.CompilersWaiting + load.placedSincePoll
+	return float64(busy) / float64(load.status.CompilerQueueSize)
+}
+
+// StartPolling queries Status of all known servers every pollInterval, until a scheduler quits
+func (s *Scheduler) StartPolling() {
+	for {
+		time.Sleep(s.pollInterval)
+
+		s.mu.Lock()
+		loads := make([]*serverLoad, 0, len(s.servers))
+		for hostPort, load := range s.servers {
+			if time.Since(load.lastRequested) > serverForgetTime {
+				logScheduler.Info(0, "forget server", hostPort, "not requested for", serverForgetTime)
+				_ = load.connection.Close()
+				delete(s.servers, hostPort)
+				continue
+			}
+			loads = append(loads, load)
+		}
+		s.mu.Unlock()
+
+		wg := sync.WaitGroup{}
+		for _, load := range loads {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.pollServer(load)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// pollServer updates a status of a server; an unreachable one has no status, so it's not chosen until it responds again
+func (s *Scheduler) pollServer(load *serverLoad) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.pollInterval)
+	defer cancel()
+	status, err := pb.NewCompilationServiceClient(load.connection).Status(ctx, &pb.StatusRequest{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil && load.status != nil {
+		logScheduler.Error("server", load.hostPort, "doesn't respond:", err)
+	} else if err == nil && load.status == nil {
+		logScheduler.Info(0, "server", load.hostPort, "is ok,", status.ServerVersion, "compilers", status.CompilerQueueSize)
+	}
+	load.status = status
+	load.placedSincePoll = 0
+}
+
+// GetStats returns placements made and requests a scheduler had no opinion on, for logging on quit
+func (s *Scheduler) GetStats() (nServers int, nPlaced int64, nNoOpinion int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.servers), s.nPlaced, s.nNoOpinion
+}
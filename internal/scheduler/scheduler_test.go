@@ -0,0 +1,147 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"nocc/pb"
+)
+
+// TestMain makes logScheduler, errors are written to stderr
+func TestMain(m *testing.M) {
+	if err := MakeLoggerScheduler("stderr", -1); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testServers are ordered by a rendezvous hash for testCppBasename: the first one is preferred for it
+var testServers = []string{"server1:43210", "server2:43210", "server3:43210"}
+
+const testCppBasename = "1.cpp"
+
+func init() {
+	sort.SliceStable(testServers, func(i, j int) bool {
+		return rendezvousWeight(testServers[i], testCppBasename) > rendezvousWeight(testServers[j], testCppBasename)
+	})
+}
+
+// makeTestServerLoad makes a polled server, load is "running/waiting/placedSincePoll/queueSize"
+func makeTestServerLoad(hostPort string, load string) *serverLoad {
+	status := &pb.StatusReply{}
+	var placedSincePoll int64
+	if _, err := fmt.Sscanf(load, "%d/%d/%d/%d", &status.CompilersRunning, &status.CompilersWaiting, &placedSincePoll, &status.CompilerQueueSize); err != nil {
+		panic(err)
+	}
+	return &serverLoad{hostPort: hostPort, status: status, placedSincePoll: placedSincePoll}
+}
+
+func TestChoosePlacement(t *testing.T) {
+	tests := []struct {
+		name    string
+		loads   []string // of testServers, in their order
+		cppSize int64
+		long    bool
+		want    int // an index in testServers, -1 for no opinion
+	}{
+		{"the preferred one", []string{"0/0/0/8", "0/0/0/8", "0/0/0/8"}, 1000, false, 0},
+		{"the preferred one, busy but not saturated", []string{"7/0/0/8", "0/0/0/8", "0/0/0/8"}, 1000, false, 0},
+		{"the preferred one is saturated", []string{"8/0/0/8", "0/0/0/8", "0/0/0/8"}, 1000, false, 1},
+		{"saturated by a queue", []string{"4/4/0/8", "1/0/0/8", "0/0/0/8"}, 1000, false, 1},
+		{"saturated by placements since a poll", []string{"4/0/4/8", "8/2/0/8", "2/0/0/8"}, 1000, false, 2},
+		{"all saturated, the least loaded", []string{"8/8/0/8", "8/4/0/8", "16/0/0/8"}, 1000, false, 1},
+		{"all saturated, a ratio", []string{"8/8/0/8", "32/8/0/32", "16/8/0/16"}, 1000, false, 1},
+		{"all saturated, equal, the preferred one", []string{"8/0/0/8", "8/0/0/8", "8/0/0/8"}, 1000, false, 0},
+		{"a large one, the least loaded", []string{"1/0/0/8", "2/0/0/8", "0/0/0/8"}, 1 << 20, false, 2},
+		{"a long one, the least loaded", []string{"1/0/0/8", "0/0/0/8", "2/0/0/8"}, 1000, true, 1},
+		{"a large one, equal, the preferred one", []string{"0/0/0/8", "0/0/0/8", "0/0/0/8"}, 1 << 20, false, 0},
+		{"none", nil, 1000, false, -1},
+	}
+	s := MakeScheduler(time.Second, 256*1024)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eligible := make([]*serverLoad, 0, len(tt.loads))
+			for i := len(tt.loads) - 1; i >= 0; i-- { // not in order, it's sorted by a hash
+				eligible = append(eligible, makeTestServerLoad(testServers[i], tt.loads[i]))
+			}
+			chosen := s.choosePlacement(eligible, testCppBasename, tt.cppSize, tt.long)
+			if tt.want == -1 {
+				if chosen != nil {
+					t.Errorf("chosen %s", chosen.hostPort)
+				}
+				return
+			}
+			if chosen == nil || chosen.hostPort != testServers[tt.want] {
+				t.Errorf("chosen %v, expected %s", chosen, testServers[tt.want])
+			}
+		})
+	}
+}
+
+// TestRendezvousSpread checks that .cpp files are spread over servers, and adding a server moves only a part of them
+func TestRendezvousSpread(t *testing.T) {
+	preferred := func(servers []string, cppBasename string) string {
+		best := servers[0]
+		for _, hostPort := range servers[1:] {
+			if rendezvousWeight(hostPort, cppBasename) > rendezvousWeight(best, cppBasename) {
+				best = hostPort
+			}
+		}
+		return best
+	}
+
+	const nFiles = 3000
+	counts := make(map[string]int)
+	nMoved := 0
+	for i := 0; i < nFiles; i++ {
+		cppBasename := fmt.Sprintf("file%d.cpp", i)
+		before := preferred(testServers, cppBasename)
+		counts[before]++
+		if preferred(append(testServers, "server4:43210"), cppBasename) != before {
+			nMoved++
+		}
+	}
+	for _, hostPort := range testServers {
+		if counts[hostPort] < nFiles/3*8/10 {
+			t.Errorf("%s is preferred for %d files of %d", hostPort, counts[hostPort], nFiles)
+		}
+	}
+	if nMoved < nFiles/4*8/10 || nMoved > nFiles/4*12/10 {
+		t.Errorf("%d files of %d moved to a new server", nMoved, nFiles)
+	}
+}
+
+// TestPlaceCompilationBurst checks that placements since a poll count as load: a burst isn't sent to one server
+func TestPlaceCompilationBurst(t *testing.T) {
+	s := MakeScheduler(time.Second, 256*1024)
+	request := &pb.PlaceCompilationRequest{ClientID: "c", CppBasename: testCppBasename, CppSize: 1000, Candidates: testServers}
+
+	// not polled yet, a daemon decides itself
+	if reply, _ := s.PlaceCompilation(context.Background(), request); reply.RemoteHostPort != "" {
+		t.Errorf("an unpolled server is chosen: %s", reply.RemoteHostPort)
+	}
+
+	s.servers[testServers[0]].status = &pb.StatusReply{CompilerQueueSize: 2}
+	s.servers[testServers[1]].status = &pb.StatusReply{CompilerQueueSize: 1}
+	s.servers[testServers[2]].status = &pb.StatusReply{CompilerQueueSize: 4, CacheOnly: true}
+	var placed []string
+	for i := 0; i < 5; i++ {
+		reply, _ := s.PlaceCompilation(context.Background(), request)
+		placed = append(placed, reply.RemoteHostPort)
+	}
+	expected := []string{testServers[0], testServers[0], testServers[1], testServers[0], testServers[1]}
+	if fmt.Sprint(placed) != fmt.Sprint(expected) {
+		t.Errorf("placed to %v, expected %v", placed, expected)
+	}
+
+	if nServers, nPlaced, nNoOpinion := s.GetStats(); nServers != 3 || nPlaced != 5 || nNoOpinion != 1 {
+		t.Errorf("unexpected stats: %d servers, %d placed, %d no opinion", nServers, nPlaced, nNoOpinion)
+	}
+	for _, load := range s.servers {
+		_ = load.connection.Close()
+	}
+}
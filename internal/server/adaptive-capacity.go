@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// AdaptiveCapacity scales a number of parallel compilers by a load of a host, within CompilerQueueSize (or a CapacitySchedule window):
+// while a 1-minute load average is above cpus (other jobs compete for them, or compilers wait for a disk), a slot is removed,
+// while it's well below, a slot is given back. When available memory drops below AdaptiveMinFreeMemory,
+// a half of slots is removed at once, and new sessions are refused with a retriable "busy" (codes.ResourceExhausted),
+// so that clients send files to other servers instead of making an OOM killer choose a compiler here.
+// Every change is advertised to clients on keepalive, like a CapacitySchedule one. It's adjusted by Cron.
+// It's nil if AdaptiveCapacity is off.
+type AdaptiveCapacity struct {
+	minSize       int
+	minFreeMemory int64 // bytes of MemAvailable
+	nCPUs         float64
+
+	current   atomic.Int64 // 0 until the first adjust
+	memoryLow atomic.Bool
+}
+
+const (
+	// a load average above nCPUs * adaptiveOverload shrinks capacity, below nCPUs * adaptiveUnderload grows it
+	adaptiveOverload  = 1.2
+	adaptiveUnderload = 0.8
+)
+
+func MakeAdaptiveCapacity(enabled bool, minSize int, minFreeMemory int64) (*AdaptiveCapacity, error) {
+	if !enabled {
+		return nil, nil
+	}
+	if minSize <= 0 {
+		return nil, fmt.Errorf("invalid AdaptiveMinQueueSize %d", minSize)
+	}
+	if _, err := readMemAvailable(); err != nil {
+		return nil, err
+	}
+	return &AdaptiveCapacity{
+		minSize:       minSize,
+		minFreeMemory: minFreeMemory,
+		nCPUs:         float64(runtime.NumCPU()),
+	}, nil
+}
+
+// Adjust is called by Cron with a configured capacity (an upper bound) and returns an effective one.
+// It changes by one slot per call (except memory pressure), so that a load average, lagging behind, can follow.
+func (adaptive *AdaptiveCapacity) Adjust(configured int) int {
+	if adaptive == nil || configured == 0 {
+		return configured
+	}
+	loadAvg, err1 := readLoadAverage()
+	memAvailable, err2 := readMemAvailable()
+	if err1 != nil || err2 != nil {
+		logServer.Error("can't read a host load, capacity is not adjusted:", err1, err2)
+		return adaptive.Effective(configured)
+	}
+
+	current := int(adaptive.current.Load())
+	if current == 0 {
+		current = configured
+	}
+	memoryLow := memAvailable < adaptive.minFreeMemory
+	switch {
+	case memoryLow:
+		current /= 2
+	case loadAvg > adaptive.nCPUs*adaptiveOverload:
+		current--
+	case loadAvg < adaptive.nCPUs*adaptiveUnderload:
+		current++
+	}
+	current = max(min(current, configured), min(adaptive.minSize, configured))
+	adaptive.current.Store(int64(current))
+
+	if adaptive.memoryLow.Swap(memoryLow) != memoryLow {
+		if memoryLow {
+			logServer.Error("low memory:", memAvailable, "bytes available, refusing new sessions")
+		} else {
+			logServer.Info(0, "memory recovered:", memAvailable, "bytes available, accepting new sessions")
+		}
+	}
+	return current
+}
+
+// Effective returns a capacity of the last adjust within a configured one, for a config reload between adjusts
+func (adaptive *AdaptiveCapacity) Effective(configured int) int {
+	if adaptive == nil || adaptive.current.Load() == 0 {
+		return configured
+	}
+	return min(int(adaptive.current.Load()), configured)
+}
+
+// IsMemoryLow tells whether new sessions are refused as "busy"
+func (adaptive *AdaptiveCapacity) IsMemoryLow() bool {
+	return adaptive != nil && adaptive.memoryLow.Load()
+}
+
+func readLoadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg %q", data)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readMemAvailable returns MemAvailable of /proc/meminfo in bytes: free memory plus caches that can be dropped
+func readMemAvailable() (int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
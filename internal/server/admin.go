@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"nocc/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// AdminService lets an operator inspect and purge caches of a running server (`nocc-server -admin`),
+// e.g. to clear a poisoned obj cache without a restart, which would lose all caches and clients.
+// It's served on AdminSocket only: a unix socket accessible by an owner of a server process, never on ListenAddr,
+// so clients can't call it. It's nil if AdminSocket is not set.
+type AdminService struct {
+	pb.UnimplementedAdminServiceServer
+
+	noccServer *NoccServer
+	grpcServer *grpc.Server
+	socketPath string
+}
+
+func MakeAdminService(noccServer *NoccServer, socketPath string) (*AdminService, error) {
+	if socketPath == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(socketPath) {
+		return nil, fmt.Errorf("AdminSocket %s must be an absolute path", socketPath)
+	}
+
+	admin := &AdminService{
+		noccServer: noccServer,
+		grpcServer: grpc.NewServer(),
+		socketPath: socketPath,
+	}
+	pb.RegisterAdminServiceServer(admin.grpcServer, admin)
+	return admin, nil
+}
+
+// StartListening serves an admin socket until a server quits; a socket is accessible by an owner only
+func (admin *AdminService) StartListening() {
+	listener, err := listenPrivately(admin.socketPath)
+	if err != nil {
+		logServer.Error("admin socket is not served:", err)
+		return
+	}
+
+	logServer.Info(0, "admin listening on", admin.socketPath)
+	if err := admin.grpcServer.Serve(listener); err != nil {
+		logServer.Error("admin socket stopped:", err)
+	}
+}
+
+func (admin *AdminService) Stop() {
+	if admin != nil {
+		admin.grpcServer.Stop()
+		_ = os.Remove(admin.socketPath)
+	}
+}
+
+// listenPrivately creates a socket in a private dir and moves it to socketPath: unlike chmod after listening,
+// a socket is never accessible by others, even for a moment (and unlike umask, other goroutines creating files aren't affected)
+func listenPrivately(socketPath string) (net.Listener, error) {
+	privateDir, err := os.MkdirTemp(filepath.Dir(socketPath), ".nocc-admin.") // 0700
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(privateDir)
+
+	tmpPath := filepath.Join(privateDir, "sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false) // it would unlink tmpPath, a socket is removed by Stop
+	if err = os.Chmod(tmpPath, 0600); err == nil {
+		err = removeStaleSocket(socketPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, socketPath)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// caches returns src and obj caches (or one of them) by a name in a request, "" is both
+func (admin *AdminService) caches(name string) (map[string]*FileCache, error) {
+	all := map[string]*FileCache{
+		"src": admin.noccServer.SrcFileCache.FileCache,
+		"obj": admin.noccServer.ObjFileCache.FileCache,
+	}
+	if name == "" {
+		return all, nil
+	}
+	if cache := all[name]; cache != nil {
+		return map[string]*FileCache{name: cache}, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unknown cache %q, expected src or obj", name)
+}
+
+// CacheStats is a grpc handler.
+func (admin *AdminService) CacheStats(_ context.Context, in *pb.CacheStatsRequest) (*pb.CacheStatsReply, error) {
+	caches, _ := admin.caches("")
+	reply := &pb.CacheStatsReply{}
+	for _, name := range []string{"src", "obj"} {
+		cache := caches[name]
+		stats := &pb.CacheStats{
+			Cache:       name,
+			FilesCount:  cache.GetFilesCount(),
+			BytesOnDisk: cache.GetBytesOnDisk(),
+			Limit:       cache.hardLimit,
+			FreeDisk:    getFreeDiskSpace(cache.cacheDir),
+			Hits:        cache.GetHitsCount(),
+			Misses:      cache.GetMissesCount(),
+			Purged:      cache.GetPurgedFilesCount(),
+		}
+		if oldestAccess := cache.GetOldestAccessTime(); !oldestAccess.IsZero() {
+			stats.OldestAccessSec = int64(time.Since(oldestAccess).Seconds())
+		}
+		for _, ns := range cache.GetNamespacesStats() {
+			stats.Namespaces = append(stats.Namespaces, &pb.CacheNamespaceEntry{Namespace: ns.Namespace, FilesCount: ns.FilesCount, BytesOnDisk: ns.BytesOnDisk, Limit: ns.Limit})
+		}
+		if in.TopEntries > 0 {
+			stats.TopEntries = cache.ListLargest(int(in.TopEntries))
+		}
+		reply.Caches = append(reply.Caches, stats)
+	}
+	return reply, nil
+}
+
+// PurgeCache is a grpc handler.
+// Without any filter, nothing is purged unless All is set: an empty request must not drop caches by mistake.
+func (admin *AdminService) PurgeCache(_ context.Context, in *pb.PurgeCacheRequest) (*pb.PurgeCacheReply, error) {
+	if in.KeyPrefix == "" && in.OlderThanSec <= 0 && in.Namespace == "" && !in.All {
+		return nil, status.Errorf(codes.InvalidArgument, "nothing to purge by: set a key prefix, an age, a namespace, or all")
+	}
+	caches, err := admin.caches(in.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	var accessedBefore time.Time
+	if in.OlderThanSec > 0 {
+		accessedBefore = time.Now().Add(-time.Duration(in.OlderThanSec) * time.Second)
+	}
+	reply := &pb.PurgeCacheReply{}
+	for name, cache := range caches {
+		nFiles, nBytes := cache.PurgeMatching(in.KeyPrefix, accessedBefore, in.Namespace)
+		logServer.Info(0, "admin purged", nFiles, "files of", nBytes, "bytes from", name, "cache,", "key prefix", in.KeyPrefix, "older than", in.OlderThanSec, "namespace", in.Namespace)
+		reply.FilesCount += nFiles
+		reply.BytesFreed += nBytes
+	}
+	return reply, nil
+}
+
+// EvictCache is a grpc handler.
+// It runs eviction that Cron does periodically (cache and namespace limits, DiskWatchdog) at once, e.g. after a config change.
+func (admin *AdminService) EvictCache(_ context.Context, _ *pb.EvictCacheRequest) (*pb.EvictCacheReply, error) {
+	caches, _ := admin.caches("")
+	purgedBefore, bytesBefore := int64(0), int64(0)
+	for _, cache := range caches {
+		purgedBefore += cache.GetPurgedFilesCount()
+		bytesBefore += cache.GetBytesOnDisk()
+	}
+
+	admin.noccServer.SrcFileCache.PurgeLastElementsIfRequired()
+	admin.noccServer.ObjFileCache.PurgeLastElementsIfRequired()
+	admin.noccServer.ObjFileCache.PurgeNamespacesOverLimit()
+	admin.noccServer.DiskWatchdog.Check()
+
+	reply := &pb.EvictCacheReply{}
+	for _, cache := range caches {
+		reply.FilesCount += cache.GetPurgedFilesCount()
+		reply.BytesFreed -= cache.GetBytesOnDisk()
+	}
+	reply.FilesCount -= purgedBefore
+	reply.BytesFreed = max(0, reply.BytesFreed+bytesBefore) // files saved meanwhile are counted too, it's approximate
+	logServer.Info(0, "admin evicted", reply.FilesCount, "files of", reply.BytesFreed, "bytes")
+	return reply, nil
+}
+
+// DialAdminSocket connects to AdminService of a server running on this machine, see `nocc-server -admin`
+func DialAdminSocket(socketPath string) (pb.AdminServiceClient, func(), error) {
+	if socketPath == "" {
+		return nil, nil, fmt.Errorf("AdminSocket is not set in a config, set -admin-socket")
+	}
+	connection, err := grpc.NewClient("unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return pb.NewAdminServiceClient(connection), func() { _ = connection.Close() }, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"nocc/pb"
+)
+
+const buildSummariesRecentCount = 50
+
+// a daemon reports reasons it knows (see client.localFallbackReason), but a broken or malicious one could send any,
+// they are merged up to this count (and this length), others are counted as buildSummariesOtherReason
+const buildSummariesMaxReasons = 64
+const buildSummariesMaxReasonLen = 64
+const buildSummariesOtherReason = "other"
+
+// BuildSummaries aggregates reports sent by daemons on quit (see client.ReportBuildSummaries).
+// Without them, a server sees only what is compiled remotely; these show what clients compile locally and why.
+// They are shown on a dashboard.
+type BuildSummaries struct {
+	mu sync.Mutex
+
+	nBuilds       int
+	nInvocations  int64
+	nRemote       int64
+	nObjCacheHits int64
+	nLocal        int64
+	nRemoteFailed int64
+	localReasons  map[string]int64
+	recent        []buildSummaryRecord // the last buildSummariesRecentCount, the newest first
+}
+
+type buildSummaryRecord struct {
+	ReceivedAt    time.Time        `json:"receivedAt"`
+	ClientHash    string           `json:"clientHash"` // not a clientID itself, a report is anonymized
+	ClientVersion string           `json:"clientVersion"`
+	BuildHash     string           `json:"buildHash"`
+	NInvocations  int32            `json:"nInvocations"`
+	NRemote       int32            `json:"nRemote"`
+	NObjCacheHits int32            `json:"nObjCacheHits"`
+	NLocal        int32            `json:"nLocal"`
+	NRemoteFailed int32            `json:"nRemoteFailed"`
+	LocalReasons  map[string]int32 `json:"localReasons"`
+}
+
+func MakeBuildSummaries() *BuildSummaries {
+	return &BuildSummaries{
+		localReasons: make(map[string]int64),
+	}
+}
+
+func (summaries *BuildSummaries) AddReport(in *pb.BuildSummaryRequest) {
+	summaries.mu.Lock()
+	defer summaries.mu.Unlock()
+
+	summaries.nBuilds++
+	summaries.nInvocations += int64(in.NInvocations)
+	summaries.nRemote += int64(in.NRemote)
+	summaries.nObjCacheHits += int64(in.NObjCacheHits)
+	summaries.nLocal += int64(in.NLocal)
+	summaries.nRemoteFailed += int64(in.NRemoteFailed)
+	localReasons := make(map[string]int32, min(len(in.LocalReasons), buildSummariesMaxReasons+1))
+	for reason, count := range in.LocalReasons {
+		if len(reason) > buildSummariesMaxReasonLen || len(localReasons) >= buildSummariesMaxReasons {
+			reason = buildSummariesOtherReason
+		}
+		localReasons[reason] += count
+	}
+	for reason, count := range localReasons {
+		if _, exists := summaries.localReasons[reason]; !exists && len(summaries.localReasons) >= buildSummariesMaxReasons {
+			reason = buildSummariesOtherReason
+		}
+		summaries.localReasons[reason] += int64(count)
+	}
+
+	clientHash := sha256.Sum256([]byte(in.ClientID))
+	record := buildSummaryRecord{
+		ReceivedAt:    time.Now(),
+		ClientHash:    hex.EncodeToString(clientHash[:8]),
+		ClientVersion: in.ClientVersion,
+		BuildHash:     in.BuildHash,
+		NInvocations:  in.NInvocations,
+		NRemote:       in.NRemote,
+		NObjCacheHits: in.NObjCacheHits,
+		NLocal:        in.NLocal,
+		NRemoteFailed: in.NRemoteFailed,
+		LocalReasons:  localReasons,
+	}
+	summaries.recent = append([]buildSummaryRecord{record}, summaries.recent...)
+	if len(summaries.recent) > buildSummariesRecentCount {
+		summaries.recent = summaries.recent[:buildSummariesRecentCount]
+	}
+}
+
+type dashboardBuildSummaries struct {
+	NBuilds       int                  `json:"nBuilds"`
+	NInvocations  int64                `json:"nInvocations"`
+	NRemote       int64                `json:"nRemote"`
+	NObjCacheHits int64                `json:"nObjCacheHits"`
+	NLocal        int64                `json:"nLocal"`
+	NRemoteFailed int64                `json:"nRemoteFailed"`
+	LocalReasons  map[string]int64     `json:"localReasons"`
+	Recent        []buildSummaryRecord `json:"recent"`
+}
+
+func (summaries *BuildSummaries) makeDashboardBuildSummaries() dashboardBuildSummaries {
+	summaries.mu.Lock()
+	defer summaries.mu.Unlock()
+
+	localReasons := make(map[string]int64, len(summaries.localReasons))
+	for reason, count := range summaries.localReasons {
+		localReasons[reason] = count
+	}
+	return dashboardBuildSummaries{
+		NBuilds:       summaries.nBuilds,
+		NInvocations:  summaries.nInvocations,
+		NRemote:       summaries.nRemote,
+		NObjCacheHits: summaries.nObjCacheHits,
+		NLocal:        summaries.nLocal,
+		NRemoteFailed: summaries.nRemoteFailed,
+		LocalReasons:  localReasons,
+		Recent:        append([]buildSummaryRecord{}, summaries.recent...),
+	}
+}
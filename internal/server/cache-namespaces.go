@@ -0,0 +1,115 @@
+package server
+
+import (
+	"sort"
+)
+
+// Cache namespaces split obj cache by projects (a client sends CacheNamespace of its .nocc.toml, it's a part of an obj cache key)
+// or by compilers (ObjCacheNamespaceByCompiler, for sessions without a project namespace; only accounted, a compiler is in a key anyway).
+// Files of a namespace are counted separately, may be bounded by ObjCacheNamespaceLimits and purged without touching others.
+// Files without a namespace (src cache, objects pushed by other servers, pch) are bounded by a cache limit only.
+type cacheNamespace struct {
+	nFiles int64
+	nBytes int64
+}
+
+type CacheNamespaceStats struct {
+	Namespace   string `json:"namespace"`
+	FilesCount  int64  `json:"filesCount"`
+	BytesOnDisk int64  `json:"bytesOnDisk"`
+	Limit       int64  `json:"limit"` // 0 if not bounded
+}
+
+// addToNamespace accounts a saved (or removed, with negative deltas) file, it's called under mu
+func (cache *FileCache) addToNamespace(namespace string, nBytes int64, nFiles int64) {
+	if namespace == "" {
+		return
+	}
+	ns := cache.namespaces[namespace]
+	if ns == nil {
+		ns = &cacheNamespace{}
+		cache.namespaces[namespace] = ns
+	}
+	ns.nFiles += nFiles
+	ns.nBytes += nBytes
+	if ns.nFiles <= 0 {
+		delete(cache.namespaces, namespace)
+	}
+}
+
+// PurgeNamespace deletes all files of a namespace, returns how many were deleted
+func (cache *FileCache) PurgeNamespace(namespace string) (nFiles int64, nBytes int64) {
+	return cache.purgeFromLruTail(func(file cachedFile) bool {
+		return file.namespace == namespace && namespace != ""
+	})
+}
+
+// PurgeNamespacesOverLimit deletes the least recently used files of every namespace exceeding its limit, called by Cron.
+// Unlike a cache limit, it's not checked on every save: namespaces are walked in lru, that's too long for a hot path.
+func (cache *FileCache) PurgeNamespacesOverLimit() {
+	if len(cache.NamespaceLimits) == 0 {
+		return
+	}
+
+	cache.mu.RLock()
+	overLimit := false
+	for namespace, ns := range cache.namespaces {
+		if limit := cache.NamespaceLimits[namespace]; limit > 0 && ns.nBytes > limit {
+			overLimit = true
+		}
+	}
+	cache.mu.RUnlock()
+	if !overLimit {
+		return
+	}
+
+	nFiles, nBytes := cache.purgeFromLruTail(func(file cachedFile) bool {
+		limit := cache.NamespaceLimits[file.namespace]
+		return limit > 0 && cache.namespaces[file.namespace] != nil && cache.namespaces[file.namespace].nBytes > limit
+	})
+	logServer.Info(1, "evicted", nFiles, "files of", nBytes, "bytes from namespaces over their limits")
+}
+
+// purgeFromLruTail walks files from the least recently used and deletes ones matching shouldPurge.
+// shouldPurge is called under mu, namespaces are already updated for files removed before.
+func (cache *FileCache) purgeFromLruTail(shouldPurge func(file cachedFile) bool) (nFiles int64, nBytes int64) {
+	removedFiles := make([]cachedFile, 0)
+	cache.mu.Lock()
+	for node := cache.lruTail; node != nil; {
+		prev := node.prev
+		if shouldPurge(cache.table[node.key]) {
+			removedFiles = append(removedFiles, cache.removeFromTable(node.key))
+		}
+		node = prev
+	}
+	cache.mu.Unlock()
+
+	for _, removedFile := range removedFiles {
+		cache.deleteRemovedFile(removedFile)
+		nBytes += removedFile.fileSize
+	}
+	return int64(len(removedFiles)), nBytes
+}
+
+// GetNamespacesStats returns namespaces having files or a limit, the largest first
+func (cache *FileCache) GetNamespacesStats() []CacheNamespaceStats {
+	cache.mu.RLock()
+	stats := make([]CacheNamespaceStats, 0, len(cache.namespaces))
+	for namespace, ns := range cache.namespaces {
+		stats = append(stats, CacheNamespaceStats{Namespace: namespace, FilesCount: ns.nFiles, BytesOnDisk: ns.nBytes, Limit: cache.NamespaceLimits[namespace]})
+	}
+	for namespace, limit := range cache.NamespaceLimits {
+		if cache.namespaces[namespace] == nil {
+			stats = append(stats, CacheNamespaceStats{Namespace: namespace, Limit: limit})
+		}
+	}
+	cache.mu.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].BytesOnDisk != stats[j].BytesOnDisk {
+			return stats[i].BytesOnDisk > stats[j].BytesOnDisk
+		}
+		return stats[i].Namespace < stats[j].Namespace
+	})
+	return stats
+}
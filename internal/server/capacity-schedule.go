@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CapacityWindow is one entry of [[CapacitySchedule]] in server.conf, for example
+//
+//	[[CapacitySchedule]]
+//	Days = ["Mon", "Tue", "Wed", "Thu", "Fri"]
+//	From = "22:00"
+//	To = "06:00"
+//	CompilerQueueSize = 4
+//
+// Days are optional (every day if empty). If To is less than From, a window lasts over midnight
+// (and Days mean the days when it starts).
+type CapacityWindow struct {
+	Days              []string
+	From              string
+	To                string
+	CompilerQueueSize int
+}
+
+// CapacitySchedule calculates CompilerQueueSize at a given time: servers often share hosts with other jobs
+// (nightly builds, tests), and while they run, nocc-server should use fewer cores.
+// The current value is applied to CompilerLauncher by Cron and advertised to clients (see KeepAlive),
+// so that they send fewer files here and more to other servers.
+type CapacitySchedule struct {
+	defaultSize int
+	windows     []capacityWindow
+}
+
+type capacityWindow struct {
+	days     map[time.Weekday]bool // empty means every day
+	fromMin  int                   // minutes since midnight
+	toMin    int
+	capacity int
+}
+
+var weekdaysByName = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func MakeCapacitySchedule(defaultSize int, windows []CapacityWindow) (*CapacitySchedule, error) {
+	schedule := &CapacitySchedule{
+		defaultSize: defaultSize,
+		windows:     make([]capacityWindow, 0, len(windows)),
+	}
+
+	for _, w := range windows {
+		parsed := capacityWindow{
+			days:     make(map[time.Weekday]bool),
+			capacity: w.CompilerQueueSize,
+		}
+		var err error
+		if parsed.fromMin, err = parseTimeOfDay(w.From); err != nil {
+			return nil, err
+		}
+		if parsed.toMin, err = parseTimeOfDay(w.To); err != nil {
+			return nil, err
+		}
+		if w.CompilerQueueSize <= 0 {
+			return nil, fmt.Errorf("invalid CompilerQueueSize %d in a capacity window %s-%s", w.CompilerQueueSize, w.From, w.To)
+		}
+		for _, day := range w.Days {
+			weekday, ok := weekdaysByName[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q in a capacity window, expected Mon/Tue/etc.", day)
+			}
+			parsed.days[weekday] = true
+		}
+		schedule.windows = append(schedule.windows, parsed)
+	}
+
+	return schedule, nil
+}
+
+// parseTimeOfDay converts "22:30" to minutes since midnight
+func parseTimeOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q in a capacity window, expected HH:MM", hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// CapacityAt returns CompilerQueueSize of the first matching window, or the default one
+func (schedule *CapacitySchedule) CapacityAt(now time.Time) int {
+	nowMin := now.Hour()*60 + now.Minute()
+	for _, w := range schedule.windows {
+		if w.fromMin <= w.toMin {
+			if nowMin >= w.fromMin && nowMin < w.toMin && w.isOnDay(now.Weekday()) {
+				return w.capacity
+			}
+		} else {
+			// over midnight: 22:00-06:00 on Fri also covers Sat 00:00-06:00
+			if nowMin >= w.fromMin && w.isOnDay(now.Weekday()) {
+				return w.capacity
+			}
+			if nowMin < w.toMin && w.isOnDay(now.AddDate(0, 0, -1).Weekday()) {
+				return w.capacity
+			}
+		}
+	}
+	return schedule.defaultSize
+}
+
+func (w *capacityWindow) isOnDay(weekday time.Weekday) bool {
+	return len(w.days) == 0 || w.days[weekday]
+}
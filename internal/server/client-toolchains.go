@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ClientToolchains lets clients upload their own compilers (UploadToolchain of a client), off unless AcceptClientToolchains is set.
+// An uploaded compiler is an arbitrary binary with libraries and ld.so.cache chosen by a client,
+// and a server usually runs as root (a chroot requires it), which can escape a chroot.
+// That's why such compilers are launched as an unprivileged user, never as a server user.
+// Every client gets its own uid (and gid) from ClientToolchainsUids: with one user for all, a compiler of one client
+// could ptrace a compiler of another one and change its output (which is then saved to obj cache).
+// Without a range, all of them run as ClientToolchainsUser.
+type ClientToolchains struct {
+	sharedCredential *syscall.Credential // ClientToolchainsUser, if ClientToolchainsUids is empty
+
+	mu       sync.Mutex
+	firstUid uint32
+	nUids    uint32
+	uids     map[string]*clientUid // by clientID, at most nUids
+}
+
+type clientUid struct {
+	credential *syscall.Credential
+	lastUsed   time.Time
+}
+
+// MakeClientToolchains returns nil if client toolchains are not accepted
+func MakeClientToolchains(accept bool, uidRange string, userName string) (*ClientToolchains, error) {
+	if !accept {
+		return nil, nil
+	}
+	if uidRange != "" {
+		return makeClientToolchainsWithUids(uidRange)
+	}
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if uid == 0 || gid == 0 {
+		return nil, fmt.Errorf("user %s is privileged, uploaded compilers must not run as root", userName)
+	}
+
+	// empty Groups drop supplementary groups of a server
+	return &ClientToolchains{sharedCredential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}}, nil
+}
+
+// makeClientToolchainsWithUids parses ClientToolchainsUids like "1000000-1065535"
+func makeClientToolchainsWithUids(uidRange string) (*ClientToolchains, error) {
+	firstStr, lastStr, _ := strings.Cut(uidRange, "-")
+	first, err := strconv.ParseUint(firstStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ClientToolchainsUids %q: %v", uidRange, err)
+	}
+	last, err := strconv.ParseUint(lastStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ClientToolchainsUids %q: %v", uidRange, err)
+	}
+	if first == 0 || last < first {
+		return nil, fmt.Errorf("invalid ClientToolchainsUids %q, expected a range of unprivileged uids", uidRange)
+	}
+
+	return &ClientToolchains{
+		firstUid: uint32(first),
+		nUids:    uint32(last - first + 1),
+		uids:     make(map[string]*clientUid),
+	}, nil
+}
+
+// credentialOf returns a uid of a client, the same for all its compilers.
+// When all uids of a range are taken, a uid of the least recently compiling client is given to a new one.
+func (toolchains *ClientToolchains) credentialOf(clientID string) *syscall.Credential {
+	if toolchains.sharedCredential != nil {
+		return toolchains.sharedCredential
+	}
+
+	toolchains.mu.Lock()
+	defer toolchains.mu.Unlock()
+	assigned := toolchains.uids[clientID]
+	if assigned == nil {
+		uid := toolchains.firstUid + uint32(len(toolchains.uids))
+		if uint32(len(toolchains.uids)) >= toolchains.nUids {
+			uid = toolchains.deleteLeastRecentlyUsed()
+		}
+		// empty Groups drop supplementary groups of a server
+		assigned = &clientUid{credential: &syscall.Credential{Uid: uid, Gid: uid, Groups: []uint32{}}}
+		toolchains.uids[clientID] = assigned
+	}
+	assigned.lastUsed = time.Now()
+	return assigned.credential
+}
+
+// deleteLeastRecentlyUsed is called under mu when all uids are taken, it returns a freed uid
+func (toolchains *ClientToolchains) deleteLeastRecentlyUsed() uint32 {
+	oldestClientID := ""
+	var oldest *clientUid
+	for clientID, assigned := range toolchains.uids {
+		if oldest == nil || assigned.lastUsed.Before(oldest.lastUsed) {
+			oldestClientID, oldest = clientID, assigned
+		}
+	}
+	delete(toolchains.uids, oldestClientID)
+	return oldest.credential.Uid
+}
+
+// prepareCommand makes an uploaded compiler run unprivileged: it can write only to dirs of its output and TMPDIR
+func (toolchains *ClientToolchains) prepareCommand(compilerCommand *exec.Cmd, clientID string, workingDir string, compileOutput string) error {
+	credential := toolchains.credentialOf(clientID)
+	for _, dir := range []string{path.Dir(compileOutput), "/tmp"} {
+		mkdirAllInChroot(workingDir, dir)
+		if err := chownInChroot(workingDir, dir, credential); err != nil {
+			return err
+		}
+	}
+
+	compilerCommand.SysProcAttr.Credential = credential
+	compilerCommand.Env = append(compilerCommand.Environ(), "TMPDIR=/tmp")
+	return nil
+}
+
+// chownInChroot gives a dir to an unprivileged user; like mkdirAllInChroot, it doesn't follow symlinks outside a chroot
+func chownInChroot(workingDir string, dir string, credential *syscall.Credential) error {
+	resolvedRoot, err := filepath.EvalSymlinks(workingDir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(path.Join(workingDir, dir))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resolved, resolvedRoot+"/") {
+		return fmt.Errorf("%s is outside a working dir", dir)
+	}
+	return os.Lchown(resolved, int(credential.Uid), int(credential.Gid))
+}
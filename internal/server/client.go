@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,7 +19,7 @@ import (
 //
 // For example, a client uploads 3 files: /home/alice/1.cpp, /home/alice/1.h, /usr/include/math.h.
 // They are saved to ${SrcCacheDir}/cpp/clients/{clientID}/home/alice/1.cpp and so on.
-// (if math.h is equal to a server system include /usr/include/math.h, it isn't requested to be uploaded).
+// (if /usr/include is equal to a server one, see SystemHeaders, math.h isn't uploaded: that dir is mounted instead).
 //
 // fileInClientDir also represents files in the process of uploading, before actually saved to a disk (state field).
 //
@@ -32,6 +33,8 @@ type fileInClientDir struct {
 
 	state           atomic.Int32 // fsFileState*
 	uploadStartTime time.Time
+	deltaBase       common.SHA256 // a previous version offered to upload a delta against, see offerDeltaBases
+	gated           atomic.Bool   // a placeholder that a compiler may open before it's uploaded, see PipelinedUploads
 
 	serverFileName string // abs path, see Client.MapClientFileNameToServerAbs
 }
@@ -42,16 +45,33 @@ type fileInClientDir struct {
 // Every client as a workingDir, where all files uploaded from that client are saved to.
 type Client struct {
 	clientID   string
-	workingDir string    // ${SrcCacheDir}/cpp/clients/{clientID}
-	lastSeen   time.Time // to detect when a client becomes inactive
+	workingDir string       // ${SrcCacheDir}/cpp/clients/{clientID}
+	lastSeen   atomic.Int64 // unix nano, to detect when a client becomes inactive; written by KeepAlive, read by Cron and dashboard
 
-	mu       sync.RWMutex
-	sessions map[uint32]*Session
-	files    map[string]*fileInClientDir // from clientFileName to a server file
-	dirs     map[string]bool             // not to call MkdirAll for every file, key is path.Dir(serverFileName)
+	uploadsToolchain bool // a client's compiler is uploaded into workingDir, CompilerDirs are not mounted
 
-	chanDisconnected  chan struct{}
-	chanReadySessions chan *Session
+	systemHeaders    map[string]common.SHA256 // SystemHeaderDirs accepted from a client (mounted into workingDir), see SystemHeaders
+	systemHeadersKey common.SHA256            // mixed into obj cache keys, empty if no dirs are accepted
+
+	onDemand *onDemandRoot // nil unless a client serves includes on demand, see OnDemandIncludes
+
+	mu        sync.RWMutex
+	sessions  map[uint32]*Session
+	files     map[string]*fileInClientDir // from clientFileName to a server file
+	dirs      map[string]bool             // not to call MkdirAll for every file, key is path.Dir(serverFileName)
+	snapshots map[string]*placedSnapshot  // by snapshot id, see placeSnapshot
+
+	chanDisconnected       chan struct{}
+	chanReadySessions      chan *Session
+	chanReadyLargeSessions chan *Session // .o files >= largeObjFileSize, not to be sent via SmallObjsOnly recv streams
+}
+
+func (client *Client) touch() {
+	client.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (client *Client) LastSeen() time.Time {
+	return time.Unix(0, client.lastSeen.Load())
 }
 
 func (client *Client) makeNewFile(clientFileName string, fileSize int64, isSymlink bool, symlinkTarget string, fileSHA256 common.SHA256) *fileInClientDir {
@@ -87,12 +107,46 @@ func (client *Client) RegisterCreatedSession(session *Session) {
 func (client *Client) CloseSession(session *Session) {
 	client.mu.Lock()
 	delete(client.sessions, session.sessionID)
+	session.files = nil // under a lock, see ExpireSession
 	client.mu.Unlock()
 
 	if !session.objCacheExists { // delete ${ObjCacheDir}/compiler-out/this.o (already hard linked to obj cache)
 		_ = os.Remove(session.OutputFile)
+		if session.moduleOutputFile != "" {
+			_ = os.Remove(session.moduleOutputFile)
+		}
+		for _, fileName := range session.sideOutputFiles {
+			_ = os.Remove(fileName)
+		}
+	}
+}
+
+// ExpireSession interrupts a session living too long, see ClientsStorage.DeleteExpiredSessions.
+// It isn't closed here: handlers and a compiler goroutine may still use it, so it's closed once by the one sending it
+// (as interrupted: a client gave up on it anyway). If a compiler hasn't been launched (e.g. uploads hanged),
+// nobody would send it, so it's taken here and pushed to a ready channel.
+// Its files that are still being uploaded are marked as failed, so that the next session re-requests them immediately.
+// It returns false if a session has already expired (it's in the ready channel, but not sent yet).
+func (client *Client) ExpireSession(session *Session) bool {
+	if session.expired.Swap(true) {
+		return false
+	}
+
+	client.mu.RLock()
+	files := session.files
+	client.mu.RUnlock()
+	for _, file := range files {
+		if client.IsFileUploadHanged(file) {
+			file.state.CompareAndSwap(fsFileStateUploading, fsFileStateUploadError)
+		}
 	}
-	session.files = nil
+
+	session.interrupt()
+	if session.compilationStarted.Swap(1) == 0 {
+		session.interrupted = true
+		go client.PushToClientReadyChannel(session)
+	}
+	return true
 }
 
 func (client *Client) GetSession(sessionID uint32) *Session {
@@ -108,11 +162,20 @@ func (client *Client) InterruptSession(sessionID uint32) {
 	session := client.sessions[sessionID]
 	if session != nil {
 		logServer.Info(0, "interrupting session by user request", "clientID", client.clientID, "sessionID", sessionID)
-		close(session.interruptchan)
+		session.interrupt()
 	}
 	client.mu.RUnlock()
 }
 
+// endSessionSpans ends spans of sessions that will never be sent: a client has gone, chanDisconnected is closed.
+// A session being sent right now could end its span too, Span.End is no-op then.
+func (client *Client) endSessionSpans() {
+	for _, session := range client.GetAllSessions() {
+		session.span.SetAttribute("nocc.client_stopped", true)
+		session.span.End()
+	}
+}
+
 func (client *Client) GetActiveSessionsCount() int {
 	client.mu.RLock()
 	count := len(client.sessions)
@@ -121,6 +184,29 @@ func (client *Client) GetActiveSessionsCount() int {
 	return count
 }
 
+func (client *Client) GetAllSessions() []*Session {
+	client.mu.RLock()
+	sessions := make([]*Session, 0, len(client.sessions))
+	for _, session := range client.sessions {
+		sessions = append(sessions, session)
+	}
+	client.mu.RUnlock()
+	return sessions
+}
+
+// GetCompilingSessionIDs returns sessions that started compilation and are not sent yet (reported via KeepAlive)
+func (client *Client) GetCompilingSessionIDs() []uint32 {
+	sessionIDs := make([]uint32, 0)
+	client.mu.RLock()
+	for _, session := range client.sessions {
+		if session.compilationStarted.Load() != 0 {
+			sessionIDs = append(sessionIDs, session.sessionID)
+		}
+	}
+	client.mu.RUnlock()
+	return sessionIDs
+}
+
 func (client *Client) GetSessionsNotStartedCompilation() []*Session {
 	sessions := make([]*Session, 0)
 	client.mu.RLock()
@@ -198,6 +284,28 @@ func (client *Client) MkdirAllForSession(session *Session) {
 	client.mu.Unlock()
 }
 
+// MkdirAllIncludeDirs creates -I/-isystem/etc. dirs that a client has, but no files from them were uploaded
+// (e.g., they are empty or contain only unused headers).
+// Otherwise, a compiler would warn about them with -Wmissing-include-dirs, unlike a local one (and fail with -Werror).
+// Like in MkdirAllForSession, every dir is created once (dirs inside read-only mounted CompilerDirs can't be, they are skipped).
+// It's called right before compiling, when all files (including symlinks) are already in place.
+func (client *Client) MkdirAllIncludeDirs(includeDirs []string) {
+	for _, dir := range includeDirs {
+		key := client.MapClientFileNameToServerAbs(dir) + "/" // as filepath.Split in MkdirAllForSession
+		client.mu.RLock()
+		created := client.dirs[key]
+		client.mu.RUnlock()
+		if created {
+			continue
+		}
+
+		mkdirAllInChroot(client.workingDir, dir)
+		client.mu.Lock()
+		client.dirs[key] = true
+		client.mu.Unlock()
+	}
+}
+
 // IsFileUploadHanged checks whether a file upload lasts too long, and a file should be re-requested.
 // A timeout depends on file size: for instance, .nocc-pch files are big, we'll wait for them for a long time
 // (especially when nocc client uploads it to all servers, the network on a client machine suffers).
@@ -225,6 +333,36 @@ func (client *Client) RemoveWorkingDir() {
 	}()
 }
 
+// copyFilesInPlace returns files and dirs of a stopped client that exist in its working dir, to be reused on restart.
+// Files being uploaded are skipped (they will be requested again); pch states are reset unless compiled.
+// They are copied, since goroutines of a stopped client may still change states of its files.
+func (client *Client) copyFilesInPlace() (map[string]*fileInClientDir, map[string]bool) {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+
+	files := make(map[string]*fileInClientDir, len(client.files))
+	for clientFileName, file := range client.files {
+		state := file.state.Load()
+		if state < fsFileStateUploaded {
+			continue
+		}
+		if state != fsFileStatePchCompiled {
+			state = fsFileStateUploaded
+		}
+
+		copied := &fileInClientDir{
+			fileSize:       file.fileSize,
+			fileSHA256:     file.fileSHA256,
+			isSymlink:      file.isSymlink,
+			symlinkTarget:  file.symlinkTarget,
+			serverFileName: file.serverFileName,
+		}
+		copied.state.Store(state)
+		files[clientFileName] = copied
+	}
+	return files, maps.Clone(client.dirs)
+}
+
 func (client *Client) FilesCount() int64 {
 	client.mu.RLock()
 	filesCount := len(client.files)
@@ -233,10 +371,15 @@ func (client *Client) FilesCount() int64 {
 }
 
 func (client *Client) PushToClientReadyChannel(session *Session) {
+	chanReady := client.chanReadySessions
+	if session.hasLargeOutputFile() {
+		chanReady = client.chanReadyLargeSessions
+	}
+
 	// a client could have disconnected while compiler was working, then chanDisconnected is closed
 	select {
 	case <-client.chanDisconnected:
-	case client.chanReadySessions <- session:
+	case chanReady <- session:
 		// note, that if this chan is full, this 'case' (and this function call) is blocking
 	}
 }
@@ -4,8 +4,14 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"nocc/internal/common"
+
+	"golang.org/x/sys/unix"
 )
 
 // defaultMappedFolders are folders that are bind-mounted to a client working directory.
@@ -20,25 +26,30 @@ var defaultMappedFolders = []string{
 // ClientsStorage contains all active clients connected to this server.
 // After a client is not active for some time, it's deleted (and its working directory is removed from a hard disk).
 type ClientsStorage struct {
-	table map[string]*Client
-	mu    sync.RWMutex
+	table    map[string]*Client
+	retained map[string]*Client // stopped clients whose working dirs are kept, see RetainClient
+	mu       sync.RWMutex
 
-	romountPaths RoMountPaths
-	rwmountPaths RwMountPaths
-	clientsDir   string // ${SrcCacheDir}/clients
+	romountPaths     RoMountPaths
+	rwmountPaths     RwMountPaths
+	systemHeaderDirs []string // all SystemHeaderDirs from config, a client mounts only accepted ones
+	clientsDir       string   // ${SrcCacheDir}/clients
 
-	lastPurgeTime time.Time
+	lastPurgeTime        time.Time
+	expiredSessionsCount atomic.Int64
 
 	uniqueRemotesList map[string]string
 }
 
-func MakeClientsStorage(compilerDirs []string, srccacheDir string, objcacheDir string) (*ClientsStorage, error) {
+func MakeClientsStorage(compilerDirs []string, srccacheDir string, objcacheDir string, systemHeaderDirs []string) (*ClientsStorage, error) {
 	clientStorage := &ClientsStorage{
 		table:             make(map[string]*Client, 1024),
+		retained:          make(map[string]*Client),
 		clientsDir:        path.Join(srccacheDir, "clients"),
 		uniqueRemotesList: make(map[string]string, 1),
 		romountPaths:      makeRoMountPaths(append(defaultMappedFolders, compilerDirs...)...),
 		rwmountPaths:      makeRwMountPaths(objcacheDir),
+		systemHeaderDirs:  systemHeaderDirs,
 	}
 
 	if err := clientStorage.prepareEmptyDir(); err != nil {
@@ -56,7 +67,7 @@ func (allClients *ClientsStorage) GetClient(clientID string) *Client {
 	return client
 }
 
-func (allClients *ClientsStorage) OnClientConnected(clientID string) (*Client, error) {
+func (allClients *ClientsStorage) OnClientConnected(clientID string, uploadsToolchain bool, systemHeaders map[string]common.SHA256) (*Client, error) {
 	allClients.mu.RLock()
 	client := allClients.table[clientID]
 	allClients.mu.RUnlock()
@@ -69,28 +80,60 @@ func (allClients *ClientsStorage) OnClientConnected(clientID string) (*Client, e
 		allClients.DeleteClient(client)
 	}
 
-	workingDir := path.Join(allClients.clientsDir, clientID)
-	if err := os.Mkdir(workingDir, os.ModePerm); err != nil {
-		return nil, fmt.Errorf("can't create client working directory: %v", err)
-	}
+	allClients.mu.Lock()
+	retained := allClients.retained[clientID]
+	delete(allClients.retained, clientID)
+	allClients.mu.Unlock()
 
-	if err := BindmountPaths(workingDir, allClients.romountPaths.MountPaths); err != nil {
-		return nil, err
+	// a working dir is mounted differently for clients uploading a toolchain (or with other system headers), it can't be reused then
+	systemHeaderDirs := sortedSystemHeaderDirs(systemHeaders)
+	if retained != nil && (retained.uploadsToolchain != uploadsToolchain || !slices.Equal(sortedSystemHeaderDirs(retained.systemHeaders), systemHeaderDirs)) {
+		allClients.deleteRetainedClient(retained)
+		retained = nil
 	}
-	if err := BindmountPaths(workingDir, allClients.rwmountPaths.MountPaths); err != nil {
-		return nil, err
+
+	workingDir := path.Join(allClients.clientsDir, clientID)
+	files := make(map[string]*fileInClientDir, 1024)
+	dirs := make(map[string]bool, 100)
+	if retained != nil {
+		files, dirs = retained.copyFilesInPlace()
+		logServer.Info(0, "client restarted, reusing working dir", "clientID", clientID, "stopped sec ago", int(time.Since(retained.LastSeen()).Seconds()), "num files", len(files))
+	} else {
+		if err := os.Mkdir(workingDir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("can't create client working directory: %v", err)
+		}
+
+		// a client uploading its own compiler (with libraries) doesn't see server ones: they would be shadowed anyway,
+		// and nothing can be uploaded into read-only mounted dirs
+		if !uploadsToolchain {
+			if err := BindmountPaths(workingDir, allClients.romountPaths.MountPaths); err != nil {
+				return nil, err
+			}
+		}
+		if err := BindmountPaths(workingDir, allClients.rwmountPaths.MountPaths); err != nil {
+			return nil, err
+		}
+		if err := BindmountPaths(workingDir, makeRoMountPaths(systemHeaderDirs...).MountPaths); err != nil {
+			allClients.CleanupMounts(clientID, uploadsToolchain, nil)
+			return nil, err
+		}
 	}
 
 	client = &Client{
-		clientID:          clientID,
-		workingDir:        workingDir,
-		lastSeen:          time.Now(),
-		sessions:          make(map[uint32]*Session, 20),
-		files:             make(map[string]*fileInClientDir, 1024),
-		dirs:              make(map[string]bool, 100),
-		chanDisconnected:  make(chan struct{}),
-		chanReadySessions: make(chan *Session, 200),
+		clientID:               clientID,
+		workingDir:             workingDir,
+		uploadsToolchain:       uploadsToolchain,
+		systemHeaders:          systemHeaders,
+		systemHeadersKey:       systemHeadersObjCacheKey(systemHeaders),
+		sessions:               make(map[uint32]*Session, 20),
+		files:                  files,
+		dirs:                   dirs,
+		snapshots:              make(map[string]*placedSnapshot),
+		chanDisconnected:       make(chan struct{}),
+		chanReadySessions:      make(chan *Session, 200),
+		chanReadyLargeSessions: make(chan *Session, 200),
 	}
+	client.touch()
 
 	allClients.mu.Lock()
 	allClients.table[clientID] = client
@@ -106,7 +149,7 @@ func (allClients *ClientsStorage) prepareEmptyDir() error {
 		}
 
 		for _, e := range entries {
-			allClients.CleanupMounts(e.Name())
+			allClients.CleanupMounts(e.Name(), false, allClients.systemHeaderDirs)
 		}
 
 		_ = os.RemoveAll(allClients.clientsDir)
@@ -119,24 +162,100 @@ func (allClients *ClientsStorage) prepareEmptyDir() error {
 	return nil
 }
 
-func (allClients *ClientsStorage) CleanupMounts(clientID string) {
+// PrepareCompilerProbesRoot creates a chroot for CompilerProbes, mounted like a client working dir, but without client files:
+// probes are shared by all clients, so a compiler must not see files uploaded by any of them
+func (allClients *ClientsStorage) PrepareCompilerProbesRoot() (string, error) {
+	root := path.Join(path.Dir(allClients.clientsDir), "compiler-probes")
+	UnmountPaths(root, allClients.romountPaths.MountPaths) // left by a previous launch
+	if err := os.RemoveAll(root); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return "", err
+	}
+	return root, BindmountPaths(root, allClients.romountPaths.MountPaths)
+}
+
+func (allClients *ClientsStorage) CleanupMounts(clientID string, uploadsToolchain bool, systemHeaderDirs []string) {
 	workingDir := path.Join(allClients.clientsDir, clientID)
-	UnmountPaths(workingDir, allClients.romountPaths.MountPaths)
+	// they may be mounted inside CompilerDirs, so they are unmounted first
+	UnmountPaths(workingDir, makeRoMountPaths(systemHeaderDirs...).MountPaths)
+	if !uploadsToolchain {
+		UnmountPaths(workingDir, allClients.romountPaths.MountPaths)
+	}
 	UnmountPaths(workingDir, allClients.rwmountPaths.MountPaths)
 }
 
+// OnDemandMounts are server dirs mounted into a root of OnDemandIncludes, the same as into a client working dir
+func (allClients *ClientsStorage) OnDemandMounts(client *Client) []onDemandMount {
+	mounts := make([]onDemandMount, 0)
+	for _, dir := range allClients.romountPaths.paths {
+		mounts = append(mounts, onDemandMount{source: dir, target: dir, flags: allClients.romountPaths.flags})
+	}
+	for _, dir := range allClients.rwmountPaths.paths {
+		mounts = append(mounts, onDemandMount{source: dir, target: dir, flags: allClients.rwmountPaths.flags})
+	}
+	for _, dir := range sortedSystemHeaderDirs(client.systemHeaders) {
+		mounts = append(mounts, onDemandMount{source: dir, target: dir, flags: unix.MS_RDONLY})
+	}
+	return mounts
+}
+
 func (allClients *ClientsStorage) DeleteClient(client *Client) {
 	allClients.mu.Lock()
 	delete(allClients.table, client.clientID)
 	allClients.mu.Unlock()
 
-	allClients.CleanupMounts(client.clientID)
+	allClients.CleanupMounts(client.clientID, client.uploadsToolchain, sortedSystemHeaderDirs(client.systemHeaders))
 
 	close(client.chanDisconnected)
+	client.endSessionSpans()
+	client.onDemand.unmount()
 	// don't close chanReadySessions intentionally, it's not a leak
 	client.RemoveWorkingDir()
 }
 
+// RetainClient is called when a daemon quits, but its clientID is stable (see pb.StopClientRequest.KeepWorkingDir).
+// A daemon quits after a build (in 15 seconds of idle), and a next build is often soon: with a new daemon launch,
+// a client would upload all files again, and a server would mirror its dir tree again (hard linking from src cache).
+// Instead, a working dir with mounts is kept, and a client restarted within ClientRetention continues using it.
+// Sessions are stopped as for a deleted client: chanDisconnected kills running compilers.
+func (allClients *ClientsStorage) RetainClient(client *Client) {
+	client.touch() // a time of stop, see DeleteExpiredRetainedClients
+
+	allClients.mu.Lock()
+	delete(allClients.table, client.clientID)
+	allClients.retained[client.clientID] = client
+	allClients.mu.Unlock()
+
+	close(client.chanDisconnected)
+	client.endSessionSpans()
+	client.onDemand.unmount() // a restarted client mounts it again, it's cheap unlike a working dir
+}
+
+// DeleteExpiredRetainedClients deletes working dirs of clients stopped earlier than clientRetention ago
+func (allClients *ClientsStorage) DeleteExpiredRetainedClients(clientRetention time.Duration) {
+	expired := make([]*Client, 0)
+	allClients.mu.Lock()
+	for clientID, client := range allClients.retained {
+		if time.Since(client.LastSeen()) > clientRetention {
+			expired = append(expired, client)
+			delete(allClients.retained, clientID)
+		}
+	}
+	allClients.mu.Unlock()
+
+	for _, client := range expired {
+		logServer.Info(0, "delete retained client", "clientID", client.clientID, "num files", client.FilesCount())
+		allClients.deleteRetainedClient(client)
+	}
+}
+
+func (allClients *ClientsStorage) deleteRetainedClient(client *Client) {
+	allClients.CleanupMounts(client.clientID, client.uploadsToolchain, sortedSystemHeaderDirs(client.systemHeaders))
+	client.RemoveWorkingDir()
+}
+
 func (allClients *ClientsStorage) DeleteInactiveClients() {
 	now := time.Now()
 	if now.Sub(allClients.lastPurgeTime) < time.Minute {
@@ -147,7 +266,7 @@ func (allClients *ClientsStorage) DeleteInactiveClients() {
 		var inactiveClient *Client = nil
 		allClients.mu.RLock()
 		for _, client := range allClients.table {
-			if now.Sub(client.lastSeen) > 5*time.Minute {
+			if now.Sub(client.LastSeen()) > 5*time.Minute {
 				inactiveClient = client
 				break
 			}
@@ -162,11 +281,35 @@ func (allClients *ClientsStorage) DeleteInactiveClients() {
 	}
 }
 
+// DeleteExpiredSessions closes sessions that live longer than sessionTimeout (0 means no limit).
+// Typically, a client vanished in the middle of uploading files or stopped receiving .o, but the daemon is still alive,
+// so its sessions would hang until it quits. Meanwhile, they hold file states, compiler slots and outputs.
+func (allClients *ClientsStorage) DeleteExpiredSessions(sessionTimeout time.Duration) {
+	if sessionTimeout == 0 {
+		return
+	}
+
+	for _, client := range allClients.GetAllClients() {
+		for _, session := range client.GetAllSessions() {
+			started := session.compilationStarted.Load() != 0
+			if time.Since(session.createTime) > sessionTimeout && client.ExpireSession(session) {
+				logServer.Error("session expired", "sessionID", session.sessionID, "clientID", client.clientID, "started", started, session.InputFile)
+				allClients.expiredSessionsCount.Add(1)
+			}
+		}
+	}
+}
+
+func (allClients *ClientsStorage) ExpiredSessionsCount() int64 {
+	return allClients.expiredSessionsCount.Load()
+}
+
 func (allClients *ClientsStorage) StopAllClients() {
 	allClients.mu.Lock()
 	for _, client := range allClients.table {
 		// do not call DeleteClient(), since the server is stopping, removing working dir is not needed
 		close(client.chanDisconnected)
+		client.endSessionSpans()
 	}
 
 	allClients.table = make(map[string]*Client)
@@ -180,6 +323,16 @@ func (allClients *ClientsStorage) ActiveCount() int64 {
 	return int64(clientsCount)
 }
 
+func (allClients *ClientsStorage) GetAllClients() []*Client {
+	allClients.mu.RLock()
+	clients := make([]*Client, 0, len(allClients.table))
+	for _, client := range allClients.table {
+		clients = append(clients, client)
+	}
+	allClients.mu.RUnlock()
+	return clients
+}
+
 func (allClients *ClientsStorage) ActiveSessionsCount() int64 {
 	allClients.mu.RLock()
 	sessionsCount := 0
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// CompilerCPUs restricts compiler processes to CompilerCPUs from config (like `taskset -c 2-15`),
+// so that services co-hosted with a server keep reserved cores.
+// With PinCompilers, every compiler is pinned to a single cpu of them, the least loaded one at launch:
+// listing one hyperthread of every core (e.g. "0-15" of 32 threads) then keeps hyperthread pairs not oversubscribed,
+// and compilers don't migrate between cores, which makes compile times more stable.
+// It's nil if CompilerCPUs is not set, then compilers are launched with an affinity of a server process.
+type CompilerCPUs struct {
+	mu       sync.Mutex
+	cpus     []int
+	nRunning map[int]int // compilers pinned to a cpu now
+	pinEach  bool
+}
+
+func MakeCompilerCPUs(cpuList string, pinEach bool) (*CompilerCPUs, error) {
+	if cpuList == "" {
+		if pinEach {
+			return nil, fmt.Errorf("PinCompilers requires CompilerCPUs")
+		}
+		return nil, nil
+	}
+	cpus, err := parseCPUList(cpuList)
+	if err != nil {
+		return nil, err
+	}
+	var available unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &available); err == nil {
+		for _, cpu := range cpus {
+			if !available.IsSet(cpu) {
+				return nil, fmt.Errorf("cpu %d from CompilerCPUs is not available to a server", cpu)
+			}
+		}
+	}
+	return &CompilerCPUs{
+		cpus:     cpus,
+		nRunning: make(map[int]int),
+		pinEach:  pinEach,
+	}, nil
+}
+
+// maxCPUsInSet is CPU_SETSIZE, a limit of sched_setaffinity
+const maxCPUsInSet = int(unsafe.Sizeof(unix.CPUSet{}) * 8)
+
+// parseCPUList parses a format of `taskset -c` and /sys/devices/system/cpu/online: "0-3,8,10-11"
+func parseCPUList(cpuList string) ([]int, error) {
+	cpus := make([]int, 0)
+	for _, part := range strings.Split(cpuList, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, err1 := strconv.Atoi(first)
+		to, err2 := from, error(nil)
+		if isRange {
+			to, err2 = strconv.Atoi(last)
+		}
+		if err1 != nil || err2 != nil || from < 0 || to < from || to >= maxCPUsInSet {
+			return nil, fmt.Errorf("invalid cpu list %q", cpuList)
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Start starts a compiler with an affinity; a returned cpu must be passed to Release after it finishes (-1 if not pinned).
+// An affinity is inherited on fork, so it's set for a thread starting a process, not for a process after start:
+// then a driver can't spawn cc1plus before being restricted.
+func (c *CompilerCPUs) Start(compilerCommand *exec.Cmd) (int, error) {
+	if c == nil {
+		return -1, compilerCommand.Start()
+	}
+
+	var set unix.CPUSet
+	pinnedCPU := c.acquire()
+	if pinnedCPU != -1 {
+		set.Set(pinnedCPU)
+	} else {
+		for _, cpu := range c.cpus {
+			set.Set(cpu)
+		}
+	}
+
+	runtime.LockOSThread()
+	var prevSet unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &prevSet); err != nil {
+		runtime.UnlockOSThread()
+		c.Release(pinnedCPU)
+		return -1, err
+	}
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+		c.Release(pinnedCPU)
+		return -1, fmt.Errorf("can't set compiler cpus: %v", err)
+	}
+	err := compilerCommand.Start()
+	// if an affinity can't be restored, the thread stays locked and is terminated when this goroutine exits
+	if unix.SchedSetaffinity(0, &prevSet) == nil {
+		runtime.UnlockOSThread()
+	}
+	if err != nil {
+		c.Release(pinnedCPU)
+		return -1, err
+	}
+	return pinnedCPU, nil
+}
+
+// acquire chooses a cpu with the fewest compilers pinned (the first of them), -1 if compilers are not pinned
+func (c *CompilerCPUs) acquire() int {
+	if !c.pinEach {
+		return -1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pinnedCPU := c.cpus[0]
+	for _, cpu := range c.cpus {
+		if c.nRunning[cpu] < c.nRunning[pinnedCPU] {
+			pinnedCPU = cpu
+		}
+	}
+	c.nRunning[pinnedCPU]++
+	return pinnedCPU
+}
+
+func (c *CompilerCPUs) Release(pinnedCPU int) {
+	if c == nil || pinnedCPU == -1 {
+		return
+	}
+	c.mu.Lock()
+	c.nRunning[pinnedCPU]--
+	c.mu.Unlock()
+}
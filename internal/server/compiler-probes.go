@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// CompilerProbes answers what compilers on this server are capable of: a version, whether lld is available,
+// whether some -std= is supported, whether a target (for cross-compilation, see common.ExtractTargetArgs) is supported.
+// Clients query it before sending a .cpp, so that a TU with -std=c++2c is not routed to a server with an old clang.
+// A probe launches a compiler, that's why results are cached (compilers don't change while a server is running).
+// Only compilers inside CompilerDirs are probed: a compiler name comes from a client, it must not run an arbitrary binary of a host.
+// They are probed in a separate root, where server dirs are mounted like into client working dirs, but no client files are:
+// results are shared by all clients (and are a part of objCacheKey), so one client must not affect them.
+type CompilerProbes struct {
+	mu    sync.Mutex
+	table map[string]*compilerProbe // key: compiler + std + target args, at most maxCompilerProbes
+
+	compilerDirs []string // CompilerDirs with symlinks resolved
+	root         string   // a chroot for probes, see ClientsStorage.PrepareCompilerProbesRoot
+
+	mismatchPolicy   CompilerMismatchPolicy
+	mismatchesLogged map[string]bool // not to log the same mismatch for every session, at most maxCompilerProbes
+}
+
+// maxCompilerProbes limits CompilerProbes.table: keys come from clients, the least recently used ones are forgotten
+const maxCompilerProbes = 1024
+
+// CompilerMismatchPolicy is what to do if a client's compiler differs from a server's one (a version or a target triple).
+// Objects compiled by another compiler may be incompatible, and it would be noticed only at link time or at runtime.
+type CompilerMismatchPolicy int
+
+const (
+	CompilerMismatchIgnore CompilerMismatchPolicy = iota
+	CompilerMismatchWarn                          // compile, but log a mismatch (once per client and compiler)
+	CompilerMismatchRefuse                        // fail a session, then a client compiles a file locally
+)
+
+func ParseCompilerMismatchPolicy(policy string) (CompilerMismatchPolicy, error) {
+	switch policy {
+	case "ignore":
+		return CompilerMismatchIgnore, nil
+	case "warn":
+		return CompilerMismatchWarn, nil
+	case "refuse":
+		return CompilerMismatchRefuse, nil
+	default:
+		return CompilerMismatchWarn, fmt.Errorf("invalid CompilerMismatch %q, expected ignore/warn/refuse", policy)
+	}
+}
+
+type compilerProbe struct {
+	compilerPath string
+	std          string
+	targetArgs   []string
+
+	once     sync.Once
+	done     atomic.Bool // reply is set
+	reply    *pb.ProbeCompilerReply
+	lastUsed time.Time // under CompilerProbes.mu
+}
+
+func MakeCompilerProbes(mismatchPolicy CompilerMismatchPolicy, compilerDirs []string, root string) *CompilerProbes {
+	resolvedDirs := make([]string, 0, len(compilerDirs))
+	for _, dir := range compilerDirs {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			resolvedDirs = append(resolvedDirs, resolved)
+		}
+	}
+
+	return &CompilerProbes{
+		table:            make(map[string]*compilerProbe),
+		compilerDirs:     resolvedDirs,
+		root:             root,
+		mismatchPolicy:   mismatchPolicy,
+		mismatchesLogged: make(map[string]bool),
+	}
+}
+
+// Probe returns what a compiler of a client (not uploading its toolchain) is capable of.
+// An error is returned if a compiler is not found in CompilerDirs; it's not cached.
+func (probes *CompilerProbes) Probe(compilerName string, std string, targetArgs []string) (*pb.ProbeCompilerReply, error) {
+	probe, _, err := probes.getCompilerProbe(compilerName, std, targetArgs)
+	if err != nil {
+		return nil, err
+	}
+	probes.runCompilerProbe(probe)
+	return probe.reply, nil
+}
+
+// ProbeIfReady is Probe without -std that never waits: it's called on every session start,
+// and a probe launches a compiler several times. Until a probe is done in the background, nil is returned.
+func (probes *CompilerProbes) ProbeIfReady(compilerName string, targetArgs []string) *pb.ProbeCompilerReply {
+	probe, created, err := probes.getCompilerProbe(compilerName, "", targetArgs)
+	if err != nil {
+		return nil
+	}
+	if created {
+		go probes.runCompilerProbe(probe)
+	}
+	if !probe.done.Load() {
+		return nil
+	}
+	return probe.reply
+}
+
+func (probes *CompilerProbes) getCompilerProbe(compilerName string, std string, targetArgs []string) (probe *compilerProbe, created bool, err error) {
+	compilerPath, err := probes.resolveCompiler(compilerName)
+	if err != nil {
+		return nil, false, err
+	}
+	key := compilerPath + " -std=" + std + " " + strings.Join(targetArgs, " ")
+
+	probes.mu.Lock()
+	defer probes.mu.Unlock()
+	probe = probes.table[key]
+	if probe == nil {
+		if len(probes.table) >= maxCompilerProbes {
+			probes.deleteLeastRecentlyUsed()
+		}
+		probe = &compilerProbe{compilerPath: compilerPath, std: std, targetArgs: targetArgs}
+		probes.table[key] = probe
+		created = true
+	}
+	probe.lastUsed = time.Now()
+	return probe, created, nil
+}
+
+func (probes *CompilerProbes) runCompilerProbe(probe *compilerProbe) {
+	probe.once.Do(func() {
+		probe.reply = runCompilerProbe(probes.root, probe.compilerPath, probe.std, probe.targetArgs)
+		probe.done.Store(true)
+		logServer.Info(0, "probed compiler", probe.compilerPath, "std", probe.std, "target", probe.targetArgs, "version", probe.reply.Version, "hasLld", probe.reply.HasLld, "stdSupported", probe.reply.StdSupported, "targetUnsupported", probe.reply.TargetUnsupported, "triple", probe.reply.Target)
+	})
+}
+
+// resolveCompiler finds a compiler like exec.Command does for a session, and checks it to be inside CompilerDirs
+func (probes *CompilerProbes) resolveCompiler(compilerName string) (string, error) {
+	compilerPath, err := exec.LookPath(compilerName)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(compilerPath)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range probes.compilerDirs {
+		if strings.HasPrefix(resolved, dir+"/") {
+			return compilerPath, nil
+		}
+	}
+	return "", fmt.Errorf("compiler %s is not in CompilerDirs", compilerName)
+}
+
+// deleteLeastRecentlyUsed is called under mu when a table is full
+func (probes *CompilerProbes) deleteLeastRecentlyUsed() {
+	oldestKey := ""
+	var oldestTime time.Time
+	for key, probe := range probes.table {
+		if oldestKey == "" || probe.lastUsed.Before(oldestTime) {
+			oldestKey, oldestTime = key, probe.lastUsed
+		}
+	}
+	delete(probes.table, oldestKey)
+}
+
+// VerifyClientCompiler compares a compiler version and a target detected on a client with server's ones.
+// An error is returned only if a policy is to refuse. Older clients don't send them, then nothing is checked.
+// With a policy to warn, sessions started before a compiler is probed (see ProbeIfReady) are not checked;
+// with a policy to refuse, they wait for a probe.
+func (probes *CompilerProbes) VerifyClientCompiler(client *Client, in *pb.StartCompilationSessionRequest) error {
+	if probes.mismatchPolicy == CompilerMismatchIgnore || in.CompilerVersion == "" {
+		return nil
+	}
+
+	targetArgs := common.ExtractTargetArgs(in.CompilerArgs)
+	reply := probes.ProbeIfReady(in.Compiler, targetArgs)
+	if reply == nil && probes.mismatchPolicy == CompilerMismatchWarn {
+		return nil
+	}
+	if reply == nil {
+		var err error
+		if reply, err = probes.Probe(in.Compiler, "", targetArgs); err != nil {
+			reply = &pb.ProbeCompilerReply{} // not found, a session fails anyway
+		}
+	}
+	if reply.Version == in.CompilerVersion && reply.Target == in.CompilerTarget {
+		return nil
+	}
+
+	mismatch := fmt.Sprintf("%s on a client: %q %s, on a server: %q %s", in.Compiler, in.CompilerVersion, in.CompilerTarget, reply.Version, reply.Target)
+	if probes.mismatchPolicy == CompilerMismatchRefuse {
+		return fmt.Errorf("compiler mismatch: %s", mismatch)
+	}
+
+	probes.mu.Lock()
+	key := client.clientID + " " + mismatch
+	alreadyLogged := probes.mismatchesLogged[key]
+	if !alreadyLogged && len(probes.mismatchesLogged) >= maxCompilerProbes {
+		clear(probes.mismatchesLogged) // some mismatches will be logged once more, that's fine
+	}
+	probes.mismatchesLogged[key] = true
+	probes.mu.Unlock()
+	if !alreadyLogged {
+		logServer.Error("compiler mismatch", "clientID", client.clientID, mismatch)
+	}
+	return nil
+}
+
+// runCompilerProbe launches a compiler in a probes root, where CompilerDirs are bind-mounted from the same paths.
+// Results are the same for all clients, a probe is cached for any of them.
+func runCompilerProbe(workingDir string, compilerPath string, std string, targetArgs []string) *pb.ProbeCompilerReply {
+	reply := &pb.ProbeCompilerReply{}
+
+	// the first line is like "clang version 20.1.2" or "g++ (Gentoo 14.2.1) 14.2.1 20250301"
+	out, err := probeCommand(workingDir, compilerPath, "--version").Output()
+	if err != nil {
+		return reply
+	}
+	reply.Version, _, _ = strings.Cut(string(out), "\n")
+
+	// both clang and gcc output an absolute path if a program is found, and just its name otherwise
+	out, err = probeCommand(workingDir, compilerPath, "-print-prog-name=ld.lld").Output()
+	reply.HasLld = err == nil && filepath.IsAbs(string(bytes.TrimSpace(out)))
+
+	// clang prints a normalized -target triple; gcc can't change a target by options, it prints its own one
+	out, err = probeCommand(workingDir, compilerPath, append(targetArgs, "-dumpmachine")...).Output()
+	if err == nil {
+		reply.Target = string(bytes.TrimSpace(out))
+	}
+
+	reply.TargetUnsupported = len(targetArgs) > 0 && !compilerCompilesEmptyInput(workingDir, compilerPath, targetArgs, "c")
+	reply.StdSupported = std == "" || compilerSupportsStd(workingDir, compilerPath, std, targetArgs)
+	return reply
+}
+
+func probeCommand(workingDir string, compilerPath string, args ...string) *exec.Cmd {
+	cmd := exec.Command(compilerPath, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: workingDir}
+	cmd.Dir = "/"
+	return cmd
+}
+
+// compilerSupportsStd compiles an empty input with -std={std}: a compiler fails if it doesn't know a standard
+func compilerSupportsStd(workingDir string, compilerPath string, std string, targetArgs []string) bool {
+	lang := "c++" // c++20, gnu++17
+	if !strings.Contains(std, "++") {
+		lang = "c" // c11, gnu99
+	}
+	return compilerCompilesEmptyInput(workingDir, compilerPath, append(targetArgs, "-std="+std), lang)
+}
+
+// compilerCompilesEmptyInput fails if a compiler doesn't know some option (an unknown triple, -m32 without multilib, etc.);
+// headers are not needed, they are uploaded by clients
+func compilerCompilesEmptyInput(workingDir string, compilerPath string, args []string, lang string) bool {
+	cmd := probeCommand(workingDir, compilerPath, append(args, "-x", lang, "-fsyntax-only", "-")...)
+	cmd.Stdin = strings.NewReader("")
+	return cmd.Run() == nil
+}
@@ -28,8 +28,16 @@ func (c *Cron) doCron() {
 		cronStartTime := time.Now()
 
 		c.noccServer.SrcFileCache.PurgeLastElementsIfRequired()
+		c.noccServer.SrcFileCache.DeleteHangedUploadClaims()
 		c.noccServer.ObjFileCache.PurgeLastElementsIfRequired()
+		c.noccServer.ObjFileCache.PurgeNamespacesOverLimit()
+		c.noccServer.DiskWatchdog.Check()
 		c.noccServer.ActiveClients.DeleteInactiveClients()
+		c.noccServer.ActiveClients.DeleteExpiredRetainedClients(c.noccServer.ClientRetention)
+		c.noccServer.ActiveClients.DeleteExpiredSessions(c.noccServer.SessionTimeout)
+		c.noccServer.SystemHeaders.CheckForChanges()
+		c.noccServer.PipelinedUploads.DeleteStaleGates()
+		c.noccServer.CompilerLauncher.SetCapacity(c.noccServer.AdaptiveCapacity.Adjust(c.noccServer.CapacitySchedule.CapacityAt(cronStartTime)))
 
 		sleepTime := cronTickInterval - time.Since(cronStartTime)
 		if sleepTime <= 0 {
@@ -47,6 +55,8 @@ func (c *Cron) doCron() {
 					}
 				} else if sig == syscall.SIGTERM {
 					go c.noccServer.QuitServerGracefully()
+				} else if sig == syscall.SIGHUP {
+					c.reloadCapacitySchedule()
 				}
 			case <-time.After(sleepTime):
 				break
@@ -60,10 +70,28 @@ func (c *Cron) StartCron() {
 	var rLimit syscall.Rlimit
 	_ = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
 	c.signals = make(chan os.Signal, 2)
-	signal.Notify(c.signals, syscall.SIGUSR1, syscall.SIGTERM)
+	signal.Notify(c.signals, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGHUP)
 	c.doCron()
 }
 
+// reloadCapacitySchedule applies CompilerQueueSize and CapacitySchedule changed in a config file without a restart
+// (which would lose src/obj caches and all clients). Other options (cache dirs, ListenAddr, etc.) need a restart.
+// CapacitySchedule is replaced here, in the same goroutine that reads it.
+func (c *Cron) reloadCapacitySchedule() {
+	if c.noccServer.ReadCapacitySchedule == nil {
+		return
+	}
+	schedule, err := c.noccServer.ReadCapacitySchedule()
+	if err != nil {
+		logServer.Error("config not reloaded:", err)
+		return
+	}
+
+	c.noccServer.CapacitySchedule = schedule
+	c.noccServer.CompilerLauncher.SetCapacity(c.noccServer.AdaptiveCapacity.Effective(schedule.CapacityAt(time.Now())))
+	logServer.Info(0, "config reloaded")
+}
+
 func (c *Cron) StopCron() {
 	c.stopFlag = true
 	// don't wait here; doCron() is now sleeping, it won't prevent process from exiting
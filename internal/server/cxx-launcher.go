@@ -8,13 +8,42 @@ import (
 	"io"
 	"nocc/internal/common"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
+// CompilerLauncher limits the number of compiler processes launched in parallel.
+// The limit can change while running (see CapacitySchedule), that's why it's a cond var, not a buffered channel.
+// Waiting ones are ordered by a priority class of a session, then by a priority, see queueRank.
+// Some slots may be reserved for a class (ReservedSlots in config): other classes don't take them even if they are free,
+// so that a class always starts quickly, like developers' builds while CI agents keep a server busy.
+// Among equal ranks, a client having fewer compilers running goes first, so that clients share a server evenly:
+// one doing `make -j128` doesn't starve others, whose files would otherwise wait behind its whole queue.
 type CompilerLauncher struct {
-	serverCompilerThrottle chan struct{}
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	capacity int
+	nRunning int
+	nWaiting int // a queue depth
+
+	waiting          map[queueRank]map[string]int // by rank, by clientID; a slot is taken only when nobody with a higher rank (able to take it) waits
+	reservedSlots    map[string]int               // a priority class to slots kept for it, see hasSlotFor
+	nReservedSlots   int                          // a sum of reservedSlots, see scaledReservation
+	runningPerClass  map[string]int
+	runningPerClient map[string]int // by clientID, see fairerClientWaiting
+
+	extraArgs []string // ExtraCompilerArgs from config, appended to every compiler command line
+
+	// nil unless CompilerCPUs are set in config
+	CPUs *CompilerCPUs
+
+	// nil unless AcceptClientToolchains is set in config
+	ClientToolchains *ClientToolchains
 }
 
 type CompilerLaunchRequest struct {
@@ -23,42 +52,247 @@ type CompilerLaunchRequest struct {
 	compileInput     string
 	compileOutput    string
 	compilerArgs     []string
+	compilerCwd      string   // inside workingDir, "/" if empty
+	clientID         string   // compilers are shared fairly between clients, see CompilerLauncher
+	priorityClass    string   // one of common.PriorityClass*, "default" for an empty one
+	priority         int32    // from a client's Rules, 0 by default
+	diagnosticsColor bool     // a compiler doesn't detect a terminal on a server, but a client prints to it
+	compilerEnv      []string // "KEY=VALUE" appended to a server env, see filterCompilerEnv
 	interruptchan    chan struct{}
 	chanDisconnected chan struct{}
+	onDemandView     *onDemandView // if set, workingDir is a FUSE root, see OnDemandIncludes
+	uploadedCompiler bool          // a compiler is uploaded by a client, it's launched unprivileged, see ClientToolchains
+}
+
+// allowedCompilerEnvVars may be set for a compiler by a client (from `nocc` env), others are dropped:
+// a client must not make a compiler load anything (like LD_PRELOAD of an uploaded file).
+// A value tells whether a var affects an object (then it's a part of obj cache key) or only diagnostics (locale, colors).
+var allowedCompilerEnvVars = map[string]bool{
+	"SOURCE_DATE_EPOCH": true,
+	"SDKROOT":           true,
+	"GCC_EXEC_PREFIX":   true, // only with an uploaded toolchain, otherwise it could point to uploaded fake cc1plus
+	"GCC_COLORS":        false,
+	"LANG":              false,
+	"LC_ALL":            false,
+	"LC_MESSAGES":       false,
+}
+
+// filterCompilerEnv leaves only allowedCompilerEnvVars in a session env
+func filterCompilerEnv(env []string, uploadsToolchain bool) []string {
+	filtered := make([]string, 0, len(env))
+	for _, keyValue := range env {
+		key, value, _ := strings.Cut(keyValue, "=")
+		if _, allowed := allowedCompilerEnvVars[key]; !allowed || strings.ContainsRune(value, 0) {
+			continue
+		}
+		if key == "GCC_EXEC_PREFIX" && (!uploadsToolchain || !path.IsAbs(value)) {
+			continue
+		}
+		filtered = append(filtered, keyValue)
+	}
+	return filtered
+}
+
+// isObjAffectingEnvVar tells whether "KEY=VALUE" from a session env is a part of obj cache key
+func isObjAffectingEnvVar(keyValue string) bool {
+	key, _, _ := strings.Cut(keyValue, "=")
+	return allowedCompilerEnvVars[key]
 }
 
 type CompilerLaunchResponse struct {
 	interrupted bool
 	exitcode    int
+	signal      int32 // a compiler was killed by it, exitcode is -1 then
 	duration    int32
+	queued      int32 // ms waited for a free slot, a server is congested if it's large
+	queueDepth  int32 // see acquire
 	stdout      []byte
 	stderr      []byte
 }
 
-func MakeCompilerLauncher(maxParallelCompilerProcesses int) (*CompilerLauncher, error) {
-	if maxParallelCompilerProcesses <= 0 {
+// queueRank orders waiting compilers: a priority class first, then a priority within a class
+type queueRank struct {
+	class    string
+	priority int32
+}
+
+func (rank queueRank) higherThan(other queueRank) bool {
+	classRank, otherClassRank := common.PriorityClassRank(rank.class), common.PriorityClassRank(other.class)
+	if classRank != otherClassRank {
+		return classRank > otherClassRank
+	}
+	return rank.priority > other.priority
+}
+
+func MakeCompilerLauncher(maxParallelCompilerProcesses int, extraArgs []string, reservedSlots map[string]int) (*CompilerLauncher, error) {
+	if maxParallelCompilerProcesses < 0 { // 0 is a cache server, see NoccServer.CacheOnly
 		return nil, fmt.Errorf("invalid maxParallelcompilerProcesses %d", maxParallelCompilerProcesses)
 	}
+	nReservedSlots := 0
+	for class, nSlots := range reservedSlots {
+		if common.PriorityClassRank(class) == -1 || class == "" {
+			return nil, fmt.Errorf("unknown priority class %q", class)
+		}
+		if nSlots < 0 {
+			return nil, fmt.Errorf("invalid number of slots %d for %q", nSlots, class)
+		}
+		nReservedSlots += nSlots
+	}
+
+	compilerLauncher := &CompilerLauncher{
+		capacity:         maxParallelCompilerProcesses,
+		extraArgs:        extraArgs,
+		waiting:          make(map[queueRank]map[string]int),
+		reservedSlots:    reservedSlots,
+		nReservedSlots:   nReservedSlots,
+		runningPerClass:  make(map[string]int),
+		runningPerClient: make(map[string]int),
+	}
+	compilerLauncher.cond = sync.NewCond(&compilerLauncher.mu)
+	return compilerLauncher, nil
+}
+
+// CheckReservedSlots is called when a config is loaded (and reloaded): reservations must leave slots for other classes
+func CheckReservedSlots(reservedSlots map[string]int, compilerQueueSize int) error {
+	nReservedSlots := 0
+	for _, nSlots := range reservedSlots {
+		nReservedSlots += nSlots
+	}
+	if nReservedSlots > 0 && nReservedSlots >= compilerQueueSize {
+		return fmt.Errorf("%d slots are reserved, CompilerQueueSize %d must be more", nReservedSlots, compilerQueueSize)
+	}
+	return nil
+}
+
+// SetCapacity changes the max number of parallel compilers.
+// If it decreases, running compilers are not killed, new ones just wait until the number goes down.
+func (compilerLauncher *CompilerLauncher) SetCapacity(capacity int) {
+	compilerLauncher.mu.Lock()
+	if compilerLauncher.capacity != capacity {
+		logServer.Info(0, "compiler queue size changed", compilerLauncher.capacity, "->", capacity)
+		compilerLauncher.capacity = capacity
+		compilerLauncher.cond.Broadcast()
+	}
+	compilerLauncher.mu.Unlock()
+}
+
+// acquire waits for a free slot; it returns false if ctx is canceled while waiting (a session was interrupted)
+// Among waiting ones, a higher rank gets a slot first; among equal ranks, a client with fewer compilers running.
+// queueDepth is the most waiting ones (this one included) seen on every wake-up, 0 if a slot was free at once.
+func (compilerLauncher *CompilerLauncher) acquire(ctx context.Context, rank queueRank, clientID string) (ok bool, queueDepth int32) {
+	compilerLauncher.mu.Lock()
+	defer compilerLauncher.mu.Unlock()
+
+	compilerLauncher.nWaiting++
+	waitingClients := compilerLauncher.waiting[rank]
+	if waitingClients == nil {
+		waitingClients = make(map[string]int)
+		compilerLauncher.waiting[rank] = waitingClients
+	}
+	waitingClients[clientID]++
+	for (!compilerLauncher.hasSlotFor(rank.class) || compilerLauncher.higherRankWaiting(rank) || compilerLauncher.fairerClientWaiting(rank, clientID)) && ctx.Err() == nil {
+		queueDepth = max(queueDepth, int32(compilerLauncher.nWaiting))
+		compilerLauncher.cond.Wait()
+	}
+	compilerLauncher.nWaiting--
+	waitingClients[clientID]--
+	if waitingClients[clientID] == 0 {
+		delete(waitingClients, clientID)
+		if len(waitingClients) == 0 {
+			delete(compilerLauncher.waiting, rank)
+		}
+	}
+	if ctx.Err() != nil {
+		compilerLauncher.cond.Broadcast() // lower ranks and other clients could wait for this one
+		return false, queueDepth
+	}
+	compilerLauncher.nRunning++
+	compilerLauncher.runningPerClass[rank.class]++
+	compilerLauncher.runningPerClient[clientID]++
+	return true, queueDepth
+}
+
+// hasSlotFor is called under a lock: slots reserved for other classes and not taken by them are not free for a class
+func (compilerLauncher *CompilerLauncher) hasSlotFor(class string) bool {
+	nKept := 0
+	for reservedClass, nReserved := range compilerLauncher.reservedSlots {
+		if reservedClass != class {
+			nKept += max(0, compilerLauncher.scaledReservation(nReserved)-compilerLauncher.runningPerClass[reservedClass])
+		}
+	}
+	return compilerLauncher.nRunning+nKept < compilerLauncher.capacity
+}
+
+// scaledReservation is called under a lock: if capacity is reduced (by CapacitySchedule or AdaptiveCapacity)
+// to the sum of reservations or less, they are scaled down, so that other classes still have a slot
+func (compilerLauncher *CompilerLauncher) scaledReservation(nReserved int) int {
+	if compilerLauncher.nReservedSlots < compilerLauncher.capacity {
+		return nReserved
+	}
+	return nReserved * max(0, compilerLauncher.capacity-1) / compilerLauncher.nReservedSlots
+}
+
+// higherRankWaiting is called under a lock; zero counters are deleted, so every key is waiting.
+// A higher rank that can't take a slot now (others are reserved for a lower class) is not waited for.
+func (compilerLauncher *CompilerLauncher) higherRankWaiting(rank queueRank) bool {
+	for waitingRank := range compilerLauncher.waiting {
+		if waitingRank.higherThan(rank) && compilerLauncher.hasSlotFor(waitingRank.class) {
+			return true
+		}
+	}
+	return false
+}
+
+// fairerClientWaiting is called under a lock: another client waits with the same rank, having fewer compilers running.
+// Clients with equal numbers are not ordered, so with one waiting file each, clients take slots by turns.
+func (compilerLauncher *CompilerLauncher) fairerClientWaiting(rank queueRank, clientID string) bool {
+	nRunning := compilerLauncher.runningPerClient[clientID]
+	for waitingClientID := range compilerLauncher.waiting[rank] {
+		if compilerLauncher.runningPerClient[waitingClientID] < nRunning {
+			return true
+		}
+	}
+	return false
+}
 
-	return &CompilerLauncher{
-		serverCompilerThrottle: make(chan struct{}, maxParallelCompilerProcesses),
-	}, nil
+// wakeUpWaiting lets acquire() check whether it's canceled; it's locked not to be missed between a check and Wait()
+func (compilerLauncher *CompilerLauncher) wakeUpWaiting() {
+	compilerLauncher.mu.Lock()
+	compilerLauncher.cond.Broadcast()
+	compilerLauncher.mu.Unlock()
+}
+
+func (compilerLauncher *CompilerLauncher) release(class string, clientID string) {
+	compilerLauncher.mu.Lock()
+	compilerLauncher.nRunning--
+	compilerLauncher.runningPerClass[class]--
+	compilerLauncher.runningPerClient[clientID]--
+	if compilerLauncher.runningPerClient[clientID] == 0 {
+		delete(compilerLauncher.runningPerClient, clientID) // clients come and go, the map must not grow
+	}
+	compilerLauncher.cond.Broadcast() // not Signal: a woken one may have to yield to a higher priority
+	compilerLauncher.mu.Unlock()
 }
 
 func (compilerLauncher *CompilerLauncher) ExecCompiler(request *CompilerLaunchRequest) CompilerLaunchResponse {
 	var compilerStdoutBuffer, compilerStderrBuffer bytes.Buffer
-	compilerCmd := make([]string, 0, 5+len(request.compilerArgs))
+	compilerCmd := make([]string, 0, 4+len(request.compilerArgs)+len(compilerLauncher.extraArgs))
 	compilerCmd = append(compilerCmd, request.compilerArgs...)
 	compilerCmd = append(compilerCmd, "-o", request.compileOutput, "-c", request.compileInput)
-	compilerCmd = append(compilerCmd, "-Wno-missing-include-dirs") // This is needed to avoid errors about missing include dirs in the chroot environment
+	compilerCmd = append(compilerCmd, compilerLauncher.extraArgs...)
+	if request.diagnosticsColor {
+		compilerCmd = append(compilerCmd, "-fdiagnostics-color=always")
+	}
 
 	compilerCommand, ctx, cancel :=
 		common.CreateCompilerCommand(request.compilerName, compilerCmd, func(cancel context.CancelFunc, ctx context.Context) {
 			select {
 			case <-request.interruptchan:
 				cancel()
+				compilerLauncher.wakeUpWaiting()
 			case <-request.chanDisconnected:
 				cancel()
+				compilerLauncher.wakeUpWaiting()
 			case <-ctx.Done():
 			}
 		})
@@ -66,21 +300,58 @@ func (compilerLauncher *CompilerLauncher) ExecCompiler(request *CompilerLaunchRe
 	compilerCommand.SysProcAttr = &syscall.SysProcAttr{
 		Chroot: request.workingDir,
 	}
+	if len(request.compilerEnv) > 0 {
+		compilerCommand.Env = append(os.Environ(), request.compilerEnv...)
+	}
 	compilerCommand.Dir = "/"
+	if request.compilerCwd != "" {
+		compilerCommand.Dir = request.compilerCwd
+	}
+	if request.onDemandView != nil {
+		launchInOnDemandRoot(compilerCommand)
+	}
+	if request.uploadedCompiler {
+		err := fmt.Errorf("client toolchains are not accepted")
+		if compilerLauncher.ClientToolchains != nil {
+			err = compilerLauncher.ClientToolchains.prepareCommand(compilerCommand, request.clientID, request.workingDir, request.compileOutput)
+		}
+		if err != nil {
+			cancel()
+			return CompilerLaunchResponse{exitcode: 1, stderr: []byte(fmt.Sprintf("nocc-server: can't launch an uploaded compiler: %v\n", err))}
+		}
+	}
 	compilerCommand.Stderr = &compilerStderrBuffer
 	compilerCommand.Stdout = &compilerStdoutBuffer
 	defer cancel()
 
 	// This code is blocking until the compiler ends
-	compilerLauncher.serverCompilerThrottle <- struct{}{}
+	queueStart := time.Now()
+	acquired, queueDepth := compilerLauncher.acquire(ctx, queueRank{request.priorityClass, request.priority}, request.clientID)
+	if !acquired {
+		return CompilerLaunchResponse{
+			interrupted: true,
+		}
+	}
 
 	start := time.Now()
-	compilerCommand.Run()
+	compilerQueued := int32(start.Sub(queueStart).Milliseconds())
+	if pinnedCPU, err := compilerLauncher.CPUs.Start(compilerCommand); err == nil {
+		if request.onDemandView != nil {
+			request.onDemandView.attach(compilerCommand.Process.Pid)
+		}
+		if common.InjectFault(common.FaultCompilerKill) != nil {
+			// as if it was killed by OOM killer
+			_ = compilerCommand.Process.Kill()
+		}
+		_ = compilerCommand.Wait()
+		compilerLauncher.CPUs.Release(pinnedCPU)
+	}
 	compilerDuration := int32(time.Since(start).Milliseconds())
 
-	<-compilerLauncher.serverCompilerThrottle
+	compilerLauncher.release(request.priorityClass, request.clientID)
 
 	compilerExitCode := compilerCommand.ProcessState.ExitCode()
+	compilerSignal := common.CompilerTerminationSignal(compilerCommand)
 	compilerStdout := compilerStdoutBuffer.Bytes()
 	compilerStderr := compilerStderrBuffer.Bytes()
 
@@ -92,18 +363,82 @@ func (compilerLauncher *CompilerLauncher) ExecCompiler(request *CompilerLaunchRe
 
 	if compilerExitCode != 0 {
 		logServer.Error(
-			"The compiler exited with code", compilerExitCode,
+			"The compiler exited with code", compilerExitCode, "signal", compilerSignal,
 			"\ncmdLine:", request.compilerName, request.compilerArgs,
 			"\ncompilerStdout:", strings.TrimSpace(string(compilerStdout)),
 			"\ncxxStderr:", strings.TrimSpace(string(compilerStderr)))
 	}
 
 	return CompilerLaunchResponse{
-		exitcode: compilerExitCode,
-		duration: compilerDuration,
-		stdout:   compilerStdout,
-		stderr:   compilerStderr,
+		exitcode:   compilerExitCode,
+		signal:     int32(compilerSignal),
+		duration:   compilerDuration,
+		queued:     compilerQueued,
+		queueDepth: queueDepth,
+		stdout:     compilerStdout,
+		stderr:     compilerStderr,
+	}
+}
+
+// extractIncludeDirs returns abs -I/-isystem/etc. dirs from compiler args (a client makes them absolute),
+// they are created in a client working dir before compiling, see Client.MkdirAllIncludeDirs
+func extractIncludeDirs(compilerArgs []string) []string {
+	includeDirKeys := []string{"-I", "-iquote", "-isystem", "-idirafter"}
+	includeDirs := make([]string, 0)
+
+	for i, arg := range compilerArgs {
+		for _, key := range includeDirKeys {
+			dir := ""
+			if arg == key && i+1 < len(compilerArgs) {
+				dir = compilerArgs[i+1]
+			} else if strings.HasPrefix(arg, key) && arg != key {
+				dir = arg[len(key):]
+			}
+			if strings.HasPrefix(dir, "/") {
+				includeDirs = append(includeDirs, path.Clean(dir))
+				break
+			}
+		}
 	}
+	return includeDirs
+}
+
+// mkdirAllInChroot is os.MkdirAll that doesn't follow symlinks outside a chroot:
+// uploaded symlinks point to client paths, on a host they may lead anywhere
+func mkdirAllInChroot(workingDir string, dir string) {
+	fullPath := path.Join(workingDir, dir)
+	existingParent := fullPath
+	for existingParent != workingDir {
+		if _, err := os.Lstat(existingParent); err == nil {
+			break
+		}
+		existingParent = path.Dir(existingParent)
+	}
+
+	resolvedRoot, err1 := filepath.EvalSymlinks(workingDir)
+	resolved, err2 := filepath.EvalSymlinks(existingParent)
+	if err1 != nil || err2 != nil || (resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+"/")) {
+		return
+	}
+	_ = os.MkdirAll(fullPath, os.ModePerm)
+}
+
+func (compilerLauncher *CompilerLauncher) GetQueueSize() int {
+	compilerLauncher.mu.Lock()
+	defer compilerLauncher.mu.Unlock()
+	return compilerLauncher.capacity
+}
+
+func (compilerLauncher *CompilerLauncher) GetRunningCount() int64 {
+	compilerLauncher.mu.Lock()
+	defer compilerLauncher.mu.Unlock()
+	return int64(compilerLauncher.nRunning)
+}
+
+func (compilerLauncher *CompilerLauncher) GetWaitingCount() int64 {
+	compilerLauncher.mu.Lock()
+	defer compilerLauncher.mu.Unlock()
+	return int64(compilerLauncher.nWaiting)
 }
 
 func ParsePchFile(pchFile *fileInClientDir) (pchCompilation *common.PCHInvocation, err error) {
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"nocc/internal/common"
+)
+
+const (
+	interactive = common.PriorityClassInteractive
+	batch       = common.PriorityClassBatch
+)
+
+// makeTestLauncher makes a launcher with compilers running, as "class:clientID" (the same one may be repeated)
+func makeTestLauncher(t *testing.T, capacity int, reservedSlots map[string]int, running ...string) *CompilerLauncher {
+	compilerLauncher, err := MakeCompilerLauncher(capacity, nil, reservedSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compiler := range running {
+		class, clientID, _ := strings.Cut(compiler, ":")
+		compilerLauncher.nRunning++
+		compilerLauncher.runningPerClass[class]++
+		compilerLauncher.runningPerClient[clientID]++
+	}
+	return compilerLauncher
+}
+
+func TestCompilerLauncherHasSlotFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		capacity      int
+		reservedSlots map[string]int
+		running       []string
+		class         string
+		want          bool
+	}{
+		{"free", 2, nil, []string{"default:a"}, "default", true},
+		{"full", 2, nil, []string{"default:a", "batch:b"}, interactive, false},
+		{"no capacity", 0, nil, nil, interactive, false},
+		{"reserved for a class itself", 4, map[string]int{interactive: 3}, nil, interactive, true},
+		{"reserved for another class", 4, map[string]int{interactive: 3}, []string{"default:a"}, "default", false},
+		{"one unreserved left", 4, map[string]int{interactive: 3}, nil, "default", true},
+		{"reserved ones are taken", 4, map[string]int{interactive: 2}, []string{"interactive:a", "interactive:b", "interactive:c"}, batch, true},
+		{"reserved ones are partly taken", 4, map[string]int{interactive: 2}, []string{"interactive:a", "batch:b", "batch:b"}, batch, false},
+		{"more than reserved running", 4, map[string]int{interactive: 1}, []string{"interactive:a", "interactive:a", "interactive:a"}, interactive, true},
+		{"two classes reserved", 5, map[string]int{interactive: 2, "default": 2}, []string{"batch:a"}, batch, false},
+		{"two classes reserved, one for itself", 5, map[string]int{interactive: 2, "default": 2}, []string{"batch:a"}, "default", true},
+		{"two classes reserved, one partly taken", 5, map[string]int{interactive: 2, "default": 2}, []string{"default:a"}, batch, true},
+
+		// capacity reduced by a schedule to reservations or less, they are scaled down to leave a slot
+		{"scaled down", 3, map[string]int{interactive: 4}, nil, batch, true},
+		{"scaled down, a slot is taken", 3, map[string]int{interactive: 4}, []string{"batch:a"}, batch, false},
+		{"scaled down, reservation is taken", 3, map[string]int{interactive: 4}, []string{"interactive:a", "interactive:b"}, batch, true},
+		{"scaled down to equal", 4, map[string]int{interactive: 2, "default": 2}, []string{"batch:a"}, batch, true},
+		{"scaled down to equal, full", 4, map[string]int{interactive: 2, "default": 2}, []string{"batch:a", "batch:b"}, batch, false},
+		{"scaled down to equal, for a reserved class", 4, map[string]int{interactive: 2, "default": 2}, []string{"batch:a", "batch:b"}, "default", true},
+		{"scaled down to one", 1, map[string]int{interactive: 4}, nil, batch, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compilerLauncher := makeTestLauncher(t, tt.capacity, tt.reservedSlots, tt.running...)
+			if got := compilerLauncher.hasSlotFor(tt.class); got != tt.want {
+				t.Errorf("hasSlotFor(%q) = %v", tt.class, got)
+			}
+		})
+	}
+}
+
+// TestCompilerLauncherNextToStart checks which of waiting compilers takes a free slot
+func TestCompilerLauncherNextToStart(t *testing.T) {
+	tests := []struct {
+		name          string
+		capacity      int
+		reservedSlots map[string]int
+		running       []string
+		waiting       []string // "class:priority:clientID"
+		wantStarting  []string
+	}{
+		{
+			name:         "a higher class first",
+			capacity:     2,
+			running:      []string{"batch:ci"},
+			waiting:      []string{"batch:0:ci", "default:0:dev", "interactive:0:ide"},
+			wantStarting: []string{"interactive:0:ide"},
+		},
+		{
+			name:         "a higher priority in a class",
+			capacity:     2,
+			running:      []string{"default:a"},
+			waiting:      []string{"default:0:a", "default:5:b", "default:-5:c"},
+			wantStarting: []string{"default:5:b"},
+		},
+		{
+			name:         "a class over a priority",
+			capacity:     2,
+			running:      []string{"default:a"},
+			waiting:      []string{"batch:100:a", "default:-100:b"},
+			wantStarting: []string{"default:-100:b"},
+		},
+		{
+			name:         "a client with fewer running",
+			capacity:     4,
+			running:      []string{"default:make-j128", "default:make-j128", "default:make-j128"},
+			waiting:      []string{"default:0:make-j128", "default:0:make-j128", "default:0:agent"},
+			wantStarting: []string{"default:0:agent"},
+		},
+		{
+			name:         "clients with equal numbers by turns",
+			capacity:     3,
+			running:      []string{"default:a", "default:b"},
+			waiting:      []string{"default:0:a", "default:0:b"},
+			wantStarting: []string{"default:0:a", "default:0:b"},
+		},
+		{
+			name:         "fairness within a rank only",
+			capacity:     3,
+			running:      []string{"interactive:dev", "interactive:dev"},
+			waiting:      []string{"interactive:0:dev", "default:0:ci"},
+			wantStarting: []string{"interactive:0:dev"},
+		},
+		{
+			name:          "a higher rank without a slot isn't waited for",
+			capacity:      3,
+			reservedSlots: map[string]int{batch: 1},
+			running:       []string{"default:a", "default:a"},
+			waiting:       []string{"default:0:a", "batch:0:ci"},
+			wantStarting:  []string{"batch:0:ci"},
+		},
+		{
+			name:          "a reserved slot waits for its class",
+			capacity:      3,
+			reservedSlots: map[string]int{interactive: 1},
+			running:       []string{"batch:ci", "batch:ci"},
+			waiting:       []string{"batch:0:ci", "default:0:dev"},
+			wantStarting:  nil,
+		},
+		{
+			name:         "no slot",
+			capacity:     1,
+			running:      []string{"batch:ci"},
+			waiting:      []string{"interactive:0:dev"},
+			wantStarting: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compilerLauncher := makeTestLauncher(t, tt.capacity, tt.reservedSlots, tt.running...)
+			ranks := make(map[string]queueRank)
+			for _, compiler := range tt.waiting {
+				var rank queueRank
+				var clientID string
+				if _, err := fmt.Sscanf(strings.ReplaceAll(compiler, ":", " "), "%s %d %s", &rank.class, &rank.priority, &clientID); err != nil {
+					t.Fatal(err)
+				}
+				ranks[compiler] = rank
+				if compilerLauncher.waiting[rank] == nil {
+					compilerLauncher.waiting[rank] = make(map[string]int)
+				}
+				compilerLauncher.waiting[rank][clientID]++
+				compilerLauncher.nWaiting++
+			}
+
+			var starting []string
+			for _, compiler := range tt.waiting {
+				rank, clientID := ranks[compiler], compiler[strings.LastIndexByte(compiler, ':')+1:]
+				if compilerLauncher.hasSlotFor(rank.class) && !compilerLauncher.higherRankWaiting(rank) && !compilerLauncher.fairerClientWaiting(rank, clientID) {
+					if len(starting) == 0 || starting[len(starting)-1] != compiler {
+						starting = append(starting, compiler)
+					}
+				}
+			}
+			if fmt.Sprint(starting) != fmt.Sprint(tt.wantStarting) {
+				t.Errorf("starting %q, expected %q", starting, tt.wantStarting)
+			}
+		})
+	}
+}
+
+// TestCompilerLauncherFairShare checks that a client joining a busy server doesn't wait behind a queue of another one:
+// as slots are freed one by one, clients take them by turns
+func TestCompilerLauncherFairShare(t *testing.T) {
+	compilerLauncher := makeTestLauncher(t, 2, nil)
+	rank := queueRank{class: "default"}
+	running := []string{"a", "a"}
+	for range running {
+		compilerLauncher.acquire(context.Background(), rank, "a")
+	}
+
+	started := make(chan string)
+	for _, clientID := range []string{"a", "a", "a", "a", "a", "b", "b"} {
+		go func() {
+			compilerLauncher.acquire(context.Background(), rank, clientID)
+			started <- clientID
+		}()
+	}
+	waitForWaiting(t, compilerLauncher, 7)
+
+	var order []string
+	for len(order) < 7 {
+		compilerLauncher.release(rank.class, running[0])
+		running = running[1:]
+		select {
+		case clientID := <-started:
+			order = append(order, clientID)
+			running = append(running, clientID)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("nobody started after %v", order)
+		}
+	}
+	if strings.Join(order, "") != "babaaaa" {
+		t.Errorf("started in order %v", order)
+	}
+}
+
+// TestCompilerLauncherCancel checks that a canceled waiting compiler leaves a queue, and others don't wait for it
+func TestCompilerLauncherCancel(t *testing.T) {
+	compilerLauncher := makeTestLauncher(t, 1, nil, "batch:ci")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := make(chan bool)
+	go func() {
+		ok, _ := compilerLauncher.acquire(ctx, queueRank{class: interactive}, "dev")
+		acquired <- ok
+	}()
+	go func() {
+		ok, _ := compilerLauncher.acquire(context.Background(), queueRank{class: batch}, "ci")
+		acquired <- ok
+	}()
+	waitForWaiting(t, compilerLauncher, 2)
+
+	cancel()
+	compilerLauncher.wakeUpWaiting()
+	if ok := <-acquired; ok {
+		t.Fatal("a canceled compiler has started")
+	}
+	compilerLauncher.release(batch, "ci")
+	if ok := <-acquired; !ok {
+		t.Fatal("a compiler waiting for a canceled one hasn't started")
+	}
+	if compilerLauncher.nWaiting != 0 || len(compilerLauncher.waiting) != 0 || compilerLauncher.nRunning != 1 {
+		t.Errorf("unexpected state: %d waiting %v, %d running", compilerLauncher.nWaiting, compilerLauncher.waiting, compilerLauncher.nRunning)
+	}
+}
+
+func waitForWaiting(t *testing.T, compilerLauncher *CompilerLauncher, nWaiting int) {
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		compilerLauncher.mu.Lock()
+		n := compilerLauncher.nWaiting
+		compilerLauncher.mu.Unlock()
+		if n == nWaiting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiting, expected %d", n, nWaiting)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"nocc/internal/common"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// Dashboard is an optional http server showing a live state of nocc-server: connected clients, running sessions,
+// the compiler queue and cache sizes. "/" is a page for humans, "/api/state" is the same as JSON for scripts.
+// It's read-only and has no authorization, so it's expected to listen on localhost or an internal network.
+type Dashboard struct {
+	noccServer *NoccServer
+	httpServer *http.Server
+}
+
+type dashboardSession struct {
+	SessionID  uint32 `json:"sessionID"`
+	UserName   string `json:"userName"`
+	InputFile  string `json:"inputFile"`
+	Compiler   string `json:"compiler"`
+	State      string `json:"state"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type dashboardClient struct {
+	ClientID    string             `json:"clientID"`
+	LastSeenSec int64              `json:"lastSeenSec"`
+	FilesCount  int64              `json:"filesCount"`
+	Sessions    []dashboardSession `json:"sessions"`
+}
+
+type dashboardCache struct {
+	FilesCount  int64 `json:"filesCount"`
+	BytesOnDisk int64 `json:"bytesOnDisk"`
+	HardLimit   int64 `json:"hardLimit"`
+	PurgedCount int64 `json:"purgedCount"`
+	SaveErrors  int64 `json:"saveErrors"`
+	Degraded    bool  `json:"degraded"`
+
+	Hits            int64 `json:"hits"`
+	Misses          int64 `json:"misses"`
+	OldestAccessSec int64 `json:"oldestAccessSec"` // since the least recently used file was accessed, it's evicted next
+
+	Namespaces []CacheNamespaceStats `json:"namespaces"`
+}
+
+type dashboardCacheTier struct {
+	HostPort string `json:"hostPort"`
+	Pushed   int64  `json:"pushed"`
+	Failed   int64  `json:"failed"`
+	Dropped  int64  `json:"dropped"`
+	Queued   int    `json:"queued"`
+}
+
+type dashboardState struct {
+	Version           string            `json:"version"`
+	UptimeSec         int64             `json:"uptimeSec"`
+	CompilerQueueSize int               `json:"compilerQueueSize"`
+	CompilersRunning  int64             `json:"compilersRunning"`
+	CompilersWaiting  int64             `json:"compilersWaiting"`
+	ExpiredSessions   int64             `json:"expiredSessions"`
+	Clients           []dashboardClient `json:"clients"`
+	SrcCache          dashboardCache    `json:"srcCache"`
+	ObjCache          dashboardCache    `json:"objCache"`
+
+	CacheTiers []dashboardCacheTier `json:"cacheTiers"`
+
+	BuildSummaries dashboardBuildSummaries `json:"buildSummaries"`
+}
+
+func MakeDashboard(noccServer *NoccServer, listenAddr string) *Dashboard {
+	dashboard := &Dashboard{
+		noccServer: noccServer,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", dashboard.handlePage)
+	mux.HandleFunc("/api/state", dashboard.handleState)
+	dashboard.httpServer = &http.Server{
+		Addr:              listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return dashboard
+}
+
+func (dashboard *Dashboard) StartListening() {
+	logServer.Info(0, "dashboard listening on", dashboard.httpServer.Addr)
+	if err := dashboard.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logServer.Error("dashboard stopped:", err)
+	}
+}
+
+func (dashboard *Dashboard) Stop() {
+	if dashboard != nil {
+		_ = dashboard.httpServer.Close()
+	}
+}
+
+func (dashboard *Dashboard) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(dashboardHTML)
+}
+
+func (dashboard *Dashboard) handleState(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(dashboard.collectState())
+}
+
+func (dashboard *Dashboard) collectState() *dashboardState {
+	s := dashboard.noccServer
+	now := time.Now()
+
+	state := &dashboardState{
+		Version:           common.GetVersion(),
+		UptimeSec:         int64(now.Sub(s.StartTime).Seconds()),
+		CompilerQueueSize: s.CompilerLauncher.GetQueueSize(),
+		CompilersRunning:  s.CompilerLauncher.GetRunningCount(),
+		CompilersWaiting:  s.CompilerLauncher.GetWaitingCount(),
+		ExpiredSessions:   s.ActiveClients.ExpiredSessionsCount(),
+		Clients:           make([]dashboardClient, 0),
+		SrcCache:          makeDashboardCache(s.SrcFileCache.FileCache),
+		ObjCache:          makeDashboardCache(s.ObjFileCache.FileCache),
+		CacheTiers:        s.ObjFileCache.Replicator.makeDashboardCacheTiers(),
+		BuildSummaries:    s.BuildSummaries.makeDashboardBuildSummaries(),
+	}
+
+	for _, client := range s.ActiveClients.GetAllClients() {
+		c := dashboardClient{
+			ClientID:    client.clientID,
+			LastSeenSec: int64(now.Sub(client.LastSeen()).Seconds()),
+			FilesCount:  client.FilesCount(),
+			Sessions:    make([]dashboardSession, 0),
+		}
+		for _, session := range client.GetAllSessions() {
+			sessionState := "uploading"
+			if session.compilationStarted.Load() != 0 {
+				sessionState = "compiling"
+			}
+			c.Sessions = append(c.Sessions, dashboardSession{
+				SessionID:  session.sessionID,
+				UserName:   session.userName,
+				InputFile:  session.InputFile,
+				Compiler:   session.compilerName,
+				State:      sessionState,
+				DurationMs: now.Sub(session.createTime).Milliseconds(),
+			})
+		}
+		// the longest sessions first, they are the most interesting
+		sort.Slice(c.Sessions, func(i, j int) bool { return c.Sessions[i].DurationMs > c.Sessions[j].DurationMs })
+		state.Clients = append(state.Clients, c)
+	}
+	sort.Slice(state.Clients, func(i, j int) bool { return state.Clients[i].ClientID < state.Clients[j].ClientID })
+
+	return state
+}
+
+func makeDashboardCache(cache *FileCache) dashboardCache {
+	c := dashboardCache{
+		FilesCount:  cache.GetFilesCount(),
+		BytesOnDisk: cache.GetBytesOnDisk(),
+		HardLimit:   cache.hardLimit,
+		PurgedCount: cache.GetPurgedFilesCount(),
+		SaveErrors:  cache.GetSaveErrorsCount(),
+		Degraded:    cache.IsDegraded(),
+
+		Hits:   cache.GetHitsCount(),
+		Misses: cache.GetMissesCount(),
+
+		Namespaces: cache.GetNamespacesStats(),
+	}
+	if oldestAccess := cache.GetOldestAccessTime(); !oldestAccess.IsZero() {
+		c.OldestAccessSec = int64(time.Since(oldestAccess).Seconds())
+	}
+	return c
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// Delta uploads are for generated sources (.pb.cc, moc outputs, etc.): they are regenerated on every build
+// and differ slightly, but a changed sha256 makes a client upload them whole.
+// A server remembers a version of a file uploaded last time (by a client file name, see SrcFileCache.RememberVersion),
+// and if it's still in src cache, a session start offers it as a base: signatures of its blocks.
+// A client sends a delta against it (see common.MakeDelta), or a whole file if a delta isn't much smaller.
+
+// deltaMinFileSize: smaller files are uploaded as is, a delta wouldn't save much
+const deltaMinFileSize = 16 * 1024
+
+// offerDeltaBases fills file.deltaBase of files requested to upload that have a previous version in src cache
+// and returns signatures of those versions for a client
+func (s *NoccServer) offerDeltaBases(client *Client, session *Session, fileIndexesToUpload []uint32) []*pb.UploadDeltaBase {
+	deltaBases := make([]*pb.UploadDeltaBase, 0)
+	for _, index := range fileIndexesToUpload {
+		file := session.files[index]
+		file.deltaBase = common.SHA256{}
+		if file.fileSize < deltaMinFileSize {
+			continue
+		}
+
+		clientFileName := client.MapServerAbsToClientFileName(file.serverFileName)
+		baseSHA256, exists := s.SrcFileCache.LookupPreviousVersion(clientFileName)
+		if !exists {
+			continue
+		}
+		pathInSrcCache := s.SrcFileCache.LookupInCache(baseSHA256)
+		if pathInSrcCache == "" {
+			continue
+		}
+		base, err := os.ReadFile(pathInSrcCache)
+		if err != nil {
+			continue
+		}
+
+		blockSize := common.DeltaBlockSize(file.fileSize)
+		weak, strong := common.CalcDeltaSignature(base, blockSize)
+		file.deltaBase = baseSHA256
+		deltaBases = append(deltaBases, &pb.UploadDeltaBase{
+			FileIndex:       index,
+			BlockSize:       uint32(blockSize),
+			WeakChecksums:   weak,
+			StrongChecksums: strong,
+		})
+		logServer.Info(2, "offer delta base", baseSHA256.ToShortHexString(), "sessionID", session.sessionID, clientFileName)
+	}
+	return deltaBases
+}
+
+// receiveUploadedDelta reads all chunks of a delta (see client.uploadFileDelta); an error means a stream is broken
+func receiveUploadedDelta(stream pb.CompilationService_UploadFileStreamServer, firstChunk *pb.UploadFileChunkRequest) ([]byte, error) {
+	delta := make([]byte, 0, firstChunk.DeltaSize)
+	delta = append(delta, firstChunk.ChunkBody...)
+	for int64(len(delta)) < firstChunk.DeltaSize {
+		nextChunk, err := stream.Recv()
+		if err != nil { // EOF is also unexpected
+			return nil, err
+		}
+		if nextChunk.SessionID != firstChunk.SessionID || nextChunk.FileIndex != firstChunk.FileIndex {
+			return nil, fmt.Errorf("inconsistent stream, chunks mismatch")
+		}
+		delta = append(delta, nextChunk.ChunkBody...)
+	}
+	return delta, nil
+}
+
+// applyUploadedDelta reconstructs a file from file.deltaBase and a delta and saves it to file.serverFileName.
+// An error means a client should upload a whole file (a base was purged from src cache, a delta is corrupted, etc.).
+func applyUploadedDelta(noccServer *NoccServer, file *fileInClientDir, delta []byte) error {
+	if file.deltaBase.IsEmpty() {
+		return fmt.Errorf("no delta base was offered")
+	}
+	pathInSrcCache := noccServer.SrcFileCache.LookupInCache(file.deltaBase)
+	if pathInSrcCache == "" {
+		return fmt.Errorf("delta base %s was purged from src cache", file.deltaBase.ToShortHexString())
+	}
+	base, err := os.ReadFile(pathInSrcCache)
+	if err != nil {
+		return err
+	}
+
+	body, err := common.ApplyDelta(base, common.DeltaBlockSize(file.fileSize), delta)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, _ = hasher.Write(body)
+	if bodySHA256 := common.MakeSHA256Struct(hasher); bodySHA256 != file.fileSHA256 {
+		return fmt.Errorf("sha256 mismatch after applying a delta")
+	}
+	return saveUploadedFile(noccServer, body, int(file.fileSize), file.serverFileName)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DiskWatchdog keeps free space on disks of SrcCacheDir and ObjCacheDir, checked by Cron.
+// Cache limits (SrcCacheSize, ObjCacheSize) don't help if a partition is shared or smaller than them:
+// when it fills up, uploads and compilations fail with confusing errors. So when free space drops below MinFreeDiskSpace,
+// the least recently used files are evicted from a cache on that disk, even though it's within its limit.
+// If it's still below CriticalFreeDiskSpace (a disk is filled by someone else, or by working dirs of clients),
+// new sessions are refused with a "busy" error telling why, so that clients send files to other servers.
+// It's nil if MinFreeDiskSpace is not set.
+type DiskWatchdog struct {
+	minFreeBytes      int64
+	criticalFreeBytes int64
+	caches            []*FileCache // src cache first: sources are cheaper to upload again than objects to compile
+
+	critical  atomic.Bool
+	freeBytes atomic.Int64 // the least free space of all cache disks on the last check, for an error message
+}
+
+func MakeDiskWatchdog(minFreeBytes int64, criticalFreeBytes int64, srcCache *FileCache, objCache *FileCache) (*DiskWatchdog, error) {
+	if minFreeBytes == 0 {
+		return nil, nil
+	}
+	if minFreeBytes < 0 || criticalFreeBytes < 0 || criticalFreeBytes > minFreeBytes {
+		return nil, fmt.Errorf("CriticalFreeDiskSpace %d must be between 0 and MinFreeDiskSpace %d", criticalFreeBytes, minFreeBytes)
+	}
+	for _, cache := range []*FileCache{srcCache, objCache} {
+		if getFreeDiskSpace(cache.cacheDir) < 0 {
+			return nil, fmt.Errorf("can't get free disk space of %s", cache.cacheDir)
+		}
+	}
+
+	return &DiskWatchdog{
+		minFreeBytes:      minFreeBytes,
+		criticalFreeBytes: criticalFreeBytes,
+		caches:            []*FileCache{srcCache, objCache},
+	}, nil
+}
+
+// Check evicts cache files while a disk of a cache is low on space and updates whether it's critically full.
+// If both caches are on one disk, the second one is evicted only if evicting the first one was not enough.
+func (watchdog *DiskWatchdog) Check() {
+	if watchdog == nil {
+		return
+	}
+
+	leastFree := int64(-1)
+	for _, cache := range watchdog.caches {
+		freeBytes := getFreeDiskSpace(cache.cacheDir)
+		if freeBytes < 0 {
+			continue
+		}
+		if freeBytes < watchdog.minFreeBytes {
+			nPurged := cache.GetPurgedFilesCount()
+			freed := cache.PurgeBytes(watchdog.minFreeBytes - freeBytes)
+			logServer.Info(0, "low disk space:", freeBytes, "bytes free, evicted", cache.GetPurgedFilesCount()-nPurged, "files of", freed, "bytes from", cache.cacheDir)
+			freeBytes = getFreeDiskSpace(cache.cacheDir)
+		}
+		if leastFree < 0 || freeBytes < leastFree {
+			leastFree = freeBytes
+		}
+	}
+	if leastFree < 0 {
+		return
+	}
+
+	watchdog.freeBytes.Store(leastFree)
+	critical := leastFree < watchdog.criticalFreeBytes
+	if watchdog.critical.Swap(critical) != critical {
+		if critical {
+			logServer.Error("disk is critically full:", leastFree, "bytes free, refusing new sessions")
+		} else {
+			logServer.Info(0, "disk space recovered:", leastFree, "bytes free, accepting new sessions")
+		}
+	}
+}
+
+// RefuseReason is non-empty while a disk of caches is critically full, new sessions are refused then
+func (watchdog *DiskWatchdog) RefuseReason() string {
+	if watchdog == nil || !watchdog.critical.Load() {
+		return ""
+	}
+	return fmt.Sprintf("disk is critically full, %d bytes free", watchdog.freeBytes.Load())
+}
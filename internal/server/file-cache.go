@@ -4,39 +4,54 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"nocc/internal/common"
+	"nocc/pb"
 )
 
 type cachedFile struct {
 	pathInCache string // /tmp/full/path/to/file.ext
 	fileSize    int64
 	lruNode     *lruNode
+	namespace   string // empty if none, see FileCache.PurgeNamespace
 }
 
 type lruNode struct {
 	next, prev *lruNode
 	key        common.SHA256
+	lastAccess int64 // unix nano of the last lookup hit or save, under mu
 }
 
 // FileCache is a base for ObjFileCache and SrcFileCache, see comments for them.
 // It's a directory stored somewhere in / where files could be saved and retrieved back by sha256.
-// It's limited in size by lru (when its size exceeds a limit, the oldest accessed file is deleted).
+// It's limited in size by lru: files are kept in a list ordered by access (a lookup hit or a save moves a file to its head),
+// and when a size exceeds a limit, files are deleted from its tail, the least recently used first.
+// Access times are tracked in memory (not by atime of a filesystem, which is often mounted noatime).
 // "Restoring from cache" is just a hard link to a new path.
 type FileCache struct {
 	table            map[common.SHA256]cachedFile
 	lruTail, lruHead *lruNode
 	mu               sync.RWMutex
 
-	lastIndex   atomic.Int64 // nb! atomic
-	purgedCount atomic.Int64 // nb! atomic
-	cacheDir    string
+	lastIndex       atomic.Int64 // nb! atomic
+	purgedCount     atomic.Int64 // nb! atomic
+	hitsCount       atomic.Int64 // nb! atomic
+	missesCount     atomic.Int64 // nb! atomic
+	saveErrorsCount atomic.Int64 // nb! atomic
+	lastSaveFailed  atomic.Bool  // a cache is degraded (a disk is full or broken, etc.) until a file is saved successfully
+	cacheDir        string
 
 	totalSizeOnDisk atomic.Int64 // nb! atomic
 	hardLimit       int64
 	softLimit       int64
+
+	namespaces      map[string]*cacheNamespace // under mu, only non-empty ones having files
+	NamespaceLimits map[string]int64           // bytes, set for obj cache from ObjCacheNamespaceLimits, see PurgeNamespacesOverLimit
 }
 
 const shardsDirCount = 256
@@ -61,33 +76,83 @@ func MakeFileCache(cacheDir string, limitBytes int64) (*FileCache, error) {
 		cacheDir:  cacheDir,
 		hardLimit: limitBytes,
 		softLimit: int64(80.0 * (float64(limitBytes) / 100.0)),
+
+		namespaces: make(map[string]*cacheNamespace),
 	}, nil
 }
 
 func (cache *FileCache) LookupInCache(key common.SHA256) string {
 	cache.mu.Lock()
 	cachedFile := cache.table[key]
-	if cachedFile.lruNode != nil && cachedFile.lruNode != cache.lruHead {
-		// cachedFile.lruNode != cache.lruHead => cachedFile.lruNode.prev != nil
-		cachedFile.lruNode.prev.next = cachedFile.lruNode.next
-		if cachedFile.lruNode.next == nil {
-			// cachedFile.lruNode.next == nil => cachedFile.lruNode == cache.lruTail
-			cache.lruTail = cachedFile.lruNode.prev
-		} else {
-			cachedFile.lruNode.next.prev = cachedFile.lruNode.prev
-		}
-
-		cachedFile.lruNode.prev = nil
-		cachedFile.lruNode.next = cache.lruHead
-
-		cache.lruHead.prev = cachedFile.lruNode
-		cache.lruHead = cachedFile.lruNode
+	if cachedFile.lruNode != nil {
+		cache.touchLruNode(cachedFile.lruNode)
 	}
 	cache.mu.Unlock()
 
+	if cachedFile.lruNode != nil {
+		cache.hitsCount.Add(1)
+	} else {
+		cache.missesCount.Add(1)
+	}
 	return cachedFile.pathInCache // empty if cachedFile doesn't exist
 }
 
+// touchLruNode moves a node to the head of lru, it's called under mu
+func (cache *FileCache) touchLruNode(node *lruNode) {
+	node.lastAccess = time.Now().UnixNano()
+	if node == cache.lruHead {
+		return
+	}
+
+	cache.unlinkLruNode(node)
+	cache.pushLruHead(node)
+}
+
+// unlinkLruNode removes a node from lru, it's called under mu
+func (cache *FileCache) unlinkLruNode(node *lruNode) {
+	if node.prev == nil {
+		// node.prev == nil => node == cache.lruHead
+		cache.lruHead = node.next
+	} else {
+		node.prev.next = node.next
+	}
+	if node.next == nil {
+		// node.next == nil => node == cache.lruTail
+		cache.lruTail = node.prev
+	} else {
+		node.next.prev = node.prev
+	}
+	node.prev, node.next = nil, nil
+}
+
+// pushLruHead inserts a node as the most recently used, it's called under mu
+func (cache *FileCache) pushLruHead(node *lruNode) {
+	node.next = cache.lruHead
+	if cache.lruHead != nil {
+		cache.lruHead.prev = node
+	}
+	cache.lruHead = node
+	if cache.lruTail == nil {
+		cache.lruTail = node
+	}
+}
+
+// removeFromTable forgets a file (it's to be deleted from disk by a caller, out of mu), it's called under mu
+func (cache *FileCache) removeFromTable(key common.SHA256) cachedFile {
+	removingFile := cache.table[key]
+	delete(cache.table, key)
+	cache.unlinkLruNode(removingFile.lruNode)
+	cache.addToNamespace(removingFile.namespace, -removingFile.fileSize, -1)
+	return removingFile
+}
+
+// deleteRemovedFile deletes a file removed from table, out of mu
+func (cache *FileCache) deleteRemovedFile(removedFile cachedFile) {
+	_ = os.Remove(removedFile.pathInCache)
+	cache.totalSizeOnDisk.Add(-removedFile.fileSize)
+	cache.purgedCount.Add(1)
+}
+
 func (cache *FileCache) CreateHardLinkFromCache(serverFileName string, key common.SHA256) bool {
 	pathInCache := cache.LookupInCache(key)
 	if len(pathInCache) == 0 {
@@ -100,28 +165,35 @@ func (cache *FileCache) CreateHardLinkFromCache(serverFileName string, key commo
 }
 
 func (cache *FileCache) SaveFileToCache(srcPath string, fileNameInCacheDir string, key common.SHA256, fileSize int64) error {
+	return cache.SaveFileToCacheInNamespace(srcPath, fileNameInCacheDir, key, fileSize, "")
+}
+
+// SaveFileToCacheInNamespace saves a file accounted in a namespace; a key must already differ per namespace.
+// If a file with this key exists, it stays in a namespace it was saved in first.
+func (cache *FileCache) SaveFileToCacheInNamespace(srcPath string, fileNameInCacheDir string, key common.SHA256, fileSize int64, namespace string) error {
 	uniqueID := cache.lastIndex.Add(1)
 	pathInCache := fmt.Sprintf("%s/%X/%s.%X", cache.cacheDir, uniqueID%shardsDirCount, fileNameInCacheDir, uniqueID)
 
 	if err := os.Link(srcPath, pathInCache); err != nil {
+		cache.saveErrorsCount.Add(1)
+		cache.lastSaveFailed.Store(true)
+		logServer.Error("can't save to cache:", err)
 		return err
 	}
+	cache.lastSaveFailed.Store(false)
 
-	newHead := &lruNode{key: key}
-	value := cachedFile{pathInCache, fileSize, newHead}
+	newHead := &lruNode{key: key, lastAccess: time.Now().UnixNano()}
+	value := cachedFile{pathInCache, fileSize, newHead, namespace}
 	cache.mu.Lock()
-	_, exists := cache.table[key]
-	if !exists {
+	existing, exists := cache.table[key]
+	if exists {
+		// saved again by another session (or pushed again): it's used, not to be evicted as the oldest one
+		cache.touchLruNode(existing.lruNode)
+	} else {
 		cache.totalSizeOnDisk.Add(fileSize)
 		cache.table[key] = value
-		newHead.next = cache.lruHead
-		if cache.lruHead != nil {
-			cache.lruHead.prev = newHead
-		}
-		cache.lruHead = newHead
-		if cache.lruTail == nil {
-			cache.lruTail = newHead
-		}
+		cache.pushLruHead(newHead)
+		cache.addToNamespace(namespace, fileSize, 1)
 	}
 	cache.mu.Unlock()
 
@@ -137,6 +209,50 @@ func (cache *FileCache) PurgeLastElementsIfRequired() {
 	cache.purgeLastElementsTillLimit(cache.softLimit)
 }
 
+// PurgeBytes deletes the least recently used files of at least nBytes in total (or all files), regardless of a limit.
+// It's called by DiskWatchdog when a disk is low on space. Returns bytes deleted.
+func (cache *FileCache) PurgeBytes(nBytes int64) int64 {
+	sizeBefore := cache.totalSizeOnDisk.Load()
+	cache.purgeLastElementsTillLimit(max(0, sizeBefore-nBytes))
+	return sizeBefore - cache.totalSizeOnDisk.Load()
+}
+
+// PurgeMatching deletes files with a key having a hex prefix (any if empty), not accessed since a time (any if zero),
+// in a namespace (any if empty); it's called by an admin, e.g. to clear a poisoned cache. Returns how many were deleted.
+func (cache *FileCache) PurgeMatching(keyPrefix string, accessedBefore time.Time, namespace string) (nFiles int64, nBytes int64) {
+	keyPrefix = strings.ToLower(keyPrefix)
+	return cache.purgeFromLruTail(func(file cachedFile) bool {
+		return (namespace == "" || file.namespace == namespace) &&
+			(accessedBefore.IsZero() || file.lruNode.lastAccess < accessedBefore.UnixNano()) &&
+			(keyPrefix == "" || strings.HasPrefix(file.lruNode.key.ToHexString(), keyPrefix))
+	})
+}
+
+// ListLargest returns up to n largest files, for an admin to see what takes a cache
+func (cache *FileCache) ListLargest(n int) []*pb.CacheFileEntry {
+	cache.mu.RLock()
+	files := make([]cachedFile, 0, len(cache.table))
+	for _, file := range cache.table {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].fileSize > files[j].fileSize })
+	files = files[:min(n, len(files))]
+
+	now := time.Now()
+	entries := make([]*pb.CacheFileEntry, 0, len(files))
+	for _, file := range files {
+		entries = append(entries, &pb.CacheFileEntry{
+			Key:           file.lruNode.key.ToHexString(),
+			Name:          path.Base(file.pathInCache),
+			FileSize:      file.fileSize,
+			LastAccessSec: int64(now.Sub(time.Unix(0, file.lruNode.lastAccess)).Seconds()),
+			Namespace:     file.namespace,
+		})
+	}
+	cache.mu.RUnlock()
+	return entries
+}
+
 func (cache *FileCache) GetFilesCount() int64 {
 	cache.mu.Lock()
 	elements := len(cache.table)
@@ -152,6 +268,35 @@ func (cache *FileCache) GetPurgedFilesCount() int64 {
 	return cache.purgedCount.Load()
 }
 
+// GetHitsCount and GetMissesCount count lookups by a key, both from sessions and internal ones (like a provenance of a .o)
+func (cache *FileCache) GetHitsCount() int64 {
+	return cache.hitsCount.Load()
+}
+
+func (cache *FileCache) GetMissesCount() int64 {
+	return cache.missesCount.Load()
+}
+
+// GetOldestAccessTime returns when the least recently used file was accessed (it's the next to be evicted), zero if empty.
+// A time since it is how long an unused file lives in a cache.
+func (cache *FileCache) GetOldestAccessTime() time.Time {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	if cache.lruTail == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, cache.lruTail.lastAccess)
+}
+
+func (cache *FileCache) GetSaveErrorsCount() int64 {
+	return cache.saveErrorsCount.Load()
+}
+
+// IsDegraded is true if the last attempt to save a file failed; then clients are notified via KeepAlive
+func (cache *FileCache) IsDegraded() bool {
+	return cache.lastSaveFailed.Load()
+}
+
 func (cache *FileCache) DropAll() {
 	cache.mu.Lock()
 	cache.purgedCount.Add(int64(len(cache.table)))
@@ -159,7 +304,8 @@ func (cache *FileCache) DropAll() {
 
 	cache.table = make(map[common.SHA256]cachedFile, 128*1024)
 	cache.lruHead = nil
-	cache.lruHead = nil
+	cache.lruTail = nil
+	cache.namespaces = make(map[string]*cacheNamespace)
 	_ = os.RemoveAll(cache.cacheDir)
 	_ = createSubdirsForFileCache(cache.cacheDir)
 
@@ -170,18 +316,14 @@ func (cache *FileCache) purgeLastElementsTillLimit(cacheLimit int64) {
 	for cache.totalSizeOnDisk.Load() > cacheLimit {
 		var removingFile cachedFile
 		cache.mu.Lock()
-		if tail := cache.lruTail; tail != nil && tail.prev != nil {
-			cache.lruTail = tail.prev
-			cache.lruTail.next = nil
-			removingFile = cache.table[tail.key]
-			delete(cache.table, tail.key)
+		if tail := cache.lruTail; tail != nil {
+			removingFile = cache.removeFromTable(tail.key)
 		}
 		cache.mu.Unlock()
 
-		if removingFile.lruNode != nil {
-			_ = os.Remove(removingFile.pathInCache)
-			cache.totalSizeOnDisk.Add(-removingFile.fileSize)
-			cache.purgedCount.Add(1)
+		if removingFile.lruNode == nil {
+			return // a cache is empty
 		}
+		cache.deleteRemovedFile(removingFile)
 	}
 }
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"nocc/internal/common"
+)
+
+// TestFileCacheEviction runs operations on a cache and checks what's left, from the most recently used.
+// Operations are "+a:10" (save a file "a" of 10 bytes), "+a:10@ns" (in a namespace), "?a" (look up),
+// "purge" (down to a soft limit), "purgeBytes:15", "purgeNamespaces" (over NamespaceLimits).
+func TestFileCacheEviction(t *testing.T) {
+	tests := []struct {
+		name            string
+		limit           int64
+		namespaceLimits map[string]int64
+		ops             string
+		wantLru         string
+	}{
+		{"under a limit", 100, nil, "+a:10 +b:10 +c:10", "c b a"},
+		{"a lookup moves to head", 100, nil, "+a:10 +b:10 +c:10 ?a", "a c b"},
+		{"a lookup miss", 100, nil, "+a:10 +b:10 ?x", "b a"},
+		{"over a limit, the least recently used", 25, nil, "+a:10 +b:10 ?a +c:10", "c a"},
+		{"saved again is used", 25, nil, "+a:10 +b:10 +a:10 +c:10", "c a"},
+		{"a large file evicts several", 30, nil, "+a:10 +b:10 +c:10 +d:25", "d"},
+		{"exactly a limit", 30, nil, "+a:10 +b:10 +c:10", "c b a"},
+		{"a file over a limit evicts all", 20, nil, "+a:10 +b:30", ""},
+		{"a soft limit", 100, nil, "+a:30 +b:30 +c:30 ?a purge", "a c"},
+		{"under a soft limit", 100, nil, "+a:30 +b:30 purge", "b a"},
+		{"purge bytes", 100, nil, "+a:10 +b:10 +c:10 purgeBytes:15", "c"},
+		{"purge more bytes than all", 100, nil, "+a:10 +b:10 purgeBytes:100", ""},
+		{"a namespace over its limit", 1000, map[string]int64{"p": 15}, "+a:10@p +b:10@q +c:10@p ?a purgeNamespaces", "a b"},
+		{"a namespace under its limit", 1000, map[string]int64{"p": 20}, "+a:10@p +b:10@q +c:10@p purgeNamespaces", "c b a"},
+		{"a namespace without a limit", 1000, map[string]int64{"p": 5}, "+a:10@q +b:10 +c:10@q purgeNamespaces", "c b a"},
+		{"namespaces over limits", 1000, map[string]int64{"p": 10, "q": 15}, "+a:10@p +b:10@q +c:10@p +d:10@q +e:10 purgeNamespaces", "e d c"},
+		{"a namespace is evicted by a cache limit", 25, map[string]int64{"p": 100}, "+a:10@p +b:10 +c:10@p purgeNamespaces", "c b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := MakeFileCache(t.TempDir(), tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache.NamespaceLimits = tt.namespaceLimits
+			srcDir := t.TempDir()
+			sizes := make(map[string]int64)
+			namespaces := make(map[string]string)
+
+			for _, op := range strings.Fields(tt.ops) {
+				switch {
+				case op[0] == '+':
+					name, rest, _ := strings.Cut(op[1:], ":")
+					sizeStr, namespace, _ := strings.Cut(rest, "@")
+					size, _ := strconv.ParseInt(sizeStr, 10, 64)
+					srcPath := filepath.Join(srcDir, name)
+					if err := os.WriteFile(srcPath, make([]byte, size), 0644); err != nil {
+						t.Fatal(err)
+					}
+					if err := cache.SaveFileToCacheInNamespace(srcPath, name, testCacheKey(name), size, namespace); err != nil {
+						t.Fatal(err)
+					}
+					sizes[name], namespaces[name] = size, namespace
+				case op[0] == '?':
+					cache.LookupInCache(testCacheKey(op[1:]))
+				case op == "purge":
+					cache.PurgeLastElementsIfRequired()
+				case strings.HasPrefix(op, "purgeBytes:"):
+					nBytes, _ := strconv.ParseInt(op[len("purgeBytes:"):], 10, 64)
+					cache.PurgeBytes(nBytes)
+				case op == "purgeNamespaces":
+					cache.PurgeNamespacesOverLimit()
+				default:
+					t.Fatalf("unknown op %q", op)
+				}
+			}
+
+			var lru []string
+			for node := cache.lruHead; node != nil; node = node.next {
+				lru = append(lru, testCacheName(node.key))
+			}
+			if strings.Join(lru, " ") != tt.wantLru {
+				t.Fatalf("lru %q, expected %q", lru, tt.wantLru)
+			}
+
+			// a cache is consistent with what's left: sizes, namespaces, files on disk, a list in reverse
+			var wantBytes int64
+			wantNamespaces := make(map[string]int64)
+			for _, name := range lru {
+				wantBytes += sizes[name]
+				if namespaces[name] != "" {
+					wantNamespaces[namespaces[name]] += sizes[name]
+				}
+			}
+			if cache.GetBytesOnDisk() != wantBytes || cache.GetFilesCount() != int64(len(lru)) {
+				t.Errorf("%d bytes in %d files, expected %d bytes", cache.GetBytesOnDisk(), cache.GetFilesCount(), wantBytes)
+			}
+			for _, stats := range cache.GetNamespacesStats() {
+				if stats.BytesOnDisk != wantNamespaces[stats.Namespace] {
+					t.Errorf("namespace %s has %d bytes, expected %d", stats.Namespace, stats.BytesOnDisk, wantNamespaces[stats.Namespace])
+				}
+				delete(wantNamespaces, stats.Namespace)
+			}
+			if len(wantNamespaces) != 0 {
+				t.Errorf("namespaces %v are not counted", wantNamespaces)
+			}
+			nFilesOnDisk := 0
+			_ = filepath.WalkDir(cache.cacheDir, func(_ string, entry fs.DirEntry, _ error) error {
+				if entry != nil && entry.Type().IsRegular() {
+					nFilesOnDisk++
+				}
+				return nil
+			})
+			if nFilesOnDisk != len(lru) {
+				t.Errorf("%d files on disk, expected %d", nFilesOnDisk, len(lru))
+			}
+			for node, i := cache.lruTail, len(lru)-1; node != nil || i >= 0; node, i = node.prev, i-1 {
+				if node == nil || i < 0 || testCacheName(node.key) != lru[i] {
+					t.Fatal("lru is broken in reverse")
+				}
+			}
+		})
+	}
+}
+
+func testCacheKey(name string) common.SHA256 {
+	return common.SHA256{B0_7: uint64(name[0])}
+}
+
+func testCacheName(key common.SHA256) string {
+	return string(rune(key.B0_7))
+}
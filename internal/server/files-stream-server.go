@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"strings"
 
+	"nocc/internal/common"
 	"nocc/pb"
 )
 
@@ -33,11 +36,17 @@ func receiveUploadedFileByChunks(noccServer *NoccServer, stream pb.CompilationSe
 		}
 		receivedBytes += len(nextChunk.ChunkBody)
 	}
+	if err == nil && receivedBytes != expectedBytes {
+		err = fmt.Errorf("inconsistent stream, received %d bytes instead of %d", receivedBytes, expectedBytes)
+	}
 
 	if fileTmp != nil {
 		_ = fileTmp.Close()
 		if err == nil {
-			err = os.Rename(fileTmp.Name(), serverFileName)
+			err = common.InjectFault(common.FaultUploadRenameFail)
+		}
+		if err == nil {
+			err = placeUploadedFile(noccServer, fileTmp.Name(), serverFileName)
 		}
 		if err != nil {
 			_ = os.Remove(fileTmp.Name())
@@ -46,70 +55,215 @@ func receiveUploadedFileByChunks(noccServer *NoccServer, stream pb.CompilationSe
 	return
 }
 
-// sendObjFileByChunks is an actual implementation of piping a local server file to a client stream.
-// See client.receiveObjFileByChunks.
-func sendObjFileByChunks(stream pb.CompilationService_RecvCompiledObjStreamServer, chunkBuf []byte, session *Session) error {
-	if session.interrupted {
-		err := stream.Send(&pb.RecvCompiledObjChunkReply{
-			SessionID:   session.sessionID,
-			Interrupted: true,
-		})
-		if err != nil {
-			return err
-		}
+// saveUploadedFile is like receiveUploadedFileByChunks for a file sent in a batch, see NoccServer.receiveUploadedBatch.
+func saveUploadedFile(noccServer *NoccServer, body []byte, expectedBytes int, serverFileName string) error {
+	if len(body) != expectedBytes {
+		return fmt.Errorf("inconsistent batch, received %d bytes instead of %d", len(body), expectedBytes)
 	}
 
-	fd, err := os.Open(session.OutputFile)
+	fileTmp, err := noccServer.SrcFileCache.MakeTempFileForUploadSaving(serverFileName)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
-	stat, err := fd.Stat()
+	_, err = fileTmp.Write(body)
+	_ = fileTmp.Close()
+	if err == nil {
+		err = common.InjectFault(common.FaultUploadRenameFail)
+	}
+	if err == nil {
+		err = placeUploadedFile(noccServer, fileTmp.Name(), serverFileName)
+	}
 	if err != nil {
-		return err
+		_ = os.Remove(fileTmp.Name())
 	}
+	return err
+}
 
-	err = stream.Send(&pb.RecvCompiledObjChunkReply{
-		SessionID:        session.sessionID,
-		CompilerExitCode: int32(session.compilerExitCode),
-		CompilerStdout:   session.compilerStdout,
-		CompilerStderr:   session.compilerStderr,
-		CompilerDuration: session.compilerDuration,
-		FileSize:         stat.Size(),
-	})
+// receivePushedObjByChunks saves a .o pushed by another server to obj cache, see NoccServer.PushObjToCache.
+func receivePushedObjByChunks(noccServer *NoccServer, stream pb.CompilationService_PushObjToCacheServer, firstChunk *pb.PushObjChunkRequest, key common.SHA256) error {
+	fileName := path.Base(firstChunk.FileName)
+	fileTmp, err := os.CreateTemp(noccServer.ObjFileCache.objTmpDir, "pushed.*."+fileName)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(fileTmp.Name()) // after being saved, it's hard linked to obj cache
 
-	var n int
-	for {
-		n, err = fd.Read(chunkBuf)
-		if err == io.EOF {
+	receivedBytes := int64(len(firstChunk.ChunkBody))
+	_, err = fileTmp.Write(firstChunk.ChunkBody)
+	for receivedBytes < firstChunk.FileSize && err == nil {
+		var nextChunk *pb.PushObjChunkRequest
+		nextChunk, err = stream.Recv()
+		if err != nil { // EOF is also unexpected
 			break
 		}
+		_, err = fileTmp.Write(nextChunk.ChunkBody)
+		receivedBytes += int64(len(nextChunk.ChunkBody))
+	}
+	_ = fileTmp.Close()
+
+	if err == nil && receivedBytes != firstChunk.FileSize {
+		err = fmt.Errorf("inconsistent stream, received %d bytes instead of %d", receivedBytes, firstChunk.FileSize)
+	}
+	if err == nil {
+		err = noccServer.ObjFileCache.SaveFileToCache(fileTmp.Name(), fileName, key, receivedBytes)
+	}
+	return err
+}
+
+// sendObjFileByChunks is an actual implementation of piping a local server file to a client stream.
+// See client.objReceiving.
+func sendObjFileByChunks(stream pb.CompilationService_RecvCompiledObjStreamServer, chunkBuf []byte, session *Session) error {
+	sender, err := startSendingObjFile(stream, session)
+	for sender != nil && err == nil {
+		sender, err = sender.sendNextChunk(stream, chunkBuf)
+	}
+
+	// after sending a compiled obj, the client doesn't respond in any way,
+	// so we don't call stream.Recv(), the stream is already ready to send other objs
+	return err
+}
+
+// maxInterleavedObjFiles is how many .o files are sent over one stream at once, see sendObjFilesInterleaved
+const maxInterleavedObjFiles = 4
+
+// objFileSender sends a .o chunk by chunk; chunks of several senders can be interleaved over one stream,
+// then a large .o doesn't delay small ones (a client distinguishes them by sessionID).
+// If a client requested a BMI (see Session.moduleOutputFile), it's sent right after .o, as if it's one file;
+// side outputs (see Session.sideOutputFiles) are appended the same way.
+type objFileSender struct {
+	session   *Session
+	fds       []*os.File // .o, then a BMI and side outputs if any
+	sizes     []int64    // of fds when opened, a client expects exactly that many bytes of each
+	reader    io.Reader  // all fds one after another
+	leftBytes int64
+}
+
+// startSendingObjFile sends a header (exit code, file size, etc.) and returns a sender of chunks.
+// A sender is nil if there is nothing more to send (an interrupted session or an empty file).
+func startSendingObjFile(stream pb.CompilationService_RecvCompiledObjStreamServer, session *Session) (*objFileSender, error) {
+	if session.interrupted || session.expired.Load() {
+		return nil, stream.Send(&pb.RecvCompiledObjChunkReply{
+			SessionID:   session.sessionID,
+			Interrupted: true,
+		})
+	}
+
+	sender := &objFileSender{session: session}
+	fileSize, err := sender.open(session.OutputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	bmiSize := int64(0)
+	if session.moduleOutputFile != "" {
+		if bmiSize, err = sender.open(session.moduleOutputFile); err != nil {
+			sender.close()
+			return nil, err
+		}
+	}
+
+	sideOutputs := make([]*pb.SideOutputFile, 0, len(session.sideOutputFiles))
+	sideOutputsSize := int64(0)
+	for _, fileName := range session.sideOutputFiles {
+		size, err := sender.open(fileName)
 		if err != nil {
-			return err
+			sender.close()
+			return nil, err
 		}
+		sideOutputs = append(sideOutputs, &pb.SideOutputFile{Ext: strings.TrimPrefix(fileName, common.ReplaceFileExt(session.OutputFile, "")), FileSize: size})
+		sideOutputsSize += size
+	}
+
+	readers := make([]io.Reader, len(sender.fds))
+	for i, fd := range sender.fds {
+		readers[i] = io.LimitReader(fd, sender.sizes[i])
+	}
+	sender.reader = io.MultiReader(readers...)
+
+	totalSize := fileSize + bmiSize + sideOutputsSize
+	sender.leftBytes = totalSize
+	err = stream.Send(&pb.RecvCompiledObjChunkReply{
+		SessionID:          session.sessionID,
+		CompilerExitCode:   int32(session.compilerExitCode),
+		CompilerSignal:     session.compilerSignal,
+		CompilerStdout:     session.compilerStdout,
+		CompilerStderr:     session.compilerStderr,
+		CompilerDuration:   session.compilerDuration,
+		CompilerQueued:     session.compilerQueued,
+		CompilerQueueDepth: session.compilerQueueDepth,
+		FileSize:           totalSize,
+		FromObjCache:       session.objCacheExists,
+		ModuleOutputSize:   bmiSize,
+		SideOutputs:        sideOutputs,
+		Provenance:         session.provenance,
+		OnDemandFiles:      session.onDemandFiles,
+	})
+	if err != nil || totalSize == 0 {
+		sender.close()
+		return nil, err
+	}
+
+	return sender, nil
+}
+
+// open appends a file to be sent and returns its size
+func (sender *objFileSender) open(fileName string) (int64, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return 0, err
+	}
+	sender.fds = append(sender.fds, fd)
+	sender.sizes = append(sender.sizes, stat.Size())
+	return stat.Size(), nil
+}
+
+// sendNextChunk returns the same sender if there are more chunks to send, nil on EOF or error
+func (sender *objFileSender) sendNextChunk(stream pb.CompilationService_RecvCompiledObjStreamServer, chunkBuf []byte) (*objFileSender, error) {
+	n, err := sender.reader.Read(chunkBuf)
+	if err == io.EOF && sender.leftBytes == 0 {
+		sender.close()
+		return nil, nil
+	}
+	if err == io.EOF { // a client would wait for the rest forever, a stream is recreated instead
+		err = fmt.Errorf("%s was truncated while sending, %d bytes left", sender.session.OutputFile, sender.leftBytes)
+	}
+	sender.leftBytes -= int64(n)
+	common.InjectDelay(common.FaultObjStreamDelay)
+	if err == nil && common.InjectFault(common.FaultObjChunkDrop) == nil {
 		err = stream.Send(&pb.RecvCompiledObjChunkReply{
-			SessionID: session.sessionID,
+			SessionID: sender.session.sessionID,
 			ChunkBody: chunkBuf[:n],
 		})
-		if err != nil {
-			return err
-		}
 	}
+	if err != nil {
+		sender.close()
+		return nil, err
+	}
+	return sender, nil
+}
 
-	// after sending a compiled obj, the client doesn't respond in any way,
-	// so we don't call stream.Recv(), the stream is already ready to send other objs
-	return nil
+func (sender *objFileSender) close() {
+	for _, fd := range sender.fds {
+		_ = fd.Close()
+	}
 }
 
 func sendFailureMessage(stream pb.CompilationService_RecvCompiledObjStreamServer, session *Session) error {
 	return stream.Send(&pb.RecvCompiledObjChunkReply{
-		SessionID:        session.sessionID,
-		CompilerExitCode: int32(session.compilerExitCode),
-		CompilerStdout:   session.compilerStdout,
-		CompilerStderr:   session.compilerStderr,
-		CompilerDuration: session.compilerDuration,
+		SessionID:          session.sessionID,
+		CompilerExitCode:   int32(session.compilerExitCode),
+		CompilerSignal:     session.compilerSignal,
+		CompilerStdout:     session.compilerStdout,
+		CompilerStderr:     session.compilerStderr,
+		CompilerDuration:   session.compilerDuration,
+		CompilerQueued:     session.compilerQueued,
+		CompilerQueueDepth: session.compilerQueueDepth,
+		WrongObjTarget:     session.wrongObjTarget,
+		OnDemandFiles:      session.onDemandFiles,
 	})
 }
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fuseConn is a minimal read-only FUSE server speaking the kernel protocol directly (see fuse(4) and linux/fuse.h),
+// enough for a compiler to look up, list and read files; other operations fail with ENOSYS (writes with EROFS).
+// It's used by OnDemandIncludes, a filesystem itself is fuseFilesystem.
+// Every request is handled in its own goroutine: serving a file may wait for a client, other requests don't wait for it.
+type fuseConn struct {
+	fd         int
+	mountPoint string
+	fs         fuseFilesystem
+
+	mu         sync.Mutex
+	dirHandles map[uint64][]fuseDirEntry // listed on OPENDIR, read by READDIR with offsets
+	lastFh     uint64
+}
+
+// fuseFilesystem serves a mounted tree; pid is a process that issued a request (a filesystem may show different
+// contents to different compilers). Inodes are never reused while the kernel remembers them (until forget).
+type fuseFilesystem interface {
+	lookup(pid uint32, parentIno uint64, name string) (fuseAttr, syscall.Errno)
+	forget(ino uint64, nlookup uint64)
+	getattr(ino uint64) (fuseAttr, syscall.Errno)
+	readlink(ino uint64) (string, syscall.Errno)
+	open(pid uint32, ino uint64) (uint64, syscall.Errno) // returns a file handle
+	read(fh uint64, offset int64, buf []byte) (int, syscall.Errno)
+	release(fh uint64)
+	readdir(pid uint32, ino uint64) ([]fuseDirEntry, syscall.Errno)
+}
+
+type fuseAttr struct {
+	ino   uint64
+	size  int64
+	mtime int64 // unix nanoseconds
+	mode  uint32
+}
+
+type fuseDirEntry struct {
+	ino  uint64
+	name string
+	mode uint32
+}
+
+const fuseRootIno = 1
+
+const (
+	fuseOpLookup      = 1
+	fuseOpForget      = 2
+	fuseOpGetattr     = 3
+	fuseOpReadlink    = 5
+	fuseOpOpen        = 14
+	fuseOpRead        = 15
+	fuseOpStatfs      = 17
+	fuseOpRelease     = 18
+	fuseOpFlush       = 25
+	fuseOpInit        = 26
+	fuseOpOpendir     = 27
+	fuseOpReaddir     = 28
+	fuseOpReleasedir  = 29
+	fuseOpAccess      = 34
+	fuseOpInterrupt   = 36
+	fuseOpDestroy     = 38
+	fuseOpBatchForget = 42
+)
+
+const (
+	fuseKernelVersion      = 7
+	fuseKernelMinorVersion = 31
+	fuseAsyncRead          = 1 << 0
+	fuseOpenKeepCache      = 1 << 1 // a file of an inode never changes, see onDemandNode
+	fuseReadBufferSize     = 64 * 1024
+)
+
+type fuseInHeader struct {
+	len         uint32
+	opcode      uint32
+	unique      uint64
+	nodeid      uint64
+	uid         uint32
+	gid         uint32
+	pid         uint32
+	totalExtlen uint16
+	padding     uint16
+}
+
+type fuseOutHeader struct {
+	len    uint32
+	error  int32
+	unique uint64
+}
+
+type fuseInitIn struct {
+	major        uint32
+	minor        uint32
+	maxReadahead uint32
+	flags        uint32
+}
+
+type fuseInitOut struct {
+	major               uint32
+	minor               uint32
+	maxReadahead        uint32
+	flags               uint32
+	maxBackground       uint16
+	congestionThreshold uint16
+	maxWrite            uint32
+	timeGran            uint32
+	maxPages            uint16
+	mapAlignment        uint16
+	flags2              uint32
+	unused              [7]uint32
+}
+
+type fuseAttrOut struct {
+	ino       uint64
+	size      uint64
+	blocks    uint64
+	atime     uint64
+	mtime     uint64
+	ctime     uint64
+	atimensec uint32
+	mtimensec uint32
+	ctimensec uint32
+	mode      uint32
+	nlink     uint32
+	uid       uint32
+	gid       uint32
+	rdev      uint32
+	blksize   uint32
+	flags     uint32
+}
+
+type fuseEntryOut struct {
+	nodeid         uint64
+	generation     uint64
+	entryValid     uint64
+	attrValid      uint64
+	entryValidNsec uint32
+	attrValidNsec  uint32
+	attr           fuseAttrOut
+}
+
+type fuseGetattrOut struct {
+	attrValid     uint64
+	attrValidNsec uint32
+	dummy         uint32
+	attr          fuseAttrOut
+}
+
+type fuseOpenOut struct {
+	fh        uint64
+	openFlags uint32
+	padding   uint32
+}
+
+type fuseReadIn struct {
+	fh        uint64
+	offset    uint64
+	size      uint32
+	readFlags uint32
+	lockOwner uint64
+	flags     uint32
+	padding   uint32
+}
+
+type fuseForgetOne struct {
+	nodeid  uint64
+	nlookup uint64
+}
+
+type fuseStatfsOut struct {
+	blocks  uint64
+	bfree   uint64
+	bavail  uint64
+	files   uint64
+	ffree   uint64
+	bsize   uint32
+	namelen uint32
+	frsize  uint32
+	padding uint32
+	spare   [6]uint32
+}
+
+type fuseDirentHeader struct {
+	ino     uint64
+	off     uint64
+	namelen uint32
+	typ     uint32
+}
+
+// mountFuse mounts a read-only fs at mountPoint (an existing empty dir) and starts serving it
+func mountFuse(mountPoint string, fs fuseFilesystem) (*fuseConn, error) {
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/fuse: %v", err)
+	}
+
+	options := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0,allow_other,default_permissions", fd)
+	if err := unix.Mount("nocc", mountPoint, "fuse", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, options); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("mount fuse at %s: %v", mountPoint, err)
+	}
+
+	conn := &fuseConn{
+		fd:         fd,
+		mountPoint: mountPoint,
+		fs:         fs,
+		dirHandles: make(map[uint64][]fuseDirEntry),
+	}
+	go conn.serve()
+	return conn, nil
+}
+
+// unmount detaches a mount (compilers still using it finish with errors), then serve() stops
+func (conn *fuseConn) unmount() {
+	if err := unix.Unmount(conn.mountPoint, unix.MNT_DETACH); err != nil {
+		logServer.Error("failed to unmount", conn.mountPoint, err)
+	}
+	_ = unix.Close(conn.fd)
+}
+
+func (conn *fuseConn) serve() {
+	buf := make([]byte, fuseReadBufferSize)
+	for {
+		n, err := unix.Read(conn.fd, buf)
+		if err == unix.EINTR || err == unix.EAGAIN || err == unix.ENOENT { // ENOENT: a request was interrupted
+			continue
+		}
+		if err != nil { // ENODEV after unmounting, EBADF after closing
+			return
+		}
+		if n < int(unsafe.Sizeof(fuseInHeader{})) {
+			continue
+		}
+
+		request := make([]byte, n)
+		copy(request, buf[:n])
+		go conn.handle(request)
+	}
+}
+
+func (conn *fuseConn) handle(request []byte) {
+	header := (*fuseInHeader)(unsafe.Pointer(&request[0]))
+	body := request[unsafe.Sizeof(fuseInHeader{}):]
+
+	switch header.opcode {
+	case fuseOpInit:
+		in := (*fuseInitIn)(unsafe.Pointer(&body[0]))
+		out := fuseInitOut{
+			major:               fuseKernelVersion,
+			minor:               fuseKernelMinorVersion,
+			maxReadahead:        in.maxReadahead,
+			flags:               in.flags & fuseAsyncRead,
+			maxBackground:       64,
+			congestionThreshold: 48,
+			maxWrite:            4096,
+			timeGran:            1,
+		}
+		conn.reply(header, 0, structBytes(&out))
+
+	case fuseOpLookup:
+		name := string(body[:len(body)-1]) // NUL-terminated
+		attr, errno := conn.fs.lookup(header.pid, header.nodeid, name)
+		if errno != 0 {
+			conn.reply(header, errno, nil)
+			return
+		}
+		out := fuseEntryOut{nodeid: attr.ino, attr: attr.toAttrOut()} // not cached: every lookup asks fs again
+		conn.reply(header, 0, structBytes(&out))
+
+	case fuseOpForget:
+		conn.fs.forget(header.nodeid, *(*uint64)(unsafe.Pointer(&body[0])))
+
+	case fuseOpBatchForget:
+		count := *(*uint32)(unsafe.Pointer(&body[0]))
+		for i := 0; i < int(count); i++ {
+			forget := (*fuseForgetOne)(unsafe.Pointer(&body[8+i*int(unsafe.Sizeof(fuseForgetOne{}))]))
+			conn.fs.forget(forget.nodeid, forget.nlookup)
+		}
+
+	case fuseOpGetattr:
+		attr, errno := conn.fs.getattr(header.nodeid)
+		if errno != 0 {
+			conn.reply(header, errno, nil)
+			return
+		}
+		out := fuseGetattrOut{attr: attr.toAttrOut()}
+		conn.reply(header, 0, structBytes(&out))
+
+	case fuseOpReadlink:
+		target, errno := conn.fs.readlink(header.nodeid)
+		conn.reply(header, errno, []byte(target))
+
+	case fuseOpOpen:
+		fh, errno := conn.fs.open(header.pid, header.nodeid)
+		out := fuseOpenOut{fh: fh, openFlags: fuseOpenKeepCache}
+		conn.reply(header, errno, structBytes(&out))
+
+	case fuseOpRead:
+		in := (*fuseReadIn)(unsafe.Pointer(&body[0]))
+		data := make([]byte, in.size)
+		n, errno := conn.fs.read(in.fh, int64(in.offset), data)
+		conn.reply(header, errno, data[:n])
+
+	case fuseOpRelease:
+		conn.fs.release(*(*uint64)(unsafe.Pointer(&body[0])))
+		conn.reply(header, 0, nil)
+
+	case fuseOpOpendir:
+		entries, errno := conn.fs.readdir(header.pid, header.nodeid)
+		if errno != 0 {
+			conn.reply(header, errno, nil)
+			return
+		}
+		conn.mu.Lock()
+		conn.lastFh++
+		fh := conn.lastFh
+		conn.dirHandles[fh] = entries
+		conn.mu.Unlock()
+		out := fuseOpenOut{fh: fh}
+		conn.reply(header, 0, structBytes(&out))
+
+	case fuseOpReaddir:
+		in := (*fuseReadIn)(unsafe.Pointer(&body[0]))
+		conn.mu.Lock()
+		entries := conn.dirHandles[in.fh]
+		conn.mu.Unlock()
+		conn.reply(header, 0, encodeDirents(entries, in.offset, int(in.size)))
+
+	case fuseOpReleasedir:
+		conn.mu.Lock()
+		delete(conn.dirHandles, *(*uint64)(unsafe.Pointer(&body[0])))
+		conn.mu.Unlock()
+		conn.reply(header, 0, nil)
+
+	case fuseOpStatfs:
+		out := fuseStatfsOut{bsize: 4096, frsize: 4096, namelen: 255}
+		conn.reply(header, 0, structBytes(&out))
+
+	case fuseOpFlush, fuseOpAccess:
+		conn.reply(header, 0, nil)
+
+	case fuseOpInterrupt, fuseOpDestroy:
+		// no reply: an interrupted request is replied when it finishes
+
+	default:
+		conn.reply(header, unix.ENOSYS, nil)
+	}
+}
+
+func (conn *fuseConn) reply(header *fuseInHeader, errno syscall.Errno, body []byte) {
+	if errno != 0 {
+		body = nil
+	}
+	out := fuseOutHeader{
+		len:    uint32(unsafe.Sizeof(fuseOutHeader{})) + uint32(len(body)),
+		error:  -int32(errno),
+		unique: header.unique,
+	}
+	// a reply to an interrupted request fails with ENOENT, it's fine
+	_, _ = unix.Writev(conn.fd, [][]byte{structBytes(&out), body})
+}
+
+// encodeDirents packs entries starting from offset (an index) into at most size bytes, as struct fuse_dirent
+func encodeDirents(entries []fuseDirEntry, offset uint64, size int) []byte {
+	out := make([]byte, 0, size)
+	for i := offset; i < uint64(len(entries)); i++ {
+		entry := entries[i]
+		direntSize := int(unsafe.Sizeof(fuseDirentHeader{})) + len(entry.name)
+		paddedSize := (direntSize + 7) &^ 7
+		if len(out)+paddedSize > size {
+			break
+		}
+		dirent := fuseDirentHeader{ino: entry.ino, off: i + 1, namelen: uint32(len(entry.name)), typ: entry.mode >> 12}
+		out = append(out, structBytes(&dirent)...)
+		out = append(out, entry.name...)
+		out = append(out, make([]byte, paddedSize-direntSize)...)
+	}
+	return out
+}
+
+func (attr *fuseAttr) toAttrOut() fuseAttrOut {
+	nlink := uint32(1)
+	if attr.mode&unix.S_IFMT == unix.S_IFDIR {
+		nlink = 2
+	}
+	return fuseAttrOut{
+		ino:       attr.ino,
+		size:      uint64(attr.size),
+		blocks:    uint64(attr.size+511) / 512,
+		atime:     uint64(attr.mtime / 1e9),
+		mtime:     uint64(attr.mtime / 1e9),
+		ctime:     uint64(attr.mtime / 1e9),
+		atimensec: uint32(attr.mtime % 1e9),
+		mtimensec: uint32(attr.mtime % 1e9),
+		ctimensec: uint32(attr.mtime % 1e9),
+		mode:      attr.mode,
+		nlink:     nlink,
+		blksize:   4096,
+	}
+}
+
+// structBytes is a view of a protocol struct as bytes, they are in native byte order, as the kernel expects
+func structBytes[T any](value *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(value)), unsafe.Sizeof(*value))
+}
+
+// unmountStaleFuse detaches mounts left under dir by a previous launch that didn't unmount them (e.g. was killed);
+// otherwise, removing dir would fail (a dead FUSE mount fails any access with ENOTCONN)
+func unmountStaleFuse(dir string) {
+	mountInfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return
+	}
+	var stale []string
+	for _, line := range strings.Split(string(mountInfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && (fields[4] == dir || strings.HasPrefix(fields[4], dir+"/")) {
+			stale = append(stale, fields[4])
+		}
+	}
+	for i := len(stale) - 1; i >= 0; i-- { // nested ones are listed after their parents
+		_ = unix.Unmount(stale[i], unix.MNT_DETACH)
+	}
+}
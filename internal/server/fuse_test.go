@@ -0,0 +1,486 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// testFuseFilesystem serves files of a map, inodes are indexes in it + 2 (1 is a root)
+type testFuseFilesystem struct {
+	files []testFuseFile
+
+	mu        sync.Mutex
+	forgotten map[uint64]uint64
+	released  []uint64
+}
+
+type testFuseFile struct {
+	name   string
+	body   string
+	target string // a symlink if set
+}
+
+func (fs *testFuseFilesystem) attrOf(ino uint64) (fuseAttr, syscall.Errno) {
+	if ino == fuseRootIno {
+		return fuseAttr{ino: ino, mode: unix.S_IFDIR | 0555}, 0
+	}
+	if ino < 2 || ino-2 >= uint64(len(fs.files)) {
+		return fuseAttr{}, unix.ENOENT
+	}
+	file := fs.files[ino-2]
+	if file.target != "" {
+		return fuseAttr{ino: ino, size: int64(len(file.target)), mode: unix.S_IFLNK | 0777}, 0
+	}
+	return fuseAttr{ino: ino, size: int64(len(file.body)), mtime: 1_500_000_000_123_456_789, mode: unix.S_IFREG | 0444}, 0
+}
+
+func (fs *testFuseFilesystem) lookup(pid uint32, parentIno uint64, name string) (fuseAttr, syscall.Errno) {
+	for i, file := range fs.files {
+		if parentIno == fuseRootIno && file.name == name {
+			return fs.attrOf(uint64(i + 2))
+		}
+	}
+	return fuseAttr{}, unix.ENOENT
+}
+
+func (fs *testFuseFilesystem) forget(ino uint64, nlookup uint64) {
+	fs.mu.Lock()
+	fs.forgotten[ino] += nlookup
+	fs.mu.Unlock()
+}
+
+func (fs *testFuseFilesystem) getattr(ino uint64) (fuseAttr, syscall.Errno) {
+	return fs.attrOf(ino)
+}
+
+func (fs *testFuseFilesystem) readlink(ino uint64) (string, syscall.Errno) {
+	if attr, _ := fs.attrOf(ino); attr.mode&unix.S_IFMT != unix.S_IFLNK {
+		return "", unix.EINVAL
+	}
+	return fs.files[ino-2].target, 0
+}
+
+func (fs *testFuseFilesystem) open(pid uint32, ino uint64) (uint64, syscall.Errno) {
+	if attr, errno := fs.attrOf(ino); errno != 0 || attr.mode&unix.S_IFMT != unix.S_IFREG {
+		return 0, unix.EACCES
+	}
+	return ino * 10, 0 // a file handle differs from an inode
+}
+
+func (fs *testFuseFilesystem) read(fh uint64, offset int64, buf []byte) (int, syscall.Errno) {
+	if fh%10 != 0 || fh/10 < 2 || fh/10-2 >= uint64(len(fs.files)) {
+		return 0, unix.EBADF
+	}
+	body := fs.files[fh/10-2].body
+	return copy(buf, body[min(int(offset), len(body)):]), 0
+}
+
+func (fs *testFuseFilesystem) release(fh uint64) {
+	fs.mu.Lock()
+	fs.released = append(fs.released, fh)
+	fs.mu.Unlock()
+}
+
+func (fs *testFuseFilesystem) readdir(pid uint32, ino uint64) ([]fuseDirEntry, syscall.Errno) {
+	if ino != fuseRootIno {
+		return nil, unix.ENOTDIR
+	}
+	entries := []fuseDirEntry{{ino: ino, name: ".", mode: unix.S_IFDIR}, {ino: ino, name: "..", mode: unix.S_IFDIR}}
+	for i, file := range fs.files {
+		attr, _ := fs.attrOf(uint64(i + 2))
+		entries = append(entries, fuseDirEntry{ino: attr.ino, name: file.name, mode: attr.mode})
+	}
+	return entries, 0
+}
+
+// testFuseKernel is the other end of a fuseConn: it sends requests and reads replies, like the kernel does
+type testFuseKernel struct {
+	t      *testing.T
+	conn   *fuseConn
+	fd     int
+	unique uint64
+}
+
+func makeTestFuseKernel(t *testing.T, fs fuseFilesystem) *testFuseKernel {
+	// a seqpacket socket keeps message boundaries, like /dev/fuse does
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = unix.Close(fds[0])
+		_ = unix.Close(fds[1])
+	})
+	conn := &fuseConn{fd: fds[0], fs: fs, dirHandles: make(map[uint64][]fuseDirEntry)}
+	return &testFuseKernel{t: t, conn: conn, fd: fds[1]}
+}
+
+// handle passes a request to a conn and returns its reply, errno is 0 on success
+func (kernel *testFuseKernel) handle(opcode uint32, nodeid uint64, body []byte) (syscall.Errno, []byte) {
+	kernel.unique++
+	request := kernel.request(opcode, nodeid, body)
+	kernel.conn.handle(request)
+
+	buf := make([]byte, fuseReadBufferSize)
+	n, err := unix.Read(kernel.fd, buf)
+	if err != nil {
+		kernel.t.Fatalf("no reply to opcode %d: %v", opcode, err)
+	}
+	var header fuseOutHeader
+	copy(structBytes(&header), buf[:n])
+	if int(header.len) != n || header.unique != kernel.unique {
+		kernel.t.Fatalf("invalid reply header to opcode %d: %+v, %d bytes", opcode, header, n)
+	}
+	return syscall.Errno(-header.error), buf[unsafe.Sizeof(header):n]
+}
+
+// handleNoReply passes a request that must not be replied (a reply to it would be an error for the kernel)
+func (kernel *testFuseKernel) handleNoReply(opcode uint32, nodeid uint64, body []byte) {
+	kernel.unique++
+	kernel.conn.handle(kernel.request(opcode, nodeid, body))
+
+	if n, _, err := unix.Recvfrom(kernel.fd, make([]byte, 64), unix.MSG_DONTWAIT); err != unix.EAGAIN {
+		kernel.t.Fatalf("opcode %d is replied: %d bytes, %v", opcode, n, err)
+	}
+}
+
+func (kernel *testFuseKernel) request(opcode uint32, nodeid uint64, body []byte) []byte {
+	header := fuseInHeader{opcode: opcode, unique: kernel.unique, nodeid: nodeid, pid: 42}
+	header.len = uint32(unsafe.Sizeof(header)) + uint32(len(body))
+	return append(slices.Clone(structBytes(&header)), body...)
+}
+
+func fromStructBytes[T any](t *testing.T, body []byte) T {
+	var value T
+	if len(body) != int(unsafe.Sizeof(value)) {
+		t.Fatalf("reply of %d bytes, expected %d", len(body), unsafe.Sizeof(value))
+	}
+	copy(structBytes(&value), body)
+	return value
+}
+
+func TestFuseRequestReply(t *testing.T) {
+	fs := &testFuseFilesystem{
+		files: []testFuseFile{
+			{name: "1.h", body: "#pragma once\n"},
+			{name: "2.h", target: "1.h"},
+		},
+		forgotten: make(map[uint64]uint64),
+	}
+
+	tests := []struct {
+		name      string
+		opcode    uint32
+		nodeid    uint64
+		body      []byte
+		wantErrno syscall.Errno
+		check     func(t *testing.T, reply []byte)
+	}{
+		{
+			name:   "init",
+			opcode: fuseOpInit,
+			body:   structBytes(&fuseInitIn{major: 7, minor: 38, maxReadahead: 128 * 1024, flags: fuseAsyncRead | 1<<30}),
+			check: func(t *testing.T, reply []byte) {
+				out := fromStructBytes[fuseInitOut](t, reply)
+				if out.major != fuseKernelVersion || out.minor != fuseKernelMinorVersion || out.maxReadahead != 128*1024 {
+					t.Errorf("unexpected version %d.%d, readahead %d", out.major, out.minor, out.maxReadahead)
+				}
+				if out.flags != fuseAsyncRead {
+					t.Errorf("unknown flags are accepted: %x", out.flags)
+				}
+			},
+		},
+		{
+			name:   "lookup a file",
+			opcode: fuseOpLookup,
+			nodeid: fuseRootIno,
+			body:   []byte("1.h\x00"),
+			check: func(t *testing.T, reply []byte) {
+				out := fromStructBytes[fuseEntryOut](t, reply)
+				if out.nodeid != 2 || out.attr.ino != 2 || out.attr.size != 13 || out.attr.mode != unix.S_IFREG|0444 {
+					t.Errorf("unexpected entry %+v", out)
+				}
+				if out.entryValid != 0 || out.attrValid != 0 {
+					t.Errorf("an entry is cached: %+v", out)
+				}
+			},
+		},
+		{
+			name:      "lookup a missing file",
+			opcode:    fuseOpLookup,
+			nodeid:    fuseRootIno,
+			body:      []byte("3.h\x00"),
+			wantErrno: unix.ENOENT,
+		},
+		{
+			name:   "getattr",
+			opcode: fuseOpGetattr,
+			nodeid: 2,
+			body:   make([]byte, 16),
+			check: func(t *testing.T, reply []byte) {
+				out := fromStructBytes[fuseGetattrOut](t, reply)
+				if out.attr.mtime != 1_500_000_000 || out.attr.mtimensec != 123_456_789 || out.attr.nlink != 1 || out.attr.blocks != 1 {
+					t.Errorf("unexpected attr %+v", out.attr)
+				}
+			},
+		},
+		{
+			name:   "getattr of a root",
+			opcode: fuseOpGetattr,
+			nodeid: fuseRootIno,
+			body:   make([]byte, 16),
+			check: func(t *testing.T, reply []byte) {
+				if out := fromStructBytes[fuseGetattrOut](t, reply); out.attr.nlink != 2 || out.attr.mode != unix.S_IFDIR|0555 {
+					t.Errorf("unexpected attr %+v", out.attr)
+				}
+			},
+		},
+		{
+			name:      "getattr of a forgotten inode",
+			opcode:    fuseOpGetattr,
+			nodeid:    100,
+			body:      make([]byte, 16),
+			wantErrno: unix.ENOENT,
+		},
+		{
+			name:   "readlink",
+			opcode: fuseOpReadlink,
+			nodeid: 3,
+			check: func(t *testing.T, reply []byte) {
+				if string(reply) != "1.h" {
+					t.Errorf("unexpected target %q", reply)
+				}
+			},
+		},
+		{
+			name:      "readlink of a file",
+			opcode:    fuseOpReadlink,
+			nodeid:    2,
+			wantErrno: unix.EINVAL,
+		},
+		{
+			name:   "open",
+			opcode: fuseOpOpen,
+			nodeid: 2,
+			body:   make([]byte, 8),
+			check: func(t *testing.T, reply []byte) {
+				if out := fromStructBytes[fuseOpenOut](t, reply); out.fh != 20 || out.openFlags != fuseOpenKeepCache {
+					t.Errorf("unexpected open reply %+v", out)
+				}
+			},
+		},
+		{
+			name:      "open a symlink",
+			opcode:    fuseOpOpen,
+			nodeid:    3,
+			body:      make([]byte, 8),
+			wantErrno: unix.EACCES,
+		},
+		{
+			name:   "read",
+			opcode: fuseOpRead,
+			nodeid: 2,
+			body:   structBytes(&fuseReadIn{fh: 20, offset: 8, size: 4096}),
+			check: func(t *testing.T, reply []byte) {
+				if string(reply) != "once\n" {
+					t.Errorf("unexpected body %q", reply)
+				}
+			},
+		},
+		{
+			name:   "read up to size",
+			opcode: fuseOpRead,
+			nodeid: 2,
+			body:   structBytes(&fuseReadIn{fh: 20, offset: 1, size: 6}),
+			check: func(t *testing.T, reply []byte) {
+				if string(reply) != "pragma" {
+					t.Errorf("unexpected body %q", reply)
+				}
+			},
+		},
+		{
+			name:      "read an unknown handle",
+			opcode:    fuseOpRead,
+			nodeid:    2,
+			body:      structBytes(&fuseReadIn{fh: 21, size: 4096}),
+			wantErrno: unix.EBADF,
+		},
+		{
+			name:   "release",
+			opcode: fuseOpRelease,
+			nodeid: 2,
+			body:   structBytes(&fuseReadIn{fh: 20}),
+			check: func(t *testing.T, reply []byte) {
+				if !slices.Equal(fs.released, []uint64{20}) {
+					t.Errorf("unexpected released handles %v", fs.released)
+				}
+			},
+		},
+		{
+			name:   "statfs",
+			opcode: fuseOpStatfs,
+			nodeid: fuseRootIno,
+			check: func(t *testing.T, reply []byte) {
+				if out := fromStructBytes[fuseStatfsOut](t, reply); out.bsize != 4096 || out.namelen != 255 {
+					t.Errorf("unexpected statfs %+v", out)
+				}
+			},
+		},
+		{
+			name:   "flush",
+			opcode: fuseOpFlush,
+			nodeid: 2,
+			body:   make([]byte, 24),
+			check: func(t *testing.T, reply []byte) {
+				if len(reply) != 0 {
+					t.Errorf("unexpected body %q", reply)
+				}
+			},
+		},
+		{
+			name:      "write",
+			opcode:    16, // FUSE_WRITE
+			nodeid:    2,
+			body:      make([]byte, 40),
+			wantErrno: unix.ENOSYS,
+		},
+		{
+			name:      "mkdir",
+			opcode:    9, // FUSE_MKDIR
+			nodeid:    fuseRootIno,
+			body:      append(make([]byte, 8), "dir\x00"...),
+			wantErrno: unix.ENOSYS,
+		},
+	}
+
+	kernel := makeTestFuseKernel(t, fs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kernel.t = t
+			errno, reply := kernel.handle(tt.opcode, tt.nodeid, tt.body)
+			if errno != tt.wantErrno {
+				t.Fatalf("errno %v, expected %v", errno, tt.wantErrno)
+			}
+			if errno != 0 && len(reply) != 0 {
+				t.Errorf("an error is replied with a body of %d bytes", len(reply))
+			}
+			if tt.check != nil {
+				tt.check(t, reply)
+			}
+		})
+	}
+}
+
+func TestFuseForget(t *testing.T) {
+	fs := &testFuseFilesystem{forgotten: make(map[uint64]uint64)}
+	kernel := makeTestFuseKernel(t, fs)
+
+	nlookup := uint64(3) // fuse_forget_in
+	kernel.handleNoReply(fuseOpForget, 2, structBytes(&nlookup))
+	batch := []byte{2, 0, 0, 0, 0, 0, 0, 0} // fuse_batch_forget_in: count, dummy
+	for _, forget := range []fuseForgetOne{{nodeid: 2, nlookup: 1}, {nodeid: 5, nlookup: 7}} {
+		batch = append(batch, structBytes(&forget)...)
+	}
+	kernel.handleNoReply(fuseOpBatchForget, 0, batch)
+	kernel.handleNoReply(fuseOpInterrupt, 0, make([]byte, 8))
+
+	if len(fs.forgotten) != 2 || fs.forgotten[2] != 4 || fs.forgotten[5] != 7 {
+		t.Errorf("unexpected forgotten inodes %v", fs.forgotten)
+	}
+}
+
+// TestFuseReaddir checks that a dir listed on OPENDIR is read by READDIR in parts, as the kernel does with a small buffer
+func TestFuseReaddir(t *testing.T) {
+	fs := &testFuseFilesystem{forgotten: make(map[uint64]uint64)}
+	for i := 0; i < 100; i++ {
+		fs.files = append(fs.files, testFuseFile{name: string(rune('a'+i%26)) + string(bytes.Repeat([]byte{'x'}, i)) + ".h"})
+	}
+	kernel := makeTestFuseKernel(t, fs)
+
+	if errno, _ := kernel.handle(fuseOpOpendir, 2, make([]byte, 8)); errno != unix.ENOTDIR {
+		t.Errorf("a file is opened as a dir: %v", errno)
+	}
+	errno, reply := kernel.handle(fuseOpOpendir, fuseRootIno, make([]byte, 8))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh := fromStructBytes[fuseOpenOut](t, reply).fh
+
+	var names []string
+	for offset := uint64(0); ; {
+		errno, reply := kernel.handle(fuseOpReaddir, fuseRootIno, structBytes(&fuseReadIn{fh: fh, offset: offset, size: 1024}))
+		if errno != 0 || len(reply) > 1024 {
+			t.Fatalf("readdir at %d: %v, %d bytes", offset, errno, len(reply))
+		}
+		if len(reply) == 0 {
+			break
+		}
+		for len(reply) > 0 {
+			var dirent fuseDirentHeader
+			copy(structBytes(&dirent), reply)
+			direntSize := int(unsafe.Sizeof(dirent)) + int(dirent.namelen)
+			names = append(names, string(reply[unsafe.Sizeof(dirent):direntSize]))
+			reply = reply[(direntSize+7)&^7:]
+			offset = dirent.off
+		}
+	}
+	if len(names) != len(fs.files)+2 || names[0] != "." || names[1] != ".." || names[len(names)-1] != fs.files[len(fs.files)-1].name {
+		t.Errorf("unexpected names %q", names)
+	}
+
+	if errno, _ := kernel.handle(fuseOpReleasedir, fuseRootIno, structBytes(&fuseReadIn{fh: fh})); errno != 0 || len(kernel.conn.dirHandles) != 0 {
+		t.Errorf("a dir handle isn't released: %v", errno)
+	}
+}
+
+func TestEncodeDirents(t *testing.T) {
+	entries := []fuseDirEntry{
+		{ino: 1, name: ".", mode: unix.S_IFDIR},
+		{ino: 7, name: "stdio.h", mode: unix.S_IFREG | 0444},
+		{ino: 9, name: "sys", mode: unix.S_IFDIR | 0555},
+		{ino: 11, name: "cstdio", mode: unix.S_IFLNK | 0777},
+	}
+	const headerSize = int(unsafe.Sizeof(fuseDirentHeader{}))
+
+	tests := []struct {
+		name      string
+		offset    uint64
+		size      int
+		wantNames []string
+	}{
+		{"all", 0, 4096, []string{".", "stdio.h", "sys", "cstdio"}},
+		{"from offset", 2, 4096, []string{"sys", "cstdio"}},
+		{"past the end", 4, 4096, nil},
+		{"exactly two", 0, 2 * (headerSize + 8), []string{".", "stdio.h"}},
+		{"one byte short of two", 0, 2*(headerSize+8) - 1, []string{"."}},
+		{"none fits", 1, headerSize, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := encodeDirents(entries, tt.offset, tt.size)
+			if len(out) > tt.size || len(out)%8 != 0 {
+				t.Fatalf("%d bytes, size %d", len(out), tt.size)
+			}
+			var names []string
+			for i := tt.offset; len(out) > 0; i++ {
+				var dirent fuseDirentHeader
+				copy(structBytes(&dirent), out)
+				name := string(out[headerSize : headerSize+int(dirent.namelen)])
+				if dirent.ino != entries[i].ino || dirent.off != i+1 || dirent.typ != entries[i].mode>>12 {
+					t.Errorf("unexpected dirent of %s: %+v", name, dirent)
+				}
+				names = append(names, name)
+				out = out[(headerSize+int(dirent.namelen)+7)&^7:]
+			}
+			if !slices.Equal(names, tt.wantNames) {
+				t.Errorf("names %q, expected %q", names, tt.wantNames)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	sdaemon "github.com/coreos/go-systemd/v22/daemon"
+	"google.golang.org/grpc"
+)
+
+// parseListenAddr splits an address from ListenAddr like "tcp6://[::]:43210" or "unix:///run/nocc-server.sock".
+// An address without a scheme ("localhost:43210") is tcp.
+func parseListenAddr(addr string) (network string, address string, err error) {
+	network, address, hasScheme := strings.Cut(addr, "://")
+	if !hasScheme {
+		network, address = "tcp", addr
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid listen address %s: %v", addr, err)
+		}
+	case "unix":
+		if !strings.HasPrefix(address, "/") {
+			return "", "", fmt.Errorf("invalid listen address %s: a socket path must be absolute", addr)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid listen address %s: unknown network %q", addr, network)
+	}
+	return network, address, nil
+}
+
+// listenAll opens sockets passed by systemd (see nocc-server.socket), or, if a server was started not by systemd,
+// all ListenAddr. Either all listeners are opened, or none.
+func listenAll(listenAddrs []string) ([]net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) != 0 {
+		for _, listener := range listeners {
+			if listener == nil {
+				return nil, errors.New("a socket passed by systemd is not a stream socket")
+			}
+		}
+		logServer.Info(0, "taking", len(listeners), "sockets passed by systemd, ListenAddr is ignored")
+		return listeners, nil
+	}
+
+	if len(listenAddrs) == 0 {
+		return nil, errors.New("ListenAddr is empty")
+	}
+	for _, addr := range listenAddrs {
+		listener, err := listenAddr(addr)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func listenAddr(addr string) (net.Listener, error) {
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// removeStaleSocket removes a socket file left by a previous launch, unless another process is listening it
+func removeStaleSocket(address string) error {
+	if stat, err := os.Lstat(address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", address); err == nil {
+			_ = conn.Close()
+			return fmt.Errorf("%s is listened by another process", address)
+		}
+		_ = os.Remove(address)
+	}
+	return nil
+}
+
+// StartGRPCListening serves all listeners until QuitServerGracefully.
+// If any of them can't be opened, nothing is served; if any of them fails while serving, others are stopped.
+func (s *NoccServer) StartGRPCListening(listenAddrs []string) error {
+	listeners, err := listenAll(listenAddrs)
+	if err != nil {
+		logServer.Error(err)
+		return err
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		logServer.Info(0, "listening on", listener.Addr().Network()+"://"+listener.Addr().String())
+		go func(listener net.Listener) {
+			err := s.GRPCServer.Serve(listener)
+			if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+				err = fmt.Errorf("failed to serve grpc on %s: %w", listener.Addr(), err)
+			} else {
+				err = nil
+			}
+			errs <- err
+		}(listener)
+	}
+	_, _ = sdaemon.SdNotify(false, sdaemon.SdNotifyReady)
+
+	var firstErr error
+	for range listeners {
+		if err := <-errs; err != nil && firstErr == nil {
+			logServer.Error(err)
+			firstErr = err
+			s.GRPCServer.Stop() // makes other Serve calls return
+		}
+	}
+	_, _ = sdaemon.SdNotify(false, sdaemon.SdNotifyStopping)
+	return firstErr
+}
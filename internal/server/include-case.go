@@ -0,0 +1,90 @@
+package server
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Windows-targeted code (mingw) is usually written on case-insensitive disks: `#include <Windows.h>` works there,
+// though a file is windows.h. On a server, such a compilation fails, while a local one succeeds.
+// For targets listed in NoccServer.CaseInsensitiveTargets, a failed compilation is examined:
+// if an include is not found, but a client has uploaded a file differing only in case,
+// a symlink with the requested case is created in a client working dir, and a compiler is launched again.
+// (a compiler stops at the first missing include, that's why it's repeated up to maxIncludeCaseRetries times)
+
+const maxIncludeCaseRetries = 16
+
+// gcc: "/src/a.cpp:1:10: fatal error: Windows.h: No such file or directory"
+// clang: "/src/a.cpp:1:10: fatal error: 'Windows.h' file not found"
+var reMissingInclude = regexp.MustCompile(`(?m)^(.+?):\d+:\d+: fatal error: (?:'([^']+)' file not found|([^:]+): No such file or directory)`)
+
+// isCaseInsensitiveTarget tells whether a target triple (like "x86_64-w64-mingw32") contains any of targets
+func isCaseInsensitiveTarget(target string, targets []string) bool {
+	for _, t := range targets {
+		if t != "" && strings.Contains(target, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveIncludeCase creates a symlink for a missing include from compiler stderr; returns false if it's not a case problem.
+// Candidates are as a compiler looks for them: next to an including file, then in -I/-isystem/etc. dirs.
+func (client *Client) resolveIncludeCase(session *Session, compilerStderr []byte) bool {
+	match := reMissingInclude.FindSubmatch(compilerStderr)
+	if match == nil {
+		return false
+	}
+	includingFile := string(match[1])
+	includeName := string(match[2])
+	if includeName == "" {
+		includeName = string(match[3])
+	}
+
+	candidates := make([]string, 0, len(session.includeDirs)+1)
+	if path.IsAbs(includeName) {
+		candidates = append(candidates, path.Clean(includeName))
+	} else {
+		if path.IsAbs(includingFile) {
+			candidates = append(candidates, path.Join(path.Dir(includingFile), includeName))
+		}
+		for _, dir := range session.includeDirs {
+			candidates = append(candidates, path.Join(dir, includeName))
+		}
+	}
+
+	lowercaseIndex := client.makeLowercaseFilesIndex()
+	for _, requested := range candidates {
+		existing, ok := lowercaseIndex[strings.ToLower(requested)]
+		if !ok || existing == requested {
+			continue
+		}
+
+		linkName := client.MapClientFileNameToServerAbs(requested)
+		mkdirAllInChroot(client.workingDir, path.Dir(requested))
+		// a symlink is absolute, a compiler resolves it inside a chroot (another session could have created it already)
+		if err := os.Symlink(existing, linkName); err != nil && !os.IsExist(err) {
+			logServer.Error("failed to create a case-insensitive include", "clientID", client.clientID, requested, err)
+			return false
+		}
+		logServer.Info(1, "case-insensitive include", "sessionID", session.sessionID, requested, "->", existing)
+		return true
+	}
+	return false
+}
+
+// makeLowercaseFilesIndex maps lowercased client file names to actual ones (of uploaded files, not of CompilerDirs)
+func (client *Client) makeLowercaseFilesIndex() map[string]string {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+
+	index := make(map[string]string, len(client.files))
+	for clientFileName, file := range client.files {
+		if file.state.Load() >= fsFileStateUploaded {
+			index[strings.ToLower(clientFileName)] = clientFileName
+		}
+	}
+	return index
+}
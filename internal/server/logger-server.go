@@ -5,8 +5,11 @@ import "nocc/internal/common"
 // anywhere in the server code, use logServer.Info() and other methods for logging
 var logServer *common.LoggerWrapper
 
-func MakeLoggerServer(logFile string, verbosity int) error {
+func MakeLoggerServer(logFile string, verbosity int, maxFieldLength int, maxLineLength int, fullFieldsDumpDir string) error {
 	var err error
 	logServer, err = common.MakeLogger(logFile, verbosity)
-	return err
+	if err != nil {
+		return err
+	}
+	return logServer.SetLimits(maxFieldLength, maxLineLength, fullFieldsDumpDir)
 }
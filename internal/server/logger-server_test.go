@@ -0,0 +1,14 @@
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain makes logServer, errors are written to stderr
+func TestMain(m *testing.M) {
+	if err := MakeLoggerServer("stderr", -1, 0, 0, ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"nocc/internal/common"
+)
+
+// MDNSAnnouncer answers mDNS queries for a service (see common.MakeMDNSQuery), so that daemons on a LAN
+// having "mdns:" in their Servers discover this server without listing it, see client.ServerDiscovery.
+// It's meant for small offices where developer workstations donate cycles; a server announces a port of its first tcp ListenAddr
+// and all addresses of its interfaces, so ListenAddr must be reachable from a LAN (not localhost).
+type MDNSAnnouncer struct {
+	service  string
+	instance string
+	port     int
+	conn     *net.UDPConn
+}
+
+func MakeMDNSAnnouncer(service string, listenAddrs []string) (*MDNSAnnouncer, error) {
+	port := 0
+	for _, addr := range listenAddrs {
+		if network, address, err := parseListenAddr(addr); err == nil && network != "unix" {
+			_, portStr, _ := net.SplitHostPort(address)
+			port, _ = strconv.Atoi(portStr)
+			break
+		}
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("no tcp address in ListenAddr to announce")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	instance, _, _ := strings.Cut(hostname, ".") // a label can't contain dots, a domain isn't needed in .local
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, common.MDNSGroupAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MDNSAnnouncer{
+		service:  service,
+		instance: instance,
+		port:     port,
+		conn:     conn,
+	}, nil
+}
+
+func (announcer *MDNSAnnouncer) StartAnnouncing() {
+	logServer.Info(0, "announcing", announcer.instance, "port", announcer.port, "via mDNS as", common.MDNSServiceName(announcer.service))
+
+	packet := make([]byte, 9000)
+	for {
+		n, from, err := announcer.conn.ReadFromUDP(packet)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") {
+				logServer.Error("mDNS announcer stopped:", err)
+			}
+			return
+		}
+
+		isQuery, queryID := common.IsMDNSQueryFor(packet[:n], announcer.service)
+		if !isQuery {
+			continue
+		}
+
+		// a querier not from port 5353 is a "legacy" one (like a daemon), it's answered directly; others are answered to a group
+		unicast := from.Port != common.MDNSGroupAddr.Port
+		response, err := common.MakeMDNSResponse(announcer.service, announcer.instance, announcer.port, getAnnouncedAddrs(), queryID, unicast)
+		if err != nil {
+			logServer.Error("can't make mDNS response:", err)
+			continue
+		}
+		to := common.MDNSGroupAddr
+		if unicast {
+			to = from
+		}
+		if _, err := announcer.conn.WriteToUDP(response, to); err != nil {
+			logServer.Error("can't send mDNS response to", to, err)
+			continue
+		}
+		logServer.Info(2, "answered mDNS query from", from)
+	}
+}
+
+func (announcer *MDNSAnnouncer) Stop() {
+	if announcer != nil {
+		_ = announcer.conn.Close()
+	}
+}
+
+// getAnnouncedAddrs returns addresses of all interfaces except loopback and link-local ones (they need a zone to connect)
+func getAnnouncedAddrs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
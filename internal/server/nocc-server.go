@@ -4,13 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"os"
 	"path"
 	"strconv"
-	"strings"
 	"time"
 
+	"nocc/internal/common"
 	"nocc/pb"
 
 	"google.golang.org/grpc"
@@ -33,6 +32,46 @@ type NoccServer struct {
 
 	SrcFileCache *SrcFileCache
 	ObjFileCache *ObjFileCache
+
+	CompilerProbes   *CompilerProbes
+	SystemHeaders    *SystemHeaders    // nil if SystemHeaderDirs are not set
+	Snapshots        *Snapshots        // nil if Snapshots are not set
+	PipelinedUploads *PipelinedUploads // nil if PipelinedUploadsMinBytes is not set
+	OnDemandIncludes *OnDemandIncludes // nil if OnDemandIncludes is off
+	Dashboard        *Dashboard        // nil if DashboardAddr is not set
+	MDNSAnnouncer    *MDNSAnnouncer    // nil if MDNSAnnounce is off
+	CapacitySchedule *CapacitySchedule
+	AdaptiveCapacity *AdaptiveCapacity // nil if AdaptiveCapacity is off
+	DiskWatchdog     *DiskWatchdog     // nil if MinFreeDiskSpace is not set
+	Admin            *AdminService     // nil if AdminSocket is not set
+	BuildSummaries   *BuildSummaries
+
+	StartTime time.Time // for uptime in Status and Dashboard
+
+	// if set, compiled objects are checked to be ELF for a requested target, otherwise a session fails
+	StrictObjTarget bool
+
+	// sessions living longer are closed by Cron, 0 means no limit
+	SessionTimeout time.Duration
+
+	// a working dir of a stopped client is kept for its next launch during this time, see ClientsStorage.RetainClient
+	ClientRetention time.Duration
+
+	// a cache server (CompilerQueueSize = 0 in config) doesn't compile: it serves obj cache hits
+	// and accepts objects pushed by other servers (see PushObjToCache), sessions missing in obj cache are refused
+	CacheOnly bool
+
+	// if set, debug info and __FILE__ of remotely compiled objects contain the same paths as a local build, see Session.compilerCwd
+	RemapDebugPaths bool
+
+	// substrings of target triples, like "mingw", compiled as if includes were case-insensitive, see Client.resolveIncludeCase
+	CaseInsensitiveTargets []string
+
+	// objects of sessions without a project namespace are accounted by a compiler, see FileCache.PurgeNamespace
+	ObjCacheNamespaceByCompiler bool
+
+	// ReadCapacitySchedule re-reads CompilerQueueSize and CapacitySchedule from a config file on SIGHUP, see Cron
+	ReadCapacitySchedule func() (*CapacitySchedule, error)
 }
 
 const (
@@ -52,50 +91,23 @@ func launchCompilerOnServerOnReadySessions(noccServer *NoccServer, client *Clien
 	}
 }
 
-func (s *NoccServer) StartGRPCListening(listenAddrs []string) error {
-	errs := make(chan error, len(listenAddrs))
-	for _, addr := range listenAddrs {
-		go func(addr string) {
-			parts := strings.Split(addr, "://")
-			if len(parts) != 2 {
-				errs <- fmt.Errorf("invalid listen address: %s", addr)
-				return
-			}
-			listener, err := net.Listen(parts[0], parts[1])
-			if err != nil {
-				errs <- err
-				return
-			}
-
-			logServer.Info(0, "listening on", addr)
-
-			err = s.GRPCServer.Serve(listener)
-			if err != nil {
-				errs <- fmt.Errorf("failed to start grpc listener %s: %w", addr, err)
-			}
-			errs <- nil
-		}(addr)
-	}
-
-	for range listenAddrs {
-		err := <-errs
-		if err != nil {
-			logServer.Error(err)
-			return err
-		}
-	}
-
-	return nil
-}
-
 // QuitServerGracefully closes all active clients and stops accepting new connections.
 // After it, StartGRPCListening returns, and main() continues.
 func (s *NoccServer) QuitServerGracefully() {
 	logServer.Info(0, "graceful stop...")
 
 	s.Cron.StopCron()
+	s.Dashboard.Stop()
+	s.Admin.Stop()
+	s.MDNSAnnouncer.Stop()
 	s.ActiveClients.StopAllClients()
 	s.GRPCServer.GracefulStop()
+
+	// compilers killed via chanDisconnected end their spans on exit, export them too
+	for start := time.Now(); s.CompilerLauncher.GetRunningCount() > 0 && time.Since(start) < 2*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tracerServer.Close()
 }
 
 // StartClient is a grpc handler.
@@ -103,14 +115,34 @@ func (s *NoccServer) QuitServerGracefully() {
 // So, one client == one running nocc-daemon. All clients have unique clientID.
 // When a nocc-daemon exits, it sends StopClient (or when it dies unexpectedly, a client is deleted after timeout).
 func (s *NoccServer) StartClient(_ context.Context, in *pb.StartClientRequest) (*pb.StartClientReply, error) {
-	client, err := s.ActiveClients.OnClientConnected(in.ClientID)
+	if in.UploadsToolchain && s.CompilerLauncher.ClientToolchains == nil {
+		return nil, status.Errorf(codes.PermissionDenied, "this server doesn't launch uploaded compilers (AcceptClientToolchains is off), don't set UploadToolchain")
+	}
+	systemHeaders := s.SystemHeaders.AcceptClientDirs(in.SystemHeaderDirs)
+	client, err := s.ActiveClients.OnClientConnected(in.ClientID, in.UploadsToolchain, systemHeaders)
 	if err != nil {
 		return nil, err
 	}
 
-	logServer.Info(0, "new client", "clientID", client.clientID, "version", in.ClientVersion, "; nClients", s.ActiveClients.ActiveCount())
+	// a client uploading its toolchain needs uploaded files at their paths, a root doesn't mirror a working dir
+	if in.OnDemandIncludes && !in.UploadsToolchain {
+		client.onDemand, err = s.OnDemandIncludes.MountForClient(client.clientID, s.ActiveClients.OnDemandMounts(client))
+		if err != nil {
+			logServer.Error("can't mount on-demand root, a client uploads includes", "clientID", client.clientID, err)
+		}
+	}
 
-	return &pb.StartClientReply{}, nil
+	systemHeaderDirs := sortedSystemHeaderDirs(systemHeaders)
+	logServer.Info(0, "new client", "clientID", client.clientID, "version", in.ClientVersion, "uploadsToolchain", in.UploadsToolchain, "systemHeaders", systemHeaderDirs, "onDemandIncludes", client.onDemand != nil, "; nClients", s.ActiveClients.ActiveCount())
+	if len(systemHeaderDirs) != len(in.SystemHeaderDirs) {
+		logServer.Info(1, "client system headers differ, they are uploaded", "clientID", client.clientID, "requested", len(in.SystemHeaderDirs), "accepted", len(systemHeaderDirs))
+	}
+
+	return &pb.StartClientReply{
+		SystemHeaderDirs: systemHeaderDirs,
+		Snapshots:        s.Snapshots.ForClient(in.Snapshots),
+		OnDemandIncludes: client.onDemand != nil,
+	}, nil
 }
 
 func (s *NoccServer) InterruptSession(_ context.Context, in *pb.InterruptSessionRequest) (*pb.InterruptSessionResponse, error) {
@@ -121,6 +153,7 @@ func (s *NoccServer) InterruptSession(_ context.Context, in *pb.InterruptSession
 	}
 
 	client.InterruptSession(in.SessionID)
+	s.SrcFileCache.ReleaseSessionUploads(client.clientID, in.SessionID)
 
 	return &pb.InterruptSessionResponse{}, nil
 }
@@ -129,36 +162,91 @@ func (s *NoccServer) InterruptSession(_ context.Context, in *pb.InterruptSession
 // A client sends this request providing sha256 of a .cpp file name and all its dependencies (.h/.nocc-pch/etc.).
 // A server responds, what dependencies are missing (needed to be uploaded from the client).
 // See comments in server.Session.
-func (s *NoccServer) StartCompilationSession(_ context.Context, in *pb.StartCompilationSessionRequest) (*pb.StartCompilationSessionReply, error) {
+func (s *NoccServer) StartCompilationSession(ctx context.Context, in *pb.StartCompilationSessionRequest) (*pb.StartCompilationSessionReply, error) {
 	client := s.ActiveClients.GetClient(in.ClientID)
 	if client == nil {
 		logServer.Error("unauthenticated client on session start", "clientID", in.ClientID)
 		return nil, status.Errorf(codes.Unauthenticated, "clientID %s not found; probably, the server was restarted just now", in.ClientID)
 	}
 
+	// a client uploading its compiler doesn't use a server one, there is nothing to compare
+	// (and a cache server may have no compilers at all)
+	if !client.uploadsToolchain && !s.CacheOnly {
+		if err := s.CompilerProbes.VerifyClientCompiler(client, in); err != nil {
+			logServer.Error("refused session", "clientID", client.clientID, "sessionID", in.SessionID, err)
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+
+	snapshot, err := s.lookupSnapshot(in)
+	if err != nil {
+		logServer.Error("refused session", "clientID", client.clientID, "sessionID", in.SessionID, err)
+		return nil, err
+	}
+
+	// a client sends OnDemandDirs only if a root was mounted (see StartClient), it's checked not to chroot to nowhere
+	if len(in.OnDemandDirs) != 0 && client.onDemand == nil {
+		logServer.Error("refused session, no on-demand root", "clientID", client.clientID, "sessionID", in.SessionID)
+		return nil, status.Errorf(codes.FailedPrecondition, "includes can't be served on demand for clientID %s", in.ClientID)
+	}
+
 	session, err := CreateNewSession(in, client)
 	if err != nil {
 		logServer.Error("failed to open session", "clientID", client.clientID, "sessionID", in.SessionID, err)
 		return nil, err
 	}
+	session.snapshot = snapshot
+	session.startSpan(ctx, client)
 
 	// optimistic path: this .o has already been compiled earlier and exists in obj cache
 	// then we don't need to upload files from the client (and even don't need to link them from src cache)
 	// respond that we are waiting 0 files, and the client would immediately request for a compiled obj
 	// it's mostly a moment of optimization: avoid calling os.Link from src cache to working dir
-	session.objCacheKey = s.ObjFileCache.MakeObjCacheKey(session.compilerName, in.OriginalCompilerArgs, session.files)
-	if pathInObjCache := s.ObjFileCache.LookupInCache(session.objCacheKey); len(pathInObjCache) != 0 {
+	pathInObjCache := s.lookupObjCache(client, session, in)
+	if len(pathInObjCache) != 0 {
 		session.objCacheExists = true
+		session.span.SetAttribute("nocc.from_obj_cache", true)
 		session.OutputFile = pathInObjCache // stream back this file directly
+		session.provenance = s.ObjFileCache.LookupProvenance(session.objCacheKey)
 		session.compilationStarted.Store(1) // client.GetSessionsNotStartedCompilation() will not return it
 
-		logServer.Info(0, "started", "sessionID", session.sessionID, "clientID", client.clientID, "from obj cache", session.InputFile)
+		logServer.Info(0, "started", "sessionID", session.sessionID, "clientID", client.clientID, "user", session.userName, "from obj cache", session.InputFile)
 		client.RegisterCreatedSession(session)
 		client.PushToClientReadyChannel(session)
 
 		return &pb.StartCompilationSessionReply{}, nil
 	}
 
+	if s.CacheOnly {
+		logServer.Info(1, "not in obj cache", "sessionID", session.sessionID, "clientID", client.clientID, session.InputFile)
+		return nil, refuseSession(client, session, status.Errorf(codes.NotFound, "%s is not in obj cache of a cache server", session.InputFile))
+	}
+
+	// a client sends a file to another server, see client.RemoteConnection.OnRemoteBusy
+	if s.AdaptiveCapacity.IsMemoryLow() {
+		logServer.Info(1, "refused session, low memory", "sessionID", session.sessionID, "clientID", client.clientID)
+		return nil, refuseSession(client, session, status.Errorf(codes.ResourceExhausted, "server is busy: low memory"))
+	}
+	if reason := s.DiskWatchdog.RefuseReason(); reason != "" {
+		logServer.Info(1, "refused session,", reason, "sessionID", session.sessionID, "clientID", client.clientID)
+		return nil, refuseSession(client, session, status.Errorf(codes.ResourceExhausted, "server is busy: %s", reason))
+	}
+
+	// system headers changed on a server since a client started, they are not the ones a client omitted
+	// (obj cache hits above are still valid: they were compiled with the previous headers, equal to a client's ones)
+	if !s.SystemHeaders.IsContractValid(client.systemHeaders) {
+		logServer.Error("refused session, system headers changed", "clientID", client.clientID, "sessionID", in.SessionID)
+		return nil, refuseSession(client, session, status.Errorf(codes.FailedPrecondition, "system headers on a server changed since a client started"))
+	}
+
+	// files of a snapshot are not in session files, they are placed into a client working dir once
+	if session.snapshot != nil {
+		if err := client.placeSnapshot(session.snapshot); err != nil {
+			logServer.Error("refused session, can't place snapshot", session.snapshot.id, "clientID", client.clientID, "sessionID", in.SessionID, err)
+			return nil, refuseSession(client, session, status.Errorf(codes.FailedPrecondition, "can't place snapshot %s: %v", session.snapshot.id, err))
+		}
+	}
+
 	// otherwise, we detect files that don't exist in src cache and request a client to upload them
 	// before restoring from src cache, ensure that all client dirs structure is mirrored to workingDir
 	client.MkdirAllForSession(session)
@@ -169,6 +257,7 @@ func (s *NoccServer) StartCompilationSession(_ context.Context, in *pb.StartComp
 	// the first session is responded "need X to be uploaded", whereas other sessions just wait
 	// note, that if X is in src-cache, it's just hard linked from there to serverFileName
 	fileIndexesToUpload := make([]uint32, 0, len(session.files))
+	uploadsByOthers := make([]uploadByOther, 0)
 	for index, file := range session.files {
 		if file.state.CompareAndSwap(fsFileStateJustCreated, fsFileStateUploading) {
 			file.uploadStartTime = time.Now()
@@ -187,6 +276,7 @@ func (s *NoccServer) StartCompilationSession(_ context.Context, in *pb.StartComp
 			}
 
 			clientFilenameToUpload := client.MapServerAbsToClientFileName(file.serverFileName)
+			s.PipelinedUploads.Release(file, false) // an empty placeholder left by a previous launch of a client, if any
 			if s.SrcFileCache.CreateHardLinkFromCache(file.serverFileName, file.fileSHA256) {
 				logServer.Info(2, "file", clientFilenameToUpload, "is in src-cache, no need to upload")
 				file.state.Store(fsFileStateUploaded)
@@ -194,6 +284,13 @@ func (s *NoccServer) StartCompilationSession(_ context.Context, in *pb.StartComp
 				continue
 			}
 
+			if claim := s.SrcFileCache.ClaimUpload(file.fileSHA256, client, session.sessionID); claim != nil {
+				logServer.Info(1, "fs created->uploading (by another client)", "sessionID", session.sessionID, clientFilenameToUpload)
+				uploadsByOthers = append(uploadsByOthers, uploadByOther{uint32(index), claim})
+
+				continue
+			}
+
 			logServer.Info(1, "fs created->uploading", "sessionID", session.sessionID, clientFilenameToUpload)
 			fileIndexesToUpload = append(fileIndexesToUpload, uint32(index))
 		} else if file.state.CompareAndSwap(fsFileStateUploading, fsFileStateUploading) {
@@ -213,15 +310,162 @@ func (s *NoccServer) StartCompilationSession(_ context.Context, in *pb.StartComp
 		}
 	}
 
-	logServer.Info(0, "started", "sessionID", session.sessionID, "clientID", client.clientID, "waiting", len(fileIndexesToUpload), "uploads", session.InputFile)
+	// files being uploaded by other clients are hard linked from src cache after their uploads end
+	if len(uploadsByOthers) > 0 {
+		fileIndexesToUpload = append(fileIndexesToUpload, s.waitForUploadsByOthers(ctx, session, uploadsByOthers)...)
+	}
+
+	// changed generated files are uploaded as deltas against their previous versions, if a client can
+	var deltaBases []*pb.UploadDeltaBase
+	if in.AcceptsDeltaUploads {
+		deltaBases = s.offerDeltaBases(client, session, fileIndexesToUpload)
+	}
+
+	// a large TU starts compiling before uploads finish, a compiler waits for files when opening them
+	if s.PipelinedUploads.ShouldPipeline(session, fileIndexesToUpload) {
+		for _, index := range fileIndexesToUpload {
+			if file := session.files[index]; file != session.pchFile {
+				s.PipelinedUploads.Gate(file)
+			}
+		}
+	}
+
+	logServer.Info(0, "started", "sessionID", session.sessionID, "clientID", client.clientID, "user", session.userName, "waiting", len(fileIndexesToUpload), "uploads", session.InputFile)
 	client.RegisterCreatedSession(session)
 	launchCompilerOnServerOnReadySessions(s, client) // other sessions could also be waiting for files in src-cache
 
 	return &pb.StartCompilationSessionReply{
 		FileIndexesToUpload: fileIndexesToUpload,
+		DeltaBases:          deltaBases,
 	}, nil
 }
 
+// lookupObjCache calculates session.objCacheKey and returns a path of .o in obj cache, "" if it's not there.
+// If a BMI is requested, it must also be there (it's session.moduleOutputFile then).
+func (s *NoccServer) lookupObjCache(client *Client, session *Session, in *pb.StartCompilationSessionRequest) string {
+	targetArgs := common.ExtractTargetArgs(session.compilerArgs)
+	target := in.CompilerTarget
+	if !client.uploadsToolchain && !s.CacheOnly {
+		// a target in a key is the one of a server compiler; until it's probed, obj cache is not used at all
+		if reply := s.CompilerProbes.ProbeIfReady(session.compilerName, targetArgs); reply != nil {
+			target = reply.Target
+		} else {
+			session.noObjCache = true
+		}
+	}
+	if s.RemapDebugPaths {
+		session.remapDebugPaths(in)
+	}
+	session.objCacheKey = s.ObjFileCache.MakeObjCacheKey(session.compilerName, target, session.compilerCwd, in.OriginalCompilerArgs, session.compilerEnv, session.files)
+	session.objCacheKey.XorWith(&client.systemHeadersKey) // system headers are not in session.files then
+	if session.snapshot != nil {
+		session.objCacheKey.XorWith(&session.snapshot.digest)
+	}
+	if session.cacheNamespace != "" {
+		namespaceDigest := common.MakeCacheNamespaceDigest(session.cacheNamespace)
+		session.objCacheKey.XorWith(&namespaceDigest)
+	} else if s.ObjCacheNamespaceByCompiler {
+		session.cacheNamespace = "compiler:" + path.Base(session.compilerName) // not in a key, a compiler is there already
+	}
+	if s.StrictObjTarget {
+		session.expectedObjMachine = expectedObjMachine(target, targetArgs)
+	}
+	session.caseInsensitiveIncludes = isCaseInsensitiveTarget(target, s.CaseInsensitiveTargets)
+	pathInObjCache := ""
+	if session.sideOutputsObjFile == "" && !session.noObjCache { // side outputs are not saved to obj cache, see LaunchCompilerWhenPossible
+		pathInObjCache = s.ObjFileCache.LookupInCache(session.objCacheKey)
+	}
+	if session.moduleOutputRequested && len(pathInObjCache) != 0 {
+		session.moduleOutputFile = s.ObjFileCache.LookupInCache(MakeModuleOutputCacheKey(session.objCacheKey))
+		if len(session.moduleOutputFile) == 0 {
+			pathInObjCache = ""
+		}
+	}
+	return pathInObjCache
+}
+
+// lookupSnapshot returns a snapshot referenced by a session (nil if none), it's an error if it's unknown:
+// a server was restarted with another manifest since a client started, then a client compiles locally
+func (s *NoccServer) lookupSnapshot(in *pb.StartCompilationSessionRequest) (*snapshot, error) {
+	if in.SnapshotID == "" {
+		return nil, nil
+	}
+	snapshot := s.Snapshots.Lookup(in.SnapshotID)
+	if snapshot == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s is unknown", in.SnapshotID)
+	}
+	return snapshot, nil
+}
+
+// ProbeObjCache is a grpc handler.
+// A client asks, whether a .o for a session request is in obj cache, without starting a session:
+// nothing is created in a client working dir, and files are not uploaded (so, a client may ask several servers cheaply).
+// A request is the same as for StartCompilationSession, that's why the answer is exactly the same as a session would get.
+func (s *NoccServer) ProbeObjCache(_ context.Context, in *pb.StartCompilationSessionRequest) (*pb.ProbeObjCacheReply, error) {
+	client := s.ActiveClients.GetClient(in.ClientID)
+	if client == nil {
+		logServer.Error("unauthenticated client on obj cache probe", "clientID", in.ClientID)
+		return nil, status.Errorf(codes.Unauthenticated, "client %s not found", in.ClientID)
+	}
+
+	snapshot, err := s.lookupSnapshot(in)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		snapshot:              snapshot,
+		compilerName:          in.Compiler,
+		compilerArgs:          in.CompilerArgs,
+		moduleOutputRequested: in.ModuleOutput,
+		sideOutputsObjFile:    in.SideOutputsObjFile,
+		noObjCache:            in.NoObjCache,
+		files:                 make([]*fileInClientDir, 0, len(in.RequiredFiles)+1),
+	}
+	for _, meta := range in.RequiredFiles {
+		session.files = append(session.files, makeProbedFile(meta))
+	}
+	if in.RequiredPchFile != nil { // like in CreateNewSession, it's appended once more
+		session.files = append(session.files, makeProbedFile(in.RequiredPchFile))
+	}
+
+	exists := s.lookupObjCache(client, session, in) != ""
+	logServer.Info(2, "probed obj cache", "clientID", client.clientID, "exists", exists, in.InputFile)
+	return &pb.ProbeObjCacheReply{Exists: exists}, nil
+}
+
+// uploadByOther is a file of a session being uploaded by another client, see SrcFileCache.ClaimUpload
+type uploadByOther struct {
+	fileIndex uint32
+	claim     *srcUploadClaim
+}
+
+// waitForUploadsByOthers returns indexes of files that must be uploaded by a session client anyway:
+// another upload failed, takes longer than srcUploadWaitTimeout, or another client disconnected
+func (s *NoccServer) waitForUploadsByOthers(ctx context.Context, session *Session, uploadsByOthers []uploadByOther) []uint32 {
+	ctx, cancel := context.WithTimeout(ctx, srcUploadWaitTimeout)
+	defer cancel()
+
+	fileIndexesToUpload := make([]uint32, 0)
+	for _, upload := range uploadsByOthers {
+		select {
+		case <-upload.claim.done:
+		case <-upload.claim.chanDisconnected:
+		case <-ctx.Done():
+		}
+		file := session.files[upload.fileIndex]
+		if s.SrcFileCache.CreateHardLinkFromCache(file.serverFileName, file.fileSHA256) {
+			logServer.Info(1, "fs uploading->uploaded (by another client)", "sessionID", session.sessionID, file.serverFileName)
+			file.state.Store(fsFileStateUploaded)
+			continue
+		}
+		logServer.Info(1, "fs uploading->uploading (another upload failed)", "sessionID", session.sessionID, file.serverFileName)
+		file.uploadStartTime = time.Now()
+		fileIndexesToUpload = append(fileIndexesToUpload, upload.fileIndex)
+	}
+	return fileIndexesToUpload
+}
+
 // UploadFileStream handles a grpc stream created on a client start.
 // When a client needs to upload a file, a client pushes it to the stream: so, a client is the initiator.
 // Multiple .h/.cpp files are transferred over a single stream, one by one.
@@ -243,6 +487,15 @@ func (s *NoccServer) UploadFileStream(stream pb.CompilationService_UploadFileStr
 			return status.Errorf(codes.Unauthenticated, "client %s not found", firstChunk.ClientID)
 		}
 
+		if len(firstChunk.Batch) != 0 {
+			if err := s.receiveUploadedBatch(client, firstChunk.Batch); err != nil {
+				return err
+			}
+			launchCompilerOnServerOnReadySessions(s, client)
+			_ = stream.Send(&pb.UploadFileReply{})
+			continue
+		}
+
 		session := client.GetSession(firstChunk.SessionID)
 		if session == nil || firstChunk.FileIndex >= uint32(len(session.files)) {
 			logServer.Error("bad sessionID/fileIndex on upload", "clientID", client.clientID, "sessionID", firstChunk.SessionID)
@@ -256,7 +509,23 @@ func (s *NoccServer) UploadFileStream(stream pb.CompilationService_UploadFileStr
 			logServer.Info(0, "start receiving large file", file.fileSize, "sessionID", session.sessionID, clientFileName)
 		}
 
-		if err := receiveUploadedFileByChunks(s, stream, firstChunk, int(file.fileSize), file.serverFileName); err != nil {
+		if firstChunk.DeltaSize > 0 {
+			delta, err := receiveUploadedDelta(stream, firstChunk)
+			if err != nil {
+				s.SrcFileCache.ReleaseUpload(file.fileSHA256)
+				file.state.Store(fsFileStateUploadError)
+				logServer.Error("fs uploading->error", "sessionID", session.sessionID, clientFileName, err)
+				return fmt.Errorf("can't receive delta of %q: %v", clientFileName, err)
+			}
+			if err := applyUploadedDelta(s, file, delta); err != nil {
+				// a file remains in the uploading state, a client sends it whole right after
+				logServer.Error("can't apply delta", "sessionID", session.sessionID, clientFileName, err)
+				_ = stream.Send(&pb.UploadFileReply{DeltaFailed: true})
+				continue
+			}
+			logServer.Info(2, "received delta", len(delta), "bytes of", file.fileSize, "sessionID", session.sessionID, clientFileName)
+		} else if err := receiveUploadedFileByChunks(s, stream, firstChunk, int(file.fileSize), file.serverFileName); err != nil {
+			s.SrcFileCache.ReleaseUpload(file.fileSHA256)
 			file.state.Store(fsFileStateUploadError)
 			logServer.Error("fs uploading->error", "sessionID", session.sessionID, clientFileName, err)
 			return fmt.Errorf("can't receive file %q: %v", clientFileName, err)
@@ -268,18 +537,53 @@ func (s *NoccServer) UploadFileStream(stream pb.CompilationService_UploadFileStr
 		}
 
 		file.state.Store(fsFileStateUploaded)
+		s.PipelinedUploads.Release(file, true)
 		logServer.Info(1, "fs uploading->uploaded", "sessionID", session.sessionID, clientFileName)
 		launchCompilerOnServerOnReadySessions(s, client) // other sessions could also be waiting for this file, we should check all
 		_ = stream.Send(&pb.UploadFileReply{})
 		_ = s.SrcFileCache.SaveFileToCache(file.serverFileName, path.Base(file.serverFileName), file.fileSHA256, file.fileSize)
+		s.SrcFileCache.ReleaseUpload(file.fileSHA256)
+		s.SrcFileCache.RememberVersion(clientFileName, file.fileSHA256, file.fileSize)
 
 		// start waiting for the next file over the same stream
 	}
 }
 
+// receiveUploadedBatch saves small files (of any sessions of a client) sent in one message, see client.uploadFilesInBatch.
+// Like for a file sent by chunks, any error closes the stream, and a client compiles all files of a batch locally.
+func (s *NoccServer) receiveUploadedBatch(client *Client, batch []*pb.UploadBatchFile) error {
+	for _, uploaded := range batch {
+		session := client.GetSession(uploaded.SessionID)
+		if session == nil || uploaded.FileIndex >= uint32(len(session.files)) {
+			logServer.Error("bad sessionID/fileIndex on upload", "clientID", client.clientID, "sessionID", uploaded.SessionID)
+			return fmt.Errorf("unknown sessionID %d with index %d", uploaded.SessionID, uploaded.FileIndex)
+		}
+
+		file := session.files[uploaded.FileIndex]
+		clientFileName := client.MapServerAbsToClientFileName(file.serverFileName)
+		if err := saveUploadedFile(s, uploaded.Body, int(file.fileSize), file.serverFileName); err != nil {
+			s.SrcFileCache.ReleaseUpload(file.fileSHA256)
+			file.state.Store(fsFileStateUploadError)
+			logServer.Error("fs uploading->error", "sessionID", session.sessionID, clientFileName, err)
+			return fmt.Errorf("can't receive file %q: %v", clientFileName, err)
+		}
+
+		file.state.Store(fsFileStateUploaded)
+		s.PipelinedUploads.Release(file, true)
+		logServer.Info(1, "fs uploading->uploaded (batch)", "sessionID", session.sessionID, clientFileName)
+		_ = s.SrcFileCache.SaveFileToCache(file.serverFileName, path.Base(file.serverFileName), file.fileSHA256, file.fileSize)
+		s.SrcFileCache.ReleaseUpload(file.fileSHA256)
+		s.SrcFileCache.RememberVersion(clientFileName, file.fileSHA256, file.fileSize)
+	}
+	return nil
+}
+
 // RecvCompiledObjStream handles a grpc stream created on a client start.
 // When a .o file on the server is ready, it to the stream: so, a server is the initiator.
 // Multiple .o files are transferred over a single stream, one by one.
+// A client opens several streams, so that a huge .o doesn't block all others; a SmallObjsOnly stream
+// never takes large ones (see largeObjFileSize), so small .o files are never stuck behind them.
+// If a client supports it, chunks of several .o are interleaved, see sendObjFilesInterleaved.
 // This stream is alive until any error happens. On error, it's closed. A client recreates it.
 // See client.FilesReceiving.
 func (s *NoccServer) RecvCompiledObjStream(in *pb.OpenReceiveStreamRequest, stream pb.CompilationService_RecvCompiledObjStreamServer) error {
@@ -303,32 +607,138 @@ func (s *NoccServer) RecvCompiledObjStream(in *pb.OpenReceiveStreamRequest, stre
 		return err
 	}
 
+	chanReadyLargeSessions := client.chanReadyLargeSessions
+	if in.SmallObjsOnly {
+		chanReadyLargeSessions = nil // receiving from a nil chan blocks forever, so it's never selected
+	}
+
+	if in.AllowInterleaving {
+		return sendObjFilesInterleaved(client, stream, chanReadyLargeSessions, chunkBuf, onError)
+	}
+
 	for {
+		var session *Session
 		select {
 		case <-client.chanDisconnected:
 			return nil
+		case session = <-client.chanReadySessions:
+		case session = <-chanReadyLargeSessions:
+		}
+
+		if session.compilerExitCode != 0 {
+			err := sendFailureMessage(stream, session)
+			if err != nil {
+				return onError(session.sessionID, "can't send obj non-0 reply sessionID %d clientID %s %v", session.sessionID, client.clientID, err)
+			}
+		} else {
+			logServer.Info(0, "send obj file", "sessionID", session.sessionID, "clientID", client.clientID, "compilerDuration", session.compilerDuration, session.OutputFile)
+			err := sendObjFileByChunks(stream, chunkBuf, session)
+			if err != nil {
+				return onError(session.sessionID, "can't send obj file %s sessionID %d clientID %s %v", session.OutputFile, session.sessionID, client.clientID, err)
+			}
+		}
+
+		closeSentSession(client, session)
+		// start waiting for the next ready session
+	}
+}
+
+// sendObjFilesInterleaved is a RecvCompiledObjStream loop for clients that allow interleaving:
+// up to maxInterleavedObjFiles .o files are sent at once, a chunk of each in turn,
+// so that a latency of small .o files doesn't depend on large ones ready before them.
+func sendObjFilesInterleaved(client *Client, stream pb.CompilationService_RecvCompiledObjStreamServer, chanReadyLargeSessions chan *Session, chunkBuf []byte, onError func(uint32, string, ...any) error) error {
+	senders := make([]*objFileSender, 0, maxInterleavedObjFiles)
+	// on error or disconnect, .o files being sent won't reach a client over this stream: their sessions are closed
+	defer func() {
+		for _, sender := range senders {
+			sender.close()
+			closeSentSession(client, sender.session)
+		}
+	}()
+
+	for {
+		// take ready sessions: wait for one if nothing is being sent, otherwise take only those ready right now
+		for len(senders) < maxInterleavedObjFiles {
+			var session *Session
+			if len(senders) == 0 {
+				select {
+				case <-client.chanDisconnected:
+					return nil
+				case session = <-client.chanReadySessions:
+				case session = <-chanReadyLargeSessions:
+				}
+			} else {
+				select {
+				case <-client.chanDisconnected:
+					return nil
+				case session = <-client.chanReadySessions:
+				case session = <-chanReadyLargeSessions:
+				default:
+				}
+			}
+			if session == nil {
+				break
+			}
 
-		case session := <-client.chanReadySessions:
 			if session.compilerExitCode != 0 {
 				err := sendFailureMessage(stream, session)
+				closeSentSession(client, session)
 				if err != nil {
 					return onError(session.sessionID, "can't send obj non-0 reply sessionID %d clientID %s %v", session.sessionID, client.clientID, err)
 				}
+				continue
+			}
+
+			logServer.Info(0, "send obj file", "sessionID", session.sessionID, "clientID", client.clientID, "compilerDuration", session.compilerDuration, session.OutputFile)
+			sender, err := startSendingObjFile(stream, session)
+			if err != nil {
+				closeSentSession(client, session)
+				return onError(session.sessionID, "can't send obj file %s sessionID %d clientID %s %v", session.OutputFile, session.sessionID, client.clientID, err)
+			}
+			if sender == nil {
+				closeSentSession(client, session)
 			} else {
-				logServer.Info(0, "send obj file", "sessionID", session.sessionID, "clientID", client.clientID, "compilerDuration", session.compilerDuration, session.OutputFile)
-				err := sendObjFileByChunks(stream, chunkBuf, session)
-				if err != nil {
-					return onError(session.sessionID, "can't send obj file %s sessionID %d clientID %s %v", session.OutputFile, session.sessionID, client.clientID, err)
-				}
+				senders = append(senders, sender)
 			}
+		}
 
-			client.CloseSession(session)
-			logServer.Info(2, "close", "sessionID", session.sessionID, "clientID", client.clientID)
-			// start waiting for the next ready session
+		// one chunk of every .o in turn; not senders[:0], then on error senders would keep duplicates of those appended
+		stillSending := make([]*objFileSender, 0, maxInterleavedObjFiles)
+		for i, sender := range senders {
+			session := sender.session
+			next, err := sender.sendNextChunk(stream, chunkBuf)
+			if err != nil {
+				senders = append(stillSending, senders[i+1:]...) // closed on return, and a failed one right here
+				closeSentSession(client, session)
+				return onError(session.sessionID, "can't send obj file %s sessionID %d clientID %s %v", session.OutputFile, session.sessionID, client.clientID, err)
+			}
+			if next == nil {
+				closeSentSession(client, session)
+			} else {
+				stillSending = append(stillSending, next)
+			}
 		}
+		senders = stillSending
 	}
 }
 
+// refuseSession closes a session created, but not registered (a client compiles it elsewhere), and returns err
+func refuseSession(client *Client, session *Session, err error) error {
+	client.CloseSession(session)
+	session.span.SetAttribute("nocc.refused", status.Convert(err).Message())
+	session.span.End()
+	return err
+}
+
+func closeSentSession(client *Client, session *Session) {
+	client.CloseSession(session)
+	if session.expired.Load() {
+		session.span.SetAttribute("nocc.expired", true)
+	}
+	session.span.End()
+	logServer.Info(2, "close", "sessionID", session.sessionID, "clientID", client.clientID)
+}
+
 func (s *NoccServer) KeepAlive(_ context.Context, in *pb.KeepAliveRequest) (*pb.KeepAliveReply, error) {
 	client := s.ActiveClients.GetClient(in.ClientID)
 	if client == nil {
@@ -336,18 +746,119 @@ func (s *NoccServer) KeepAlive(_ context.Context, in *pb.KeepAliveRequest) (*pb.
 		return nil, status.Errorf(codes.Unauthenticated, "client %s not found", in.ClientID)
 	}
 
-	client.lastSeen = time.Now()
-	return &pb.KeepAliveReply{}, nil
+	client.touch()
+	// a client balances between servers considering their current capacity, see CapacitySchedule
+	// and reports a server whose caches are broken (it still compiles, but every file is uploaded and compiled again);
+	// sessions being compiled are listed, so that a client doesn't consider waiting for their .o hanged (see client.ObjWaitTimeout)
+	return &pb.KeepAliveReply{
+		CompilerQueueSize:        int32(s.CompilerLauncher.GetQueueSize()),
+		CacheDegraded:            s.SrcFileCache.IsDegraded() || s.ObjFileCache.IsDegraded(),
+		CacheOnly:                s.CacheOnly,
+		CompilingSessionIDs:      client.GetCompilingSessionIDs(),
+		ReportsCompilingSessions: true,
+		AcceptsUploadBatches:     true,
+	}, nil
+}
+
+// ProbeCompiler is a grpc handler.
+// A client asks, whether a compiler on this server supports some features before routing a .cpp here.
+// See CompilerProbes.
+func (s *NoccServer) ProbeCompiler(_ context.Context, in *pb.ProbeCompilerRequest) (*pb.ProbeCompilerReply, error) {
+	client := s.ActiveClients.GetClient(in.ClientID)
+	if client == nil {
+		logServer.Error("unauthenticated client on compiler probe", "clientID", in.ClientID)
+		return nil, status.Errorf(codes.Unauthenticated, "client %s not found", in.ClientID)
+	}
+
+	if client.uploadsToolchain {
+		return nil, status.Errorf(codes.FailedPrecondition, "a compiler of a client uploading its toolchain is not probed")
+	}
+	reply, err := s.CompilerProbes.Probe(in.Compiler, in.Std, in.TargetArgs)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return reply, nil
+}
+
+// ReportBuildSummary is a grpc handler.
+// A daemon sends stats of a build when it quits (if enabled on a client-side). See BuildSummaries.
+func (s *NoccServer) ReportBuildSummary(_ context.Context, in *pb.BuildSummaryRequest) (*pb.BuildSummaryReply, error) {
+	client := s.ActiveClients.GetClient(in.ClientID)
+	if client == nil {
+		logServer.Error("unauthenticated client on build summary", "clientID", in.ClientID)
+		return nil, status.Errorf(codes.Unauthenticated, "client %s not found", in.ClientID)
+	}
+
+	logServer.Info(0, "build summary", "clientID", in.ClientID, "build", in.BuildHash, "invocations", in.NInvocations,
+		"remote", in.NRemote, "local", in.NLocal, "remoteFailed", in.NRemoteFailed, "localReasons", in.LocalReasons)
+	s.BuildSummaries.AddReport(in)
+
+	return &pb.BuildSummaryReply{}, nil
 }
 
 // StopClient is a grpc handler. See StartClient for comments.
 func (s *NoccServer) StopClient(_ context.Context, in *pb.StopClientRequest) (*pb.StopClientReply, error) {
 	client := s.ActiveClients.GetClient(in.ClientID)
 	if client != nil {
-		logServer.Info(0, "client disconnected", "clientID", client.clientID, "; nClients", s.ActiveClients.ActiveCount()-1)
-		// removing working dir could take some time, but respond immediately
-		go s.ActiveClients.DeleteClient(client)
+		logServer.Info(0, "client disconnected", "clientID", client.clientID, "keepWorkingDir", in.KeepWorkingDir, "; nClients", s.ActiveClients.ActiveCount()-1)
+		s.SrcFileCache.ReleaseClientUploads(client.clientID)
+		if in.KeepWorkingDir && s.ClientRetention > 0 {
+			s.ActiveClients.RetainClient(client)
+		} else {
+			// removing working dir could take some time, but respond immediately
+			go s.ActiveClients.DeleteClient(client)
+		}
 	}
 
 	return &pb.StopClientReply{}, nil
 }
+
+// PushObjToCache is a grpc handler.
+// Another server pushes a compiled .o (or a BMI) to this cache server, one file per stream; a pusher isn't a client.
+// Then clients close to this server take it from here without uploading sources to a full server.
+func (s *NoccServer) PushObjToCache(stream pb.CompilationService_PushObjToCacheServer) error {
+	if !s.CacheOnly {
+		return status.Error(codes.PermissionDenied, "only a cache server accepts pushes")
+	}
+
+	firstChunk, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	key := common.SHA256{B0_7: firstChunk.Key_B0_7, B8_15: firstChunk.Key_B8_15, B16_23: firstChunk.Key_B16_23, B24_31: firstChunk.Key_B24_31}
+	if s.ObjFileCache.LookupInCache(key) != "" {
+		logServer.Info(2, "pushed obj already exists", firstChunk.FileName)
+		return stream.SendAndClose(&pb.PushObjToCacheReply{})
+	}
+
+	if err := receivePushedObjByChunks(s, stream, firstChunk, key); err != nil {
+		logServer.Error("can't receive pushed obj", firstChunk.FileName, err)
+		return err
+	}
+
+	logServer.Info(1, "received pushed obj", firstChunk.FileSize, "bytes", firstChunk.FileName)
+	return stream.SendAndClose(&pb.PushObjToCacheReply{})
+}
+
+// OnDemandFilesStream is a grpc handler.
+// A client opens it after StartClient if a server mounted a root for it (see OnDemandIncludes).
+// Unlike other streams, a server is the initiator: it requests files a compiler looks up, and a client replies.
+func (s *NoccServer) OnDemandFilesStream(stream pb.CompilationService_OnDemandFilesStreamServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	client := s.ActiveClients.GetClient(first.ClientID)
+	if client == nil || client.onDemand == nil {
+		logServer.Error("unauthenticated client on on-demand stream", "clientID", first.ClientID)
+		return status.Errorf(codes.Unauthenticated, "client %s not found", first.ClientID)
+	}
+
+	err = client.onDemand.serveStream(stream)
+	if err != nil && !errors.Is(stream.Context().Err(), context.Canceled) {
+		logServer.Error("on-demand stream receive error:", "clientID", client.clientID, err)
+	}
+	return err
+}
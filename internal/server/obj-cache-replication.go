@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ObjCacheReplicator pushes compiled objects to cache servers (see NoccServer.CacheOnly) in the background,
+// so that clients in remote offices hit a warm cache close to them.
+// Only heavy objects are pushed (compiled longer than minDuration): light ones are cheaper to compile again.
+// Pushing never delays compilation: if a tier is slow or down, its queue overflows, and objects are dropped.
+type ObjCacheReplicator struct {
+	objFileCache *ObjFileCache
+	minDuration  time.Duration
+	tiers        []*cacheTier
+}
+
+type cacheTier struct {
+	hostPort string
+	client   pb.CompilationServiceClient
+	queue    chan objPushReq
+
+	nPushed  atomic.Int64
+	nFailed  atomic.Int64
+	nDropped atomic.Int64
+}
+
+type objPushReq struct {
+	key      common.SHA256
+	fileName string // in obj cache dir, like "1.cpp.o"
+}
+
+const cacheTierQueueSize = 1024
+
+func MakeObjCacheReplicator(objFileCache *ObjFileCache, tierHostPorts []string, minDuration time.Duration) (*ObjCacheReplicator, error) {
+	replicator := &ObjCacheReplicator{
+		objFileCache: objFileCache,
+		minDuration:  minDuration,
+	}
+
+	for _, hostPort := range tierHostPorts {
+		// this connection is non-blocking, like on a client: if a tier is not available, pushes fail
+		connection, err := grpc.NewClient("dns:///"+hostPort, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, err
+		}
+		tier := &cacheTier{
+			hostPort: hostPort,
+			client:   pb.NewCompilationServiceClient(connection),
+			queue:    make(chan objPushReq, cacheTierQueueSize),
+		}
+		replicator.tiers = append(replicator.tiers, tier)
+		go replicator.pushQueuedObjs(tier)
+	}
+	return replicator, nil
+}
+
+// PushIfHeavy enqueues an object just saved to obj cache to be pushed to all tiers.
+func (replicator *ObjCacheReplicator) PushIfHeavy(key common.SHA256, fileName string, compilerDuration int32) {
+	if replicator == nil || time.Duration(compilerDuration)*time.Millisecond < replicator.minDuration {
+		return
+	}
+
+	for _, tier := range replicator.tiers {
+		select {
+		case tier.queue <- objPushReq{key, fileName}:
+		default:
+			if tier.nDropped.Add(1)%100 == 1 {
+				logServer.Error("cache tier", tier.hostPort, "is too slow, objects are not pushed; dropped", tier.nDropped.Load())
+			}
+		}
+	}
+}
+
+func (replicator *ObjCacheReplicator) pushQueuedObjs(tier *cacheTier) {
+	chunkBuf := make([]byte, 64*1024)
+	for req := range tier.queue {
+		// an object could have been purged from obj cache while waiting in a queue, it's not pushed then
+		pathInCache := replicator.objFileCache.LookupInCache(req.key)
+		if pathInCache == "" {
+			continue
+		}
+
+		if err := tier.pushObjByChunks(pathInCache, req, chunkBuf); err != nil {
+			tier.nFailed.Add(1)
+			logServer.Error("can't push obj to cache tier", tier.hostPort, req.fileName, err)
+			continue
+		}
+		tier.nPushed.Add(1)
+		logServer.Info(2, "pushed obj to cache tier", tier.hostPort, req.fileName)
+	}
+}
+
+// pushObjByChunks is an actual implementation of piping a file in obj cache to a cache server stream.
+// See receivePushedObjByChunks.
+func (tier *cacheTier) pushObjByChunks(pathInCache string, req objPushReq, chunkBuf []byte) error {
+	file, err := os.Open(pathInCache) // if it's purged right now, an opened file is still readable
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	stream, err := tier.client.PushObjToCache(ctx)
+	if err != nil {
+		return err
+	}
+
+	chunk := &pb.PushObjChunkRequest{
+		FileName:   req.fileName,
+		FileSize:   stat.Size(),
+		Key_B0_7:   req.key.B0_7,
+		Key_B8_15:  req.key.B8_15,
+		Key_B16_23: req.key.B16_23,
+		Key_B24_31: req.key.B24_31,
+	}
+	sentBytes := int64(0)
+	for {
+		n, err := file.Read(chunkBuf)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		chunk.ChunkBody = chunkBuf[:n]
+		if err := stream.Send(chunk); err != nil {
+			if errors.Is(err, io.EOF) { // a tier already has it and closed a stream, see NoccServer.PushObjToCache
+				break
+			}
+			return err
+		}
+		sentBytes += int64(n)
+		if sentBytes >= stat.Size() {
+			break
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		chunk = &pb.PushObjChunkRequest{}
+	}
+
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func (replicator *ObjCacheReplicator) makeDashboardCacheTiers() []dashboardCacheTier {
+	cacheTiers := make([]dashboardCacheTier, 0)
+	if replicator == nil {
+		return cacheTiers
+	}
+	for _, tier := range replicator.tiers {
+		cacheTiers = append(cacheTiers, dashboardCacheTier{
+			HostPort: tier.hostPort,
+			Pushed:   tier.nPushed.Load(),
+			Failed:   tier.nFailed.Load(),
+			Dropped:  tier.nDropped.Load(),
+			Queued:   len(tier.queue),
+		})
+	}
+	return cacheTiers
+}
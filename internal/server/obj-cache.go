@@ -20,6 +20,12 @@ type ObjFileCache struct {
 	// next to obj-cache, there is a ${ObjCacheDir}/obj/compiler-out directory (session.objOutFile point here)
 	// after being compiled, files from here are hard linked to obj-cache
 	objTmpDir string
+
+	// nil unless CacheTiers are set in config
+	Replicator *ObjCacheReplicator
+
+	// nil unless Provenance is set in config
+	Provenance *ProvenanceRecorder
 }
 
 func MakeObjFileCache(cacheDir string, objTmpDir string, limitBytes int64) (*ObjFileCache, error) {
@@ -28,7 +34,7 @@ func MakeObjFileCache(cacheDir string, objTmpDir string, limitBytes int64) (*Obj
 		return nil, err
 	}
 
-	return &ObjFileCache{cache, strings.TrimSuffix(objTmpDir, "/")}, nil
+	return &ObjFileCache{FileCache: cache, objTmpDir: strings.TrimSuffix(objTmpDir, "/")}, nil
 }
 
 // MakeObjCacheKey creates a unique key (sha256) for an input .cpp file and all its dependencies.
@@ -41,14 +47,24 @@ func MakeObjFileCache(cacheDir string, objTmpDir string, limitBytes int64) (*Obj
 // * the .cpp file is the same (sha256)
 // * all dependent .h/.nocc-pch/etc. are the same (their count, order, size, sha256)
 // * all compiler options are the same: We use the original commandline which includes the .cpp file
+// * a target triple is the same (the same compiler name may produce code for another platform, see CompilerProbes)
+// * a compiler cwd is the same, if it's written to debug info (see NoccServer.RemapDebugPaths)
+// * a compiler env from a client affecting an object is the same (e.g. SOURCE_DATE_EPOCH changes __DATE__), not a locale
 //
-func (cache *ObjFileCache) MakeObjCacheKey(compilerName string, compilerArgs []string, sessionFiles []*fileInClientDir) common.SHA256 {
+func (cache *ObjFileCache) MakeObjCacheKey(compilerName string, target string, compilerCwd string, compilerArgs []string, compilerEnv []string, sessionFiles []*fileInClientDir) common.SHA256 {
 	hasher := sha256.New()
 
 	hasher.Write([]byte(compilerName))
+	hasher.Write([]byte(target))
+	hasher.Write([]byte(compilerCwd))
 	for _, arg := range compilerArgs {
 		hasher.Write([]byte(arg))
 	}
+	for _, keyValue := range compilerEnv {
+		if isObjAffectingEnvVar(keyValue) {
+			hasher.Write([]byte(keyValue))
+		}
+	}
 
 	sha256xor := common.MakeSHA256Struct(hasher)
 	sha256xor.B8_15 ^= uint64(len(compilerArgs))
@@ -61,6 +77,13 @@ func (cache *ObjFileCache) MakeObjCacheKey(compilerName string, compilerArgs []s
 	return sha256xor
 }
 
+// MakeModuleOutputCacheKey is a key of a BMI produced along with a .o (see Session.moduleOutputFile).
+// A session with -fmodule-output is taken from obj cache only if both exist.
+func MakeModuleOutputCacheKey(objCacheKey common.SHA256) common.SHA256 {
+	objCacheKey.B24_31 ^= 0x2e70636d // ".pcm"
+	return objCacheKey
+}
+
 // GenerateObjOutFileName generates session.objOutFile (destination for C++ compiler launched on a server)
 func (cache *ObjFileCache) GenerateObjOutFileName(client *Client, session *Session) string {
 	return fmt.Sprintf("%s/%s.%d.o", cache.objTmpDir, client.clientID, session.sessionID)
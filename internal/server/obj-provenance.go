@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"nocc/internal/common"
+)
+
+// ProvenanceRecorder records which server and compiler produced every compiled .o (see common.ObjProvenance),
+// so that security-sensitive builds can verify where each object of a final binary came from.
+// Provenance is saved to obj cache next to a .o (and pushed to cache tiers along with it),
+// that's why it's sent to a client on cache hits as well, describing an original compilation.
+// If a private key is configured, provenance is signed, and clients may refuse unsigned objects.
+type ProvenanceRecorder struct {
+	serverName     string
+	privateKey     ed25519.PrivateKey // nil if provenance is not signed
+	compilerProbes *CompilerProbes
+
+	mu             sync.Mutex
+	compilerHashes map[string]string // key: a compiler path on this server; compilers don't change while a server is running
+}
+
+func MakeProvenanceRecorder(serverName string, keyFile string, compilerProbes *CompilerProbes) (*ProvenanceRecorder, error) {
+	recorder := &ProvenanceRecorder{
+		serverName:     serverName,
+		compilerProbes: compilerProbes,
+		compilerHashes: make(map[string]string),
+	}
+	if recorder.serverName == "" {
+		recorder.serverName, _ = os.Hostname()
+	}
+
+	if keyFile != "" {
+		var err error
+		if recorder.privateKey, err = common.ReadEd25519PrivateKey(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return recorder, nil
+}
+
+// MakeProvenanceCacheKey is a key of provenance of a .o in obj cache (see ProvenanceRecorder).
+func MakeProvenanceCacheKey(objCacheKey common.SHA256) common.SHA256 {
+	objCacheKey.B16_23 ^= 0x2e70726f76 // ".prov"
+	return objCacheKey
+}
+
+// Record makes provenance of a just compiled session.OutputFile, nil if provenance is off.
+func (recorder *ProvenanceRecorder) Record(client *Client, session *Session) []byte {
+	if recorder == nil {
+		return nil
+	}
+
+	objSHA256, err := common.GetFileSHA256(session.OutputFile)
+	if err != nil {
+		logServer.Error("can't record provenance", session.OutputFile, err)
+		return nil
+	}
+
+	provenance := &common.ObjProvenance{
+		Server:      recorder.serverName,
+		Compiler:    session.compilerName,
+		CompiledAt:  time.Now().UTC(),
+		ObjCacheKey: session.objCacheKey.ToLongHexString(),
+		ObjSHA256:   objSHA256.ToHexString(),
+	}
+	if client.uploadsToolchain {
+		// a client compiler is uploaded like any other file, its sha256 is already known
+		provenance.CompilerVersion = session.clientCompilerVersion
+		serverFileName := client.MapClientFileNameToServerAbs(session.compilerName)
+		for _, file := range session.files {
+			if file.serverFileName == serverFileName && !file.isSymlink {
+				provenance.CompilerSHA256 = file.fileSHA256.ToHexString()
+			}
+		}
+	} else {
+		if reply := recorder.compilerProbes.ProbeIfReady(session.compilerName, common.ExtractTargetArgs(session.compilerArgs)); reply != nil {
+			provenance.CompilerVersion = reply.Version
+		}
+		provenance.CompilerSHA256 = recorder.getCompilerSHA256(session.compilerName)
+	}
+
+	signedJSON, err := common.SignObjProvenance(provenance, recorder.privateKey)
+	if err != nil {
+		logServer.Error("can't record provenance", session.OutputFile, err)
+		return nil
+	}
+	return signedJSON
+}
+
+func (recorder *ProvenanceRecorder) getCompilerSHA256(compilerName string) string {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	compilerHash, exists := recorder.compilerHashes[compilerName]
+	if !exists {
+		if compilerPath, err := exec.LookPath(compilerName); err == nil {
+			if compilerSHA256, err := common.GetFileSHA256(compilerPath); err == nil {
+				compilerHash = compilerSHA256.ToHexString()
+			}
+		}
+		recorder.compilerHashes[compilerName] = compilerHash
+	}
+	return compilerHash
+}
+
+// SaveProvenanceToCache saves provenance as a small file in obj cache, next to a .o saved with objCacheKey.
+func (cache *ObjFileCache) SaveProvenanceToCache(provenance []byte, inputFile string, objCacheKey common.SHA256, namespace string) bool {
+	fileTmp, err := os.CreateTemp(cache.objTmpDir, "prov.*")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(fileTmp.Name()) // after being saved, it's hard linked to obj cache
+
+	_, err = fileTmp.Write(provenance)
+	if err1 := fileTmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		logServer.Error("can't save provenance to cache:", err)
+		return false
+	}
+	return cache.SaveFileToCacheInNamespace(fileTmp.Name(), path.Base(inputFile)+".prov", MakeProvenanceCacheKey(objCacheKey), int64(len(provenance)), namespace) == nil
+}
+
+// LookupProvenance returns provenance of a .o in obj cache, nil if it was compiled without it (or purged).
+func (cache *ObjFileCache) LookupProvenance(objCacheKey common.SHA256) []byte {
+	pathInCache := cache.LookupInCache(MakeProvenanceCacheKey(objCacheKey))
+	if pathInCache == "" {
+		return nil
+	}
+	provenance, _ := os.ReadFile(pathInCache)
+	return provenance
+}
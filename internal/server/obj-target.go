@@ -0,0 +1,60 @@
+package server
+
+import (
+	"debug/elf"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// expectedObjMachine returns an ELF machine of objects produced for a target triple (as `compiler -dumpmachine` prints it),
+// or EM_NONE for an unknown arch (then objects are not verified).
+// gcc prints its default triple even with -m32, that's why targetArgs are also considered.
+func expectedObjMachine(target string, targetArgs []string) elf.Machine {
+	arch, _, _ := strings.Cut(target, "-")
+	switch {
+	case arch == "x86_64" || arch == "amd64":
+		if slices.Contains(targetArgs, "-m32") || slices.Contains(targetArgs, "-m16") {
+			return elf.EM_386
+		}
+		return elf.EM_X86_64
+	case arch == "i386" || arch == "i486" || arch == "i586" || arch == "i686":
+		if slices.Contains(targetArgs, "-m64") {
+			return elf.EM_X86_64
+		}
+		return elf.EM_386
+	case arch == "aarch64" || arch == "aarch64_be" || arch == "arm64":
+		return elf.EM_AARCH64
+	case strings.HasPrefix(arch, "arm") || strings.HasPrefix(arch, "thumb"):
+		return elf.EM_ARM
+	case strings.HasPrefix(arch, "riscv"):
+		return elf.EM_RISCV
+	case strings.HasPrefix(arch, "powerpc64") || strings.HasPrefix(arch, "ppc64"):
+		return elf.EM_PPC64
+	case arch == "powerpc" || arch == "ppc":
+		return elf.EM_PPC
+	case arch == "s390x":
+		return elf.EM_S390
+	case strings.HasPrefix(arch, "mips"):
+		return elf.EM_MIPS
+	case arch == "loongarch64":
+		return elf.EM_LOONGARCH
+	default:
+		return elf.EM_NONE
+	}
+}
+
+// verifyObjMachine returns an error if a compiled .o is an ELF for another machine.
+// Non-ELF outputs (LLVM bitcode, etc.) are not checked.
+func verifyObjMachine(objFile string, expected elf.Machine) error {
+	f, err := elf.Open(objFile)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	if f.Machine != expected {
+		return fmt.Errorf("nocc-server: an object was compiled for %s, but %s was expected; probably, a compiler on this server targets another platform", f.Machine, expected)
+	}
+	return nil
+}
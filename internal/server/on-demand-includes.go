@@ -0,0 +1,885 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+
+	"golang.org/x/sys/unix"
+)
+
+// OnDemandIncludes lets a client skip collecting dependencies of a .cpp (a `compiler -M`-like pass) and uploading them:
+// a session has only a .cpp (and -f option files, BMIs) and dirs where a compiler searches for includes (OnDemandDirs).
+// A compiler of such a session is chrooted not to a client working dir, but to a FUSE root (see fuseConn) mounted
+// once per client: files inside session dirs are listed and read from a client on demand, over a stream opened
+// by a client (see NoccServer.OnDemandFilesStream). Fetched files are saved to src cache by sha256,
+// so a compiler opening the same header later (even of another client) makes a client send only its sha256.
+// Server dirs (CompilerDirs, accepted SystemHeaderDirs, ObjCacheDir) are bind-mounted into a root, like into a working dir.
+//
+// Every session sees only its own dirs, and every dir is listed once per session, like a client would see it
+// while compiling locally, no matter what other sessions see; a session is detected by a pid of a process
+// that looks up a file (a compiler or its child, like cc1plus), see onDemandRoot.viewOf.
+// Such sessions don't use obj cache (dependencies are unknown before compiling),
+// and files a compiler read are sent to a client along with .o, for a depfile.
+//
+// It requires CAP_SYS_ADMIN and /dev/fuse. It's nil if OnDemandIncludes is off in config.
+type OnDemandIncludes struct {
+	mountsDir    string // ${SrcCacheDir}/on-demand, roots of clients are mounted there
+	srcFileCache *SrcFileCache
+
+	fetchesMu sync.Mutex
+	fetches   map[common.SHA256]chan struct{} // files being fetched now (from any client), see fetchFile
+}
+
+// onDemandRequestTimeout is how long a compiler waits for a client to reply, after it a session falls back
+const onDemandRequestTimeout = 30 * time.Second
+
+// onDemandPidWait is how long a lookup by an unknown pid waits for a compiler to be attached, see viewOf:
+// a compiler starts looking up files right after fork, before ExecCompiler knows its pid
+const onDemandPidWait = time.Second
+
+const onDemandFetchChunkSize = 64 * 1024
+
+var errOnDemandStreamGone = errors.New("on-demand stream of a client has closed")
+
+func MakeOnDemandIncludes(mountsDir string, srcFileCache *SrcFileCache) (*OnDemandIncludes, error) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return nil, err
+	}
+
+	unmountStaleFuse(mountsDir)
+	_ = os.RemoveAll(mountsDir)
+	if err := os.MkdirAll(mountsDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &OnDemandIncludes{
+		mountsDir:    mountsDir,
+		srcFileCache: srcFileCache,
+		fetches:      make(map[common.SHA256]chan struct{}),
+	}, nil
+}
+
+// onDemandTmpDir is where a tmp dir of a client is mounted inside a root (a root itself is read-only), TMPDIR of a compiler.
+// It's not /tmp, since a client may have sources there.
+const onDemandTmpDir = "/.nocc-tmp"
+
+// OnDemandExecArg is the first argument of nocc-server launched by itself to chroot to a root, see launchInOnDemandRoot
+const OnDemandExecArg = "--exec-in-on-demand-root"
+
+// onDemandMount is a server dir (or a file) bind-mounted into a root at the same path, except a tmp dir, see onDemandTmpDir
+type onDemandMount struct {
+	source string
+	target string
+	flags  uintptr
+}
+
+// MountForClient mounts a root for a client (see OnDemandIncludes), mounts are the same as ones of a client working dir
+func (includes *OnDemandIncludes) MountForClient(clientID string, mounts []onDemandMount) (*onDemandRoot, error) {
+	if includes == nil {
+		return nil, nil
+	}
+
+	root := &onDemandRoot{
+		includes:   includes,
+		root:       path.Join(includes.mountsDir, clientID),
+		tmpDir:     path.Join(includes.mountsDir, clientID+".tmp"),
+		static:     make(map[string]uint32),
+		nodes:      make(map[uint64]*onDemandNode),
+		nodesByKey: make(map[string]*onDemandNode),
+		lastIno:    fuseRootIno,
+		views:      make(map[int]*onDemandView),
+		openFiles:  make(map[uint64]*os.File),
+		pending:    make(map[uint32]chan *pb.OnDemandFileReply),
+	}
+	rootNode := &onDemandNode{ino: fuseRootIno, key: "d:/", path: "/", attr: fuseAttr{ino: fuseRootIno, mode: unix.S_IFDIR | 0555}}
+	root.nodes[fuseRootIno] = rootNode
+	root.nodesByKey[rootNode.key] = rootNode
+
+	if err := os.Mkdir(root.tmpDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	mounts = append(mounts, onDemandMount{source: root.tmpDir, target: onDemandTmpDir})
+
+	root.static["/"] = unix.S_IFDIR | 0555
+	for _, mount := range mounts {
+		stat, err := os.Stat(mount.source)
+		if err != nil {
+			_ = os.RemoveAll(root.tmpDir)
+			return nil, err
+		}
+		root.static[mount.target] = unix.S_IFREG | 0444 // an empty file to mount a file onto
+		if stat.IsDir() {
+			root.static[mount.target] = unix.S_IFDIR | 0555
+		}
+		for dir := path.Dir(mount.target); dir != "/"; dir = path.Dir(dir) {
+			root.static[dir] = unix.S_IFDIR | 0555
+		}
+	}
+
+	if err := os.Mkdir(root.root, os.ModePerm); err != nil {
+		_ = os.RemoveAll(root.tmpDir)
+		return nil, err
+	}
+	conn, err := mountFuse(root.root, root)
+	if err != nil {
+		_ = os.Remove(root.root)
+		_ = os.RemoveAll(root.tmpDir)
+		return nil, err
+	}
+	root.conn = conn
+
+	for _, mount := range mounts {
+		if err := bindMount(mount.source, path.Join(root.root, mount.target), mount.flags); err != nil {
+			root.unmount()
+			return nil, fmt.Errorf("failed to bind mount %s on %s: %v", mount.source, mount.target, err)
+		}
+		root.mounted = append(root.mounted, mount.target)
+	}
+	return root, nil
+}
+
+// openFromSrcCache returns nil if a file isn't in src cache
+func (includes *OnDemandIncludes) openFromSrcCache(key common.SHA256) *os.File {
+	pathInCache := includes.srcFileCache.LookupInCache(key)
+	if pathInCache == "" {
+		return nil
+	}
+	fd, err := os.Open(pathInCache)
+	if err != nil {
+		return nil
+	}
+	return fd
+}
+
+// fetchFile requests a file body from a client and saves it to src cache.
+// If the same file is being fetched now (by another compiler or another client), it waits for it instead.
+func (includes *OnDemandIncludes) fetchFile(root *onDemandRoot, fileName string, key common.SHA256, fileSize int64) (*os.File, error) {
+	includes.fetchesMu.Lock()
+	done, fetching := includes.fetches[key]
+	if !fetching {
+		done = make(chan struct{})
+		includes.fetches[key] = done
+	}
+	includes.fetchesMu.Unlock()
+
+	if fetching {
+		<-done
+		if fd := includes.openFromSrcCache(key); fd != nil {
+			return fd, nil
+		}
+		return includes.receiveFile(root, fileName, key, fileSize) // that fetch failed
+	}
+
+	defer func() {
+		includes.fetchesMu.Lock()
+		delete(includes.fetches, key)
+		includes.fetchesMu.Unlock()
+		close(done)
+	}()
+	return includes.receiveFile(root, fileName, key, fileSize)
+}
+
+func (includes *OnDemandIncludes) receiveFile(root *onDemandRoot, fileName string, key common.SHA256, fileSize int64) (*os.File, error) {
+	fileTmp, err := os.CreateTemp(includes.mountsDir, "fetched.*."+path.Base(fileName))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fileTmp.Name()) // after being saved, it's hard linked to src cache
+
+	hasher := sha256.New()
+	err = root.requestBody(fileName, io.MultiWriter(fileTmp, hasher), fileSize)
+	if err == nil {
+		if received := common.MakeSHA256Struct(hasher); received != key {
+			err = fmt.Errorf("sha256 mismatch of %s, it has changed", fileName)
+		}
+	}
+	if err != nil {
+		_ = fileTmp.Close()
+		return nil, err
+	}
+
+	if err := includes.srcFileCache.SaveFileToCache(fileTmp.Name(), path.Base(fileName), key, fileSize); err != nil {
+		logServer.Error("can't save fetched file to src cache", fileName, err)
+	}
+	_, err = fileTmp.Seek(0, io.SeekStart)
+	return fileTmp, err
+}
+
+// onDemandRoot is a FUSE root of one client, see OnDemandIncludes.
+// Its tree is the same for all sessions of a client (it's static: server mounts and their parent dirs),
+// plus what a session sees (an onDemandView): its uploaded files and dirs served by a client.
+type onDemandRoot struct {
+	includes *OnDemandIncludes
+	root     string // ${SrcCacheDir}/on-demand/{clientID}, a compiler is chrooted there
+	tmpDir   string // ${SrcCacheDir}/on-demand/{clientID}.tmp, mounted as onDemandTmpDir
+	conn     *fuseConn
+	mounted  []string          // targets inside root, unmounted in reverse order
+	static   map[string]uint32 // a mode of a mount target or its parent dir, not modified after mounting
+
+	mu         sync.Mutex
+	nodes      map[uint64]*onDemandNode
+	nodesByKey map[string]*onDemandNode
+	lastIno    uint64
+	views      map[int]*onDemandView // by pid of a compiler and its children
+	openFiles  map[uint64]*os.File
+	lastFh     uint64
+
+	streamMu      sync.Mutex
+	stream        pb.CompilationService_OnDemandFilesStreamServer // nil until a client opens it
+	streamGone    chan struct{}                                   // closed when a current stream ends
+	pending       map[uint32]chan *pb.OnDemandFileReply
+	lastRequestID uint32
+}
+
+// onDemandNode is an inode the kernel knows (until forget). A client file node is created per contents
+// (a path, a size, a mtime), not per path: sessions may see different versions of a file,
+// and the kernel keeps cached pages of an inode (see fuseOpenKeepCache).
+type onDemandNode struct {
+	ino            uint64
+	key            string
+	path           string
+	attr           fuseAttr
+	symlinkTarget  string
+	serverFileName string // a file uploaded in a session (a .cpp, etc.), read from a client working dir
+	nlookup        uint64
+}
+
+// unmount is called when a client is deleted; running compilers are already killed by chanDisconnected
+func (root *onDemandRoot) unmount() {
+	if root == nil {
+		return
+	}
+
+	slices.Reverse(root.mounted)
+	unmountPaths(root.root, root.mounted)
+	root.conn.unmount()
+	_ = os.Remove(root.root)
+	_ = os.RemoveAll(root.tmpDir)
+
+	root.mu.Lock()
+	for fh, fd := range root.openFiles {
+		_ = fd.Close()
+		delete(root.openFiles, fh)
+	}
+	root.mu.Unlock()
+}
+
+// launchInOnDemandRoot makes a compiler command launch nocc-server itself, which chroots to a root and executes a compiler,
+// see ExecInOnDemandRoot. If a command chrooted on its own, a forking thread would be blocked (holding a Go scheduler slot)
+// until the kernel looks up a cwd and a compiler in a root, i.e. until this very server replies FUSE requests,
+// and a pid isn't attached to a view until fork returns.
+func launchInOnDemandRoot(compilerCommand *exec.Cmd) {
+	compilerCommand.Env = append(compilerCommand.Environ(), "TMPDIR="+onDemandTmpDir)
+	compilerCommand.Args = append([]string{"nocc-server", OnDemandExecArg, compilerCommand.SysProcAttr.Chroot, compilerCommand.Dir, compilerCommand.Path}, compilerCommand.Args...)
+	compilerCommand.Path = "/proc/self/exe"
+	compilerCommand.SysProcAttr.Chroot = ""
+	compilerCommand.Dir = "/"
+}
+
+// ExecInOnDemandRoot is called by nocc-server launched with OnDemandExecArg, args are a root, a cwd, a compiler and its argv.
+// It doesn't return: an error is written to stderr (which is compiler stderr for a session).
+func ExecInOnDemandRoot(args []string) {
+	err := errors.New("invalid arguments")
+	if len(args) >= 4 {
+		err = syscall.Chroot(args[0])
+		if err == nil {
+			err = syscall.Chdir(args[1])
+		}
+		if err == nil {
+			err = syscall.Exec(args[2], args[3:], os.Environ())
+		}
+	}
+	_, _ = fmt.Fprintln(os.Stderr, "nocc-server: can't launch a compiler in on-demand root:", err)
+	os.Exit(1)
+}
+
+// makeView is called before launching a compiler of a session with OnDemandDirs
+func (root *onDemandRoot) makeView(client *Client, session *Session) *onDemandView {
+	view := &onDemandView{
+		root:     root,
+		parents:  make(map[string]bool),
+		uploaded: make(map[string]*fileInClientDir, len(session.files)),
+		listings: make(map[string]*onDemandListing),
+		hashes:   make(map[string]common.SHA256),
+	}
+	for _, dir := range session.onDemandDirs {
+		if path.IsAbs(dir) && dir != "/" {
+			view.dirs = append(view.dirs, path.Clean(dir))
+		}
+	}
+	for _, file := range session.files {
+		view.uploaded[client.MapServerAbsToClientFileName(file.serverFileName)] = file
+	}
+
+	// parents of dirs and uploaded files exist in a root (empty unless served), like a client working dir is mirrored
+	parentsOf := append(slices.Clone(view.dirs), session.compilerCwd)
+	for clientFileName := range view.uploaded {
+		parentsOf = append(parentsOf, path.Dir(clientFileName))
+	}
+	for _, dir := range parentsOf {
+		for ; dir != "/" && dir != "." && dir != ""; dir = path.Dir(dir) {
+			view.parents[dir] = true
+		}
+	}
+	return view
+}
+
+// viewOf finds a session by a pid of a process that requested a file, nil if it's not a compiler
+func (root *onDemandRoot) viewOf(pid uint32) *onDemandView {
+	if int(pid) == os.Getpid() || pid == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(onDemandPidWait)
+	for {
+		root.mu.Lock()
+		view := root.findViewLocked(int(pid))
+		root.mu.Unlock()
+		if view != nil || time.Now().After(deadline) {
+			return view
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (root *onDemandRoot) findViewLocked(pid int) *onDemandView {
+	for ancestor, depth := pid, 0; ancestor > 1 && depth < 8; ancestor, depth = readParentPid(ancestor), depth+1 {
+		if view := root.views[ancestor]; view != nil {
+			if ancestor != pid {
+				root.views[pid] = view
+				view.pids = append(view.pids, pid)
+			}
+			return view
+		}
+	}
+	return nil
+}
+
+// readParentPid returns 0 if a process has exited
+func readParentPid(pid int) int {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0
+	}
+	// "pid (comm) state ppid ...", comm may contain spaces and parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
+
+// refNode returns an inode for a key, creating it from a template; it's remembered until the kernel forgets it
+func (root *onDemandRoot) refNode(template *onDemandNode) fuseAttr {
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	node := root.nodesByKey[template.key]
+	if node == nil {
+		root.lastIno++
+		node = template
+		node.ino = root.lastIno
+		node.attr.ino = node.ino
+		root.nodes[node.ino] = node
+		root.nodesByKey[node.key] = node
+	}
+	node.nlookup++
+	return node.attr
+}
+
+func (root *onDemandRoot) getNode(ino uint64) *onDemandNode {
+	root.mu.Lock()
+	node := root.nodes[ino]
+	root.mu.Unlock()
+	return node
+}
+
+func (root *onDemandRoot) lookup(pid uint32, parentIno uint64, name string) (fuseAttr, syscall.Errno) {
+	parent := root.getNode(parentIno)
+	if parent == nil {
+		return fuseAttr{}, unix.ENOENT
+	}
+	fileName := path.Join(parent.path, name)
+
+	if mode, ok := root.static[fileName]; ok {
+		key := "s:" + fileName
+		if mode&unix.S_IFMT == unix.S_IFDIR {
+			key = "d:" + fileName
+		}
+		return root.refNode(&onDemandNode{key: key, path: fileName, attr: fuseAttr{mode: mode}}), 0
+	}
+
+	view := root.viewOf(pid)
+	if view == nil {
+		return fuseAttr{}, unix.ENOENT
+	}
+	template, errno := view.lookup(fileName)
+	if errno != 0 {
+		return fuseAttr{}, errno
+	}
+	return root.refNode(template), 0
+}
+
+func (root *onDemandRoot) forget(ino uint64, nlookup uint64) {
+	root.mu.Lock()
+	if node := root.nodes[ino]; node != nil && ino != fuseRootIno {
+		node.nlookup -= min(nlookup, node.nlookup)
+		if node.nlookup == 0 {
+			delete(root.nodes, ino)
+			delete(root.nodesByKey, node.key)
+		}
+	}
+	root.mu.Unlock()
+}
+
+func (root *onDemandRoot) getattr(ino uint64) (fuseAttr, syscall.Errno) {
+	node := root.getNode(ino)
+	if node == nil {
+		return fuseAttr{}, unix.ENOENT
+	}
+	return node.attr, 0
+}
+
+func (root *onDemandRoot) readlink(ino uint64) (string, syscall.Errno) {
+	node := root.getNode(ino)
+	if node == nil || node.attr.mode&unix.S_IFMT != unix.S_IFLNK {
+		return "", unix.EINVAL
+	}
+	return node.symlinkTarget, 0
+}
+
+func (root *onDemandRoot) open(pid uint32, ino uint64) (uint64, syscall.Errno) {
+	node := root.getNode(ino)
+	if node == nil {
+		return 0, unix.ENOENT
+	}
+
+	var fd *os.File
+	var err error
+	switch {
+	case node.serverFileName != "":
+		fd, err = os.Open(node.serverFileName)
+	case strings.HasPrefix(node.key, "f:"):
+		view := root.viewOf(pid)
+		if view == nil {
+			return 0, unix.EACCES
+		}
+		fd, err = view.openFile(node)
+	default: // an empty file a server file is mounted onto
+		return 0, unix.EACCES
+	}
+	if err != nil {
+		return 0, unix.EIO
+	}
+
+	root.mu.Lock()
+	root.lastFh++
+	fh := root.lastFh
+	root.openFiles[fh] = fd
+	root.mu.Unlock()
+	return fh, 0
+}
+
+func (root *onDemandRoot) read(fh uint64, offset int64, buf []byte) (int, syscall.Errno) {
+	root.mu.Lock()
+	fd := root.openFiles[fh]
+	root.mu.Unlock()
+	if fd == nil {
+		return 0, unix.EBADF
+	}
+
+	n, err := fd.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return 0, unix.EIO
+	}
+	return n, 0
+}
+
+func (root *onDemandRoot) release(fh uint64) {
+	root.mu.Lock()
+	if fd := root.openFiles[fh]; fd != nil {
+		_ = fd.Close()
+		delete(root.openFiles, fh)
+	}
+	root.mu.Unlock()
+}
+
+func (root *onDemandRoot) readdir(pid uint32, ino uint64) ([]fuseDirEntry, syscall.Errno) {
+	node := root.getNode(ino)
+	if node == nil || node.attr.mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil, unix.ENOTDIR
+	}
+
+	modes := make(map[string]uint32)
+	for fileName, mode := range root.static {
+		if fileName != "/" && path.Dir(fileName) == node.path {
+			modes[path.Base(fileName)] = mode
+		}
+	}
+	if view := root.viewOf(pid); view != nil {
+		if errno := view.readdir(node.path, modes); errno != 0 {
+			return nil, errno
+		}
+	}
+
+	entries := []fuseDirEntry{
+		{ino: node.ino, name: ".", mode: unix.S_IFDIR},
+		{ino: node.ino, name: "..", mode: unix.S_IFDIR},
+	}
+	for name, mode := range modes {
+		hasher := fnv.New64a()
+		_, _ = hasher.Write([]byte(path.Join(node.path, name)))
+		entries = append(entries, fuseDirEntry{ino: hasher.Sum64() | 1, name: name, mode: mode})
+	}
+	return entries, 0
+}
+
+// sendRequest returns a channel of replies and a channel closed if a stream (the one a request was sent to) ends
+func (root *onDemandRoot) sendRequest(request *pb.OnDemandFileRequest) (chan *pb.OnDemandFileReply, <-chan struct{}, error) {
+	root.streamMu.Lock()
+	defer root.streamMu.Unlock()
+
+	if root.stream == nil {
+		return nil, nil, errOnDemandStreamGone
+	}
+	root.lastRequestID++
+	request.RequestID = root.lastRequestID
+	replies := make(chan *pb.OnDemandFileReply, 16)
+	root.pending[request.RequestID] = replies
+	if err := root.stream.Send(request); err != nil {
+		delete(root.pending, request.RequestID)
+		return nil, nil, err
+	}
+	return replies, root.streamGone, nil
+}
+
+func (root *onDemandRoot) forgetRequest(requestID uint32) {
+	root.streamMu.Lock()
+	delete(root.pending, requestID)
+	root.streamMu.Unlock()
+}
+
+func nextOnDemandReply(replies chan *pb.OnDemandFileReply, streamGone <-chan struct{}) (*pb.OnDemandFileReply, error) {
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-streamGone:
+		return nil, errOnDemandStreamGone
+	case <-time.After(onDemandRequestTimeout):
+		return nil, fmt.Errorf("a client didn't reply in %s", onDemandRequestTimeout)
+	}
+}
+
+// request sends a request and waits for a single reply
+func (root *onDemandRoot) request(request *pb.OnDemandFileRequest) (*pb.OnDemandFileReply, error) {
+	replies, streamGone, err := root.sendRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer root.forgetRequest(request.RequestID)
+	return nextOnDemandReply(replies, streamGone)
+}
+
+// requestBody writes a file body received from a client (in chunks following a reply with a file) to w
+func (root *onDemandRoot) requestBody(fileName string, w io.Writer, fileSize int64) error {
+	request := &pb.OnDemandFileRequest{Path: fileName, FetchBody: true}
+	replies, streamGone, err := root.sendRequest(request)
+	if err != nil {
+		return err
+	}
+	defer root.forgetRequest(request.RequestID)
+
+	reply, err := nextOnDemandReply(replies, streamGone)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	if reply.File.GetFileSize() != fileSize {
+		return fmt.Errorf("%s has changed, size %d instead of %d", fileName, reply.File.GetFileSize(), fileSize)
+	}
+
+	for receivedBytes := int64(0); receivedBytes < fileSize; {
+		chunk, err := nextOnDemandReply(replies, streamGone)
+		if err != nil {
+			return err
+		}
+		if chunk.Error != "" {
+			return errors.New(chunk.Error)
+		}
+		if _, err := w.Write(chunk.ChunkBody); err != nil {
+			return err
+		}
+		receivedBytes += int64(len(chunk.ChunkBody))
+	}
+	return nil
+}
+
+// serveStream receives replies of a client until a stream ends, see NoccServer.OnDemandFilesStream.
+// If a client opens a new stream (after a network error), new requests are sent to it.
+func (root *onDemandRoot) serveStream(stream pb.CompilationService_OnDemandFilesStreamServer) error {
+	streamGone := make(chan struct{})
+	root.streamMu.Lock()
+	root.stream = stream
+	root.streamGone = streamGone
+	root.streamMu.Unlock()
+
+	defer func() {
+		root.streamMu.Lock()
+		if root.stream == stream {
+			root.stream = nil
+		}
+		root.streamMu.Unlock()
+		close(streamGone)
+	}()
+
+	for {
+		reply, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		root.streamMu.Lock()
+		replies := root.pending[reply.RequestID]
+		root.streamMu.Unlock()
+		if replies != nil {
+			select {
+			case replies <- reply:
+			case <-time.After(onDemandRequestTimeout): // a requester has gone
+			}
+		}
+	}
+}
+
+// onDemandView is what one session sees in a root besides static dirs, see OnDemandIncludes
+type onDemandView struct {
+	root     *onDemandRoot
+	dirs     []string                    // served by a client, as OnDemandDirs of a session
+	parents  map[string]bool             // parent dirs of dirs, uploaded files and compilerCwd
+	uploaded map[string]*fileInClientDir // session files by a client file name
+
+	mu       sync.Mutex
+	pids     []int // a compiler and its children, see onDemandRoot.viewOf
+	listings map[string]*onDemandListing
+	hashes   map[string]common.SHA256 // of files opened by a compiler, by a client file name
+	opened   []string                 // files read from a client, sent back for a depfile
+	err      error                    // the first error talking to a client, a session falls back then
+}
+
+// onDemandListing is a dir listed once per session; concurrent lookups wait for the first one to finish
+type onDemandListing struct {
+	done    chan struct{}
+	entries map[string]*pb.OnDemandDirEntry // nil if a dir doesn't exist on a client
+	err     error
+}
+
+// attach is called right after a compiler has started (see launchInOnDemandRoot)
+func (view *onDemandView) attach(pid int) {
+	view.root.mu.Lock()
+	view.root.views[pid] = view
+	view.pids = append(view.pids, pid)
+	view.root.mu.Unlock()
+}
+
+// detach is called after a compiler has exited, its results are in openedFiles() and failure()
+func (view *onDemandView) detach() {
+	view.root.mu.Lock()
+	for _, pid := range view.pids {
+		if view.root.views[pid] == view {
+			delete(view.root.views, pid)
+		}
+	}
+	view.root.mu.Unlock()
+}
+
+func (view *onDemandView) openedFiles() []string {
+	view.mu.Lock()
+	defer view.mu.Unlock()
+	return slices.Clone(view.opened)
+}
+
+func (view *onDemandView) failure() error {
+	view.mu.Lock()
+	defer view.mu.Unlock()
+	return view.err
+}
+
+func (view *onDemandView) fail(err error) {
+	view.mu.Lock()
+	if view.err == nil {
+		view.err = err
+	}
+	view.mu.Unlock()
+}
+
+func (view *onDemandView) isServed(fileName string) bool {
+	for _, dir := range view.dirs {
+		if fileName == dir || strings.HasPrefix(fileName, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (view *onDemandView) lookup(fileName string) (*onDemandNode, syscall.Errno) {
+	if file := view.uploaded[fileName]; file != nil {
+		return &onDemandNode{
+			key:            "u:" + fileName + ":" + file.fileSHA256.ToLongHexString(),
+			path:           fileName,
+			attr:           fuseAttr{size: file.fileSize, mode: unix.S_IFREG | 0444},
+			serverFileName: file.serverFileName,
+		}, 0
+	}
+
+	if slices.Contains(view.dirs, fileName) {
+		return &onDemandNode{key: "d:" + fileName, path: fileName, attr: fuseAttr{mode: unix.S_IFDIR | 0555}}, 0
+	}
+	if view.isServed(fileName) {
+		entries, errno := view.listDir(path.Dir(fileName))
+		if errno != 0 {
+			return nil, errno
+		}
+		if entry := entries[path.Base(fileName)]; entry != nil {
+			return makeOnDemandNode(fileName, entry), 0
+		}
+	}
+	if view.parents[fileName] {
+		return &onDemandNode{key: "d:" + fileName, path: fileName, attr: fuseAttr{mode: unix.S_IFDIR | 0555}}, 0
+	}
+	return nil, unix.ENOENT
+}
+
+func makeOnDemandNode(fileName string, entry *pb.OnDemandDirEntry) *onDemandNode {
+	switch {
+	case entry.IsSymlink:
+		return &onDemandNode{
+			key:           "l:" + fileName + ":" + entry.SymlinkTarget,
+			path:          fileName,
+			attr:          fuseAttr{size: int64(len(entry.SymlinkTarget)), mode: unix.S_IFLNK | 0777},
+			symlinkTarget: entry.SymlinkTarget,
+		}
+	case entry.IsDir:
+		return &onDemandNode{key: "d:" + fileName, path: fileName, attr: fuseAttr{mode: unix.S_IFDIR | 0555}}
+	default:
+		return &onDemandNode{
+			key:  fmt.Sprintf("f:%s:%d:%d", fileName, entry.FileSize, entry.ModTime),
+			path: fileName,
+			attr: fuseAttr{size: entry.FileSize, mtime: entry.ModTime, mode: unix.S_IFREG | 0444},
+		}
+	}
+}
+
+// readdir adds entries of dir visible in a session to modes
+func (view *onDemandView) readdir(dir string, modes map[string]uint32) syscall.Errno {
+	for fileName := range view.uploaded {
+		if path.Dir(fileName) == dir {
+			modes[path.Base(fileName)] = unix.S_IFREG | 0444
+		}
+	}
+	for fileName := range view.parents {
+		if path.Dir(fileName) == dir {
+			modes[path.Base(fileName)] = unix.S_IFDIR | 0555
+		}
+	}
+	for _, fileName := range view.dirs {
+		if path.Dir(fileName) == dir {
+			modes[path.Base(fileName)] = unix.S_IFDIR | 0555
+		}
+	}
+	if view.isServed(dir) {
+		entries, errno := view.listDir(dir)
+		if errno != 0 {
+			return errno
+		}
+		for name, entry := range entries {
+			modes[name] = makeOnDemandNode(path.Join(dir, name), entry).attr.mode
+		}
+	}
+	return 0
+}
+
+// listDir requests a client for dir entries once per session
+func (view *onDemandView) listDir(dir string) (map[string]*pb.OnDemandDirEntry, syscall.Errno) {
+	view.mu.Lock()
+	listing := view.listings[dir]
+	if listing == nil {
+		listing = &onDemandListing{done: make(chan struct{})}
+		view.listings[dir] = listing
+		view.mu.Unlock()
+
+		reply, err := view.root.request(&pb.OnDemandFileRequest{Path: dir, ListDir: true})
+		if err != nil {
+			listing.err = err
+			view.fail(err)
+		} else if reply.Error == "" { // otherwise, it doesn't exist on a client
+			listing.entries = make(map[string]*pb.OnDemandDirEntry, len(reply.Entries))
+			for _, entry := range reply.Entries {
+				listing.entries[entry.Name] = entry
+			}
+		}
+		close(listing.done)
+	} else {
+		view.mu.Unlock()
+		<-listing.done
+	}
+
+	if listing.err != nil {
+		return nil, unix.EIO
+	}
+	return listing.entries, 0
+}
+
+// openFile opens a file served by a client: from src cache if a client has the same, or fetching it
+func (view *onDemandView) openFile(node *onDemandNode) (*os.File, error) {
+	view.mu.Lock()
+	key, known := view.hashes[node.path]
+	view.mu.Unlock()
+
+	if !known {
+		reply, err := view.root.request(&pb.OnDemandFileRequest{Path: node.path})
+		if err == nil && reply.Error != "" {
+			err = errors.New(reply.Error)
+		}
+		if err == nil && reply.File.GetFileSize() != node.attr.size {
+			err = fmt.Errorf("%s has changed, size %d instead of %d", node.path, reply.File.GetFileSize(), node.attr.size)
+		}
+		if err != nil {
+			view.fail(err)
+			return nil, err
+		}
+		key = common.SHA256{B0_7: reply.File.SHA256_B0_7, B8_15: reply.File.SHA256_B8_15, B16_23: reply.File.SHA256_B16_23, B24_31: reply.File.SHA256_B24_31}
+
+		view.mu.Lock()
+		if _, known = view.hashes[node.path]; !known {
+			view.hashes[node.path] = key
+			view.opened = append(view.opened, node.path)
+		}
+		view.mu.Unlock()
+	}
+
+	if fd := view.root.includes.openFromSrcCache(key); fd != nil {
+		return fd, nil
+	}
+	fd, err := view.root.includes.fetchFile(view.root, node.path, key, node.attr.size)
+	if err != nil {
+		view.fail(err)
+	}
+	return fd, err
+}
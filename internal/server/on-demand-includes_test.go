@@ -0,0 +1,560 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+
+	"golang.org/x/sys/unix"
+)
+
+// testOnDemandClient is a client end of a stream: it serves files of a map, like client.OnDemandIncludes serves files of a disk
+type testOnDemandClient struct {
+	pb.CompilationService_OnDemandFilesStreamServer // not used, to implement grpc.ServerStream
+
+	chunkSize int
+	replies   chan *pb.OnDemandFileReply
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	files     map[string]string // a dir is a key with a trailing slash, its entries are files with it as a prefix
+	changed   map[string]string // a body sent instead of files[path], as if a file changed after being stat'ed
+	requests  []*pb.OnDemandFileRequest
+	bodyGate  chan struct{} // if set, bodies are sent after it's closed
+	nDropping int           // so many next requests are never replied
+}
+
+func (client *testOnDemandClient) Send(request *pb.OnDemandFileRequest) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.requests = append(client.requests, request)
+	if client.nDropping > 0 {
+		client.nDropping--
+		return nil
+	}
+
+	reply := func(reply *pb.OnDemandFileReply) {
+		reply.RequestID = request.RequestID
+		client.replies <- reply
+	}
+	switch {
+	case request.ListDir:
+		if _, exists := client.files[request.Path+"/"]; !exists {
+			reply(&pb.OnDemandFileReply{Error: request.Path + " doesn't exist"})
+			break
+		}
+		var entries []*pb.OnDemandDirEntry
+		for fileName, body := range client.files {
+			name := strings.TrimSuffix(strings.TrimPrefix(fileName, request.Path+"/"), "/")
+			if name == fileName || name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			entry := &pb.OnDemandDirEntry{Name: name, IsDir: strings.HasSuffix(fileName, "/"), FileSize: int64(len(body)), ModTime: 100}
+			if target, isSymlink := strings.CutPrefix(body, "-> "); isSymlink {
+				entry.IsSymlink, entry.SymlinkTarget = true, target
+			}
+			entries = append(entries, entry)
+		}
+		reply(&pb.OnDemandFileReply{Entries: entries})
+
+	case !request.FetchBody:
+		body, exists := client.files[request.Path]
+		if !exists {
+			reply(&pb.OnDemandFileReply{Error: request.Path + " doesn't exist"})
+			break
+		}
+		hasher := sha256.New()
+		hasher.Write([]byte(body))
+		key := common.MakeSHA256Struct(hasher)
+		reply(&pb.OnDemandFileReply{File: &pb.FileMetadata{FileName: request.Path, FileSize: int64(len(body)),
+			SHA256_B0_7: key.B0_7, SHA256_B8_15: key.B8_15, SHA256_B16_23: key.B16_23, SHA256_B24_31: key.B24_31}})
+
+	default:
+		body, exists := client.changed[request.Path]
+		if !exists {
+			body = client.files[request.Path]
+		}
+		gate := client.bodyGate
+		go func() {
+			if gate != nil {
+				<-gate
+			}
+			reply(&pb.OnDemandFileReply{File: &pb.FileMetadata{FileName: request.Path, FileSize: int64(len(body))}})
+			for offset := 0; offset < len(body); offset += client.chunkSize {
+				reply(&pb.OnDemandFileReply{ChunkBody: []byte(body[offset:min(offset+client.chunkSize, len(body))])})
+			}
+		}()
+	}
+	return nil
+}
+
+func (client *testOnDemandClient) Recv() (*pb.OnDemandFileReply, error) {
+	reply, ok := <-client.replies
+	if !ok {
+		return nil, io.EOF
+	}
+	return reply, nil
+}
+
+// closeStream ends a stream, as if a client has disconnected
+func (client *testOnDemandClient) closeStream() {
+	client.closeOnce.Do(func() { close(client.replies) })
+}
+
+// countRequests counts requests for a path, listings or bodies
+func (client *testOnDemandClient) countRequests(fileName string, listDir bool, fetchBody bool) int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	count := 0
+	for _, request := range client.requests {
+		if request.Path == fileName && request.ListDir == listDir && request.FetchBody == fetchBody {
+			count++
+		}
+	}
+	return count
+}
+
+// makeTestOnDemandRoot makes a root that isn't mounted, its FUSE methods are called directly;
+// a stream of a client is served until a test ends
+func makeTestOnDemandRoot(t *testing.T, client *testOnDemandClient) *onDemandRoot {
+	srcFileCache, err := MakeSrcFileCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	includes := &OnDemandIncludes{mountsDir: t.TempDir(), srcFileCache: srcFileCache, fetches: make(map[common.SHA256]chan struct{})}
+	root := &onDemandRoot{
+		includes:   includes,
+		static:     map[string]uint32{"/": unix.S_IFDIR | 0555, "/usr": unix.S_IFDIR | 0555, "/usr/bin": unix.S_IFDIR | 0555},
+		nodes:      make(map[uint64]*onDemandNode),
+		nodesByKey: make(map[string]*onDemandNode),
+		lastIno:    fuseRootIno,
+		views:      make(map[int]*onDemandView),
+		openFiles:  make(map[uint64]*os.File),
+		pending:    make(map[uint32]chan *pb.OnDemandFileReply),
+	}
+	rootNode := &onDemandNode{ino: fuseRootIno, key: "d:/", path: "/", attr: fuseAttr{ino: fuseRootIno, mode: unix.S_IFDIR | 0555}}
+	root.nodes[fuseRootIno] = rootNode
+	root.nodesByKey[rootNode.key] = rootNode
+
+	if client.chunkSize == 0 {
+		client.chunkSize = 4
+	}
+	client.replies = make(chan *pb.OnDemandFileReply, 1024)
+	served := make(chan struct{})
+	go func() {
+		_ = root.serveStream(client)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		client.closeStream()
+		<-served
+		root.mu.Lock()
+		for _, fd := range root.openFiles {
+			_ = fd.Close()
+		}
+		root.mu.Unlock()
+	})
+
+	for root.waitingForStream() {
+		time.Sleep(time.Millisecond)
+	}
+	return root
+}
+
+func (root *onDemandRoot) waitingForStream() bool {
+	root.streamMu.Lock()
+	defer root.streamMu.Unlock()
+	return root.stream == nil
+}
+
+// makeTestOnDemandView makes a view of a session compiling /src/1.cpp in /src/build with -I /src/include
+func makeTestOnDemandView(t *testing.T, root *onDemandRoot) *onDemandView {
+	client := &Client{workingDir: t.TempDir()}
+	session := &Session{
+		compilerCwd:  "/src/build",
+		onDemandDirs: []string{"/src/include", "/", "relative"},
+		files:        []*fileInClientDir{{fileSize: 10, serverFileName: client.workingDir + "/src/1.cpp"}},
+	}
+	return root.makeView(client, session)
+}
+
+func makeTestOnDemandClient() *testOnDemandClient {
+	return &testOnDemandClient{
+		files: map[string]string{
+			"/src/include/":         "",
+			"/src/include/a.h":      "#pragma once\nint a();\n",
+			"/src/include/b.h":      "#include \"a.h\"\n",
+			"/src/include/link.h":   "-> a.h",
+			"/src/include/sub/":     "",
+			"/src/include/sub/c.h":  "int c;\n",
+			"/src/other/":           "",
+			"/src/other/not-sent.h": "",
+		},
+	}
+}
+
+func TestOnDemandViewLookup(t *testing.T) {
+	client := makeTestOnDemandClient()
+	root := makeTestOnDemandRoot(t, client)
+	view := makeTestOnDemandView(t, root)
+
+	tests := []struct {
+		fileName   string
+		wantErrno  syscall.Errno
+		wantMode   uint32
+		wantSize   int64
+		wantTarget string
+	}{
+		{fileName: "/src/1.cpp", wantMode: unix.S_IFREG | 0444, wantSize: 10}, // uploaded
+		{fileName: "/src", wantMode: unix.S_IFDIR | 0555},                     // a parent of a dir and of an uploaded file
+		{fileName: "/src/build", wantMode: unix.S_IFDIR | 0555},               // a cwd
+		{fileName: "/src/include", wantMode: unix.S_IFDIR | 0555},
+		{fileName: "/src/include/a.h", wantMode: unix.S_IFREG | 0444, wantSize: 22},
+		{fileName: "/src/include/link.h", wantMode: unix.S_IFLNK | 0777, wantSize: 3, wantTarget: "a.h"},
+		{fileName: "/src/include/sub", wantMode: unix.S_IFDIR | 0555},
+		{fileName: "/src/include/sub/c.h", wantMode: unix.S_IFREG | 0444, wantSize: 7},
+		{fileName: "/src/include/missing.h", wantErrno: unix.ENOENT},
+		{fileName: "/src/include/sub/missing/d.h", wantErrno: unix.ENOENT}, // a missing dir is listed, not its child
+		{fileName: "/src/other/not-sent.h", wantErrno: unix.ENOENT},        // not in dirs of a session
+		{fileName: "/etc/passwd", wantErrno: unix.ENOENT},                  // "/" isn't served
+		{fileName: "/relative", wantErrno: unix.ENOENT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fileName, func(t *testing.T) {
+			node, errno := view.lookup(tt.fileName)
+			if errno != tt.wantErrno {
+				t.Fatalf("errno %v, expected %v", errno, tt.wantErrno)
+			}
+			if errno != 0 {
+				return
+			}
+			if node.path != tt.fileName || node.attr.mode != tt.wantMode || node.attr.size != tt.wantSize || node.symlinkTarget != tt.wantTarget {
+				t.Errorf("unexpected node %+v", node)
+			}
+		})
+	}
+
+	if node, _ := view.lookup("/src/1.cpp"); node.serverFileName == "" {
+		t.Error("an uploaded file isn't read from a working dir")
+	}
+	for _, dir := range []string{"/src/include", "/src/include/sub", "/src/include/sub/missing"} {
+		if n := client.countRequests(dir, true, false); n != 1 {
+			t.Errorf("%s is listed %d times", dir, n)
+		}
+	}
+	if view.failure() != nil {
+		t.Errorf("a missing file fails a session: %v", view.failure())
+	}
+}
+
+func TestOnDemandReaddir(t *testing.T) {
+	root := makeTestOnDemandRoot(t, makeTestOnDemandClient())
+	view := makeTestOnDemandView(t, root)
+	view.attach(1000001)
+
+	tests := []struct {
+		dir       string
+		pid       uint32
+		wantNames []string
+	}{
+		{"/", 1000001, []string{"src", "usr"}},
+		{"/", 0, []string{"usr"}}, // not a compiler
+		{"/src", 1000001, []string{"1.cpp", "build", "include"}},
+		{"/src/include", 1000001, []string{"a.h", "b.h", "link.h", "sub"}},
+		{"/usr", 1000001, []string{"bin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			attr, errno := lookupOnDemandPath(root, tt.pid, tt.dir)
+			if errno != 0 {
+				t.Fatal(errno)
+			}
+			entries, errno := root.readdir(tt.pid, attr.ino)
+			if errno != 0 {
+				t.Fatal(errno)
+			}
+			var names []string
+			for _, entry := range entries[2:] {
+				names = append(names, entry.name)
+			}
+			slices.Sort(names)
+			if entries[0].name != "." || entries[1].name != ".." || !slices.Equal(names, tt.wantNames) {
+				t.Errorf("unexpected entries %v", entries)
+			}
+		})
+	}
+}
+
+// lookupOnDemandPath looks up every component of an abs fileName, like the kernel does
+func lookupOnDemandPath(root *onDemandRoot, pid uint32, fileName string) (fuseAttr, syscall.Errno) {
+	attr, errno := root.getattr(fuseRootIno)
+	for _, name := range strings.Split(fileName, "/") {
+		if name != "" && errno == 0 {
+			attr, errno = root.lookup(pid, attr.ino, name)
+		}
+	}
+	return attr, errno
+}
+
+func TestOnDemandNodes(t *testing.T) {
+	root := makeTestOnDemandRoot(t, makeTestOnDemandClient())
+	view := makeTestOnDemandView(t, root)
+	view.attach(1000001)
+
+	usr, _ := root.lookup(1000001, fuseRootIno, "usr")
+	if again, _ := root.lookup(0, fuseRootIno, "usr"); again.ino != usr.ino {
+		t.Errorf("a static dir has inodes %d and %d", usr.ino, again.ino)
+	}
+	if _, errno := root.lookup(0, fuseRootIno, "src"); errno != unix.ENOENT {
+		t.Errorf("a dir of a session is seen by not a compiler: %v", errno)
+	}
+
+	include, _ := lookupOnDemandPath(root, 1000001, "/src/include")
+	link, _ := lookupOnDemandPath(root, 1000001, "/src/include/link.h")
+	if target, errno := root.readlink(link.ino); target != "a.h" || errno != 0 {
+		t.Errorf("unexpected target %q: %v", target, errno)
+	}
+	if _, errno := root.readlink(include.ino); errno != unix.EINVAL {
+		t.Errorf("a dir is read as a symlink: %v", errno)
+	}
+
+	root.forget(usr.ino, 1)
+	if _, errno := root.getattr(usr.ino); errno != 0 {
+		t.Errorf("an inode looked up twice is forgotten once: %v", errno)
+	}
+	root.forget(usr.ino, 1)
+	if _, errno := root.getattr(usr.ino); errno != unix.ENOENT {
+		t.Errorf("a forgotten inode exists: %v", errno)
+	}
+	if again, _ := root.lookup(0, fuseRootIno, "usr"); again.ino == usr.ino {
+		t.Errorf("an inode %d is reused", usr.ino)
+	}
+	root.forget(fuseRootIno, 100)
+	if _, errno := root.getattr(fuseRootIno); errno != 0 {
+		t.Errorf("a root is forgotten: %v", errno)
+	}
+}
+
+// TestOnDemandViewOfChild checks that a child of a compiler (like cc1plus) sees what a compiler sees
+func TestOnDemandViewOfChild(t *testing.T) {
+	root := makeTestOnDemandRoot(t, makeTestOnDemandClient())
+	view := makeTestOnDemandView(t, root)
+
+	child := exec.Command("sleep", "10")
+	if err := child.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		_ = child.Process.Kill()
+		_ = child.Wait()
+	}()
+
+	view.attach(os.Getpid()) // as if this test were a compiler
+	if root.viewOf(uint32(os.Getpid())) != nil {
+		t.Error("requests of a server itself are of a session")
+	}
+	if root.viewOf(uint32(child.Process.Pid)) != view {
+		t.Fatal("a child doesn't see a view of its parent")
+	}
+	if !slices.Contains(view.pids, child.Process.Pid) {
+		t.Errorf("a child isn't remembered: %v", view.pids)
+	}
+
+	view.detach()
+	if len(root.views) != 0 {
+		t.Errorf("pids are left after detaching: %v", root.views)
+	}
+}
+
+func readOnDemandFile(view *onDemandView, fileName string) (string, error) {
+	node, errno := view.lookup(fileName)
+	if errno != 0 {
+		return "", errno
+	}
+	fd, err := view.openFile(node)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	body, err := io.ReadAll(fd)
+	return string(body), err
+}
+
+func TestOnDemandFetch(t *testing.T) {
+	client := makeTestOnDemandClient()
+	root := makeTestOnDemandRoot(t, client)
+	view := makeTestOnDemandView(t, root)
+
+	for i := 0; i < 2; i++ {
+		if body, err := readOnDemandFile(view, "/src/include/a.h"); err != nil || body != client.files["/src/include/a.h"] {
+			t.Fatalf("unexpected body %q: %v", body, err)
+		}
+	}
+	if n := client.countRequests("/src/include/a.h", false, false); n != 1 {
+		t.Errorf("sha256 is requested %d times in a session", n)
+	}
+	if n := client.countRequests("/src/include/a.h", false, true); n != 1 {
+		t.Errorf("a body is fetched %d times", n)
+	}
+	if root.includes.srcFileCache.GetFilesCount() != 1 {
+		t.Error("a fetched file isn't saved to src cache")
+	}
+
+	// another session (maybe of another client) takes it from src cache by sha256
+	anotherView := makeTestOnDemandView(t, root)
+	if body, err := readOnDemandFile(anotherView, "/src/include/a.h"); err != nil || body != client.files["/src/include/a.h"] {
+		t.Fatalf("unexpected body %q: %v", body, err)
+	}
+	if n := client.countRequests("/src/include/a.h", false, true); n != 1 {
+		t.Errorf("a body in src cache is fetched again: %d times", n)
+	}
+	if n := client.countRequests("/src/include/a.h", false, false); n != 2 {
+		t.Errorf("sha256 is requested %d times in two sessions", n)
+	}
+
+	// an empty file is read, too
+	client.files["/src/include/empty.h"] = ""
+	anotherView = makeTestOnDemandView(t, root)
+	if body, err := readOnDemandFile(anotherView, "/src/include/empty.h"); err != nil || body != "" {
+		t.Fatalf("unexpected body %q: %v", body, err)
+	}
+
+	if opened := view.openedFiles(); !slices.Equal(opened, []string{"/src/include/a.h"}) {
+		t.Errorf("unexpected opened files %q", opened)
+	}
+	if view.failure() != nil || anotherView.failure() != nil {
+		t.Errorf("a session has failed: %v %v", view.failure(), anotherView.failure())
+	}
+}
+
+// TestOnDemandFetchChanged checks that a file changed on a client while a compiler reads it fails a session,
+// and a wrong body is not saved to src cache
+func TestOnDemandFetchChanged(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(client *testOnDemandClient)
+		wantText string
+	}{
+		{"size after listing", func(client *testOnDemandClient) { client.files["/src/include/a.h"] += "int b();\n" }, "has changed"},
+		{"size after sha256", func(client *testOnDemandClient) { client.changed["/src/include/a.h"] = "int a();\n" }, "has changed"},
+		{"body after sha256", func(client *testOnDemandClient) { client.changed["/src/include/a.h"] = "#pragma once\nint A();\n" }, "sha256 mismatch"},
+		{"removed", func(client *testOnDemandClient) { delete(client.files, "/src/include/a.h") }, "doesn't exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := makeTestOnDemandClient()
+			client.changed = make(map[string]string)
+			root := makeTestOnDemandRoot(t, client)
+			view := makeTestOnDemandView(t, root)
+
+			node, _ := view.lookup("/src/include/a.h")
+			client.mu.Lock()
+			tt.change(client)
+			client.mu.Unlock()
+			if _, err := view.openFile(node); err == nil || !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if err := view.failure(); err == nil || !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("unexpected failure %v", err)
+			}
+			if root.includes.srcFileCache.GetFilesCount() != 0 {
+				t.Error("a changed file is saved to src cache")
+			}
+		})
+	}
+}
+
+// TestOnDemandFetchOnce checks that compilers opening a file concurrently (of any session) wait for one fetch
+func TestOnDemandFetchOnce(t *testing.T) {
+	client := makeTestOnDemandClient()
+	client.bodyGate = make(chan struct{})
+	root := makeTestOnDemandRoot(t, client)
+
+	const nCompilers = 8
+	var wg sync.WaitGroup
+	bodies := make([]string, nCompilers)
+	errs := make([]error, nCompilers)
+	for i := 0; i < nCompilers; i++ {
+		view := makeTestOnDemandView(t, root)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies[i], errs[i] = readOnDemandFile(view, "/src/include/b.h")
+		}()
+	}
+
+	for client.countRequests("/src/include/b.h", false, true) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // others are waiting for it
+	close(client.bodyGate)
+	wg.Wait()
+
+	for i := 0; i < nCompilers; i++ {
+		if errs[i] != nil || bodies[i] != client.files["/src/include/b.h"] {
+			t.Errorf("unexpected body %q: %v", bodies[i], errs[i])
+		}
+	}
+	if n := client.countRequests("/src/include/b.h", false, true); n != 1 {
+		t.Errorf("a body is fetched %d times", n)
+	}
+	if len(root.includes.fetches) != 0 {
+		t.Errorf("fetches are left: %v", root.includes.fetches)
+	}
+}
+
+// TestOnDemandStreamGone checks that compilers waiting for a client don't wait for a timeout if its stream ends
+func TestOnDemandStreamGone(t *testing.T) {
+	client := makeTestOnDemandClient()
+	client.nDropping = 1
+	root := makeTestOnDemandRoot(t, client)
+	view := makeTestOnDemandView(t, root)
+
+	listed := make(chan syscall.Errno)
+	go func() {
+		_, errno := view.lookup("/src/include/a.h")
+		listed <- errno
+	}()
+	for client.countRequests("/src/include", true, false) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client.closeStream()
+
+	select {
+	case errno := <-listed:
+		if errno != unix.EIO {
+			t.Errorf("unexpected errno %v", errno)
+		}
+	case <-time.After(onDemandRequestTimeout / 2):
+		t.Fatal("a lookup waits for a timeout")
+	}
+	if err := view.failure(); !errors.Is(err, errOnDemandStreamGone) {
+		t.Errorf("unexpected failure %v", err)
+	}
+	for !root.waitingForStream() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// no stream, requests fail at once
+	anotherView := makeTestOnDemandView(t, root)
+	if _, errno := anotherView.lookup("/src/include/a.h"); errno != unix.EIO || !errors.Is(anotherView.failure(), errOnDemandStreamGone) {
+		t.Errorf("unexpected errno %v, failure %v", errno, anotherView.failure())
+	}
+	if _, err := root.includes.fetchFile(root, "/src/include/a.h", common.SHA256{B0_7: 1}, 22); !errors.Is(err, errOnDemandStreamGone) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if entries, _ := os.ReadDir(root.includes.mountsDir); len(entries) != 0 {
+		t.Errorf("tmp files are left: %v", entries)
+	}
+}
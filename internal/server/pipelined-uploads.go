@@ -0,0 +1,283 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// PipelinedUploads lets a compiler start before all files of a session are uploaded, PipelinedUploadsMinBytes in config.
+// For a large TU, uploading takes a while, and a compiler could already be parsing the first includes meanwhile.
+// Every file requested to upload by such a session is created as an empty placeholder "gated" with fanotify:
+// open() of it by a compiler blocks (FAN_OPEN_PERM) until a file is uploaded, its contents are written into a placeholder
+// (not renamed over it: a compiler opens the same inode), and then open() is allowed.
+// A compiler waiting for uploads occupies a CompilerLauncher slot, that's why it's only for sessions uploading much.
+// It requires CAP_SYS_ADMIN. It's nil if PipelinedUploadsMinBytes is 0.
+type PipelinedUploads struct {
+	MinBytes int64
+
+	fanotifyFd int
+
+	mu     sync.Mutex
+	gates  map[gateKey]*uploadGate // by an inode of a placeholder, events of fanotify come with an fd
+	byName map[string]*uploadGate  // by serverFileName
+}
+
+type gateKey struct {
+	dev uint64
+	ino uint64
+}
+
+type uploadGate struct {
+	key            gateKey
+	serverFileName string
+	pendingFds     []int32 // permission events of compilers opening a placeholder, answered on release
+	released       bool
+	allowed        bool      // after release: a file was uploaded, otherwise opening fails
+	since          time.Time // when gated or released
+}
+
+// staleGateTimeout: a placeholder still not uploaded is removed (a client has gone), and compilers opening it fail
+const staleGateTimeout = 10 * time.Minute
+
+func MakePipelinedUploads(minBytes int64) (*PipelinedUploads, error) {
+	if minBytes <= 0 {
+		return nil, nil
+	}
+
+	fanotifyFd, err := unix.FanotifyInit(unix.FAN_CLASS_CONTENT|unix.FAN_CLOEXEC|unix.FAN_UNLIMITED_QUEUE, unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("fanotify_init: %v (CAP_SYS_ADMIN is required)", err)
+	}
+
+	p := &PipelinedUploads{
+		MinBytes:   minBytes,
+		fanotifyFd: fanotifyFd,
+		gates:      make(map[gateKey]*uploadGate),
+		byName:     make(map[string]*uploadGate),
+	}
+	go p.serveOpenEvents()
+	return p, nil
+}
+
+// ShouldPipeline tells whether a session uploads enough to start a compiler before uploads finish
+func (p *PipelinedUploads) ShouldPipeline(session *Session, fileIndexesToUpload []uint32) bool {
+	if p == nil {
+		return false
+	}
+
+	bytesToUpload := int64(0)
+	for _, index := range fileIndexesToUpload {
+		bytesToUpload += session.files[index].fileSize
+	}
+	return bytesToUpload >= p.MinBytes
+}
+
+// Gate creates a placeholder for a file requested to upload; after it, a session doesn't wait for this file to start compiling.
+// If a placeholder can't be created (e.g. a file already exists), a file is not gated, and a session waits for it as usual.
+func (p *PipelinedUploads) Gate(file *fileInClientDir) {
+	if file.gated.Load() || file.isSymlink {
+		return
+	}
+
+	fd, err := os.OpenFile(file.serverFileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return
+	}
+	var stat unix.Stat_t
+	err = unix.Fstat(int(fd.Fd()), &stat)
+	_ = fd.Close()
+	if err == nil {
+		err = unix.FanotifyMark(p.fanotifyFd, unix.FAN_MARK_ADD, unix.FAN_OPEN_PERM, unix.AT_FDCWD, file.serverFileName)
+	}
+	if err != nil {
+		logServer.Error("can't gate", file.serverFileName, err)
+		_ = os.Remove(file.serverFileName)
+		return
+	}
+
+	gate := &uploadGate{
+		key:            gateKey{uint64(stat.Dev), uint64(stat.Ino)},
+		serverFileName: file.serverFileName,
+		since:          time.Now(),
+	}
+	p.mu.Lock()
+	p.gates[gate.key] = gate
+	p.byName[gate.serverFileName] = gate
+	p.mu.Unlock()
+	file.gated.Store(true)
+}
+
+// IsGated tells whether a received file must be written into a placeholder, see placeUploadedFile
+func (p *PipelinedUploads) IsGated(serverFileName string) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	gate := p.byName[serverFileName]
+	return gate != nil && !gate.released
+}
+
+// Release is called after a gated file was uploaded: compilers waiting for it continue.
+// With uploaded=false, a placeholder is removed, and compilers fail to open it. It's for a placeholder left
+// by a previous launch of a client (it's a new file for a client now, it would be hard linked from src cache).
+// After an upload error, a file isn't released: a client uploads it again.
+func (p *PipelinedUploads) Release(file *fileInClientDir, uploaded bool) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	gate := p.byName[file.serverFileName]
+	if gate == nil || gate.released {
+		p.mu.Unlock()
+		return
+	}
+	pendingFds := p.releaseGate(gate, uploaded)
+	p.mu.Unlock()
+
+	file.gated.Store(false)
+	p.respondToPending(gate, pendingFds, uploaded)
+}
+
+// DeleteStaleGates is called by Cron: it forgets released gates and releases ones not uploaded for too long
+func (p *PipelinedUploads) DeleteStaleGates() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	stale := make(map[*uploadGate][]int32)
+	for key, gate := range p.gates {
+		if gate.released && time.Since(gate.since) > time.Minute {
+			delete(p.gates, key)
+			if p.byName[gate.serverFileName] == gate {
+				delete(p.byName, gate.serverFileName)
+			}
+		} else if !gate.released && time.Since(gate.since) > staleGateTimeout {
+			stale[gate] = p.releaseGate(gate, false)
+		}
+	}
+	p.mu.Unlock()
+
+	for gate, pendingFds := range stale {
+		logServer.Error("placeholder was not uploaded", gate.serverFileName)
+		p.respondToPending(gate, pendingFds, false)
+	}
+}
+
+// releaseGate is called under p.mu; pending events are answered after unlocking, see respondToPending
+func (p *PipelinedUploads) releaseGate(gate *uploadGate, uploaded bool) []int32 {
+	pendingFds := gate.pendingFds
+	gate.pendingFds = nil
+	gate.released = true
+	gate.allowed = uploaded
+	gate.since = time.Now()
+	return pendingFds
+}
+
+func (p *PipelinedUploads) respondToPending(gate *uploadGate, pendingFds []int32, uploaded bool) {
+	_ = unix.FanotifyMark(p.fanotifyFd, unix.FAN_MARK_REMOVE, unix.FAN_OPEN_PERM, unix.AT_FDCWD, gate.serverFileName)
+	if !uploaded {
+		_ = os.Remove(gate.serverFileName)
+	}
+	for _, fd := range pendingFds {
+		p.respond(fd, uploaded)
+	}
+}
+
+// serveOpenEvents reads permission events of opening gated placeholders until a server stops
+func (p *PipelinedUploads) serveOpenEvents() {
+	const metadataSize = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	buf := make([]byte, 64*metadataSize)
+	for {
+		n, err := unix.Read(p.fanotifyFd, buf)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			logServer.Error("fanotify read failed, pipelined uploads stop working", err)
+			return
+		}
+
+		for offset := 0; offset+metadataSize <= n; {
+			event := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if event.Event_len < uint32(metadataSize) || event.Vers != unix.FANOTIFY_METADATA_VERSION {
+				break
+			}
+			offset += int(event.Event_len)
+			if event.Fd >= 0 {
+				p.onOpenEvent(event.Fd, event.Pid)
+			}
+		}
+	}
+}
+
+// onOpenEvent allows opening a file if it's not gated (or already uploaded), otherwise an answer waits for Release
+func (p *PipelinedUploads) onOpenEvent(fd int32, pid int32) {
+	// a server itself writes into a placeholder, see placeUploadedFile
+	if int(pid) == os.Getpid() {
+		p.respond(fd, true)
+		return
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(fd), &stat); err != nil {
+		p.respond(fd, true)
+		return
+	}
+
+	p.mu.Lock()
+	gate := p.gates[gateKey{uint64(stat.Dev), uint64(stat.Ino)}]
+	if gate != nil && !gate.released {
+		gate.pendingFds = append(gate.pendingFds, fd)
+		p.mu.Unlock()
+		return
+	}
+	allowed := gate == nil || gate.allowed
+	p.mu.Unlock()
+
+	p.respond(fd, allowed)
+}
+
+func (p *PipelinedUploads) respond(fd int32, allowed bool) {
+	response := unix.FanotifyResponse{Fd: fd, Response: unix.FAN_ALLOW}
+	if !allowed {
+		response.Response = unix.FAN_DENY
+	}
+	_, _ = unix.Write(p.fanotifyFd, (*[unsafe.Sizeof(response)]byte)(unsafe.Pointer(&response))[:])
+	_ = unix.Close(int(fd))
+}
+
+// placeUploadedFile renames a received tmp file to serverFileName.
+// If it's gated (a compiler may have already opened a placeholder), contents are written into a placeholder instead.
+func placeUploadedFile(noccServer *NoccServer, tmpFileName string, serverFileName string) error {
+	if !noccServer.PipelinedUploads.IsGated(serverFileName) {
+		return os.Rename(tmpFileName, serverFileName)
+	}
+
+	src, err := os.Open(tmpFileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(serverFileName, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_ = os.Remove(tmpFileName)
+	}
+	return err
+}
@@ -1,14 +1,22 @@
 package server
 
 import (
+	"context"
+	"debug/elf"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"nocc/internal/common"
 	"nocc/pb"
+
+	"google.golang.org/grpc/metadata"
 )
 
 // Session is created when a client requests to compile a .cpp file.
@@ -21,38 +29,92 @@ import (
 // 5) the session is closed automatically
 // Steps 2-5 can be skipped if a compiled .o already exists in ObjFileCache.
 type Session struct {
-	sessionID uint32
+	sessionID  uint32
+	createTime time.Time // for a dashboard
+	userName   string    // a user on a client machine who launched `nocc`, empty if unknown (an old client)
 
 	InputFile    string // as-is from a client cmd line (relative to compilerCwd on a server-side)
 	OutputFile   string // inside ${ObjCacheDir}/compiler-out, or directly in ${ObjCacheDir}/obj-cache if taken from cache
 	compilerName string   // g++ / clang / etc.
 	compilerArgs []string // all args for the compiler, including -I/-isystem/-L
+	includeDirs  []string // -I/-isystem/etc. from compilerArgs, see Client.MkdirAllIncludeDirs
+	compilerCwd  string   // a client cwd inside a working dir, if NoccServer.RemapDebugPaths; otherwise, a compiler is launched in "/"
+
+	clientCompilerVersion string // as detected on a client, see CompilerProbes.VerifyClientCompiler
 
 	files   []*fileInClientDir
 	pchFile *fileInClientDir
 
+	moduleOutputRequested bool   // a client compiles a module interface unit with -fmodule-output
+	moduleOutputFile      string // a BMI produced along with OutputFile (the same dir), sent to a client after it
+
+	sideOutputsObjFile string   // a client .o, if a client expects files named after it (.su, .gcno, etc.)
+	sideOutputFiles    []string // produced along with OutputFile (the same dir and basename), sent to a client after a BMI
+
+	provenance []byte // signed JSON sent along with OutputFile, nil if ProvenanceRecorder is off, see common.ObjProvenance
+
+	onDemandDirs  []string // includes are not in files, a compiler reads them from a client, see OnDemandIncludes
+	onDemandFiles []string // read by a compiler from onDemandDirs, sent to a client for a depfile
+
+	snapshot           *snapshot // files equal to ones of it are not in files, see Snapshots
 	objCacheKey        common.SHA256
+	expectedObjMachine elf.Machine // EM_NONE if not verified, see NoccServer.StrictObjTarget
 	objCacheExists     bool
 	compilationStarted atomic.Int32
 
-	compilerExitCode int
-	compilerStdout   []byte
-	compilerStderr   []byte
-	compilerDuration int32
-	interrupted      bool
+	noObjCache              bool   // a client asked not to use obj cache for this .cpp (see client.PolicyRule.NoObjCache), or a compiler isn't probed yet
+	cacheNamespace          string // of a project (or a compiler, see NoccServer.ObjCacheNamespaceByCompiler), empty if none
+	priorityClass           string // a compiler waits in CompilerLauncher for higher classes first, see common.PriorityClassRank
+	priority                int32  // then for higher priorities within a class
+	caseInsensitiveIncludes bool   // see NoccServer.CaseInsensitiveTargets
+	diagnosticsColor        bool   // a client prints to a terminal, see CompilerLaunchRequest.diagnosticsColor
+
+	compilerEnv []string // from a client, only allowed ones, see filterCompilerEnv
+
+	compilerExitCode   int
+	compilerSignal     int32 // see CompilerLaunchResponse.signal
+	compilerStdout     []byte
+	compilerStderr     []byte
+	compilerDuration   int32
+	compilerQueued     int32 // see CompilerLaunchResponse.queued
+	compilerQueueDepth int32
+	interrupted        bool
+	wrongObjTarget     bool        // a .o was rejected by verifyObjMachine, a client quarantines this server
+	expired            atomic.Bool // interrupted by Cron, see ClientsStorage.DeleteExpiredSessions
 
 	interruptchan chan struct{}
+	interruptOnce sync.Once
+	span          *common.Span // nil if tracing is off
 }
 
 func CreateNewSession(in *pb.StartCompilationSessionRequest, client *Client) (*Session, error) {
 	newSession := &Session{
 		sessionID:     in.SessionID,
+		createTime:    time.Now(),
+		userName:      in.UserName,
 		compilerName:  in.Compiler,
 		compilerArgs:  in.CompilerArgs,
+		includeDirs:   extractIncludeDirs(in.CompilerArgs),
 		InputFile:     in.InputFile,
 		files:         make([]*fileInClientDir, len(in.RequiredFiles)),
 		interruptchan: make(chan struct{}),
 	}
+	newSession.moduleOutputRequested = in.ModuleOutput
+	newSession.sideOutputsObjFile = in.SideOutputsObjFile
+	newSession.clientCompilerVersion = in.CompilerVersion
+	newSession.noObjCache = in.NoObjCache || len(in.OnDemandDirs) != 0 // dependencies are unknown before compiling
+	newSession.onDemandDirs = in.OnDemandDirs
+	newSession.priorityClass = in.PriorityClass
+	if common.PriorityClassRank(in.PriorityClass) == -1 || in.PriorityClass == "" {
+		newSession.priorityClass = common.PriorityClassDefault // an unknown class of a newer client is ranked as default
+	}
+	newSession.priority = in.Priority
+	if err := common.ValidateCacheNamespace(in.CacheNamespace); err != nil {
+		return nil, err
+	}
+	newSession.cacheNamespace = in.CacheNamespace
+	newSession.diagnosticsColor = in.DiagnosticsColor
+	newSession.compilerEnv = filterCompilerEnv(in.CompilerEnv, client.uploadsToolchain)
 
 	for index, meta := range in.RequiredFiles {
 		file, err := startUsingFileInSession(client, meta)
@@ -78,6 +140,61 @@ func CreateNewSession(in *pb.StartCompilationSessionRequest, client *Client) (*S
 	return newSession, nil
 }
 
+// remapDebugPaths makes debug info and __FILE__ the same as if a file was compiled on a client:
+// a compiler is launched in a client cwd (it's DW_AT_comp_dir), and if an input file was relative,
+// paths inside cwd are written relative (a client makes all paths absolute, including -I).
+// Custom -ffile-prefix-map and similar on a command line are left to a user, nothing is injected.
+func (session *Session) remapDebugPaths(in *pb.StartCompilationSessionRequest) {
+	if !strings.HasPrefix(in.Cwd, "/") {
+		return
+	}
+	for _, arg := range session.compilerArgs {
+		if strings.HasPrefix(arg, "-ffile-prefix-map=") || strings.HasPrefix(arg, "-fdebug-prefix-map=") || strings.HasPrefix(arg, "-fmacro-prefix-map=") {
+			return
+		}
+	}
+
+	session.compilerCwd = path.Clean(in.Cwd)
+	if in.InputFileRelative && session.compilerCwd != "/" {
+		session.compilerArgs = append(slices.Clip(session.compilerArgs), "-ffile-prefix-map="+session.compilerCwd+"/=")
+	}
+}
+
+// startSpan starts a session span, attached to a client trace if it was passed via grpc metadata.
+func (session *Session) startSpan(ctx context.Context, client *Client) {
+	traceparent := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("traceparent"); len(values) == 1 {
+			traceparent = values[0]
+		}
+	}
+
+	session.span = tracerServer.StartSpanFromTraceparent("session", traceparent)
+	session.span.SetAttribute("nocc.client_id", client.clientID)
+	session.span.SetAttribute("nocc.session_id", session.sessionID)
+	session.span.SetAttribute("nocc.user", session.userName)
+	session.span.SetAttribute("nocc.input_file", session.InputFile)
+}
+
+// interrupt kills a running compiler (or stops waiting for a free slot); a session can be interrupted
+// both by a client and by Cron, so interruptchan is closed once
+func (session *Session) interrupt() {
+	session.interruptOnce.Do(func() {
+		close(session.interruptchan)
+	})
+}
+
+// largeObjFileSize is a size of .o starting from which it's sent not via all recv streams, see RecvCompiledObjStream
+const largeObjFileSize = 4 * 1024 * 1024
+
+func (session *Session) hasLargeOutputFile() bool {
+	if session.compilerExitCode != 0 || session.interrupted || session.OutputFile == "" {
+		return false
+	}
+	stat, err := os.Stat(session.OutputFile)
+	return err == nil && stat.Size() >= largeObjFileSize
+}
+
 // the only reason why a session can't be created is a dependency conflict:
 // previously, a client reported that clientFileName has sha256=v1, and now it sends sha256=v2
 func startUsingFileInSession(client *Client, meta *pb.FileMetadata) (*fileInClientDir, error) {
@@ -85,12 +202,20 @@ func startUsingFileInSession(client *Client, meta *pb.FileMetadata) (*fileInClie
 	return client.StartUsingFileInSession(meta.FileName, meta.FileSize, meta.IsSymlink, meta.SymlinkTarget, fileSHA256)
 }
 
+// makeProbedFile is a file not placed into a client working dir, only to calculate objCacheKey, see NoccServer.ProbeObjCache
+func makeProbedFile(meta *pb.FileMetadata) *fileInClientDir {
+	fileSHA256 := common.SHA256{B0_7: meta.SHA256_B0_7, B8_15: meta.SHA256_B8_15, B16_23: meta.SHA256_B16_23, B24_31: meta.SHA256_B24_31}
+	return &fileInClientDir{fileSize: meta.FileSize, fileSHA256: fileSHA256, isSymlink: meta.IsSymlink, symlinkTarget: meta.SymlinkTarget}
+}
+
 // StartCompilingObjIfPossible executes compiler if all dependent files (.cpp/.h/.nocc-pch/etc.) are ready.
 // They have either been uploaded by the client or already taken from src cache.
 // Note, that it's called for sessions that don't exist in obj cache.
 func (session *Session) StartCompilingObjIfPossible(client *Client, compilerLauncher *CompilerLauncher, objFileCache *ObjFileCache) {
+	// a file failed to upload is not ready either: a client re-uploads it after a network error (or gives up on a session)
+	// a gated file being uploaded is, a compiler waits for it on opening, see PipelinedUploads
 	for _, file := range session.files {
-		if file.state.Load() == fsFileStateUploading {
+		if state := file.state.Load(); (state == fsFileStateUploading && !file.gated.Load()) || state == fsFileStateUploadError {
 			return
 		}
 	}
@@ -124,11 +249,17 @@ func (session *Session) StartCompilingPchIfPossible(client *Client, compilerLaun
 			session.StartCompilingObjIfPossible(client, compilerLauncher, objFileCache)
 		}
 	} else if session.pchFile.state.Load() == fsFileStatePchCompileError {
+		if session.compilationStarted.Swap(1) != 0 { // taken by Cron, see Client.ExpireSession
+			return
+		}
 		logServer.Error("pch file compilation failed, not continuing")
 		session.compilerStderr = fmt.Appendln(nil, fmt.Errorf("compilation of pch file %s failed, not continuing", session.pchFile.serverFileName))
 		session.compilerExitCode = -1
 		client.PushToClientReadyChannel(session)
 	} else if session.pchFile.state.Load() == fsFileStatePchCompileInterrupted {
+		if session.compilationStarted.Swap(1) != 0 {
+			return
+		}
 		session.interrupted = true
 		client.PushToClientReadyChannel(session)
 	}
@@ -145,45 +276,144 @@ func (session *Session) LaunchCompilerWhenPossible(client *Client, compilerLaunc
 	}
 
 	session.OutputFile = objFileCache.GenerateObjOutFileName(client, session)
+	compileOutput := session.OutputFile
+	if session.sideOutputsObjFile != "" {
+		// side outputs are named after .o (and a .o with coverage refers to .gcda by an abs path),
+		// that's why it's compiled to a client path inside a working dir, not to compiler-out
+		compileOutput = session.sideOutputsObjFile
+		session.OutputFile = client.MapClientFileNameToServerAbs(compileOutput)
+		client.MkdirAllIncludeDirs([]string{path.Dir(compileOutput)})
+	}
 
-	logServer.Info(1, "launch compiler #", "sessionID", session.sessionID, "clientID", client.clientID, session.compilerArgs)
+	logServer.Info(1, "launch compiler #", "sessionID", session.sessionID, "clientID", client.clientID, "user", session.userName, session.compilerArgs)
 
 	request := &CompilerLaunchRequest{
-		workingDir:    client.workingDir,
+		workingDir:       client.workingDir,
 		chanDisconnected: client.chanDisconnected,
+		clientID:         client.clientID,
 		compilerName:     session.compilerName,
 		compileInput:     session.InputFile,
-		compileOutput:    session.OutputFile,
+		compileOutput:    compileOutput,
 		compilerArgs:     session.compilerArgs,
+		compilerCwd:      session.compilerCwd,
+		priorityClass:    session.priorityClass,
+		priority:         session.priority,
+		diagnosticsColor: session.diagnosticsColor,
+		compilerEnv:      session.compilerEnv,
 		interruptchan:    session.interruptchan,
+		uploadedCompiler: client.uploadsToolchain,
+	}
+	if session.moduleOutputRequested {
+		session.moduleOutputFile = common.ReplaceFileExt(session.OutputFile, ".pcm")
+		request.compilerArgs = append(slices.Clip(session.compilerArgs), "-fmodule-output="+session.moduleOutputFile)
+	}
+
+	client.MkdirAllIncludeDirs(session.includeDirs)
+	if session.compilerCwd != "" {
+		client.MkdirAllIncludeDirs([]string{session.compilerCwd})
+	}
+	var existingBeforeCompile []string
+	if session.sideOutputsObjFile != "" {
+		existingBeforeCompile = session.listFilesNamedAfterOutput()
 	}
 
+	var onDemandView *onDemandView
+	if session.onDemandDirs != nil {
+		onDemandView = client.onDemand.makeView(client, session)
+		request.workingDir = client.onDemand.root
+		request.onDemandView = onDemandView
+	}
+
+	compilerSpan := tracerServer.StartSpan("compile", session.span)
 	response := compilerLauncher.ExecCompiler(request)
+	for nRetries := 0; session.caseInsensitiveIncludes && response.exitcode != 0 && !response.interrupted && nRetries < maxIncludeCaseRetries; nRetries++ {
+		if !client.resolveIncludeCase(session, response.stderr) {
+			break
+		}
+		response = compilerLauncher.ExecCompiler(request)
+	}
+	if onDemandView != nil {
+		onDemandView.detach()
+		session.onDemandFiles = onDemandView.openedFiles()
+		// a compiler saw an incomplete tree (e.g. a client didn't reply), its result can't be trusted
+		if err := onDemandView.failure(); err != nil && !response.interrupted {
+			logServer.Error("on-demand includes failed", "sessionID", session.sessionID, "clientID", client.clientID, session.InputFile, err)
+			response.interrupted = true
+		}
+	}
+	compilerSpan.SetAttribute("nocc.compiler_exit_code", response.exitcode)
+	compilerSpan.End()
 	if response.interrupted {
+		_ = os.Remove(session.OutputFile) // a killed compiler could have written it partially
+		session.removeSideOutputs(existingBeforeCompile)
 		session.interrupted = true
 		client.PushToClientReadyChannel(session)
 		return
 	}
 
 	session.compilerExitCode = response.exitcode
+	session.compilerSignal = response.signal
 	session.compilerDuration = response.duration
+	session.compilerQueued = response.queued
+	session.compilerQueueDepth = response.queueDepth
 	session.compilerStdout = response.stdout
 	session.compilerStderr = response.stderr
 
 	if session.compilerExitCode != 0 {
+		session.removeSideOutputs(existingBeforeCompile)
 		client.PushToClientReadyChannel(session)
 		return
 	}
 
+	if session.expectedObjMachine != elf.EM_NONE {
+		if err := verifyObjMachine(session.OutputFile, session.expectedObjMachine); err != nil {
+			logServer.Error("wrong obj target", "sessionID", session.sessionID, "clientID", client.clientID, session.InputFile, err)
+			session.compilerExitCode = 1
+			session.wrongObjTarget = true
+			session.compilerStderr = append(session.compilerStderr, err.Error()+"\n"...)
+			session.removeSideOutputs(existingBeforeCompile)
+			client.PushToClientReadyChannel(session)
+			return
+		}
+	}
+
+	session.provenance = objFileCache.Provenance.Record(client, session)
+
 	if session.compilerDuration > 30000 {
 		logServer.Info(0, "compiled very heavy file", "sessionID", session.sessionID, "compilerDuration", session.compilerDuration, session.InputFile)
 	}
 
-	// save to obj cache only if compilation was successful
-	if !session.objCacheKey.IsEmpty() {
+	// a compiler doesn't produce a BMI for a non-module unit, then a client gets none and compiles it locally
+	if session.moduleOutputFile != "" {
+		if _, err := os.Stat(session.moduleOutputFile); err != nil {
+			session.moduleOutputFile = ""
+		}
+	}
+
+	if session.sideOutputsObjFile != "" {
+		for _, fileName := range session.listFilesNamedAfterOutput() {
+			if !slices.Contains(existingBeforeCompile, fileName) {
+				session.sideOutputFiles = append(session.sideOutputFiles, fileName)
+			}
+		}
+	}
+
+	// save to obj cache only if compilation was successful (not with side outputs, they aren't cached)
+	if !session.objCacheKey.IsEmpty() && session.sideOutputsObjFile == "" && !session.noObjCache {
 		if session.compilerExitCode == 0 {
+			// provenance is saved before .o, so that a cache hit of .o always finds it
+			if session.provenance != nil && objFileCache.SaveProvenanceToCache(session.provenance, session.InputFile, session.objCacheKey, session.cacheNamespace) {
+				objFileCache.Replicator.PushIfHeavy(MakeProvenanceCacheKey(session.objCacheKey), path.Base(session.InputFile)+".prov", session.compilerDuration)
+			}
 			if stat, err := os.Stat(session.OutputFile); err == nil {
-				_ = objFileCache.SaveFileToCache(session.OutputFile, path.Base(session.InputFile)+".o", session.objCacheKey, stat.Size())
+				if objFileCache.SaveFileToCacheInNamespace(session.OutputFile, path.Base(session.InputFile)+".o", session.objCacheKey, stat.Size(), session.cacheNamespace) == nil {
+					objFileCache.Replicator.PushIfHeavy(session.objCacheKey, path.Base(session.InputFile)+".o", session.compilerDuration)
+				}
+			}
+			if stat, err := os.Stat(session.moduleOutputFile); err == nil {
+				if objFileCache.SaveFileToCacheInNamespace(session.moduleOutputFile, path.Base(session.InputFile)+".pcm", MakeModuleOutputCacheKey(session.objCacheKey), stat.Size(), session.cacheNamespace) == nil {
+					objFileCache.Replicator.PushIfHeavy(MakeModuleOutputCacheKey(session.objCacheKey), path.Base(session.InputFile)+".pcm", session.compilerDuration)
+				}
 			}
 		}
 	}
@@ -191,6 +421,35 @@ func (session *Session) LaunchCompilerWhenPossible(client *Client, compilerLaunc
 	client.PushToClientReadyChannel(session)
 }
 
+// listFilesNamedAfterOutput returns files like x.su and x.gcno for OutputFile x.o (except a BMI).
+// OutputFile is in a client working dir here, so uploaded files (x.cpp, x.h) also match,
+// that's why side outputs are detected as files that didn't exist before compilation.
+func (session *Session) listFilesNamedAfterOutput() []string {
+	dir, objName := filepath.Split(session.OutputFile)
+	prefix := common.ReplaceFileExt(objName, ".")
+	entries, _ := os.ReadDir(dir)
+	fileNames := make([]string, 0)
+	for _, entry := range entries {
+		fileName := dir + entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), prefix) && fileName != session.OutputFile && fileName != session.moduleOutputFile {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	return fileNames
+}
+
+// removeSideOutputs removes files written by a compiler that failed or was killed (they are not sent to a client)
+func (session *Session) removeSideOutputs(existingBeforeCompile []string) {
+	if session.sideOutputsObjFile == "" {
+		return
+	}
+	for _, fileName := range session.listFilesNamedAfterOutput() {
+		if !slices.Contains(existingBeforeCompile, fileName) {
+			_ = os.Remove(fileName)
+		}
+	}
+}
+
 func (session *Session) LaunchPchWhenPossible(client *Client, compilerLauncher *CompilerLauncher, objFileCache *ObjFileCache) (bool, error) {
 	pchInvocation, err := ParsePchFile(session.pchFile)
 	if err != nil {
@@ -213,10 +472,17 @@ func (session *Session) LaunchPchWhenPossible(client *Client, compilerLauncher *
 		compileInput:     pchInvocation.InputFile,
 		compileOutput:    pchInvocation.OutputFile,
 		compilerArgs:     pchInvocation.Args,
+		clientID:         client.clientID,
+		priorityClass:    session.priorityClass,
 		interruptchan:    session.interruptchan,
+		uploadedCompiler: client.uploadsToolchain,
 	}
 
+	client.MkdirAllIncludeDirs(extractIncludeDirs(pchInvocation.Args))
+
+	pchSpan := tracerServer.StartSpan("compile pch", session.span)
 	response := compilerLauncher.ExecCompiler(request)
+	pchSpan.End()
 
 	if response.interrupted {
 		return true, nil
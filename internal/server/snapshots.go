@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// Snapshots are named toolchain snapshots registered by an operator, Snapshots in config.
+// A snapshot is a manifest of files (system headers, libs of an uploaded toolchain, etc.) in a format of `sha256sum`,
+// like `find /usr/include /usr/lib/gcc -type f | xargs sha256sum > gcc12.manifest`.
+// A client requests snapshots by name on start and receives their files (see pb.Snapshot);
+// then its sessions reference a snapshot ID instead of sending thousands of equal files in every session,
+// and an obj cache key contains a snapshot digest instead of hashing all of them.
+// Snapshot files are copied to ${SrcCacheDir}/snapshots on start (and checked to match a manifest),
+// and are hard linked into a client working dir by its first session referencing a snapshot.
+// It's nil if Snapshots are not set.
+type Snapshots struct {
+	byName map[string]*snapshot
+	byID   map[string]*snapshot
+}
+
+type snapshot struct {
+	name       string
+	id         string // name@digest, a new manifest makes another id
+	digest     common.SHA256
+	files      []*pb.FileMetadata
+	storageDir string // files are saved there with their abs paths, like ${SrcCacheDir}/snapshots/{name}/usr/include/stdio.h
+}
+
+// placedSnapshot is a snapshot hard linked into a client working dir, see Client.placeSnapshot
+type placedSnapshot struct {
+	once sync.Once
+	err  error
+}
+
+func MakeSnapshots(manifests map[string]string, storageDir string) (*Snapshots, error) {
+	if len(manifests) == 0 {
+		return nil, nil
+	}
+
+	snapshots := &Snapshots{
+		byName: make(map[string]*snapshot, len(manifests)),
+		byID:   make(map[string]*snapshot, len(manifests)),
+	}
+	for name, manifestFile := range manifests {
+		start := time.Now()
+		snapshot, err := loadSnapshot(name, manifestFile, path.Join(storageDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %v", name, err)
+		}
+		snapshots.byName[name] = snapshot
+		snapshots.byID[snapshot.id] = snapshot
+		logServer.Info(0, "snapshot", snapshot.id, "num files", len(snapshot.files), "loaded in", time.Since(start))
+	}
+	return snapshots, nil
+}
+
+// loadSnapshot parses a manifest and copies files listed there into storageDir, checking their sha256
+func loadSnapshot(name string, manifestFile string, storageDir string) (*snapshot, error) {
+	entries, err := parseSnapshotManifest(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	files := make([]*pb.FileMetadata, 0, len(entries))
+	for _, entry := range entries {
+		fileSHA256, fileSize, err := copySnapshotFile(entry.fileName, path.Join(storageDir, entry.fileName))
+		if err != nil {
+			return nil, err
+		}
+		if fileSHA256.ToHexString() != entry.hexSHA256 {
+			return nil, fmt.Errorf("%s differs from a manifest, it's outdated", entry.fileName)
+		}
+		files = append(files, &pb.FileMetadata{
+			FileName:      entry.fileName,
+			FileSize:      fileSize,
+			SHA256_B0_7:   fileSHA256.B0_7,
+			SHA256_B8_15:  fileSHA256.B8_15,
+			SHA256_B16_23: fileSHA256.B16_23,
+			SHA256_B24_31: fileSHA256.B24_31,
+		})
+		_, _ = fmt.Fprintf(hasher, "%s %s\n", entry.fileName, entry.hexSHA256)
+	}
+
+	digest := common.MakeSHA256Struct(hasher)
+	return &snapshot{
+		name:       name,
+		id:         name + "@" + digest.ToShortHexString(),
+		digest:     digest,
+		files:      files,
+		storageDir: storageDir,
+	}, nil
+}
+
+type snapshotManifestEntry struct {
+	fileName  string
+	hexSHA256 string
+}
+
+// parseSnapshotManifest parses an output of `sha256sum`: "{sha256}  {abs path}" per line, sorted by path
+func parseSnapshotManifest(manifestFile string) ([]snapshotManifestEntry, error) {
+	file, err := os.Open(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]snapshotManifestEntry, 0, 1024)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		hexSHA256, fileName, found := strings.Cut(line, " ")
+		fileName = strings.TrimPrefix(strings.TrimPrefix(fileName, " "), "*") // "  " for text mode, " *" for binary
+		if !found || len(hexSHA256) != 64 || !path.IsAbs(fileName) {
+			return nil, fmt.Errorf("invalid line in %s: %s", manifestFile, line)
+		}
+		entries = append(entries, snapshotManifestEntry{path.Clean(fileName), strings.ToLower(hexSHA256)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(entries, func(a, b snapshotManifestEntry) int { return strings.Compare(a.fileName, b.fileName) })
+	return entries, nil
+}
+
+// copySnapshotFile copies a file into a snapshot storage and returns sha256 of what was copied
+func copySnapshotFile(fileName string, storageFileName string) (common.SHA256, int64, error) {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return common.SHA256{}, 0, err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(path.Dir(storageFileName), os.ModePerm); err != nil {
+		return common.SHA256{}, 0, err
+	}
+	dst, err := os.OpenFile(storageFileName, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0444)
+	if err != nil {
+		return common.SHA256{}, 0, err
+	}
+	defer dst.Close()
+
+	hasher := sha256.New()
+	fileSize, err := io.Copy(io.MultiWriter(dst, hasher), src)
+	if err != nil {
+		return common.SHA256{}, 0, err
+	}
+	return common.MakeSHA256Struct(hasher), fileSize, nil
+}
+
+// ForClient returns snapshots requested by a client on start, unknown names are skipped
+func (snapshots *Snapshots) ForClient(names []string) []*pb.Snapshot {
+	replied := make([]*pb.Snapshot, 0)
+	if snapshots == nil {
+		return replied
+	}
+
+	for _, name := range names {
+		if snapshot := snapshots.byName[name]; snapshot != nil {
+			replied = append(replied, &pb.Snapshot{Name: snapshot.name, ID: snapshot.id, Files: snapshot.files})
+		}
+	}
+	return replied
+}
+
+// Lookup returns a snapshot by StartCompilationSessionRequest.SnapshotID, nil if it's unknown
+// (a server was restarted with another manifest, or a client doesn't use snapshots)
+func (snapshots *Snapshots) Lookup(snapshotID string) *snapshot {
+	if snapshots == nil || snapshotID == "" {
+		return nil
+	}
+	return snapshots.byID[snapshotID]
+}
+
+// placeSnapshot hard links all snapshot files into a client working dir, once per client.
+// Files that already exist there (e.g. inside mounted dirs, which contain the same server files) are left as is.
+func (client *Client) placeSnapshot(snapshot *snapshot) error {
+	client.mu.Lock()
+	placed := client.snapshots[snapshot.id]
+	if placed == nil {
+		placed = &placedSnapshot{}
+		client.snapshots[snapshot.id] = placed
+	}
+	client.mu.Unlock()
+
+	placed.once.Do(func() {
+		start := time.Now()
+		for _, meta := range snapshot.files {
+			file, err := startUsingFileInSession(client, meta)
+			if err != nil {
+				placed.err = err
+				return
+			}
+			if !file.state.CompareAndSwap(fsFileStateJustCreated, fsFileStateUploading) {
+				continue
+			}
+			if _, err := os.Lstat(file.serverFileName); err != nil {
+				_ = os.MkdirAll(path.Dir(file.serverFileName), os.ModePerm)
+				if err := os.Link(path.Join(snapshot.storageDir, meta.FileName), file.serverFileName); err != nil {
+					file.state.Store(fsFileStateUploadError)
+					placed.err = err
+					return
+				}
+			}
+			file.state.Store(fsFileStateUploaded)
+		}
+		logServer.Info(0, "placed snapshot", snapshot.id, "clientID", client.clientID, "in", time.Since(start))
+	})
+	return placed.err
+}
@@ -4,6 +4,10 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
+	"time"
+
+	"nocc/internal/common"
 )
 
 // SrcFileCache is a ${SrcCacheDir}/cpp/src-cache directory, where uploaded .cpp/.h/etc. files are saved.
@@ -12,15 +16,134 @@ import (
 // Also, it helps reuse files across the same client after it was considered inactive and deleted, but launched again.
 type SrcFileCache struct {
 	*FileCache
+
+	uploadsMu sync.Mutex
+	uploads   map[common.SHA256]*srcUploadClaim // files being uploaded now (by any client), see ClaimUpload
+
+	versionsMu   sync.Mutex
+	lastVersions map[string]common.SHA256 // by a client file name, bases for delta uploads, see RememberVersion
 }
 
+type srcUploadClaim struct {
+	done    chan struct{} // closed when an upload ends
+	started time.Time
+
+	clientID         string        // a claimant, its other sessions don't wait for it, see ClaimUpload
+	sessionID        uint32        // see ReleaseSessionUploads
+	chanDisconnected chan struct{} // of a claimant client, then a claim is abandoned
+}
+
+// maxRememberedVersions limits lastVersions, see RememberVersion
+const maxRememberedVersions = 64 * 1024
+
+// srcUploadWaitTimeout limits waiting for another client uploading the same file, then a file is uploaded once more
+const srcUploadWaitTimeout = 10 * time.Second
+
 func MakeSrcFileCache(cacheDir string, limitBytes int64) (*SrcFileCache, error) {
 	cache, err := MakeFileCache(cacheDir, limitBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SrcFileCache{cache}, nil
+	return &SrcFileCache{
+		FileCache:    cache,
+		uploads:      make(map[common.SHA256]*srcUploadClaim),
+		lastVersions: make(map[string]common.SHA256),
+	}, nil
+}
+
+// ClaimUpload is called before requesting a client to upload a file missing in src cache.
+// While src cache dedups files uploaded earlier, concurrent sessions of different clients (e.g. build agents
+// starting the same build) would all upload the same headers. Instead, only the first client uploads a file,
+// and others wait: ClaimUpload returns a claim whose done is closed after that upload ends (nil if the caller is the first).
+// After it's closed, a file is usually in src cache; if not (an upload failed), a waiting client uploads it itself.
+// A claim of the same client is never waited for (nil is returned): a session may require equal files (like empty headers),
+// and the first one is uploaded only after a session start replies, so waiting for it would always time out.
+// A claim older than srcUploadWaitTimeout is considered hanged and is taken over.
+func (cache *SrcFileCache) ClaimUpload(key common.SHA256, client *Client, sessionID uint32) *srcUploadClaim {
+	cache.uploadsMu.Lock()
+	defer cache.uploadsMu.Unlock()
+
+	if claim := cache.uploads[key]; claim != nil {
+		if claim.clientID == client.clientID {
+			return nil
+		}
+		if time.Since(claim.started) < srcUploadWaitTimeout {
+			return claim
+		}
+		close(claim.done)
+	}
+	cache.uploads[key] = &srcUploadClaim{
+		done:             make(chan struct{}),
+		started:          time.Now(),
+		clientID:         client.clientID,
+		sessionID:        sessionID,
+		chanDisconnected: client.chanDisconnected,
+	}
+	return nil
+}
+
+// ReleaseUpload is called after a file was uploaded (and saved to src cache) or failed to upload, see ClaimUpload
+func (cache *SrcFileCache) ReleaseUpload(key common.SHA256) {
+	cache.uploadsMu.Lock()
+	if claim := cache.uploads[key]; claim != nil {
+		close(claim.done)
+		delete(cache.uploads, key)
+	}
+	cache.uploadsMu.Unlock()
+}
+
+// ReleaseSessionUploads is called when a session is interrupted: its client won't upload files it claimed
+// (e.g. it compiles locally instead), so other clients stop waiting for them
+func (cache *SrcFileCache) ReleaseSessionUploads(clientID string, sessionID uint32) {
+	cache.releaseUploadsWhere(func(claim *srcUploadClaim) bool {
+		return claim.clientID == clientID && claim.sessionID == sessionID
+	})
+}
+
+// ReleaseClientUploads is called when a client stops, see ReleaseSessionUploads
+func (cache *SrcFileCache) ReleaseClientUploads(clientID string) {
+	cache.releaseUploadsWhere(func(claim *srcUploadClaim) bool {
+		return claim.clientID == clientID
+	})
+}
+
+func (cache *SrcFileCache) releaseUploadsWhere(shouldRelease func(claim *srcUploadClaim) bool) {
+	cache.uploadsMu.Lock()
+	for key, claim := range cache.uploads {
+		if shouldRelease(claim) {
+			close(claim.done)
+			delete(cache.uploads, key)
+		}
+	}
+	cache.uploadsMu.Unlock()
+}
+
+// RememberVersion is called after a file was uploaded: when it changes, a new version is uploaded as a delta against this one
+// (while it's still in src cache), see offerDeltaBases. Small files are not remembered, they are uploaded as is.
+func (cache *SrcFileCache) RememberVersion(clientFileName string, key common.SHA256, fileSize int64) {
+	if fileSize < deltaMinFileSize {
+		return
+	}
+
+	cache.versionsMu.Lock()
+	if _, exists := cache.lastVersions[clientFileName]; !exists && len(cache.lastVersions) >= maxRememberedVersions {
+		for evicted := range cache.lastVersions { // any one, it's just a lost chance of a delta
+			delete(cache.lastVersions, evicted)
+			break
+		}
+	}
+	cache.lastVersions[clientFileName] = key
+	cache.versionsMu.Unlock()
+}
+
+// LookupPreviousVersion returns sha256 of a file uploaded last time with the same name, see RememberVersion
+func (cache *SrcFileCache) LookupPreviousVersion(clientFileName string) (common.SHA256, bool) {
+	cache.versionsMu.Lock()
+	defer cache.versionsMu.Unlock()
+
+	key, exists := cache.lastVersions[clientFileName]
+	return key, exists
 }
 
 func (cache *SrcFileCache) MakeTempFileForUploadSaving(serverFileName string) (*os.File, error) {
@@ -28,3 +151,15 @@ func (cache *SrcFileCache) MakeTempFileForUploadSaving(serverFileName string) (*
 	fileNameTmp := serverFileName + "." + strconv.Itoa(rand.Int())
 	return os.OpenFile(fileNameTmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm)
 }
+
+// DeleteHangedUploadClaims forgets claims of clients that never uploaded a file and were not released (e.g. a client hangs)
+func (cache *SrcFileCache) DeleteHangedUploadClaims() {
+	cache.uploadsMu.Lock()
+	for key, claim := range cache.uploads {
+		if time.Since(claim.started) >= srcUploadWaitTimeout {
+			close(claim.done)
+			delete(cache.uploads, key)
+		}
+	}
+	cache.uploadsMu.Unlock()
+}
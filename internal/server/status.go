@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Status is a grpc handler.
+// It's a lightweight check that a server is alive and how loaded it is, for liveness probes (`nocc-server -healthcheck`)
+// and for clients verifying their remotes (`nocc --check-servers`). Unlike other handlers, it needs no started client.
+func (s *NoccServer) Status(_ context.Context, _ *pb.StatusRequest) (*pb.StatusReply, error) {
+	return &pb.StatusReply{
+		ServerVersion:     common.GetVersion(),
+		UptimeSec:         int64(time.Since(s.StartTime).Seconds()),
+		CompilerQueueSize: int32(s.CompilerLauncher.GetQueueSize()),
+		CompilersRunning:  s.CompilerLauncher.GetRunningCount(),
+		CompilersWaiting:  s.CompilerLauncher.GetWaitingCount(),
+		CacheOnly:         s.CacheOnly,
+		CacheDegraded:     s.SrcFileCache.IsDegraded() || s.ObjFileCache.IsDegraded(),
+		SrcCacheFreeDisk:  getFreeDiskSpace(s.SrcFileCache.cacheDir),
+		ObjCacheFreeDisk:  getFreeDiskSpace(s.ObjFileCache.cacheDir),
+		SrcCacheBytes:     s.SrcFileCache.GetBytesOnDisk(),
+		ObjCacheBytes:     s.ObjFileCache.GetBytesOnDisk(),
+		ActiveClients:     int32(s.ActiveClients.ActiveCount()),
+	}, nil
+}
+
+// getFreeDiskSpace returns bytes available to an unprivileged user on a filesystem containing dir, -1 on error
+func getFreeDiskSpace(dir string) int64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return -1
+	}
+	return int64(stat.Bavail) * stat.Bsize
+}
+
+// QueryStatus calls Status of a server listening on addr, in a format of ListenAddr ("host:port", "unix:///path", etc.).
+// A wildcard host (like "0.0.0.0:43210" or "[::]:43210") is connected to locally.
+func QueryStatus(addr string, timeout time.Duration) (*pb.StatusReply, error) {
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	target := "unix://" + address
+	if network != "unix" {
+		host, port, _ := net.SplitHostPort(address) // validated by parseListenAddr
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+		target = "passthrough:///" + net.JoinHostPort(host, port)
+	}
+
+	connection, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	reply, err := pb.NewCompilationServiceClient(connection).Status(ctx, &pb.StatusRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", addr, err)
+	}
+	return reply, nil
+}
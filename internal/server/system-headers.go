@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"nocc/internal/common"
+	"nocc/pb"
+)
+
+// SystemHeaders implements a contract of not uploading system headers (like /usr/include), SystemHeaderDirs in config.
+// Most uploaded files are such headers, and build agents and servers often have the same ones (the same distro image).
+// A client sends digests of its SystemHeaderDirs on start (see common.CalcDirDigest); dirs having the same digest here
+// are bind-mounted read-only into a client working dir, and a client omits files from them in sessions.
+// Other dirs are not mounted, and their files are uploaded as usual.
+// If headers change on a server (say, a package is upgraded), it's detected by Cron, and clients that made a contract
+// with previous headers are refused (they compile locally); new clients make a contract with new headers.
+// It's nil if SystemHeaderDirs are not set, then all files are uploaded.
+type SystemHeaders struct {
+	mu          sync.RWMutex
+	digests     map[string]common.SHA256 // by contents, compared with a client's ones
+	statDigests map[string]common.SHA256 // by names, sizes and mtimes, to detect changes cheaply
+	lastCheck   time.Time
+}
+
+// systemHeadersCheckInterval is how often Cron checks whether SystemHeaderDirs changed
+const systemHeadersCheckInterval = time.Minute
+
+func MakeSystemHeaders(dirs []string) (*SystemHeaders, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+
+	systemHeaders := &SystemHeaders{
+		digests:     make(map[string]common.SHA256, len(dirs)),
+		statDigests: make(map[string]common.SHA256, len(dirs)),
+		lastCheck:   time.Now(),
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("%s is not an absolute path", dir)
+		}
+		start := time.Now()
+		digest, statDigest, err := calcSystemHeadersDigests(dir)
+		if err != nil {
+			return nil, err
+		}
+		systemHeaders.digests[dir] = digest
+		systemHeaders.statDigests[dir] = statDigest
+		logServer.Info(0, "system headers", dir, "digest", digest.ToLongHexString(), "calculated in", time.Since(start))
+	}
+	return systemHeaders, nil
+}
+
+func calcSystemHeadersDigests(dir string) (digest common.SHA256, statDigest common.SHA256, err error) {
+	statDigest, err = calcDirStatDigest(dir)
+	if err == nil {
+		digest, err = common.CalcDirDigest(dir)
+	}
+	return
+}
+
+// calcDirStatDigest is like common.CalcDirDigest, but without reading files (walking /usr/include takes milliseconds)
+func calcDirStatDigest(dir string) (common.SHA256, error) {
+	hasher := sha256.New()
+	err := filepath.WalkDir(dir, func(fileName string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(hasher, "%s %d %d\n", fileName, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return common.MakeSHA256Struct(hasher), err
+}
+
+// AcceptClientDirs returns dirs of a client with the same digests as here, a client doesn't upload files from them
+func (systemHeaders *SystemHeaders) AcceptClientDirs(clientDirs []*pb.SystemHeaderDir) map[string]common.SHA256 {
+	accepted := make(map[string]common.SHA256)
+	if systemHeaders == nil {
+		return accepted
+	}
+
+	systemHeaders.mu.RLock()
+	defer systemHeaders.mu.RUnlock()
+	for _, clientDir := range clientDirs {
+		digest, exists := systemHeaders.digests[clientDir.Dir]
+		if exists && digest.ToLongHexString() == clientDir.Digest {
+			accepted[clientDir.Dir] = digest
+		}
+	}
+	return accepted
+}
+
+// IsContractValid tells whether dirs accepted from a client (see AcceptClientDirs) are still the same
+func (systemHeaders *SystemHeaders) IsContractValid(accepted map[string]common.SHA256) bool {
+	if systemHeaders == nil || len(accepted) == 0 {
+		return true
+	}
+
+	systemHeaders.mu.RLock()
+	defer systemHeaders.mu.RUnlock()
+	for dir, digest := range accepted {
+		if systemHeaders.digests[dir] != digest {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckForChanges is called by Cron: if a dir changed, its digest is recalculated
+func (systemHeaders *SystemHeaders) CheckForChanges() {
+	if systemHeaders == nil || time.Since(systemHeaders.lastCheck) < systemHeadersCheckInterval {
+		return
+	}
+	systemHeaders.lastCheck = time.Now()
+
+	systemHeaders.mu.RLock()
+	dirs := make([]string, 0, len(systemHeaders.digests))
+	for dir := range systemHeaders.digests {
+		dirs = append(dirs, dir)
+	}
+	systemHeaders.mu.RUnlock()
+
+	for _, dir := range dirs {
+		statDigest, err := calcDirStatDigest(dir)
+		if err != nil || statDigest == systemHeaders.statDigests[dir] {
+			continue
+		}
+		digest, statDigest, err := calcSystemHeadersDigests(dir)
+		if err != nil {
+			logServer.Error("can't recalculate system headers digest", dir, err)
+			continue
+		}
+
+		systemHeaders.mu.Lock()
+		changed := systemHeaders.digests[dir] != digest
+		systemHeaders.digests[dir] = digest
+		systemHeaders.statDigests[dir] = statDigest
+		systemHeaders.mu.Unlock()
+		if changed {
+			logServer.Error("system headers", dir, "changed, digest", digest.ToLongHexString(), "; clients started before compile locally until restarted")
+		}
+	}
+}
+
+// sortedSystemHeaderDirs returns accepted dirs to be mounted (in a stable order for comparing retained clients)
+func sortedSystemHeaderDirs(accepted map[string]common.SHA256) []string {
+	dirs := make([]string, 0, len(accepted))
+	for dir := range accepted {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// systemHeadersObjCacheKey is mixed into obj cache key of a client not uploading system headers,
+// since they are not in session files then (and a .o depends on them)
+func systemHeadersObjCacheKey(accepted map[string]common.SHA256) common.SHA256 {
+	hasher := sha256.New()
+	for _, dir := range sortedSystemHeaderDirs(accepted) {
+		digest := accepted[dir]
+		_, _ = fmt.Fprintf(hasher, "%s %s\n", dir, digest.ToLongHexString())
+	}
+	if len(accepted) == 0 {
+		return common.SHA256{}
+	}
+	return common.MakeSHA256Struct(hasher)
+}
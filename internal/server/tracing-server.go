@@ -0,0 +1,12 @@
+package server
+
+import "nocc/internal/common"
+
+// tracerServer exports spans of sessions if TracingEndpoint is set (nil otherwise, all calls are no-op)
+var tracerServer *common.Tracer
+
+func MakeTracerServer(endpoint string) error {
+	var err error
+	tracerServer, err = common.MakeTracer(endpoint, "nocc-server")
+	return err
+}
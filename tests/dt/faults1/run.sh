@@ -0,0 +1,73 @@
+# fault injection: every case breaks a transfer or a compilation path on purpose (see common.InjectFault),
+# a build must still succeed with the same .o files as without faults (a daemon recovers or falls back to local)
+# for local testing, assuming that bin/ is built with `go build -tags nocc_faults`,
+# /etc/nocc/server.conf listens on 127.0.0.1:43210, and nocc-daemon/nocc-server are not running (they are started here)
+
+BIN=$(pwd)/../../../bin
+ROOT=$(pwd)/work
+N_FILES=20
+
+# a process that gets NOCC_FAULTS | faults
+CASES=(
+  "server|obj-chunk-drop=7"
+  "server|obj-stream-delay=50ms"
+  "server|upload-rename-fail=5"
+  "server|compiler-kill=3"
+  "daemon|upload-chunk-drop=50"
+  "daemon|upload-stream-delay=50ms"
+)
+
+prepare() {
+  rm -rf "$ROOT"
+  mkdir -p "$ROOT/src" "$ROOT/out"
+  for i in $(seq $N_FILES); do
+    printf '#include <string>\nstd::string f%d() { return std::to_string(%d); }\n' "$i" "$i" > "$ROOT/src/$i.cpp"
+  done
+  cat > "$ROOT/daemon.conf" << EOF
+Servers = ["127.0.0.1:43210"]
+InvocationTimeout = 5
+LogFileName = "$ROOT/daemon.log"
+EOF
+}
+
+stop_all() {
+  pkill -x nocc-daemon; pkill -x nocc-server
+  sleep 1
+}
+
+# compiles all files in parallel with faults, prints exit codes and hashes of .o, so that two runs can be diffed
+build() {
+  stop_all
+  if [ "$1" == "server" ]; then NOCC_FAULTS=$2 "$BIN/nocc-server" > "$ROOT/server.out" 2>&1 & else "$BIN/nocc-server" > "$ROOT/server.out" 2>&1 & fi
+  sleep 1
+  rm -f "$ROOT"/out/*
+  for i in $(seq $N_FILES); do
+    ( cd "$ROOT/src" && if [ "$1" == "daemon" ]; then export NOCC_FAULTS=$2; fi
+      NOCC_CONFIG="$ROOT/daemon.conf" NOCC_PER_USER_DAEMON=1 "$BIN/nocc" g++ -c $i.cpp -o ../out/$i.o > /dev/null 2>&1
+      echo "$i.cpp exit $?" ) &
+  done | sort
+  (cd "$ROOT/out" && sha256sum -- * | sort -k2)
+}
+
+prepare
+expected=$(build "none" "")
+
+failed=0
+for c in "${CASES[@]}"; do
+  side=${c%%|*}
+  faults=${c#*|}
+
+  actual=$(build "$side" "$faults")
+  if [ "$expected" != "$actual" ]; then
+    failed=1
+    echo "FAIL: $side $faults"
+    diff <(echo "$expected") <(echo "$actual")
+  else
+    echo "ok:   $side $faults ($(grep -c "injected fault\|interrupt sessionID\|failed, but succeeded locally" "$ROOT/daemon.log") recovered)"
+  fi
+  rm -f "$ROOT/daemon.log"
+done
+
+stop_all
+rm -rf "$ROOT"
+exit $failed
@@ -0,0 +1,63 @@
+# a matrix of path-related invocations: every line is compiled with the real compiler and with nocc,
+# the set of produced files and depfile targets must be equal
+# for local testing, assuming that bin/nocc is installed and nocc-daemon/nocc-server are running locally
+
+NOCC=$(pwd)/../../../bin/nocc
+CXX=${CXX:-g++}
+ROOT=$(pwd)/work
+
+# cwd (relative to work/) | arguments
+CASES=(
+  "src|-Iinc -c 1.cpp"
+  "src|-Iinc -c 1.cpp -o 1.o"
+  "src|-Iinc -c ./1.cpp -o ./out/1.o"
+  "src|-Iinc -c 1.cpp -o ../out/1.o -MD"
+  "src|-Iinc -c 1.cpp -o ../out//1.o -MMD -MP"
+  "src|-I./inc/ -c 1.cpp -o out/1.o -MD -MF ../out/1.d"
+  "src/inc|-I. -c ../1.cpp -o ../../out/1.o -MD"
+  "src/inc|-I. -c ../1.cpp -MD -MT 'custom target.o'"
+  "link|-Iinc -c 1.cpp -o ../out/1.o -MD"
+  "link/inc|-I. -c ../1.cpp -o ../../out/1.o -MD -MF ../../out/1.d"
+  "src|-Iinc -c 1.cpp -o ../out/"
+  "src|-Iinc -c 1.cpp -o ../out"
+)
+
+prepare() {
+  rm -rf "$ROOT"
+  mkdir -p "$ROOT/out" "$ROOT/src/out"
+  cp -r src/* "$ROOT/src/"
+  ln -s src "$ROOT/link"
+}
+
+# prints all files in work/ with depfile targets, so that two runs can be diffed
+snapshot() {
+  (cd "$ROOT" && find . -type f -newer "$ROOT/.start" | sort | while read -r f; do
+    echo "$f"
+    case "$f" in *.d) grep -v '^ ' "$f" | cut -d: -f1 | sed 's/^/  target: /' ;; esac
+  done)
+}
+
+failed=0
+for c in "${CASES[@]}"; do
+  cwd=${c%%|*}
+  args=${c#*|}
+
+  prepare; touch "$ROOT/.start"; sleep 1
+  (cd "$ROOT/$cwd" && eval "$CXX $args" >/dev/null 2>&1); expected_code=$?
+  expected=$(snapshot)
+
+  prepare; touch "$ROOT/.start"; sleep 1
+  (cd "$ROOT/$cwd" && eval "$NOCC $CXX $args" >/dev/null 2>&1); actual_code=$?
+  actual=$(snapshot)
+
+  if [ "$expected" != "$actual" ] || [ $expected_code != $actual_code ]; then
+    failed=1
+    echo "FAIL: (cd $cwd && $args)"
+    diff <(echo "exit $expected_code"; echo "$expected") <(echo "exit $actual_code"; echo "$actual")
+  else
+    echo "ok:   (cd $cwd && $args)"
+  fi
+done
+
+rm -rf "$ROOT"
+exit $failed
@@ -0,0 +1,5 @@
+#include "1.h"
+
+int square(int a) {
+  return a * a;
+}
@@ -0,0 +1 @@
+int square(int a);